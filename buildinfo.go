@@ -0,0 +1,72 @@
+package yggdrasil
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// BuildInfo describes how the running binary was built: its version, the Go
+// toolchain, the revision of the source it was built from and the versions of
+// the modules it includes, so that vulnerable builds can be identified.
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	GoVersion string   `json:"go_version"`
+	Path      string   `json:"path,omitempty"`
+	Revision  string   `json:"revision,omitempty"`
+	Time      string   `json:"time,omitempty"`
+	Modified  bool     `json:"modified,omitempty"`
+	Modules   []Module `json:"modules,omitempty"`
+}
+
+// A Module is a dependency module included in a build.
+type Module struct {
+	Path    string  `json:"path"`
+	Version string  `json:"version"`
+	Sum     string  `json:"sum,omitempty"`
+	Replace *Module `json:"replace,omitempty"`
+}
+
+// ReadBuildInfo returns the build information of the running binary. Only
+// the version and Go version are known for binaries built without module
+// support; the revision is only known for binaries built from a version
+// control checkout.
+func ReadBuildInfo() *BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return &info
+	}
+	info.Path = bi.Path
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.Time = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	for _, dep := range bi.Deps {
+		info.Modules = append(info.Modules, newModule(dep))
+	}
+	return &info
+}
+
+// newModule returns the Module describing m.
+func newModule(m *debug.Module) Module {
+	module := Module{
+		Path:    m.Path,
+		Version: m.Version,
+		Sum:     m.Sum,
+	}
+	if m.Replace != nil {
+		replace := newModule(m.Replace)
+		module.Replace = &replace
+	}
+	return module
+}
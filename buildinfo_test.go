@@ -0,0 +1,44 @@
+package yggdrasil
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewModule(t *testing.T) {
+	tests := []struct {
+		description string
+		input       *debug.Module
+		want        Module
+	}{
+		{
+			description: "module",
+			input:       &debug.Module{Path: "github.com/google/uuid", Version: "v1.1.2", Sum: "h1:abc="},
+			want:        Module{Path: "github.com/google/uuid", Version: "v1.1.2", Sum: "h1:abc="},
+		},
+		{
+			description: "replaced module",
+			input: &debug.Module{
+				Path:    "github.com/google/uuid",
+				Version: "v1.1.2",
+				Replace: &debug.Module{Path: "../uuid", Version: "(devel)"},
+			},
+			want: Module{
+				Path:    "github.com/google/uuid",
+				Version: "v1.1.2",
+				Replace: &Module{Path: "../uuid", Version: "(devel)"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := newModule(test.input)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
@@ -111,7 +111,7 @@ func GetCanonicalFacts() (*CanonicalFacts, error) {
 		facts.InsightsID = insightsID
 	}
 
-	machineID, err := readFile("/etc/machine-id")
+	machineID, err := readMachineID()
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +128,7 @@ func GetCanonicalFacts() (*CanonicalFacts, error) {
 		facts.BIOSUUID = BIOSUUID
 	}
 
-	facts.SubscriptionManagerID, err = readCert("/etc/pki/consumer/cert.pem")
+	facts.SubscriptionManagerID, err = readSubscriptionManagerID()
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package yggdrasil
+
+// readMachineID returns the content of /etc/machine-id.
+func readMachineID() (string, error) {
+	return readFile("/etc/machine-id")
+}
+
+// readSubscriptionManagerID returns the subject CN of the consumer
+// certificate of subscription-manager.
+func readSubscriptionManagerID() (string, error) {
+	return readCert("/etc/pki/consumer/cert.pem")
+}
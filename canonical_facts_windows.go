@@ -0,0 +1,22 @@
+package yggdrasil
+
+import (
+	"golang.org/x/sys/windows/registry"
+)
+
+// readMachineID returns the machine GUID Windows generates at installation.
+func readMachineID() (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Cryptography`, registry.QUERY_VALUE|registry.WOW64_64KEY)
+	if err != nil {
+		return "", err
+	}
+	defer k.Close()
+	id, _, err := k.GetStringValue("MachineGuid")
+	return id, err
+}
+
+// readSubscriptionManagerID returns an empty ID: subscription-manager does
+// not run on Windows.
+func readSubscriptionManagerID() (string, error) {
+	return "", nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	"github.com/redhatinsights/yggdrasil/internal/secrets"
+	"github.com/urfave/cli/v2"
+)
+
+// adminClient is a client of the admin API a running yggd serves on a unix
+// socket.
+type adminClient struct {
+	client *http.Client
+	token  string
+}
+
+// secretStore returns the store of secrets sealed by the backend given with
+// --secrets-backend.
+func secretStore(c *cli.Context) (*secrets.Store, error) {
+	backend, err := secrets.NewBackend(c.String("secrets-backend"))
+	if err != nil {
+		return nil, err
+	}
+	return secrets.NewStore(secrets.DefaultPath(), backend), nil
+}
+
+// newAdminClient returns a client of the admin API at the socket given with
+// --admin-socket, authenticating with the token in --admin-token-file, if
+// set.
+func newAdminClient(c *cli.Context) (*adminClient, error) {
+	path := c.String("admin-socket")
+	if path == "" {
+		return nil, fmt.Errorf("missing --admin-socket or YGG_ADMIN_SOCKET")
+	}
+
+	var token string
+	if file := c.String("admin-token-file"); strings.HasPrefix(file, secrets.ReferencePrefix) {
+		store, err := secretStore(c)
+		if err != nil {
+			return nil, err
+		}
+		token, err = store.Resolve(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read admin token: %w", err)
+		}
+	} else if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read admin token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	return &adminClient{
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return ipc.DialContext(ctx, path)
+				},
+			},
+		},
+		token: token,
+	}, nil
+}
+
+// do sends a request with method to path, with in encoded as JSON as its
+// body if not nil, and decodes the JSON response into out if not nil. If in
+// is an io.Reader, it is sent as is. If out is an io.Writer, the response is
+// copied to it as is.
+func (a *adminClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if r, ok := in.(io.Reader); ok {
+		body = r
+	} else if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("cannot marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://localhost"+path, body)
+	if err != nil {
+		return fmt.Errorf("cannot create request: %w", err)
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%v", res.Status)
+		}
+		return fmt.Errorf("%v", e.Error)
+	}
+	if w, ok := out.(io.Writer); ok {
+		if _, err := io.Copy(w, res.Body); err != nil {
+			return fmt.Errorf("cannot read response: %w", err)
+		}
+	} else if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return fmt.Errorf("cannot decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+// showMessageState prints the delivery state of the message with the given
+// ID, waiting up to wait for the worker to respond to it or its delivery to
+// fail. It returns an error if delivery failed.
+func showMessageState(client *adminClient, messageID string, wait time.Duration) error {
+	path := "/v1/messages/" + url.PathEscape(messageID)
+	if wait > 0 {
+		client.client.Timeout += wait
+		path += "?" + url.Values{"wait": []string{string(yggdrasil.MessageStateResponded) + "," + string(yggdrasil.MessageStateFailed)}, "timeout": []string{wait.String()}}.Encode()
+	}
+	var status struct {
+		MessageID string                 `json:"message_id"`
+		Directive string                 `json:"directive"`
+		State     yggdrasil.MessageState `json:"state"`
+		Error     string                 `json:"error"`
+		Responses []string               `json:"responses"`
+		Updated   time.Time              `json:"updated"`
+	}
+	if err := client.do(http.MethodGet, path, nil, &status); err != nil {
+		return cli.Exit(fmt.Errorf("cannot get message state: %w", err), 1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MESSAGE ID\tDIRECTIVE\tSTATE\tUPDATED\tRESPONSES")
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", status.MessageID, status.Directive, status.State, status.Updated.Format(time.RFC3339), strings.Join(status.Responses, ","))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if status.State == yggdrasil.MessageStateFailed {
+		return cli.Exit(fmt.Errorf("delivery failed: %v", status.Error), 1)
+	}
+	return nil
+}
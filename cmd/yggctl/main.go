@@ -1,15 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
 
 	"github.com/google/uuid"
 	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/grants"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	"github.com/redhatinsights/yggdrasil/internal/logging"
+	"github.com/redhatinsights/yggdrasil/internal/secrets"
+	"github.com/redhatinsights/yggdrasil/internal/signing"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
 	"github.com/urfave/cli/v2"
 )
 
@@ -30,6 +45,27 @@ func main() {
 			Name:   "generate-markdown",
 			Hidden: !DeveloperBuild,
 		},
+		&cli.StringFlag{
+			Name:    "socket-addr",
+			Usage:   "Connect to " + yggdrasil.ShortName + "d on `SOCKET`",
+			EnvVars: []string{"YGG_SOCKET_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-socket",
+			Usage:   "Connect to the admin API of " + yggdrasil.ShortName + "d on `PATH`",
+			EnvVars: []string{"YGG_ADMIN_SOCKET"},
+		},
+		&cli.StringFlag{
+			Name:    "admin-token-file",
+			Usage:   "Authenticate to the admin API with the token read from `FILE`, or the secret NAME if set to \"secret:NAME\"",
+			EnvVars: []string{"YGG_ADMIN_TOKEN_FILE"},
+		},
+		&cli.StringFlag{
+			Name:    "secrets-backend",
+			Usage:   "Seal and unseal secrets with `BACKEND` (\"key-file\" or \"tpm2\")",
+			EnvVars: []string{"YGG_SECRETS_BACKEND"},
+			Value:   secrets.BackendKeyFile,
+		},
 	}
 
 	app.Commands = []*cli.Command{
@@ -66,6 +102,10 @@ func main() {
 							Required: true,
 							Usage:    "set directive to `STRING`",
 						},
+						&cli.StringFlag{
+							Name:  "sign-key",
+							Usage: "sign the message with the Ed25519 private key in `FILE`",
+						},
 					},
 					Action: func(c *cli.Context) error {
 						var metadata map[string]string
@@ -77,6 +117,10 @@ func main() {
 						if err != nil {
 							return cli.Exit(fmt.Errorf("cannot marshal message: %w", err), 1)
 						}
+						data, err = signMessage(data, c.String("sign-key"))
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
 
 						fmt.Println(string(data))
 
@@ -105,12 +149,20 @@ func main() {
 							Required: true,
 							Usage:    "set message type to `STRING`",
 						},
+						&cli.StringFlag{
+							Name:  "sign-key",
+							Usage: "sign the message with the Ed25519 private key in `FILE`",
+						},
 					},
 					Action: func(c *cli.Context) error {
 						data, err := generateMessage(c.String("type"), c.String("response-to"), "", c.Args().First(), nil, c.Int("version"))
 						if err != nil {
 							return cli.Exit(fmt.Errorf("cannot marshal message: %w", err), 1)
 						}
+						data, err = signMessage(data, c.String("sign-key"))
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
 
 						fmt.Println(string(data))
 
@@ -119,6 +171,757 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:      "pause",
+			Usage:     "Stop dispatching data for a directive.",
+			UsageText: "pause DIRECTIVE",
+			Description: `Data received for a paused directive is queued until the
+directive is resumed.`,
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.Exit("missing DIRECTIVE argument", 1)
+				}
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				if err := client.do(http.MethodPost, "/v1/directives/"+url.PathEscape(c.Args().First())+"/pause", nil, nil); err != nil {
+					return cli.Exit(fmt.Errorf("cannot pause directive: %w", err), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "resume",
+			Usage:     "Resume dispatching data for a paused directive.",
+			UsageText: "resume DIRECTIVE",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.Exit("missing DIRECTIVE argument", 1)
+				}
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				if err := client.do(http.MethodPost, "/v1/directives/"+url.PathEscape(c.Args().First())+"/resume", nil, nil); err != nil {
+					return cli.Exit(fmt.Errorf("cannot resume directive: %w", err), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "Show the last error of each subsystem, and the startup precondition yggd is waiting for, if any.",
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				var status struct {
+					Errors     map[string]yggdrasil.SubsystemError `json:"errors"`
+					WaitingFor string                              `json:"waiting_for"`
+				}
+				if err := client.do(http.MethodGet, "/v1/status", nil, &status); err != nil {
+					return cli.Exit(fmt.Errorf("cannot get status: %w", err), 1)
+				}
+
+				if status.WaitingFor != "" {
+					fmt.Printf("waiting for %v before connecting\n", status.WaitingFor)
+				}
+
+				if len(status.Errors) == 0 {
+					fmt.Println("no errors recorded")
+					return nil
+				}
+				subsystems := make([]string, 0, len(status.Errors))
+				for subsystem := range status.Errors {
+					subsystems = append(subsystems, subsystem)
+				}
+				sort.Strings(subsystems)
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "SUBSYSTEM\tTIME\tCOUNT\tLAST ERROR")
+				for _, subsystem := range subsystems {
+					e := status.Errors[subsystem]
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", subsystem, e.Time.Format(time.RFC3339), e.Count, e.Message)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:      "log-level",
+			Usage:     "Change the log level of yggd.",
+			UsageText: "log-level [--subsystem SUBSYSTEM] LEVEL",
+			Description: `Without --subsystem, the default log level of yggd and its
+workers is changed. With --subsystem, only the messages of that subsystem of yggd
+(dispatcher, transport or http) are logged at LEVEL; a LEVEL of "default" makes
+the subsystem log at the default level again.`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "subsystem",
+					Usage: "Change the log level of `SUBSYSTEM` only",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.Exit("missing LEVEL argument", 1)
+				}
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				req := map[string]string{"level": c.Args().First(), "subsystem": c.String("subsystem")}
+				if err := client.do(http.MethodPut, "/v1/log-level", req, nil); err != nil {
+					return cli.Exit(fmt.Errorf("cannot set log level: %w", err), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "dump-logs",
+			Usage:     "Show the recent log messages yggd keeps in memory.",
+			UsageText: "dump-logs [--output FILE]",
+			Description: `yggd keeps its recent log messages at every level, whatever
+its log level, compressed in memory. They are written to standard output, or to
+FILE as a Zstandard stream with --output.`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Write the compressed messages to `FILE`",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				var dump bytes.Buffer
+				if err := client.do(http.MethodGet, "/v1/logs", nil, &dump); err != nil {
+					return cli.Exit(fmt.Errorf("cannot dump logs: %w", err), 1)
+				}
+				if file := c.String("output"); file != "" {
+					if err := ioutil.WriteFile(file, dump.Bytes(), 0600); err != nil {
+						return cli.Exit(fmt.Errorf("cannot write logs: %w", err), 1)
+					}
+					return nil
+				}
+				if err := logging.Decompress(os.Stdout, &dump); err != nil {
+					return cli.Exit(fmt.Errorf("cannot dump logs: %w", err), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "support-bundle",
+			Usage:     "Collect diagnostics of yggd into an archive for support.",
+			UsageText: "support-bundle [--output FILE] [--upload]",
+			Description: `The bundle, a gzip compressed tar archive, holds the
+configuration of yggd and the worker manifests, with secrets redacted, its recent
+log messages, status, queues and metrics, the state of the message journal and
+spool, and the results of health checks. It is written to FILE, by default
+yggdrasil-support-TIME.tar.gz in the current directory. With --upload, yggd
+uploads the bundle through the data plane instead, under its --upload-url, and
+the URL of the bundle is printed.`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Write the bundle to `FILE`",
+				},
+				&cli.BoolFlag{
+					Name:  "upload",
+					Usage: "Upload the bundle through the data plane",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				// Collecting and uploading the bundle may take a while.
+				client.client.Timeout = 5 * time.Minute
+
+				if c.Bool("upload") {
+					var ref yggdrasil.ContentReference
+					if err := client.do(http.MethodPost, "/v1/support-bundle", nil, &ref); err != nil {
+						return cli.Exit(fmt.Errorf("cannot upload support bundle: %w", err), 1)
+					}
+					fmt.Printf("uploaded support bundle to %v (%v)\n", ref.URL, ref.Checksum)
+					return nil
+				}
+
+				file := c.String("output")
+				if file == "" {
+					file = "yggdrasil-support-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+				}
+				var bundle bytes.Buffer
+				if err := client.do(http.MethodGet, "/v1/support-bundle", nil, &bundle); err != nil {
+					return cli.Exit(fmt.Errorf("cannot collect support bundle: %w", err), 1)
+				}
+				if err := ioutil.WriteFile(file, bundle.Bytes(), 0600); err != nil {
+					return cli.Exit(fmt.Errorf("cannot write support bundle: %w", err), 1)
+				}
+				fmt.Printf("wrote support bundle to %v\n", file)
+				return nil
+			},
+		},
+		{
+			Name:      "trace",
+			Usage:     "Record a timeline of yggd activity.",
+			UsageText: "trace [--duration DURATION] [--output FILE]",
+			Description: `yggd records its dispatches, publishes, worker calls and
+reconnects for DURATION. The timeline is written to standard output, or to FILE
+with --output, in the Chrome trace event format, which chrome://tracing and
+Perfetto load.`,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:    "duration",
+					Aliases: []string{"d"},
+					Value:   10 * time.Second,
+					Usage:   "Record for `DURATION`",
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Write the trace to `FILE`",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				duration := c.Duration("duration")
+				client.client.Timeout += duration
+				var trace bytes.Buffer
+				path := "/v1/trace?" + url.Values{"duration": []string{duration.String()}}.Encode()
+				if err := client.do(http.MethodGet, path, nil, &trace); err != nil {
+					return cli.Exit(fmt.Errorf("cannot record trace: %w", err), 1)
+				}
+				if file := c.String("output"); file != "" {
+					if err := ioutil.WriteFile(file, trace.Bytes(), 0600); err != nil {
+						return cli.Exit(fmt.Errorf("cannot write trace: %w", err), 1)
+					}
+					return nil
+				}
+				if _, err := trace.WriteTo(os.Stdout); err != nil {
+					return cli.Exit(fmt.Errorf("cannot write trace: %w", err), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "facts",
+			Usage: "Show the canonical and additional facts yggd publishes.",
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				var facts json.RawMessage
+				if err := client.do(http.MethodGet, "/v1/facts", nil, &facts); err != nil {
+					return cli.Exit(fmt.Errorf("cannot get facts: %w", err), 1)
+				}
+				var out bytes.Buffer
+				if err := json.Indent(&out, facts, "", "  "); err != nil {
+					return cli.Exit(fmt.Errorf("cannot format facts: %w", err), 1)
+				}
+				fmt.Println(out.String())
+				return nil
+			},
+		},
+		{
+			Name:      "tags",
+			Usage:     "Show or change the tags yggd publishes.",
+			UsageText: "tags [--set KEY=VALUE]... [--unset KEY]...",
+			Description: `Without flags, the published tags are shown along with the
+tags of each scope: the locally configured tags, the tags assigned by the server
+and the tags derived by workers. --set and --unset change the locally configured
+tags, which take precedence over the other scopes.`,
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "set",
+					Usage: "Set the local tag `KEY=VALUE`",
+				},
+				&cli.StringSliceFlag{
+					Name:  "unset",
+					Usage: "Remove the local tag `KEY`",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				if c.IsSet("set") || c.IsSet("unset") {
+					req := struct {
+						Set   map[string]string `json:"set,omitempty"`
+						Unset []string          `json:"unset,omitempty"`
+					}{
+						Set:   make(map[string]string),
+						Unset: c.StringSlice("unset"),
+					}
+					for _, s := range c.StringSlice("set") {
+						kv := strings.SplitN(s, "=", 2)
+						if len(kv) != 2 || kv[0] == "" {
+							return cli.Exit(fmt.Errorf("invalid value for set: %v", s), 1)
+						}
+						req.Set[kv[0]] = kv[1]
+					}
+					if err := client.do(http.MethodPatch, "/v1/tags", req, nil); err != nil {
+						return cli.Exit(fmt.Errorf("cannot update tags: %w", err), 1)
+					}
+					return nil
+				}
+				var tags json.RawMessage
+				if err := client.do(http.MethodGet, "/v1/tags", nil, &tags); err != nil {
+					return cli.Exit(fmt.Errorf("cannot get tags: %w", err), 1)
+				}
+				var out bytes.Buffer
+				if err := json.Indent(&out, tags, "", "  "); err != nil {
+					return cli.Exit(fmt.Errorf("cannot format tags: %w", err), 1)
+				}
+				fmt.Println(out.String())
+				return nil
+			},
+		},
+		{
+			Name:  "buildinfo",
+			Usage: "Show how yggd was built and the versions of its workers.",
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				var info json.RawMessage
+				if err := client.do(http.MethodGet, "/v1/buildinfo", nil, &info); err != nil {
+					return cli.Exit(fmt.Errorf("cannot get build information: %w", err), 1)
+				}
+				var out bytes.Buffer
+				if err := json.Indent(&out, info, "", "  "); err != nil {
+					return cli.Exit(fmt.Errorf("cannot format build information: %w", err), 1)
+				}
+				fmt.Println(out.String())
+				return nil
+			},
+		},
+		{
+			Name:  "connect",
+			Usage: "Connect the transport of yggd started disconnected.",
+			Description: `The transport stays connected, and spooled data messages
+are published, until disconnected with 'yggctl disconnect'.`,
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				client.client.Timeout = 30 * time.Second
+				if err := client.do(http.MethodPost, "/v1/transport/connect", nil, nil); err != nil {
+					return cli.Exit(fmt.Errorf("cannot connect: %w", err), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "disconnect",
+			Usage: "Disconnect the transport of yggd started disconnected.",
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				if err := client.do(http.MethodPost, "/v1/transport/disconnect", nil, nil); err != nil {
+					return cli.Exit(fmt.Errorf("cannot disconnect: %w", err), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "dispatch",
+			Usage:     "Dispatch data to a worker as if received from the server.",
+			UsageText: "dispatch --directive DIRECTIVE [--metadata JSON] [--sign-key FILE] [--wait DURATION] [FILE]",
+			Description: `The JSON content of the message is read from FILE, or from
+standard input if FILE is omitted or "-". If yggd verifies message signatures,
+the message must be signed with --sign-key, like the messages of the server.
+Responses of the worker are published, or spooled while disconnected. With
+--wait, the delivery state of the message is shown once the worker responded to
+it or its delivery failed, or after DURATION.`,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "directive",
+					Aliases:  []string{"d"},
+					Required: true,
+					Usage:    "set directive to `STRING`",
+				},
+				&cli.StringFlag{
+					Name:    "metadata",
+					Aliases: []string{"m"},
+					Value:   "{}",
+					Usage:   "set metadata to `JSON`",
+				},
+				&cli.StringFlag{
+					Name:  "sign-key",
+					Usage: "sign the message with the Ed25519 private key in `FILE`",
+				},
+				&cli.DurationFlag{
+					Name:  "wait",
+					Usage: "Wait up to `DURATION` for the worker to respond",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				var metadata map[string]string
+				if err := json.Unmarshal([]byte(c.String("metadata")), &metadata); err != nil {
+					return cli.Exit(fmt.Errorf("cannot unmarshal metadata: %w", err), 1)
+				}
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				var content []byte
+				if name := c.Args().First(); name == "" || name == "-" {
+					content, err = ioutil.ReadAll(os.Stdin)
+				} else {
+					content, err = ioutil.ReadFile(name)
+				}
+				if err != nil {
+					return cli.Exit(fmt.Errorf("cannot read content: %w", err), 1)
+				}
+				if !json.Valid(content) {
+					return cli.Exit("content is not valid JSON", 1)
+				}
+
+				msg, err := json.Marshal(yggdrasil.Data{
+					Type:      yggdrasil.MessageTypeData,
+					MessageID: uuid.New().String(),
+					Version:   1,
+					Sent:      time.Now(),
+					Directive: c.String("directive"),
+					Metadata:  metadata,
+					Content:   content,
+				})
+				if err != nil {
+					return cli.Exit(fmt.Errorf("cannot marshal message: %w", err), 1)
+				}
+				msg, err = signMessage(msg, c.String("sign-key"))
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+
+				var dispatched struct {
+					MessageID string `json:"message_id"`
+				}
+				if err := client.do(http.MethodPost, "/v1/dispatch", bytes.NewReader(msg), &dispatched); err != nil {
+					return cli.Exit(fmt.Errorf("cannot dispatch data: %w", err), 1)
+				}
+				if !c.IsSet("wait") {
+					fmt.Println(dispatched.MessageID)
+					return nil
+				}
+				return showMessageState(client, dispatched.MessageID, c.Duration("wait"))
+			},
+		},
+		{
+			Name:      "inject",
+			Usage:     "Inject messages as if received from the server.",
+			UsageText: "inject [FILE]",
+			Description: `The control and data messages, JSON documents such as those
+printed by 'yggctl generate', one after the other, are read from FILE, or from
+standard input if FILE is omitted or "-". They are handed to yggd as if received
+from the server, which requires the admin API and yggd running with
+--transport none.`,
+			Action: func(c *cli.Context) error {
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				var in io.Reader = os.Stdin
+				if name := c.Args().First(); name != "" && name != "-" {
+					f, err := os.Open(name)
+					if err != nil {
+						return cli.Exit(fmt.Errorf("cannot read messages: %w", err), 1)
+					}
+					defer f.Close()
+					in = f
+				}
+				var res struct {
+					Injected int `json:"injected"`
+				}
+				if err := client.do(http.MethodPost, "/v1/inject", in, &res); err != nil {
+					return cli.Exit(fmt.Errorf("cannot inject messages: %w", err), 1)
+				}
+				fmt.Printf("injected %v messages\n", res.Injected)
+				return nil
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "Replay the messages received in a recording.",
+			UsageText: "replay [--speed FACTOR] [FILE]",
+			Description: `The recording, written by yggd with --record-file or
+--mirror-file, is read from FILE, or from standard input if FILE is omitted or
+"-". The messages received in it are handed to yggd as if received from the
+server again, spaced as they were received, which requires the admin API and
+yggd running with --transport none. Messages recorded with --mirror-file are
+replayed with their secrets redacted.`,
+			Flags: []cli.Flag{
+				&cli.Float64Flag{
+					Name:  "speed",
+					Usage: "Replay the messages `FACTOR` times faster than recorded (0 replays them without delay)",
+					Value: 1,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Float64("speed") < 0 {
+					return cli.Exit(fmt.Errorf("invalid value for speed: %v", c.Float64("speed")), 1)
+				}
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				var in io.Reader = os.Stdin
+				if name := c.Args().First(); name != "" && name != "-" {
+					f, err := os.Open(name)
+					if err != nil {
+						return cli.Exit(fmt.Errorf("cannot read recording: %w", err), 1)
+					}
+					defer f.Close()
+					in = f
+				}
+				var res struct {
+					Injected int `json:"injected"`
+				}
+				// The replay takes as long as the recording lasted.
+				client.client.Timeout = 0
+				path := fmt.Sprintf("/v1/replay?speed=%v", c.Float64("speed"))
+				if err := client.do(http.MethodPost, path, in, &res); err != nil {
+					return cli.Exit(fmt.Errorf("cannot replay messages: %w", err), 1)
+				}
+				fmt.Printf("replayed %v messages\n", res.Injected)
+				return nil
+			},
+		},
+		{
+			Name:      "message",
+			Usage:     "Show the delivery state of a received message.",
+			UsageText: "message [--wait DURATION] MESSAGE_ID",
+			Description: `A message received from the server, or dispatched with
+'yggctl dispatch', is accepted, delivered to its worker, responded to by the
+worker, or failed. With --wait, the state is shown once the worker responded
+to the message or its delivery failed, or after DURATION.`,
+			Flags: []cli.Flag{
+				&cli.DurationFlag{
+					Name:  "wait",
+					Usage: "Wait up to `DURATION` for the worker to respond",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return cli.Exit("missing MESSAGE_ID argument", 1)
+				}
+				client, err := newAdminClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				return showMessageState(client, c.Args().First(), c.Duration("wait"))
+			},
+		},
+		{
+			Name:  "grant",
+			Usage: "Temporarily allow a restricted directive.",
+			Description: `Messages for a directive restricted with --restricted-directive are
+only dispatched while a grant allows them. A grant is signed by an approver
+with an Ed25519 private key, whose public key is trusted by yggd, and applied
+to yggd, possibly on another machine.`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "sign",
+					Usage:     "Sign a grant and print it.",
+					UsageText: "grant sign --key FILE [--duration DURATION] [--client-id ID] DIRECTIVE",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "key",
+							Required: true,
+							Usage:    "sign with the PEM encoded Ed25519 private key in `FILE`",
+						},
+						&cli.DurationFlag{
+							Name:  "duration",
+							Value: 15 * time.Minute,
+							Usage: "allow the directive for `DURATION` from now",
+						},
+						&cli.StringFlag{
+							Name:  "client-id",
+							Usage: "only allow the directive on the client with `ID`",
+						},
+						&cli.StringFlag{
+							Name:  "approver",
+							Value: os.Getenv("USER"),
+							Usage: "record `NAME` as the approver of the grant",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.Exit("missing DIRECTIVE argument", 1)
+						}
+						key, err := grants.ReadPrivateKey(c.String("key"))
+						if err != nil {
+							return cli.Exit(fmt.Errorf("cannot read key: %w", err), 1)
+						}
+						now := time.Now()
+						signed, err := grants.Sign(grants.Grant{
+							Directive: c.Args().First(),
+							ClientID:  c.String("client-id"),
+							Approver:  c.String("approver"),
+							NotBefore: now,
+							NotAfter:  now.Add(c.Duration("duration")),
+						}, key)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						data, err := json.Marshal(signed)
+						if err != nil {
+							return cli.Exit(fmt.Errorf("cannot marshal grant: %w", err), 1)
+						}
+						fmt.Println(string(data))
+						return nil
+					},
+				},
+				{
+					Name:      "apply",
+					Usage:     "Apply a signed grant, read from FILE or standard input.",
+					UsageText: "grant apply [FILE]",
+					Action: func(c *cli.Context) error {
+						var data []byte
+						var err error
+						if name := c.Args().First(); name == "" || name == "-" {
+							data, err = ioutil.ReadAll(os.Stdin)
+						} else {
+							data, err = ioutil.ReadFile(name)
+						}
+						if err != nil {
+							return cli.Exit(fmt.Errorf("cannot read grant: %w", err), 1)
+						}
+						var signed grants.Signed
+						if err := json.Unmarshal(data, &signed); err != nil {
+							return cli.Exit(fmt.Errorf("cannot unmarshal grant: %w", err), 1)
+						}
+
+						client, closeConn, err := dispatcherClient(c)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						defer closeConn()
+
+						ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+						defer cancel()
+						if _, err := client.Grant(ctx, &pb.GrantRequest{Grant: signed.Grant, Signature: signed.Signature}); err != nil {
+							return cli.Exit(fmt.Errorf("cannot apply grant: %w", err), 1)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "secret",
+			Usage: "Manage the encrypted secrets referenced from the configuration.",
+			Description: `Configuration values in the form "secret:NAME", such as
+broker-password, are replaced by the secret NAME. Secrets are encrypted with a
+key bound to this machine, derived from a key file or held by its TPM
+depending on --secrets-backend.`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "set",
+					Usage:     "Store a secret, reading its value from standard input.",
+					UsageText: "secret set NAME",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.Exit("missing NAME argument", 1)
+						}
+						data, err := ioutil.ReadAll(os.Stdin)
+						if err != nil {
+							return cli.Exit(fmt.Errorf("cannot read secret: %w", err), 1)
+						}
+						value := strings.TrimRight(string(data), "\r\n")
+						store, err := secretStore(c)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						if err := store.Set(c.Args().First(), value); err != nil {
+							return cli.Exit(fmt.Errorf("cannot set secret: %w", err), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "delete",
+					Usage:     "Remove a secret.",
+					UsageText: "secret delete NAME",
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.Exit("missing NAME argument", 1)
+						}
+						store, err := secretStore(c)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						if err := store.Delete(c.Args().First()); err != nil {
+							return cli.Exit(fmt.Errorf("cannot delete secret: %w", err), 1)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List the names of the stored secrets.",
+					Action: func(c *cli.Context) error {
+						store, err := secretStore(c)
+						if err != nil {
+							return cli.Exit(err, 1)
+						}
+						names, err := store.List()
+						if err != nil {
+							return cli.Exit(fmt.Errorf("cannot list secrets: %w", err), 1)
+						}
+						for _, name := range names {
+							fmt.Println(name)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:      "echo-test",
+			Usage:     "Send a test message through a worker and report stage latencies.",
+			UsageText: "echo-test [DIRECTIVE]",
+			Description: `The test message is sent to the worker handling DIRECTIVE (by
+default "echo"), and its response is published by the transport. The result is
+also published to the server as an "echo-test" event.`,
+			Action: func(c *cli.Context) error {
+				client, closeConn, err := dispatcherClient(c)
+				if err != nil {
+					return cli.Exit(err, 1)
+				}
+				defer closeConn()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+				defer cancel()
+				r, err := client.EchoTest(ctx, &pb.DirectiveRequest{Directive: c.Args().First()})
+				if err != nil {
+					return cli.Exit(fmt.Errorf("cannot run echo test: %w", err), 1)
+				}
+
+				for _, stage := range []string{"dispatch", "response", "publish", "total"} {
+					if latency, prs := r.GetLatencies()[stage]; prs {
+						fmt.Printf("%-10v %vms\n", stage+":", latency)
+					}
+				}
+				if !r.GetSuccess() {
+					return cli.Exit(fmt.Errorf("echo test failed: %v", r.GetError()), 1)
+				}
+				return nil
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -146,6 +949,21 @@ func main() {
 	}
 }
 
+// dispatcherClient dials the dispatcher socket of a running yggd, returning a
+// client and a function that closes the connection.
+func dispatcherClient(c *cli.Context) (pb.DispatcherClient, func() error, error) {
+	addr := c.String("socket-addr")
+	if addr == "" {
+		return nil, nil, fmt.Errorf("missing --socket-addr or YGG_SOCKET_ADDR")
+	}
+	conn, err := ipc.Dial(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot dial dispatcher: %w", err)
+	}
+
+	return pb.NewDispatcherClient(conn), conn.Close, nil
+}
+
 func generateMessage(messageType, responseTo, directive, content string, metadata map[string]string, version int) ([]byte, error) {
 	msg := map[string]interface{}{
 		"type":        messageType,
@@ -180,3 +998,20 @@ func generateMessage(messageType, responseTo, directive, content string, metadat
 
 	return data, nil
 }
+
+// signMessage returns data, the encoding of a message, signed with the
+// Ed25519 private key in keyFile, or as is if keyFile is empty.
+func signMessage(data []byte, keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		return data, nil
+	}
+	key, err := grants.ReadPrivateKey(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key: %w", err)
+	}
+	data, err = json.Marshal(signing.Sign(data, key))
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal signed message: %w", err)
+	}
+	return data, nil
+}
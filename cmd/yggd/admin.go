@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/grants"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/logging"
+	"github.com/redhatinsights/yggdrasil/internal/secrets"
+	"github.com/redhatinsights/yggdrasil/internal/tracing"
+)
+
+// adminStatus is the response of the "/v1/status" admin endpoint.
+type adminStatus struct {
+	ClientID    string                              `json:"client_id"`
+	Dispatchers map[string]map[string]string        `json:"dispatchers"`
+	Workers     map[string]yggdrasil.WorkerInfo     `json:"workers"`
+	Errors      map[string]yggdrasil.SubsystemError `json:"errors"`
+
+	// WaitingFor is the startup precondition yggd is waiting for before
+	// connecting, if any.
+	WaitingFor string `json:"waiting_for,omitempty"`
+}
+
+// adminFacts is the response of the "/v1/facts" admin endpoint.
+type adminFacts struct {
+	CanonicalFacts *yggdrasil.CanonicalFacts `json:"canonical_facts"`
+	Facts          map[string]interface{}    `json:"facts"`
+}
+
+// adminBuildInfo is the response of the "/v1/buildinfo" admin endpoint.
+type adminBuildInfo struct {
+	Build   *yggdrasil.BuildInfo     `json:"build"`
+	Workers map[string]workerVersion `json:"workers"`
+}
+
+// workerVersion is the version a worker registered and the version of its
+// manifest, if it was started from one.
+type workerVersion struct {
+	Version         string `json:"version,omitempty"`
+	ManifestVersion string `json:"manifest_version,omitempty"`
+}
+
+// queueStatus describes the occupancy of a queue.
+type queueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+// adminQueues is the response of the "/v1/queues" admin endpoint.
+type adminQueues struct {
+	Send          queueStatus            `json:"send"`
+	SendHigh      queueStatus            `json:"send_high"`
+	SendLow       queueStatus            `json:"send_low"`
+	Receive       queueStatus            `json:"receive"`
+	Ordered       map[string]queueStatus `json:"ordered"`
+	Paused        map[string]int         `json:"paused"`
+	HeldTransfers int                    `json:"held_transfers"`
+	Deferred      int                    `json:"deferred"`
+	Scheduled     int                    `json:"scheduled"`
+	Concurrency   int                    `json:"concurrency"`
+}
+
+// adminLogLevel is the request and response of the "/v1/log-level" admin
+// endpoint.
+type adminLogLevel struct {
+	Level      string            `json:"level"`
+	Subsystem  string            `json:"subsystem,omitempty"`
+	Subsystems map[string]string `json:"subsystems,omitempty"`
+}
+
+// adminTags is the response of the "/v1/tags" admin endpoint.
+type adminTags struct {
+	Tags   map[string]string            `json:"tags"`
+	Scopes map[string]map[string]string `json:"scopes"`
+}
+
+// adminTagsUpdate is the request of the "/v1/tags" admin endpoint, changing
+// the locally configured tags.
+type adminTagsUpdate struct {
+	Set   map[string]string `json:"set,omitempty"`
+	Unset []string          `json:"unset,omitempty"`
+}
+
+// adminDispatched is the response of the "/v1/dispatch" admin endpoint.
+type adminDispatched struct {
+	MessageID string `json:"message_id"`
+}
+
+// adminInjected is the response of the "/v1/inject" admin endpoint.
+type adminInjected struct {
+	Injected int `json:"injected"`
+}
+
+// newAdminHandler returns the handler of the admin API. It exposes:
+//
+//	GET  /v1/health                         liveness check
+//	GET  /v1/status                         dispatchers, workers and last errors
+//	GET  /v1/facts                          canonical and additional facts
+//	GET  /v1/buildinfo                      build information of yggd and worker versions
+//	GET  /v1/queues                         depth of the dispatch queues
+//	POST /v1/directives/DIRECTIVE/pause     pause dispatch to DIRECTIVE
+//	POST /v1/directives/DIRECTIVE/resume    resume dispatch to DIRECTIVE
+//	POST /v1/dispatch                       dispatch a data message as if received from the
+//	                                        server, signed if message keys are trusted
+//	POST /v1/transport/connect              connect the transport of yggd started disconnected
+//	POST /v1/transport/disconnect           disconnect the transport of yggd started disconnected
+//	GET  /v1/messages/ID                    delivery state of a received message
+//	GET  /v1/messages/ID?wait=STATE[,STATE]&timeout=DURATION
+//	                                        the same, once the message is in one of the
+//	                                        states or after DURATION
+//	GET  /v1/log-level                      current log level and subsystem overrides
+//	PUT  /v1/log-level                      change the log level of yggd and its workers,
+//	                                        or of a single subsystem
+//	POST /v1/grants                         allow a restricted directive with a signed grant
+//	GET  /v1/logs                           recent log messages at every level, as a
+//	                                        Zstandard stream
+//	GET  /v1/tags                           published tags and the tags of each scope
+//	PATCH /v1/tags                          set or unset locally configured tags
+//	GET  /v1/trace?duration=DURATION        record a timeline of activity for DURATION, as
+//	                                        Chrome trace events
+//	POST /v1/inject                         inject messages as if received from the server,
+//	                                        with --transport none
+//	POST /v1/replay?speed=FACTOR            replay the messages received in a recording,
+//	                                        with --transport none
+//	GET  /v1/support-bundle                 support bundle, as a gzip compressed tar archive
+//	POST /v1/support-bundle                 upload a support bundle through the data plane
+//	GET  /debug/vars                        metrics
+//
+// If token is not empty, requests must carry it as a bearer token.
+func newAdminHandler(d *dispatcher, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		dispatchers, workers := d.connectionStatus()
+		writeJSON(w, http.StatusOK, adminStatus{
+			ClientID:    ClientID,
+			Dispatchers: dispatchers,
+			Workers:     workers,
+			Errors:      lasterror.All(),
+			WaitingFor:  currentPrecondition(),
+		})
+	})
+	mux.HandleFunc("/v1/facts", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		canonicalFacts, facts, err := collectFacts()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, adminFacts{CanonicalFacts: canonicalFacts, Facts: facts})
+	})
+	mux.HandleFunc("/v1/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		res := adminBuildInfo{Build: yggdrasil.ReadBuildInfo(), Workers: map[string]workerVersion{}}
+		for directive, info := range d.makeWorkersMap() {
+			res.Workers[directive] = workerVersion{Version: info.Version, ManifestVersion: info.ManifestVersion}
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+	mux.HandleFunc("/v1/queues", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, d.queueStatus())
+	})
+	mux.HandleFunc("/v1/directives/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		fields := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/directives/"), "/")
+		if len(fields) != 2 || fields[0] == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+			return
+		}
+		var err error
+		switch fields[1] {
+		case "pause":
+			err = d.pause(fields[0])
+		case "resume":
+			err = d.resume(fields[0])
+		default:
+			writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/v1/dispatch", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("cannot read request: %w", err))
+			return
+		}
+		if len(payload) > maxMessageSize {
+			writeError(w, http.StatusRequestEntityTooLarge, errMessageTooLarge)
+			return
+		}
+		messageID, err := d.dispatchLocal(payload)
+		switch err {
+		case nil:
+			writeJSON(w, http.StatusOK, adminDispatched{MessageID: messageID})
+		case errUntrustedDispatch:
+			writeError(w, http.StatusForbidden, err)
+		case errSendQueueFull:
+			writeError(w, http.StatusServiceUnavailable, err)
+		default:
+			writeError(w, http.StatusBadRequest, err)
+		}
+	})
+	mux.HandleFunc("/v1/transport/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		var err error
+		switch strings.TrimPrefix(r.URL.Path, "/v1/transport/") {
+		case "connect":
+			err = connectTransport()
+		case "disconnect":
+			err = disconnectTransport()
+		default:
+			writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+			return
+		}
+		if err == errNotDisconnected {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/v1/messages/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/v1/messages/")
+		var states []yggdrasil.MessageState
+		if wait := r.URL.Query().Get("wait"); wait != "" {
+			for _, state := range strings.Split(wait, ",") {
+				states = append(states, yggdrasil.MessageState(state))
+			}
+		}
+		timeout, err := parseMessageWait(r.URL.Query().Get("timeout"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		status, ok := d.correlations.wait(ctx, id, states...)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("message %v is not tracked", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("/v1/log-level", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			var req adminLogLevel
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("cannot decode request: %w", err))
+				return
+			}
+			if err := d.setLogLevel(req.Subsystem, req.Level); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		res := adminLogLevel{Level: logging.Level().String(), Subsystems: map[string]string{}}
+		for subsystem, level := range logging.SubsystemLevels() {
+			res.Subsystems[subsystem] = level.String()
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+	mux.HandleFunc("/v1/grants", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		var signed grants.Signed
+		if err := json.NewDecoder(r.Body).Decode(&signed); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("cannot decode request: %w", err))
+			return
+		}
+		if err := d.applyGrant(signed); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/v1/logs", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		ring := logging.CurrentRing()
+		if ring == nil {
+			writeError(w, http.StatusNotFound, errNoLogRing)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zstd")
+		if err := ring.Dump(w); err != nil {
+			log.Errorf("cannot dump logs: %v", err)
+		}
+	})
+	mux.HandleFunc("/v1/tags", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+			return
+		}
+		if r.Method == http.MethodPatch {
+			var req adminTagsUpdate
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("cannot decode request: %w", err))
+				return
+			}
+			if err := d.tags.updateLocal(req.Set, req.Unset); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			log.Infof("updated local tags: set %v, unset %v", req.Set, req.Unset)
+			d.sendDispatchersMap()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		scopes, err := d.tags.scopes()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		merged, err := d.tags.merged()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, adminTags{Tags: merged, Scopes: scopes})
+	})
+	mux.HandleFunc("/v1/trace", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		duration, err := parseTraceDuration(r.URL.Query().Get("duration"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		recording, err := tracing.Start()
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		log.Infof("recording trace for %v", duration)
+		timer := time.NewTimer(duration)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+		recording.Stop()
+		if dropped := recording.Dropped(); dropped > 0 {
+			log.Warnf("trace dropped %v events over the limit of %v", dropped, tracing.MaxEvents)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := recording.WriteChrome(w); err != nil {
+			log.Errorf("cannot write trace: %v", err)
+		}
+	})
+	mux.HandleFunc("/v1/inject", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		n, err := injectMessages(r.Body)
+		if err == errNotSimulating {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("injected %v messages: %w", n, err))
+			return
+		}
+		writeJSON(w, http.StatusOK, adminInjected{Injected: n})
+	})
+	mux.HandleFunc("/v1/replay", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		speed := 1.0
+		if s := r.URL.Query().Get("speed"); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || v < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid speed: %v", s))
+				return
+			}
+			speed = v
+		}
+		n, err := replayRecording(r.Body, speed)
+		if err == errNotSimulating {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("replayed %v messages: %w", n, err))
+			return
+		}
+		writeJSON(w, http.StatusOK, adminInjected{Injected: n})
+	})
+	mux.HandleFunc("/v1/support-bundle", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			ref, err := d.uploadSupportBundle()
+			if err == errNoUploadURL {
+				writeError(w, http.StatusConflict, err)
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err)
+				return
+			}
+			log.Infof("uploaded support bundle to %v", ref.URL)
+			writeJSON(w, http.StatusOK, ref)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		if err := d.writeSupportBundle(w); err != nil {
+			log.Errorf("cannot write support bundle: %v", err)
+		}
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+				return
+			}
+		}
+		log.Debugf("admin request: %v %v", r.Method, r.URL.Path)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowMethods responds with an error unless the method of r is one of
+// methods, reporting whether it is.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+	return false
+}
+
+// writeJSON responds with status and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("cannot encode admin response: %v", err)
+	}
+}
+
+// writeError responds with status and err in the "error" field of a JSON
+// object.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// queueStatus returns the occupancy of the dispatcher's queues.
+func (d *dispatcher) queueStatus() adminQueues {
+	d.RLock()
+	defer d.RUnlock()
+
+	q := adminQueues{
+		Send:          queueStatus{Depth: len(d.sendQ), Capacity: cap(d.sendQ)},
+		SendHigh:      queueStatus{Depth: len(d.sendHighQ), Capacity: cap(d.sendHighQ)},
+		SendLow:       queueStatus{Depth: len(d.sendLowQ), Capacity: cap(d.sendLowQ)},
+		Receive:       queueStatus{Depth: len(d.recvQ), Capacity: cap(d.recvQ)},
+		Ordered:       make(map[string]queueStatus, len(d.queues)),
+		Paused:        make(map[string]int, len(d.paused)),
+		HeldTransfers: len(d.heldTransfers),
+		Deferred:      d.deferred,
+		Scheduled:     d.scheduler.len(),
+		Concurrency:   d.concurrency.len(),
+	}
+	for handler, c := range d.queues {
+		q.Ordered[handler] = queueStatus{Depth: len(c.data), Capacity: cap(c.data)}
+	}
+	for directive, held := range d.paused {
+		q.Paused[directive] = len(held)
+	}
+	return q
+}
+
+// readAdminToken reads the admin API token from the file at path, or from
+// secretStore if path refers to a secret. An empty path disables
+// authentication.
+func readAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(path, secrets.ReferencePrefix) {
+		token, err := secretStore.Resolve(path)
+		if err != nil {
+			return "", err
+		}
+		if token == "" {
+			return "", fmt.Errorf("secret %v is empty", strings.TrimPrefix(path, secrets.ReferencePrefix))
+		}
+		return token, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("file %v is empty", path)
+	}
+	return token, nil
+}
+
+// listenAdmin listens on the socket at path, which only its owner may
+// connect to (on Windows, a named pipe only the local system and
+// administrators may connect to).
+func listenAdmin(path string) (net.Listener, error) {
+	return ipc.ListenPrivate(path)
+}
+
+// serveAdmin starts serving the admin API for d on the socket at path,
+// authenticating requests with the token read from tokenFile, if set.
+func serveAdmin(path, tokenFile string, d *dispatcher) error {
+	token, err := readAdminToken(tokenFile)
+	if err != nil {
+		return fmt.Errorf("cannot read token: %w", err)
+	}
+	l, err := listenAdmin(path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Infof("serving admin API on socket: %v", path)
+		if err := http.Serve(l, newAdminHandler(d, token)); err != nil {
+			log.Errorf("cannot serve admin API: %v", err)
+		}
+	}()
+	return nil
+}
+
+const (
+	// defaultTraceDuration is how long a trace is recorded for when the
+	// request does not say.
+	defaultTraceDuration = 10 * time.Second
+
+	// maxTraceDuration is the longest a trace may be recorded for.
+	maxTraceDuration = 5 * time.Minute
+)
+
+const (
+	// defaultMessageWait is how long a message state request waits for the
+	// requested states when it does not say.
+	defaultMessageWait = 30 * time.Second
+
+	// maxMessageWait is the longest a message state request may wait for.
+	maxMessageWait = 5 * time.Minute
+)
+
+// parseMessageWait parses the "timeout" parameter of a message state request,
+// defaulting to defaultMessageWait when empty.
+func parseMessageWait(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultMessageWait, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse timeout: %w", err)
+	}
+	if timeout < 0 || timeout > maxMessageWait {
+		return 0, fmt.Errorf("timeout %v is not between 0 and %v", timeout, maxMessageWait)
+	}
+	return timeout, nil
+}
+
+// parseTraceDuration parses the "duration" parameter of a trace request,
+// defaulting to defaultTraceDuration when empty.
+func parseTraceDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultTraceDuration, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse duration: %w", err)
+	}
+	if duration <= 0 || duration > maxTraceDuration {
+		return 0, fmt.Errorf("duration %v is not between 0 and %v", duration, maxTraceDuration)
+	}
+	return duration, nil
+}
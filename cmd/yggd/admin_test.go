@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+	handler := newAdminHandler(d, "secret")
+
+	tests := []struct {
+		description string
+		method      string
+		path        string
+		token       string
+		body        string
+		want        int
+	}{
+		{description: "missing token", method: http.MethodGet, path: "/v1/health", want: http.StatusUnauthorized},
+		{description: "wrong token", method: http.MethodGet, path: "/v1/health", token: "guess", want: http.StatusUnauthorized},
+		{description: "health", method: http.MethodGet, path: "/v1/health", token: "secret", want: http.StatusOK},
+		{description: "queues", method: http.MethodGet, path: "/v1/queues", token: "secret", want: http.StatusOK},
+		{description: "method not allowed", method: http.MethodPost, path: "/v1/status", token: "secret", want: http.StatusMethodNotAllowed},
+		{description: "unknown action", method: http.MethodPost, path: "/v1/directives/echo/stop", token: "secret", want: http.StatusNotFound},
+		{description: "buildinfo", method: http.MethodGet, path: "/v1/buildinfo", token: "secret", want: http.StatusOK},
+		{description: "facts method not allowed", method: http.MethodPost, path: "/v1/facts", token: "secret", want: http.StatusMethodNotAllowed},
+		{description: "pause", method: http.MethodPost, path: "/v1/directives/echo/pause", token: "secret", want: http.StatusNoContent},
+		{description: "resume", method: http.MethodPost, path: "/v1/directives/echo/resume", token: "secret", want: http.StatusNoContent},
+		{description: "resume not paused", method: http.MethodPost, path: "/v1/directives/echo/resume", token: "secret", want: http.StatusConflict},
+		{description: "connect not disconnected", method: http.MethodPost, path: "/v1/transport/connect", token: "secret", want: http.StatusConflict},
+		{description: "unknown transport action", method: http.MethodPost, path: "/v1/transport/stop", token: "secret", want: http.StatusNotFound},
+		{description: "dispatch", method: http.MethodPost, path: "/v1/dispatch", token: "secret", body: `{"directive":"echo","content":{}}`, want: http.StatusOK},
+		{description: "dispatch without directive", method: http.MethodPost, path: "/v1/dispatch", token: "secret", body: `{"content":{}}`, want: http.StatusBadRequest},
+		{description: "dispatch method not allowed", method: http.MethodGet, path: "/v1/dispatch", token: "secret", want: http.StatusMethodNotAllowed},
+		{description: "invalid log level", method: http.MethodPut, path: "/v1/log-level", token: "secret", body: `{"level":"loud"}`, want: http.StatusBadRequest},
+		{description: "unknown message", method: http.MethodGet, path: "/v1/messages/unknown", token: "secret", want: http.StatusNotFound},
+		{description: "invalid message wait", method: http.MethodGet, path: "/v1/messages/unknown?wait=responded&timeout=1h", token: "secret", want: http.StatusBadRequest},
+		{description: "tags", method: http.MethodGet, path: "/v1/tags", token: "secret", want: http.StatusOK},
+		{description: "invalid tags update", method: http.MethodPatch, path: "/v1/tags", token: "secret", body: `{"set":`, want: http.StatusBadRequest},
+		{description: "trace", method: http.MethodGet, path: "/v1/trace?duration=1ms", token: "secret", want: http.StatusOK},
+		{description: "trace invalid duration", method: http.MethodGet, path: "/v1/trace?duration=1h", token: "secret", want: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.want {
+				t.Errorf("%v != %v: %v", w.Code, test.want, w.Body.String())
+			}
+		})
+	}
+}
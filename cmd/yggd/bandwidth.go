@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// transferPollInterval is the interval at which held bulk transfers check
+// whether they are permitted again.
+const transferPollInterval = time.Minute
+
+// A transferWindow is a daily period of time, given as offsets from midnight
+// local time. A window whose end is before its start spans midnight.
+type transferWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// parseTransferWindow parses a window in the form "HH:MM-HH:MM".
+func parseTransferWindow(value string) (transferWindow, error) {
+	fields := strings.Split(value, "-")
+	if len(fields) != 2 {
+		return transferWindow{}, fmt.Errorf("invalid transfer window %q: expected HH:MM-HH:MM", value)
+	}
+	start, err := parseTimeOfDay(fields[0])
+	if err != nil {
+		return transferWindow{}, fmt.Errorf("invalid transfer window %q: %w", value, err)
+	}
+	end, err := parseTimeOfDay(fields[1])
+	if err != nil {
+		return transferWindow{}, fmt.Errorf("invalid transfer window %q: %w", value, err)
+	}
+	if start == end {
+		return transferWindow{}, fmt.Errorf("invalid transfer window %q: empty window", value)
+	}
+	return transferWindow{start: start, end: end}, nil
+}
+
+// parseTimeOfDay parses a time of day in the form "HH:MM", returning its
+// offset from midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse time of day %q", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether t falls within the window.
+func (w transferWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// A transferPolicy decides when bulk data transfers, the download and upload
+// of detached message content, are permitted. Sites with expensive links can
+// restrict them to a set of daily windows, and to times when the network
+// connection is not metered. Control messages and data carried in the
+// messages themselves are not affected.
+type transferPolicy struct {
+	windows      []transferWindow
+	avoidMetered bool
+
+	// metered reports whether the current network connection is metered.
+	metered func() (bool, error)
+}
+
+// newTransferPolicy creates a transferPolicy from a list of windows in the form
+// "HH:MM-HH:MM". If avoidMetered is true, transfers are also held while
+// NetworkManager reports the connection as metered. A nil policy is returned
+// when transfers are never restricted.
+func newTransferPolicy(windows []string, avoidMetered bool) (*transferPolicy, error) {
+	if len(windows) == 0 && !avoidMetered {
+		return nil, nil
+	}
+	p := &transferPolicy{
+		avoidMetered: avoidMetered,
+		metered:      networkManagerMetered,
+	}
+	for _, value := range windows {
+		w, err := parseTransferWindow(value)
+		if err != nil {
+			return nil, err
+		}
+		p.windows = append(p.windows, w)
+	}
+	return p, nil
+}
+
+// allowed reports whether bulk transfers are permitted at now. A nil policy
+// always permits transfers. If the metered state cannot be determined, the
+// connection is assumed to be unmetered.
+func (p *transferPolicy) allowed(now time.Time) bool {
+	if p == nil {
+		return true
+	}
+	if len(p.windows) > 0 {
+		inWindow := false
+		for _, w := range p.windows {
+			if w.contains(now) {
+				inWindow = true
+				break
+			}
+		}
+		if !inWindow {
+			return false
+		}
+	}
+	if p.avoidMetered {
+		metered, err := p.metered()
+		if err != nil {
+			log.Debugf("cannot determine whether connection is metered: %v", err)
+			return true
+		}
+		if metered {
+			return false
+		}
+	}
+	return true
+}
+
+// wait blocks until bulk transfers are permitted. Transfers are checked again
+// every transferPollInterval, and as soon as the network state changes.
+func (p *transferPolicy) wait() {
+	for {
+		changed := network.changed()
+		if p.allowed(time.Now()) {
+			return
+		}
+		select {
+		case <-time.After(transferPollInterval):
+		case <-changed:
+		}
+	}
+}
+
+// networkManagerMetered asks NetworkManager whether the primary network
+// connection is metered, either explicitly or by its guess (for example for
+// cellular connections).
+func networkManagerMetered() (bool, error) {
+	output, err := exec.Command("busctl", "get-property",
+		"org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager",
+		"Metered").Output()
+	if err != nil {
+		return false, fmt.Errorf("cannot get metered property: %w", err)
+	}
+	return parseMetered(string(output))
+}
+
+// parseMetered parses the NMMetered value printed by busctl, such as "u 4".
+func parseMetered(output string) (bool, error) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 || fields[0] != "u" {
+		return false, fmt.Errorf("unexpected metered property value %q", output)
+	}
+	value, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return false, fmt.Errorf("unexpected metered property value %q", output)
+	}
+	// NM_METERED_YES and NM_METERED_GUESS_YES
+	return value == 1 || value == 3, nil
+}
+
+// holdTransfer holds data if delivering it requires a bulk transfer that is
+// not permitted now, reporting whether it did. Held data is sent back to the
+// dispatch queue, in the order it was received, once transfers are permitted.
+func (d *dispatcher) holdTransfer(w worker, data yggdrasil.Data) bool {
+	if !(w.detachedContent || isContentReference(data)) || d.transfers.allowed(time.Now()) {
+		return false
+	}
+
+	d.Lock()
+	d.heldTransfers = append(d.heldTransfers, data)
+	waiting := d.transfersWaiting
+	d.transfersWaiting = true
+	d.Unlock()
+	log.Debugf("holding message %v until bulk transfers are permitted", data.MessageID)
+
+	if !waiting {
+		go func() {
+			d.transfers.wait()
+
+			d.Lock()
+			held := d.heldTransfers
+			d.heldTransfers = nil
+			d.transfersWaiting = false
+			d.Unlock()
+
+			log.Infof("bulk transfers permitted; dispatching %v held messages", len(held))
+			for _, data := range held {
+				d.sendLanes()[priorityLane(data)] <- data
+			}
+		}()
+	}
+
+	return true
+}
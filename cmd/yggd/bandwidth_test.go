@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTransferWindow(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        transferWindow
+		wantError   bool
+	}{
+		{
+			description: "same day",
+			input:       "09:00-17:30",
+			want:        transferWindow{start: 9 * time.Hour, end: 17*time.Hour + 30*time.Minute},
+		},
+		{
+			description: "spans midnight",
+			input:       "22:00-06:00",
+			want:        transferWindow{start: 22 * time.Hour, end: 6 * time.Hour},
+		},
+		{
+			description: "missing end",
+			input:       "22:00",
+			wantError:   true,
+		},
+		{
+			description: "invalid time",
+			input:       "25:00-06:00",
+			wantError:   true,
+		},
+		{
+			description: "empty window",
+			input:       "06:00-06:00",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseTransferWindow(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want, cmp.AllowUnexported(transferWindow{})) {
+					t.Errorf("%#v != %#v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTransferPolicyAllowed(t *testing.T) {
+	night := transferWindow{start: 22 * time.Hour, end: 6 * time.Hour}
+	at := func(hour, min int) time.Time {
+		return time.Date(2021, 6, 1, hour, min, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		description string
+		policy      *transferPolicy
+		now         time.Time
+		want        bool
+	}{
+		{
+			description: "no policy",
+			policy:      nil,
+			now:         at(12, 0),
+			want:        true,
+		},
+		{
+			description: "before midnight",
+			policy:      &transferPolicy{windows: []transferWindow{night}},
+			now:         at(23, 0),
+			want:        true,
+		},
+		{
+			description: "after midnight",
+			policy:      &transferPolicy{windows: []transferWindow{night}},
+			now:         at(5, 59),
+			want:        true,
+		},
+		{
+			description: "outside window",
+			policy:      &transferPolicy{windows: []transferWindow{night}},
+			now:         at(6, 0),
+			want:        false,
+		},
+		{
+			description: "metered",
+			policy: &transferPolicy{
+				windows:      []transferWindow{night},
+				avoidMetered: true,
+				metered:      func() (bool, error) { return true, nil },
+			},
+			now:  at(23, 0),
+			want: false,
+		},
+		{
+			description: "metered state unknown",
+			policy: &transferPolicy{
+				avoidMetered: true,
+				metered:      func() (bool, error) { return false, fmt.Errorf("no NetworkManager") },
+			},
+			now:  at(12, 0),
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := test.policy.allowed(test.now)
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMetered(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{input: "u 0\n", want: false},
+		{input: "u 1\n", want: true},
+		{input: "u 2\n", want: false},
+		{input: "u 3\n", want: true},
+		{input: "u 4\n", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := parseMetered(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
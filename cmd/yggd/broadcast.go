@@ -0,0 +1,158 @@
+package main
+
+import (
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// maxBroadcasts is the number of broadcast messages whose deliveries are
+// tracked at once; the oldest is forgotten beyond it.
+const maxBroadcasts = 1000
+
+// broadcastMetrics holds the number of broadcast messages "received", and the
+// number of copies "delivered" to and "failed" for workers.
+var broadcastMetrics = expvar.NewMap("broadcasts")
+
+// A broadcast tracks the delivery of the copies of a broadcast message, by
+// handler: "delivered", or the error delivery failed with. Handlers without a
+// result are still pending.
+type broadcast struct {
+	handlers []string
+	results  map[string]string
+}
+
+// broadcastTracker holds the broadcast messages whose copies are not all
+// delivered yet, by message ID.
+type broadcastTracker struct {
+	lock       sync.Mutex
+	broadcasts map[string]*broadcast
+	order      []string
+}
+
+func newBroadcastTracker() *broadcastTracker {
+	return &broadcastTracker{broadcasts: make(map[string]*broadcast)}
+}
+
+// start tracks the delivery of the message with the given ID to handlers.
+func (t *broadcastTracker) start(messageID string, handlers []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, prs := t.broadcasts[messageID]; !prs {
+		t.order = append(t.order, messageID)
+	}
+	t.broadcasts[messageID] = &broadcast{handlers: handlers, results: make(map[string]string, len(handlers))}
+	for len(t.order) > maxBroadcasts {
+		delete(t.broadcasts, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// done records the result of the delivery of the message with the given ID
+// to handler. Once all copies have a result, the broadcast is forgotten and
+// its results are returned. Only the first result of a handler counts.
+func (t *broadcastTracker) done(messageID, handler string, err error) (map[string]string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	b, prs := t.broadcasts[messageID]
+	if !prs {
+		return nil, false
+	}
+	if _, prs := b.results[handler]; prs {
+		return nil, false
+	}
+	if err != nil {
+		b.results[handler] = err.Error()
+	} else {
+		b.results[handler] = "delivered"
+	}
+	if len(b.results) < len(b.handlers) {
+		return nil, false
+	}
+
+	delete(t.broadcasts, messageID)
+	for i, id := range t.order {
+		if id == messageID {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+	return b.results, true
+}
+
+// broadcastData returns a copy of data, a message for the broadcast
+// directive, for each registered worker, with the handler of the worker as
+// directive and the broadcast directive in its MetadataKeyRoutedFrom metadata
+// key. The deliveries of the copies are tracked until each of them is
+// delivered or failed.
+func (d *dispatcher) broadcastData(data yggdrasil.Data) []yggdrasil.Data {
+	d.RLock()
+	handlers := make([]string, 0, len(d.workers))
+	for handler, w := range d.workers {
+		if !w.namespace {
+			handlers = append(handlers, handler)
+		}
+	}
+	d.RUnlock()
+	sort.Strings(handlers)
+
+	broadcastMetrics.Add("received", 1)
+	log.Infof("broadcasting message %v to workers %v", data.MessageID, handlers)
+	d.broadcasts.start(data.MessageID, handlers)
+	if len(handlers) == 0 {
+		go d.broadcastCompleted(data.MessageID, map[string]string{})
+		return nil
+	}
+
+	copies := make([]yggdrasil.Data, 0, len(handlers))
+	for _, handler := range handlers {
+		c := data
+		c.Directive = handler
+		c.Metadata = make(map[string]string, len(data.Metadata)+1)
+		for k, v := range data.Metadata {
+			c.Metadata[k] = v
+		}
+		c.Metadata[yggdrasil.MetadataKeyRoutedFrom] = yggdrasil.DirectiveBroadcast
+		copies = append(copies, c)
+	}
+	return copies
+}
+
+// broadcastDone records the result of the delivery of data, if it is a copy
+// of a broadcast message, publishing a "broadcast-completed" event once all
+// copies have a result.
+func (d *dispatcher) broadcastDone(data yggdrasil.Data, err error) {
+	if data.Metadata[yggdrasil.MetadataKeyRoutedFrom] != yggdrasil.DirectiveBroadcast {
+		return
+	}
+	if err != nil {
+		broadcastMetrics.Add("failed", 1)
+	} else {
+		broadcastMetrics.Add("delivered", 1)
+	}
+	if results, ok := d.broadcasts.done(data.MessageID, data.Directive, err); ok {
+		d.broadcastCompleted(data.MessageID, results)
+	}
+}
+
+// broadcastCompleted publishes a "broadcast-completed" event for the
+// broadcast message with the given ID, detailing the result of each worker.
+func (d *dispatcher) broadcastCompleted(messageID string, results map[string]string) {
+	log.Infof("broadcast of message %v completed: %v", messageID, results)
+	d.events <- yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: messageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameBroadcastCompleted),
+		Details:    results,
+	}
+}
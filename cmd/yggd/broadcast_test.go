@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestBroadcast(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+	echo := registerFakeWorker(t, d, "echo", false)
+	other := registerFakeWorker(t, d, "other", false)
+	go d.sendData(1)
+	defer close(d.sendQ)
+
+	d.sendQ <- yggdrasil.Data{MessageID: "1", Directive: yggdrasil.DirectiveBroadcast}
+
+	waitFor(t, func() bool { return len(echo.messages()) == 1 && len(other.messages()) == 1 })
+	select {
+	case e := <-d.events:
+		want := map[string]string{"echo": "delivered", "other": "delivered"}
+		if e.Content != string(yggdrasil.EventNameBroadcastCompleted) || e.ResponseTo != "1" {
+			t.Errorf("event %v in response to %v, want broadcast-completed in response to 1", e.Content, e.ResponseTo)
+		}
+		if !cmp.Equal(e.Details, want) {
+			t.Errorf("%#v", cmp.Diff(e.Details, want))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out")
+	}
+}
+
+func TestBroadcastTracker(t *testing.T) {
+	tr := newBroadcastTracker()
+	tr.start("1", []string{"a", "b"})
+
+	if _, ok := tr.done("1", "a", nil); ok {
+		t.Error("completed with b pending")
+	}
+	if _, ok := tr.done("1", "a", fmt.Errorf("late")); ok {
+		t.Error("completed by a second result of a")
+	}
+	got, ok := tr.done("1", "b", fmt.Errorf("cannot send message"))
+	if !ok {
+		t.Fatal("not completed")
+	}
+	want := map[string]string{"a": "delivered", "b": "cannot send message"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+	if _, ok := tr.done("1", "b", nil); ok {
+		t.Error("completed again")
+	}
+}
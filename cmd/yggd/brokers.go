@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// brokerSchemes are the URI schemes of the brokers the MQTT client can
+// connect to.
+var brokerSchemes = map[string]bool{
+	"tcp": true, "mqtt": true,
+	"ssl": true, "tls": true, "mqtts": true, "mqtt+ssl": true, "tcps": true,
+	"ws": true, "wss": true,
+}
+
+// brokersFile returns the path of the file in which the brokers set by the
+// "set-brokers" command are persisted. When present, they are used in place
+// of the configured brokers.
+func brokersFile() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "brokers")
+}
+
+// parseBrokers parses a comma-separated list of broker URIs, such as
+// "ssl://broker1:8883,ssl://broker2:8883".
+func parseBrokers(list string) ([]string, error) {
+	var brokers []string
+	for _, broker := range strings.Split(list, ",") {
+		broker = strings.TrimSpace(broker)
+		if broker == "" {
+			continue
+		}
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker %q: %w", broker, err)
+		}
+		if !brokerSchemes[u.Scheme] || u.Host == "" {
+			return nil, fmt.Errorf("invalid broker %q: expected SCHEME://HOST[:PORT]", broker)
+		}
+		// Certificate verification can only be disabled locally.
+		if u.Query().Get(transport.BrokerParamInsecureSkipVerify) != "" {
+			return nil, fmt.Errorf("invalid broker %q: %v cannot be set by the server", broker, transport.BrokerParamInsecureSkipVerify)
+		}
+		if err := checkBrokerTLS(u, nil); err != nil {
+			return nil, fmt.Errorf("invalid broker %q: %w", broker, err)
+		}
+		brokers = append(brokers, broker)
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("missing brokers")
+	}
+	return brokers, nil
+}
+
+// checkBrokerTLS checks that the TLS settings in the query parameters of the
+// broker u, if any, can be applied to base, and warns if they disable
+// certificate verification.
+func checkBrokerTLS(u *url.URL, base *tls.Config) error {
+	config, _, err := transport.BrokerTLSConfig(u, base)
+	if err != nil {
+		return err
+	}
+	if config != nil && config.InsecureSkipVerify {
+		log.Warnf("certificate verification disabled for broker %v", u.Host)
+	}
+	return nil
+}
+
+// readBrokers reads the brokers persisted at path, one per line. It returns
+// nil if the file does not exist.
+func readBrokers(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+	return parseBrokers(strings.Replace(string(data), "\n", ",", -1))
+}
+
+// writeBrokers replaces the file at path with brokers, one per line.
+func writeBrokers(path string, brokers []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(brokers, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot replace file: %w", err)
+	}
+	return nil
+}
+
+// migrateBrokers persists brokers, so that they are used from then on,
+// including after a restart, and reconnects t to them. If t cannot connect to
+// brokers, the previously persisted brokers are restored and t is reconnected
+// to its previous brokers.
+func migrateBrokers(t transport.Transport, brokers []string) error {
+	s, ok := t.(transport.BrokerSetter)
+	if !ok {
+		return fmt.Errorf("transport does not support changing brokers")
+	}
+	previous := s.Brokers()
+
+	path := brokersFile()
+	persisted, err := readBrokers(path)
+	if err != nil {
+		return fmt.Errorf("cannot read persisted brokers: %w", err)
+	}
+	if err := writeBrokers(path, brokers); err != nil {
+		return fmt.Errorf("cannot persist brokers: %w", err)
+	}
+
+	log.Infof("migrating to brokers %v; reconnecting", brokers)
+	t.Disconnect(500)
+	err = s.SetBrokers(brokers)
+	if err == nil {
+		err = t.Start()
+	}
+	if err == nil {
+		log.Infof("connected to brokers %v", brokers)
+		return nil
+	}
+
+	log.Errorf("cannot connect to brokers %v; reconnecting to %v: %v", brokers, previous, err)
+	if persisted == nil {
+		if err := os.Remove(path); err != nil {
+			log.Errorf("cannot remove persisted brokers: %v", err)
+		}
+	} else if err := writeBrokers(path, persisted); err != nil {
+		log.Errorf("cannot restore persisted brokers: %v", err)
+	}
+	t.Disconnect(0)
+	if err := s.SetBrokers(previous); err != nil {
+		return fmt.Errorf("cannot restore brokers: %w", err)
+	}
+	if err := t.Start(); err != nil {
+		lasterror.Set(lasterror.Transport, err)
+		return fmt.Errorf("cannot reconnect to previous brokers: %w", err)
+	}
+	return fmt.Errorf("cannot connect to brokers: %w", err)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseBrokers(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []string
+		wantError   bool
+	}{
+		{
+			description: "multiple brokers",
+			input:       "ssl://broker1.example.com:8883, wss://broker2.example.com/mqtt",
+			want:        []string{"ssl://broker1.example.com:8883", "wss://broker2.example.com/mqtt"},
+		},
+		{
+			description: "empty",
+			input:       " , ",
+			wantError:   true,
+		},
+		{
+			description: "missing scheme",
+			input:       "broker.example.com:8883",
+			wantError:   true,
+		},
+		{
+			description: "unsupported scheme",
+			input:       "http://broker.example.com",
+			wantError:   true,
+		},
+		{
+			description: "server name override",
+			input:       "ssl://10.0.0.1:8883?tls-server-name=broker.example.com",
+			want:        []string{"ssl://10.0.0.1:8883?tls-server-name=broker.example.com"},
+		},
+		{
+			description: "insecure skip verify",
+			input:       "ssl://broker.example.com:8883?tls-insecure-skip-verify=true",
+			wantError:   true,
+		},
+		{
+			description: "unknown TLS setting",
+			input:       "ssl://broker.example.com:8883?tls-version=1.0",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseBrokers(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadWriteBrokers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-brokers-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "brokers")
+
+	got, err := readBrokers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("expected no brokers, got %v", got)
+	}
+
+	want := []string{"ssl://broker1.example.com:8883", "ssl://broker2.example.com:8883"}
+	if err := writeBrokers(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err = readBrokers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// brokerSRVServices are the SRV services looked up to discover brokers, in
+// order of preference, with the scheme of the broker URIs built from their
+// records.
+var brokerSRVServices = []struct {
+	service string
+	scheme  string
+}{
+	{"mqtts", "ssl"},
+	{"mqtt", "tcp"},
+}
+
+// A srvLookupFunc looks up SRV records, like net.LookupSRV.
+type srvLookupFunc func(service, proto, name string) (string, []*net.SRV, error)
+
+// resolveBrokerSRV returns the URIs of the brokers advertised by the
+// "_mqtts._tcp" SRV records of domain or, if there are none, by its
+// "_mqtt._tcp" records. The URIs are ordered by priority, and randomly by
+// weight among records of equal priority.
+func resolveBrokerSRV(lookup srvLookupFunc, domain string) ([]string, error) {
+	var errs []string
+	for _, s := range brokerSRVServices {
+		_, records, err := lookup(s.service, "tcp", domain)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		brokers := make([]string, 0, len(records))
+		for _, r := range records {
+			host := strings.TrimSuffix(r.Target, ".")
+			if host == "" {
+				// A target of "." means the service is not available.
+				continue
+			}
+			brokers = append(brokers, fmt.Sprintf("%v://%v", s.scheme, net.JoinHostPort(host, fmt.Sprint(r.Port))))
+		}
+		if len(brokers) > 0 {
+			return brokers, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("cannot look up broker SRV records of %v: %v", domain, strings.Join(errs, "; "))
+	}
+	return nil, fmt.Errorf("no broker SRV records found for %v", domain)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolveBrokerSRV(t *testing.T) {
+	tests := []struct {
+		description string
+		input       map[string][]*net.SRV
+		want        []string
+		wantError   bool
+	}{
+		{
+			description: "mqtts preferred",
+			input: map[string][]*net.SRV{
+				"mqtts": {{Target: "b1.example.com.", Port: 8883}, {Target: "b2.example.com.", Port: 8883}},
+				"mqtt":  {{Target: "b3.example.com.", Port: 1883}},
+			},
+			want: []string{"ssl://b1.example.com:8883", "ssl://b2.example.com:8883"},
+		},
+		{
+			description: "mqtt fallback",
+			input: map[string][]*net.SRV{
+				"mqtt": {{Target: "b3.example.com.", Port: 1883}},
+			},
+			want: []string{"tcp://b3.example.com:1883"},
+		},
+		{
+			description: "service unavailable",
+			input: map[string][]*net.SRV{
+				"mqtts": {{Target: ".", Port: 0}},
+			},
+			wantError: true,
+		},
+		{
+			description: "no records",
+			input:       map[string][]*net.SRV{},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			lookup := func(service, proto, name string) (string, []*net.SRV, error) {
+				records, prs := test.input[service]
+				if !prs {
+					return "", nil, fmt.Errorf("no such host")
+				}
+				return "", records, nil
+			}
+
+			got, err := resolveBrokerSRV(lookup, "example.com")
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%#v != %#v", got, test.want)
+				}
+			}
+		})
+	}
+}
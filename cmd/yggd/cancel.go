@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// maxInflightMessages is the number of dispatched messages whose directive is
+// remembered so that they can be cancelled.
+const maxInflightMessages = 10000
+
+// cancel aborts the processing of the message with the given ID and returns
+// the directive it was destined to. A message that is still held by the
+// dispatcher is dropped; a message already dispatched is cancelled by the
+// worker handling it.
+func (d *dispatcher) cancel(messageID string) (string, error) {
+	if messageID == "" {
+		return "", fmt.Errorf("missing message ID")
+	}
+
+	if directive, ok := d.drop(messageID); ok {
+		log.Infof("dropped held message %v for directive %v", messageID, directive)
+		return directive, nil
+	}
+
+	if directive, ok := d.concurrency.drop(messageID); ok {
+		log.Infof("dropped message %v waiting for directive %v", messageID, directive)
+		return directive, nil
+	}
+
+	directive := d.inflight.get(messageID)
+	if directive == "" {
+		return "", fmt.Errorf("message %v is not in flight", messageID)
+	}
+
+	w, prs := d.lookupWorker(directive)
+	if !prs {
+		return directive, fmt.Errorf("no worker registered for directive %v", directive)
+	}
+
+	if err := cancelWorkerMessage(w, messageID); err != nil {
+		return directive, err
+	}
+	d.inflight.remove(messageID)
+	d.concurrency.release(messageID)
+	d.expiries.Stop(messageID)
+	log.Infof("cancelled message %v for directive %v", messageID, directive)
+
+	return directive, nil
+}
+
+// drop removes the message with the given ID from the data held for paused
+// directives or for bulk transfers, returning its directive and whether it
+// was found.
+func (d *dispatcher) drop(messageID string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	for directive, held := range d.paused {
+		for i, data := range held {
+			if data.MessageID == messageID {
+				d.paused[directive] = append(held[:i], held[i+1:]...)
+				return directive, true
+			}
+		}
+	}
+	for i, data := range d.heldTransfers {
+		if data.MessageID == messageID {
+			d.heldTransfers = append(d.heldTransfers[:i], d.heldTransfers[i+1:]...)
+			return data.Directive, true
+		}
+	}
+	return "", false
+}
+
+// cancelWorkerMessage calls the "Cancel" method of the worker w.
+func cancelWorkerMessage(w worker, messageID string) error {
+	conn, err := ipc.Dial(w.addr)
+	if err != nil {
+		return fmt.Errorf("cannot dial socket: %w", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewWorkerClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := c.Cancel(ctx, &pb.CancelRequest{MessageId: messageID}); err != nil {
+		return fmt.Errorf("cannot cancel message: %w", err)
+	}
+	return nil
+}
+
+// cancelEvent returns the event reporting the result of the "cancel" command
+// with the given ID.
+func cancelEvent(responseTo, messageID, directive string, err error) yggdrasil.Event {
+	event := yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: responseTo,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameCancelled),
+		Details: map[string]string{
+			"message_id": messageID,
+		},
+	}
+	if directive != "" {
+		event.Details["directive"] = directive
+	}
+	if err != nil {
+		event.Content = string(yggdrasil.EventNameCancelFailed)
+		event.Details["error"] = err.Error()
+	}
+	return event
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// concurrencyMetrics holds the number of messages that "waited" for a
+// concurrency slot, the number of messages "dropped" because too many were
+// waiting, the number of slots "timed_out" before their message was responded
+// to, and the number of messages "waiting" now.
+var concurrencyMetrics = expvar.NewMap("concurrency")
+
+// parseConcurrencyLimits parses per-directive concurrency limits in the form
+// "DIRECTIVE[=N]", where N, which defaults to 1, is the number of messages
+// that may be in flight to the directive at once.
+func parseConcurrencyLimits(values []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, value := range values {
+		fields := strings.SplitN(value, "=", 2)
+		if fields[0] == "" {
+			return nil, fmt.Errorf("invalid concurrency limit %q: expected DIRECTIVE[=N]", value)
+		}
+		n := 1
+		if len(fields) == 2 {
+			var err error
+			n, err = strconv.Atoi(fields[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid concurrency limit %q: N must be a positive integer", value)
+			}
+		}
+		limits[fields[0]] = n
+	}
+	return limits, nil
+}
+
+// A concurrencySlot is held by a message in flight to a directive with a
+// concurrency limit.
+type concurrencySlot struct {
+	directive string
+	timer     *time.Timer
+}
+
+// A concurrencyWaiter is a message waiting for a concurrency slot, to be
+// dispatched to the worker w.
+type concurrencyWaiter struct {
+	w    worker
+	data yggdrasil.Data
+}
+
+// A concurrencyLimiter bounds the number of messages in flight to each
+// directive with a concurrency limit. A message holds a slot from the time it
+// is routed until its worker responds to it, it is cancelled or its deadline
+// passes, its dispatch fails, or timeout elapses, so that a worker that never
+// responds does not stall its directive forever. Messages over the limit wait
+// in the order they were routed, and are handed to dispatch as slots are
+// released. At most maxWaiting messages wait at once, across directives; any
+// more are refused.
+type concurrencyLimiter struct {
+	lock       sync.Mutex
+	limits     map[string]int
+	timeout    time.Duration
+	maxWaiting int
+	slots      map[string]*concurrencySlot
+	active     map[string]int
+	waiting    map[string][]concurrencyWaiter
+	nwaiting   int
+	dispatch   func(worker, yggdrasil.Data)
+}
+
+// newConcurrencyLimiter creates a concurrencyLimiter applying limits, by
+// directive, holding at most maxWaiting messages over the limits and handing
+// them to dispatch once they hold a slot. A timeout of 0 never releases slots
+// by itself.
+func newConcurrencyLimiter(limits map[string]int, timeout time.Duration, maxWaiting int, dispatch func(worker, yggdrasil.Data)) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		limits:     limits,
+		timeout:    timeout,
+		maxWaiting: maxWaiting,
+		slots:      make(map[string]*concurrencySlot),
+		active:     make(map[string]int),
+		waiting:    make(map[string][]concurrencyWaiter),
+		dispatch:   dispatch,
+	}
+}
+
+// acquire takes a slot for data, reporting whether it may be dispatched now.
+// Otherwise data waits until a slot is released, and as long as earlier
+// messages for its directive are waiting, so that it does not overtake them.
+// If maxWaiting messages are already waiting, data is refused with an error.
+// Directives without a limit, data already holding a slot and everything with
+// a nil concurrencyLimiter are always allowed.
+func (c *concurrencyLimiter) acquire(w worker, data yggdrasil.Data) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	limit, prs := c.limits[data.Directive]
+	if !prs {
+		return true, nil
+	}
+	if _, held := c.slots[data.MessageID]; held {
+		return true, nil
+	}
+	if c.active[data.Directive] < limit && len(c.waiting[data.Directive]) == 0 {
+		c.take(data.Directive, data.MessageID)
+		return true, nil
+	}
+
+	if c.nwaiting >= c.maxWaiting {
+		concurrencyMetrics.Add("dropped", 1)
+		return false, fmt.Errorf("too many messages waiting for directives with a concurrency limit")
+	}
+	c.waiting[data.Directive] = append(c.waiting[data.Directive], concurrencyWaiter{w: w, data: data})
+	c.nwaiting++
+	concurrencyMetrics.Add("waited", 1)
+	log.Debugf("message %v waiting for one of %v messages in flight to directive %v", data.MessageID, limit, data.Directive)
+	return false, nil
+}
+
+// take gives a slot of directive to the message with the given ID. The caller
+// must hold the lock.
+func (c *concurrencyLimiter) take(directive, messageID string) {
+	slot := &concurrencySlot{directive: directive}
+	if c.timeout > 0 {
+		slot.timer = time.AfterFunc(c.timeout, func() {
+			c.lock.Lock()
+			current := c.slots[messageID] == slot
+			c.lock.Unlock()
+			if !current {
+				return
+			}
+			concurrencyMetrics.Add("timed_out", 1)
+			log.Warnf("no response to message %v for directive %v after %v; releasing its concurrency slot", messageID, directive, c.timeout)
+			c.release(messageID)
+		})
+	}
+	c.slots[messageID] = slot
+	c.active[directive]++
+}
+
+// release frees the slot held by the message with the given ID, if any, and
+// dispatches the next message waiting for its directive.
+func (c *concurrencyLimiter) release(messageID string) {
+	c.releaseIf(messageID, nil)
+}
+
+// releaseIf is like release, but only frees the slot if owns, when not nil,
+// reports that its directive is owned by the caller, so that a response from
+// one worker cannot free the slot of a message sent to another.
+func (c *concurrencyLimiter) releaseIf(messageID string, owns func(directive string) bool) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	slot, prs := c.slots[messageID]
+	if !prs || (owns != nil && !owns(slot.directive)) {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.slots, messageID)
+	if slot.timer != nil {
+		slot.timer.Stop()
+	}
+	c.active[slot.directive]--
+	if c.active[slot.directive] == 0 {
+		delete(c.active, slot.directive)
+	}
+
+	var next []concurrencyWaiter
+	q := c.waiting[slot.directive]
+	for len(q) > 0 && c.active[slot.directive] < c.limits[slot.directive] {
+		c.take(slot.directive, q[0].data.MessageID)
+		next = append(next, q[0])
+		q = q[1:]
+		c.nwaiting--
+	}
+	if len(q) == 0 {
+		delete(c.waiting, slot.directive)
+	} else {
+		c.waiting[slot.directive] = q
+	}
+	c.lock.Unlock()
+
+	if len(next) > 0 {
+		go func() {
+			for _, waiter := range next {
+				log.Debugf("dispatching message %v waiting for directive %v", waiter.data.MessageID, waiter.data.Directive)
+				c.dispatch(waiter.w, waiter.data)
+			}
+		}()
+	}
+}
+
+// drop removes the message with the given ID from the messages waiting for a
+// slot, returning its directive and whether it was found.
+func (c *concurrencyLimiter) drop(messageID string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for directive, q := range c.waiting {
+		for i, waiter := range q {
+			if waiter.data.MessageID != messageID {
+				continue
+			}
+			q = append(q[:i:i], q[i+1:]...)
+			c.nwaiting--
+			if len(q) == 0 {
+				delete(c.waiting, directive)
+			} else {
+				c.waiting[directive] = q
+			}
+			return directive, true
+		}
+	}
+	return "", false
+}
+
+// len returns the number of messages waiting for a slot.
+func (c *concurrencyLimiter) len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nwaiting
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestParseConcurrencyLimits(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        map[string]int
+		wantError   bool
+	}{
+		{
+			description: "default",
+			input:       []string{"echo"},
+			want:        map[string]int{"echo": 1},
+		},
+		{
+			description: "explicit",
+			input:       []string{"echo=1", "package-manager=4"},
+			want:        map[string]int{"echo": 1, "package-manager": 4},
+		},
+		{
+			description: "zero",
+			input:       []string{"echo=0"},
+			wantError:   true,
+		},
+		{
+			description: "missing directive",
+			input:       []string{"=2"},
+			wantError:   true,
+		},
+		{
+			description: "invalid",
+			input:       []string{"echo=many"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseConcurrencyLimits(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	dispatched := make(chan string, 10)
+	c := newConcurrencyLimiter(map[string]int{"echo": 2}, 0, 10, func(w worker, data yggdrasil.Data) {
+		dispatched <- data.MessageID
+	})
+
+	var acquired []string
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		ok, err := c.acquire(worker{}, yggdrasil.Data{MessageID: id, Directive: "echo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			acquired = append(acquired, id)
+		}
+	}
+	if ok, _ := c.acquire(worker{}, yggdrasil.Data{MessageID: "a", Directive: "other"}); !ok {
+		t.Error("directive without limit not allowed")
+	}
+	if want := []string{"1", "2"}; !cmp.Equal(acquired, want) {
+		t.Errorf("%#v", cmp.Diff(acquired, want))
+	}
+	if c.len() != 3 {
+		t.Errorf("waiting = %v, want 3", c.len())
+	}
+
+	if directive, ok := c.drop("4"); !ok || directive != "echo" {
+		t.Errorf("drop = %v, %v; want echo, true", directive, ok)
+	}
+	c.release("unknown")
+	c.release("1")
+	c.release("2")
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-dispatched:
+			got = append(got, id)
+		case <-time.After(time.Second):
+			t.Fatal("waiting message not dispatched")
+		}
+	}
+	sort.Strings(got)
+	if want := []string{"3", "5"}; !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+	if c.len() != 0 {
+		t.Errorf("waiting = %v, want 0", c.len())
+	}
+}
+
+func TestConcurrencyLimiterTimeout(t *testing.T) {
+	dispatched := make(chan string, 1)
+	c := newConcurrencyLimiter(map[string]int{"echo": 1}, 10*time.Millisecond, 10, func(w worker, data yggdrasil.Data) {
+		dispatched <- data.MessageID
+	})
+
+	c.acquire(worker{}, yggdrasil.Data{MessageID: "1", Directive: "echo"})
+	if ok, _ := c.acquire(worker{}, yggdrasil.Data{MessageID: "2", Directive: "echo"}); ok {
+		t.Fatal("message over the limit allowed")
+	}
+	select {
+	case id := <-dispatched:
+		if id != "2" {
+			t.Errorf("dispatched %v, want 2", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slot not released after timeout")
+	}
+	c.release("2")
+}
+
+func TestConcurrencyLimiterMaxWaiting(t *testing.T) {
+	c := newConcurrencyLimiter(map[string]int{"echo": 1}, 0, 2, func(w worker, data yggdrasil.Data) {})
+
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err := c.acquire(worker{}, yggdrasil.Data{MessageID: id, Directive: "echo"}); err != nil {
+			t.Fatalf("message %v refused: %v", id, err)
+		}
+	}
+	ok, err := c.acquire(worker{}, yggdrasil.Data{MessageID: "4", Directive: "echo"})
+	if ok || err == nil {
+		t.Errorf("acquire = %v, %v; want false and an error", ok, err)
+	}
+	if c.len() != 2 {
+		t.Errorf("waiting = %v, want 2", c.len())
+	}
+
+	c.drop("3")
+	if _, err := c.acquire(worker{}, yggdrasil.Data{MessageID: "4", Directive: "echo"}); err != nil {
+		t.Errorf("message refused after another was dropped: %v", err)
+	}
+}
+
+func TestConcurrencyLimiterReleaseIf(t *testing.T) {
+	c := newConcurrencyLimiter(map[string]int{"echo": 1}, 0, 10, func(w worker, data yggdrasil.Data) {})
+
+	c.acquire(worker{}, yggdrasil.Data{MessageID: "1", Directive: "echo"})
+	c.releaseIf("1", worker{handler: "other"}.handles)
+	if ok, _ := c.acquire(worker{}, yggdrasil.Data{MessageID: "2", Directive: "echo"}); ok {
+		t.Fatal("slot released by a worker not handling its directive")
+	}
+	c.drop("2")
+
+	c.releaseIf("1", worker{handler: "echo"}.handles)
+	if ok, _ := c.acquire(worker{}, yggdrasil.Data{MessageID: "3", Directive: "echo"}); !ok {
+		t.Error("slot not released by the worker handling its directive")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+)
+
+// runtimeConfig holds the configuration values that are applied again when
+// the configuration file is reloaded.
+type runtimeConfig struct {
+	logLevel    string
+	logLevels   []string
+	logFormat   string
+	dataHost    string
+	topicPrefix string
+	brokers     []string
+}
+
+// configProfile is the name of the configuration profile in use, if any.
+var configProfile string
+
+// configFile is the path of the configuration file in use, if any.
+var configFile string
+
+// loadRuntimeConfig reads the reloadable values from the TOML configuration
+// file, with the values of profile overlaid. Values absent from the file are
+// copied from current.
+func loadRuntimeConfig(file, profile string, current runtimeConfig) (runtimeConfig, error) {
+	config := current
+
+	inputSource, _, err := newConfigSource(file, profile)
+	if err != nil {
+		return config, err
+	}
+
+	for name, value := range map[string]*string{
+		"log-level":    &config.logLevel,
+		"log-format":   &config.logFormat,
+		"data-host":    &config.dataHost,
+		"topic-prefix": &config.topicPrefix,
+	} {
+		v, err := inputSource.String(name)
+		if err != nil {
+			return current, fmt.Errorf("cannot read %v: %w", name, err)
+		}
+		if v != "" {
+			*value = v
+		}
+	}
+
+	logLevels, err := inputSource.StringSlice("log-level-override")
+	if err != nil {
+		return current, fmt.Errorf("cannot read log-level-override: %w", err)
+	}
+	if logLevels != nil {
+		config.logLevels = logLevels
+	}
+
+	brokers, err := inputSource.StringSlice("broker")
+	if err != nil {
+		return current, fmt.Errorf("cannot read broker: %w", err)
+	}
+	if brokers != nil {
+		config.brokers = brokers
+	}
+
+	return config, nil
+}
+
+// connectionChanged reports whether any setting affecting the transport
+// connection differs between c and other.
+func (c runtimeConfig) connectionChanged(other runtimeConfig) bool {
+	if c.topicPrefix != other.topicPrefix {
+		return true
+	}
+	if len(c.brokers) != len(other.brokers) {
+		return true
+	}
+	for i := range c.brokers {
+		if c.brokers[i] != other.brokers[i] {
+			return true
+		}
+	}
+	return false
+}
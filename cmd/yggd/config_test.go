@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoadRuntimeConfig(t *testing.T) {
+	current := runtimeConfig{
+		logLevel:    "info",
+		dataHost:    "data.example.com",
+		topicPrefix: "yggdrasil",
+		brokers:     []string{"tcp://a.example.com:1883"},
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		want        runtimeConfig
+		wantChanged bool
+	}{
+		{
+			description: "unchanged",
+			input:       ``,
+			want:        current,
+		},
+		{
+			description: "log level",
+			input:       `log-level = "debug"`,
+			want: runtimeConfig{
+				logLevel:    "debug",
+				dataHost:    "data.example.com",
+				topicPrefix: "yggdrasil",
+				brokers:     []string{"tcp://a.example.com:1883"},
+			},
+		},
+		{
+			description: "brokers",
+			input:       `broker = ["tcp://b.example.com:1883", "tcp://c.example.com:1883"]`,
+			want: runtimeConfig{
+				logLevel:    "info",
+				dataHost:    "data.example.com",
+				topicPrefix: "yggdrasil",
+				brokers:     []string{"tcp://b.example.com:1883", "tcp://c.example.com:1883"},
+			},
+			wantChanged: true,
+		},
+		{
+			description: "topic prefix",
+			input:       `topic-prefix = "test"`,
+			want: runtimeConfig{
+				logLevel:    "info",
+				dataHost:    "data.example.com",
+				topicPrefix: "test",
+				brokers:     []string{"tcp://a.example.com:1883"},
+			},
+			wantChanged: true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "yggd-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			file := filepath.Join(dir, string(rune('a'+i))+".toml")
+			if err := ioutil.WriteFile(file, []byte(test.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadRuntimeConfig(file, "", current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(runtimeConfig{})) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+			if got.connectionChanged(current) != test.wantChanged {
+				t.Errorf("connectionChanged() != %v", test.wantChanged)
+			}
+		})
+	}
+}
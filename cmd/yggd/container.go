@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// containerWorkerSuffix is the file name suffix of worker directory entries
+// that describe a worker run from a container image rather than a worker
+// executable.
+const containerWorkerSuffix = "worker.container"
+
+// containerWorker describes a worker run in a container by podman.
+type containerWorker struct {
+	// Image is the container image reference to run.
+	Image string `toml:"image"`
+
+	// PodmanArgs is a list of additional arguments passed to "podman run"
+	// before the image reference.
+	PodmanArgs []string `toml:"podman-args"`
+
+	// Args is a list of arguments passed to the container entrypoint.
+	Args []string `toml:"args"`
+}
+
+// isWorkerFile reports whether name is the file name of a worker executable,
+// ignoring executableSuffix, or container worker.
+func isWorkerFile(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, executableSuffix), "worker") || strings.HasSuffix(name, containerWorkerSuffix)
+}
+
+// isContainerWorker reports whether file describes a container worker.
+func isContainerWorker(file string) bool {
+	return strings.HasSuffix(file, containerWorkerSuffix)
+}
+
+// containerName returns the name of the container started for the container
+// worker file.
+func containerName(file string) string {
+	return "ygg-" + strings.TrimSuffix(filepath.Base(file), "."+containerWorkerSuffix)
+}
+
+// loadContainerWorker reads a container worker description from file.
+func loadContainerWorker(file string) (*containerWorker, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+
+	var w containerWorker
+	if err := toml.Unmarshal(data, &w); err != nil {
+		return nil, fmt.Errorf("cannot parse container worker: %w", err)
+	}
+	if w.Image == "" {
+		return nil, fmt.Errorf("missing image in %v", file)
+	}
+
+	return &w, nil
+}
+
+// podmanArgs returns the arguments to "podman" that run the container worker
+// named name with env. The container shares the host network namespace, so
+// the abstract sockets of the dispatcher and worker are reachable from
+// either side, and the host PID namespace, so the worker registers with its
+// host PID. A dispatcher socket on the file system is bind-mounted into the
+// container.
+func (w *containerWorker) podmanArgs(name string, env []string) []string {
+	args := []string{"run", "--rm", "--replace", "--name", name, "--network=host", "--pid=host"}
+	for _, e := range env {
+		args = append(args, "--env", e)
+		if strings.HasPrefix(e, "YGG_SOCKET_ADDR=unix:") {
+			socket := strings.TrimPrefix(e, "YGG_SOCKET_ADDR=unix:")
+			if !strings.HasPrefix(socket, "@") {
+				args = append(args, "--volume", socket+":"+socket)
+			}
+		}
+	}
+	args = append(args, w.PodmanArgs...)
+	args = append(args, w.Image)
+	args = append(args, w.Args...)
+
+	return args
+}
+
+// workerCommand returns the command that runs the worker file with env. If
+// file is a worker manifest, manifest is its parsed content.
+func workerCommand(file string, env []string, manifest *workerManifest) (*exec.Cmd, error) {
+	if manifest != nil {
+		return manifest.command(env, manifestName(file))
+	}
+
+	if !isContainerWorker(file) {
+		cmd := exec.Command(file)
+		cmd.Env = env
+		return cmd, nil
+	}
+
+	w, err := loadContainerWorker(file)
+	if err != nil {
+		return nil, err
+	}
+
+	podman, err := exec.LookPath("podman")
+	if err != nil {
+		return nil, fmt.Errorf("cannot find podman: %w", err)
+	}
+
+	cmd := exec.Command(podman, w.podmanArgs(containerName(file), env)...)
+	cmd.Env = env
+
+	return cmd, nil
+}
+
+// removeContainer forcibly removes the container started for the container
+// worker file.
+func removeContainer(file string) error {
+	output, err := exec.Command("podman", "rm", "--force", "--ignore", containerName(file)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cannot remove container: %v: %w", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
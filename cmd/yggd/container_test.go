@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPodmanArgs(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        []string
+	}{
+		{
+			description: "abstract socket",
+			input:       []string{"YGG_SOCKET_ADDR=unix:@yggd"},
+			want: []string{
+				"run", "--rm", "--replace", "--name", "ygg-foo", "--network=host", "--pid=host",
+				"--env", "YGG_SOCKET_ADDR=unix:@yggd",
+				"--cap-drop=all", "quay.io/example/foo:latest", "--verbose",
+			},
+		},
+		{
+			description: "file system socket",
+			input:       []string{"YGG_SOCKET_ADDR=unix:/run/yggd.sock", "LOG_LEVEL=info"},
+			want: []string{
+				"run", "--rm", "--replace", "--name", "ygg-foo", "--network=host", "--pid=host",
+				"--env", "YGG_SOCKET_ADDR=unix:/run/yggd.sock", "--volume", "/run/yggd.sock:/run/yggd.sock",
+				"--env", "LOG_LEVEL=info",
+				"--cap-drop=all", "quay.io/example/foo:latest", "--verbose",
+			},
+		},
+	}
+
+	w := containerWorker{
+		Image:      "quay.io/example/foo:latest",
+		PodmanArgs: []string{"--cap-drop=all"},
+		Args:       []string{"--verbose"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := w.podmanArgs(containerName("/usr/libexec/yggdrasil/foo.worker.container"), test.input)
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+)
+
+// contentCacheDir returns the directory in which the payloads of content
+// references are downloaded.
+func contentCacheDir() string {
+	return filepath.Join(yggdrasil.LocalstateDir, "cache", yggdrasil.LongName, "content")
+}
+
+// isContentReference reports whether the content of data is a
+// ContentReference.
+func isContentReference(data yggdrasil.Data) bool {
+	return data.Metadata[yggdrasil.MetadataKeyContentReference] == "true"
+}
+
+// parseChecksum parses a checksum in the form "sha256:<hex digest>",
+// returning the digest.
+func parseChecksum(checksum string) ([]byte, error) {
+	fields := strings.SplitN(checksum, ":", 2)
+	if len(fields) != 2 || fields[0] != "sha256" {
+		return nil, fmt.Errorf("unsupported checksum %q", checksum)
+	}
+	digest, err := hex.DecodeString(fields[1])
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid sha256 digest %q", fields[1])
+	}
+	return digest, nil
+}
+
+// fileDigest returns the SHA-256 digest of the file at path.
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// fetchContent downloads the payload of ref into dir and returns the path of
+// the verified file. Files are named after their digest, so a payload already
+// downloaded is not downloaded again. With the peer cache, payloads are
+// fetched from peers on the local network first. A partial download is kept in a ".part"
+// file and resumed on the next attempt, if the server supports range
+// requests. A payload that does not match its checksum is discarded. The
+// download is abandoned when ctx is done.
+func fetchContent(ctx context.Context, client *http.Client, ref yggdrasil.ContentReference, dir string) (string, error) {
+	digest, err := parseChecksum(ref.Checksum)
+	if err != nil {
+		return "", err
+	}
+	URL, err := url.Parse(ref.URL)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse content URL: %w", err)
+	}
+	if yggdrasil.DataHost != "" {
+		URL.Host = yggdrasil.DataHost
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("cannot create directory: %w", err)
+	}
+	path := filepath.Join(dir, hex.EncodeToString(digest))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if peerCache.link(digest, path) {
+		return path, nil
+	}
+
+	part := path + ".part"
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return "", fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("cannot seek file: %w", err)
+	}
+
+	// A previous attempt may have been interrupted after downloading the
+	// whole payload; the server would then reject the range request.
+	complete := ref.Size > 0 && offset >= ref.Size
+	if offset > 0 && !complete {
+		if got, err := fileDigest(part); err == nil && bytes.Equal(got, digest) {
+			complete = true
+		}
+	}
+	if offset == 0 && peerCache.fetch(ctx, digest, f) {
+		complete = true
+	}
+
+	if !complete {
+		body, resumed, err := client.Download(ctx, URL.String(), offset)
+		if err != nil {
+			return "", err
+		}
+		defer body.Close()
+		if !resumed && offset > 0 {
+			log.Debugf("server does not support resuming download of %v; restarting", ref.URL)
+			if err := f.Truncate(0); err != nil {
+				return "", fmt.Errorf("cannot truncate file: %w", err)
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return "", fmt.Errorf("cannot seek file: %w", err)
+			}
+		} else if resumed {
+			log.Debugf("resuming download of %v at byte %v", ref.URL, offset)
+		}
+		if _, err := io.Copy(f, body); err != nil {
+			return "", fmt.Errorf("cannot download content: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("cannot close file: %w", err)
+	}
+
+	got, err := fileDigest(part)
+	if err != nil {
+		return "", fmt.Errorf("cannot compute digest: %w", err)
+	}
+	if !bytes.Equal(got, digest) {
+		os.Remove(part)
+		return "", fmt.Errorf("checksum mismatch for %v: got sha256:%x", ref.URL, got)
+	}
+	if err := os.Rename(part, path); err != nil {
+		return "", fmt.Errorf("cannot rename file: %w", err)
+	}
+	peerCache.keep(path, digest)
+
+	return path, nil
+}
+
+// resolveContentReference downloads the payload referenced by the content of
+// data and returns data updated for the worker w, along with the path of the
+// downloaded file. Unless w registered to receive local content, the payload
+// replaces the content of data, and the caller removes the file once the
+// message is delivered; otherwise the path is set in the metadata and the
+// worker is responsible for the file.
+func (d *dispatcher) resolveContentReference(ctx context.Context, w worker, data yggdrasil.Data) (yggdrasil.Data, string, error) {
+	var ref yggdrasil.ContentReference
+	if err := json.Unmarshal(data.Content, &ref); err != nil {
+		return data, "", fmt.Errorf("cannot unmarshal content reference: %w", err)
+	}
+
+	path, err := fetchContent(ctx, d.httpClient, ref, contentCacheDir())
+	if err != nil {
+		return data, "", transientError{fmt.Errorf("cannot fetch content: %w", err)}
+	}
+
+	metadata := make(map[string]string, len(data.Metadata)+1)
+	for k, v := range data.Metadata {
+		metadata[k] = v
+	}
+	delete(metadata, yggdrasil.MetadataKeyContentReference)
+
+	if w.localContent {
+		metadata[yggdrasil.MetadataKeyContentPath] = path
+		data.Content = nil
+	} else {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return data, "", fmt.Errorf("cannot read content: %w", err)
+		}
+		data.Content = content
+	}
+	data.Metadata = metadata
+
+	return data, path, nil
+}
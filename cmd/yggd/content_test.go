@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+)
+
+func TestFetchContent(t *testing.T) {
+	payload := []byte(strings.Repeat("yggdrasil", 1000))
+	checksum := fmt.Sprintf("sha256:%x", sha256.Sum256(payload))
+
+	var ranges []string
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		nethttp.ServeContent(w, r, "payload", time.Time{}, bytes.NewReader(payload))
+	}))
+	defer server.Close()
+	client := http.NewHTTPClient(nil, "test", dialer.New(dialer.DefaultTimeouts))
+
+	tests := []struct {
+		description string
+		partial     []byte
+		checksum    string
+		wantRange   string
+		wantError   bool
+	}{
+		{
+			description: "full download",
+			checksum:    checksum,
+			wantRange:   "",
+		},
+		{
+			description: "resumed download",
+			partial:     payload[:100],
+			checksum:    checksum,
+			wantRange:   "bytes=100-",
+		},
+		{
+			description: "checksum mismatch",
+			checksum:    fmt.Sprintf("sha256:%x", sha256.Sum256(nil)),
+			wantError:   true,
+		},
+		{
+			description: "unsupported checksum",
+			checksum:    "md5:d41d8cd98f00b204e9800998ecf8427e",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "content-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if test.partial != nil {
+				part := filepath.Join(dir, fmt.Sprintf("%x.part", sha256.Sum256(payload)))
+				if err := ioutil.WriteFile(part, test.partial, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ranges = nil
+
+			ref := yggdrasil.ContentReference{URL: server.URL, Checksum: test.checksum}
+			path, err := fetchContent(context.Background(), client, ref, dir)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("downloaded content does not match payload")
+			}
+			if len(ranges) != 1 || ranges[0] != test.wantRange {
+				t.Errorf("%q != [%q]", ranges, test.wantRange)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// maxTrackedMessages is the number of received messages whose delivery state
+// is remembered; the oldest is forgotten beyond it.
+const maxTrackedMessages = 10000
+
+// A messageStatus is the delivery state of a data message received from the
+// server or submitted locally.
+type messageStatus struct {
+	MessageID string                 `json:"message_id"`
+	Directive string                 `json:"directive"`
+	State     yggdrasil.MessageState `json:"state"`
+	Error     string                 `json:"error,omitempty"`
+	Responses []string               `json:"responses,omitempty"`
+	Updated   time.Time              `json:"updated"`
+
+	// local reports whether the message was submitted locally rather than
+	// received from the server, which is not told about it.
+	local bool
+
+	// changed is closed, and replaced, each time the state changes.
+	changed chan struct{}
+}
+
+// A correlationTable tracks the delivery state of received messages, matching
+// the messages workers send to the message they respond to by its ID.
+type correlationTable struct {
+	lock     sync.Mutex
+	size     int
+	messages map[string]*messageStatus
+	order    []string
+}
+
+func newCorrelationTable(size int) *correlationTable {
+	return &correlationTable{
+		size:     size,
+		messages: make(map[string]*messageStatus),
+	}
+}
+
+// accept starts tracking data, in the accepted state, and returns its status.
+// local reports whether data was submitted locally. Nothing is tracked by a
+// nil correlationTable.
+func (t *correlationTable) accept(data yggdrasil.Data, local bool, now time.Time) (messageStatus, bool) {
+	if t == nil {
+		return messageStatus{}, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, prs := t.messages[data.MessageID]
+	if !prs {
+		s = &messageStatus{MessageID: data.MessageID, changed: make(chan struct{})}
+		t.messages[data.MessageID] = s
+		t.order = append(t.order, data.MessageID)
+		for len(t.order) > t.size {
+			delete(t.messages, t.order[0])
+			t.order = t.order[1:]
+		}
+	}
+	s.Directive = data.Directive
+	s.local = local
+	t.update(s, yggdrasil.MessageStateAccepted, "", now)
+	return *s, true
+}
+
+// set moves the tracked message with the given ID to state, recording err
+// for a failed message. It returns the new status, and false if the message
+// is not tracked. A message that was responded to stays in that state.
+func (t *correlationTable) set(messageID string, state yggdrasil.MessageState, err error, now time.Time) (messageStatus, bool) {
+	if t == nil {
+		return messageStatus{}, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, prs := t.messages[messageID]
+	if !prs || s.State == yggdrasil.MessageStateResponded {
+		return messageStatus{}, false
+	}
+	var message string
+	if err != nil {
+		message = err.Error()
+	}
+	t.update(s, state, message, now)
+	return *s, true
+}
+
+// respond records that the message with the given ID was responded to by the
+// message responseID. It returns the new status, and false if the message is
+// not tracked.
+func (t *correlationTable) respond(messageID, responseID string, now time.Time) (messageStatus, bool) {
+	if t == nil {
+		return messageStatus{}, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, prs := t.messages[messageID]
+	if !prs {
+		return messageStatus{}, false
+	}
+	if responseID != "" {
+		s.Responses = append(s.Responses, responseID)
+	}
+	t.update(s, yggdrasil.MessageStateResponded, "", now)
+	return *s, true
+}
+
+// update sets the state of s and wakes those waiting for it to change. The
+// table must be locked.
+func (t *correlationTable) update(s *messageStatus, state yggdrasil.MessageState, message string, now time.Time) {
+	s.State = state
+	s.Error = message
+	s.Updated = now
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// get returns the status of the message with the given ID, and whether it is
+// tracked.
+func (t *correlationTable) get(messageID string) (messageStatus, bool) {
+	if t == nil {
+		return messageStatus{}, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, prs := t.messages[messageID]
+	if !prs {
+		return messageStatus{}, false
+	}
+	return *s, true
+}
+
+// wait returns the status of the message with the given ID once it is in one
+// of states, or when ctx is done. It returns false if the message is not
+// tracked.
+func (t *correlationTable) wait(ctx context.Context, messageID string, states ...yggdrasil.MessageState) (messageStatus, bool) {
+	for {
+		s, prs := t.get(messageID)
+		if !prs {
+			return s, false
+		}
+		for _, state := range states {
+			if s.State == state {
+				return s, true
+			}
+		}
+		select {
+		case <-s.changed:
+		case <-ctx.Done():
+			return s, true
+		}
+	}
+}
+
+// messageAccepted starts tracking the delivery of data, queued for dispatch.
+// local reports whether data was submitted locally.
+func (d *dispatcher) messageAccepted(data yggdrasil.Data, local bool) {
+	if s, ok := d.correlations.accept(data, local, time.Now()); ok {
+		d.messageStateChanged(s)
+	}
+}
+
+// deliveryDone records the result of the delivery of data to its worker:
+// delivered if err is nil, failed otherwise.
+func (d *dispatcher) deliveryDone(data yggdrasil.Data, err error) {
+	d.broadcastDone(data, err)
+	state := yggdrasil.MessageStateDelivered
+	if err != nil {
+		state = yggdrasil.MessageStateFailed
+	}
+	if s, ok := d.correlations.set(data.MessageID, state, err, time.Now()); ok {
+		d.messageStateChanged(s)
+	}
+}
+
+// messageResponded records that a worker sent data in response to a tracked
+// message.
+func (d *dispatcher) messageResponded(data yggdrasil.Data) {
+	if data.ResponseTo == "" {
+		return
+	}
+	if s, ok := d.correlations.respond(data.ResponseTo, data.MessageID, time.Now()); ok {
+		d.messageStateChanged(s)
+	}
+}
+
+// messageStateChanged publishes a "message-state" event for s, if enabled
+// and s is the status of a message received from the server.
+func (d *dispatcher) messageStateChanged(s messageStatus) {
+	if !d.messageStateEvents || s.local {
+		return
+	}
+	details := map[string]string{
+		"directive": s.Directive,
+		"state":     string(s.State),
+	}
+	if s.Error != "" {
+		details["error"] = s.Error
+	}
+	if n := len(s.Responses); n > 0 {
+		details["response_id"] = s.Responses[n-1]
+	}
+	d.events <- yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: s.MessageID,
+		Version:    1,
+		Sent:       s.Updated,
+		Content:    string(yggdrasil.EventNameMessageState),
+		Details:    details,
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestCorrelationTable(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		apply       func(c *correlationTable)
+		want        yggdrasil.MessageState
+		wantError   string
+	}{
+		{
+			description: "accepted",
+			apply:       func(c *correlationTable) {},
+			want:        yggdrasil.MessageStateAccepted,
+		},
+		{
+			description: "delivered",
+			apply: func(c *correlationTable) {
+				c.set("1", yggdrasil.MessageStateDelivered, nil, now)
+			},
+			want: yggdrasil.MessageStateDelivered,
+		},
+		{
+			description: "failed",
+			apply: func(c *correlationTable) {
+				c.set("1", yggdrasil.MessageStateFailed, fmt.Errorf("cannot dial socket"), now)
+			},
+			want:      yggdrasil.MessageStateFailed,
+			wantError: "cannot dial socket",
+		},
+		{
+			description: "responded before delivery returned",
+			apply: func(c *correlationTable) {
+				c.respond("1", "2", now)
+				c.set("1", yggdrasil.MessageStateDelivered, nil, now)
+			},
+			want: yggdrasil.MessageStateResponded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			c := newCorrelationTable(10)
+			c.accept(yggdrasil.Data{MessageID: "1", Directive: "echo"}, false, now)
+			test.apply(c)
+
+			got, ok := c.get("1")
+			if !ok {
+				t.Fatal("message not tracked")
+			}
+			if !cmp.Equal(got.State, test.want) {
+				t.Errorf("%#v", cmp.Diff(got.State, test.want))
+			}
+			if got.Error != test.wantError {
+				t.Errorf("error = %q, want %q", got.Error, test.wantError)
+			}
+		})
+	}
+}
+
+func TestCorrelationTableWait(t *testing.T) {
+	c := newCorrelationTable(1)
+	c.accept(yggdrasil.Data{MessageID: "1", Directive: "echo"}, false, time.Now())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.set("1", yggdrasil.MessageStateDelivered, nil, time.Now())
+		c.respond("1", "2", time.Now())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, ok := c.wait(ctx, "1", yggdrasil.MessageStateResponded)
+	if !ok || got.State != yggdrasil.MessageStateResponded {
+		t.Fatalf("state %v, want responded", got.State)
+	}
+	if !cmp.Equal(got.Responses, []string{"2"}) {
+		t.Errorf("%#v", cmp.Diff(got.Responses, []string{"2"}))
+	}
+
+	// The oldest message is forgotten beyond the size of the table.
+	c.accept(yggdrasil.Data{MessageID: "3", Directive: "echo"}, false, time.Now())
+	if _, ok := c.wait(ctx, "1"); ok {
+		t.Error("message 1 still tracked")
+	}
+}
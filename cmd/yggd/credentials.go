@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// credentialsEnv is set to the credentials directory of a worker, as systemd
+// sets it for services with LoadCredential=, so that workers read their
+// credentials the same way in both cases.
+const credentialsEnv = "CREDENTIALS_DIRECTORY"
+
+// credentialsDir returns the directory holding the credentials of the worker
+// named name.
+func credentialsDir(name string) string {
+	return filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "credentials", name)
+}
+
+// validCredentialName reports whether name can name a credential file.
+func validCredentialName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// readCredential returns the value of the credential name: the credential of
+// the same name passed to yggd by systemd, if any, or else the secret of the
+// same name in secretStore.
+func readCredential(name string) ([]byte, error) {
+	if dir := os.Getenv(credentialsEnv); dir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read credential %v: %w", name, err)
+		}
+	}
+	value, err := secretStore.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read credential %v: %w", name, err)
+	}
+	return []byte(value), nil
+}
+
+// writeCredentials writes the credentials of the manifest, one file each,
+// into the credentials directory of the worker named name, replacing its
+// previous content, and returns the directory. The directory and files are
+// owned by the user and group the worker runs as and only readable by them,
+// so that, unlike environment variables, the credentials are not visible to
+// other processes.
+func (m *workerManifest) writeCredentials(name string) (string, error) {
+	uid, gid, err := m.owner()
+	if err != nil {
+		return "", err
+	}
+
+	dir := credentialsDir(name)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("cannot remove credentials: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", fmt.Errorf("cannot create directory: %w", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", fmt.Errorf("cannot create directory: %w", err)
+	}
+
+	for _, credential := range m.Credentials {
+		value, err := readCredential(credential)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		file := filepath.Join(dir, credential)
+		if err := ioutil.WriteFile(file, value, 0400); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("cannot write credential %v: %w", credential, err)
+		}
+		if uid != -1 {
+			if err := os.Chown(file, uid, gid); err != nil {
+				os.RemoveAll(dir)
+				return "", fmt.Errorf("cannot change owner of credential %v: %w", credential, err)
+			}
+		}
+	}
+
+	if uid != -1 {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("cannot change owner of credentials: %w", err)
+		}
+	}
+	if err := os.Chmod(dir, 0500); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("cannot change mode of credentials: %w", err)
+	}
+	return dir, nil
+}
+
+// removeCredentials removes the credentials directory of the worker named
+// name.
+func removeCredentials(name string) error {
+	return os.RemoveAll(credentialsDir(name))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/secrets"
+)
+
+func TestWriteCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(old string) { yggdrasil.LocalstateDir = old }(yggdrasil.LocalstateDir)
+	yggdrasil.LocalstateDir = dir
+	defer func(path string) { secrets.MachineIDPath = path }(secrets.MachineIDPath)
+	secrets.MachineIDPath = filepath.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(secrets.MachineIDPath, []byte("0123456789abcdef0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(s *secrets.Store) { secretStore = s }(secretStore)
+	secretStore = secrets.NewStore(filepath.Join(dir, "secrets"), &secrets.KeyFile{Path: filepath.Join(dir, "secrets.key")})
+	if err := secretStore.Set("api-token", "stored"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Credentials passed by systemd take precedence over stored secrets.
+	systemdDir := filepath.Join(dir, "systemd")
+	if err := os.Mkdir(systemdDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(systemdDir, "db-password"), []byte("passed"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(credentialsEnv)
+	os.Setenv(credentialsEnv, systemdDir)
+
+	m := workerManifest{Exec: "/bin/true", Credentials: []string{"api-token", "db-password"}}
+	cmd, err := m.command(nil, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeCredentials("test")
+
+	want := map[string]string{"api-token": "stored", "db-password": "passed"}
+	for name, value := range want {
+		got, err := ioutil.ReadFile(filepath.Join(credentialsDir("test"), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != value {
+			t.Errorf("credential %v: %q != %q", name, got, value)
+		}
+	}
+	info, err := os.Stat(credentialsDir("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0500 {
+		t.Errorf("mode %v != %v", info.Mode().Perm(), os.FileMode(0500))
+	}
+	if cmd.Env[len(cmd.Env)-1] != credentialsEnv+"="+credentialsDir("test") {
+		t.Errorf("%v not set in %v", credentialsEnv, cmd.Env)
+	}
+
+	m.Credentials = []string{"missing"}
+	if _, err := m.command(nil, "test"); err == nil {
+		t.Error("expected an error for a missing credential")
+	}
+	if _, err := os.Stat(credentialsDir("test")); !os.IsNotExist(err) {
+		t.Errorf("credentials directory left behind: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+)
+
+// errDeadlineExceeded is returned by dispatch for a message that could not be
+// delivered before its deadline. It has already been reported, and must not
+// be retried.
+var errDeadlineExceeded = errors.New("message deadline exceeded")
+
+// messageDeadline returns the deadline set in the metadata of data, and
+// whether it has one. An invalid deadline is ignored.
+func messageDeadline(data yggdrasil.Data) (time.Time, bool) {
+	value, prs := data.Metadata[yggdrasil.MetadataKeyDeadline]
+	if !prs {
+		return time.Time{}, false
+	}
+	deadline, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Warnf("ignoring invalid deadline of message %v: %v", data.MessageID, err)
+		return time.Time{}, false
+	}
+	return deadline, true
+}
+
+// messageContext returns a context that is done when the deadline of data, if
+// any, is exceeded.
+func messageContext(data yggdrasil.Data) (context.Context, context.CancelFunc) {
+	if deadline, ok := messageDeadline(data); ok {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// deadlineExceeded reports that data could not be handled before its
+// deadline, while at stage ("queue", "content", "delivery" or "worker"), and
+// returns errDeadlineExceeded.
+func (d *dispatcher) deadlineExceeded(data yggdrasil.Data, stage string) error {
+	log.Warnf("deadline of message %v for directive %v exceeded during %v", data.MessageID, data.Directive, stage)
+	lasterror.Set(lasterror.Dispatcher, errDeadlineExceeded)
+	d.deliveryDone(data, errDeadlineExceeded)
+	d.events <- yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: data.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameDeadlineExceeded),
+		Details: map[string]string{
+			"directive": data.Directive,
+			"deadline":  data.Metadata[yggdrasil.MetadataKeyDeadline],
+			"stage":     stage,
+		},
+	}
+	return errDeadlineExceeded
+}
+
+// expireAt asks the worker w to cancel data, if it has not responded to it by
+// its deadline. The deadline is rebased when the wall clock jumps.
+func (d *dispatcher) expireAt(w worker, data yggdrasil.Data, deadline time.Time) {
+	d.expiries.At(data.MessageID, deadline, func() {
+		if d.inflight.get(data.MessageID) == "" {
+			return
+		}
+		d.inflight.remove(data.MessageID)
+		d.concurrency.release(data.MessageID)
+		if err := cancelWorkerMessage(w, data.MessageID); err != nil {
+			log.Debugf("cannot cancel expired message %v: %v", data.MessageID, err)
+		}
+		d.deadlineExceeded(data, "worker")
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestDispatchDeadlineExceeded(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 1)
+	data := yggdrasil.Data{
+		MessageID: "1",
+		Directive: "echo",
+		Metadata: map[string]string{
+			yggdrasil.MetadataKeyDeadline: time.Now().Add(-time.Second).Format(time.RFC3339),
+		},
+	}
+
+	events := make(chan yggdrasil.Event, 1)
+	go func() { events <- <-d.events }()
+
+	if err := d.dispatch(worker{handler: "echo", addr: "@ygg-test-none"}, data); err != errDeadlineExceeded {
+		t.Fatalf("%v != %v", err, errDeadlineExceeded)
+	}
+
+	select {
+	case event := <-events:
+		if event.Content != string(yggdrasil.EventNameDeadlineExceeded) || event.ResponseTo != "1" || event.Details["stage"] != "queue" {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no deadline-exceeded event")
+	}
+}
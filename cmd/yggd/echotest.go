@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+const (
+	// echoTestDirective is the directive an echo test is sent to unless
+	// another one is requested.
+	echoTestDirective = "echo"
+
+	// echoTestTimeout is the time allowed for each stage of an echo test.
+	echoTestTimeout = 30 * time.Second
+)
+
+// An echoTest tracks a test message on its way through a worker and back to
+// the transport.
+type echoTest struct {
+	// responded receives the time the worker's response reached the
+	// dispatcher.
+	responded chan time.Time
+
+	// published receives the result of publishing the worker's response.
+	published chan error
+}
+
+// echoTestResult is the outcome of an echo test.
+type echoTestResult struct {
+	err       error
+	latencies map[string]time.Duration
+}
+
+// runEchoTest sends a test message to the worker handling directive and
+// waits for the worker's response to be published, measuring the latency of
+// each stage: "dispatch" until the worker acknowledged the test message,
+// "response" until the worker's response reached the dispatcher, and
+// "publish" until the response was published by the transport.
+func (d *dispatcher) runEchoTest(directive string) echoTestResult {
+	result := echoTestResult{latencies: make(map[string]time.Duration)}
+
+	if directive == "" {
+		directive = echoTestDirective
+	}
+
+	w, prs := d.lookupWorker(directive)
+	if !prs {
+		result.err = fmt.Errorf("no worker registered for directive %v", directive)
+		return result
+	}
+
+	content, err := json.Marshal("echo-test")
+	if err != nil {
+		result.err = err
+		return result
+	}
+	data := yggdrasil.Data{
+		Type:      yggdrasil.MessageTypeData,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+		Directive: directive,
+		Metadata:  map[string]string{},
+		Content:   content,
+	}
+
+	test := &echoTest{
+		responded: make(chan time.Time, 1),
+		published: make(chan error, 1),
+	}
+	d.Lock()
+	d.echoTests[data.MessageID] = test
+	d.Unlock()
+	defer func() {
+		d.Lock()
+		delete(d.echoTests, data.MessageID)
+		d.Unlock()
+	}()
+
+	start := time.Now()
+	if err := d.dispatch(w, data); err != nil {
+		result.err = fmt.Errorf("cannot dispatch test message: %w", err)
+		return result
+	}
+	dispatched := time.Now()
+	result.latencies["dispatch"] = dispatched.Sub(start)
+
+	var responded time.Time
+	select {
+	case responded = <-test.responded:
+		result.latencies["response"] = responded.Sub(dispatched)
+	case <-time.After(echoTestTimeout):
+		result.err = fmt.Errorf("no response from worker within %v", echoTestTimeout)
+		return result
+	}
+
+	select {
+	case err := <-test.published:
+		if err != nil {
+			result.err = fmt.Errorf("cannot publish response: %w", err)
+			return result
+		}
+		result.latencies["publish"] = time.Since(responded)
+	case <-time.After(echoTestTimeout):
+		result.err = fmt.Errorf("response not published within %v", echoTestTimeout)
+		return result
+	}
+	result.latencies["total"] = time.Since(start)
+
+	return result
+}
+
+// echoTestResponded records the arrival of a worker response to an echo
+// test message.
+func (d *dispatcher) echoTestResponded(data yggdrasil.Data) {
+	d.RLock()
+	test, prs := d.echoTests[data.ResponseTo]
+	d.RUnlock()
+	if prs {
+		select {
+		case test.responded <- time.Now():
+		default:
+		}
+	}
+}
+
+// dataPublished is called with every data message published by the
+// transport, and records the time of the last successful publication and the
+// publication of responses to echo test messages. Once a response is
+// published, the temporary directory of the message it responds to is
+// removed.
+func (d *dispatcher) dataPublished(data yggdrasil.Data, err error) {
+	if err == nil {
+		d.lastPublished.Store(time.Now())
+		d.tempDirs.remove(data.ResponseTo)
+	}
+
+	d.RLock()
+	test, prs := d.echoTests[data.ResponseTo]
+	d.RUnlock()
+	if prs {
+		select {
+		case test.published <- err:
+		default:
+		}
+	}
+}
+
+// event returns an "echo-test" event in response to the message responseTo
+// describing r.
+func (r echoTestResult) event(responseTo string) yggdrasil.Event {
+	details := map[string]string{
+		"success": strconv.FormatBool(r.err == nil),
+	}
+	if r.err != nil {
+		details["error"] = r.err.Error()
+	}
+	for stage, latency := range r.latencies {
+		details[stage+"_ms"] = strconv.FormatInt(latency.Milliseconds(), 10)
+	}
+
+	return yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: responseTo,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameEchoTest),
+		Details:    details,
+	}
+}
+
+// EchoTest implements the "EchoTest" method of the Dispatcher gRPC service.
+// The result is also published to the server as an "echo-test" event.
+func (d *dispatcher) EchoTest(ctx context.Context, r *pb.DirectiveRequest) (*pb.EchoTestResponse, error) {
+	result := d.runEchoTest(r.GetDirective())
+	d.events <- result.event("")
+
+	response := pb.EchoTestResponse{
+		Success:   result.err == nil,
+		Latencies: make(map[string]int64),
+	}
+	if result.err != nil {
+		response.Error = result.err.Error()
+		log.Errorf("echo test failed: %v", result.err)
+	}
+	for stage, latency := range result.latencies {
+		response.Latencies[stage] = latency.Milliseconds()
+	}
+
+	return &response, nil
+}
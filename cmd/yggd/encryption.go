@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// payloadIdentityFile returns the path of the age identity of the client, the
+// private key the server encrypts data message content to.
+func payloadIdentityFile() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "payload-identity.txt")
+}
+
+// payloadRecipientsFile returns the path of the age recipients, one per line,
+// the content of the data messages the client publishes is encrypted to.
+func payloadRecipientsFile() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "payload-recipients.txt")
+}
+
+// loadPayloadIdentity reads the age X25519 identity in file, generating and
+// writing a new one if the file does not exist.
+func loadPayloadIdentity(file string) (*age.X25519Identity, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate payload identity: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return nil, fmt.Errorf("cannot create directory: %w", err)
+		}
+		content := fmt.Sprintf("# public key: %v\n%v\n", identity.Recipient(), identity)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			return nil, fmt.Errorf("cannot write payload identity: %w", err)
+		}
+		log.Infof("generated payload identity %v", identity.Recipient())
+		return identity, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read payload identity: %w", err)
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse payload identity: %w", err)
+	}
+	if len(identities) != 1 {
+		return nil, fmt.Errorf("cannot parse payload identity: %v contains %v identities", file, len(identities))
+	}
+	identity, ok := identities[0].(*age.X25519Identity)
+	if !ok {
+		return nil, fmt.Errorf("cannot parse payload identity: not an X25519 identity")
+	}
+	return identity, nil
+}
+
+// loadPayloadRecipients reads the age recipients in file.
+func loadPayloadRecipients(file string) ([]age.Recipient, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read payload recipients: %w", err)
+	}
+	recipients, err := age.ParseRecipients(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse payload recipients: %w", err)
+	}
+	return recipients, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestLoadPayloadIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-encryption-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "payload-identity.txt")
+
+	generated, err := loadPayloadIdentity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("%v != %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+
+	loaded, err := loadPayloadIdentity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.String() != generated.String() {
+		t.Errorf("loaded identity differs from generated identity")
+	}
+}
+
+func TestLoadPayloadRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		content     string
+		want        int
+		wantError   bool
+	}{
+		{
+			description: "recipients",
+			content:     "# server\n" + identity.Recipient().String() + "\n",
+			want:        1,
+		},
+		{
+			description: "invalid",
+			content:     "age1invalid\n",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-encryption-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "payload-recipients.txt")
+			if err := ioutil.WriteFile(file, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadPayloadRecipients(file)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != test.want {
+				t.Errorf("%v != %v", len(got), test.want)
+			}
+		})
+	}
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
@@ -16,15 +18,16 @@ import (
 	"github.com/rjeczalik/notify"
 )
 
+// replaceWorkerTimeout is how long replaceWorker waits for the running
+// instance of a worker to exit before starting the new one.
+const replaceWorkerTimeout = 10 * time.Second
+
 func startProcess(file string, env []string, delay time.Duration, died chan int) {
 	if _, err := os.Stat(file); os.IsNotExist(err) {
 		log.Warnf("cannot start worker: %v", err)
 		return
 	}
 
-	cmd := exec.Command(file)
-	cmd.Env = env
-
 	if delay < 0 {
 		log.Errorf("failed to start worker '%v' too many times", file)
 		return
@@ -35,43 +38,97 @@ func startProcess(file string, env []string, delay time.Duration, died chan int)
 		time.Sleep(delay)
 	}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Errorf("cannot connect to stdout: %v", err)
-		return
+	var manifest *workerManifest
+	if isWorkerManifest(file) {
+		var err error
+		manifest, err = loadWorkerManifest(file)
+		if err != nil {
+			log.Errorf("cannot start worker: %v: %v", file, err)
+			return
+		}
 	}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		log.Errorf("cannot connect to stderr: %v", err)
+	executable := file
+	if manifest != nil {
+		executable = manifest.Exec
+	}
+	if err := verifyWorker(executable); err != nil {
+		log.Errorf("cannot start worker: %v", err)
 		return
 	}
 
-	if err := cmd.Start(); err != nil {
+	cmd, err := workerCommand(file, env, manifest)
+	if err != nil {
 		log.Errorf("cannot start worker: %v: %v", file, err)
 		return
 	}
-	log.Debugf("started process: %v", cmd.Process.Pid)
 
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			log.Tracef("[%v] %v", file, scanner.Text())
+	// Workers kept across restarts of yggd write to a log file, since a pipe
+	// to yggd would break, killing them, when it exits.
+	var stdout, stderr io.ReadCloser
+	if keepWorkers {
+		output, err := openWorkerLog(file)
+		if err != nil {
+			log.Errorf("cannot start worker: %v: %v", file, err)
+			return
 		}
-		if err := scanner.Err(); err != nil {
-			log.Errorf("cannot read from stdout: %v", err)
+		defer output.Close()
+		cmd.Stdout = output
+		cmd.Stderr = output
+	} else {
+		stdout, err = cmd.StdoutPipe()
+		if err != nil {
+			log.Errorf("cannot connect to stdout: %v", err)
+			return
 		}
-	}()
 
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Errorf("[%v] %v", file, scanner.Text())
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			log.Errorf("cannot connect to stderr: %v", err)
+			return
 		}
-		if err := scanner.Err(); err != nil {
-			log.Errorf("cannot read from stderr: %v", err)
-		}
-	}()
+	}
+
+	err = cmd.Start()
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	if err != nil {
+		log.Errorf("cannot start worker: %v: %v", file, err)
+		return
+	}
+	log.Debugf("started process: %v", cmd.Process.Pid)
+
+	if manifest != nil {
+		manifestWorkers.Lock()
+		manifestWorkers.m[cmd.Process.Pid] = manifest
+		manifestWorkers.Unlock()
+	}
+	workerFiles.Lock()
+	workerFiles.m[cmd.Process.Pid] = file
+	workerFiles.Unlock()
+
+	if stdout != nil {
+		go func() {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				log.Tracef("[%v] %v", file, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				log.Errorf("cannot read from stdout: %v", err)
+			}
+		}()
+
+		go func() {
+			scanner := bufio.NewScanner(stderr)
+			for scanner.Scan() {
+				log.Errorf("[%v] %v", file, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				log.Errorf("cannot read from stderr: %v", err)
+			}
+		}()
+	}
 
 	pidDirPath := filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers")
 
@@ -85,10 +142,34 @@ func startProcess(file string, env []string, delay time.Duration, died chan int)
 		return
 	}
 
-	go watchProcess(cmd, delay, died)
+	go watchProcess(file, env, cmd, manifest, delay, died)
+}
+
+// stoppingWorkers maps the PIDs of workers killed on purpose to a channel
+// that is closed once they have exited. These workers are not restarted.
+var stoppingWorkers = struct {
+	sync.Mutex
+	m map[int]chan struct{}
+}{m: make(map[int]chan struct{})}
+
+// stopping marks the worker process pid as being killed on purpose and
+// returns a channel that is closed once it has exited.
+func stopping(pid int) <-chan struct{} {
+	stoppingWorkers.Lock()
+	defer stoppingWorkers.Unlock()
+	c, prs := stoppingWorkers.m[pid]
+	if !prs {
+		c = make(chan struct{})
+		stoppingWorkers.m[pid] = c
+	}
+	return c
 }
 
-func watchProcess(cmd *exec.Cmd, delay time.Duration, died chan int) {
+// watchProcess waits for the worker process of cmd to exit, and restarts it
+// with env, the environment it was originally started with, unless it was
+// killed on purpose or its restart policy says otherwise for the class of the
+// exit. Unexpected exits are reported.
+func watchProcess(file string, env []string, cmd *exec.Cmd, manifest *workerManifest, delay time.Duration, died chan int) {
 	log.Debugf("watching process: %v", cmd.Process.Pid)
 
 	state, err := cmd.Process.Wait()
@@ -96,8 +177,50 @@ func watchProcess(cmd *exec.Cmd, delay time.Duration, died chan int) {
 		log.Errorf("process %v exited with error: %v", cmd.Process.Pid, err)
 	}
 
+	manifestWorkers.Lock()
+	delete(manifestWorkers.m, cmd.Process.Pid)
+	manifestWorkers.Unlock()
+	workerFiles.Lock()
+	delete(workerFiles.m, cmd.Process.Pid)
+	workerFiles.Unlock()
+
+	var oomKilled bool
+	if manifest != nil {
+		oomKilled = cgroupOOMKilled(manifestName(file))
+		if err := removeCgroup(manifestName(file)); err != nil {
+			log.Debugf("cannot remove cgroup of worker %v: %v", file, err)
+		}
+		if err := removeCredentials(manifestName(file)); err != nil {
+			log.Errorf("cannot remove credentials of worker %v: %v", file, err)
+		}
+	}
+
 	died <- state.Pid()
 
+	stoppingWorkers.Lock()
+	stopped, prs := stoppingWorkers.m[cmd.Process.Pid]
+	delete(stoppingWorkers.m, cmd.Process.Pid)
+	stoppingWorkers.Unlock()
+	if prs {
+		log.Infof("worker %v stopped", file)
+		close(stopped)
+		return
+	}
+
+	class := classifyExit(state, oomKilled)
+	restart := manifest.restartOn(class)
+	reportExit(workerExit{
+		worker:  manifestName(file),
+		pid:     cmd.Process.Pid,
+		class:   class,
+		status:  exitStatus(state),
+		restart: restart,
+		alert:   manifest.alertOn(class),
+	})
+	if !restart {
+		return
+	}
+
 	if state.SystemTime() < time.Duration(1*time.Second) {
 		delay += 5 * time.Second
 	}
@@ -105,7 +228,7 @@ func watchProcess(cmd *exec.Cmd, delay time.Duration, died chan int) {
 		delay = -1
 	}
 
-	go startProcess(cmd.Path, cmd.Env, delay, died)
+	go startProcess(file, env, delay, died)
 }
 
 func killProcess(pid int) error {
@@ -121,27 +244,75 @@ func killProcess(pid int) error {
 	return nil
 }
 
-func killWorker(pidFile string) error {
+// workerPIDFile returns the path of the file holding the PID of the worker
+// started from file.
+func workerPIDFile(file string) string {
+	return filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers", filepath.Base(file)+".pid")
+}
+
+// readPID reads the PID of a worker from pidFile.
+func readPID(pidFile string) (int, error) {
 	data, err := ioutil.ReadFile(pidFile)
 	if err != nil {
-		return fmt.Errorf("cannot read contents of file: %w", err)
+		return 0, fmt.Errorf("cannot read contents of file: %w", err)
 	}
 	pid, err := strconv.ParseInt(string(data), 10, 64)
 	if err != nil {
-		return fmt.Errorf("cannot parse file contents as int: %w", err)
+		return 0, fmt.Errorf("cannot parse file contents as int: %w", err)
 	}
+	return int(pid), nil
+}
 
-	if err := killProcess(int(pid)); err != nil {
+func killWorker(pidFile string) error {
+	pid, err := readPID(pidFile)
+	if err != nil {
+		return err
+	}
+
+	if processExists(pid) {
+		stopping(pid)
+	}
+	if err := killProcess(pid); err != nil {
 		return fmt.Errorf("cannot kill process: %w", err)
 	}
 
+	// Killing podman does not stop the container it runs, so remove it
+	// explicitly.
+	if workerFile := strings.TrimSuffix(filepath.Base(pidFile), ".pid"); isContainerWorker(workerFile) {
+		if err := removeContainer(workerFile); err != nil {
+			log.Errorf("cannot remove container worker: %v", err)
+		}
+	}
+
 	if err := os.Remove(pidFile); err != nil {
 		return fmt.Errorf("cannot remove file: %w", err)
 	}
 	return nil
 }
 
-func killWorkers() error {
+// replaceWorker stops the running instance of the worker file, if any, and
+// starts file once it has exited, so that an edited worker or manifest never
+// runs twice.
+func replaceWorker(file string, env []string, died chan int) {
+	pidFile := workerPIDFile(file)
+	if pid, err := readPID(pidFile); err == nil && processExists(pid) {
+		log.Infof("worker %v changed; stopping running instance %v", file, pid)
+		exited := stopping(pid)
+		if err := killWorker(pidFile); err != nil {
+			log.Errorf("cannot kill worker: %v", err)
+		}
+		select {
+		case <-exited:
+		case <-time.After(replaceWorkerTimeout):
+			log.Warnf("worker %v did not exit within %v", pid, replaceWorkerTimeout)
+		}
+	}
+	startProcess(file, env, 0, died)
+}
+
+// killWorkers kills the workers with a PID file, except those whose PID is
+// in keep.
+func killWorkers(keep map[int]bool) error {
 	pidDirPath := filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers")
 	if err := os.MkdirAll(pidDirPath, 0755); err != nil {
 		return fmt.Errorf("cannot create directory: %w", err)
@@ -153,6 +324,9 @@ func killWorkers() error {
 
 	for _, info := range fileInfos {
 		pidFilePath := filepath.Join(pidDirPath, info.Name())
+		if pid, err := readPID(pidFilePath); err == nil && keep[pid] {
+			continue
+		}
 		if err := killWorker(pidFilePath); err != nil {
 			return fmt.Errorf("cannot kill worker: %w", err)
 		}
@@ -164,7 +338,7 @@ func killWorkers() error {
 func watchWorkerDir(dir string, env []string, died chan int) {
 	c := make(chan notify.EventInfo, 1)
 
-	if err := notify.Watch(dir, c, notify.InCloseWrite, notify.InDelete, notify.InMovedFrom, notify.InMovedTo); err != nil {
+	if err := notify.Watch(dir, c, watchEvents...); err != nil {
 		log.Errorf("cannot start notify watchpoint: %v", err)
 		return
 	}
@@ -172,17 +346,14 @@ func watchWorkerDir(dir string, env []string, died chan int) {
 
 	for e := range c {
 		log.Debugf("received inotify event %v", e.Event())
-		switch e.Event() {
-		case notify.InCloseWrite, notify.InMovedTo:
-			if strings.HasSuffix(e.Path(), "worker") {
+		switch {
+		case isWrittenEvent(e.Event()):
+			if isWorkerManifest(e.Path()) || (isWorkerFile(e.Path()) && !manifestExecs(workerManifestDir())[e.Path()]) {
 				log.Tracef("new worker detected: %v", e.Path())
-				go startProcess(e.Path(), env, 0, died)
+				go replaceWorker(e.Path(), env, died)
 			}
-		case notify.InDelete, notify.InMovedFrom:
-			workerName := filepath.Base(e.Path())
-			pidFilePath := filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers", workerName+".pid")
-
-			if err := killWorker(pidFilePath); err != nil {
+		case isRemovedEvent(e.Event()):
+			if err := killWorker(workerPIDFile(e.Path())); err != nil {
 				log.Errorf("cannot kill worker: %v", err)
 				continue
 			}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestReplaceWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-exec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { yggdrasil.LocalstateDir = old }(yggdrasil.LocalstateDir)
+	yggdrasil.LocalstateDir = dir
+
+	// The worker records its environment, so duplicated variables show.
+	envFile := filepath.Join(dir, "env")
+	file := filepath.Join(dir, "test-worker")
+	script := "#!/bin/sh\nenv >> " + envFile + "\nexec sleep 60\n"
+	if err := ioutil.WriteFile(file, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	died := make(chan int, 10)
+	startProcess(file, []string{"YGG_TEST=1"}, 0, died)
+	first, err := readPID(workerPIDFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := waitForVariable(envFile, 1); n != 1 {
+		t.Fatalf("variable set %v times by 1 instance", n)
+	}
+
+	replaceWorker(file, []string{"YGG_TEST=1"}, died)
+	second, err := readPID(workerPIDFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killWorker(workerPIDFile(file))
+
+	if second == first {
+		t.Fatal("worker not restarted")
+	}
+	select {
+	case pid := <-died:
+		if pid != first {
+			t.Errorf("pid %v died, want %v", pid, first)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("running instance not stopped")
+	}
+
+	// The stopped instance must not be restarted by its watcher.
+	time.Sleep(200 * time.Millisecond)
+	if pid, _ := readPID(workerPIDFile(file)); pid != second {
+		t.Errorf("worker restarted again as %v", pid)
+	}
+
+	// Each instance is started with the variable once.
+	if n := waitForVariable(envFile, 2); n != 2 {
+		t.Errorf("variable set %v times by 2 instances", n)
+	}
+}
+
+// waitForVariable waits up to a second for YGG_TEST to be recorded want times
+// in file, and returns the number of times it was recorded.
+func waitForVariable(file string, want int) int {
+	var n int
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		data, _ := ioutil.ReadFile(file)
+		if n = strings.Count(string(data), "YGG_TEST=1"); n >= want {
+			break
+		}
+	}
+	return n
+}
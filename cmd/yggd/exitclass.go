@@ -0,0 +1,179 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+)
+
+// Classes of worker exits.
+const (
+	exitClean       = "clean"
+	exitCrash       = "crash"
+	exitOOMKilled   = "oom-killed"
+	exitSignal      = "signal"
+	exitConfigError = "config-error"
+)
+
+// exitClasses lists the classes of worker exits.
+var exitClasses = []string{exitClean, exitCrash, exitOOMKilled, exitSignal, exitConfigError}
+
+// workerExitMetrics holds the number of unexpected worker exits of each class.
+var workerExitMetrics = expvar.NewMap("worker_exits")
+
+// workerExits carries the unexpected exits of workers to the dispatcher, which
+// reports them to the server.
+var workerExits = make(chan workerExit, 16)
+
+// A workerExit describes the unexpected exit of a worker process.
+type workerExit struct {
+	worker  string
+	pid     int
+	class   string
+	status  string
+	restart bool
+	alert   bool
+}
+
+// An exitPolicy overrides, for one class of exits, whether a worker is
+// restarted and whether its exit raises an alert.
+type exitPolicy struct {
+	Restart *bool `toml:"restart"`
+	Alert   *bool `toml:"alert"`
+}
+
+// crashSignals are the signals a process receives for a fault of its own.
+var crashSignals = map[syscall.Signal]bool{
+	syscall.SIGABRT: true,
+	syscall.SIGBUS:  true,
+	syscall.SIGFPE:  true,
+	syscall.SIGILL:  true,
+	syscall.SIGSEGV: true,
+}
+
+// classifyExit returns the class of the exit of a worker process with state.
+// oomKilled reports whether the kernel killed a process of the worker for
+// exceeding its memory limit.
+func classifyExit(state *os.ProcessState, oomKilled bool) string {
+	if state == nil {
+		return exitCrash
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		switch {
+		case status.Signal() == syscall.SIGKILL && oomKilled:
+			return exitOOMKilled
+		case crashSignals[status.Signal()]:
+			return exitCrash
+		default:
+			return exitSignal
+		}
+	}
+	switch state.ExitCode() {
+	case 0:
+		return exitClean
+	case yggdrasil.ExitCodeConfigError:
+		return exitConfigError
+	default:
+		return exitCrash
+	}
+}
+
+// exitStatus describes state, as "exit status 1" or "signal: killed".
+func exitStatus(state *os.ProcessState) string {
+	if state == nil {
+		return "unknown status"
+	}
+	return state.String()
+}
+
+// restartOn reports whether a worker started from m is restarted after an
+// exit of class. The exit policy of class decides, if the manifest sets one;
+// otherwise a worker is not restarted after a configuration error, and is
+// after any other exit as its restart policy says. A nil manifest has the
+// default restart policy.
+func (m *workerManifest) restartOn(class string) bool {
+	restart := restartAlways
+	if m != nil {
+		if p, prs := m.OnExit[class]; prs && p.Restart != nil {
+			return *p.Restart
+		}
+		restart = m.Restart
+	}
+	if class == exitConfigError {
+		return false
+	}
+	switch restart {
+	case restartNever:
+		return false
+	case restartOnFailure:
+		return class != exitClean
+	default:
+		return true
+	}
+}
+
+// alertOn reports whether an exit of class of a worker started from m raises
+// an alert. The exit policy of class decides, if the manifest sets one;
+// otherwise crashes, OOM kills and configuration errors do.
+func (m *workerManifest) alertOn(class string) bool {
+	if m != nil {
+		if p, prs := m.OnExit[class]; prs && p.Alert != nil {
+			return *p.Alert
+		}
+	}
+	switch class {
+	case exitCrash, exitOOMKilled, exitConfigError:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportExit records the unexpected exit e of a worker in the metrics and the
+// log, and queues it for the dispatcher to report. An exit raising an alert is
+// also recorded as the last error of the dispatcher.
+func reportExit(e workerExit) {
+	workerExitMetrics.Add(e.class, 1)
+	if e.alert {
+		log.Errorf("worker %v exited with %v (%v); restarting: %v", e.worker, e.status, e.class, e.restart)
+		lasterror.Set(lasterror.Dispatcher, fmt.Errorf("worker %v exited with %v (%v)", e.worker, e.status, e.class))
+	} else {
+		log.Infof("worker %v exited with %v (%v); restarting: %v", e.worker, e.status, e.class, e.restart)
+	}
+
+	select {
+	case workerExits <- e:
+	default:
+		log.Warnf("cannot report exit of worker %v: too many exits pending", e.worker)
+	}
+}
+
+// reportWorkerExits publishes a "worker-exited" event for each unexpected
+// worker exit.
+func (d *dispatcher) reportWorkerExits() {
+	for e := range workerExits {
+		d.events <- yggdrasil.Event{
+			Type:      yggdrasil.MessageTypeEvent,
+			MessageID: uuid.New().String(),
+			Version:   1,
+			Sent:      time.Now(),
+			Content:   string(yggdrasil.EventNameWorkerExited),
+			Details: map[string]string{
+				"worker":  e.worker,
+				"pid":     strconv.Itoa(e.pid),
+				"class":   e.class,
+				"status":  e.status,
+				"restart": strconv.FormatBool(e.restart),
+				"alert":   strconv.FormatBool(e.alert),
+			},
+		}
+	}
+}
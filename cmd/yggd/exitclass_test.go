@@ -0,0 +1,150 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestClassifyExit(t *testing.T) {
+	tests := []struct {
+		description string
+		script      string
+		oomKilled   bool
+		want        string
+	}{
+		{
+			description: "clean",
+			script:      "exit 0",
+			want:        exitClean,
+		},
+		{
+			description: "failure",
+			script:      "exit 1",
+			want:        exitCrash,
+		},
+		{
+			description: "config error",
+			script:      "exit 78",
+			want:        exitConfigError,
+		},
+		{
+			description: "segmentation fault",
+			script:      "kill -SEGV $$",
+			want:        exitCrash,
+		},
+		{
+			description: "terminated",
+			script:      "kill -TERM $$",
+			want:        exitSignal,
+		},
+		{
+			description: "killed",
+			script:      "kill -KILL $$",
+			want:        exitSignal,
+		},
+		{
+			description: "OOM killed",
+			script:      "kill -KILL $$",
+			oomKilled:   true,
+			want:        exitOOMKilled,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cmd := exec.Command("/bin/sh", "-c", test.script)
+			cmd.Run()
+			if got := classifyExit(cmd.ProcessState, test.oomKilled); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExitPolicy(t *testing.T) {
+	yes, no := true, false
+	manifest := &workerManifest{
+		Restart: restartOnFailure,
+		OnExit: map[string]exitPolicy{
+			exitOOMKilled:   {Restart: &no},
+			exitConfigError: {Restart: &yes, Alert: &no},
+			exitSignal:      {Alert: &yes},
+		},
+	}
+
+	tests := []struct {
+		description string
+		manifest    *workerManifest
+		class       string
+		wantRestart bool
+		wantAlert   bool
+	}{
+		{
+			description: "no manifest, crash",
+			class:       exitCrash,
+			wantRestart: true,
+			wantAlert:   true,
+		},
+		{
+			description: "no manifest, clean",
+			class:       exitClean,
+			wantRestart: true,
+		},
+		{
+			description: "no manifest, config error",
+			class:       exitConfigError,
+			wantAlert:   true,
+		},
+		{
+			description: "on failure, clean",
+			manifest:    manifest,
+			class:       exitClean,
+		},
+		{
+			description: "on failure, crash",
+			manifest:    manifest,
+			class:       exitCrash,
+			wantRestart: true,
+			wantAlert:   true,
+		},
+		{
+			description: "overridden OOM kill",
+			manifest:    manifest,
+			class:       exitOOMKilled,
+			wantAlert:   true,
+		},
+		{
+			description: "overridden config error",
+			manifest:    manifest,
+			class:       exitConfigError,
+			wantRestart: true,
+		},
+		{
+			description: "overridden signal",
+			manifest:    manifest,
+			class:       exitSignal,
+			wantRestart: true,
+			wantAlert:   true,
+		},
+		{
+			description: "never",
+			manifest:    &workerManifest{Restart: restartNever},
+			class:       exitCrash,
+			wantAlert:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := test.manifest.restartOn(test.class); got != test.wantRestart {
+				t.Errorf("restart = %v, want %v", got, test.wantRestart)
+			}
+			if got := test.manifest.alertOn(test.class); got != test.wantAlert {
+				t.Errorf("alert = %v, want %v", got, test.wantAlert)
+			}
+		})
+	}
+}
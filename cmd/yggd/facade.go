@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// facadeMetrics holds the number of messages of each attached namespace
+// rejected for exceeding its quota, such as "insights.rejected".
+var facadeMetrics = expvar.NewMap("facades")
+
+// attachedPollInterval is the interval at which the dispatcher checks whether
+// the processes of attached products are still running.
+const attachedPollInterval = 10 * time.Second
+
+// parseFacades parses the namespaces local products may attach to, in the
+// form "NAMESPACE[=RATE[/BURST]]", where the optional rate limit, as parsed
+// by parseRate, is the quota of messages the product may publish. It returns
+// the set of namespaces and the quotas of those that have one.
+func parseFacades(values []string) (map[string]bool, map[string]*rateLimit, error) {
+	namespaces := make(map[string]bool)
+	quotas := make(map[string]*rateLimit)
+	for _, value := range values {
+		fields := strings.SplitN(value, "=", 2)
+		if fields[0] == "" || strings.ContainsAny(fields[0], "/ \t") {
+			return nil, nil, fmt.Errorf("invalid facade %q: expected NAMESPACE[=RATE[/BURST]]", value)
+		}
+		namespaces[fields[0]] = true
+		if len(fields) == 2 {
+			l, err := parseRate(fields[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid facade %q: %w", value, err)
+			}
+			quotas[fields[0]] = l
+		}
+	}
+	return namespaces, quotas, nil
+}
+
+// directiveNamespace returns the namespace of a directive in the form
+// "NAMESPACE/NAME", or the directive itself if it has no namespace.
+func directiveNamespace(directive string) string {
+	return strings.SplitN(directive, "/", 2)[0]
+}
+
+// lookupWorker returns the worker handling directive: the worker registered
+// for it or, for a directive in the form "NAMESPACE/NAME", the product
+// attached to its namespace.
+func (d *dispatcher) lookupWorker(directive string) (worker, bool) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if w, prs := d.workers[directive]; prs {
+		return w, true
+	}
+	if ns := directiveNamespace(directive); ns != directive {
+		if w, prs := d.workers[ns]; prs && w.namespace {
+			return w, true
+		}
+	}
+	return worker{}, false
+}
+
+// Attach implements the "Attach" method of the Dispatcher gRPC service. A
+// local product may only attach to a namespace allowed with --facade, and
+// only one product may attach to each namespace at a time.
+func (d *dispatcher) Attach(ctx context.Context, r *pb.AttachRequest) (*pb.RegistrationResponse, error) {
+	ns := r.GetNamespace()
+	if !d.facades[ns] {
+		log.Errorf("product failed to attach to namespace %v: namespace not allowed", ns)
+		return &pb.RegistrationResponse{Registered: false}, nil
+	}
+	if r.GetPid() <= 0 {
+		return nil, fmt.Errorf("invalid pid %v", r.GetPid())
+	}
+
+	w := worker{
+		pid:       int(r.GetPid()),
+		handler:   ns,
+		addr:      ipc.Addr(fmt.Sprintf("ygg-%v-%v", ns, randomString(6))),
+		features:  r.GetFeatures(),
+		version:   r.GetVersion(),
+		namespace: true,
+	}
+
+	d.Lock()
+	if _, prs := d.workers[ns]; prs {
+		d.Unlock()
+		log.Errorf("product failed to attach to namespace %v: already attached", ns)
+		return &pb.RegistrationResponse{Registered: false}, nil
+	}
+	d.workers[ns] = w
+	d.pidHandlers[w.pid] = ns
+	d.Unlock()
+
+	log.Infof("product attached: %+v", w)
+
+	go d.watchAttached(w.pid)
+
+	d.sendDispatchersMap()
+
+	return &pb.RegistrationResponse{Registered: true, Address: w.addr}, nil
+}
+
+// watchAttached waits for the process of an attached product, which was not
+// started by the dispatcher, to exit, and then unregisters it.
+func (d *dispatcher) watchAttached(pid int) {
+	for {
+		time.Sleep(attachedPollInterval)
+		if !processExists(pid) {
+			d.deadWorkers <- pid
+			return
+		}
+	}
+}
+
+// withinQuota reports whether data may be published under the quota of its
+// namespace. Data outside of a namespace with a quota is always within quota.
+func (d *dispatcher) withinQuota(directive string) bool {
+	ns := directiveNamespace(directive)
+	if ok, _ := d.quotas.allow(ns, time.Now(), false); !ok {
+		facadeMetrics.Add(ns+".rejected", 1)
+		return false
+	}
+	return true
+}
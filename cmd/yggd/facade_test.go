@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseFacades(t *testing.T) {
+	tests := []struct {
+		description    string
+		input          []string
+		wantNamespaces map[string]bool
+		wantQuotas     map[string][2]float64
+		wantError      bool
+	}{
+		{
+			description:    "namespaces",
+			input:          []string{"insights", "satellite=10/100"},
+			wantNamespaces: map[string]bool{"insights": true, "satellite": true},
+			wantQuotas:     map[string][2]float64{"satellite": {10, 100}},
+		},
+		{
+			description: "empty namespace",
+			input:       []string{"=10"},
+			wantError:   true,
+		},
+		{
+			description: "nested namespace",
+			input:       []string{"insights/upload"},
+			wantError:   true,
+		},
+		{
+			description: "invalid quota",
+			input:       []string{"insights=0"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			namespaces, quotas, err := parseFacades(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(namespaces, test.wantNamespaces) {
+					t.Errorf("%#v != %#v", namespaces, test.wantNamespaces)
+				}
+				got := make(map[string][2]float64, len(quotas))
+				for ns, l := range quotas {
+					got[ns] = [2]float64{l.rate, l.burst}
+				}
+				if !cmp.Equal(got, test.wantQuotas) {
+					t.Errorf("%#v != %#v", got, test.wantQuotas)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupWorker(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 1)
+	d.workers["echo"] = worker{handler: "echo"}
+	d.workers["insights"] = worker{handler: "insights", namespace: true}
+
+	tests := []struct {
+		directive string
+		want      string
+	}{
+		{directive: "echo", want: "echo"},
+		{directive: "insights", want: "insights"},
+		{directive: "insights/upload", want: "insights"},
+		{directive: "echo/upload", want: ""},
+		{directive: "unknown/upload", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.directive, func(t *testing.T) {
+			w, _ := d.lookupWorker(test.directive)
+			if w.handler != test.want {
+				t.Errorf("%v != %v", w.handler, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// fileFetchMetrics holds the number of "fetch-files" commands that "fetched"
+// files, that were "denied" by the policy and that otherwise "failed", and
+// the number of "files" uploaded.
+var fileFetchMetrics = expvar.NewMap("file_fetch")
+
+// errFileFetchDisabled is returned when files are fetched while no file is
+// allowed to be.
+var errFileFetchDisabled = fmt.Errorf("file fetching is disabled (no file-fetch-allow set)")
+
+// fileFetchAuditFile returns the path of the file the audit records of file
+// fetches are appended to.
+func fileFetchAuditFile() string {
+	return filepath.Join(yggdrasil.LocalstateDir, "log", yggdrasil.LongName, "file-fetch-audit.jsonl")
+}
+
+// A fileFetchPolicy decides which files of the host the server may fetch, and
+// redacts them before they leave the host.
+type fileFetchPolicy struct {
+	allow    []string
+	maxSize  int64
+	redactor *regexp.Regexp
+}
+
+// newFileFetchPolicy creates a fileFetchPolicy allowing the files matching
+// one of the absolute patterns in allow, as matched by filepath.Match, up to
+// maxSize bytes in total per fetch. The values of the keys containing,
+// regardless of case, one of redactions or of defaultMirrorRedactions are
+// redacted from the files.
+func newFileFetchPolicy(allow []string, maxSize int64, redactions []string) (*fileFetchPolicy, error) {
+	for _, pattern := range allow {
+		if !filepath.IsAbs(pattern) {
+			return nil, fmt.Errorf("pattern %q is not absolute", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maximum size must be positive")
+	}
+
+	var words []string
+	for _, r := range append(append([]string{}, defaultMirrorRedactions...), redactions...) {
+		words = append(words, regexp.QuoteMeta(strings.ToLower(r)))
+	}
+	redactor := regexp.MustCompile(`(?i)([\w.-]*(?:` + strings.Join(words, "|") + `)[\w.-]*["']?\s*[:=]\s*)("[^"]*"|'[^']*'|(?:bearer|basic)\s+\S+|\S+)`)
+	return &fileFetchPolicy{allow: allow, maxSize: maxSize, redactor: redactor}, nil
+}
+
+// allowed reports whether the file at path may be fetched.
+func (p *fileFetchPolicy) allowed(path string) bool {
+	for _, pattern := range p.allow {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns data with the values of the keys to redact, in "KEY=VALUE"
+// or "KEY: VALUE" form, replaced by mirrorRedacted, and the number of values
+// replaced.
+func (p *fileFetchPolicy) redact(data []byte) ([]byte, int) {
+	n := 0
+	redacted := p.redactor.ReplaceAllFunc(data, func(match []byte) []byte {
+		n++
+		return p.redactor.ReplaceAll(match, []byte("${1}"+mirrorRedacted))
+	})
+	return redacted, n
+}
+
+// A fileFetchAudit is a line of the file fetch audit file, recording a
+// "fetch-files" command and its outcome.
+type fileFetchAudit struct {
+	Time      time.Time     `json:"time"`
+	MessageID string        `json:"message_id"`
+	Requested []string      `json:"requested"`
+	Files     []fetchedFile `json:"files,omitempty"`
+	Denied    []string      `json:"denied,omitempty"`
+	URL       string        `json:"url,omitempty"`
+	Checksum  string        `json:"checksum,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// A fetchedFile is a file collected by a "fetch-files" command.
+type fetchedFile struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Redacted int    `json:"redacted,omitempty"`
+}
+
+// writeFileFetchAudit appends record to the file fetch audit file, created
+// readable only by its owner if it does not exist.
+func writeFileFetchAudit(record fileFetchAudit) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot marshal audit record: %w", err)
+	}
+	path := fileFetchAuditFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	return nil
+}
+
+// parseFetchPatterns parses the comma-separated absolute paths or patterns of
+// the "paths" argument of a "fetch-files" command.
+func parseFetchPatterns(arguments map[string]string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(arguments["paths"], ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !filepath.IsAbs(pattern) || filepath.Clean(pattern) != pattern {
+			return nil, fmt.Errorf("path %q is not absolute and clean", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("missing paths")
+	}
+	return patterns, nil
+}
+
+// collect writes the files matching patterns that the policy allows,
+// redacted, to a gzip compressed tar archive written to w, and records them
+// and those denied in audit. A file is denied unless both its path and the
+// path it resolves to once symbolic links are followed are allowed. Patterns
+// matching nothing and files that cannot be read are listed in errors.txt
+// rather than failing the fetch; it fails if no file is allowed, or if the
+// files exceed the maximum size.
+func (p *fileFetchPolicy) collect(patterns []string, w io.Writer, audit *fileFetchAudit) error {
+	gz := gzip.NewWriter(w)
+	b := &supportBundle{tw: tar.NewWriter(gz), modified: time.Now()}
+
+	var size int64
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			b.failed(pattern, fmt.Errorf("no such file"))
+			continue
+		}
+		for _, path := range matches {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+
+			if !p.allowed(path) {
+				audit.Denied = append(audit.Denied, path)
+				continue
+			}
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				b.failed(path, err)
+				continue
+			}
+			if !p.allowed(resolved) {
+				audit.Denied = append(audit.Denied, path)
+				continue
+			}
+			info, err := os.Stat(resolved)
+			if err != nil {
+				b.failed(path, err)
+				continue
+			}
+			if !info.Mode().IsRegular() {
+				b.failed(path, fmt.Errorf("not a regular file"))
+				continue
+			}
+			// The file may grow after it was examined, so its size is
+			// only known once read, up to one byte over the limit.
+			f, err := os.Open(resolved)
+			if err != nil {
+				b.failed(path, err)
+				continue
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(f, p.maxSize-size+1))
+			f.Close()
+			if err != nil {
+				b.failed(path, err)
+				continue
+			}
+			n := int64(len(data))
+			if size += n; size > p.maxSize {
+				return fmt.Errorf("files exceed %v bytes", p.maxSize)
+			}
+			data, redacted := p.redact(data)
+			if err := b.add(strings.TrimLeft(filepath.ToSlash(path), "/"), data); err != nil {
+				return err
+			}
+			audit.Files = append(audit.Files, fetchedFile{Path: path, Size: n, Redacted: redacted})
+		}
+	}
+	if len(audit.Files) == 0 {
+		if len(audit.Denied) > 0 {
+			return fmt.Errorf("files not allowed: %v", strings.Join(audit.Denied, ", "))
+		}
+		return fmt.Errorf("no files found")
+	}
+
+	if len(b.errors) > 0 {
+		if err := b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// fetchFiles collects the files the "fetch-files" command cmd requests into
+// an archive and uploads it through the data plane, under the upload URL
+// followed by the client ID and "files-" and the message ID of cmd, recording
+// the outcome in audit. It returns a reference to the uploaded archive.
+func (d *dispatcher) fetchFiles(cmd yggdrasil.Command, audit *fileFetchAudit) (yggdrasil.ContentReference, error) {
+	if d.fileFetch == nil {
+		return yggdrasil.ContentReference{}, errFileFetchDisabled
+	}
+	if d.uploadURL == "" {
+		return yggdrasil.ContentReference{}, errNoUploadURL
+	}
+	patterns, err := parseFetchPatterns(cmd.Content.Arguments)
+	if err != nil {
+		return yggdrasil.ContentReference{}, err
+	}
+	audit.Requested = patterns
+	URL, err := uploadURL(d.uploadURL, ClientID, "files-"+cmd.MessageID)
+	if err != nil {
+		return yggdrasil.ContentReference{}, err
+	}
+
+	f, err := ioutil.TempFile("", "yggdrasil-files-*.tar.gz")
+	if err != nil {
+		return yggdrasil.ContentReference{}, fmt.Errorf("cannot create file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := d.fileFetch.collect(patterns, f, audit); err != nil {
+		return yggdrasil.ContentReference{}, err
+	}
+	if err := f.Close(); err != nil {
+		return yggdrasil.ContentReference{}, fmt.Errorf("cannot write archive: %w", err)
+	}
+
+	d.transfers.wait()
+	ref, err := uploadFile(d.httpClient, URL, f.Name())
+	if err != nil {
+		return ref, fmt.Errorf("cannot upload files: %w", err)
+	}
+	audit.URL = ref.URL
+	audit.Checksum = ref.Checksum
+	return ref, nil
+}
+
+// fetchFilesCommand carries out the "fetch-files" command cmd, publishing a
+// "files-fetched" or "file-fetch-failed" event, and appends its audit record.
+func (d *dispatcher) fetchFilesCommand(t transport.Transport, cmd yggdrasil.Command) {
+	audit := fileFetchAudit{
+		Time:      time.Now().UTC(),
+		MessageID: cmd.MessageID,
+		Requested: []string{cmd.Content.Arguments["paths"]},
+	}
+	ref, err := d.fetchFiles(cmd, &audit)
+
+	event := yggdrasil.Event{
+		Type:           yggdrasil.MessageTypeEvent,
+		MessageID:      uuid.New().String(),
+		ResponseTo:     cmd.MessageID,
+		Version:        1,
+		Sent:           time.Now(),
+		OperationGroup: cmd.OperationGroup,
+		Details:        map[string]string{},
+	}
+	if len(audit.Denied) > 0 {
+		event.Details["denied"] = strings.Join(audit.Denied, ",")
+	}
+	if err != nil {
+		audit.Error = err.Error()
+		if err == errFileFetchDisabled || len(audit.Denied) > 0 && len(audit.Files) == 0 {
+			fileFetchMetrics.Add("denied", 1)
+		} else {
+			fileFetchMetrics.Add("failed", 1)
+		}
+		log.Errorf("cannot fetch files: %v", err)
+		event.Content = string(yggdrasil.EventNameFileFetchFailed)
+		event.Details["error"] = err.Error()
+	} else {
+		fileFetchMetrics.Add("fetched", 1)
+		fileFetchMetrics.Add("files", int64(len(audit.Files)))
+		log.Infof("uploaded %v files to %v", len(audit.Files), ref.URL)
+		event.Content = string(yggdrasil.EventNameFilesFetched)
+		event.Details["url"] = ref.URL
+		event.Details["checksum"] = ref.Checksum
+		event.Details["size"] = strconv.FormatInt(ref.Size, 10)
+		event.Details["files"] = strconv.Itoa(len(audit.Files))
+	}
+	if err := writeFileFetchAudit(audit); err != nil {
+		log.Errorf("cannot write file fetch audit record: %v", err)
+	}
+	if err := t.SendControl(event); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseFetchPatterns(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []string
+		wantError   bool
+	}{
+		{
+			description: "paths and patterns",
+			input:       "/var/log/foo/*.log, /etc/foo.conf",
+			want:        []string{"/var/log/foo/*.log", "/etc/foo.conf"},
+		},
+		{
+			description: "missing",
+			input:       " , ",
+			wantError:   true,
+		},
+		{
+			description: "relative",
+			input:       "var/log/messages",
+			wantError:   true,
+		},
+		{
+			description: "parent directory",
+			input:       "/var/log/foo/../../../etc/shadow",
+			wantError:   true,
+		},
+		{
+			description: "invalid pattern",
+			input:       "/var/log/[",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseFetchPatterns(map[string]string{"paths": test.input})
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestFileFetchPolicyRedact(t *testing.T) {
+	p, err := newFileFetchPolicy([]string{"/var/log/*"}, 1024, []string{"apikey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantCount   int
+	}{
+		{
+			description: "key value",
+			input:       "user=admin password=hunter2 retries=3",
+			want:        "user=admin password=REDACTED retries=3",
+			wantCount:   1,
+		},
+		{
+			description: "JSON",
+			input:       `{"api_token": "abc def", "name": "foo"}`,
+			want:        `{"api_token": REDACTED, "name": "foo"}`,
+			wantCount:   1,
+		},
+		{
+			description: "header",
+			input:       "Authorization: Bearer abc\nCookie: a=b",
+			want:        "Authorization: REDACTED\nCookie: REDACTED",
+			wantCount:   2,
+		},
+		{
+			description: "additional redaction",
+			input:       "APIKEY = 1234",
+			want:        "APIKEY = REDACTED",
+			wantCount:   1,
+		},
+		{
+			description: "nothing to redact",
+			input:       "started worker echo",
+			want:        "started worker echo",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, n := p.redact([]byte(test.input))
+			if string(got) != test.want {
+				t.Errorf("%#v", cmp.Diff(string(got), test.want))
+			}
+			if n != test.wantCount {
+				t.Errorf("redacted %v values, want %v", n, test.wantCount)
+			}
+		})
+	}
+}
+
+func TestFileFetchPolicyCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-filefetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logDir := filepath.Join(dir, "log")
+	if err := os.Mkdir(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(logDir, "a.log"): "token=abc\nstarted\n",
+		filepath.Join(logDir, "b.log"): "stopped\n",
+		filepath.Join(dir, "secret"):   "hunter2\n",
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link in an allowed directory must not expose a file outside of it.
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(logDir, "c.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newFileFetchPolicy([]string{filepath.Join(logDir, "*.log")}, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	var audit fileFetchAudit
+	patterns := []string{filepath.Join(logDir, "*"), filepath.Join(dir, "secret"), filepath.Join(dir, "missing")}
+	if err := p.collect(patterns, &buf, &audit); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	errors := got["errors.txt"]
+	delete(got, "errors.txt")
+	want := map[string]string{
+		strings.TrimLeft(filepath.ToSlash(filepath.Join(logDir, "a.log")), "/"): "token=REDACTED\nstarted\n",
+		strings.TrimLeft(filepath.ToSlash(filepath.Join(logDir, "b.log")), "/"): "stopped\n",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+	if !strings.Contains(errors, "missing: no such file") {
+		t.Errorf("errors.txt = %q", errors)
+	}
+	wantDenied := []string{filepath.Join(logDir, "c.log"), filepath.Join(dir, "secret")}
+	if !cmp.Equal(audit.Denied, wantDenied) {
+		t.Errorf("%#v", cmp.Diff(audit.Denied, wantDenied))
+	}
+	if len(audit.Files) != 2 || audit.Files[0].Redacted != 1 {
+		t.Errorf("files = %#v", audit.Files)
+	}
+
+	if err := p.collect([]string{filepath.Join(dir, "secret")}, ioutil.Discard, &fileFetchAudit{}); err == nil {
+		t.Error("denied file fetched")
+	}
+	small, err := newFileFetchPolicy([]string{filepath.Join(logDir, "*.log")}, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := small.collect([]string{filepath.Join(logDir, "*.log")}, ioutil.Discard, &fileFetchAudit{}); err == nil {
+		t.Error("files exceeding the maximum size fetched")
+	}
+}
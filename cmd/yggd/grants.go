@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/grants"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// grantMetrics holds the number of grants "accepted" and "rejected", and the
+// number of messages "denied" for restricted directives without an active
+// grant.
+var grantMetrics = expvar.NewMap("grants")
+
+// grantKeysDir returns the directory holding the public keys trusted to sign
+// grants, each a PEM encoded Ed25519 public key in a ".pem" file.
+func grantKeysDir() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "grant-keys.d")
+}
+
+// directiveGrants holds the restricted directives, which are only dispatched
+// while a grant allows them, and the expiry of the active grants.
+type directiveGrants struct {
+	lock        sync.Mutex
+	restricted  map[string]bool
+	maxDuration time.Duration
+	expires     map[string]time.Time
+}
+
+// newDirectiveGrants restricts directives, which may name a single directive
+// or a namespace of directives, to be dispatched only while granted, for at
+// most maxDuration at a time.
+func newDirectiveGrants(directives []string, maxDuration time.Duration) *directiveGrants {
+	g := &directiveGrants{
+		restricted:  make(map[string]bool, len(directives)),
+		maxDuration: maxDuration,
+		expires:     make(map[string]time.Time),
+	}
+	for _, directive := range directives {
+		g.restricted[directive] = true
+	}
+	return g
+}
+
+// restriction returns the restricted directive or namespace directive belongs
+// to, or an empty string if it is not restricted.
+func (g *directiveGrants) restriction(directive string) string {
+	if g.restricted[directive] {
+		return directive
+	}
+	if ns := directiveNamespace(directive); g.restricted[ns] {
+		return ns
+	}
+	return ""
+}
+
+// allowed reports whether messages for directive may be dispatched at now:
+// directives that are not restricted always may, as may everything with a nil
+// directiveGrants.
+func (g *directiveGrants) allowed(directive string, now time.Time) bool {
+	if g == nil {
+		return true
+	}
+	key := g.restriction(directive)
+	if key == "" {
+		return true
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return now.Before(g.expires[key])
+}
+
+// add activates grant at now, until it expires.
+func (g *directiveGrants) add(grant grants.Grant, now time.Time) error {
+	if g == nil || !g.restricted[grant.Directive] {
+		return fmt.Errorf("directive %v is not restricted", grant.Directive)
+	}
+	if grant.ClientID != "" && grant.ClientID != ClientID {
+		return fmt.Errorf("grant is for client %v", grant.ClientID)
+	}
+	if grant.NotAfter.Sub(grant.NotBefore) > g.maxDuration {
+		return fmt.Errorf("grant lasts longer than %v", g.maxDuration)
+	}
+	if now.Before(grant.NotBefore) || !now.Before(grant.NotAfter) {
+		return fmt.Errorf("grant is not valid now")
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if grant.NotAfter.After(g.expires[grant.Directive]) {
+		g.expires[grant.Directive] = grant.NotAfter
+	}
+	return nil
+}
+
+// applyGrant verifies signed against the trusted grant keys and activates the
+// grant it holds.
+func (d *dispatcher) applyGrant(signed grants.Signed) error {
+	keys, err := readPublicKeys(grantKeysDir())
+	if err != nil {
+		return fmt.Errorf("cannot read grant keys: %w", err)
+	}
+	grant, err := grants.Verify(signed, keys)
+	if err == nil {
+		err = d.grants.add(grant, time.Now())
+	}
+	if err != nil {
+		grantMetrics.Add("rejected", 1)
+		log.Warnf("rejected grant: %v", err)
+		return err
+	}
+	grantMetrics.Add("accepted", 1)
+	log.Infof("directive %v granted by %v until %v", grant.Directive, grant.Approver, grant.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Grant implements the "Grant" method of the Dispatcher gRPC service.
+func (d *dispatcher) Grant(ctx context.Context, r *pb.GrantRequest) (*pb.Empty, error) {
+	if err := d.applyGrant(grants.Signed{Grant: r.GetGrant(), Signature: r.GetSignature()}); err != nil {
+		return nil, fmt.Errorf("cannot apply grant: %w", err)
+	}
+	return &pb.Empty{}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil/internal/grants"
+)
+
+func TestDirectiveGrants(t *testing.T) {
+	now := time.Now()
+	g := newDirectiveGrants([]string{"package-manager", "insights"}, time.Hour)
+
+	if !g.allowed("echo", now) {
+		t.Fatal("unrestricted directive not allowed")
+	}
+	if g.allowed("package-manager", now) || g.allowed("insights/upload", now) {
+		t.Fatal("restricted directive allowed without grant")
+	}
+
+	tests := []struct {
+		description string
+		grant       grants.Grant
+		wantError   bool
+	}{
+		{
+			description: "unrestricted directive",
+			grant:       grants.Grant{Directive: "echo", NotBefore: now, NotAfter: now.Add(time.Minute)},
+			wantError:   true,
+		},
+		{
+			description: "too long",
+			grant:       grants.Grant{Directive: "package-manager", NotBefore: now, NotAfter: now.Add(2 * time.Hour)},
+			wantError:   true,
+		},
+		{
+			description: "expired",
+			grant:       grants.Grant{Directive: "package-manager", NotBefore: now.Add(-time.Hour), NotAfter: now.Add(-time.Minute)},
+			wantError:   true,
+		},
+		{
+			description: "other client",
+			grant:       grants.Grant{Directive: "package-manager", ClientID: "other", NotBefore: now, NotAfter: now.Add(time.Minute)},
+			wantError:   true,
+		},
+		{
+			description: "namespace",
+			grant:       grants.Grant{Directive: "insights", NotBefore: now, NotAfter: now.Add(time.Minute)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := g.add(test.grant, now)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if !g.allowed("insights/upload", now) {
+		t.Error("granted namespace not allowed")
+	}
+	if g.allowed("insights/upload", now.Add(2*time.Minute)) {
+		t.Error("granted namespace allowed after grant expired")
+	}
+	if g.allowed("package-manager", now) {
+		t.Error("restricted directive allowed after rejected grants")
+	}
+}
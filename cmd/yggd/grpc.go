@@ -2,25 +2,97 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"hash/fnv"
 	"net/url"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
 	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/clock"
+	"github.com/redhatinsights/yggdrasil/internal/idtoken"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/logging"
+	"github.com/redhatinsights/yggdrasil/internal/tracing"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
 	pb "github.com/redhatinsights/yggdrasil/protocol"
-	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// maxRetryInterval is the upper bound of the delay between two delivery
+// attempts of the same message.
+const maxRetryInterval = 5 * time.Minute
+
 type worker struct {
 	pid             int
 	handler         string
 	addr            string
 	features        map[string]string
 	detachedContent bool
+	ordered         bool
+	topics          []string
+	version         string
+	coalesce        bool
+	localContent    bool
+
+	// namespace indicates the worker is a local product attached to the
+	// namespace of directives named after its handler.
+	namespace bool
+
+	// vm indicates the worker runs in the virtual machine with context ID
+	// cid and registered over a VM socket. Its pid is a pseudo PID; guestPID
+	// is its PID in the guest.
+	vm       bool
+	cid      uint32
+	guestPID int
+}
+
+// handles reports whether directive is routed to w: it is the handler of w,
+// or in the namespace w is attached to.
+func (w worker) handles(directive string) bool {
+	return directive == w.handler || (w.namespace && directiveNamespace(directive) == w.handler)
+}
+
+// callerPID returns the PID the worker registered with: its PID on the host,
+// or in its guest if it runs in a virtual machine.
+func (w worker) callerPID() int {
+	if w.vm {
+		return w.guestPID
+	}
+	return w.pid
+}
+
+// A coalescer holds the message being dispatched to a coalescing worker and
+// the single most recent message waiting behind it.
+type coalescer struct {
+	busy    bool
+	pending *yggdrasil.Data
+}
+
+// A workerQueue holds the messages waiting for a worker that requires in-order
+// delivery. It is stopped by closing done when the worker unregisters.
+type workerQueue struct {
+	data chan yggdrasil.Data
+	done chan struct{}
+}
+
+// A subscription is a request to subscribe to, or unsubscribe from, an
+// additional transport topic on behalf of the worker handling directive.
+type subscription struct {
+	topic     string
+	directive string
+	remove    bool
 }
 
 type dispatcher struct {
@@ -28,22 +100,178 @@ type dispatcher struct {
 	sync.RWMutex
 	dispatchers chan map[string]map[string]string
 	sendQ       chan yggdrasil.Data
+	sendHighQ   chan yggdrasil.Data
+	sendLowQ    chan yggdrasil.Data
 	recvQ       chan yggdrasil.Data
+	events      chan yggdrasil.Event
 	deadWorkers chan int
 	workers     map[string]worker
 	pidHandlers map[int]string
 	httpClient  *http.Client
+	queues      map[string]*workerQueue
+	sequences   map[string]uint64
+	coalescers  map[string]*coalescer
+
+	// paused holds the data received for each paused directive, in the order
+	// it was received.
+	paused map[string][]yggdrasil.Data
+
+	// resuming holds the generation of the resumption draining the data held
+	// for each resumed directive; the directive stays in paused, so that new
+	// data is held behind it, until it is drained.
+	resuming map[string]uint64
+	resumes  uint64
+
+	// echoTests tracks the echo tests in progress by test message ID.
+	echoTests map[string]*echoTest
+
+	// subscriptions receives requests to subscribe to the additional topics
+	// workers declare during registration.
+	subscriptions chan subscription
+
+	// maxAttempts is the number of times delivery of a message to a worker is
+	// attempted before it is dropped.
+	maxAttempts int
+
+	// retryInterval is the delay before the first delivery retry; it doubles
+	// with every subsequent attempt.
+	retryInterval time.Duration
+
+	// schemas validates the content of data messages before dispatch.
+	schemas *contentSchemas
+
+	// tags holds the tags of each scope.
+	tags *scopedTags
+
+	// messageKeys are the keys trusted to sign server messages. Messages are
+	// not verified if there are none.
+	messageKeys []ed25519.PublicKey
+
+	// tempDirs provides the temporary directory of each message dispatched
+	// to a worker, if enabled.
+	tempDirs *tempDirs
+
+	// transfers decides when detached content may be downloaded or uploaded.
+	transfers *transferPolicy
+
+	// heldTransfers holds the data waiting for bulk transfers to be
+	// permitted, in the order it was received.
+	heldTransfers    []yggdrasil.Data
+	transfersWaiting bool
+
+	// env holds the variables set for each directive by the server.
+	env *workerEnv
+
+	// groups remembers the operation group of received messages.
+	groups *messageTable
+
+	// inflight remembers the directive of messages dispatched to workers, until
+	// the worker responds to them.
+	inflight *messageTable
+
+	// expiries cancels messages that workers have not responded to by their
+	// deadline.
+	expiries *clock.Schedule
+
+	// uploadURL is the base URL files offloaded from worker messages are
+	// uploaded to.
+	uploadURL string
+
+	// queuePolicy decides what happens to messages when a queue is full or a
+	// rate limit is exceeded.
+	queuePolicy QueuePolicy
+
+	// limiter applies the rate limit of each directive.
+	limiter *rateLimiter
+
+	// deferred is the number of messages waiting for a rate limit, queued in
+	// deferredQ by directive.
+	deferred  int
+	deferredQ map[string][]deferredData
+
+	// concurrency bounds the messages in flight to each directive.
+	concurrency *concurrencyLimiter
+
+	// spool stores the data messages published while disconnected, if
+	// enabled.
+	spool *spool
+
+	// fileFetch decides which files the server may fetch. It is nil if no
+	// file may be fetched.
+	fileFetch *fileFetchPolicy
+
+	// scheduler holds the data messages received before they may be
+	// dispatched.
+	scheduler *messageScheduler
+
+	// facades holds the namespaces local products may attach to.
+	facades map[string]bool
+
+	// quotas applies the publishing quota of each namespace.
+	quotas *rateLimiter
+
+	// grants holds the restricted directives and their active grants.
+	grants *directiveGrants
+
+	// identity signs the identity tokens requested by workers. It is nil
+	// if yggd has no client certificate.
+	identity *idtoken.Issuer
+
+	// credentialLifetime is how long the credentials requested by workers
+	// are valid.
+	credentialLifetime time.Duration
+
+	// routes holds the rules routing directives to other handlers.
+	routes []route
+
+	// broadcasts tracks the delivery of broadcast messages to each worker.
+	broadcasts *broadcastTracker
+
+	// correlations tracks the delivery state of received messages, and the
+	// responses of workers to them.
+	correlations *correlationTable
+
+	// messageStateEvents reports whether changes of the delivery state of
+	// received messages are published as events.
+	messageStateEvents bool
+
+	// lastPublished holds the time a data message was last published
+	// successfully.
+	lastPublished atomic.Value
+
+	// socketAddr is the address of the dispatcher socket, persisted with the
+	// worker registrations so that reattached workers can reach it.
+	socketAddr string
 }
 
-func newDispatcher(httpClient *http.Client) *dispatcher {
+func newDispatcher(httpClient *http.Client, maxAttempts int, retryInterval time.Duration, queueSize int) *dispatcher {
 	return &dispatcher{
-		dispatchers: make(chan map[string]map[string]string),
-		sendQ:       make(chan yggdrasil.Data),
-		recvQ:       make(chan yggdrasil.Data),
-		deadWorkers: make(chan int),
-		workers:     make(map[string]worker),
-		pidHandlers: make(map[int]string),
-		httpClient: httpClient,
+		dispatchers:   make(chan map[string]map[string]string),
+		sendQ:         make(chan yggdrasil.Data, queueSize),
+		sendHighQ:     make(chan yggdrasil.Data, queueSize),
+		sendLowQ:      make(chan yggdrasil.Data, queueSize),
+		recvQ:         make(chan yggdrasil.Data, queueSize),
+		events:        make(chan yggdrasil.Event),
+		subscriptions: make(chan subscription),
+		deadWorkers:   make(chan int),
+		workers:       make(map[string]worker),
+		pidHandlers:   make(map[int]string),
+		httpClient:    httpClient,
+		queues:        make(map[string]*workerQueue),
+		sequences:     make(map[string]uint64),
+		coalescers:    make(map[string]*coalescer),
+		paused:        make(map[string][]yggdrasil.Data),
+		resuming:      make(map[string]uint64),
+		deferredQ:     make(map[string][]deferredData),
+		echoTests:     make(map[string]*echoTest),
+		groups:        newMessageTable(maxOperationGroups),
+		inflight:      newMessageTable(maxInflightMessages),
+		broadcasts:    newBroadcastTracker(),
+		correlations:  newCorrelationTable(maxTrackedMessages),
+		expiries:      clock.NewSchedule(clock.System),
+		tags:          newScopedTags(yggdrasil.TagsFilePath(), serverTagsFile()),
+		maxAttempts:   maxAttempts,
+		retryInterval: retryInterval,
 	}
 }
 
@@ -56,27 +284,203 @@ func (d *dispatcher) Register(ctx context.Context, r *pb.RegistrationRequest) (*
 	}
 	d.RUnlock()
 
+	pid := int(r.GetPid())
+	addr := ipc.Addr(fmt.Sprintf("ygg-%v-%v", r.GetHandler(), randomString(6)))
+	cid, vm := peerVsockCID(ctx)
+	if vm {
+		// The PID of a worker in a virtual machine may also be the PID
+		// of a process on the host, and the dispatcher connects to it
+		// over a VM socket.
+		pid = nextVMPID()
+		addr = vmWorkerAddr(cid)
+	}
+
+	detachedContent := r.GetDetachedContent()
+	if m := manifestForPID(pid); m != nil {
+		if m.Directive != "" && m.Directive != r.GetHandler() {
+			log.Errorf("worker failed to register for handler %v: manifest requires handler %v", r.GetHandler(), m.Directive)
+			return &pb.RegistrationResponse{Registered: false}, nil
+		}
+		detachedContent = detachedContent || m.RemoteContent
+	}
+
 	w := worker{
-		pid:             int(r.GetPid()),
+		pid:             pid,
 		handler:         r.GetHandler(),
-		addr:            fmt.Sprintf("@ygg-%v-%v", r.GetHandler(), randomString(6)),
+		addr:            addr,
 		features:        r.GetFeatures(),
-		detachedContent: r.GetDetachedContent(),
+		detachedContent: detachedContent,
+		ordered:         r.GetOrdered(),
+		version:         r.GetVersion(),
+		coalesce:        r.GetCoalesce(),
+		localContent:    r.GetLocalContent(),
+	}
+	if vm {
+		w.vm = true
+		w.cid = cid
+		w.guestPID = int(r.GetPid())
 	}
 
 	d.Lock()
+	for _, topic := range r.GetTopics() {
+		if handler := d.topicOwner(topic); handler != "" {
+			log.Warnf("cannot subscribe worker %v to topic %v: already subscribed by worker %v", w.handler, topic, handler)
+			continue
+		}
+		w.topics = append(w.topics, topic)
+	}
 	d.workers[r.GetHandler()] = w
-	d.pidHandlers[int(r.GetPid())] = r.GetHandler()
+	d.pidHandlers[pid] = r.GetHandler()
 	d.Unlock()
 
 	log.Infof("worker registered: %+v", w)
+	if !vm {
+		if err := createUploadDir(w); err != nil {
+			log.Errorf("cannot create upload directory of worker %v: %v", w.handler, err)
+		}
+	}
+	d.saveRegistry()
+	if vm {
+		go d.watchVM(pid, addr)
+	}
+
+	for _, topic := range w.topics {
+		d.subscriptions <- subscription{topic: topic, directive: w.handler}
+	}
 
 	d.sendDispatchersMap()
 
 	return &pb.RegistrationResponse{Registered: true, Address: w.addr}, nil
 }
 
+// UpdateFeatures implements the "UpdateFeatures" method of the Dispatcher gRPC
+// service. The new features are published to the server in a
+// connection-status message.
+func (d *dispatcher) UpdateFeatures(ctx context.Context, r *pb.UpdateFeaturesRequest) (*pb.Empty, error) {
+	d.Lock()
+	w, prs := d.workers[r.GetHandler()]
+	if !prs || w.callerPID() != int(r.GetPid()) {
+		d.Unlock()
+		return nil, fmt.Errorf("no worker with pid %v registered for handler %v", r.GetPid(), r.GetHandler())
+	}
+	w.features = r.GetFeatures()
+	d.workers[r.GetHandler()] = w
+	d.Unlock()
+
+	log.Infof("worker %v updated features: %v", w.handler, w.features)
+	d.saveRegistry()
+
+	d.sendDispatchersMap()
+
+	return &pb.Empty{}, nil
+}
+
+// GetFacts implements the "GetFacts" method of the Dispatcher gRPC service,
+// returning the same facts as are published in connection-status messages.
+// Only registered workers may call it.
+func (d *dispatcher) GetFacts(ctx context.Context, r *pb.Empty) (*pb.FactsResponse, error) {
+	if !d.calledByWorker(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "facts are only available to registered workers; use the admin API")
+	}
+	canonicalFacts, facts, err := collectFacts()
+	if err != nil {
+		return nil, err
+	}
+
+	var response pb.FactsResponse
+	if response.CanonicalFacts, err = json.Marshal(canonicalFacts); err != nil {
+		return nil, fmt.Errorf("cannot marshal canonical facts: %w", err)
+	}
+	if response.Facts, err = json.Marshal(facts); err != nil {
+		return nil, fmt.Errorf("cannot marshal facts: %w", err)
+	}
+	return &response, nil
+}
+
+// collectFacts returns the canonical facts and the additional facts collected
+// from the facts directory.
+func collectFacts() (*yggdrasil.CanonicalFacts, map[string]interface{}, error) {
+	canonicalFacts, err := yggdrasil.GetCanonicalFacts()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get canonical facts: %w", err)
+	}
+	facts, err := yggdrasil.CollectFacts(yggdrasil.FactsDirPath())
+	if err != nil {
+		log.Errorf("cannot collect facts from '%v': %v", yggdrasil.FactsDirPath(), err)
+	}
+	return canonicalFacts, facts, nil
+}
+
+// calledByWorker reports whether the call of ctx was made by the process of a
+// registered worker.
+func (d *dispatcher) calledByWorker(ctx context.Context) bool {
+	_, ok := d.callerWorker(ctx)
+	return ok
+}
+
+// callerWorker returns the registered worker making the call of ctx.
+func (d *dispatcher) callerWorker(ctx context.Context) (worker, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	if cid, ok := peerVsockCID(ctx); ok {
+		for _, w := range d.workers {
+			if w.vm && w.cid == cid {
+				return w, true
+			}
+		}
+		return worker{}, false
+	}
+	pid, ok := peerPID(ctx)
+	if !ok {
+		return worker{}, false
+	}
+	handler, prs := d.pidHandlers[pid]
+	if !prs {
+		return worker{}, false
+	}
+	return d.workers[handler], true
+}
+
+// openWorkerUpload opens the file at filePath that the worker making the call
+// of ctx asked to offload, if it is in the upload directory of the worker.
+func (d *dispatcher) openWorkerUpload(ctx context.Context, filePath string) (*os.File, error) {
+	if !d.calledByWorker(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "files are only offloaded for registered workers")
+	}
+	if _, ok := peerVsockCID(ctx); ok {
+		return nil, fmt.Errorf("files are not offloaded for workers in virtual machines")
+	}
+	pid, _ := peerPID(ctx)
+	d.RLock()
+	w := d.workers[d.pidHandlers[pid]]
+	d.RUnlock()
+	uid, err := workerUID(w)
+	if err != nil {
+		return nil, err
+	}
+	return openUpload(yggdrasil.WorkerUploadDir(w.handler), uid, filePath)
+}
+
+// GetTags implements the "GetTags" method of the Dispatcher gRPC service,
+// returning the same tags as are published in connection-status messages.
+// Only registered workers may call it.
+func (d *dispatcher) GetTags(ctx context.Context, r *pb.Empty) (*pb.TagsResponse, error) {
+	if !d.calledByWorker(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "tags are only available to registered workers")
+	}
+	tagMap, err := d.tags.merged()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.TagsResponse{Tags: tagMap}, nil
+}
+
 func (d *dispatcher) Send(ctx context.Context, r *pb.Data) (*pb.Receipt, error) {
+	if err := checkWorkerData(r); err != nil {
+		e := fmt.Errorf("cannot publish message %v: %w", r.GetMessageId(), err)
+		log.Error(e)
+		return nil, e
+	}
 	data := yggdrasil.Data{
 		Type:       yggdrasil.MessageTypeData,
 		MessageID:  r.GetMessageId(),
@@ -87,6 +491,17 @@ func (d *dispatcher) Send(ctx context.Context, r *pb.Data) (*pb.Receipt, error)
 		Metadata:   r.GetMetadata(),
 		Content:    r.GetContent(),
 	}
+	data.OperationGroup = data.Metadata[yggdrasil.MetadataKeyOperationGroup]
+	if data.OperationGroup == "" {
+		data.OperationGroup = d.groups.get(data.ResponseTo)
+	}
+	d.groups.set(data.MessageID, data.OperationGroup)
+	d.inflight.remove(data.ResponseTo)
+	if w, ok := d.callerWorker(ctx); ok {
+		d.concurrency.releaseIf(data.ResponseTo, w.handles)
+	}
+	d.messageResponded(data)
+	d.expiries.Stop(data.ResponseTo)
 
 	URL, err := url.Parse(data.Directive)
 	if err != nil {
@@ -96,16 +511,58 @@ func (d *dispatcher) Send(ctx context.Context, r *pb.Data) (*pb.Receipt, error)
 	}
 
 	if URL.Scheme == "" {
-		d.recvQ <- data
+		if !d.withinQuota(data.Directive) {
+			e := fmt.Errorf("cannot publish message %v: quota of namespace %v exceeded", data.MessageID, directiveNamespace(data.Directive))
+			log.Warn(e)
+			return nil, e
+		}
+		w, prs := d.lookupWorker(data.Directive)
+		if prs && w.ordered {
+			data.Metadata = d.sequenceMetadata(w.handler+"/out", data.Metadata)
+		}
+		if filePath := data.Metadata[yggdrasil.MetadataKeyContentPath]; filePath != "" {
+			if d.uploadURL == "" {
+				e := fmt.Errorf("cannot offload message content: no upload URL configured")
+				log.Error(e)
+				return nil, e
+			}
+			f, err := d.openWorkerUpload(ctx, filePath)
+			if err != nil {
+				e := fmt.Errorf("cannot offload message content: %w", err)
+				log.Error(e)
+				return nil, e
+			}
+			go d.offload(data, f)
+			return &pb.Receipt{}, nil
+		}
+		d.echoTestResponded(data)
+		if !d.enqueue(d.recvQ, "receive", data) {
+			e := fmt.Errorf("cannot publish message %v: receive queue is full", data.MessageID)
+			lasterror.Set(lasterror.Dispatcher, e)
+			return nil, e
+		}
 	} else {
 		if yggdrasil.DataHost != "" {
 			URL.Host = yggdrasil.DataHost
 		}
+		if !d.transfers.allowed(time.Now()) {
+			log.Debugf("holding upload of message %v until bulk transfers are permitted", data.MessageID)
+			go func() {
+				d.transfers.wait()
+				if err := d.httpClient.Post(URL.String(), data.Metadata, data.Content); err != nil {
+					log.Errorf("cannot post detached message content: %v", err)
+					lasterror.Set(lasterror.DataPlane, err)
+				}
+			}()
+			return &pb.Receipt{}, nil
+		}
 		if err := d.httpClient.Post(URL.String(), data.Metadata, data.Content); err != nil {
 			e := fmt.Errorf("cannot post detached message content: %w", err)
 			log.Error(e)
+			lasterror.Set(lasterror.DataPlane, e)
 			return nil, e
 		}
+		d.tempDirs.remove(data.ResponseTo)
 	}
 	log.Debugf("received message %v", data.MessageID)
 	log.Tracef("message: %+v", data.Content)
@@ -113,81 +570,748 @@ func (d *dispatcher) Send(ctx context.Context, r *pb.Data) (*pb.Receipt, error)
 	return &pb.Receipt{}, nil
 }
 
-// sendData receives values on a channel and sends the data over gRPC
-func (d *dispatcher) sendData() {
-	for data := range d.sendQ {
-		f := func() {
-			d.RLock()
-			w, prs := d.workers[data.Directive]
-			d.RUnlock()
+// pause holds the data received for directive until it is resumed.
+func (d *dispatcher) pause(directive string) error {
+	if directive == "" {
+		return fmt.Errorf("missing directive")
+	}
 
-			if !prs {
-				log.Warnf("cannot route message to directive: %v", data.Directive)
-				return
-			}
+	d.Lock()
+	if _, prs := d.paused[directive]; !prs {
+		d.paused[directive] = []yggdrasil.Data{}
+	}
+	delete(d.resuming, directive)
+	d.Unlock()
+	log.Infof("paused directive %v", directive)
 
-			if w.detachedContent {
-				var urlString string
-				if err := json.Unmarshal(data.Content, &urlString); err != nil {
-					log.Errorf("cannot unmarshal message content: %v", err)
-					return
-				}
-				URL, err := url.Parse(urlString)
-				if err != nil {
-					log.Errorf("cannot parse message content as URL: %v", err)
-					return
+	d.sendDispatchersMap()
+
+	return nil
+}
+
+// resume dispatches the data held while directive was paused, in the order
+// it was received, before any data received since.
+func (d *dispatcher) resume(directive string) error {
+	d.Lock()
+	held, prs := d.paused[directive]
+	_, resuming := d.resuming[directive]
+	if !prs || resuming {
+		d.Unlock()
+		return fmt.Errorf("directive %v is not paused", directive)
+	}
+	d.resumes++
+	generation := d.resumes
+	d.resuming[directive] = generation
+	d.Unlock()
+
+	log.Infof("resumed directive %v; dispatching %v held messages", directive, len(held))
+	go d.drainHeld(directive, generation)
+
+	d.sendDispatchersMap()
+
+	return nil
+}
+
+// drainHeld dispatches the data held for directive one message at a time,
+// including data held while it drains, until none is left, then stops holding
+// data for directive. It returns early if the directive is paused again,
+// ending the resumption of the given generation.
+func (d *dispatcher) drainHeld(directive string, generation uint64) {
+	for {
+		d.Lock()
+		if d.resuming[directive] != generation {
+			d.Unlock()
+			return
+		}
+		held := d.paused[directive]
+		if len(held) == 0 {
+			delete(d.paused, directive)
+			delete(d.resuming, directive)
+			d.Unlock()
+			return
+		}
+		data := held[0]
+		d.paused[directive] = held[1:]
+		d.Unlock()
+
+		w, prs := d.lookupWorker(data.Directive)
+		if !prs {
+			log.Warnf("cannot route message to directive: %v", data.Directive)
+			lasterror.Set(lasterror.Dispatcher, fmt.Errorf("cannot route message to directive: %v", data.Directive))
+			continue
+		}
+		if !d.limit(w, data) {
+			continue
+		}
+		d.route(w, data)
+	}
+}
+
+// hold queues data if its directive is paused, reporting whether it did.
+func (d *dispatcher) hold(data yggdrasil.Data) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	held, prs := d.paused[data.Directive]
+	if !prs {
+		return false
+	}
+	d.paused[data.Directive] = append(held, data)
+	log.Debugf("holding message %v for paused directive %v", data.MessageID, data.Directive)
+
+	return true
+}
+
+// sendData receives values on the lanes of the send queue and distributes
+// them among a pool of workers goroutines that send the data over gRPC. All
+// data for a directive is handled by the same goroutine, so data of the same
+// priority is dispatched in the order it was received, while data for
+// different directives is dispatched in parallel. Data of a higher priority
+// is taken first by the goroutines of the pool, and each lane is distributed
+// by its own goroutine, so that a full lane of the pool does not hold up data
+// of another priority. Data for the broadcast directive is dispatched to every
+// registered worker, and data whose directive matches a route to the handlers
+// of the route instead.
+func (d *dispatcher) sendData(workers int) {
+	pool := make([][numLanes]chan yggdrasil.Data, workers)
+	for i := range pool {
+		for lane := range pool[i] {
+			pool[i][lane] = make(chan yggdrasil.Data, cap(d.sendQ)/workers+1)
+		}
+		go d.sendDirectiveData(&laneSelector{lanes: pool[i]})
+	}
+	d.distributeData(pool)
+}
+
+// distributeData distributes the values received on each lane of the send
+// queue among the goroutines of pool, in a goroutine per lane, and closes the
+// lanes of pool once every lane of the send queue is closed.
+func (d *dispatcher) distributeData(pool [][numLanes]chan yggdrasil.Data) {
+	var wg sync.WaitGroup
+	for _, q := range d.sendLanes() {
+		wg.Add(1)
+		go func(q chan yggdrasil.Data) {
+			defer wg.Done()
+			d.distributeLane(q, pool)
+		}(q)
+	}
+	wg.Wait()
+
+	for _, lanes := range pool {
+		for _, q := range lanes {
+			close(q)
+		}
+	}
+}
+
+// distributeLane receives values on q, a lane of the send queue, routes them
+// and places each on the lane of its priority of the goroutine of pool
+// handling its directive, until q is closed.
+func (d *dispatcher) distributeLane(q <-chan yggdrasil.Data, pool [][numLanes]chan yggdrasil.Data) {
+	for data := range q {
+		var routed []yggdrasil.Data
+		if data.Directive == yggdrasil.DirectiveBroadcast {
+			routed = d.broadcastData(data)
+		} else {
+			routed = routeData(d.routes, data)
+		}
+		for _, data := range routed {
+			h := fnv.New32a()
+			h.Write([]byte(data.Directive))
+			pool[h.Sum32()%uint32(len(pool))][priorityLane(data)] <- data
+		}
+	}
+}
+
+// sendDirectiveData receives values from the lanes of q, in order of
+// priority, and sends the data over gRPC. Data for a restricted directive
+// without an active grant is dropped, data for a paused directive is held
+// until the directive is resumed, data exceeding the rate limit of its
+// directive is deferred or dropped, and data requiring a bulk transfer is held
+// until transfers are permitted. Data destined to a worker that requires
+// in-order delivery is placed on that worker's queue; all other data is
+// dispatched immediately.
+func (d *dispatcher) sendDirectiveData(q *laneSelector) {
+	for data, ok := q.next(); ok; data, ok = q.next() {
+		if !d.grants.allowed(data.Directive, time.Now()) {
+			grantMetrics.Add("denied", 1)
+			e := fmt.Errorf("cannot dispatch message %v: directive %v is restricted and not granted", data.MessageID, data.Directive)
+			log.Warn(e)
+			lasterror.Set(lasterror.Dispatcher, e)
+			d.deliveryDone(data, e)
+			continue
+		}
+
+		if d.hold(data) {
+			continue
+		}
+
+		w, prs := d.lookupWorker(data.Directive)
+
+		if !prs {
+			e := fmt.Errorf("cannot route message to directive: %v", data.Directive)
+			log.Warn(e)
+			lasterror.Set(lasterror.Dispatcher, e)
+			d.deliveryDone(data, e)
+			continue
+		}
+
+		if !d.limit(w, data) {
+			continue
+		}
+
+		d.route(w, data)
+	}
+}
+
+// route dispatches data to the worker w, holding, coalescing or queueing it
+// as the worker requires. Data exceeding the concurrency limit of its
+// directive waits for a message in flight to complete.
+func (d *dispatcher) route(w worker, data yggdrasil.Data) {
+	if d.holdTransfer(w, data) {
+		return
+	}
+
+	if w.coalesce {
+		d.coalesce(w.handler, data)
+		return
+	}
+
+	ok, err := d.concurrency.acquire(w, data)
+	if err != nil {
+		log.Warnf("dropping message %v: %v", data.MessageID, err)
+		go d.deliveryFailed(data, 0, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	d.deliver(w, data)
+}
+
+// deliver places data on the queue of the worker w, if it requires in-order
+// delivery, or dispatches it immediately.
+func (d *dispatcher) deliver(w worker, data yggdrasil.Data) {
+	if w.ordered {
+		q := d.orderedQueue(w.handler)
+		select {
+		case q.data <- data:
+		case <-q.done:
+			log.Warnf("cannot route message to directive: %v", data.Directive)
+			d.concurrency.release(data.MessageID)
+		}
+		return
+	}
+
+	if err := d.dispatch(w, data); err != nil {
+		if reported(err) {
+			d.concurrency.release(data.MessageID)
+			return
+		}
+		log.Errorf("cannot dispatch message %v: %v", data.MessageID, err)
+		go d.retryDispatch(data, err)
+	}
+}
+
+// orderedQueue returns the queue of the given handler, creating it and
+// starting a goroutine that dispatches its messages one at a time if
+// necessary. The goroutine returns once the queue is stopped by
+// stopOrderedQueue.
+func (d *dispatcher) orderedQueue(handler string) *workerQueue {
+	d.Lock()
+	defer d.Unlock()
+
+	q, prs := d.queues[handler]
+	if !prs {
+		q = &workerQueue{data: make(chan yggdrasil.Data, 100), done: make(chan struct{})}
+		d.queues[handler] = q
+		go func() {
+			for {
+				var data yggdrasil.Data
+				select {
+				case data = <-q.data:
+				case <-q.done:
+					for {
+						select {
+						case data := <-q.data:
+							log.Warnf("dropping message %v: worker %v unregistered", data.MessageID, handler)
+							d.concurrency.release(data.MessageID)
+						default:
+							return
+						}
+					}
 				}
-				if yggdrasil.DataHost != "" {
-					URL.Host = yggdrasil.DataHost
+				if d.hold(data) {
+					continue
 				}
 
-				content, err := d.httpClient.Get(URL.String())
-				if err != nil {
-					log.Errorf("cannot get detached message content: %v", err)
-					return
+				w, prs := d.lookupWorker(data.Directive)
+
+				if !prs {
+					log.Warnf("cannot route message to directive: %v", data.Directive)
+					lasterror.Set(lasterror.Dispatcher, fmt.Errorf("cannot route message to directive: %v", data.Directive))
+					d.concurrency.release(data.MessageID)
+					continue
+				}
+				data.Metadata = d.sequenceMetadata(w.handler+"/in", data.Metadata)
+				if err := d.dispatch(w, data); err != nil {
+					if reported(err) {
+						d.concurrency.release(data.MessageID)
+						continue
+					}
+					log.Errorf("cannot dispatch message %v: %v", data.MessageID, err)
+					d.retryDispatch(data, err)
 				}
-				data.Content = content
 			}
+		}()
+	}
+	return q
+}
 
-			conn, err := grpc.Dial("unix:"+w.addr, grpc.WithInsecure())
-			if err != nil {
-				log.Errorf("cannot dial socket: %v", err)
-				return
+// stopOrderedQueue stops the queue of the given handler, if any. Messages
+// still queued are dropped, as they would be for lack of a worker.
+func (d *dispatcher) stopOrderedQueue(handler string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if q, prs := d.queues[handler]; prs {
+		close(q.done)
+		delete(d.queues, handler)
+	}
+}
+
+// coalesce dispatches data to the coalescing worker handling handler. If the
+// worker is busy with a previous message, data replaces any message already
+// waiting, and the replaced message is reported as coalesced.
+func (d *dispatcher) coalesce(handler string, data yggdrasil.Data) {
+	d.Lock()
+	c, prs := d.coalescers[handler]
+	if !prs {
+		c = &coalescer{}
+		d.coalescers[handler] = c
+	}
+	if c.busy {
+		superseded := c.pending
+		c.pending = &data
+		d.Unlock()
+
+		if superseded != nil {
+			log.Infof("message %v superseded by message %v", superseded.MessageID, data.MessageID)
+			d.events <- yggdrasil.Event{
+				Type:       yggdrasil.MessageTypeEvent,
+				MessageID:  uuid.New().String(),
+				ResponseTo: superseded.MessageID,
+				Version:    1,
+				Sent:       time.Now(),
+				Content:    string(yggdrasil.EventNameCoalesced),
+				Details: map[string]string{
+					"directive":     superseded.Directive,
+					"superseded_by": data.MessageID,
+				},
 			}
-			defer conn.Close()
-
-			c := pb.NewWorkerClient(conn)
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			defer cancel()
-
-			msg := pb.Data{
-				MessageId:  data.MessageID,
-				ResponseTo: data.ResponseTo,
-				Directive:  data.Directive,
-				Metadata:   data.Metadata,
-				Content:    data.Content,
+		}
+		return
+	}
+	c.busy = true
+	d.Unlock()
+
+	go func() {
+		for {
+			w, prs := d.lookupWorker(data.Directive)
+
+			if !prs {
+				log.Warnf("cannot route message to directive: %v", data.Directive)
+				lasterror.Set(lasterror.Dispatcher, fmt.Errorf("cannot route message to directive: %v", data.Directive))
+			} else {
+				if w.ordered {
+					data.Metadata = d.sequenceMetadata(w.handler+"/in", data.Metadata)
+				}
+				if err := d.dispatch(w, data); err != nil && !reported(err) {
+					log.Errorf("cannot dispatch message %v: %v", data.MessageID, err)
+					d.retryDispatch(data, err)
+				}
 			}
-			_, err = c.Send(ctx, &msg)
-			if err != nil {
-				log.Errorf("cannot send message %v: %v", data.MessageID, err)
-				log.Tracef("message: %+v", data)
+
+			d.Lock()
+			if c.pending == nil {
+				c.busy = false
+				d.Unlock()
 				return
 			}
-			log.Debugf("dispatched message %v to worker %v", msg.MessageId, data.Directive)
+			data = *c.pending
+			c.pending = nil
+			d.Unlock()
+		}
+	}()
+}
+
+// sequenceMetadata returns a copy of metadata with the ordering and next
+// sequence number of the named sequence set.
+func (d *dispatcher) sequenceMetadata(name string, metadata map[string]string) map[string]string {
+	d.Lock()
+	d.sequences[name]++
+	seq := d.sequences[name]
+	d.Unlock()
+
+	m := make(map[string]string, len(metadata)+2)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	m[yggdrasil.MetadataKeyOrdering] = yggdrasil.OrderingStrict
+	m[yggdrasil.MetadataKeySequence] = strconv.FormatUint(seq, 10)
+
+	return m
+}
+
+// reported reports whether err, returned by dispatch, was already reported to
+// the server, so that the message must be dropped rather than retried.
+func reported(err error) bool {
+	return err == errDeadlineExceeded || err == errInvalidContent
+}
+
+// A transientError is an error delivering a message that may not recur, such
+// as a worker that is not listening yet. Only deliveries failing with a
+// transientError are retried.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+// isTransient reports whether err is a transientError.
+func isTransient(err error) bool {
+	var t transientError
+	return errors.As(err, &t)
+}
+
+// retryDispatch attempts to deliver data to its worker again after the first
+// attempt failed with err, waiting an exponentially increasing interval
+// before each attempt, for as long as delivery fails with a transient error.
+// The worker is looked up again before every attempt, since it may have been
+// restarted with a new address. If delivery fails for good, a
+// "delivery-failed" event is published to the control plane.
+func (d *dispatcher) retryDispatch(data yggdrasil.Data, err error) {
+	attempt := 2
+	for ; isTransient(err) && attempt <= d.maxAttempts; attempt++ {
+		delay := backoff(d.retryInterval, attempt-1)
+		log.Debugf("retrying delivery of message %v in %v (attempt %v of %v)", data.MessageID, delay, attempt, d.maxAttempts)
+		time.Sleep(delay)
+
+		w, prs := d.lookupWorker(data.Directive)
+		if !prs {
+			err = transientError{fmt.Errorf("no worker registered for directive %v", data.Directive)}
+			continue
+		}
+
+		if err = d.dispatch(w, data); err == nil {
+			return
+		}
+		if reported(err) {
+			d.concurrency.release(data.MessageID)
+			return
+		}
+		log.Errorf("cannot dispatch message %v: %v", data.MessageID, err)
+	}
+	attempts := attempt - 1
+
+	log.Errorf("giving up delivery of message %v after %v attempts", data.MessageID, attempts)
+	d.concurrency.release(data.MessageID)
+	d.deliveryFailed(data, attempts, err)
+}
+
+// deliveryFailed publishes a "delivery-failed" event for data, received from
+// the server, after the given number of attempts to deliver it failed with
+// err. The message ID is forgotten, since the server may redeliver the
+// message later.
+func (d *dispatcher) deliveryFailed(data yggdrasil.Data, attempts int, err error) {
+	journal.forget(data.MessageID)
+	if err != nil {
+		d.deliveryDone(data, err)
+	} else {
+		d.deliveryDone(data, fmt.Errorf("delivery failed"))
+	}
+	details := map[string]string{
+		"directive": data.Directive,
+		"attempts":  strconv.Itoa(attempts),
+	}
+	if err != nil {
+		details["error"] = err.Error()
+	}
+	d.events <- yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: data.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameDeliveryFailed),
+		Details:    details,
+	}
+}
+
+// backoff returns the delay before retry number n, doubling interval for every
+// retry up to a maximum of maxRetryInterval.
+func backoff(interval time.Duration, n int) time.Duration {
+	delay := interval
+	for i := 1; i < n; i++ {
+		delay *= 2
+		if delay >= maxRetryInterval {
+			return maxRetryInterval
+		}
+	}
+	return delay
+}
+
+// dispatch sends data to the worker w over gRPC, fetching detached content
+// first if the worker requires it, and the payload of a content reference.
+// Content that is not a reference is validated against the schema of its
+// directive first.
+func (d *dispatcher) dispatch(w worker, data yggdrasil.Data) error {
+	defer tracing.Begin(tracing.Dispatch, data.Directive, map[string]string{"message_id": data.MessageID})()
+
+	ctx, cancel := messageContext(data)
+	defer cancel()
+	if ctx.Err() != nil {
+		return d.deadlineExceeded(data, "queue")
+	}
+
+	if w.detachedContent {
+		var urlString string
+		if err := json.Unmarshal(data.Content, &urlString); err != nil {
+			return fmt.Errorf("cannot unmarshal message content: %w", err)
+		}
+		URL, err := url.Parse(urlString)
+		if err != nil {
+			return fmt.Errorf("cannot parse message content as URL: %w", err)
+		}
+		if yggdrasil.DataHost != "" {
+			URL.Host = yggdrasil.DataHost
+		}
+
+		content, err := d.httpClient.Get(ctx, URL.String())
+		if err != nil && ctx.Err() != nil {
+			return d.deadlineExceeded(data, "content")
+		}
+		if err != nil {
+			err = fmt.Errorf("cannot get detached message content: %w", err)
+			lasterror.Set(lasterror.DataPlane, err)
+			return transientError{err}
+		}
+		data.Content = content
+	}
+
+	var contentPath string
+	if !isContentReference(data) {
+		if err := d.validateContent(data); err != nil {
+			return err
+		}
+	}
+	if isContentReference(data) {
+		var err error
+		data, contentPath, err = d.resolveContentReference(ctx, w, data)
+		if err != nil && ctx.Err() != nil {
+			return d.deadlineExceeded(data, "content")
+		}
+		if err != nil {
+			lasterror.Set(lasterror.DataPlane, err)
+			return err
+		}
+	}
+
+	conn, err := ipc.Dial(w.addr)
+	if err != nil {
+		err = fmt.Errorf("cannot dial socket: %w", err)
+		lasterror.Set(lasterror.Worker(data.Directive), err)
+		return transientError{err}
+	}
+	defer conn.Close()
+
+	c := pb.NewWorkerClient(conn)
+	sendCtx, sendCancel := context.WithTimeout(ctx, time.Minute)
+	defer sendCancel()
+
+	metadata := d.env.metadata(data.Directive, data.Metadata)
+	tempDir, err := d.tempDirs.create(w, data)
+	if err != nil {
+		log.Errorf("cannot provide temporary directory for message %v: %v", data.MessageID, err)
+	}
+	if data.OperationGroup != "" || tempDir != "" {
+		m := make(map[string]string, len(metadata)+2)
+		for k, v := range metadata {
+			m[k] = v
+		}
+		if data.OperationGroup != "" {
+			m[yggdrasil.MetadataKeyOperationGroup] = data.OperationGroup
+		}
+		if tempDir != "" {
+			m[yggdrasil.MetadataKeyTempDir] = tempDir
+		}
+		metadata = m
+	}
+
+	msg := pb.Data{
+		MessageId:  data.MessageID,
+		ResponseTo: data.ResponseTo,
+		Directive:  data.Directive,
+		Metadata:   metadata,
+		Content:    data.Content,
+	}
+	end := tracing.Begin(tracing.Worker, "Send", map[string]string{"directive": data.Directive, "message_id": data.MessageID})
+	_, err = c.Send(sendCtx, &msg)
+	end()
+	if err != nil {
+		d.tempDirs.remove(data.MessageID)
+	}
+	if err != nil && ctx.Err() != nil {
+		return d.deadlineExceeded(data, "delivery")
+	}
+	if err != nil {
+		log.Tracef("message: %+v", data)
+		code := status.Code(err)
+		err = fmt.Errorf("cannot send message: %w", err)
+		lasterror.Set(lasterror.Worker(data.Directive), err)
+		// Only a worker that could not be reached is sure not to have
+		// accepted the message; the handlers of ordered and coalescing
+		// workers run within the call, so a message that timed out may
+		// well have been handled already.
+		if code == codes.Unavailable {
+			return transientError{err}
+		}
+		return err
+	}
+	d.inflight.set(data.MessageID, data.Directive)
+	delivered(data.MessageID)
+	d.deliveryDone(data, nil)
+	if deadline, ok := messageDeadline(data); ok {
+		d.expireAt(w, data, deadline)
+	}
+	if contentPath != "" && !w.localContent {
+		os.Remove(contentPath)
+	}
+	log.Debugf("dispatched message %v to worker %v", msg.MessageId, data.Directive)
+
+	return nil
+}
+
+// setLogLevel changes the log level of subsystem or, if subsystem is empty,
+// the default log level of yggd and its workers. An empty level or "default"
+// removes the override of subsystem.
+func (d *dispatcher) setLogLevel(subsystem, level string) error {
+	if subsystem != "" && (level == "" || level == "default") {
+		if err := logging.ClearSubsystemLevel(subsystem); err != nil {
+			return err
+		}
+		log.Infof("log level of %v reset to %v", subsystem, logging.Level())
+		return nil
+	}
+
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if subsystem != "" {
+		if err := logging.SetSubsystemLevel(subsystem, l); err != nil {
+			return err
+		}
+		log.Infof("log level of %v set to %v", subsystem, l)
+		return nil
+	}
+	logging.SetLevel(l)
+	log.Infof("log level set to %v", l)
+	d.setWorkersLogLevel(l.String())
+	return nil
+}
+
+// setWorkersLogLevel asks every registered worker to change its log level.
+// Workers that do not implement the call keep their current level.
+func (d *dispatcher) setWorkersLogLevel(level string) {
+	d.RLock()
+	workers := make([]worker, 0, len(d.workers))
+	for _, w := range d.workers {
+		workers = append(workers, w)
+	}
+	d.RUnlock()
+
+	for _, w := range workers {
+		if err := setWorkerLogLevel(w, level); err != nil {
+			log.Errorf("cannot set log level of worker %v: %v", w.handler, err)
+		}
+	}
+}
+
+// setWorkerLogLevel calls the "SetLogLevel" method of the worker w.
+func setWorkerLogLevel(w worker, level string) error {
+	conn, err := ipc.Dial(w.addr)
+	if err != nil {
+		return fmt.Errorf("cannot dial socket: %w", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewWorkerClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.SetLogLevel(ctx, &pb.LogLevelRequest{Level: level}); err != nil {
+		return fmt.Errorf("cannot set log level: %w", err)
+	}
+	return nil
+}
+
+// topicOwner returns the handler of the worker subscribed to topic, if any.
+// The caller must hold the dispatcher lock.
+func (d *dispatcher) topicOwner(topic string) string {
+	for _, w := range d.workers {
+		for _, t := range w.topics {
+			if t == topic {
+				return w.handler
+			}
 		}
+	}
+	return ""
+}
 
-		f()
+// topicHandler returns a function that wraps messages received on a worker's
+// additional topics in a Data message and queues it for dispatch to the worker
+// handling directive.
+func (d *dispatcher) topicHandler(directive string) transport.TopicHandler {
+	return func(topic string, payload []byte) {
+		data := yggdrasil.Data{
+			Type:      yggdrasil.MessageTypeData,
+			MessageID: uuid.New().String(),
+			Version:   1,
+			Sent:      time.Now(),
+			Directive: directive,
+			Metadata:  map[string]string{yggdrasil.MetadataKeyTopic: topic},
+			Content:   payload,
+		}
+		if !d.enqueueSend(data) {
+			lasterror.Set(lasterror.Dispatcher, fmt.Errorf("cannot dispatch message received on topic %v: send queue is full", topic))
+		}
 	}
 }
 
 func (d *dispatcher) unregisterWorker() {
 	for pid := range d.deadWorkers {
 		d.Lock()
-		handler := d.pidHandlers[pid]
+		handler, prs := d.pidHandlers[pid]
+		if !prs {
+			// The worker was already unregistered, such as when it
+			// was collected as stale before its process exited.
+			d.Unlock()
+			continue
+		}
+		w := d.workers[handler]
 		delete(d.pidHandlers, pid)
 		delete(d.workers, handler)
+		d.tags.setWorker(handler, nil)
 		d.Unlock()
+		d.stopOrderedQueue(handler)
 		log.Infof("unregistered worker: %v", handler)
+		d.saveRegistry()
+
+		for _, topic := range w.topics {
+			d.subscriptions <- subscription{topic: topic, directive: handler, remove: true}
+		}
 
 		d.sendDispatchersMap()
 	}
@@ -205,6 +1329,48 @@ func (d *dispatcher) makeDispatchersMap() map[string]map[string]string {
 	return dispatchers
 }
 
+// makeWorkersMap returns details of each registered worker, keyed by the
+// directive it handles.
+func (d *dispatcher) makeWorkersMap() map[string]yggdrasil.WorkerInfo {
+	d.RLock()
+	defer d.RUnlock()
+
+	workers := make(map[string]yggdrasil.WorkerInfo)
+	for handler, worker := range d.workers {
+		var manifestVersion string
+		if m := manifestForPID(worker.pid); m != nil {
+			manifestVersion = m.Version
+		}
+		workers[handler] = yggdrasil.WorkerInfo{
+			Version:         worker.version,
+			ManifestVersion: manifestVersion,
+			PID:             worker.callerPID(),
+			VsockCID:        worker.cid,
+			DetachedContent: worker.detachedContent,
+			Ordered:         worker.ordered,
+			Coalesce:        worker.coalesce,
+			Topics:          worker.topics,
+			Paused:          d.isPaused(handler),
+		}
+	}
+
+	return workers
+}
+
+// isPaused reports whether dispatch for directive is paused, and not being
+// resumed. The caller must hold the lock.
+func (d *dispatcher) isPaused(directive string) bool {
+	_, prs := d.paused[directive]
+	_, resuming := d.resuming[directive]
+	return prs && !resuming
+}
+
+// connectionStatus returns the dispatchers map and worker details published
+// in connection-status messages.
+func (d *dispatcher) connectionStatus() (map[string]map[string]string, map[string]yggdrasil.WorkerInfo) {
+	return d.makeDispatchersMap(), d.makeWorkersMap()
+}
+
 func (d *dispatcher) sendDispatchersMap() {
 	d.dispatchers <- d.makeDispatchersMap()
 }
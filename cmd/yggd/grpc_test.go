@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		description string
+		interval    time.Duration
+		n           int
+		want        time.Duration
+	}{
+		{
+			description: "first retry",
+			interval:    time.Second,
+			n:           1,
+			want:        time.Second,
+		},
+		{
+			description: "fourth retry",
+			interval:    time.Second,
+			n:           4,
+			want:        8 * time.Second,
+		},
+		{
+			description: "capped",
+			interval:    time.Minute,
+			n:           10,
+			want:        maxRetryInterval,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := backoff(test.interval, test.n)
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+// fakeWorker serves the Worker service, recording the IDs of the messages
+// sent to it, and returning err from Send if set.
+type fakeWorker struct {
+	pb.UnimplementedWorkerServer
+	lock     sync.Mutex
+	received []string
+	err      error
+}
+
+func (w *fakeWorker) Send(ctx context.Context, r *pb.Data) (*pb.Receipt, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.received = append(w.received, r.GetMessageId())
+	if w.err != nil {
+		return nil, w.err
+	}
+	return &pb.Receipt{}, nil
+}
+
+func (w *fakeWorker) messages() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string(nil), w.received...)
+}
+
+// registerFakeWorker serves a fakeWorker on an abstract socket and registers
+// it with d as the worker handling directive.
+func registerFakeWorker(t *testing.T, d *dispatcher, directive string, ordered bool) *fakeWorker {
+	addr := fmt.Sprintf("@yggd-test-%v-%v", directive, randomString(6))
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw := &fakeWorker{}
+	s := grpc.NewServer()
+	pb.RegisterWorkerServer(s, fw)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	d.Lock()
+	d.workers[directive] = worker{handler: directive, addr: addr, ordered: ordered}
+	d.Unlock()
+	return fw
+}
+
+// waitFor polls cond until it returns true, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestResumeOrder(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+	fw := registerFakeWorker(t, d, "echo", true)
+
+	if err := d.pause("echo"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if !d.hold(yggdrasil.Data{MessageID: id, Directive: "echo"}) {
+			t.Fatalf("message %v not held", id)
+		}
+	}
+	if err := d.resume("echo"); err != nil {
+		t.Fatal(err)
+	}
+	// Data received while held data is drained waits behind it.
+	d.hold(yggdrasil.Data{MessageID: "4", Directive: "echo"})
+
+	waitFor(t, func() bool { return len(fw.messages()) == 4 })
+	if got := strings.Join(fw.messages(), ","); got != "1,2,3,4" {
+		t.Errorf("dispatched %v, want 1,2,3,4", got)
+	}
+	waitFor(t, func() bool {
+		d.RLock()
+		defer d.RUnlock()
+		_, prs := d.paused["echo"]
+		return !prs
+	})
+	if d.hold(yggdrasil.Data{MessageID: "5", Directive: "echo"}) {
+		t.Error("message held after the directive was resumed")
+	}
+}
+
+func TestStopOrderedQueue(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	q := d.orderedQueue("echo")
+	d.stopOrderedQueue("echo")
+
+	select {
+	case <-q.done:
+	default:
+		t.Fatal("queue not stopped")
+	}
+	d.RLock()
+	_, prs := d.queues["echo"]
+	d.RUnlock()
+	if prs {
+		t.Error("stopped queue not removed")
+	}
+}
+
+func TestRetryDispatch(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		want        int
+	}{
+		{
+			description: "transient",
+			err:         status.Error(codes.Unavailable, "not ready"),
+			want:        3,
+		},
+		{
+			description: "permanent",
+			err:         status.Error(codes.Internal, "cannot handle"),
+			want:        1,
+		},
+		{
+			description: "timeout",
+			err:         status.Error(codes.DeadlineExceeded, "too slow"),
+			want:        1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil, 3, 0, 10)
+			fw := registerFakeWorker(t, d, "echo", false)
+			fw.err = test.err
+
+			go d.route(worker{handler: "echo", addr: d.workers["echo"].addr}, yggdrasil.Data{MessageID: "1", Directive: "echo"})
+
+			select {
+			case event := <-d.events:
+				if event.Content != string(yggdrasil.EventNameDeliveryFailed) {
+					t.Fatalf("event %v != %v", event.Content, yggdrasil.EventNameDeliveryFailed)
+				}
+				if event.Details["attempts"] != strconv.Itoa(test.want) {
+					t.Errorf("attempts %v != %v", event.Details["attempts"], test.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no delivery-failed event")
+			}
+			if got := len(fw.messages()); got != test.want {
+				t.Errorf("delivered %v times, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDispatcherAdminOnly(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+
+	l, err := net.Listen("unix", "@yggd-test-dispatcher-"+randomString(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.Creds(peerCredentials{}))
+	pb.RegisterDispatcherServer(s, d)
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.Dial("unix:"+l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := pb.NewDispatcherClient(conn)
+	ctx := context.Background()
+
+	tests := []struct {
+		description string
+		call        func() error
+	}{
+		{description: "facts of unregistered process", call: func() error {
+			_, err := c.GetFacts(ctx, &pb.Empty{})
+			return err
+		}},
+		{description: "tags of unregistered process", call: func() error {
+			_, err := c.GetTags(ctx, &pb.Empty{})
+			return err
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if code := status.Code(test.call()); code != codes.PermissionDenied {
+				t.Errorf("%v != %v", code, codes.PermissionDenied)
+			}
+		})
+	}
+
+	// A registered worker may get the facts and tags.
+	d.Lock()
+	d.pidHandlers[os.Getpid()] = "echo"
+	d.Unlock()
+	if _, err := c.GetFacts(ctx, &pb.Empty{}); status.Code(err) == codes.PermissionDenied {
+		t.Errorf("registered worker denied facts: %v", err)
+	}
+	if _, err := c.GetTags(ctx, &pb.Empty{}); status.Code(err) == codes.PermissionDenied {
+		t.Errorf("registered worker denied tags: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// Limits on the messages received from the server and from workers, which
+// are parsed before anything else is known about them.
+const (
+	// maxMessageSize is the largest control or data message, in bytes.
+	maxMessageSize = 32 << 20
+
+	// maxJSONDepth is the deepest nesting of JSON arrays and objects in a
+	// message.
+	maxJSONDepth = 64
+
+	// maxNameLength is the longest message ID or directive, in bytes.
+	maxNameLength = 1024
+
+	// maxMetadataEntries is the largest number of metadata keys of a message.
+	maxMetadataEntries = 256
+
+	// maxMetadataSize is the largest total size of the metadata keys and
+	// values of a message, in bytes.
+	maxMetadataSize = 64 << 10
+)
+
+var (
+	errMessageTooLarge = errors.New("message too large")
+	errMessageTooDeep  = errors.New("message nested too deeply")
+)
+
+// checkJSON returns an error if msg is larger than maxMessageSize or nests
+// arrays and objects deeper than maxJSONDepth. It does not validate msg
+// otherwise; brackets within strings are not counted.
+func checkJSON(msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return errMessageTooLarge
+	}
+	depth := 0
+	inString := false
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+			if depth > maxJSONDepth {
+				return errMessageTooDeep
+			}
+		case ']', '}':
+			depth--
+		}
+	}
+	return nil
+}
+
+// parseControlMessage parses a command or capabilities message received on
+// the control topic.
+func parseControlMessage(msg []byte) (yggdrasil.Command, error) {
+	var cmd yggdrasil.Command
+	if err := checkJSON(msg); err != nil {
+		return cmd, err
+	}
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return cmd, err
+	}
+	switch cmd.Type {
+	case yggdrasil.MessageTypeCapabilities:
+		return cmd, nil
+	case yggdrasil.MessageTypeCommand:
+	default:
+		return cmd, fmt.Errorf("unexpected message type %q", cmd.Type)
+	}
+	if err := checkName("message ID", cmd.MessageID); err != nil {
+		return cmd, err
+	}
+	return cmd, checkMetadata(cmd.Content.Arguments)
+}
+
+// parseDataMessage parses a data or worker-config message received on the
+// data topic.
+func parseDataMessage(msg []byte) (yggdrasil.Data, error) {
+	var data yggdrasil.Data
+	if err := checkJSON(msg); err != nil {
+		return data, err
+	}
+	if err := json.Unmarshal(msg, &data); err != nil {
+		return data, err
+	}
+	switch data.Type {
+	case yggdrasil.MessageTypeData, yggdrasil.MessageTypeWorkerConfig:
+	default:
+		return data, fmt.Errorf("unexpected message type %q", data.Type)
+	}
+	if err := checkName("message ID", data.MessageID); err != nil {
+		return data, err
+	}
+	if data.Type == yggdrasil.MessageTypeData {
+		if err := checkName("directive", data.Directive); err != nil {
+			return data, err
+		}
+	}
+	return data, checkMetadata(data.Metadata)
+}
+
+// checkWorkerData returns an error if the message a worker sends is not fit
+// to be published.
+func checkWorkerData(r *pb.Data) error {
+	if len(r.GetMessageId()) > maxNameLength {
+		return fmt.Errorf("message ID longer than %v bytes", maxNameLength)
+	}
+	if err := checkName("directive", r.GetDirective()); err != nil {
+		return err
+	}
+	if len(r.GetContent()) > maxMessageSize {
+		return errMessageTooLarge
+	}
+	return checkMetadata(r.GetMetadata())
+}
+
+// checkName returns an error if the message ID or directive value is empty,
+// too long, or not valid UTF-8.
+func checkName(name, value string) error {
+	switch {
+	case value == "":
+		return fmt.Errorf("missing %v", name)
+	case len(value) > maxNameLength:
+		return fmt.Errorf("%v longer than %v bytes", name, maxNameLength)
+	case !utf8.ValidString(value):
+		return fmt.Errorf("%v is not valid UTF-8", name)
+	}
+	return nil
+}
+
+// checkMetadata returns an error if metadata has more than maxMetadataEntries
+// keys or is larger than maxMetadataSize.
+func checkMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataEntries {
+		return fmt.Errorf("more than %v metadata keys", maxMetadataEntries)
+	}
+	size := 0
+	for k, v := range metadata {
+		size += len(k) + len(v)
+	}
+	if size > maxMetadataSize {
+		return fmt.Errorf("metadata larger than %v bytes", maxMetadataSize)
+	}
+	return nil
+}
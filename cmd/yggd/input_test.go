@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestCheckJSON(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		wantError   error
+	}{
+		{
+			description: "flat",
+			input:       `{"type":"data","content":[1,2,3]}`,
+		},
+		{
+			description: "deepest",
+			input:       strings.Repeat("[", maxJSONDepth) + strings.Repeat("]", maxJSONDepth),
+		},
+		{
+			description: "too deep",
+			input:       strings.Repeat("[", maxJSONDepth+1) + strings.Repeat("]", maxJSONDepth+1),
+			wantError:   errMessageTooDeep,
+		},
+		{
+			description: "brackets in strings",
+			input:       `{"a":"` + strings.Repeat("[", maxJSONDepth+1) + `\"["}`,
+		},
+		{
+			description: "too large",
+			input:       `"` + strings.Repeat("a", maxMessageSize) + `"`,
+			wantError:   errMessageTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if err := checkJSON([]byte(test.input)); err != test.wantError {
+				t.Errorf("error = %v, want %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func TestParseDataMessage(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		wantError   bool
+	}{
+		{
+			description: "data",
+			input:       `{"type":"data","message_id":"1","directive":"echo","content":"hi"}`,
+		},
+		{
+			description: "worker config",
+			input:       `{"type":"worker-config","message_id":"1","directive":"echo","content":{}}`,
+		},
+		{
+			description: "command on data topic",
+			input:       `{"type":"command","message_id":"1","directive":"echo"}`,
+			wantError:   true,
+		},
+		{
+			description: "missing message ID",
+			input:       `{"type":"data","directive":"echo"}`,
+			wantError:   true,
+		},
+		{
+			description: "missing directive",
+			input:       `{"type":"data","message_id":"1"}`,
+			wantError:   true,
+		},
+		{
+			description: "metadata of wrong type",
+			input:       `{"type":"data","message_id":"1","directive":"echo","metadata":{"a":1}}`,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := parseDataMessage([]byte(test.input))
+			if (err != nil) != test.wantError {
+				t.Errorf("error = %v, want error %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func FuzzParseControlMessage(f *testing.F) {
+	f.Add([]byte(`{"type":"command","message_id":"1","content":{"command":"ping"}}`))
+	f.Add([]byte(`{"type":"command","message_id":"1","content":{"command":"set-env","arguments":{"directive":"echo","name":"A","value":"1"}}}`))
+	f.Add([]byte(`{"type":"capabilities","content":{"max_payload_size":1024,"encodings":["gzip"],"commands":["ping"]}}`))
+	f.Add([]byte(`{"type":"command","content":[[[[]]]]}`))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		cmd, err := parseControlMessage(msg)
+		if err != nil {
+			return
+		}
+		if cmd.Type == yggdrasil.MessageTypeCommand && cmd.MessageID == "" {
+			t.Errorf("accepted command without message ID: %q", msg)
+		}
+		if len(cmd.Content.Arguments) > maxMetadataEntries {
+			t.Errorf("accepted %v arguments", len(cmd.Content.Arguments))
+		}
+	})
+}
+
+func FuzzParseDataMessage(f *testing.F) {
+	f.Add([]byte(`{"type":"data","message_id":"1","directive":"echo","content":"hi"}`))
+	f.Add([]byte(`{"type":"data","message_id":"1","directive":"echo","metadata":{"content-encoding":"gzip"},"content":"H4sIAAAAAAAA/ypJLS4BBAAA//+VAQjbBAAAAA=="}`))
+	f.Add([]byte(`{"type":"worker-config","message_id":"1","directive":"echo","content":{"a":1}}`))
+	f.Add([]byte(`{"type":"data","message_id":"1","directive":"echo","content":{"a":[{"b":[]}]}}`))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		data, err := parseDataMessage(msg)
+		if err != nil {
+			return
+		}
+		if data.MessageID == "" || (data.Type == yggdrasil.MessageTypeData && data.Directive == "") {
+			t.Errorf("accepted message without message ID or directive: %q", msg)
+		}
+		// Content is decoded as the data handler does.
+		data, err = transport.DecryptContent(data)
+		if err == nil {
+			transport.DecompressContent(data)
+		}
+	})
+}
+
+func FuzzSend(f *testing.F) {
+	f.Add("1", "", "echo", "a", "1", []byte(`"hi"`))
+	f.Add("2", "1", "insights/upload", "operation-group", "g", []byte(`{}`))
+	f.Add("", "", "", "", "", []byte(nil))
+
+	d := newDispatcher(nil, 1, 0, 10)
+	go func() {
+		for range d.recvQ {
+		}
+	}()
+
+	f.Fuzz(func(t *testing.T, messageID, responseTo, directive, key, value string, content []byte) {
+		// Directives with a scheme are posted to the data host.
+		if u, err := url.Parse(directive); err == nil && u.Scheme != "" {
+			t.Skip()
+		}
+		r := &pb.Data{
+			MessageId:  messageID,
+			ResponseTo: responseTo,
+			Directive:  directive,
+			Metadata:   map[string]string{key: value},
+			Content:    content,
+		}
+		if _, err := d.Send(context.Background(), r); err == nil && directive == "" {
+			t.Errorf("accepted message without directive")
+		}
+	})
+}
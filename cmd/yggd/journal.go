@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// journalCompactThreshold is the number of entries appended to the journal
+// file before it is rewritten without its expired entries.
+const journalCompactThreshold = 1000
+
+// journal records the IDs of messages received from the server so that
+// duplicate deliveries are dropped.
+var journal *messageJournal
+
+// messageJournalFile returns the path of the file in which the IDs of
+// received messages are persisted.
+func messageJournalFile() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "message-journal")
+}
+
+// A messageJournal is a disk-backed set of delivered message IDs. Brokers
+// redeliver messages (for example after a reconnect, or when an MQTT QoS 1
+// acknowledgement was lost), and a replayed message must not reach a worker a
+// second time, even across a restart of yggd. IDs are forgotten once they are
+// older than the journal's TTL.
+//
+// An ID is only written to the journal once its message was delivered; until
+// then it is pending, and only held in memory, so that a message lost by a
+// restart of yggd before its delivery is accepted when redelivered.
+type messageJournal struct {
+	lock     sync.Mutex
+	path     string
+	ttl      time.Duration
+	ids      map[string]time.Time
+	pending  map[string]time.Time
+	file     *os.File
+	appended int
+}
+
+// openMessageJournal opens the journal stored at path, discarding entries
+// older than ttl. The file is created if it does not exist.
+func openMessageJournal(path string, ttl time.Duration) (*messageJournal, error) {
+	j := &messageJournal{
+		path:    path,
+		ttl:     ttl,
+		ids:     make(map[string]time.Time),
+		pending: make(map[string]time.Time),
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot open journal: %w", err)
+	}
+	if f != nil {
+		ids, err := readJournal(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read journal: %w", err)
+		}
+		j.ids = ids
+	}
+
+	if err := j.compact(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// readJournal reads journal entries from r. Each line holds the time the
+// message was received, in seconds since the Unix epoch, and the message ID.
+// If an ID appears more than once, the latest time is kept.
+func readJournal(r io.Reader) (map[string]time.Time, error) {
+	ids := make(map[string]time.Time)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		received := time.Unix(sec, 0)
+		if received.After(ids[fields[1]]) {
+			ids[fields[1]] = received
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// begin reports whether id was already delivered, or received and not
+// delivered yet, within the journal's TTL. If not, id is recorded as pending
+// until record or forget is called. A nil journal and an empty ID are never
+// considered seen.
+func (j *messageJournal) begin(id string, now time.Time) bool {
+	if j == nil || id == "" {
+		return false
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if received, prs := j.ids[id]; prs && now.Sub(received) < j.ttl {
+		return true
+	}
+	if received, prs := j.pending[id]; prs && now.Sub(received) < j.ttl {
+		return true
+	}
+	j.pending[id] = now
+	return false
+}
+
+// record writes id to the journal as delivered at now, and syncs the journal
+// file so that the ID survives a crash.
+func (j *messageJournal) record(id string, now time.Time) error {
+	if j == nil || id == "" {
+		return nil
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	delete(j.pending, id)
+	j.ids[id] = now
+
+	if _, err := fmt.Fprintf(j.file, "%d %v\n", now.Unix(), id); err != nil {
+		return fmt.Errorf("cannot write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync journal: %w", err)
+	}
+	j.appended++
+	if j.appended >= journalCompactThreshold {
+		if err := j.compact(now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forget removes the pending id, so that a redelivery of its message is
+// accepted.
+func (j *messageJournal) forget(id string) {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.pending, id)
+}
+
+// counts returns the number of IDs recorded and pending.
+func (j *messageJournal) counts() (recorded, pending int) {
+	if j == nil {
+		return 0, 0
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.ids), len(j.pending)
+}
+
+// shift moves the receive time of every recorded ID by skew, after the wall
+// clock jumped by skew, so that IDs expire after the same time they would have
+// without the jump.
+func (j *messageJournal) shift(skew time.Duration) error {
+	if j == nil {
+		return nil
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	for id, received := range j.ids {
+		j.ids[id] = received.Add(skew)
+	}
+	for id, received := range j.pending {
+		j.pending[id] = received.Add(skew)
+	}
+	return j.compact(time.Now())
+}
+
+// compact forgets expired IDs, pending or not, and rewrites the journal file
+// with the remaining delivered ones, replacing the file atomically. The caller
+// must hold the lock, unless the journal is not shared yet.
+func (j *messageJournal) compact(now time.Time) error {
+	for id, received := range j.ids {
+		if now.Sub(received) >= j.ttl {
+			delete(j.ids, id)
+		}
+	}
+	for id, received := range j.pending {
+		if now.Sub(received) >= j.ttl {
+			delete(j.pending, id)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(j.path), "."+filepath.Base(j.path)+"-")
+	if err != nil {
+		return fmt.Errorf("cannot create journal: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for id, received := range j.ids {
+		fmt.Fprintf(w, "%d %v\n", received.Unix(), id)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("cannot write journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("cannot sync journal: %w", err)
+	}
+	if err := os.Rename(f.Name(), j.path); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("cannot replace journal: %w", err)
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	j.appended = 0
+
+	return nil
+}
+
+// Close closes the journal file.
+func (j *messageJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
+
+// duplicate reports whether the message with the given ID was already
+// received, recording it as pending otherwise.
+func duplicate(id string) bool {
+	return journal.begin(id, time.Now())
+}
+
+// delivered records that the message with the given ID was delivered, logging
+// any error recording it.
+func delivered(id string) {
+	if err := journal.record(id, time.Now()); err != nil {
+		log.Errorf("cannot record message %v: %v", id, err)
+	}
+}
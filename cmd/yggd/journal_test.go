@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadJournal(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        map[string]time.Time
+	}{
+		{
+			description: "empty",
+			input:       "",
+			want:        map[string]time.Time{},
+		},
+		{
+			description: "entries",
+			input:       "100 a\n200 b\n",
+			want: map[string]time.Time{
+				"a": time.Unix(100, 0),
+				"b": time.Unix(200, 0),
+			},
+		},
+		{
+			description: "repeated ID",
+			input:       "300 a\n100 a\n",
+			want: map[string]time.Time{
+				"a": time.Unix(300, 0),
+			},
+		},
+		{
+			description: "malformed lines",
+			input:       "a\nx a\n100 a b\n100 b\n",
+			want: map[string]time.Time{
+				"b": time.Unix(100, 0),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := readJournal(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMessageJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "message-journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "message-journal")
+
+	j, err := openMessageJournal(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		description string
+		id          string
+		at          time.Time
+		deliver     bool
+		forget      bool
+		want        bool
+	}{
+		{description: "first delivery", id: "a", at: now, deliver: true, want: false},
+		{description: "redelivery", id: "a", at: now.Add(time.Minute), want: true},
+		{description: "other ID", id: "b", at: now, deliver: true, want: false},
+		{description: "pending", id: "c", at: now, want: false},
+		{description: "redelivery while pending", id: "c", at: now.Add(time.Minute), forget: true, want: true},
+		{description: "redelivery after failure", id: "c", at: now.Add(2 * time.Minute), want: false},
+		{description: "undelivered", id: "d", at: now, want: false},
+		{description: "empty ID", id: "", at: now, want: false},
+		{description: "empty ID again", id: "", at: now, want: false},
+		{description: "after TTL", id: "a", at: now.Add(2 * time.Hour), want: false},
+	}
+
+	for _, test := range tests {
+		got := j.begin(test.id, test.at)
+		if got != test.want {
+			t.Errorf("%v: got %v, want %v", test.description, got, test.want)
+		}
+		if test.deliver {
+			if err := j.record(test.id, test.at); err != nil {
+				t.Fatalf("%v: %v", test.description, err)
+			}
+		}
+		if test.forget {
+			j.forget(test.id)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivered IDs persist across a restart, pending ones do not.
+	j, err = openMessageJournal(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if !j.begin("b", now.Add(time.Minute)) {
+		t.Errorf("message b not seen after reopening journal")
+	}
+	if j.begin("d", now.Add(time.Minute)) {
+		t.Errorf("undelivered message d seen after reopening journal")
+	}
+}
+
+func TestMessageJournalShift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "message-journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := openMessageJournal(filepath.Join(dir, "message-journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	// The message is received while the wall clock is a day behind, and the
+	// clock is then corrected.
+	now := time.Now()
+	j.begin("a", now.Add(-24*time.Hour))
+	if err := j.record("a", now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.shift(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if !j.begin("a", now.Add(time.Minute)) {
+		t.Error("message a forgotten after the clock jumped forward")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/logging"
+)
+
+// errNoLogRing is returned when logs are dumped while no log ring buffer is
+// kept.
+var errNoLogRing = fmt.Errorf("no log buffer is kept (log-buffer-size is 0)")
+
+// logDumpFile returns the path of the file the log ring buffer is dumped to
+// at time t.
+func logDumpFile(t time.Time) string {
+	return filepath.Join(yggdrasil.LocalstateDir, "log", yggdrasil.LongName, "yggd-"+t.Format("20060102-150405")+".log.zst")
+}
+
+// dumpLogsToFile writes the content of the log ring buffer to a new file,
+// readable only by its owner, and returns its path.
+func dumpLogsToFile() (string, error) {
+	r := logging.CurrentRing()
+	if r == nil {
+		return "", errNoLogRing
+	}
+	path := logDumpFile(time.Now())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("cannot create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %w", err)
+	}
+	defer f.Close()
+	if err := r.Dump(f); err != nil {
+		return "", fmt.Errorf("cannot write file: %w", err)
+	}
+	return path, nil
+}
+
+// watchLogDumpSignal dumps the log ring buffer to a file every time yggd
+// receives one of logDumpSignals, SIGUSR1.
+func watchLogDumpSignal() {
+	if len(logDumpSignals) == 0 {
+		return
+	}
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, logDumpSignals...)
+	for range usr1 {
+		path, err := dumpLogsToFile()
+		if err != nil {
+			log.Errorf("cannot dump logs: %v", err)
+			continue
+		}
+		log.Infof("dumped logs to %v", path)
+	}
+}
+
+// dumpLogs posts the content of the log ring buffer to rawURL, whose host is
+// replaced by the data host, if set, like the URLs of detached content.
+func (d *dispatcher) dumpLogs(rawURL string) error {
+	r := logging.CurrentRing()
+	if r == nil {
+		return errNoLogRing
+	}
+	URL, err := url.Parse(rawURL)
+	if err != nil || URL.Host == "" {
+		return fmt.Errorf("invalid URL %q", rawURL)
+	}
+	if yggdrasil.DataHost != "" {
+		URL.Host = yggdrasil.DataHost
+	}
+
+	var dump bytes.Buffer
+	if err := r.Dump(&dump); err != nil {
+		return err
+	}
+	if err := d.httpClient.Post(URL.String(), map[string]string{"Content-Type": "application/zstd"}, dump.Bytes()); err != nil {
+		return fmt.Errorf("cannot post logs: %w", err)
+	}
+	return nil
+}
+
+// logsDumpedEvent returns the event answering the "dump-logs" command
+// responseTo, which posted the logs to rawURL or failed with err.
+func logsDumpedEvent(responseTo, rawURL string, err error) yggdrasil.Event {
+	event := yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: responseTo,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameLogsDumped),
+		Details: map[string]string{
+			"url": rawURL,
+		},
+	}
+	if err != nil {
+		event.Content = string(yggdrasil.EventNameLogsDumpFailed)
+		event.Details["error"] = err.Error()
+	}
+	return event
+}
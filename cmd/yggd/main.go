@@ -5,26 +5,36 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
 	"github.com/google/uuid"
 	"github.com/redhatinsights/yggdrasil"
 	internal "github.com/redhatinsights/yggdrasil/internal"
+	"github.com/redhatinsights/yggdrasil/internal/auth"
 	http2 "github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/clock"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/idtoken"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	"github.com/redhatinsights/yggdrasil/internal/logging"
+	"github.com/redhatinsights/yggdrasil/internal/secrets"
+	"github.com/redhatinsights/yggdrasil/internal/tracing"
 	"github.com/redhatinsights/yggdrasil/internal/transport"
 	"github.com/redhatinsights/yggdrasil/internal/transport/http"
+	"github.com/redhatinsights/yggdrasil/internal/transport/kafka"
 	"github.com/redhatinsights/yggdrasil/internal/transport/mqtt"
+	"github.com/redhatinsights/yggdrasil/internal/transport/nats"
+	"github.com/redhatinsights/yggdrasil/internal/wake"
 	pb "github.com/redhatinsights/yggdrasil/protocol"
 	"github.com/rjeczalik/notify"
 	"github.com/urfave/cli/v2"
@@ -40,12 +50,24 @@ type ClientIDSource string
 const (
 	MQTT TransportType = "mqtt"
 	HTTP TransportType = "http"
+	NATS TransportType = "nats"
+	None TransportType = "none"
 
 	CertCN    ClientIDSource = "cert-cn"
 	MachineID ClientIDSource = "machine-id"
+	DMIUUID   ClientIDSource = "dmi-uuid"
+	Hostname  ClientIDSource = "hostname"
+	Command   ClientIDSource = "command"
 )
 
 func main() {
+	if os.Getenv(sandboxExecEnv) != "" {
+		if err := execSandboxed(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot execute sandboxed worker: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	app := cli.NewApp()
 	app.Name = yggdrasil.ShortName + "d"
 	app.Version = yggdrasil.Version
@@ -63,18 +85,37 @@ func main() {
 			TakesFile: true,
 			Usage:     "Read config values from `FILE`",
 		},
+		&cli.StringFlag{
+			Name:    "profile",
+			EnvVars: []string{"YGG_PROFILE"},
+			Usage:   "Overlay the config values of profile `NAME`, such as production or stage, read from the [profiles.NAME] table of the config file or from profiles/NAME.toml next to it",
+		},
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:  "log-level",
 			Value: "info",
 			Usage: "Set the logging output level to `LEVEL`",
 		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "log-level-override",
+			Usage: "Log messages of a subsystem (" + strings.Join(logging.Subsystems, ", ") + ") at a level of its own, in the form `SUBSYSTEM=LEVEL`",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "Write log messages in `FORMAT` (text or json)",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "log-buffer-size",
+			Value: 1 << 20,
+			Usage: "Keep up to `BYTES` of recent log messages at every level, compressed, in memory, to be dumped on SIGUSR1, with 'yggctl dump-logs' or by the server (0 disables)",
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:  "cert-file",
 			Usage: "Use `FILE` as the client certificate",
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:  "key-file",
-			Usage: "Use `FILE` as the client's private key",
+			Usage: "Use `FILE` as the client's private key, or a PKCS#11 URI (pkcs11:token=...) to use a key stored on a token",
 		}),
 		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
 			Name:   "ca-root",
@@ -91,6 +132,23 @@ func main() {
 			Name:  "broker",
 			Usage: "Connect to the broker specified in `URI`",
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "broker-username",
+			Usage: "Authenticate to the broker as `USERNAME`, or as the secret NAME if set to \"secret:NAME\"",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "broker-password",
+			Usage: "Authenticate to the broker with `PASSWORD`, or with the secret NAME stored with \"yggctl secret set\" if set to \"secret:NAME\"",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "mqtt-version",
+			Usage: "Speak version `VERSION` of the MQTT protocol (3.1.1 or 5) with the broker",
+			Value: "3.1.1",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "broker-srv",
+			Usage: "Connect to the brokers advertised by the _mqtts._tcp or _mqtt._tcp SRV records of `DOMAIN`, resolved again on each reconnection",
+		}),
 		&cli.BoolFlag{
 			Name:   "generate-man-page",
 			Hidden: true,
@@ -104,30 +162,442 @@ func main() {
 			Usage: "Force all HTTP traffic over `HOST`",
 			Value: yggdrasil.DataHost,
 		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "data-retry-attempts",
+			Usage: "Make up to `NUMBER` attempts at each request to the data host that fails to reach it or is answered with a status set by data-retry-status",
+			Value: 3,
+		}),
+		altsrc.NewIntSliceFlag(&cli.IntSliceFlag{
+			Name:  "data-retry-status",
+			Usage: "Retry requests to the data host answered with HTTP status `CODE`",
+			Value: cli.NewIntSlice(http2.DefaultRetryPolicy.StatusCodes...),
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "data-retry-backoff",
+			Usage: "Wait about `DURATION` before retrying a request to the data host, doubling with each retry",
+			Value: http2.DefaultRetryPolicy.MinBackoff,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "data-retry-max-backoff",
+			Usage: "Wait at most `DURATION` before retrying a request to the data host",
+			Value: http2.DefaultRetryPolicy.MaxBackoff,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "data-circuit-threshold",
+			Usage: "Stop sending requests to a host after `NUMBER` consecutive failed requests (0 disables)",
+			Value: 5,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "data-circuit-cooldown",
+			Usage: "Send a trial request to a host `DURATION` after requests to it were stopped",
+			Value: 30 * time.Second,
+		}),
 		&cli.StringFlag{
 			Name:   "socket-addr",
 			Usage:  "Force yggd to listen on `SOCKET`",
-			Value:  fmt.Sprintf("@yggd-dispatcher-%v", randomString(6)),
+			Value:  ipc.Addr(fmt.Sprintf("yggd-dispatcher-%v", randomString(6))),
 			Hidden: true,
 		},
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "vsock-port",
+			Usage: "Also accept connections from workers running in virtual machines on VM socket `PORT` (0 disables the VM socket)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-gc-interval",
+			Usage: "Unregister workers whose process is gone or whose socket refuses connections, checking every `DURATION` (0 disables)",
+			Value: time.Minute,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "keep-workers",
+			Usage: "Leave workers running on exit and reattach to them on the next start, writing their output to log files",
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:   "transport",
 			Usage:  "Force yggdrasil to use specific transport",
 			Value:  string(MQTT),
 			Hidden: true,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "inject-file",
+			Usage: "With --transport none, inject the control and data messages read from `FILE` as if received from the server",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "inject-delay",
+			Usage: "Inject the messages of inject-file or replay-file `DURATION` after connecting, once workers have registered",
+			Value: 5 * time.Second,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "record-file",
+			Usage: "Record every message published or received, unredacted and with the time it was, to `FILE`, for replay",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "replay-file",
+			Usage: "With --transport none, replay the messages received in the recording read from `FILE`",
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:  "replay-speed",
+			Usage: "Replay the messages of replay-file `FACTOR` times faster than recorded (0 replays them without delay)",
+			Value: 1,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:   "fallback-transport",
+			Usage:  "Fall back to `TRANSPORT` when the primary transport is unreachable",
+			Hidden: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:   "failover-delay",
+			Usage:  "Switch to the fallback transport after the primary transport is unreachable for `DURATION`",
+			Value:  30 * time.Second,
+			Hidden: true,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "nats-jetstream",
+			Usage: "Publish and consume data messages through NATS JetStream, so that they survive disconnections (requires a stream capturing the data subjects)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "message-encoding",
+			Usage: "Encode MQTT messages with `ENCODING` (json or cbor) once the server accepts it",
+			Value: "json",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "content-compression",
+			Usage: "Compress data message content with `ALGORITHM` (none, gzip or zstd) once the server accepts it",
+			Value: "none",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "content-compression-threshold",
+			Usage: "Compress data message content of at least `BYTES`",
+			Value: 1024,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "message-expiry",
+			Usage: "Let the broker or server discard published messages of a class (event for events, default for data messages without a class) not delivered within a duration, in the form `CLASS=DURATION`",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "worker-temp-quota",
+			Usage: "Provide workers with a temporary directory of at most `BYTES` for each message (0 disables)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "verify-message-signatures",
+			Usage: "Drop control and data messages not signed with a key in " + messageKeysDir(),
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "payload-encryption",
+			Usage: "Encrypt data message content end to end with the age keys in " + filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName),
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:   "http-server",
 			Usage:  "HTTP server to use for HTTP transport",
 			Value:  "localhost:8888",
 			Hidden: true,
 		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:   "http-polling-interval",
+			Usage:  "Poll the HTTP server every `DURATION` while messages are received",
+			Value:  time.Second,
+			Hidden: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:   "http-max-polling-interval",
+			Usage:  "Back off polling the idle HTTP server to at most every `DURATION`",
+			Value:  time.Minute,
+			Hidden: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:   "http-token-file",
+			Usage:  "Authenticate to the HTTP server with the bearer token read from `FILE`",
+			Hidden: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:   "http-token-url",
+			Usage:  "Authenticate to the HTTP server with access tokens obtained from the OAuth2 token endpoint at `URL`",
+			Hidden: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:   "http-client-id",
+			Usage:  "Use `ID` as OAuth2 client ID",
+			Hidden: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:   "http-client-secret",
+			Usage:  "Use `SECRET` as OAuth2 client secret",
+			Hidden: true,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:   "http-token-scope",
+			Usage:  "Request OAuth2 access tokens with `SCOPE`",
+			Hidden: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:   "http-token-skew",
+			Usage:  "Refresh OAuth2 access tokens `DURATION` before they expire",
+			Value:  auth.DefaultSkew,
+			Hidden: true,
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:   "client-id-source",
-			Usage:  "Source of the client-id used to connect to remote servers. Possible values: cert-cn, machine-id",
+			Usage:  "Source of the client-id used to connect to remote servers. Possible values: cert-cn, machine-id, dmi-uuid, hostname, command",
 			Value:  "cert-cn",
 			Hidden: true,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:   "client-id-command",
+			Usage:  "Run `COMMAND` with the shell and use its output as the client-id when client-id-source is \"command\"",
+			Hidden: true,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "dispatch-max-attempts",
+			Usage: "Attempt delivering a message to a worker that cannot be reached up to `NUM` times",
+			Value: 5,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "dispatch-retry-interval",
+			Usage: "Wait `DURATION` before retrying a failed delivery, doubling the wait after each attempt",
+			Value: time.Second,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "clock-jump-threshold",
+			Usage: "Reconnect the transport when the system clock jumps by more than `DURATION` (0 disables detection)",
+			Value: time.Minute,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "worker-verification",
+			Usage: "Verify workers against their listed digests or detached signatures before starting them. Possible values: off, warn, enforce",
+			Value: string(VerificationOff),
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "message-journal-ttl",
+			Usage: "Drop messages whose ID was already received within `DURATION` (0 disables the journal)",
+			Value: 24 * time.Hour,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "bulk-transfer-window",
+			Usage: "Only download or upload detached message content during the daily window `HH:MM-HH:MM` (may be repeated)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "blackout-window",
+			Usage: "Hold data messages received during the daily window `HH:MM-HH:MM` until it closes (may be repeated)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "bulk-transfer-unmetered",
+			Usage: "Hold downloads and uploads of detached message content while NetworkManager reports a metered connection",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "network-manager",
+			Usage: "Follow NetworkManager: disconnect while the system has no connectivity, connect as soon as it returns, and hold downloads and uploads of detached message content on metered connections",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "max-upload-rate",
+			Usage: "Send at most `BYTES` per second over HTTP, to the data host or HTTP server (0 disables the limit)",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "max-download-rate",
+			Usage: "Receive at most `BYTES` per second over HTTP, from the data host or HTTP server (0 disables the limit)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "peer-cache-addr",
+			Usage: "Share downloaded message content with yggd instances on the local network found with multicast DNS, serving it on the TCP address `HOST:PORT` and fetching content from them before the server",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "peer-cache-quota",
+			Usage: "Keep up to `BYTES` of downloaded message content for peers",
+			Value: 1 << 30,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "worker-env-allow",
+			Usage: "Allow the server to set worker variables matching `PATTERN` with the set-env command (may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "upload-url",
+			Usage: "Upload files offloaded by workers under `URL`, followed by the client ID and message ID",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "file-fetch-allow",
+			Usage: "Let the server fetch the files matching the absolute `PATTERN` with a fetch-files command (may be repeated)",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "file-fetch-max-size",
+			Usage: "Fetch at most `BYTES` of files per fetch-files command",
+			Value: 100 * 1024 * 1024,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "file-fetch-redact",
+			Usage: "Redact the values of the keys containing `KEY` from fetched files, in addition to " + strings.Join(defaultMirrorRedactions, ", ") + " (may be repeated)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "report-errors",
+			Usage: "Include the last error of each subsystem in connection-status messages",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "retain-connection-status",
+			Usage: "Publish connection-status messages as retained messages",
+			Value: true,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "message-state-events",
+			Usage: "Publish a message-state event each time a data message received from the server is accepted, delivered, responded to or failed",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:  "spool-quota",
+			Usage: "Store up to `BYTES` of data messages on disk while disconnected, publishing them once connected (0 disables the spool)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "spool-class",
+			Usage: "Evict messages of a class from the full spool with a policy (drop-oldest, drop-lowest-priority or reject-new) and priority, in the form `CLASS=POLICY[:PRIORITY]`",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "start-disconnected",
+			Usage: "Start without connecting the transport, spooling data messages until connected with 'yggctl connect' or during a connection window (requires --spool-quota)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "connect-window",
+			Usage: "When started disconnected, connect the transport daily between the local times `HH:MM-HH:MM`",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "wake-pipe",
+			Usage: "Connect and poll the server now for each line written to the named pipe `FILE`",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "wake-command",
+			Usage: "Connect and poll the server now for each line `COMMAND` writes to its standard output",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "wake-duration",
+			Usage: "When started disconnected, stay connected for `DURATION` after a wake signal",
+			Value: 10 * time.Minute,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "facade",
+			Usage: "Let a local product attach to the namespace of directives `NAMESPACE[=RATE[/BURST]]`, publishing up to RATE messages per second through the connection",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "route",
+			Usage: "Dispatch messages for a directive, or for the directives matching a regular expression prefixed with ~, to other handlers, in the form `DIRECTIVE=HANDLER[,HANDLER]`",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "dispatch-queue-size",
+			Usage: "Hold up to `N` messages in each of the send and receive queues",
+			Value: 1000,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "dispatch-workers",
+			Usage: "Dispatch messages for up to `N` directives in parallel",
+			Value: 4,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "queue-full-policy",
+			Usage: "Wait for room in a full queue, or for a rate limit, before queueing a message, or drop it (`POLICY` is one of 'defer' or 'drop')",
+			Value: string(QueuePolicyDefer),
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "directive-rate-limit",
+			Usage: "Dispatch at most `DIRECTIVE=RATE[/BURST]` messages per second to a directive (may be repeated)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "directive-concurrency",
+			Usage: "Keep at most `DIRECTIVE[=N]` messages, 1 by default, in flight to a directive until its worker responds (may be repeated)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "directive-concurrency-timeout",
+			Usage: "Stop waiting for a response to a message limited by directive-concurrency after `DURATION` (0 waits indefinitely)",
+			Value: 10 * time.Minute,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "restricted-directive",
+			Usage: "Only dispatch messages for `DIRECTIVE`, or namespace of directives, while a signed grant allows it (may be repeated)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "max-grant-duration",
+			Usage: "Reject grants allowing a restricted directive for longer than `DURATION`",
+			Value: time.Hour,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-credential-lifetime",
+			Usage: "Hand workers secrets and identity tokens valid for `DURATION`",
+			Value: 5 * time.Minute,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "admin-socket",
+			Usage: "Serve the admin API on the unix socket (named pipe on Windows) at `PATH`",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "admin-token-file",
+			Usage: "Require admin API requests to carry the bearer token read from `FILE`, or the secret NAME if set to \"secret:NAME\"",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "mirror-file",
+			Usage: "Append every message published or received, redacted, as a line of JSON to `FILE`, for debugging",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "mirror-socket",
+			Usage: "Stream every message published or received, redacted, as lines of JSON to the clients of the unix socket (named pipe on Windows) at `PATH`, for debugging",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "mirror-redact",
+			Usage: "Redact the values of the keys containing `KEY` from mirrored messages, in addition to " + strings.Join(defaultMirrorRedactions, ", ") + " (may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "status-addr",
+			Usage: "Serve the status, /healthz and /readyz endpoints on the TCP address `HOST:PORT`",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "kafka-broker",
+			Usage: "Publish data messages to the Kafka cluster bootstrapped from the broker at `HOST:PORT` instead of the transport (may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "kafka-topic",
+			Usage: "Publish data messages to the Kafka topic `TOPIC`, in which " + kafka.DirectivePlaceholder + " is replaced by the directive of each message",
+			Value: yggdrasil.ShortName + "." + kafka.DirectivePlaceholder,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "kafka-tls",
+			Usage: "Connect to the Kafka brokers over TLS, with the client certificate and root CAs of the transport",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "kafka-username",
+			Usage: "Authenticate to the Kafka brokers with SASL PLAIN as `USERNAME`, or as the secret NAME if set to \"secret:NAME\"",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "kafka-password",
+			Usage: "Authenticate to the Kafka brokers with `PASSWORD`, or with the secret NAME stored with \"yggctl secret set\" if set to \"secret:NAME\"",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "secrets-backend",
+			Usage: "Unseal the secrets referred to as \"secret:NAME\" with `BACKEND` (\"key-file\" or \"tpm2\")",
+			Value: secrets.BackendKeyFile,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "dns-timeout",
+			Usage: "Give up resolving a server host name after `DURATION` (0 disables the timeout)",
+			Value: dialer.DefaultTimeouts.DNS,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "connect-timeout",
+			Usage: "Give up connecting to a server address after `DURATION` (0 disables the timeout)",
+			Value: dialer.DefaultTimeouts.Connect,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "tls-handshake-timeout",
+			Usage: "Give up the TLS handshake with a server after `DURATION` (0 disables the timeout)",
+			Value: dialer.DefaultTimeouts.TLSHandshake,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "startup-timeout",
+			Usage: "Keep trying to connect at startup until `DURATION` after yggd started, then exit with a code telling why it could not connect (0 exits after the first failed attempt)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "wait-network-online",
+			Usage: "Wait up to `DURATION` at startup for systemd to reach network-online.target before connecting (0 does not wait)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "wait-time-sync",
+			Usage: "Wait up to `DURATION` at startup for the system clock to be synchronized, as reported by timedatectl, before connecting (0 does not wait)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "handshake-timeout",
+			Usage: "Give up the protocol handshake with a server, such as the MQTT CONNECT exchange, after `DURATION` (0 disables the timeout)",
+			Value: dialer.DefaultTimeouts.Handshake,
+		}),
 	}
 
 	// This BeforeFunc will load flag values from a config file only if the
@@ -135,16 +605,21 @@ func main() {
 	app.Before = func(c *cli.Context) error {
 		filePath := c.String("config")
 		if filePath != "" {
-			inputSource, err := altsrc.NewTomlSourceFromFile(filePath)
+			inputSource, profile, err := newConfigSource(filePath, c.String("profile"))
 			if err != nil {
 				return err
 			}
+			configProfile = profile
+			configFile = filePath
 			return altsrc.ApplyInputSourceValues(c, inputSource, app.Flags)
+		} else if c.String("profile") != "" {
+			return fmt.Errorf("cannot use profile %v without a config file", c.String("profile"))
 		}
 		return nil
 	}
 
 	app.Action = func(c *cli.Context) error {
+		started := time.Now()
 		if c.Bool("generate-man-page") || c.Bool("generate-markdown") {
 			type GenerationFunc func() (string, error)
 			var generationFunc GenerationFunc
@@ -171,67 +646,323 @@ func main() {
 			yggdrasil.DataHost = c.String("data-host")
 		}
 
-		// Set up a channel to receive the TERM or INT signal over and clean up
+		if err := openSecretStore(c); err != nil {
+			return cli.Exit(fmt.Errorf("cannot open secrets: %w", err), 1)
+		}
+
+		// Set up a channel to receive the TERM or INT signal (or the stop
+		// request of the Windows service control manager) over and clean up
 		// before quitting.
 		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+		notifyQuit(quit)
 
 		// Set up logging
 		level, err := log.ParseLevel(c.String("log-level"))
 		if err != nil {
 			return cli.Exit(err, 1)
 		}
-		log.SetLevel(level)
-		log.SetPrefix(fmt.Sprintf("[%v] ", app.Name))
-		if log.CurrentLevel() >= log.LevelDebug {
-			log.SetFlags(log.LstdFlags | log.Llongfile)
+		logging.SetLevel(level)
+		overrides, err := logging.ParseSubsystemLevels(c.StringSlice("log-level-override"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		logging.SetSubsystemLevels(overrides)
+		if size := c.Int("log-buffer-size"); size > 0 {
+			r, err := logging.NewRing(size)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("cannot create log buffer: %w", err), 1)
+			}
+			logging.SetRing(r)
+		}
+		go watchLogDumpSignal()
+		if err := setLogFormat(c.String("log-format"), app.Name); err != nil {
+			return cli.Exit(err, 1)
 		}
 
 		log.Infof("starting %v version %v", app.Name, app.Version)
+		if configProfile != "" {
+			log.Infof("using configuration profile %v", configProfile)
+		}
+
+		// Workers left running by the previous instance are reattached to
+		// rather than killed, reusing the dispatcher socket they send to.
+		keepWorkers = c.Bool("keep-workers")
+		var registry *workerRegistry
+		if keepWorkers {
+			registry, err = readRegistry(registryFile())
+			if err != nil {
+				log.Errorf("cannot reattach workers: %v", err)
+			}
+			if registry != nil && registry.SocketAddr != "" && !c.IsSet("socket-addr") {
+				if err := c.Set("socket-addr", registry.SocketAddr); err != nil {
+					return cli.Exit(err, 1)
+				}
+			}
+		}
 
 		log.Trace("attempting to kill any orphaned workers")
-		if err := killWorkers(); err != nil {
+		if err := killWorkers(registry.running()); err != nil {
 			return cli.Exit(fmt.Errorf("cannot kill workers: %w", err), 1)
 		}
 
 		ClientID, err = getClientID(c)
 		if err != nil {
+			if c.String("client-id-source") == "cert-cn" {
+				return cli.Exit(err, exitCertificate)
+			}
 			return cli.Exit(err, 1)
 		}
 
+		if ttl := c.Duration("message-journal-ttl"); ttl > 0 {
+			journal, err = openMessageJournal(messageJournalFile(), ttl)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("cannot open message journal: %w", err), 1)
+			}
+			defer journal.Close()
+		}
+
 		// Read certificates, create a TLS config, and initialize HTTP client
 		var certData, keyData []byte
 		if c.String("cert-file") != "" && c.String("key-file") != "" {
 			var err error
 			certData, err = ioutil.ReadFile(c.String("cert-file"))
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot read certificate file: %v", err), 1)
+				return cli.Exit(fmt.Errorf("cannot read certificate file: %v", err), exitCertificate)
 			}
-			keyData, err = ioutil.ReadFile(c.String("key-file"))
-			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot read key file: %w", err), 1)
+			if !isPKCS11URI(c.String("key-file")) {
+				keyData, err = ioutil.ReadFile(c.String("key-file"))
+				if err != nil {
+					return cli.Exit(fmt.Errorf("cannot read key file: %w", err), exitCertificate)
+				}
 			}
 		}
 		rootCAs := make([][]byte, 0)
 		for _, file := range c.StringSlice("ca-root") {
 			data, err := ioutil.ReadFile(file)
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot read certificate authority: %v", err), 1)
+				return cli.Exit(fmt.Errorf("cannot read certificate authority: %v", err), exitCertificate)
 			}
 			rootCAs = append(rootCAs, data)
 		}
 		tlsConfig, err := newTLSConfig(certData, keyData, rootCAs)
 		if err != nil {
-			return cli.Exit(fmt.Errorf("cannot create TLS config: %w", err), 1)
+			return cli.Exit(fmt.Errorf("cannot create TLS config: %w", err), exitCertificate)
+		}
+		if len(certData) > 0 && isPKCS11URI(c.String("key-file")) {
+			cert, err := newPKCS11Certificate(certData, c.String("key-file"))
+			if err != nil {
+				return cli.Exit(fmt.Errorf("cannot load client key: %w", err), exitCertificate)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		httpClient := http2.NewHTTPClient(tlsConfig, getUserAgent(app), dialer.New(dialTimeouts(c)))
+		if c.Int("data-retry-attempts") < 1 {
+			return cli.Exit(fmt.Errorf("invalid value for data-retry-attempts: %v", c.Int("data-retry-attempts")), 1)
+		}
+		if c.Duration("data-retry-backoff") < 0 || c.Duration("data-retry-max-backoff") < c.Duration("data-retry-backoff") {
+			return cli.Exit(fmt.Errorf("invalid value for data-retry-max-backoff: %v", c.Duration("data-retry-max-backoff")), 1)
+		}
+		httpClient.Retry = http2.RetryPolicy{
+			MaxAttempts: c.Int("data-retry-attempts"),
+			StatusCodes: c.IntSlice("data-retry-status"),
+			MinBackoff:  c.Duration("data-retry-backoff"),
+			MaxBackoff:  c.Duration("data-retry-max-backoff"),
+		}
+		for _, name := range []string{"max-upload-rate", "max-download-rate"} {
+			if c.Int64(name) < 0 {
+				return cli.Exit(fmt.Errorf("invalid value for %v: %v", name, c.Int64(name)), 1)
+			}
+		}
+		httpClient.UploadLimiter = http2.NewLimiter(c.Int64("max-upload-rate"))
+		httpClient.DownloadLimiter = http2.NewLimiter(c.Int64("max-download-rate"))
+		if c.Int("data-circuit-threshold") > 0 {
+			httpClient.Breaker = &http2.CircuitBreaker{
+				Threshold: c.Int("data-circuit-threshold"),
+				Cooldown:  c.Duration("data-circuit-cooldown"),
+			}
+		} else if c.Int("data-circuit-threshold") < 0 {
+			return cli.Exit(fmt.Errorf("invalid value for data-circuit-threshold: %v", c.Int("data-circuit-threshold")), 1)
 		}
-		httpClient := http2.NewHTTPClient(tlsConfig, getUserAgent(app))
 
 		// Create gRPC dispatcher service
-		d := newDispatcher(httpClient)
-		s := grpc.NewServer()
+		switch mode := VerificationMode(c.String("worker-verification")); mode {
+		case VerificationOff, VerificationWarn, VerificationEnforce:
+			WorkerVerification = mode
+		default:
+			return cli.Exit(fmt.Errorf("invalid value for worker-verification: %v", mode), 1)
+		}
+
+		if c.Duration("worker-gc-interval") < 0 {
+			return cli.Exit(fmt.Errorf("invalid value for worker-gc-interval: %v", c.Duration("worker-gc-interval")), 1)
+		}
+		if c.Int("dispatch-max-attempts") < 1 {
+			return cli.Exit(fmt.Errorf("invalid value for dispatch-max-attempts: %v", c.Int("dispatch-max-attempts")), 1)
+		}
+		if c.Int("dispatch-workers") < 1 {
+			return cli.Exit(fmt.Errorf("invalid value for dispatch-workers: %v", c.Int("dispatch-workers")), 1)
+		}
+		if c.Int("dispatch-queue-size") < 1 {
+			return cli.Exit(fmt.Errorf("invalid value for dispatch-queue-size: %v", c.Int("dispatch-queue-size")), 1)
+		}
+		d := newDispatcher(httpClient, c.Int("dispatch-max-attempts"), c.Duration("dispatch-retry-interval"), c.Int("dispatch-queue-size"))
+		d.socketAddr = c.String("socket-addr")
+		if c.Duration("worker-credential-lifetime") <= 0 {
+			return cli.Exit(fmt.Errorf("invalid value for worker-credential-lifetime: %v", c.Duration("worker-credential-lifetime")), 1)
+		}
+		d.credentialLifetime = c.Duration("worker-credential-lifetime")
+		if len(tlsConfig.Certificates) > 0 {
+			d.identity = &idtoken.Issuer{
+				ClientID:    ClientID,
+				Certificate: tlsConfig.Certificates[0],
+				Lifetime:    d.credentialLifetime,
+			}
+		}
+		switch policy := QueuePolicy(c.String("queue-full-policy")); policy {
+		case QueuePolicyDefer, QueuePolicyDrop:
+			d.queuePolicy = policy
+		default:
+			return cli.Exit(fmt.Errorf("invalid value for queue-full-policy: %v", policy), 1)
+		}
+		limits, err := parseRateLimits(c.StringSlice("directive-rate-limit"))
+		if err != nil {
+			return cli.Exit(fmt.Errorf("invalid value for directive-rate-limit: %w", err), 1)
+		}
+		if len(limits) > 0 {
+			d.limiter = &rateLimiter{limits: limits}
+		}
+		concurrency, err := parseConcurrencyLimits(c.StringSlice("directive-concurrency"))
+		if err != nil {
+			return cli.Exit(fmt.Errorf("invalid value for directive-concurrency: %w", err), 1)
+		}
+		if timeout := c.Duration("directive-concurrency-timeout"); timeout < 0 {
+			return cli.Exit(fmt.Errorf("invalid value for directive-concurrency-timeout: %v", timeout), 1)
+		}
+		if len(concurrency) > 0 {
+			d.concurrency = newConcurrencyLimiter(concurrency, c.Duration("directive-concurrency-timeout"), cap(d.sendQ), d.deliver)
+			concurrencyMetrics.Set("waiting", expvar.Func(func() interface{} { return d.concurrency.len() }))
+		}
+		queueMetrics.Set("send.depth", expvar.Func(func() interface{} { return len(d.sendQ) }))
+		queueMetrics.Set("send.high.depth", expvar.Func(func() interface{} { return len(d.sendHighQ) }))
+		queueMetrics.Set("send.low.depth", expvar.Func(func() interface{} { return len(d.sendLowQ) }))
+		queueMetrics.Set("receive.depth", expvar.Func(func() interface{} { return len(d.recvQ) }))
+		d.transfers, err = newTransferPolicy(c.StringSlice("bulk-transfer-window"), c.Bool("bulk-transfer-unmetered") || c.Bool("network-manager"))
+		if err != nil {
+			return cli.Exit(fmt.Errorf("invalid value for bulk-transfer-window: %w", err), 1)
+		}
+		if quota := c.Int64("spool-quota"); quota > 0 {
+			classes, err := parseSpoolClasses(c.StringSlice("spool-class"))
+			if err != nil {
+				return cli.Exit(fmt.Errorf("invalid value for spool-class: %w", err), 1)
+			}
+			d.spool, err = openSpool(spoolDir(), quota, classes)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("cannot open spool: %w", err), 1)
+			}
+			spoolMetrics.Set("messages", expvar.Func(func() interface{} { return d.spool.len() }))
+			spoolMetrics.Set("bytes", expvar.Func(func() interface{} { return d.spool.size() }))
+		} else if quota < 0 {
+			return cli.Exit(fmt.Errorf("invalid value for spool-quota: %v", quota), 1)
+		}
+		d.scheduler, err = newMessageScheduler(scheduleDir(), c.StringSlice("blackout-window"), func(data yggdrasil.Data) {
+			if !d.enqueueSend(data) {
+				go d.deliveryFailed(data, 0, fmt.Errorf("send queue is full"))
+			}
+		})
+		if err != nil {
+			return cli.Exit(fmt.Errorf("invalid value for blackout-window: %w", err), 1)
+		}
+		if err := d.scheduler.load(time.Now()); err != nil {
+			return cli.Exit(fmt.Errorf("cannot load scheduled messages: %w", err), 1)
+		}
+		scheduleMetrics.Set("scheduled", expvar.Func(func() interface{} { return d.scheduler.len() }))
+		if directives := c.StringSlice("restricted-directive"); len(directives) > 0 {
+			d.grants = newDirectiveGrants(directives, c.Duration("max-grant-duration"))
+		}
+		facades, quotas, err := parseFacades(c.StringSlice("facade"))
+		if err != nil {
+			return cli.Exit(fmt.Errorf("invalid value for facade: %w", err), 1)
+		}
+		d.facades = facades
+		d.routes, err = parseRoutes(c.StringSlice("route"))
+		if err != nil {
+			return cli.Exit(fmt.Errorf("invalid value for route: %w", err), 1)
+		}
+		if len(quotas) > 0 {
+			d.quotas = &rateLimiter{limits: quotas}
+		}
+		if c.Bool("start-disconnected") && d.spool == nil {
+			return cli.Exit(fmt.Errorf("start-disconnected requires spool-quota"), 1)
+		}
+		d.uploadURL = c.String("upload-url")
+		if allow := c.StringSlice("file-fetch-allow"); len(allow) > 0 {
+			d.fileFetch, err = newFileFetchPolicy(allow, c.Int64("file-fetch-max-size"), c.StringSlice("file-fetch-redact"))
+			if err != nil {
+				return cli.Exit(fmt.Errorf("invalid value for file-fetch-allow: %w", err), 1)
+			}
+		}
+		d.messageStateEvents = c.Bool("message-state-events")
+		transport.ReportErrors = c.Bool("report-errors")
+		transport.RetainConnectionStatus = c.Bool("retain-connection-status")
+		switch c.String("message-encoding") {
+		case "json":
+		case transport.EncodingCBOR:
+			if TransportType(c.String("transport")) != MQTT || (c.String("fallback-transport") != "" && TransportType(c.String("fallback-transport")) != MQTT) {
+				return cli.Exit(fmt.Errorf("message-encoding %v requires the mqtt transport", transport.EncodingCBOR), 1)
+			}
+			transport.CBOR = true
+		default:
+			return cli.Exit(fmt.Errorf("invalid value for message-encoding: %v", c.String("message-encoding")), 1)
+		}
+		switch c.String("content-compression") {
+		case "none":
+		case transport.ContentEncodingGzip, transport.ContentEncodingZstd:
+			transport.Compression = c.String("content-compression")
+		default:
+			return cli.Exit(fmt.Errorf("invalid value for content-compression: %v", c.String("content-compression")), 1)
+		}
+		if c.Int("content-compression-threshold") < 0 {
+			return cli.Exit(fmt.Errorf("invalid value for content-compression-threshold: %v", c.Int("content-compression-threshold")), 1)
+		}
+		transport.CompressionThreshold = c.Int("content-compression-threshold")
+		transport.MessageExpiry, err = transport.ParseMessageExpiry(c.StringSlice("message-expiry"))
+		if err != nil {
+			return cli.Exit(fmt.Errorf("invalid value for message-expiry: %w", err), 1)
+		}
+		if c.Bool("verify-message-signatures") {
+			d.messageKeys, err = readMessageKeys(messageKeysDir())
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+		}
+		if c.Bool("payload-encryption") {
+			transport.PayloadIdentity, err = loadPayloadIdentity(payloadIdentityFile())
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			transport.PayloadRecipients, err = loadPayloadRecipients(payloadRecipientsFile())
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+		}
+		d.schemas = newContentSchemas(schemasDir())
+		transport.CurrentTags = d.tags.merged
+		if quota := c.Int64("worker-temp-quota"); quota > 0 {
+			d.tempDirs, err = newTempDirs(tempDirRoot(), quota)
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			go d.watchTempDirs()
+		} else if quota < 0 {
+			return cli.Exit(fmt.Errorf("invalid value for worker-temp-quota: %v", quota), 1)
+		}
+		d.env, err = loadWorkerEnv(workerEnvFile(), c.StringSlice("worker-env-allow"))
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot load worker environment: %w", err), 1)
+		}
+		s := grpc.NewServer(grpc.Creds(peerCredentials{}))
 		pb.RegisterDispatcherServer(s, d)
 
-		l, err := net.Listen("unix", c.String("socket-addr"))
+		l, err := ipc.Listen(c.String("socket-addr"))
 		if err != nil {
 			return cli.Exit(fmt.Errorf("cannot listen to socket: %w", err), 1)
 		}
@@ -242,13 +973,158 @@ func main() {
 			}
 		}()
 
+		if port := c.Int("vsock-port"); port > 0 {
+			addr := ipc.VsockListenAddr(uint32(port))
+			vl, err := ipc.Listen(addr)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("cannot listen to VM socket: %w", err), 1)
+			}
+			go func() {
+				log.Infof("listening on VM socket: %v", addr)
+				if err := s.Serve(vl); err != nil {
+					log.Errorf("cannot start server: %v", err)
+				}
+			}()
+		}
+
+		if c.String("admin-socket") != "" {
+			if err := serveAdmin(c.String("admin-socket"), c.String("admin-token-file"), d); err != nil {
+				return cli.Exit(fmt.Errorf("cannot start admin API: %w", err), 1)
+			}
+		}
+
+		if c.String("mirror-file") != "" || c.String("mirror-socket") != "" {
+			mirror := newMessageMirror(c.StringSlice("mirror-redact"))
+			if path := c.String("mirror-file"); path != "" {
+				if err := mirror.openFile(path); err != nil {
+					return cli.Exit(fmt.Errorf("cannot mirror messages: %w", err), 1)
+				}
+			}
+			if path := c.String("mirror-socket"); path != "" {
+				if err := mirror.listen(path); err != nil {
+					return cli.Exit(fmt.Errorf("cannot mirror messages: %w", err), 1)
+				}
+			}
+			defer mirror.close()
+			addMirror(mirror.mirror)
+		}
+		if path := c.String("record-file"); path != "" {
+			recorder, err := newMessageRecorder(path)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("cannot record messages: %w", err), 1)
+			}
+			defer recorder.close()
+			addMirror(recorder.record)
+			log.Infof("recording messages to %v", path)
+		}
+
+		if addr := c.String("peer-cache-addr"); addr != "" {
+			if c.Int64("peer-cache-quota") <= 0 {
+				return cli.Exit(fmt.Errorf("invalid value for peer-cache-quota: %v", c.Int64("peer-cache-quota")), 1)
+			}
+			peerCache = newContentPeers(ClientID, peerCacheDir(), c.Int64("peer-cache-quota"))
+			if err := peerCache.serve(addr); err != nil {
+				return cli.Exit(fmt.Errorf("cannot serve content to peers: %w", err), 1)
+			}
+		}
+
 		controlPlaneTransport, err := createTransport(c, tlsConfig, d)
 		if err != nil {
 			return cli.Exit(err.Error(), 1)
 		}
-		err = controlPlaneTransport.Start()
-		if err != nil {
-			return cli.Exit(err, 1)
+		if c.String("inject-file") != "" && simulator == nil {
+			return cli.Exit(fmt.Errorf("inject-file requires --transport %v", None), 1)
+		}
+		if c.String("replay-file") != "" && simulator == nil {
+			return cli.Exit(fmt.Errorf("replay-file requires --transport %v", None), 1)
+		}
+		if c.Float64("replay-speed") < 0 {
+			return cli.Exit(fmt.Errorf("invalid value for replay-speed: %v", c.Float64("replay-speed")), 1)
+		}
+		if c.Bool("network-manager") {
+			network = newNetworkMonitor(controlPlaneTransport)
+			network.init()
+			if d.transfers != nil {
+				d.transfers.metered = network.metered
+			}
+		}
+		var wakeTriggers []wake.Trigger
+		if path := c.String("wake-pipe"); path != "" {
+			wakeTriggers = append(wakeTriggers, &wake.FIFO{Path: path})
+		}
+		if commandLine := c.String("wake-command"); commandLine != "" {
+			trigger, err := wake.ParseCommand(commandLine)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("invalid value for wake-command: %w", err), 1)
+			}
+			wakeTriggers = append(wakeTriggers, trigger)
+		}
+		if c.Duration("wake-duration") <= 0 {
+			return cli.Exit(fmt.Errorf("invalid value for wake-duration: %v", c.Duration("wake-duration")), 1)
+		}
+		for _, trigger := range wakeTriggers {
+			go watchWake(trigger, controlPlaneTransport, c.Duration("wake-duration"))
+		}
+		if c.Bool("start-disconnected") {
+			gate, err = newConnectionGate(controlPlaneTransport, c.StringSlice("connect-window"))
+			if err != nil {
+				return cli.Exit(fmt.Errorf("invalid value for connect-window: %w", err), 1)
+			}
+			log.Info("started disconnected; spooling data messages until connected")
+			go gate.watchWindows(len(wakeTriggers) > 0)
+		} else if !network.online() {
+			network.suspend()
+			log.Info("network offline; connecting once it is online")
+		} else {
+			// Certificates cannot be validated before the clock is set, so
+			// the handshake is put off until the network and clock are
+			// ready on slow-starting devices.
+			var preconditions []startupPrecondition
+			if timeout := c.Duration("wait-network-online"); timeout > 0 {
+				preconditions = append(preconditions, startupPrecondition{name: preconditionNetworkOnline, timeout: timeout, met: networkOnline})
+			}
+			if timeout := c.Duration("wait-time-sync"); timeout > 0 {
+				preconditions = append(preconditions, startupPrecondition{name: preconditionTimeSync, timeout: timeout, met: timeSynchronized})
+			}
+			waitForPreconditions(preconditions)
+
+			var deadline time.Time
+			if timeout := c.Duration("startup-timeout"); timeout > 0 {
+				deadline = started.Add(timeout)
+			}
+			err = startTransport(controlPlaneTransport, deadline)
+			if err != nil {
+				return cli.Exit(err, startupExitCode(err))
+			}
+		}
+		if network != nil {
+			go network.watch()
+		}
+		if path := c.String("inject-file"); path != "" {
+			go injectFile(path, c.Duration("inject-delay"))
+		}
+		if path := c.String("replay-file"); path != "" {
+			go replayFile(path, c.Float64("replay-speed"), c.Duration("inject-delay"))
+		}
+
+		// Data messages are published to Kafka, if configured, while control
+		// messages keep flowing over the transport.
+		dataPlaneTransport := controlPlaneTransport
+		if len(c.StringSlice("kafka-broker")) > 0 {
+			sink, err := newKafkaSink(c, tlsConfig)
+			if err != nil {
+				return cli.Exit(err, 1)
+			}
+			if err := sink.Start(); err != nil {
+				log.Errorf("cannot connect to Kafka brokers: %v", err)
+			}
+			dataPlaneTransport = sink
+		}
+
+		if c.String("status-addr") != "" {
+			if err := serveStatus(c.String("status-addr"), d, controlPlaneTransport); err != nil {
+				return cli.Exit(fmt.Errorf("cannot start status endpoint: %w", err), 1)
+			}
 		}
 
 		// Start a goroutine that receives values on the 'dispatchers' channel
@@ -256,15 +1132,16 @@ func main() {
 		var prevDispatchersHash atomic.Value
 		go func() {
 			for dispatchers := range d.dispatchers {
-				data, err := json.Marshal(dispatchers)
+				workers := d.makeWorkersMap()
+				data, err := json.Marshal([]interface{}{dispatchers, workers})
 				if err != nil {
 					log.Errorf("cannot marshal dispatcher map to JSON: %v", err)
 					continue
 				}
 
-				// Create a checksum of the dispatchers map. If it's identical
-				// to the previous checksum, skip publishing a connection-status
-				// message.
+				// Create a checksum of the dispatchers and workers maps. If
+				// it's identical to the previous checksum, skip publishing a
+				// connection-status message.
 				sum := fmt.Sprintf("%x", sha256.Sum256(data))
 				oldSum := prevDispatchersHash.Load()
 				if oldSum != nil {
@@ -273,17 +1150,71 @@ func main() {
 					}
 				}
 				prevDispatchersHash.Store(sum)
-				go transport.PublishConnectionStatus(controlPlaneTransport, dispatchers)
+				go transport.PublishConnectionStatus(controlPlaneTransport, dispatchers, workers)
+			}
+		}()
+
+		// Start a goroutine that watches for wall clock jumps (for example a
+		// first NTP synchronization on a device without an RTC) and reconnects
+		// the transport, since its TLS session may have been established
+		// while the clock was wrong.
+		if threshold := c.Duration("clock-jump-threshold"); threshold > 0 {
+			go func() {
+				for skew := range clock.WatchJumps(10*time.Second, threshold) {
+					d.expiries.Rebase()
+					if err := journal.shift(skew); err != nil {
+						log.Errorf("cannot shift message journal: %v", err)
+					}
+					if !gate.allowed() || !network.online() {
+						continue
+					}
+					log.Warnf("system clock jumped by %v; reconnecting", skew)
+					controlPlaneTransport.Disconnect(500)
+					if err := controlPlaneTransport.Start(); err != nil {
+						log.Errorf("cannot reconnect transport: %v", err)
+					}
+				}
+			}()
+		}
+
+		// Start a goroutine that receives subscription requests from workers
+		// and subscribes to their additional topics on the transport.
+		go func() {
+			for s := range d.subscriptions {
+				subscriber, ok := controlPlaneTransport.(transport.Subscriber)
+				if !ok {
+					log.Warnf("cannot subscribe to topic %v: transport does not support additional topics", s.topic)
+					continue
+				}
+				var err error
+				if s.remove {
+					err = subscriber.Unsubscribe(s.topic)
+				} else {
+					err = subscriber.Subscribe(s.topic, d.topicHandler(s.directive))
+				}
+				if err != nil {
+					log.Error(err)
+				}
 			}
 		}()
 
 		// Start a goroutine that receives yggdrasil.Data values on a 'send'
 		// channel and dispatches them to worker processes.
-		go d.sendData()
+		go d.sendData(c.Int("dispatch-workers"))
 
 		// Start a goroutine that receives yggdrasil.Data values on a 'recv'
-		// channel and publish them to MQTT.
-		go transport.PublishReceivedData(controlPlaneTransport, d.recvQ)
+		// channel and publish them to MQTT, or Kafka. While disconnected, they
+		// are stored in the spool, if enabled, and published once connected.
+		if d.spool != nil {
+			go transport.PublishReceivedData(dataPlaneTransport, d.spoolData(dataPlaneTransport, d.recvQ), d.spoolUnpublished(dataPlaneTransport, d.dataPublished))
+			go d.flushSpool(dataPlaneTransport)
+		} else {
+			go transport.PublishReceivedData(dataPlaneTransport, d.recvQ, d.dataPublished)
+		}
+
+		// Start a goroutine that receives yggdrasil.Event values on an 'events'
+		// channel and publishes them to the control topic.
+		go transport.PublishEvents(controlPlaneTransport, d.stampEvents(d.events))
 
 		// Locate and start worker child processes.
 		workerPath := filepath.Join(yggdrasil.LibexecDir, yggdrasil.LongName)
@@ -297,34 +1228,66 @@ func main() {
 		}
 		configDir := filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName)
 		env := []string{
-			"YGG_SOCKET_ADDR=unix:" + c.String("socket-addr"),
-			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			"YGG_SOCKET_ADDR=" + ipc.Target(c.String("socket-addr")),
+			"PATH=" + workerSearchPath,
 			"BASE_CONFIG_DIR=" + configDir,
 			"LOG_LEVEL=" + level.String(),
 			"DEVICE_ID=" + ClientID,
 		}
+		// Workers described by a manifest in the workers.d directory are
+		// started from their manifest rather than from the worker directory.
+		manifestPath := workerManifestDir()
+		if err := os.MkdirAll(manifestPath, 0755); err != nil {
+			return cli.Exit(fmt.Errorf("cannot create directory: %w", err), 1)
+		}
+		manifestInfos, err := ioutil.ReadDir(manifestPath)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot read contents of directory: %w", err), 1)
+		}
+		reattached := d.reattachWorkers(registry, env)
+		if len(reattached) > 0 {
+			go d.subscribeReattached()
+			go d.sendDispatchersMap()
+		}
+		for _, info := range manifestInfos {
+			if file := filepath.Join(manifestPath, info.Name()); isWorkerManifest(file) && !reattached[file] {
+				log.Debugf("starting worker from manifest: %v", info.Name())
+				go startProcess(file, env, 0, d.deadWorkers)
+			}
+		}
+		execs := manifestExecs(manifestPath)
 		for _, info := range fileInfos {
-			if strings.HasSuffix(info.Name(), "worker") {
+			file := filepath.Join(workerPath, info.Name())
+			if isWorkerFile(info.Name()) && !execs[file] && !reattached[file] {
 				log.Debugf("starting worker: %v", info.Name())
-				go startProcess(filepath.Join(workerPath, info.Name()), env, 0, d.deadWorkers)
+				go startProcess(file, env, 0, d.deadWorkers)
 			}
 		}
-		// Start a goroutine that watches the worker directory for added or
-		// deleted files. Any "worker" files it detects are started up.
+		// Start goroutines that watch the worker and manifest directories for
+		// added or deleted files. Any "worker" or "worker.container" files, or
+		// manifests, they detect are started up.
 		go watchWorkerDir(workerPath, env, d.deadWorkers)
+		go watchWorkerDir(manifestPath, env, d.deadWorkers)
 
 		// Start a goroutine that receives handler values on a channel and
 		// removes the worker registration entry.
 		go d.unregisterWorker()
 
+		// Start a goroutine that reports unexpected worker exits.
+		go d.reportWorkerExits()
+
+		if interval := c.Duration("worker-gc-interval"); interval > 0 {
+			go d.collectStaleWorkers(interval)
+		}
+
 		// Start a goroutine that watches the tags file for write events and
 		// publishes connection status messages when the file changes.
 		go func() {
 			c := make(chan notify.EventInfo, 1)
 
-			fp := filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "tags.toml")
+			fp := yggdrasil.TagsFilePath()
 
-			if err := notify.Watch(fp, c, notify.InCloseWrite, notify.InDelete); err != nil {
+			if err := notify.Watch(fp, c, watchEvents...); err != nil {
 				log.Infof("cannot start watching '%v': %v", fp, err)
 				return
 			}
@@ -332,16 +1295,59 @@ func main() {
 
 			for e := range c {
 				log.Debugf("received inotify event %v", e.Event())
-				switch e.Event() {
-				case notify.InCloseWrite, notify.InDelete:
-					go transport.PublishConnectionStatus(controlPlaneTransport, d.makeDispatchersMap())
+				if isWrittenEvent(e.Event()) || isRemovedEvent(e.Event()) {
+					go transport.PublishConnectionStatus(controlPlaneTransport, d.makeDispatchersMap(), d.makeWorkersMap())
+				}
+			}
+		}()
+
+		// Start a goroutine that reloads the configuration file on SIGHUP (or
+		// the parameter change request of the Windows service control
+		// manager), reconnecting the transport only if connection settings
+		// changed.
+		hup := make(chan os.Signal, 1)
+		notifyReload(hup)
+		go func() {
+			current := runtimeConfig{
+				logLevel:    c.String("log-level"),
+				logLevels:   c.StringSlice("log-level-override"),
+				logFormat:   c.String("log-format"),
+				dataHost:    yggdrasil.DataHost,
+				topicPrefix: yggdrasil.TopicPrefix,
+				brokers:     c.StringSlice("broker"),
+			}
+			for range hup {
+				if c.String("config") == "" {
+					log.Warn("received SIGHUP but no configuration file is in use")
+					continue
+				}
+				log.Infof("reloading configuration from %v", c.String("config"))
+				next, err := loadRuntimeConfig(c.String("config"), configProfile, current)
+				if err != nil {
+					log.Errorf("cannot reload configuration: %v", err)
+					continue
 				}
+				current = applyRuntimeConfig(current, next, controlPlaneTransport)
 			}
 		}()
 
-		<-quit
+		select {
+		case <-quit:
+		case <-restartRequested:
+			log.Info("restarting to complete the update")
+		}
+
+		controlPlaneTransport.Disconnect(500)
+		if dataPlaneTransport != controlPlaneTransport {
+			dataPlaneTransport.Disconnect(500)
+		}
 
-		if err := killWorkers(); err != nil {
+		if keepWorkers {
+			d.saveRegistry()
+			log.Info("leaving workers running")
+			return nil
+		}
+		if err := killWorkers(nil); err != nil {
 			return cli.Exit(fmt.Errorf("cannot kill workers: %w", err), 1)
 		}
 
@@ -350,9 +1356,126 @@ func main() {
 	app.EnableBashCompletion = true
 	app.BashComplete = internal.BashComplete
 
-	if err := app.Run(os.Args); err != nil {
+	if err := runApp(app); err != nil {
 		log.Fatal(err)
 	}
+
+	// Re-execute only once the deferred clean up of the previous instance,
+	// such as closing the message journal, has run.
+	if restartPending() {
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("cannot locate executable: %v", err)
+		}
+		if err := reexec(exe); err != nil {
+			log.Fatalf("cannot restart: %v", err)
+		}
+	}
+}
+
+// setLogFormat configures log output for format, either "text" or "json".
+// Text output is prefixed with name and includes the file and line of the
+// caller at debug level and above; JSON output always includes them.
+func setLogFormat(format string, name string) error {
+	switch format {
+	case "text", "":
+		log.SetOutput(logging.Filter(os.Stderr))
+		log.SetPrefix(fmt.Sprintf("[%v] ", name))
+		if logging.OutputLevel() >= log.LevelDebug {
+			log.SetFlags(log.LstdFlags | log.Llongfile)
+		} else {
+			log.SetFlags(log.LstdFlags)
+		}
+	case "json":
+		log.SetOutput(logging.Filter(logging.NewJSONWriter(os.Stderr, name)))
+		log.SetPrefix("")
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("unsupported log format: %v", format)
+	}
+	return nil
+}
+
+// applyRuntimeConfig applies the values of next that differ from current,
+// reconnecting t if needed, and returns the configuration now in effect.
+func applyRuntimeConfig(current, next runtimeConfig, t transport.Transport) runtimeConfig {
+	if next.logLevel != current.logLevel {
+		level, err := log.ParseLevel(next.logLevel)
+		if err != nil {
+			log.Errorf("cannot set log level: %v", err)
+			next.logLevel = current.logLevel
+		} else {
+			logging.SetLevel(level)
+			log.Infof("log level set to %v", level)
+		}
+	}
+	if strings.Join(next.logLevels, ",") != strings.Join(current.logLevels, ",") {
+		overrides, err := logging.ParseSubsystemLevels(next.logLevels)
+		if err != nil {
+			log.Errorf("cannot set log level overrides: %v", err)
+			next.logLevels = current.logLevels
+		} else {
+			logging.SetSubsystemLevels(overrides)
+			log.Infof("log level overrides set to %v", logging.FormatSubsystemLevels(overrides))
+		}
+	}
+	if err := setLogFormat(next.logFormat, yggdrasil.ShortName+"d"); err != nil {
+		log.Errorf("cannot set log format: %v", err)
+		next.logFormat = current.logFormat
+		if err := setLogFormat(current.logFormat, yggdrasil.ShortName+"d"); err != nil {
+			log.Errorf("cannot restore log format: %v", err)
+		}
+	}
+
+	if next.dataHost != current.dataHost {
+		yggdrasil.DataHost = next.dataHost
+		log.Infof("data host set to %v", next.dataHost)
+	}
+
+	if !next.connectionChanged(current) {
+		return next
+	}
+
+	log.Info("connection settings changed; reconnecting")
+	t.Disconnect(500)
+	yggdrasil.TopicPrefix = next.topicPrefix
+	if s, ok := t.(transport.BrokerSetter); ok {
+		// Brokers changed in the configuration file replace those set by
+		// the server; otherwise, the brokers in use are kept.
+		brokers := s.Brokers()
+		changed := strings.Join(next.brokers, ",") != strings.Join(current.brokers, ",")
+		if changed {
+			brokers = next.brokers
+		}
+		if err := s.SetBrokers(brokers); err != nil {
+			log.Errorf("cannot set brokers: %v", err)
+			next.brokers = current.brokers
+		} else if changed {
+			if err := os.Remove(brokersFile()); err == nil {
+				log.Infof("discarded brokers set by the server in favor of %v", next.brokers)
+			}
+		}
+	}
+	if !gate.allowed() {
+		return next
+	}
+	if err := t.Start(); err != nil {
+		log.Errorf("cannot reconnect transport: %v", err)
+	}
+
+	return next
+}
+
+// dialTimeouts returns the connection phase timeouts set by the
+// "dns-timeout", "connect-timeout", "tls-handshake-timeout" and
+// "handshake-timeout" flags.
+func dialTimeouts(c *cli.Context) dialer.Timeouts {
+	return dialer.Timeouts{
+		DNS:          c.Duration("dns-timeout"),
+		Connect:      c.Duration("connect-timeout"),
+		TLSHandshake: c.Duration("tls-handshake-timeout"),
+		Handshake:    c.Duration("handshake-timeout"),
+	}
 }
 
 func getUserAgent(app *cli.App) string {
@@ -360,30 +1483,197 @@ func getUserAgent(app *cli.App) string {
 }
 
 func createTransport(c *cli.Context, tlsConfig *tls.Config, d *dispatcher) (transport.Transport, error) {
-	dataHandler := createDataHandler(d)
-	controlMessageHandler := createControlMessageHandler(d)
+	primary, err := newTransport(c, TransportType(c.String("transport")), tlsConfig, d)
+	if err != nil {
+		return nil, err
+	}
+	if c.String("fallback-transport") == "" {
+		return primary, nil
+	}
+
+	secondary, err := newTransport(c, TransportType(c.String("fallback-transport")), tlsConfig, d)
+	if err != nil {
+		return nil, err
+	}
+	failover := transport.NewFailover(primary, secondary, c.Duration("failover-delay"))
+	failover.OnSwitch = func(t transport.Transport) {
+		transport.PublishConnectionStatus(t, d.makeDispatchersMap(), d.makeWorkersMap())
+	}
+	return failover, nil
+}
+
+func newTransport(c *cli.Context, transportType TransportType, tlsConfig *tls.Config, d *dispatcher) (transport.Transport, error) {
+	dataHandler := queueDataMessages(verifyDataMessages(d, createDataHandler(d)), cap(d.sendQ), d.queuePolicy)
+	controlMessageHandler := queueControlMessages(verifyControlMessages(d, createControlMessageHandler(d)))
 
-	transportType := TransportType(c.String("transport"))
 	switch transportType {
 	case MQTT:
 		brokers := c.StringSlice("broker")
-		return mqtt.NewMQTTTransport(ClientID, brokers, tlsConfig, controlMessageHandler, dataHandler)
+		domain := c.String("broker-srv")
+		if domain != "" && len(brokers) > 0 {
+			return nil, fmt.Errorf("cannot use both broker and broker-srv")
+		}
+		for _, broker := range brokers {
+			u, err := url.Parse(broker)
+			if err != nil {
+				return nil, fmt.Errorf("invalid broker %q: %w", broker, err)
+			}
+			if err := checkBrokerTLS(u, tlsConfig); err != nil {
+				return nil, fmt.Errorf("invalid TLS settings of broker %q: %w", broker, err)
+			}
+		}
+		// Brokers set by the server with the "set-brokers" command take
+		// precedence over the configured ones.
+		persisted, err := readBrokers(brokersFile())
+		if err != nil {
+			log.Errorf("cannot read persisted brokers: %v", err)
+		} else if persisted != nil {
+			log.Infof("connecting to brokers set by the server: %v", persisted)
+			brokers = persisted
+		}
+		username, err := resolveSecret(c, "broker-username")
+		if err != nil {
+			return nil, err
+		}
+		password, err := resolveSecret(c, "broker-password")
+		if err != nil {
+			return nil, err
+		}
+		var resolveBrokers func() ([]string, error)
+		if domain != "" {
+			resolveBrokers = func() ([]string, error) {
+				if persisted, err := readBrokers(brokersFile()); err == nil && persisted != nil {
+					return persisted, nil
+				}
+				return resolveBrokerSRV(net.LookupSRV, domain)
+			}
+		}
+
+		switch c.String("mqtt-version") {
+		case "3.1.1":
+			t, err := mqtt.NewMQTTTransport(ClientID, brokers, tlsConfig, controlMessageHandler, dataHandler, d.connectionStatus, dialer.New(dialTimeouts(c)))
+			if err != nil {
+				return nil, err
+			}
+			t.Username = username
+			t.Password = password
+			t.ResolveBrokers = resolveBrokers
+			return t, nil
+		case "5":
+			t, err := mqtt.NewMQTTv5Transport(ClientID, brokers, tlsConfig, controlMessageHandler, dataHandler, d.connectionStatus, dialer.New(dialTimeouts(c)))
+			if err != nil {
+				return nil, err
+			}
+			t.Username = username
+			t.Password = password
+			t.ResolveBrokers = resolveBrokers
+			return t, nil
+		default:
+			return nil, fmt.Errorf("unsupported MQTT version: %v", c.String("mqtt-version"))
+		}
+	case NATS:
+		username, err := resolveSecret(c, "broker-username")
+		if err != nil {
+			return nil, err
+		}
+		password, err := resolveSecret(c, "broker-password")
+		if err != nil {
+			return nil, err
+		}
+		t, err := nats.NewNATSTransport(ClientID, c.StringSlice("broker"), tlsConfig, controlMessageHandler, dataHandler, d.connectionStatus, dialer.New(dialTimeouts(c)))
+		if err != nil {
+			return nil, err
+		}
+		t.Username = username
+		t.Password = password
+		t.JetStream = c.Bool("nats-jetstream")
+		return t, nil
 	case HTTP:
 		server := c.String("http-server")
-		return http.NewHTTPTransport(ClientID, server, tlsConfig, getUserAgent(c.App), time.Second*5, controlMessageHandler, dataHandler)
+		tokenSource, err := newTokenSource(c, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		t, err := http.NewHTTPTransport(ClientID, server, tlsConfig, getUserAgent(c.App), c.Duration("http-polling-interval"), c.Duration("http-max-polling-interval"), controlMessageHandler, dataHandler, d.connectionStatus, dialer.New(dialTimeouts(c)))
+		if err != nil {
+			return nil, err
+		}
+		t.HttpClient.TokenSource = tokenSource
+		if d.httpClient != nil {
+			// Transfers to the HTTP server share the link, and the
+			// rate limits, of those to the data host.
+			t.HttpClient.UploadLimiter = d.httpClient.UploadLimiter
+			t.HttpClient.DownloadLimiter = d.httpClient.DownloadLimiter
+		}
+		return t, nil
+	case None:
+		if simulator != nil {
+			return nil, fmt.Errorf("cannot use more than one %v transport", None)
+		}
+		return newSimulatorTransport(controlMessageHandler, dataHandler, d.connectionStatus), nil
 	default:
 		return nil, fmt.Errorf("unrecognized transport type: %v", transportType)
 	}
 }
 
+// newKafkaSink creates a sink publishing data messages to the Kafka brokers
+// set by the "kafka-broker" flag.
+func newKafkaSink(c *cli.Context, tlsConfig *tls.Config) (*kafka.Sink, error) {
+	var config *tls.Config
+	if c.Bool("kafka-tls") {
+		config = tlsConfig
+	}
+	sink, err := kafka.NewSink(ClientID, c.StringSlice("kafka-broker"), c.String("kafka-topic"), config, dialer.New(dialTimeouts(c)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create Kafka sink: %w", err)
+	}
+	sink.Username, err = resolveSecret(c, "kafka-username")
+	if err != nil {
+		return nil, err
+	}
+	sink.Password, err = resolveSecret(c, "kafka-password")
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
 func createControlMessageHandler(d *dispatcher) func(msg []byte, t transport.Transport) {
 	return func(msg []byte, t transport.Transport) {
-		var cmd yggdrasil.Command
-		if err := json.Unmarshal(msg, &cmd); err != nil {
-			log.Errorf("cannot unmarshal control message: %v", err)
+		cmd, err := parseControlMessage(msg)
+		if err != nil {
+			log.Errorf("cannot parse control message: %v", err)
+			return
+		}
+
+		if cmd.Type == yggdrasil.MessageTypeCapabilities {
+			var capabilities yggdrasil.Capabilities
+			if err := json.Unmarshal(msg, &capabilities); err != nil {
+				log.Errorf("cannot unmarshal capabilities message: %v", err)
+				return
+			}
+			log.Infof("received server capabilities: %+v", capabilities.Content)
+			transport.SetServerCapabilities(capabilities.Content)
+			return
+		}
+
+		if duplicate(cmd.MessageID) {
+			log.Infof("dropping duplicate message %v", cmd.MessageID)
 			return
 		}
+		// Commands are handled here, so a command is delivered once its
+		// handling returns.
+		defer delivered(cmd.MessageID)
 
+		if !transport.ServerCapabilities().SupportsCommand(cmd.Content.Command) {
+			log.Warnf("dropping message %v: command %v is not announced in the server capabilities", cmd.MessageID, cmd.Content.Command)
+			return
+		}
+
+		if cmd.OperationGroup != "" {
+			d.groups.set(cmd.MessageID, cmd.OperationGroup)
+			log.Infof("received message %v in operation group %v", cmd.MessageID, cmd.OperationGroup)
+		}
 		log.Debugf("received message %v", cmd.MessageID)
 		log.Tracef("command: %+v", cmd)
 		log.Tracef("Control message: %v", cmd)
@@ -397,6 +1687,8 @@ func createControlMessageHandler(d *dispatcher) func(msg []byte, t transport.Tra
 				Version:    1,
 				Sent:       time.Now(),
 				Content:    string(yggdrasil.EventNamePong),
+
+				OperationGroup: cmd.OperationGroup,
 			}
 
 			err := t.SendControl(event)
@@ -404,21 +1696,97 @@ func createControlMessageHandler(d *dispatcher) func(msg []byte, t transport.Tra
 				log.Error(err)
 			}
 		case yggdrasil.CommandNameDisconnect:
-			log.Info("disconnecting...")
-			for _, w := range d.workers {
-				disconnectWorker(w)
-			}
-			t.Disconnect(500)
+			// Draining may take a while; the transport must keep
+			// handling messages meanwhile.
+			go d.disconnect(t, cmd)
 
+		case yggdrasil.CommandNameEchoTest:
+			result := d.runEchoTest(cmd.Content.Arguments["directive"])
+			// The server's clock may differ from ours, so the transport
+			// stage is only reported when it appears plausible.
+			if transit := time.Since(cmd.Sent); !cmd.Sent.IsZero() && transit >= 0 {
+				result.latencies["transport"] = transit
+			}
+			if result.err != nil {
+				log.Errorf("echo test failed: %v", result.err)
+			}
+			event := result.event(cmd.MessageID)
+			event.OperationGroup = cmd.OperationGroup
+			if err := t.SendControl(event); err != nil {
+				log.Error(err)
+			}
+		case yggdrasil.CommandNameSetEnv:
+			directive := cmd.Content.Arguments["directive"]
+			name := cmd.Content.Arguments["name"]
+			if err := d.env.set(directive, name, cmd.Content.Arguments["value"]); err != nil {
+				log.Errorf("cannot set worker variable: %v", err)
+				return
+			}
+			log.Infof("set variable %v for directive %v", name, directive)
+		case yggdrasil.CommandNameLogLevel:
+			if err := d.setLogLevel(cmd.Content.Arguments["subsystem"], cmd.Content.Arguments["level"]); err != nil {
+				log.Errorf("ignoring log-level command: %v", err)
+				return
+			}
+		case yggdrasil.CommandNameSetBrokers:
+			brokers, err := parseBrokers(cmd.Content.Arguments["brokers"])
+			if err != nil {
+				log.Errorf("ignoring set-brokers command: %v", err)
+				return
+			}
+			if err := migrateBrokers(t, brokers); err != nil {
+				log.Errorf("cannot migrate brokers: %v", err)
+			}
+		case yggdrasil.CommandNameCancel:
+			messageID := cmd.Content.Arguments["message_id"]
+			directive, err := d.cancel(messageID)
+			if err != nil {
+				log.Errorf("cannot cancel message %v: %v", messageID, err)
+			}
+			event := cancelEvent(cmd.MessageID, messageID, directive, err)
+			event.OperationGroup = cmd.OperationGroup
+			if err := t.SendControl(event); err != nil {
+				log.Error(err)
+			}
+		case yggdrasil.CommandNameSetTags:
+			if err := d.tags.setServer(cmd.Content.Arguments); err != nil {
+				log.Errorf("cannot set tags: %v", err)
+				return
+			}
+			log.Infof("set server tags: %v", cmd.Content.Arguments)
+			go transport.PublishConnectionStatus(t, d.makeDispatchersMap(), d.makeWorkersMap())
+		case yggdrasil.CommandNameDumpLogs:
+			rawURL := cmd.Content.Arguments["url"]
+			err := d.dumpLogs(rawURL)
+			if err != nil {
+				log.Errorf("cannot dump logs: %v", err)
+			}
+			event := logsDumpedEvent(cmd.MessageID, rawURL, err)
+			event.OperationGroup = cmd.OperationGroup
+			if err := t.SendControl(event); err != nil {
+				log.Error(err)
+			}
+		case yggdrasil.CommandNameFetchFiles:
+			// Collecting and uploading files may take a while.
+			go d.fetchFilesCommand(t, cmd)
+		case yggdrasil.CommandNameUpdate:
+			// Downloading and installing may take a while; the transport
+			// must keep handling messages meanwhile.
+			go d.update(t, cmd)
 		case yggdrasil.CommandNameReconnect:
-			log.Info("reconnecting...")
-			t.Disconnect(500)
-			delay, err := strconv.ParseInt(cmd.Content.Arguments["delay"], 10, 64)
+			// Validate the delay before disconnecting, so a malformed command
+			// cannot leave the client disconnected.
+			delay, err := parseReconnectDelay(cmd.Content.Arguments["delay"])
 			if err != nil {
-				log.Errorf("cannot parse data to int: %v", err)
+				log.Errorf("ignoring reconnect command: %v", err)
 				return
 			}
-			time.Sleep(time.Duration(delay) * time.Second)
+			delay = jitter(delay, reconnectJitter)
+
+			log.Infof("reconnecting in %v...", delay)
+			tracing.Instant(tracing.Transport, "reconnect", map[string]string{"delay": delay.String()})
+			t.Disconnect(500)
+			time.Sleep(delay)
 
 			if err := t.Start(); err != nil {
 				log.Errorf("cannot reconnect to broker: %v", err)
@@ -432,7 +1800,7 @@ func createControlMessageHandler(d *dispatcher) func(msg []byte, t transport.Tra
 }
 
 func disconnectWorker(w worker) bool {
-	conn, err := grpc.Dial("unix:"+w.addr, grpc.WithInsecure())
+	conn, err := ipc.Dial(w.addr)
 	if err != nil {
 		log.Errorf("cannot dial socket: %v", err)
 		return true
@@ -452,13 +1820,57 @@ func disconnectWorker(w worker) bool {
 
 func createDataHandler(d *dispatcher) func(msg []byte) {
 	return func(msg []byte) {
-		var data yggdrasil.Data
-		if err := json.Unmarshal(msg, &data); err != nil {
-			log.Errorf("cannot unmarshal data message: %v", err)
+		data, err := parseDataMessage(msg)
+		if err != nil {
+			log.Errorf("cannot parse data message: %v", err)
+			return
+		}
+		if duplicate(data.MessageID) {
+			log.Infof("dropping duplicate message %v", data.MessageID)
 			return
 		}
+		if data.Type == yggdrasil.MessageTypeWorkerConfig {
+			var config yggdrasil.WorkerConfig
+			if err := json.Unmarshal(msg, &config); err != nil {
+				log.Errorf("cannot unmarshal worker-config message: %v", err)
+				return
+			}
+			go func() {
+				d.configure(config)
+				delivered(data.MessageID)
+			}()
+			return
+		}
+		data, err = transport.DecryptContent(data)
+		if err == nil {
+			data, err = transport.DecompressContent(data)
+		}
+		if err != nil {
+			log.Errorf("cannot decode content of data message %v: %v", data.MessageID, err)
+			go d.deliveryFailed(data, 0, err)
+			return
+		}
+		if data.OperationGroup != "" {
+			d.groups.set(data.MessageID, data.OperationGroup)
+			log.Infof("received message %v in operation group %v", data.MessageID, data.OperationGroup)
+		}
 		log.Tracef("message: %+v", data)
-		d.sendQ <- data
+		d.messageAccepted(data, false)
+		held, err := d.scheduler.hold(data, time.Now())
+		if err != nil {
+			log.Errorf("cannot schedule data message %v: %v", data.MessageID, err)
+			go d.deliveryFailed(data, 0, err)
+			return
+		}
+		if held {
+			// The message is stored until it is due, so a redelivery
+			// of it is a duplicate.
+			delivered(data.MessageID)
+			return
+		}
+		if !d.enqueueSend(data) {
+			go d.deliveryFailed(data, 0, fmt.Errorf("send queue is full"))
+		}
 	}
 }
 
@@ -473,6 +1885,12 @@ func getClientID(c *cli.Context) (string, error) {
 			return "", err
 		}
 		return facts.MachineID, nil
+	case DMIUUID:
+		return readDMIUUID(dmiProductUUIDPath)
+	case Hostname:
+		return getHostnameID()
+	case Command:
+		return runClientIDCommand(c.String("client-id-command"), clientIDCommandTimeout)
 	default:
 		return "", fmt.Errorf("unsupported client ID source: %v", source)
 	}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// recordingTransport is a fakeTransport that records the control messages it
+// sends.
+type recordingTransport struct {
+	fakeTransport
+	sent []interface{}
+}
+
+func (t *recordingTransport) SendControl(ctrlMsg interface{}) error {
+	t.sent = append(t.sent, ctrlMsg)
+	return nil
+}
+
+func TestControlMessageHandlerCapabilities(t *testing.T) {
+	defer transport.SetServerCapabilities(yggdrasil.CapabilitiesContent{})
+
+	d := newDispatcher(nil, 1, 0, 1)
+	handler := createControlMessageHandler(d)
+	ping := []byte(`{"type":"command","message_id":"1","content":{"command":"ping"}}`)
+
+	tests := []struct {
+		description string
+		commands    []yggdrasil.CommandName
+		wantPong    bool
+	}{
+		{description: "no commands announced", wantPong: true},
+		{description: "ping announced", commands: []yggdrasil.CommandName{yggdrasil.CommandNamePing}, wantPong: true},
+		{description: "ping not announced", commands: []yggdrasil.CommandName{yggdrasil.CommandNameDisconnect}, wantPong: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			capabilities, err := json.Marshal(yggdrasil.Capabilities{
+				Type:    yggdrasil.MessageTypeCapabilities,
+				Content: yggdrasil.CapabilitiesContent{Commands: test.commands},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tr := &recordingTransport{}
+			handler(capabilities, tr)
+			handler(ping, tr)
+			if got := len(tr.sent) == 1; got != test.wantPong {
+				t.Errorf("pong sent %v, want %v", got, test.wantPong)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// Restart policies of a worker manifest.
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+)
+
+// workerManifest describes how to run a worker. Manifests are TOML files
+// installed in the workers.d directory.
+type workerManifest struct {
+	// Exec is the absolute path of the worker executable.
+	Exec string `toml:"exec"`
+
+	// Args is a list of arguments passed to the worker executable.
+	Args []string `toml:"args"`
+
+	// Env is a list of additional "KEY=VALUE" environment variables.
+	Env []string `toml:"env"`
+
+	// Credentials names the credentials written, one file each, to a
+	// directory only the worker can read, whose path is set in the
+	// CREDENTIALS_DIRECTORY environment variable. Each is read from the
+	// credentials systemd passes to yggd or, failing that, from the secret
+	// store.
+	Credentials []string `toml:"credentials"`
+
+	// Secrets names the secrets the worker may request from the dispatcher
+	// with GetCredential, read like Credentials but each time requested, so
+	// that rotated secrets are picked up without restarting the worker.
+	Secrets []string `toml:"secrets"`
+
+	// TokenAudiences names the audiences of the identity tokens the worker
+	// may request from the dispatcher with GetCredential.
+	TokenAudiences []string `toml:"token-audiences"`
+
+	// Version is the version of the packaged worker, reported alongside the
+	// version the worker registers in connection-status messages.
+	Version string `toml:"version"`
+
+	// Directive is the directive the worker must register. If set, the
+	// dispatcher rejects registrations for any other directive.
+	Directive string `toml:"directive"`
+
+	// RemoteContent indicates the dispatcher should fetch message content
+	// from the URL in the message payload on the worker's behalf.
+	RemoteContent bool `toml:"remote-content"`
+
+	// Restart is one of "always" (the default), "on-failure" or "never".
+	Restart string `toml:"restart"`
+
+	// OnExit overrides, by class of exit ("clean", "crash", "oom-killed",
+	// "signal" or "config-error"), whether the worker is restarted and
+	// whether its exit raises an alert.
+	OnExit map[string]exitPolicy `toml:"on-exit"`
+
+	// Limits are resource limits applied to the worker process.
+	Limits struct {
+		// Memory is the maximum size, in bytes, of the process address space.
+		Memory uint64 `toml:"memory"`
+
+		// OpenFiles is the maximum number of open file descriptors.
+		OpenFiles uint64 `toml:"open-files"`
+
+		// Processes is the maximum number of processes of the worker's user.
+		Processes uint64 `toml:"processes"`
+
+		// CPUTime is the maximum CPU time, in seconds.
+		CPUTime uint64 `toml:"cpu-time"`
+	} `toml:"limits"`
+
+	// User and Group are the name or numeric ID of the user and group the
+	// worker runs as. By default, the worker runs as the user of yggd and
+	// the primary group of User.
+	User  string `toml:"user"`
+	Group string `toml:"group"`
+
+	// CGroup holds limits enforced on the worker and its children by placing
+	// the worker in a cgroup of its own.
+	CGroup struct {
+		// CPU is the maximum number of CPUs used, such as 0.5.
+		CPU float64 `toml:"cpu"`
+
+		// Memory is the maximum memory used, in bytes.
+		Memory uint64 `toml:"memory"`
+	} `toml:"cgroup"`
+
+	// Seccomp is the absolute path of a seccomp filter, as written by
+	// seccomp_export_bpf(3), loaded before the worker is executed. The
+	// filter must allow execve(2).
+	Seccomp string `toml:"seccomp"`
+}
+
+// workerManifestDir returns the directory worker manifests are loaded from.
+func workerManifestDir() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "workers.d")
+}
+
+// manifestExecs returns the set of executables run by the worker manifests in
+// dir. Worker executables in the worker directory that are run by a manifest
+// are not started on their own.
+func manifestExecs(dir string) map[string]bool {
+	execs := make(map[string]bool)
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return execs
+	}
+	for _, info := range fileInfos {
+		file := filepath.Join(dir, info.Name())
+		if !isWorkerManifest(file) {
+			continue
+		}
+		m, err := loadWorkerManifest(file)
+		if err != nil {
+			continue
+		}
+		execs[m.Exec] = true
+	}
+	return execs
+}
+
+// manifestName returns the name of the worker described by the manifest file.
+func manifestName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), ".toml")
+}
+
+// isWorkerManifest reports whether file is a worker manifest.
+func isWorkerManifest(file string) bool {
+	return filepath.Base(filepath.Dir(file)) == "workers.d" && strings.HasSuffix(file, ".toml")
+}
+
+// loadWorkerManifest reads, verifies and validates a worker manifest from
+// file. The manifest is verified like worker executables before it is parsed.
+func loadWorkerManifest(file string) (*workerManifest, error) {
+	data, err := readVerified(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var m workerManifest
+	if err := toml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse worker manifest: %w", err)
+	}
+
+	if !filepath.IsAbs(m.Exec) {
+		return nil, fmt.Errorf("exec must be an absolute path in %v", file)
+	}
+	switch m.Restart {
+	case "":
+		m.Restart = restartAlways
+	case restartAlways, restartOnFailure, restartNever:
+	default:
+		return nil, fmt.Errorf("invalid restart policy in %v: %v", file, m.Restart)
+	}
+	for class := range m.OnExit {
+		if !containsString(exitClasses, class) {
+			return nil, fmt.Errorf("invalid exit class in %v: %v", file, class)
+		}
+	}
+	if m.Seccomp != "" && !filepath.IsAbs(m.Seccomp) {
+		return nil, fmt.Errorf("seccomp must be an absolute path in %v", file)
+	}
+	if m.CGroup.CPU < 0 {
+		return nil, fmt.Errorf("invalid cgroup cpu limit in %v: %v", file, m.CGroup.CPU)
+	}
+	for _, e := range m.Env {
+		if !strings.Contains(e, "=") {
+			return nil, fmt.Errorf("invalid environment variable in %v: %v", file, e)
+		}
+	}
+	for _, c := range m.Credentials {
+		if !validCredentialName(c) {
+			return nil, fmt.Errorf("invalid credential name in %v: %q", file, c)
+		}
+	}
+	for _, c := range m.Secrets {
+		if !validCredentialName(c) {
+			return nil, fmt.Errorf("invalid secret name in %v: %q", file, c)
+		}
+	}
+
+	return &m, nil
+}
+
+// command returns the command that runs the worker named name with env,
+// sandboxed as the manifest requires.
+func (m *workerManifest) command(env []string, name string) (*exec.Cmd, error) {
+	cmd := exec.Command(m.Exec, m.Args...)
+	cmd.Env = append(append([]string{}, env...), m.Env...)
+	if len(m.Credentials) > 0 {
+		dir, err := m.writeCredentials(name)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = append(cmd.Env, credentialsEnv+"="+dir)
+	}
+	if err := m.sandbox(cmd, name); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// manifestWorkers maps the PIDs of running workers started from a manifest
+// to their manifest, so that the dispatcher can enforce it on registration.
+var manifestWorkers = struct {
+	sync.RWMutex
+	m map[int]*workerManifest
+}{m: make(map[int]*workerManifest)}
+
+// manifestForPID returns the manifest of the worker with pid, or nil if the
+// worker was not started from a manifest.
+func manifestForPID(pid int) *workerManifest {
+	manifestWorkers.RLock()
+	defer manifestWorkers.RUnlock()
+	return manifestWorkers.m[pid]
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadWorkerManifest(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantError   bool
+	}{
+		{
+			description: "default restart policy",
+			input:       `exec = "/usr/libexec/yggdrasil/echo-worker"`,
+			want:        restartAlways,
+		},
+		{
+			description: "on-failure",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+directive = "echo"
+restart = "on-failure"
+
+[limits]
+memory = 104857600`,
+			want: restartOnFailure,
+		},
+		{
+			description: "relative exec",
+			input:       `exec = "echo-worker"`,
+			wantError:   true,
+		},
+		{
+			description: "invalid restart policy",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+restart = "sometimes"`,
+			wantError: true,
+		},
+		{
+			description: "exit policies",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+restart = "on-failure"
+
+[on-exit.oom-killed]
+restart = true
+alert = true
+
+[on-exit.config-error]
+alert = false`,
+			want: restartOnFailure,
+		},
+		{
+			description: "invalid exit class",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+
+[on-exit.timeout]
+restart = false`,
+			wantError: true,
+		},
+		{
+			description: "sandbox",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+user = "nobody"
+seccomp = "/etc/yggdrasil/echo.bpf"
+
+[cgroup]
+cpu = 0.5
+memory = 104857600`,
+			want: restartAlways,
+		},
+		{
+			description: "relative seccomp",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+seccomp = "echo.bpf"`,
+			wantError: true,
+		},
+		{
+			description: "negative cpu",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+
+[cgroup]
+cpu = -1.0`,
+			wantError: true,
+		},
+		{
+			description: "credentials",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+credentials = ["api-token"]`,
+			want: restartAlways,
+		},
+		{
+			description: "invalid credential",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+credentials = ["../api-token"]`,
+			wantError: true,
+		},
+		{
+			description: "invalid env",
+			input: `exec = "/usr/libexec/yggdrasil/echo-worker"
+env = ["FOO"]`,
+			wantError: true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "workers.d-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			file := filepath.Join(dir, "worker.toml")
+			if err := ioutil.WriteFile(file, []byte(test.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadWorkerManifest(file)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Restart != test.want {
+					t.Errorf("%v != %v", got.Restart, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+)
+
+// mirrorMetrics holds the number of messages "mirrored", and the number of
+// mirrored messages "dropped" for socket clients that did not keep up.
+var mirrorMetrics = expvar.NewMap("message_mirror")
+
+// mirrorClientQueue is the number of mirrored messages held for a client of
+// the mirror socket, after which further messages are dropped for it.
+const mirrorClientQueue = 256
+
+// mirrorRedacted replaces the values of redacted keys in mirrored messages.
+const mirrorRedacted = "REDACTED"
+
+// defaultMirrorRedactions are the keys whose values are redacted from mirrored
+// messages in addition to those of the "mirror-redact" flag.
+var defaultMirrorRedactions = []string{"authorization", "cookie", "password", "secret", "token"}
+
+// A mirrorRecord is a line written to the mirror file and socket.
+type mirrorRecord struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"`
+	Channel   string          `json:"channel"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// A messageMirror writes the messages published and received by the
+// transport, as lines of JSON, to a file and to the clients of a socket, so
+// that tools can observe what goes over the wire without access to the
+// broker. The values of keys containing one of its redactions, at any depth
+// of a message, are replaced before they are written. Mirroring never holds
+// up the transport: messages are dropped for socket clients that do not read
+// them fast enough.
+type messageMirror struct {
+	redactions []string
+
+	lock     sync.Mutex
+	file     *os.File
+	listener net.Listener
+	clients  map[chan []byte]bool
+}
+
+// newMessageMirror returns a messageMirror redacting the values of the keys
+// containing, regardless of case, one of redactions or of
+// defaultMirrorRedactions.
+func newMessageMirror(redactions []string) *messageMirror {
+	m := &messageMirror{clients: make(map[chan []byte]bool)}
+	for _, r := range append(append([]string{}, defaultMirrorRedactions...), redactions...) {
+		m.redactions = append(m.redactions, strings.ToLower(r))
+	}
+	return m
+}
+
+// openFile appends the mirrored messages to the file at path, created
+// readable only by its owner if it does not exist.
+func (m *messageMirror) openFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %w", err)
+	}
+	m.lock.Lock()
+	m.file = f
+	m.lock.Unlock()
+	return nil
+}
+
+// listen serves the mirrored messages to the clients of the socket at path,
+// which only its owner may connect to (on Windows, a named pipe only the local
+// system and administrators may connect to).
+func (m *messageMirror) listen(path string) error {
+	l, err := ipc.ListenPrivate(path)
+	if err != nil {
+		return fmt.Errorf("cannot listen on socket: %w", err)
+	}
+	m.lock.Lock()
+	m.listener = l
+	m.lock.Unlock()
+	log.Infof("mirroring messages to socket %v", path)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// serve writes the mirrored messages to conn until the client disconnects.
+func (m *messageMirror) serve(conn net.Conn) {
+	defer conn.Close()
+	lines := make(chan []byte, mirrorClientQueue)
+	m.lock.Lock()
+	m.clients[lines] = true
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.clients, lines)
+		m.lock.Unlock()
+	}()
+
+	// Clients do not write; a read returns once the client disconnects.
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(done)
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			if _, err := conn.Write(line); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// close stops mirroring messages, closing the file and the socket.
+func (m *messageMirror) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.file != nil {
+		m.file.Close()
+		m.file = nil
+	}
+	if m.listener != nil {
+		m.listener.Close()
+		m.listener = nil
+	}
+}
+
+// mirror writes msg, the JSON encoding of a message sent or received on
+// channel, redacted, to the file and the socket clients of m. It is set as
+// transport.Mirror.
+func (m *messageMirror) mirror(direction, channel string, msg []byte) {
+	line, err := json.Marshal(mirrorRecord{
+		Time:      time.Now().UTC(),
+		Direction: direction,
+		Channel:   channel,
+		Message:   m.redact(msg),
+	})
+	if err != nil {
+		log.Debugf("cannot mirror message: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	mirrorMetrics.Add("mirrored", 1)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.file != nil {
+		if _, err := m.file.Write(line); err != nil {
+			log.Debugf("cannot write mirrored message: %v", err)
+		}
+	}
+	for lines := range m.clients {
+		select {
+		case lines <- line:
+		default:
+			mirrorMetrics.Add("dropped", 1)
+		}
+	}
+}
+
+// redact returns msg with the values of the keys containing a redaction
+// replaced by mirrorRedacted. A message that is not JSON is returned as a
+// JSON string.
+func (m *messageMirror) redact(msg []byte) json.RawMessage {
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		data, _ := json.Marshal(string(msg))
+		return data
+	}
+	data, err := json.Marshal(m.redactValue(v))
+	if err != nil {
+		data, _ = json.Marshal(string(msg))
+	}
+	return data
+}
+
+// redactValue replaces, in place, the values of the keys containing a
+// redaction in v, a decoded JSON value, and returns it.
+func (m *messageMirror) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if m.redacted(key) {
+				v[key] = mirrorRedacted
+			} else {
+				v[key] = m.redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = m.redactValue(v[i])
+		}
+	}
+	return v
+}
+
+// redacted reports whether the value of key is redacted.
+func (m *messageMirror) redacted(key string) bool {
+	key = strings.ToLower(key)
+	for _, r := range m.redactions {
+		if strings.Contains(key, r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestMessageMirrorRedact(t *testing.T) {
+	tests := []struct {
+		description string
+		redactions  []string
+		input       string
+		want        string
+	}{
+		{
+			description: "nothing redacted",
+			input:       `{"type":"data","metadata":{"a":"b"},"content":{"n":12345678901234567890}}`,
+			want:        `{"content":{"n":12345678901234567890},"metadata":{"a":"b"},"type":"data"}`,
+		},
+		{
+			description: "default redactions",
+			input:       `{"metadata":{"Authorization":"Bearer x","api_token":"y"},"content":[{"password":"z"}]}`,
+			want:        `{"content":[{"password":"REDACTED"}],"metadata":{"Authorization":"REDACTED","api_token":"REDACTED"}}`,
+		},
+		{
+			description: "extra redactions",
+			redactions:  []string{"Serial"},
+			input:       `{"content":{"serial_number":"123","host":{"secrets":["a","b"]}}}`,
+			want:        `{"content":{"host":{"secrets":"REDACTED"},"serial_number":"REDACTED"}}`,
+		},
+		{
+			description: "not JSON",
+			input:       `hello`,
+			want:        `"hello"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			m := newMessageMirror(test.redactions)
+			got := string(m.redact([]byte(test.input)))
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestMessageMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-mirror-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newMessageMirror(nil)
+	defer m.close()
+	file := filepath.Join(dir, "mirror.jsonl")
+	if err := m.openFile(file); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "mirror.sock")
+	if err := m.listen(socket); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Wait for the client to be served before mirroring messages.
+	for i := 0; ; i++ {
+		m.lock.Lock()
+		n := len(m.clients)
+		m.lock.Unlock()
+		if n > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("client not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.mirror(transport.MirrorReceived, "data", []byte(`{"message_id":"1","metadata":{"token":"t"}}`))
+	m.mirror(transport.MirrorSent, "control", []byte(`{"message_id":"2"}`))
+
+	type record struct {
+		Direction string
+		Channel   string
+		Message   map[string]interface{}
+	}
+	want := []record{
+		{
+			Direction: "received",
+			Channel:   "data",
+			Message:   map[string]interface{}{"message_id": "1", "metadata": map[string]interface{}{"token": "REDACTED"}},
+		},
+		{
+			Direction: "sent",
+			Channel:   "control",
+			Message:   map[string]interface{}{"message_id": "2"},
+		},
+	}
+
+	read := func(scanner *bufio.Scanner) []record {
+		var got []record
+		for len(got) < len(want) && scanner.Scan() {
+			var r record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, r)
+		}
+		return got
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got := read(bufio.NewScanner(conn)); !cmp.Equal(got, want) {
+		t.Errorf("socket: %#v", cmp.Diff(got, want))
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := read(bufio.NewScanner(f)); !cmp.Equal(got, want) {
+		t.Errorf("file: %#v", cmp.Diff(got, want))
+	}
+}
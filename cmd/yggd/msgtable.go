@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+)
+
+// A messageTable associates a value with each of a bounded number of recent
+// message IDs. Once full, the oldest message IDs are forgotten first.
+type messageTable struct {
+	lock   sync.Mutex
+	size   int
+	values map[string]string
+	order  []string
+}
+
+// newMessageTable creates a messageTable remembering up to size message IDs.
+func newMessageTable(size int) *messageTable {
+	return &messageTable{
+		size:   size,
+		values: make(map[string]string),
+	}
+}
+
+// set associates value with the message with the given ID. Messages without
+// an ID and empty values are ignored.
+func (t *messageTable) set(messageID, value string) {
+	if messageID == "" || value == "" {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, prs := t.values[messageID]; !prs {
+		t.order = append(t.order, messageID)
+	}
+	t.values[messageID] = value
+	for len(t.order) > t.size {
+		delete(t.values, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// get returns the value associated with the message with the given ID, or an
+// empty string if there is none.
+func (t *messageTable) get(messageID string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.values[messageID]
+}
+
+// remove forgets the message with the given ID.
+func (t *messageTable) remove(messageID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, prs := t.values[messageID]; !prs {
+		return
+	}
+	delete(t.values, messageID)
+	for i, id := range t.order {
+		if id == messageID {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// len returns the number of messages remembered.
+func (t *messageTable) len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return len(t.values)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMessageTable(t *testing.T) {
+	table := newMessageTable(2)
+	table.set("a", "campaign-1")
+	table.set("b", "campaign-2")
+	table.set("", "campaign-3")
+	table.set("c", "")
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "a", want: "campaign-1"},
+		{id: "b", want: "campaign-2"},
+		{id: "c", want: ""},
+		{id: "", want: ""},
+	}
+	for _, test := range tests {
+		if got := table.get(test.id); got != test.want {
+			t.Errorf("get(%q): %q != %q", test.id, got, test.want)
+		}
+	}
+
+	// The oldest message ID is forgotten once full.
+	table.set("d", "campaign-1")
+	if got := table.get("a"); got != "" {
+		t.Errorf("get(%q): %q != %q", "a", got, "")
+	}
+	if got := table.get("d"); got != "campaign-1" {
+		t.Errorf("get(%q): %q != %q", "d", got, "campaign-1")
+	}
+
+	// A removed message ID no longer counts towards the size.
+	table.remove("b")
+	table.set("e", "campaign-2")
+	if got := table.get("d"); got != "campaign-1" {
+		t.Errorf("get(%q): %q != %q", "d", got, "campaign-1")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	"github.com/redhatinsights/yggdrasil/internal/wake"
+)
+
+// networkPollInterval is the interval at which the network state is read
+// again, in case a change was missed, and at which watching NetworkManager is
+// retried after it failed.
+const networkPollInterval = time.Minute
+
+// networkMetrics holds the number of times the transport was "suspended"
+// while the network was offline, and "resumed" once it was online again.
+var networkMetrics = expvar.NewMap("network")
+
+// network follows the connectivity reported by NetworkManager. It is nil
+// unless yggd was started with --network-manager.
+var network *networkMonitor
+
+// A networkState is the state of the network connection of the system, as
+// reported by NetworkManager.
+type networkState struct {
+	online  bool
+	metered bool
+}
+
+// A networkMonitor suspends the transport while NetworkManager reports that
+// the system has no network connectivity, and connects it again as soon as
+// connectivity returns, rather than letting it retry until it gives up or
+// its next polling interval. Data published while suspended is spooled, if
+// the spool is enabled. It also tells the transfer policy whether the
+// connection is metered.
+type networkMonitor struct {
+	t transport.Transport
+
+	// read returns the current network state; it is replaced in tests.
+	read func() (networkState, error)
+
+	lock      sync.Mutex
+	state     networkState
+	known     bool
+	suspended bool
+	changedCh chan struct{}
+}
+
+// newNetworkMonitor returns a networkMonitor of the transport t.
+func newNetworkMonitor(t transport.Transport) *networkMonitor {
+	return &networkMonitor{
+		t:         t,
+		read:      networkManagerState,
+		changedCh: make(chan struct{}),
+	}
+}
+
+// online reports whether the network was online when last read. It is always
+// online with a nil networkMonitor, or when the state cannot be read.
+func (m *networkMonitor) online() bool {
+	if m == nil {
+		return true
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return !m.known || m.state.online
+}
+
+// metered reports whether the network connection was metered when last read.
+func (m *networkMonitor) metered() (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.known {
+		return false, fmt.Errorf("network state unknown")
+	}
+	return m.state.metered, nil
+}
+
+// changed returns a channel closed at the next change of the network state.
+// A nil networkMonitor returns a nil channel, which is never closed.
+func (m *networkMonitor) changed() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.changedCh
+}
+
+// init reads the network state at startup, before the transport is started,
+// without suspending or resuming it.
+func (m *networkMonitor) init() {
+	s, err := m.read()
+	if err != nil {
+		log.Warnf("cannot read network state: %v", err)
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.state = s
+	m.known = true
+}
+
+// suspend marks the transport as suspended, so that it is started once the
+// network is online. It is called instead of starting the transport when the
+// network is offline at startup.
+func (m *networkMonitor) suspend() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.suspended = true
+}
+
+// refresh reads the network state, and suspends or resumes the transport if
+// it changed.
+func (m *networkMonitor) refresh() {
+	s, err := m.read()
+	if err != nil {
+		log.Debugf("cannot read network state: %v", err)
+		return
+	}
+	m.update(s)
+}
+
+// update records s as the network state. The transport is disconnected when
+// the network goes offline, and started when it comes back online, unless it
+// is kept disconnected by the connection gate.
+func (m *networkMonitor) update(s networkState) {
+	m.lock.Lock()
+	if !m.known || s != m.state {
+		log.Infof("network state: online %v, metered %v", s.online, s.metered)
+		close(m.changedCh)
+		m.changedCh = make(chan struct{})
+	}
+	m.state = s
+	m.known = true
+	suspend := !s.online && !m.suspended
+	resume := s.online && m.suspended
+	m.suspended = !s.online
+	m.lock.Unlock()
+
+	// The gate is not consulted with the lock held, as the gate checks
+	// whether the network is online with its own lock held.
+	switch {
+	case suspend && gate.allowed():
+		log.Info("network offline; disconnecting transport")
+		m.t.Disconnect(0)
+		networkMetrics.Add("suspended", 1)
+	case resume && gate.allowed():
+		log.Info("network online; connecting transport")
+		if err := m.t.Start(); err != nil {
+			log.Errorf("cannot connect transport: %v", err)
+			// Try again at the next refresh.
+			m.suspend()
+			return
+		}
+		if w, ok := m.t.(transport.Waker); ok {
+			w.Wake()
+		}
+		networkMetrics.Add("resumed", 1)
+	}
+}
+
+// watch refreshes the network state each time NetworkManager signals a
+// change, and every networkPollInterval.
+func (m *networkMonitor) watch() {
+	refresh := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		monitor := &wake.Command{
+			Path: "gdbus",
+			Args: []string{"monitor", "--system", "--dest", "org.freedesktop.NetworkManager", "--object-path", "/org/freedesktop/NetworkManager"},
+		}
+		for {
+			err := monitor.Watch(func(string) { signal() })
+			log.Debugf("cannot watch NetworkManager: %v", err)
+			time.Sleep(networkPollInterval)
+		}
+	}()
+
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-refresh:
+		case <-ticker.C:
+		}
+		m.refresh()
+	}
+}
+
+// networkManagerState asks NetworkManager whether the system has network
+// connectivity, and whether its primary connection is metered.
+func networkManagerState() (networkState, error) {
+	output, err := exec.Command("busctl", "get-property",
+		"org.freedesktop.NetworkManager",
+		"/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager",
+		"Connectivity", "Metered").Output()
+	if err != nil {
+		return networkState{}, fmt.Errorf("cannot get network properties: %w", err)
+	}
+	return parseNetworkState(string(output))
+}
+
+// parseNetworkState parses the NMConnectivityState and NMMetered values
+// printed by busctl, one per line, such as "u 4". The network is offline only
+// if NetworkManager knows that there is no connectivity at all; a local
+// network or captive portal may still reach the server.
+func parseNetworkState(output string) (networkState, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		return networkState{}, fmt.Errorf("unexpected network properties %q", output)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 2 || fields[0] != "u" {
+		return networkState{}, fmt.Errorf("unexpected connectivity property value %q", lines[0])
+	}
+	connectivity, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return networkState{}, fmt.Errorf("unexpected connectivity property value %q", lines[0])
+	}
+	metered, err := parseMetered(lines[1])
+	if err != nil {
+		return networkState{}, err
+	}
+	// NM_CONNECTIVITY_NONE
+	return networkState{online: connectivity != 1, metered: metered}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseNetworkState(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        networkState
+		wantError   bool
+	}{
+		{
+			description: "full",
+			input:       "u 4\nu 4\n",
+			want:        networkState{online: true},
+		},
+		{
+			description: "none",
+			input:       "u 1\nu 0\n",
+			want:        networkState{online: false},
+		},
+		{
+			description: "limited metered",
+			input:       "u 3\nu 3\n",
+			want:        networkState{online: true, metered: true},
+		},
+		{
+			description: "unknown",
+			input:       "u 0\nu 1\n",
+			want:        networkState{online: true, metered: true},
+		},
+		{
+			description: "missing property",
+			input:       "u 4\n",
+			wantError:   true,
+		},
+		{
+			description: "wrong type",
+			input:       "s \"full\"\nu 4\n",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseNetworkState(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(networkState{})) {
+				t.Errorf("%#v", cmp.Diff(got, test.want, cmp.AllowUnexported(networkState{})))
+			}
+		})
+	}
+}
+
+func TestNetworkMonitorUpdate(t *testing.T) {
+	ft := &failingTransport{}
+	m := newNetworkMonitor(ft)
+	if !m.online() {
+		t.Fatal("offline with unknown state")
+	}
+
+	offline := networkState{online: false}
+	online := networkState{online: true, metered: true}
+
+	changed := m.changed()
+	m.update(offline)
+	select {
+	case <-changed:
+	default:
+		t.Error("change not signaled")
+	}
+	if m.online() {
+		t.Error("online after going offline")
+	}
+	m.update(offline)
+	if ft.attempts != 0 {
+		t.Errorf("attempts = %v, want 0", ft.attempts)
+	}
+
+	m.update(online)
+	if ft.attempts != 1 {
+		t.Errorf("attempts = %v, want 1", ft.attempts)
+	}
+	m.update(online)
+	if ft.attempts != 1 {
+		t.Errorf("attempts = %v, want 1", ft.attempts)
+	}
+	if metered, err := m.metered(); err != nil || !metered {
+		t.Errorf("metered = %v, %v, want true", metered, err)
+	}
+}
+
+func TestNetworkMonitorRetry(t *testing.T) {
+	ft := &failingTransport{failures: 1, err: errors.New("connection refused")}
+	m := newNetworkMonitor(ft)
+	m.suspend()
+
+	online := networkState{online: true}
+	m.update(online)
+	m.update(online)
+	if ft.attempts != 2 {
+		t.Errorf("attempts = %v, want 2", ft.attempts)
+	}
+	m.update(online)
+	if ft.attempts != 2 {
+		t.Errorf("attempts = %v, want 2", ft.attempts)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// gate keeps the transport disconnected in offline mode. It is nil unless
+// yggd was started with --start-disconnected.
+var gate *connectionGate
+
+// A connectionGate keeps the transport disconnected until an operator
+// connects it, or one of its daily connection windows opens. While
+// disconnected, data sent by workers is spooled, to be published once
+// connected. This supports sites that are air-gapped most of the time and
+// synchronize during scheduled or supervised windows.
+type connectionGate struct {
+	lock      sync.Mutex
+	t         transport.Transport
+	windows   []transferWindow
+	connected bool
+	manual    bool
+
+	// wokenUntil is the time until which the transport stays connected
+	// after a wake signal.
+	wokenUntil time.Time
+}
+
+// newConnectionGate creates a connectionGate for t, connecting during the
+// windows given in the form "HH:MM-HH:MM".
+func newConnectionGate(t transport.Transport, windows []string) (*connectionGate, error) {
+	g := &connectionGate{t: t}
+	for _, value := range windows {
+		w, err := parseTransferWindow(value)
+		if err != nil {
+			return nil, err
+		}
+		g.windows = append(g.windows, w)
+	}
+	return g, nil
+}
+
+// allowed reports whether the transport may be connected. It is always
+// allowed with a nil connectionGate.
+func (g *connectionGate) allowed() bool {
+	if g == nil {
+		return true
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.connected
+}
+
+// connect connects the transport, unless it is already connected. manual
+// reports whether an operator asked for the connection, in which case the
+// transport stays connected after a window closes.
+func (g *connectionGate) connect(manual bool) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.manual = g.manual || manual
+	if g.connected {
+		return nil
+	}
+	if !network.online() {
+		return fmt.Errorf("network is offline")
+	}
+	if err := g.t.Start(); err != nil {
+		return err
+	}
+	g.connected = true
+	log.Info("connected transport")
+	return nil
+}
+
+// disconnect disconnects the transport, unless it is already disconnected.
+func (g *connectionGate) disconnect() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.manual = false
+	g.wokenUntil = time.Time{}
+	if !g.connected {
+		return
+	}
+	g.t.Disconnect(500)
+	g.connected = false
+	log.Info("disconnected transport")
+}
+
+// inWindow reports whether now falls within one of the connection windows.
+func (g *connectionGate) inWindow(now time.Time) bool {
+	for _, w := range g.windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// wake connects the transport, keeping it connected for at least d after now.
+func (g *connectionGate) wake(now time.Time, d time.Duration) error {
+	g.lock.Lock()
+	if until := now.Add(d); until.After(g.wokenUntil) {
+		g.wokenUntil = until
+	}
+	g.lock.Unlock()
+	return g.connect(false)
+}
+
+// watchWindows checks every transferPollInterval whether a connection window
+// opened or closed, or the connection after a wake signal expired. It returns
+// at once if there are no windows and wake signals are not watched.
+func (g *connectionGate) watchWindows(wake bool) {
+	if len(g.windows) == 0 && !wake {
+		return
+	}
+	for {
+		g.check(time.Now())
+		time.Sleep(transferPollInterval)
+	}
+}
+
+// check connects the transport if now falls within a connection window, and
+// otherwise disconnects it unless an operator connected it or it was woken
+// until later.
+func (g *connectionGate) check(now time.Time) {
+	if g.inWindow(now) {
+		if err := g.connect(false); err != nil {
+			log.Errorf("cannot connect transport in connection window: %v", err)
+		}
+		return
+	}
+	g.lock.Lock()
+	leave := g.connected && !g.manual && !now.Before(g.wokenUntil)
+	g.lock.Unlock()
+	if leave {
+		log.Info("connection window closed")
+		g.disconnect()
+	}
+}
+
+// errNotDisconnected is returned when asked to connect or disconnect the
+// transport of yggd not started disconnected.
+var errNotDisconnected = fmt.Errorf("not started disconnected")
+
+// connectTransport connects the transport of yggd started disconnected, at
+// the request of an operator.
+func connectTransport() error {
+	if gate == nil {
+		return errNotDisconnected
+	}
+	if err := gate.connect(true); err != nil {
+		return fmt.Errorf("cannot connect transport: %w", err)
+	}
+	return nil
+}
+
+// disconnectTransport disconnects the transport of yggd started
+// disconnected.
+func disconnectTransport() error {
+	if gate == nil {
+		return errNotDisconnected
+	}
+	gate.disconnect()
+	return nil
+}
+
+// Errors returned by dispatchLocal for a message not signed with a trusted
+// key, and for a message that does not fit in the send queue.
+var (
+	errUntrustedDispatch = fmt.Errorf("message is not signed with a trusted key")
+	errSendQueueFull     = fmt.Errorf("send queue is full")
+)
+
+// dispatchLocal dispatches the data message encoded in payload, submitted
+// locally, to the worker handling its directive as if it had been received
+// from the server, and returns its message ID. If the dispatcher trusts
+// message keys, payload must be signed with one of them, like the messages
+// of the server.
+func (d *dispatcher) dispatchLocal(payload []byte) (string, error) {
+	if len(d.messageKeys) > 0 {
+		msg, ok := d.openSigned("data", payload)
+		if !ok {
+			return "", errUntrustedDispatch
+		}
+		payload = msg
+	}
+	var data yggdrasil.Data
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return "", fmt.Errorf("cannot unmarshal message: %w", err)
+	}
+	if data.Directive == "" {
+		return "", fmt.Errorf("missing directive")
+	}
+	if !json.Valid(data.Content) {
+		return "", fmt.Errorf("content is not valid JSON")
+	}
+	data.Type = yggdrasil.MessageTypeData
+	data.Version = 1
+	data.Sent = time.Now()
+	if data.MessageID == "" {
+		data.MessageID = uuid.New().String()
+	}
+	log.Infof("dispatching locally submitted message %v to directive %v", data.MessageID, data.Directive)
+	d.messageAccepted(data, true)
+	if !d.enqueueSend(data) {
+		d.correlations.set(data.MessageID, yggdrasil.MessageStateFailed, errSendQueueFull, time.Now())
+		return "", errSendQueueFull
+	}
+	return data.MessageID, nil
+}
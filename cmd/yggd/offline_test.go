@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/signing"
+)
+
+type fakeTransport struct {
+	started bool
+}
+
+func (t *fakeTransport) Start() error                          { t.started = true; return nil }
+func (t *fakeTransport) SendData(data yggdrasil.Data) error    { return nil }
+func (t *fakeTransport) SendControl(ctrlMsg interface{}) error { return nil }
+func (t *fakeTransport) Disconnect(quiesce uint)               { t.started = false }
+
+func TestConnectionGateCheck(t *testing.T) {
+	ft := &fakeTransport{}
+	g, err := newConnectionGate(ft, []string{"02:00-03:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour, min int) time.Time {
+		return time.Date(2021, 1, 1, hour, min, 0, 0, time.Local)
+	}
+
+	g.check(at(1, 30))
+	if ft.started || g.allowed() {
+		t.Fatal("connected outside of connection window")
+	}
+
+	g.check(at(2, 30))
+	if !ft.started || !g.allowed() {
+		t.Fatal("did not connect in connection window")
+	}
+
+	g.check(at(3, 30))
+	if ft.started || g.allowed() {
+		t.Fatal("did not disconnect when connection window closed")
+	}
+
+	if err := g.connect(true); err != nil {
+		t.Fatal(err)
+	}
+	g.check(at(4, 0))
+	if !ft.started {
+		t.Fatal("disconnected outside of connection window after operator connected")
+	}
+
+	g.disconnect()
+	if ft.started || g.allowed() {
+		t.Fatal("did not disconnect")
+	}
+
+	if err := g.wake(at(5, 0), 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !ft.started {
+		t.Fatal("did not connect after wake signal")
+	}
+	g.check(at(5, 5))
+	if !ft.started {
+		t.Fatal("disconnected before the wake duration elapsed")
+	}
+	g.check(at(5, 10))
+	if ft.started {
+		t.Fatal("did not disconnect once the wake duration elapsed")
+	}
+}
+
+func TestDispatchLocal(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(`{"type":"data","message_id":"1","directive":"echo","content":{}}`)
+	signed, err := json.Marshal(signing.Sign(msg, private))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		keys        []ed25519.PublicKey
+		input       []byte
+		wantError   error
+	}{
+		{
+			description: "verification disabled",
+			input:       msg,
+		},
+		{
+			description: "signed",
+			keys:        []ed25519.PublicKey{public},
+			input:       signed,
+		},
+		{
+			description: "unsigned",
+			keys:        []ed25519.PublicKey{public},
+			input:       msg,
+			wantError:   errUntrustedDispatch,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil, 1, 0, 10)
+			d.messageKeys = test.keys
+			go func() {
+				for range d.events {
+				}
+			}()
+
+			got, err := d.dispatchLocal(test.input)
+			if err != test.wantError {
+				t.Fatalf("error = %v, want %v", err, test.wantError)
+			}
+			if err != nil {
+				return
+			}
+			if got != "1" {
+				t.Errorf("message ID %v != 1", got)
+			}
+			if data := <-d.sendQ; data.MessageID != "1" || data.Directive != "echo" {
+				t.Errorf("queued %+v", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// maxOperationGroups is the number of message IDs whose operation group is
+// remembered.
+const maxOperationGroups = 10000
+
+// stampEvents returns a channel receiving the events sent on c, with the
+// operation group of the message they respond to set if it is not already.
+// Operators use the group to correlate a single fleet-wide campaign across
+// many hosts and messages.
+func (d *dispatcher) stampEvents(c <-chan yggdrasil.Event) <-chan yggdrasil.Event {
+	out := make(chan yggdrasil.Event)
+	go func() {
+		defer close(out)
+		for e := range c {
+			if e.OperationGroup == "" {
+				e.OperationGroup = d.groups.get(e.ResponseTo)
+			}
+			out <- e
+		}
+	}()
+	return out
+}
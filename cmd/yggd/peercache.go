@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/peers"
+)
+
+// peerDiscoveryTimeout is how long answers to a multicast DNS query for peers
+// are awaited.
+const peerDiscoveryTimeout = time.Second
+
+// peerDiscoveryInterval is how long the peers found by a query are used
+// before peers are queried again.
+const peerDiscoveryInterval = time.Minute
+
+// peerCacheMetrics holds the number of payloads fetched from peers ("hits"),
+// not found on any peer ("misses"), "rejected" as not matching their
+// checksum, and "served" to peers.
+var peerCacheMetrics = expvar.NewMap("peer_cache")
+
+// peerCacheDir returns the directory holding the payloads shared with peers.
+func peerCacheDir() string {
+	return filepath.Join(yggdrasil.LocalstateDir, "cache", yggdrasil.LongName, "peers")
+}
+
+// peerCache shares downloaded payloads with the yggd instances on the local
+// network. It is nil unless yggd was started with --peer-cache-addr.
+var peerCache *contentPeers
+
+// contentPeers keeps the payloads of content references downloaded, up to a
+// quota, serves them to peers, and fetches payloads from peers before they
+// are downloaded from the server. Payloads fetched from peers are verified
+// against their checksum like any other.
+type contentPeers struct {
+	instance string
+	dir      string
+	quota    int64
+	client   *http.Client
+
+	// discover returns the addresses of the peers; it is replaced in
+	// tests.
+	discover func(ctx context.Context) ([]string, error)
+
+	lock       sync.Mutex
+	peers      []string
+	discovered time.Time
+}
+
+// newContentPeers returns contentPeers keeping up to quota bytes of payloads
+// in dir, announced to peers as instance.
+func newContentPeers(instance, dir string, quota int64) *contentPeers {
+	p := &contentPeers{
+		instance: instance,
+		dir:      dir,
+		quota:    quota,
+		client:   &http.Client{},
+	}
+	p.discover = func(ctx context.Context) ([]string, error) {
+		return peers.Discover(ctx, p.instance, peerDiscoveryTimeout)
+	}
+	return p
+}
+
+// serve serves the payloads kept to peers on addr, and answers their queries.
+func (p *contentPeers) serve(addr string) error {
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen: %w", err)
+	}
+	handler := &peers.Handler{
+		Dir: p.dir,
+		Served: func(digest string) {
+			peerCacheMetrics.Add("served", 1)
+			log.Debugf("serving content sha256:%v to peer", digest)
+		},
+	}
+	go func() {
+		log.Infof("serving content to peers on: %v", l.Addr())
+		if err := http.Serve(l, handler); err != nil {
+			log.Errorf("cannot serve content to peers: %v", err)
+		}
+	}()
+	responder := &peers.Responder{Instance: p.instance, Port: l.Addr().(*net.TCPAddr).Port}
+	go func() {
+		if err := responder.ListenAndServe(context.Background()); err != nil {
+			log.Errorf("cannot answer peer queries: %v", err)
+		}
+	}()
+	return nil
+}
+
+// addrs returns the addresses of the peers, querying them again if they were
+// last found more than peerDiscoveryInterval ago.
+func (p *contentPeers) addrs(ctx context.Context) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if time.Since(p.discovered) < peerDiscoveryInterval {
+		return p.peers
+	}
+	addrs, err := p.discover(ctx)
+	if err != nil {
+		log.Debugf("cannot discover peers: %v", err)
+	}
+	p.peers = addrs
+	p.discovered = time.Now()
+	return p.peers
+}
+
+// link links the payload with digest to path, if it is kept and still
+// matches its digest, and reports whether it did.
+func (p *contentPeers) link(digest []byte, path string) bool {
+	if p == nil {
+		return false
+	}
+	kept := filepath.Join(p.dir, hex.EncodeToString(digest))
+	got, err := fileDigest(kept)
+	if err != nil {
+		return false
+	}
+	if !bytes.Equal(got, digest) {
+		os.Remove(kept)
+		return false
+	}
+	if err := linkOrCopy(kept, path); err != nil {
+		log.Debugf("cannot reuse content sha256:%x: %v", digest, err)
+		return false
+	}
+	return true
+}
+
+// fetch fetches the payload with digest from the first peer that has it into
+// f, an empty file, and reports whether it did. Otherwise f is left empty.
+func (p *contentPeers) fetch(ctx context.Context, digest []byte, f *os.File) bool {
+	if p == nil {
+		return false
+	}
+	for _, addr := range p.addrs(ctx) {
+		if err := peers.Fetch(ctx, p.client, addr, digest, f); err != nil {
+			log.Debugf("cannot fetch content sha256:%x: %v", digest, err)
+		} else if got, err := fileDigest(f.Name()); err == nil && bytes.Equal(got, digest) {
+			peerCacheMetrics.Add("hits", 1)
+			log.Infof("fetched content sha256:%x from peer %v", digest, addr)
+			return true
+		} else {
+			peerCacheMetrics.Add("rejected", 1)
+			log.Warnf("rejected content sha256:%x from peer %v: checksum mismatch", digest, addr)
+		}
+		if err := rewind(f); err != nil {
+			log.Errorf("cannot truncate file: %v", err)
+			return false
+		}
+	}
+	peerCacheMetrics.Add("misses", 1)
+	return false
+}
+
+// keep keeps the verified payload at path, with digest, for peers, removing
+// the least recently modified payloads kept beyond the quota.
+func (p *contentPeers) keep(path string, digest []byte) {
+	if p == nil {
+		return
+	}
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		log.Errorf("cannot create directory: %v", err)
+		return
+	}
+	kept := filepath.Join(p.dir, hex.EncodeToString(digest))
+	if _, err := os.Stat(kept); os.IsNotExist(err) {
+		if err := linkOrCopy(path, kept); err != nil {
+			log.Errorf("cannot keep content for peers: %v", err)
+			return
+		}
+	}
+	if err := p.prune(); err != nil {
+		log.Errorf("cannot prune content kept for peers: %v", err)
+	}
+}
+
+// prune removes the least recently modified payloads until the payloads kept
+// fit the quota.
+func (p *contentPeers) prune() error {
+	infos, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	var size int64
+	for _, info := range infos {
+		size += info.Size()
+	}
+	for _, info := range infos {
+		if size <= p.quota {
+			break
+		}
+		if err := os.Remove(filepath.Join(p.dir, info.Name())); err != nil {
+			return err
+		}
+		size -= info.Size()
+	}
+	return nil
+}
+
+// linkOrCopy hard links src to dst, or copies it if it cannot be linked, such
+// as across file systems.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// rewind truncates f and moves to its start.
+func rewind(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/peers"
+)
+
+func TestFetchContentFromPeers(t *testing.T) {
+	payload := []byte(strings.Repeat("yggdrasil", 1000))
+	digest := sha256.Sum256(payload)
+	checksum := fmt.Sprintf("sha256:%x", digest)
+
+	var downloads int
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		downloads++
+		w.Write(payload)
+	}))
+	defer server.Close()
+	client := http.NewHTTPClient(nil, "test", dialer.New(dialer.DefaultTimeouts))
+
+	tests := []struct {
+		description   string
+		peerContent   []byte
+		wantDownloads int
+	}{
+		{
+			description:   "peer has content",
+			peerContent:   payload,
+			wantDownloads: 0,
+		},
+		{
+			description:   "peer has other content",
+			peerContent:   []byte("tampered"),
+			wantDownloads: 1,
+		},
+		{
+			description:   "peer lacks content",
+			wantDownloads: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-peercache-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			peerDir := filepath.Join(dir, "peer")
+			if err := os.Mkdir(peerDir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if test.peerContent != nil {
+				if err := ioutil.WriteFile(filepath.Join(peerDir, fmt.Sprintf("%x", digest)), test.peerContent, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			peer := httptest.NewServer(&peers.Handler{Dir: peerDir})
+			defer peer.Close()
+
+			defer func(p *contentPeers) { peerCache = p }(peerCache)
+			peerCache = newContentPeers("self", filepath.Join(dir, "kept"), 1<<20)
+			peerCache.discover = func(context.Context) ([]string, error) {
+				return []string{strings.TrimPrefix(peer.URL, "http://")}, nil
+			}
+
+			downloads = 0
+			ref := yggdrasil.ContentReference{URL: server.URL, Checksum: checksum}
+			path, err := fetchContent(context.Background(), client, ref, filepath.Join(dir, "content"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if downloads != test.wantDownloads {
+				t.Errorf("downloads = %v, want %v", downloads, test.wantDownloads)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(payload) {
+				t.Error("content does not match payload")
+			}
+
+			// The payload is kept for peers, and reused once the
+			// delivered file is removed.
+			os.Remove(path)
+			if _, err := fetchContent(context.Background(), client, ref, filepath.Join(dir, "content")); err != nil {
+				t.Fatal(err)
+			}
+			if downloads != test.wantDownloads {
+				t.Errorf("downloads = %v after reuse, want %v", downloads, test.wantDownloads)
+			}
+		})
+	}
+}
+
+func TestContentPeersPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-peercache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newContentPeers("self", filepath.Join(dir, "kept"), 10)
+	for i, content := range []string{"first", "second", "third"} {
+		path := filepath.Join(dir, fmt.Sprint(i))
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256([]byte(content))
+		p.keep(path, digest[:])
+	}
+
+	infos, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, info := range infos {
+		size += info.Size()
+	}
+	if size > 10 || len(infos) == 0 {
+		t.Errorf("kept %v files of %v bytes", len(infos), size)
+	}
+}
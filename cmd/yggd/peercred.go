@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// peerCredentials are gRPC server transport credentials that record the
+// process of the peer of each socket connection, as reported by the system,
+// so that calls can be attributed to a worker process. The connection itself
+// is not secured.
+type peerCredentials struct{}
+
+// peerAuthInfo holds the PID of the peer of a connection, if known.
+type peerAuthInfo struct {
+	credentials.CommonAuthInfo
+	pid int
+	ok  bool
+}
+
+func (peerAuthInfo) AuthType() string { return "peercred" }
+
+func (peerCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, peerAuthInfo{}, nil
+}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	pid, ok, err := ipc.PeerPID(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, peerAuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		pid:            pid,
+		ok:             ok,
+	}, nil
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials { return c }
+
+func (peerCredentials) OverrideServerName(string) error { return nil }
+
+// peerPID returns the PID of the process that made the call of ctx, if the
+// server was created with peerCredentials.
+func peerPID(ctx context.Context) (int, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	info, ok := p.AuthInfo.(peerAuthInfo)
+	if !ok || !info.ok {
+		return 0, false
+	}
+	return info.pid, true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pkcs11Scheme is the scheme of RFC 7512 PKCS#11 URIs accepted in place of a
+// key file path.
+const pkcs11Scheme = "pkcs11:"
+
+// errPKCS11Unsupported is returned when a PKCS#11 key is requested but yggd
+// was built without the "pkcs11" build tag.
+var errPKCS11Unsupported = errors.New("PKCS#11 keys are not supported by this build (build with -tags pkcs11)")
+
+// openPKCS11Signer opens the private key identified by uri on a PKCS#11 token
+// and returns a crypto.Signer backed by it, whose public key is public. It is
+// nil unless yggd is built with the "pkcs11" build tag.
+var openPKCS11Signer func(uri *pkcs11URI, public crypto.PublicKey) (crypto.Signer, error)
+
+// pkcs11URI holds the attributes of a PKCS#11 URI used to locate a private
+// key.
+type pkcs11URI struct {
+	Token      string
+	Object     string
+	ID         []byte
+	PinValue   string
+	PinSource  string
+	ModulePath string
+}
+
+// isPKCS11URI reports whether s is a PKCS#11 URI rather than a file path.
+func isPKCS11URI(s string) bool {
+	return strings.HasPrefix(s, pkcs11Scheme)
+}
+
+// parsePKCS11URI parses a PKCS#11 URI of the form
+// "pkcs11:token=...;object=...?pin-source=...&module-path=...".
+func parsePKCS11URI(s string) (*pkcs11URI, error) {
+	if !isPKCS11URI(s) {
+		return nil, fmt.Errorf("missing %v scheme", pkcs11Scheme)
+	}
+	s = strings.TrimPrefix(s, pkcs11Scheme)
+
+	path, query := s, ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		path, query = s[:i], s[i+1:]
+	}
+
+	uri := pkcs11URI{}
+	for _, attrs := range []struct {
+		value string
+		sep   string
+	}{{path, ";"}, {query, "&"}} {
+		if attrs.value == "" {
+			continue
+		}
+		for _, attr := range strings.Split(attrs.value, attrs.sep) {
+			kv := strings.SplitN(attr, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid attribute: %v", attr)
+			}
+			value, err := url.PathUnescape(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid attribute value: %w", err)
+			}
+			switch kv[0] {
+			case "token":
+				uri.Token = value
+			case "object":
+				uri.Object = value
+			case "id":
+				uri.ID = []byte(value)
+			case "pin-value":
+				uri.PinValue = value
+			case "pin-source":
+				uri.PinSource = value
+			case "module-path":
+				uri.ModulePath = value
+			}
+		}
+	}
+
+	if uri.Token == "" {
+		return nil, fmt.Errorf("missing token attribute")
+	}
+	if uri.Object == "" && len(uri.ID) == 0 {
+		return nil, fmt.Errorf("missing object or id attribute")
+	}
+
+	return &uri, nil
+}
+
+// newPKCS11Certificate creates a TLS certificate from the PEM encoded
+// certificate chain in certPEMBlock and the private key identified by the
+// PKCS#11 URI keyURI. The private key never leaves the token; signing
+// operations are delegated to it.
+func newPKCS11Certificate(certPEMBlock []byte, keyURI string) (tls.Certificate, error) {
+	var cert tls.Certificate
+
+	uri, err := parsePKCS11URI(keyURI)
+	if err != nil {
+		return cert, fmt.Errorf("cannot parse PKCS#11 URI: %w", err)
+	}
+	// The PIN may refer to a secret rather than appear in the configuration.
+	uri.PinValue, err = secretStore.Resolve(uri.PinValue)
+	if err != nil {
+		return cert, fmt.Errorf("cannot resolve PKCS#11 PIN: %w", err)
+	}
+
+	for {
+		var block *pem.Block
+		block, certPEMBlock = pem.Decode(certPEMBlock)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, fmt.Errorf("cannot find certificate in PEM data")
+	}
+
+	if openPKCS11Signer == nil {
+		return cert, errPKCS11Unsupported
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, fmt.Errorf("cannot parse certificate: %w", err)
+	}
+	signer, err := openPKCS11Signer(uri, leaf.PublicKey)
+	if err != nil {
+		return cert, fmt.Errorf("cannot open PKCS#11 key: %w", err)
+	}
+	cert.PrivateKey = signer
+
+	return cert, nil
+}
@@ -0,0 +1,222 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+func init() {
+	openPKCS11Signer = openModuleSigner
+}
+
+// pkcs11DigestInfoPrefixes are the DER encoded DigestInfo prefixes prepended
+// to digests signed with the CKM_RSA_PKCS mechanism.
+var pkcs11DigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11PSSMechanisms maps hash functions to the PKCS#11 hash and mask
+// generation mechanisms used in RSA-PSS parameters.
+var pkcs11PSSMechanisms = map[crypto.Hash]struct{ hash, mgf uint }{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// pkcs11Signer is a crypto.Signer whose private key is held on a PKCS#11
+// token. Sessions are not safe for concurrent use, so signing operations are
+// serialized.
+type pkcs11Signer struct {
+	lock    sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	public  crypto.PublicKey
+}
+
+// openModuleSigner loads the PKCS#11 module named in uri, logs in to its token
+// with the PIN given in uri and finds the private key matching public.
+func openModuleSigner(uri *pkcs11URI, public crypto.PublicKey) (crypto.Signer, error) {
+	switch public.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+	if uri.ModulePath == "" {
+		return nil, errors.New("missing module-path attribute")
+	}
+
+	pin := uri.PinValue
+	if uri.PinSource != "" {
+		data, err := ioutil.ReadFile(uri.PinSource)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read PIN: %w", err)
+		}
+		pin = strings.TrimRight(string(data), "\r\n")
+	}
+
+	ctx := pkcs11.New(uri.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("cannot load module %v", uri.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil && !isPKCS11Error(err, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("cannot initialize module: %w", err)
+	}
+
+	s := &pkcs11Signer{ctx: ctx, public: public}
+	if err := s.open(uri, pin); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// open opens a session on the token labelled uri.Token, logs in with pin and
+// finds the private key identified by uri.
+func (s *pkcs11Signer) open(uri *pkcs11URI, pin string) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("cannot list slots: %w", err)
+	}
+	var slot uint
+	found := false
+	for _, id := range slots {
+		info, err := s.ctx.GetTokenInfo(id)
+		if err != nil {
+			continue
+		}
+		if strings.TrimRight(info.Label, " \x00") == uri.Token {
+			slot, found = id, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("cannot find token %v", uri.Token)
+	}
+
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("cannot open session: %w", err)
+	}
+	if pin != "" {
+		if err := s.ctx.Login(s.session, pkcs11.CKU_USER, pin); err != nil && !isPKCS11Error(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			s.ctx.CloseSession(s.session)
+			return fmt.Errorf("cannot log in to token: %w", err)
+		}
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if uri.Object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, uri.Object))
+	}
+	if len(uri.ID) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, uri.ID))
+	}
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		s.ctx.CloseSession(s.session)
+		return fmt.Errorf("cannot search for key: %w", err)
+	}
+	objects, _, err := s.ctx.FindObjects(s.session, 1)
+	s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		s.ctx.CloseSession(s.session)
+		return fmt.Errorf("cannot search for key: %w", err)
+	}
+	if len(objects) == 0 {
+		s.ctx.CloseSession(s.session)
+		return errors.New("cannot find private key on token")
+	}
+	s.key = objects[0]
+
+	return nil
+}
+
+// Public returns the public key of the certificate the signer was opened
+// for.
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs digest with the private key on the token. RSA keys sign with
+// PKCS #1 v1.5, or PSS if opts is a *rsa.PSSOptions; ECDSA signatures are
+// returned ASN.1 encoded, as crypto/ecdsa does.
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mechanism *pkcs11.Mechanism
+	input := digest
+
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			m, prs := pkcs11PSSMechanisms[pss.Hash]
+			if !prs {
+				return nil, fmt.Errorf("unsupported hash function %v", pss.Hash)
+			}
+			saltLength := pss.SaltLength
+			if saltLength == rsa.PSSSaltLengthEqualsHash {
+				saltLength = pss.Hash.Size()
+			}
+			if saltLength <= 0 {
+				return nil, fmt.Errorf("unsupported salt length %v", pss.SaltLength)
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(m.hash, m.mgf, uint(saltLength)))
+		} else {
+			prefix, prs := pkcs11DigestInfoPrefixes[opts.HashFunc()]
+			if !prs {
+				return nil, fmt.Errorf("unsupported hash function %v", opts.HashFunc())
+			}
+			mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			input = append(append([]byte{}, prefix...), digest...)
+		}
+	case *ecdsa.PublicKey:
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.key); err != nil {
+		return nil, fmt.Errorf("cannot initialize signature: %w", err)
+	}
+	signature, err := s.ctx.Sign(s.session, input)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign: %w", err)
+	}
+
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		// PKCS#11 returns the raw concatenation of r and s.
+		n := len(signature) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			R: new(big.Int).SetBytes(signature[:n]),
+			S: new(big.Int).SetBytes(signature[n:]),
+		})
+	}
+	return signature, nil
+}
+
+// isPKCS11Error reports whether err is the PKCS#11 return value code.
+func isPKCS11Error(err error, code uint) bool {
+	var e pkcs11.Error
+	return errors.As(err, &e) && uint(e) == code
+}
@@ -0,0 +1,175 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// softHSMModules are the paths SoftHSM is commonly installed at.
+var softHSMModules = []string{
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+}
+
+// softHSMToken initializes a SoftHSM token labelled "test" with user PIN
+// "1234" in a temporary directory, and returns the path of the SoftHSM
+// module. The test is skipped if SoftHSM is not installed.
+func softHSMToken(t *testing.T) string {
+	var module string
+	for _, path := range softHSMModules {
+		if _, err := os.Stat(path); err == nil {
+			module = path
+			break
+		}
+	}
+	if _, err := exec.LookPath("softhsm2-util"); err != nil || module == "" {
+		t.Skip("SoftHSM is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "softhsm-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %v\n", dir)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SOFTHSM2_CONF", conf)
+	t.Cleanup(func() { os.Unsetenv("SOFTHSM2_CONF") })
+
+	cmd := exec.Command("softhsm2-util", "--init-token", "--free", "--label", "test", "--so-pin", "5678", "--pin", "1234")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("cannot initialize token: %v: %s", err, output)
+	}
+
+	return module
+}
+
+// generateECKey generates a P-256 key pair labelled label on the token, and
+// returns its public key.
+func generateECKey(t *testing.T, module, label string) *ecdsa.PublicKey {
+	ctx := pkcs11.New(module)
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("cannot find slot: %v", err)
+	}
+	session, err := ctx.OpenSession(slots[0], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+	if err := ctx.Login(session, pkcs11.CKU_USER, "1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	curve, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _, err := ctx.GenerateKeyPair(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, curve),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, public, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var point []byte
+	if _, err := asn1.Unmarshal(attrs[0].Value, &point); err != nil {
+		t.Fatal(err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		t.Fatal("cannot parse public key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+}
+
+func TestPKCS11SignerSoftHSM(t *testing.T) {
+	module := softHSMToken(t)
+	public := generateECKey(t, module, "client")
+
+	tests := []struct {
+		description string
+		uri         pkcs11URI
+		wantError   bool
+	}{
+		{
+			description: "key",
+			uri:         pkcs11URI{Token: "test", Object: "client", PinValue: "1234", ModulePath: module},
+		},
+		{
+			description: "wrong PIN",
+			uri:         pkcs11URI{Token: "test", Object: "client", PinValue: "0000", ModulePath: module},
+			wantError:   true,
+		},
+		{
+			description: "missing token",
+			uri:         pkcs11URI{Token: "other", Object: "client", PinValue: "1234", ModulePath: module},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			signer, err := openModuleSigner(&test.uri, public)
+			if test.wantError {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			digest := sha256.Sum256([]byte("hello"))
+			signature, err := signer.Sign(nil, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ecdsa.VerifyASN1(public, digest[:], signature) {
+				t.Error("signature does not verify")
+			}
+		})
+	}
+}
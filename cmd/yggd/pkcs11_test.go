@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParsePKCS11URI(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        *pkcs11URI
+		wantError   bool
+	}{
+		{
+			description: "token and object",
+			input:       "pkcs11:token=tpm;object=client%20key?pin-source=/etc/pin&module-path=/usr/lib64/libtpm2_pkcs11.so",
+			want: &pkcs11URI{
+				Token:      "tpm",
+				Object:     "client key",
+				PinSource:  "/etc/pin",
+				ModulePath: "/usr/lib64/libtpm2_pkcs11.so",
+			},
+		},
+		{
+			description: "id",
+			input:       "pkcs11:token=hsm;id=%01%02",
+			want: &pkcs11URI{
+				Token: "hsm",
+				ID:    []byte{1, 2},
+			},
+		},
+		{
+			description: "missing object",
+			input:       "pkcs11:token=tpm",
+			wantError:   true,
+		},
+		{
+			description: "invalid attribute",
+			input:       "pkcs11:token",
+			wantError:   true,
+		},
+		{
+			description: "file path",
+			input:       "/etc/pki/consumer/key.pem",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parsePKCS11URI(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%#v != %#v", got, test.want)
+				}
+			}
+		})
+	}
+}
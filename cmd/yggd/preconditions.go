@@ -0,0 +1,136 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// Names of the startup preconditions.
+const (
+	preconditionNetworkOnline = "network-online"
+	preconditionTimeSync      = "time-sync"
+)
+
+// preconditionPollInterval is the interval at which a startup precondition
+// is checked again while it is not met.
+var preconditionPollInterval = time.Second
+
+// preconditionMetrics holds the state of each startup precondition waited
+// for: "waiting", "met" or "timed-out".
+var preconditionMetrics = expvar.NewMap("startup_preconditions")
+
+// waitingFor holds the name of the startup precondition yggd is waiting for,
+// if any.
+var waitingFor struct {
+	sync.Mutex
+	name string
+}
+
+// currentPrecondition returns the name of the startup precondition yggd is
+// waiting for, or an empty string.
+func currentPrecondition() string {
+	waitingFor.Lock()
+	defer waitingFor.Unlock()
+	return waitingFor.name
+}
+
+// A startupPrecondition is a state of the system waited for before the
+// transport connects, such as the system clock being synchronized, without
+// which the TLS handshake may fail.
+type startupPrecondition struct {
+	name    string
+	timeout time.Duration
+
+	// met reports whether the precondition is met.
+	met func() (bool, error)
+}
+
+// waitForPreconditions waits for each of preconditions in turn, for up to its
+// timeout. A precondition still not met by then is logged, and yggd carries
+// on: the transport may still connect, or retry until the startup deadline.
+func waitForPreconditions(preconditions []startupPrecondition) {
+	for _, p := range preconditions {
+		if waitForPrecondition(p) {
+			preconditionMetrics.Set(p.name, stringVar("met"))
+			continue
+		}
+		preconditionMetrics.Set(p.name, stringVar("timed-out"))
+		log.Warnf("%v not reached after %v; connecting anyway", p.name, p.timeout)
+	}
+}
+
+// waitForPrecondition checks p every preconditionPollInterval until it is
+// met, or its timeout passes, and reports whether it was met.
+func waitForPrecondition(p startupPrecondition) bool {
+	deadline := time.Now().Add(p.timeout)
+	logged := false
+	for {
+		met, err := p.met()
+		if err != nil {
+			log.Debugf("cannot check %v: %v", p.name, err)
+		}
+		if met {
+			if logged {
+				log.Infof("%v reached", p.name)
+			}
+			setWaitingFor("")
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			setWaitingFor("")
+			return false
+		}
+		if !logged {
+			log.Infof("waiting up to %v for %v", p.timeout, p.name)
+			preconditionMetrics.Set(p.name, stringVar("waiting"))
+			setWaitingFor(p.name)
+			logged = true
+		}
+		time.Sleep(preconditionPollInterval)
+	}
+}
+
+// setWaitingFor records that yggd is waiting for the startup precondition
+// name.
+func setWaitingFor(name string) {
+	waitingFor.Lock()
+	defer waitingFor.Unlock()
+	waitingFor.name = name
+}
+
+// stringVar returns an expvar.Var holding s.
+func stringVar(s string) expvar.Var {
+	v := new(expvar.String)
+	v.Set(s)
+	return v
+}
+
+// networkOnline reports whether systemd reached network-online.target, which
+// systemd-networkd-wait-online or NetworkManager-wait-online hold back until
+// the network is configured.
+func networkOnline() (bool, error) {
+	err := exec.Command("systemctl", "is-active", "--quiet", "network-online.target").Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot get state of network-online.target: %w", err)
+	}
+	return true, nil
+}
+
+// timeSynchronized reports whether timedatectl reports that the system clock
+// is synchronized.
+func timeSynchronized() (bool, error) {
+	output, err := exec.Command("timedatectl", "show", "--property=NTPSynchronized", "--value").Output()
+	if err != nil {
+		return false, fmt.Errorf("cannot get time synchronization state: %w", err)
+	}
+	return strings.TrimSpace(string(output)) == "yes", nil
+}
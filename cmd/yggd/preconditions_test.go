@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForPrecondition(t *testing.T) {
+	defer func(d time.Duration) { preconditionPollInterval = d }(preconditionPollInterval)
+	preconditionPollInterval = time.Millisecond
+
+	tests := []struct {
+		description string
+		metAfter    int
+		err         error
+		timeout     time.Duration
+		want        bool
+	}{
+		{
+			description: "met",
+			metAfter:    0,
+			timeout:     time.Minute,
+			want:        true,
+		},
+		{
+			description: "met after waiting",
+			metAfter:    3,
+			timeout:     time.Minute,
+			want:        true,
+		},
+		{
+			description: "timed out",
+			metAfter:    -1,
+			timeout:     20 * time.Millisecond,
+			want:        false,
+		},
+		{
+			description: "check failing",
+			metAfter:    -1,
+			err:         errors.New("timedatectl: not found"),
+			timeout:     20 * time.Millisecond,
+			want:        false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			checks := 0
+			var waiting []string
+			p := startupPrecondition{
+				name:    preconditionTimeSync,
+				timeout: test.timeout,
+				met: func() (bool, error) {
+					waiting = append(waiting, currentPrecondition())
+					checks++
+					if test.err != nil {
+						return false, test.err
+					}
+					return test.metAfter >= 0 && checks > test.metAfter, nil
+				},
+			}
+			if got := waitForPrecondition(p); got != test.want {
+				t.Errorf("met = %v, want %v", got, test.want)
+			}
+			if test.metAfter > 0 && waiting[len(waiting)-1] != preconditionTimeSync {
+				t.Errorf("waiting for %q, want %q", waiting[len(waiting)-1], preconditionTimeSync)
+			}
+			if got := currentPrecondition(); got != "" {
+				t.Errorf("still waiting for %q", got)
+			}
+		})
+	}
+}
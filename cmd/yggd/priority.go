@@ -0,0 +1,145 @@
+package main
+
+import "github.com/redhatinsights/yggdrasil"
+
+// Lanes of the send queue, in order of priority.
+const (
+	laneHigh = iota
+	laneNormal
+	laneLow
+	numLanes
+)
+
+// laneNames are the names of the lanes, as used in metrics.
+var laneNames = [numLanes]string{"send.high", "send", "send.low"}
+
+// laneStarvationLimit is the number of messages taken from higher lanes while
+// a lane has messages waiting, after which the next message is taken from
+// that lane, so that urgent messages cannot hold up others forever.
+const laneStarvationLimit = 8
+
+// priorityLane returns the lane of data, from the value of its
+// MetadataKeyPriority metadata. Messages without a known priority have normal
+// priority.
+func priorityLane(data yggdrasil.Data) int {
+	switch data.Metadata[yggdrasil.MetadataKeyPriority] {
+	case yggdrasil.PriorityHigh:
+		return laneHigh
+	case yggdrasil.PriorityLow:
+		return laneLow
+	default:
+		return laneNormal
+	}
+}
+
+// sendLanes returns the lanes of the send queue: sendHighQ, sendQ and
+// sendLowQ.
+func (d *dispatcher) sendLanes() [numLanes]chan yggdrasil.Data {
+	return [numLanes]chan yggdrasil.Data{d.sendHighQ, d.sendQ, d.sendLowQ}
+}
+
+// enqueueSend places data on the lane of the send queue of its priority, as
+// enqueue does, and reports whether it was queued.
+func (d *dispatcher) enqueueSend(data yggdrasil.Data) bool {
+	lane := priorityLane(data)
+	return d.enqueue(d.sendLanes()[lane], laneNames[lane], data)
+}
+
+// sendDepth returns the number of messages in all lanes of the send queue.
+func (d *dispatcher) sendDepth() int {
+	n := 0
+	for _, q := range d.sendLanes() {
+		n += len(q)
+	}
+	return n
+}
+
+// A laneSelector takes messages from lanes in order of priority: a message
+// is taken from the highest lane that has one, unless a lower lane was passed
+// over laneStarvationLimit times while it had messages waiting. Messages of
+// the same lane are taken in the order they were queued.
+type laneSelector struct {
+	lanes  [numLanes]chan yggdrasil.Data
+	passed [numLanes]int
+}
+
+// next returns the next message, waiting for one if every lane is empty. It
+// returns false once every lane is closed.
+func (s *laneSelector) next() (yggdrasil.Data, bool) {
+	for {
+		if lane, ok := s.starved(); ok {
+			if data, ok := s.take(lane); ok {
+				return data, true
+			}
+			continue
+		}
+		for lane := range s.lanes {
+			if s.lanes[lane] == nil || len(s.lanes[lane]) == 0 {
+				continue
+			}
+			if data, ok := s.take(lane); ok {
+				return data, true
+			}
+		}
+
+		// Every lane is empty: wait for a message on any of them. Closed
+		// lanes are nil, which never receive.
+		if s.lanes[laneHigh] == nil && s.lanes[laneNormal] == nil && s.lanes[laneLow] == nil {
+			return yggdrasil.Data{}, false
+		}
+		var lane int
+		var data yggdrasil.Data
+		var ok bool
+		select {
+		case data, ok = <-s.lanes[laneHigh]:
+			lane = laneHigh
+		case data, ok = <-s.lanes[laneNormal]:
+			lane = laneNormal
+		case data, ok = <-s.lanes[laneLow]:
+			lane = laneLow
+		}
+		if !ok {
+			s.lanes[lane] = nil
+			continue
+		}
+		s.passed[lane] = 0
+		return data, true
+	}
+}
+
+// starved returns the highest lane with messages waiting that was passed over
+// laneStarvationLimit times, if any.
+func (s *laneSelector) starved() (int, bool) {
+	for lane, q := range s.lanes {
+		if q != nil && len(q) > 0 && s.passed[lane] >= laneStarvationLimit {
+			return lane, true
+		}
+	}
+	return 0, false
+}
+
+// take takes a message from lane without waiting, counting the lower lanes
+// with messages waiting as passed over. A closed lane is dropped.
+func (s *laneSelector) take(lane int) (yggdrasil.Data, bool) {
+	select {
+	case data, ok := <-s.lanes[lane]:
+		if !ok {
+			s.lanes[lane] = nil
+			return yggdrasil.Data{}, false
+		}
+		s.passOver(lane)
+		s.passed[lane] = 0
+		return data, true
+	default:
+		return yggdrasil.Data{}, false
+	}
+}
+
+// passOver counts the lanes below lane with messages waiting as passed over.
+func (s *laneSelector) passOver(lane int) {
+	for lower := lane + 1; lower < numLanes; lower++ {
+		if q := s.lanes[lower]; q != nil && len(q) > 0 {
+			s.passed[lower]++
+		}
+	}
+}
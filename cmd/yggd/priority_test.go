@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestPriorityLane(t *testing.T) {
+	tests := []struct {
+		description string
+		metadata    map[string]string
+		want        int
+	}{
+		{
+			description: "none",
+			want:        laneNormal,
+		},
+		{
+			description: "high",
+			metadata:    map[string]string{yggdrasil.MetadataKeyPriority: yggdrasil.PriorityHigh},
+			want:        laneHigh,
+		},
+		{
+			description: "normal",
+			metadata:    map[string]string{yggdrasil.MetadataKeyPriority: yggdrasil.PriorityNormal},
+			want:        laneNormal,
+		},
+		{
+			description: "low",
+			metadata:    map[string]string{yggdrasil.MetadataKeyPriority: yggdrasil.PriorityLow},
+			want:        laneLow,
+		},
+		{
+			description: "unknown",
+			metadata:    map[string]string{yggdrasil.MetadataKeyPriority: "urgent"},
+			want:        laneNormal,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := priorityLane(yggdrasil.Data{Metadata: test.metadata}); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLaneSelector(t *testing.T) {
+	var lanes [numLanes]chan yggdrasil.Data
+	for lane := range lanes {
+		lanes[lane] = make(chan yggdrasil.Data, 20)
+	}
+	for i := 1; i <= 20; i++ {
+		lanes[laneHigh] <- yggdrasil.Data{MessageID: fmt.Sprintf("h%v", i)}
+	}
+	for i := 1; i <= 2; i++ {
+		lanes[laneNormal] <- yggdrasil.Data{MessageID: fmt.Sprintf("n%v", i)}
+		lanes[laneLow] <- yggdrasil.Data{MessageID: fmt.Sprintf("l%v", i)}
+	}
+
+	s := &laneSelector{lanes: lanes}
+	var got []string
+	for i := 0; i < 24; i++ {
+		data, ok := s.next()
+		if !ok {
+			t.Fatal("lanes closed")
+		}
+		got = append(got, data.MessageID)
+	}
+	want := []string{
+		"h1", "h2", "h3", "h4", "h5", "h6", "h7", "h8", "n1", "l1",
+		"h9", "h10", "h11", "h12", "h13", "h14", "h15", "h16", "n2", "l2",
+		"h17", "h18", "h19", "h20",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+
+	// An empty selector waits for the next message on any lane.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		lanes[laneLow] <- yggdrasil.Data{MessageID: "l3"}
+	}()
+	if data, ok := s.next(); !ok || data.MessageID != "l3" {
+		t.Errorf("next = %v, %v; want l3, true", data.MessageID, ok)
+	}
+
+	for _, q := range lanes {
+		close(q)
+	}
+	if data, ok := s.next(); ok {
+		t.Errorf("next = %v after lanes closed", data.MessageID)
+	}
+}
+
+func TestDistributeDataHighOvertakesFullLow(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	pool := make([][numLanes]chan yggdrasil.Data, 1)
+	for lane := range pool[0] {
+		pool[0][lane] = make(chan yggdrasil.Data, 1)
+	}
+	go d.distributeData(pool)
+	defer func() {
+		<-pool[0][laneLow]
+		for _, q := range d.sendLanes() {
+			close(q)
+		}
+	}()
+
+	// The pool takes no message, so the second low priority message cannot
+	// be placed on its full low lane.
+	low := map[string]string{yggdrasil.MetadataKeyPriority: yggdrasil.PriorityLow}
+	d.sendLowQ <- yggdrasil.Data{MessageID: "l1", Directive: "echo", Metadata: low}
+	d.sendLowQ <- yggdrasil.Data{MessageID: "l2", Directive: "echo", Metadata: low}
+	high := map[string]string{yggdrasil.MetadataKeyPriority: yggdrasil.PriorityHigh}
+	d.sendHighQ <- yggdrasil.Data{MessageID: "h1", Directive: "echo", Metadata: high}
+
+	select {
+	case data := <-pool[0][laneHigh]:
+		if data.MessageID != "h1" {
+			t.Errorf("%v != h1", data.MessageID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("high priority message held up by a full low priority lane")
+	}
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rjeczalik/notify"
+)
+
+// workerSearchPath is the PATH workers are started with.
+const workerSearchPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// executableSuffix is the suffix of the names of executable files.
+const executableSuffix = ""
+
+// watchEvents are the events watched on worker directories and files. A file
+// is only reported as written once it is closed, so that a worker is not
+// started from a partial copy.
+var watchEvents = []notify.Event{notify.InCloseWrite, notify.InDelete, notify.InMovedFrom, notify.InMovedTo}
+
+// isWrittenEvent reports whether e reports a file written or moved in.
+func isWrittenEvent(e notify.Event) bool {
+	return e == notify.InCloseWrite || e == notify.InMovedTo
+}
+
+// isRemovedEvent reports whether e reports a file removed or moved out.
+func isRemovedEvent(e notify.Event) bool {
+	return e == notify.InDelete || e == notify.InMovedFrom
+}
+
+// processExists reports whether a process with pid exists.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// processStartTime returns the start time of the process pid, in clock ticks
+// since boot, as reported by /proc/PID/stat.
+func processStartTime(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The command name, in parentheses, may contain spaces; the fields
+	// following it start with the state, the third field of the line.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid stat of process %v", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat of process %v", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// restartSupported is set on systems on which yggd can be re-executed, or
+// restarted by systemd, once updated.
+const restartSupported = true
+
+// defaultRestart is how yggd restarts once updated, unless the "update"
+// command says otherwise.
+const defaultRestart = restartExec
+
+// reexec replaces the process with a new instance of the executable at exe,
+// with the same arguments and environment.
+func reexec(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
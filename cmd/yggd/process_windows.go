@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/windows"
+)
+
+// workerSearchPath is the PATH workers are started with: the PATH of yggd.
+var workerSearchPath = os.Getenv("PATH")
+
+// executableSuffix is the suffix of the names of executable files, such as
+// echo-worker.exe.
+const executableSuffix = ".exe"
+
+// watchEvents are the events watched on worker directories and files. Windows
+// does not report when a written file is closed, so a file is reported as
+// written as soon as it is modified.
+var watchEvents = []notify.Event{notify.FileNotifyChangeFileName, notify.FileNotifyChangeLastWrite}
+
+// isWrittenEvent reports whether e reports a file added, modified or renamed
+// in.
+func isWrittenEvent(e notify.Event) bool {
+	return e == notify.FileActionAdded || e == notify.FileActionModified || e == notify.FileActionRenamedNewName
+}
+
+// isRemovedEvent reports whether e reports a file removed or renamed out.
+func isRemovedEvent(e notify.Event) bool {
+	return e == notify.FileActionRemoved || e == notify.FileActionRenamedOldName
+}
+
+// stillActive is the exit code of a process that is still running.
+const stillActive = 259
+
+// processExists reports whether a process with pid is running.
+func processExists(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err := windows.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+// processStartTime returns the creation time of the process pid, in 100
+// nanosecond intervals since January 1, 1601.
+func processStartTime(pid int) (uint64, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return 0, fmt.Errorf("cannot open process %v: %w", pid, err)
+	}
+	defer windows.CloseHandle(h)
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return 0, fmt.Errorf("cannot get times of process %v: %w", pid, err)
+	}
+	return uint64(creation.HighDateTime)<<32 | uint64(creation.LowDateTime), nil
+}
+
+// restartSupported is not set on Windows, where a process cannot replace
+// itself; an updated yggd takes effect when the service is next started.
+const restartSupported = false
+
+// defaultRestart is how yggd restarts once updated, unless the "update"
+// command says otherwise.
+const defaultRestart = restartNone
+
+// reexec is not supported on Windows.
+func reexec(exe string) error {
+	return fmt.Errorf("cannot re-execute %v on Windows", exe)
+}
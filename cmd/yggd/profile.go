@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// profileNamePattern matches valid configuration profile names.
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// profilesDir returns the directory holding the configuration profiles of the
+// configuration file at file, one PROFILE.toml file each.
+func profilesDir(file string) string {
+	return filepath.Join(filepath.Dir(file), "profiles")
+}
+
+// newConfigSource returns the source of the values of the TOML configuration
+// file at file, with the values of the configuration profile named profile
+// overlaid, and the name of the profile. If profile is empty, the "profile"
+// key of file names the profile, if any. The values of a profile are read
+// from profilesDir, or else from the [profiles.PROFILE] table of file.
+func newConfigSource(file, profile string) (altsrc.InputSourceContext, string, error) {
+	base, err := altsrc.NewTomlSourceFromFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	if profile == "" {
+		if profile, err = base.String("profile"); err != nil {
+			return nil, "", fmt.Errorf("cannot read profile: %w", err)
+		}
+		if profile == "" {
+			return base, "", nil
+		}
+	}
+	if !profileNamePattern.MatchString(profile) {
+		return nil, "", fmt.Errorf("invalid configuration profile name: %q", profile)
+	}
+
+	tree, err := toml.LoadFile(file)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot load configuration file: %w", err)
+	}
+	inline := tree.HasPath([]string{"profiles", profile})
+
+	path := filepath.Join(profilesDir(file), profile+".toml")
+	if _, err := os.Stat(path); err == nil {
+		if inline {
+			return nil, "", fmt.Errorf("configuration profile %v is defined both in %v and in %v", profile, file, path)
+		}
+		overlay, err := altsrc.NewTomlSourceFromFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		overlayTree, err := toml.LoadFile(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot load configuration profile: %w", err)
+		}
+		return &profileSource{base: base, overlay: overlay, tree: overlayTree}, profile, nil
+	} else if !os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("cannot stat configuration profile: %w", err)
+	}
+
+	if !inline {
+		return nil, "", fmt.Errorf("unknown configuration profile: %v", profile)
+	}
+	return &profileSource{base: base, overlay: base, tree: tree, path: []string{"profiles", profile}}, profile, nil
+}
+
+// A profileSource is an InputSourceContext reading values from overlay, the
+// values of a configuration profile, where they are defined, and from base
+// otherwise. The values of the profile are those of the table at path in
+// tree, the parsed overlay.
+type profileSource struct {
+	base    altsrc.InputSourceContext
+	overlay altsrc.InputSourceContext
+	tree    *toml.Tree
+	path    []string
+}
+
+// lookup returns the source to read the value of the flag name from, and the
+// key of the value in that source.
+func (s *profileSource) lookup(name string) (altsrc.InputSourceContext, string) {
+	path := append(append([]string{}, s.path...), name)
+	if !s.tree.HasPath(path) {
+		return s.base, name
+	}
+	key := name
+	for i := len(s.path) - 1; i >= 0; i-- {
+		key = s.path[i] + "." + key
+	}
+	return s.overlay, key
+}
+
+func (s *profileSource) Source() string {
+	return s.base.Source()
+}
+
+func (s *profileSource) Int(name string) (int, error) {
+	src, key := s.lookup(name)
+	return src.Int(key)
+}
+
+func (s *profileSource) Duration(name string) (time.Duration, error) {
+	src, key := s.lookup(name)
+	return src.Duration(key)
+}
+
+func (s *profileSource) Float64(name string) (float64, error) {
+	src, key := s.lookup(name)
+	return src.Float64(key)
+}
+
+func (s *profileSource) String(name string) (string, error) {
+	src, key := s.lookup(name)
+	return src.String(key)
+}
+
+func (s *profileSource) StringSlice(name string) ([]string, error) {
+	src, key := s.lookup(name)
+	return src.StringSlice(key)
+}
+
+func (s *profileSource) IntSlice(name string) ([]int, error) {
+	src, key := s.lookup(name)
+	return src.IntSlice(key)
+}
+
+func (s *profileSource) Generic(name string) (cli.Generic, error) {
+	src, key := s.lookup(name)
+	return src.Generic(key)
+}
+
+func (s *profileSource) Bool(name string) (bool, error) {
+	src, key := s.lookup(name)
+	return src.Bool(key)
+}
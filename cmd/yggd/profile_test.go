@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewConfigSource(t *testing.T) {
+	const config = `
+data-host = "cert.cloud.example.com"
+broker = ["mqtts://broker.example.com:8883"]
+payload-encryption = true
+
+[profiles.stage]
+broker = ["mqtts://broker.stage.example.com:8883"]
+topic-prefix = "stage"
+payload-encryption = false
+`
+
+	type values struct {
+		Profile      string
+		DataHost     string
+		TopicPrefix  string
+		Brokers      []string
+		CleanSession bool
+	}
+
+	tests := []struct {
+		description string
+		config      string
+		profileFile string
+		profile     string
+		want        values
+		wantError   bool
+	}{
+		{
+			description: "no profile",
+			config:      config,
+			want: values{
+				DataHost:     "cert.cloud.example.com",
+				Brokers:      []string{"mqtts://broker.example.com:8883"},
+				CleanSession: true,
+			},
+		},
+		{
+			description: "inline profile",
+			config:      config,
+			profile:     "stage",
+			want: values{
+				Profile:     "stage",
+				DataHost:    "cert.cloud.example.com",
+				TopicPrefix: "stage",
+				Brokers:     []string{"mqtts://broker.stage.example.com:8883"},
+			},
+		},
+		{
+			description: "profile key",
+			config:      "profile = \"stage\"\n" + config,
+			want: values{
+				Profile:     "stage",
+				DataHost:    "cert.cloud.example.com",
+				TopicPrefix: "stage",
+				Brokers:     []string{"mqtts://broker.stage.example.com:8883"},
+			},
+		},
+		{
+			description: "profile file",
+			config:      config,
+			profileFile: `data-host = "cert.dev.example.com"`,
+			profile:     "dev",
+			want: values{
+				Profile:      "dev",
+				DataHost:     "cert.dev.example.com",
+				Brokers:      []string{"mqtts://broker.example.com:8883"},
+				CleanSession: true,
+			},
+		},
+		{
+			description: "profile defined twice",
+			config:      config,
+			profileFile: `data-host = "cert.stage.example.com"`,
+			profile:     "stage",
+			wantError:   true,
+		},
+		{
+			description: "unknown profile",
+			config:      config,
+			profile:     "production",
+			wantError:   true,
+		},
+		{
+			description: "invalid profile name",
+			config:      config,
+			profile:     "../stage",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-profile-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "config.toml")
+			if err := ioutil.WriteFile(file, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.profileFile != "" {
+				if err := os.MkdirAll(profilesDir(file), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(profilesDir(file), test.profile+".toml"), []byte(test.profileFile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			source, profile, err := newConfigSource(file, test.profile)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got profile %v", profile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := values{Profile: profile}
+			if got.DataHost, err = source.String("data-host"); err != nil {
+				t.Fatal(err)
+			}
+			if got.TopicPrefix, err = source.String("topic-prefix"); err != nil {
+				t.Fatal(err)
+			}
+			if got.Brokers, err = source.StringSlice("broker"); err != nil {
+				t.Fatal(err)
+			}
+			if got.CleanSession, err = source.Bool("payload-encryption"); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// controlQueueSize is the number of control messages that may wait to be
+// handled.
+const controlQueueSize = 100
+
+// controlMessage is a control message waiting to be handled.
+type controlMessage struct {
+	msg []byte
+	t   transport.Transport
+}
+
+// queueControlMessages returns a CommandHandler that queues control messages
+// for a single goroutine calling handler. Control messages are handled
+// independently of data messages, so commands such as ping or disconnect are
+// acted upon promptly even when data dispatch is saturated. They are handled
+// one at a time, in the order they arrive, since a command may depend on the
+// effect of the one before it (such as "set-brokers" followed by
+// "reconnect").
+func queueControlMessages(handler transport.CommandHandler) transport.CommandHandler {
+	q := make(chan controlMessage, controlQueueSize)
+	go func() {
+		for m := range q {
+			handler(m.msg, m.t)
+		}
+	}()
+
+	return func(msg []byte, t transport.Transport) {
+		q <- controlMessage{msg: msg, t: t}
+	}
+}
+
+// queueDataMessages returns a DataHandler that queues data messages for a
+// single goroutine calling handler, preserving their order. Once size
+// messages are queued, policy decides whether the transport waits for room in
+// the queue, or the message is dropped.
+func queueDataMessages(handler transport.DataHandler, size int, policy QueuePolicy) transport.DataHandler {
+	q := make(chan []byte, size)
+	go func() {
+		for msg := range q {
+			handler(msg)
+		}
+	}()
+
+	return func(msg []byte) {
+		select {
+		case q <- msg:
+			return
+		default:
+		}
+
+		queueMetrics.Add("incoming.saturated", 1)
+		if policy == QueuePolicyDrop {
+			queueMetrics.Add("incoming.dropped", 1)
+			log.Warnf("data queue is full (%v messages); dropping message", size)
+			return
+		}
+		log.Warnf("data queue is full (%v messages); waiting for dispatch to catch up", size)
+		q <- msg
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestQueueControlMessages(t *testing.T) {
+	handled := make(chan string, 3)
+	handler := queueControlMessages(func(msg []byte, t transport.Transport) {
+		if string(msg) == "set-brokers" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		handled <- string(msg)
+	})
+
+	want := []string{"set-brokers", "reconnect", "ping"}
+	for _, msg := range want {
+		handler([]byte(msg), nil)
+	}
+
+	for _, w := range want {
+		select {
+		case got := <-handled:
+			if got != w {
+				t.Errorf("%v != %v", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("control message not handled")
+		}
+	}
+}
+
+func TestQueueDataMessages(t *testing.T) {
+	tests := []struct {
+		description string
+		policy      QueuePolicy
+		wantBlocked bool
+	}{
+		{description: "drop", policy: QueuePolicyDrop, wantBlocked: false},
+		{description: "defer", policy: QueuePolicyDefer, wantBlocked: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			block := make(chan struct{})
+			defer close(block)
+			handler := queueDataMessages(func(msg []byte) { <-block }, 1, test.policy)
+
+			// The first message is taken by the handler, the second fills
+			// the queue, and the third finds it full.
+			returned := make(chan struct{})
+			go func() {
+				for _, msg := range []string{"1", "2", "3"} {
+					handler([]byte(msg))
+					time.Sleep(10 * time.Millisecond)
+				}
+				close(returned)
+			}()
+
+			select {
+			case <-returned:
+				if test.wantBlocked {
+					t.Error("transport not held back by a full queue")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if !test.wantBlocked {
+					t.Error("transport held back by a full queue")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// queueMetrics holds the "depth" of the "send" and "receive" queues, the
+// number of times each, and the "incoming" queue of data messages received by
+// the transport, was found "saturated" and the number of messages "dropped"
+// from each, such as "send.dropped", as well as the number of
+// messages deferred or dropped by rate limits, in "rate_limit.deferred" and
+// "rate_limit.dropped".
+var queueMetrics = expvar.NewMap("queues")
+
+// QueuePolicy describes what happens to a message that cannot be queued or
+// dispatched immediately because a queue is full or a rate limit is exceeded.
+type QueuePolicy string
+
+const (
+	// QueuePolicyDefer waits until the message can be queued or dispatched,
+	// applying backpressure to the sender.
+	QueuePolicyDefer QueuePolicy = "defer"
+
+	// QueuePolicyDrop drops the message.
+	QueuePolicyDrop QueuePolicy = "drop"
+)
+
+// A rateLimit is a token bucket allowing rate messages per second, in bursts
+// of up to burst messages.
+type rateLimit struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// parseRateLimits parses per-directive rate limits in the form
+// "DIRECTIVE=RATE[/BURST]", as parsed by parseRate.
+func parseRateLimits(values []string) (map[string]*rateLimit, error) {
+	limits := make(map[string]*rateLimit)
+	for _, value := range values {
+		fields := strings.SplitN(value, "=", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid rate limit %q: expected DIRECTIVE=RATE[/BURST]", value)
+		}
+		l, err := parseRate(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q: %w", value, err)
+		}
+		limits[fields[0]] = l
+	}
+	return limits, nil
+}
+
+// parseRate parses a rate limit in the form "RATE[/BURST]", where RATE is the
+// number of messages per second and BURST, which defaults to RATE rounded up,
+// the number of messages that may be sent at once.
+func parseRate(value string) (*rateLimit, error) {
+	spec := strings.SplitN(value, "/", 2)
+	rate, err := strconv.ParseFloat(spec[0], 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("rate must be a positive number")
+	}
+	burst := float64(int(rate))
+	if burst < rate {
+		burst++
+	}
+	if len(spec) == 2 {
+		b, err := strconv.Atoi(spec[1])
+		if err != nil || b < 1 {
+			return nil, fmt.Errorf("burst must be a positive integer")
+		}
+		burst = float64(b)
+	}
+	return &rateLimit{rate: rate, burst: burst, tokens: burst}, nil
+}
+
+// take takes a token at now, if one is available. Otherwise, it returns the
+// time to wait until one is; if reserve is true, the token is taken anyway,
+// so that the next caller waits for the following token.
+func (l *rateLimit) take(now time.Time, reserve bool) (bool, time.Duration) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if reserve {
+		l.tokens--
+	}
+	return false, wait
+}
+
+// A rateLimiter applies a rate limit to the messages of each directive.
+type rateLimiter struct {
+	lock   sync.Mutex
+	limits map[string]*rateLimit
+}
+
+// allow reports whether a message for directive may be dispatched at now and,
+// if not, how long to wait; reserve is passed to take. Directives without a
+// rate limit are always allowed, as is everything with a nil rateLimiter.
+func (r *rateLimiter) allow(directive string, now time.Time, reserve bool) (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l, prs := r.limits[directive]
+	if !prs {
+		return true, 0
+	}
+	return l.take(now, reserve)
+}
+
+// enqueue sends data on the named queue q. If q is full, a warning is logged
+// and, depending on the queue policy, the caller waits for room in q or data
+// is dropped. It reports whether data was queued.
+func (d *dispatcher) enqueue(q chan yggdrasil.Data, name string, data yggdrasil.Data) bool {
+	select {
+	case q <- data:
+		return true
+	default:
+	}
+
+	queueMetrics.Add(name+".saturated", 1)
+	if d.queuePolicy == QueuePolicyDrop {
+		queueMetrics.Add(name+".dropped", 1)
+		log.Warnf("%v queue is full (%v messages); dropping message %v", name, cap(q), data.MessageID)
+		return false
+	}
+	log.Warnf("%v queue is full (%v messages); waiting to queue message %v", name, cap(q), data.MessageID)
+	q <- data
+	return true
+}
+
+// deferredData is a message waiting for the rate limit of its directive
+// until at, to be dispatched to the worker w.
+type deferredData struct {
+	w    worker
+	data yggdrasil.Data
+	at   time.Time
+}
+
+// limit applies the rate limit of the directive of data. It reports whether
+// data may be dispatched now; otherwise, depending on the queue policy, data
+// is dropped, with a "delivery-failed" event, or deferred until the rate
+// limit permits. Deferred messages are
+// dispatched by drainDeferred in the order they were deferred, and messages
+// for a directive are deferred as long as earlier ones are waiting, so that
+// they are not overtaken. At most as many messages as fit in the send queue
+// are deferred at once; any more are dropped.
+func (d *dispatcher) limit(w worker, data yggdrasil.Data) bool {
+	reserve := d.queuePolicy != QueuePolicyDrop
+	now := time.Now()
+
+	d.Lock()
+	defer d.Unlock()
+
+	ok, wait := d.limiter.allow(data.Directive, now, reserve)
+	q := d.deferredQ[data.Directive]
+	if ok && len(q) == 0 {
+		return true
+	}
+
+	if reserve && d.deferred < cap(d.sendQ) {
+		at := now.Add(wait)
+		if len(q) > 0 && at.Before(q[len(q)-1].at) {
+			at = q[len(q)-1].at
+		}
+		d.deferred++
+		d.deferredQ[data.Directive] = append(q, deferredData{w: w, data: data, at: at})
+		if len(q) == 0 {
+			go d.drainDeferred(data.Directive)
+		}
+		queueMetrics.Add("rate_limit.deferred", 1)
+		log.Debugf("deferring message %v by %v to honor the rate limit of directive %v", data.MessageID, at.Sub(now), data.Directive)
+		return false
+	}
+
+	queueMetrics.Add("rate_limit.dropped", 1)
+	log.Warnf("dropping message %v: rate limit of directive %v exceeded", data.MessageID, data.Directive)
+	go d.deliveryFailed(data, 0, fmt.Errorf("rate limit exceeded"))
+	return false
+}
+
+// drainDeferred dispatches the messages deferred for directive one at a time,
+// each once its rate limit permits, until none is left. A message stays at the
+// head of the queue until it is dispatched, so that limit does not start
+// another goroutine for the directive meanwhile.
+func (d *dispatcher) drainDeferred(directive string) {
+	for {
+		d.Lock()
+		next := d.deferredQ[directive][0]
+		d.Unlock()
+
+		time.Sleep(time.Until(next.at))
+		if !d.hold(next.data) {
+			d.route(next.w, next.data)
+		}
+
+		d.Lock()
+		d.deferred--
+		q := d.deferredQ[directive][1:]
+		if len(q) == 0 {
+			delete(d.deferredQ, directive)
+			d.Unlock()
+			return
+		}
+		d.deferredQ[directive] = q
+		d.Unlock()
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        map[string][2]float64
+		wantError   bool
+	}{
+		{
+			description: "rate",
+			input:       []string{"echo=5"},
+			want:        map[string][2]float64{"echo": {5, 5}},
+		},
+		{
+			description: "fractional rate",
+			input:       []string{"echo=0.5"},
+			want:        map[string][2]float64{"echo": {0.5, 1}},
+		},
+		{
+			description: "burst",
+			input:       []string{"echo=2/10", "package-manager=1"},
+			want:        map[string][2]float64{"echo": {2, 10}, "package-manager": {1, 1}},
+		},
+		{
+			description: "missing rate",
+			input:       []string{"echo"},
+			wantError:   true,
+		},
+		{
+			description: "zero rate",
+			input:       []string{"echo=0"},
+			wantError:   true,
+		},
+		{
+			description: "invalid burst",
+			input:       []string{"echo=1/0"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			limits, err := parseRateLimits(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make(map[string][2]float64, len(limits))
+				for directive, l := range limits {
+					got[directive] = [2]float64{l.rate, l.burst}
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%#v != %#v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitTake(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &rateLimit{rate: 2, burst: 2, tokens: 2}
+
+	tests := []struct {
+		description string
+		at          time.Duration
+		reserve     bool
+		want        bool
+		wantWait    time.Duration
+	}{
+		{description: "first of burst", want: true},
+		{description: "second of burst", want: true},
+		{description: "exhausted", wantWait: 500 * time.Millisecond},
+		{description: "reserved", reserve: true, wantWait: 500 * time.Millisecond},
+		{description: "after reservation", wantWait: time.Second},
+		{description: "refilled", at: 2 * time.Second, want: true},
+	}
+
+	for _, test := range tests {
+		got, gotWait := l.take(start.Add(test.at), test.reserve)
+		if got != test.want || gotWait != test.wantWait {
+			t.Errorf("%v: got (%v, %v), want (%v, %v)", test.description, got, gotWait, test.want, test.wantWait)
+		}
+	}
+}
+
+func TestLimitDefersInOrder(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	d.queuePolicy = QueuePolicyDefer
+	d.limiter = &rateLimiter{limits: map[string]*rateLimit{"echo": {rate: 50, burst: 1, tokens: 1}}}
+	fw := registerFakeWorker(t, d, "echo", false)
+	w, _ := d.lookupWorker("echo")
+
+	want := []string{"1", "2", "3", "4", "5"}
+	for _, id := range want {
+		data := yggdrasil.Data{MessageID: id, Directive: "echo"}
+		if d.limit(w, data) {
+			d.route(w, data)
+		}
+	}
+
+	waitFor(t, func() bool { return len(fw.messages()) == len(want) })
+	if got := fw.messages(); !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+	waitFor(t, func() bool {
+		d.RLock()
+		defer d.RUnlock()
+		return d.deferred == 0 && len(d.deferredQ) == 0
+	})
+}
+
+func TestLimitDropReportsDeliveryFailed(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	d.queuePolicy = QueuePolicyDrop
+	d.limiter = &rateLimiter{limits: map[string]*rateLimit{"echo": {rate: 1, burst: 1, tokens: 0}}}
+	w := worker{handler: "echo"}
+
+	if d.limit(w, yggdrasil.Data{MessageID: "1", Directive: "echo"}) {
+		t.Fatal("message allowed beyond the rate limit")
+	}
+
+	select {
+	case event := <-d.events:
+		if event.Content != string(yggdrasil.EventNameDeliveryFailed) {
+			t.Errorf("event %v != %v", event.Content, yggdrasil.EventNameDeliveryFailed)
+		}
+		if event.ResponseTo != "1" {
+			t.Errorf("event in response to %v, want 1", event.ResponseTo)
+		}
+		if event.Details["error"] != "rate limit exceeded" {
+			t.Errorf("error %q != %q", event.Details["error"], "rate limit exceeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery-failed event")
+	}
+}
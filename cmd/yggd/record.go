@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// A messageRecorder writes every message published and received by the
+// transport, unredacted, to a file in the format of the message mirror, so
+// that the traffic of a session can be replayed through the dispatcher with
+// the simulator transport. Messages received that are not JSON are recorded
+// as JSON strings.
+type messageRecorder struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// newMessageRecorder returns a messageRecorder writing to the file at path,
+// replacing its content. The file is only readable by its owner, as messages
+// are recorded unredacted.
+func newMessageRecorder(path string) (*messageRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %w", err)
+	}
+	return &messageRecorder{file: f}, nil
+}
+
+// record writes msg, the JSON encoding of a message sent or received on
+// channel, to the recording. It is set as transport.Mirror.
+func (r *messageRecorder) record(direction, channel string, msg []byte) {
+	message := json.RawMessage(msg)
+	if !json.Valid(msg) {
+		message, _ = json.Marshal(string(msg))
+	}
+	line, err := json.Marshal(mirrorRecord{
+		Time:      time.Now().UTC(),
+		Direction: direction,
+		Channel:   channel,
+		Message:   message,
+	})
+	if err != nil {
+		log.Debugf("cannot record message: %v", err)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		log.Debugf("cannot write recorded message: %v", err)
+	}
+}
+
+// close stops recording messages.
+func (r *messageRecorder) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// addMirror sets transport.Mirror to call f in addition to the function
+// already set, if any.
+func addMirror(f func(direction, channel string, msg []byte)) {
+	prev := transport.Mirror
+	if prev == nil {
+		transport.Mirror = f
+		return
+	}
+	transport.Mirror = func(direction, channel string, msg []byte) {
+		prev(direction, channel, msg)
+		f(direction, channel, msg)
+	}
+}
+
+// replayRecording hands the messages received in the recording read from rec
+// to the dispatcher with the simulator transport, and returns the number of
+// messages replayed. Messages are spaced as they were received, the delays
+// divided by speed; with a speed of 0, they are replayed without delay.
+// Messages published in the recording are skipped; the dispatcher publishes
+// its own as it handles the messages replayed. Messages recorded as JSON
+// strings are replayed as the string they hold.
+func replayRecording(rec io.Reader, speed float64) (int, error) {
+	if simulator == nil {
+		return 0, errNotSimulating
+	}
+	decoder := json.NewDecoder(rec)
+	n := 0
+	var last time.Time
+	for {
+		var record mirrorRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("cannot read record: %w", err)
+		}
+		if record.Direction != transport.MirrorReceived {
+			continue
+		}
+
+		if speed > 0 && !last.IsZero() && record.Time.After(last) {
+			time.Sleep(time.Duration(float64(record.Time.Sub(last)) / speed))
+		}
+		last = record.Time
+
+		msg := []byte(record.Message)
+		var s string
+		if err := json.Unmarshal(record.Message, &s); err == nil {
+			msg = []byte(s)
+		}
+		if err := simulator.Deliver(record.Channel, msg); err != nil {
+			return n, fmt.Errorf("cannot replay message %v: %w", n+1, err)
+		}
+		n++
+	}
+}
+
+// replayFile replays the recording in the file at path after delay, giving
+// the workers started with yggd time to register.
+func replayFile(path string, speed float64, delay time.Duration) {
+	time.Sleep(delay)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("cannot replay messages: %v", err)
+		return
+	}
+	defer f.Close()
+	n, err := replayRecording(f, speed)
+	if err != nil {
+		log.Errorf("cannot replay messages from %v: %v", path, err)
+	}
+	log.Infof("replayed %v messages from %v", n, path)
+}
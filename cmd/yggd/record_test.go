@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	"github.com/redhatinsights/yggdrasil/internal/transport/memory"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-record-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording.jsonl")
+
+	r, err := newMessageRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.record(transport.MirrorReceived, memory.ChannelControl, []byte(`{"type":"command","content":{"command":"ping"}}`))
+	r.record(transport.MirrorSent, memory.ChannelControl, []byte(`{"type":"event","content":"pong"}`))
+	r.record(transport.MirrorReceived, memory.ChannelData, []byte(`{"type":"data","content":{"password":"hunter2"}}`))
+	r.record(transport.MirrorReceived, memory.ChannelData, []byte(`not json`))
+	r.close()
+
+	var control, data []string
+	defer func(s *memory.Transport) { simulator = s }(simulator)
+	simulator = nil
+	if _, err := replayRecording(strings.NewReader(""), 0); err != errNotSimulating {
+		t.Errorf("error = %v, want %v", err, errNotSimulating)
+	}
+	simulator = memory.NewTransport(func(msg []byte, _ transport.Transport) {
+		control = append(control, string(msg))
+	}, func(msg []byte) {
+		data = append(data, string(msg))
+	}, nil)
+	if err := simulator.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := replayRecording(f, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("n = %v, want 3", n)
+	}
+
+	wantControl := []string{`{"type":"command","content":{"command":"ping"}}`}
+	if !cmp.Equal(control, wantControl) {
+		t.Errorf("%#v", cmp.Diff(control, wantControl))
+	}
+	wantData := []string{`{"type":"data","content":{"password":"hunter2"}}`, `not json`}
+	if !cmp.Equal(data, wantData) {
+		t.Errorf("%#v", cmp.Diff(data, wantData))
+	}
+}
+
+func TestAddMirror(t *testing.T) {
+	defer func(f func(string, string, []byte)) { transport.Mirror = f }(transport.Mirror)
+	transport.Mirror = nil
+
+	var got []string
+	addMirror(func(direction, channel string, msg []byte) { got = append(got, "first "+direction) })
+	addMirror(func(direction, channel string, msg []byte) { got = append(got, "second "+direction) })
+	transport.MirrorReceivedMessage(memory.ChannelData, []byte(`{}`))
+
+	want := []string{"first received", "second received"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+}
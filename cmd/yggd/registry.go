@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// keepWorkers, set by the "keep-workers" flag, leaves workers running when
+// yggd exits and reattaches to them on the next start.
+var keepWorkers bool
+
+// reattachedPollInterval is the interval at which the dispatcher checks
+// whether the reattached workers, which are not its children, are still
+// running.
+const reattachedPollInterval = time.Second
+
+// workerFiles maps the PIDs of running workers to the worker file or manifest
+// they were started from.
+var workerFiles = struct {
+	sync.RWMutex
+	m map[int]string
+}{m: make(map[int]string)}
+
+// registryFile returns the path of the file in which worker registrations
+// are persisted.
+func registryFile() string {
+	return filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "registry.json")
+}
+
+// workerLogFile returns the path of the file the output of the worker started
+// from file is appended to when workers are kept across restarts, since a
+// pipe to yggd would break when it exits.
+func workerLogFile(file string) string {
+	return filepath.Join(yggdrasil.LocalstateDir, "log", yggdrasil.LongName, filepath.Base(file)+".log")
+}
+
+// openWorkerLog opens the log file of the worker started from file for
+// appending, creating it if needed.
+func openWorkerLog(file string) (*os.File, error) {
+	path := workerLogFile(file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open log file: %w", err)
+	}
+	return f, nil
+}
+
+// A workerRegistry is the persisted state yggd needs to reattach to running
+// workers: their registrations, and the dispatcher socket they send to.
+type workerRegistry struct {
+	SocketAddr string             `json:"socket_addr"`
+	Workers    []registeredWorker `json:"workers"`
+}
+
+// A registeredWorker is the registration of a worker process. StartTime, the
+// start time of the process in clock ticks since boot, tells the process
+// apart from a later one reusing its PID.
+type registeredWorker struct {
+	File            string            `json:"file"`
+	PID             int               `json:"pid"`
+	StartTime       uint64            `json:"start_time"`
+	Handler         string            `json:"handler"`
+	Addr            string            `json:"addr"`
+	Features        map[string]string `json:"features,omitempty"`
+	DetachedContent bool              `json:"detached_content,omitempty"`
+	Ordered         bool              `json:"ordered,omitempty"`
+	Topics          []string          `json:"topics,omitempty"`
+	Version         string            `json:"version,omitempty"`
+	Coalesce        bool              `json:"coalesce,omitempty"`
+	LocalContent    bool              `json:"local_content,omitempty"`
+}
+
+// worker returns the dispatcher's registration of r.
+func (r registeredWorker) worker() worker {
+	return worker{
+		pid:             r.PID,
+		handler:         r.Handler,
+		addr:            r.Addr,
+		features:        r.Features,
+		detachedContent: r.DetachedContent,
+		ordered:         r.Ordered,
+		topics:          r.Topics,
+		version:         r.Version,
+		coalesce:        r.Coalesce,
+		localContent:    r.LocalContent,
+	}
+}
+
+// readRegistry reads the registry stored at path. It returns nil if the file
+// does not exist.
+func readRegistry(path string) (*workerRegistry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read registry: %w", err)
+	}
+	var r workerRegistry
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("cannot parse registry: %w", err)
+	}
+	return &r, nil
+}
+
+// writeRegistry atomically replaces the registry stored at path with r.
+func writeRegistry(path string, r *workerRegistry) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("cannot marshal registry: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write registry: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// saveRegistry persists the registrations of the workers started by yggd, if
+// workers are kept across restarts.
+func (d *dispatcher) saveRegistry() {
+	if !keepWorkers {
+		return
+	}
+
+	r := workerRegistry{SocketAddr: d.socketAddr}
+	d.RLock()
+	workerFiles.RLock()
+	for _, w := range d.workers {
+		file, prs := workerFiles.m[w.pid]
+		if !prs || w.namespace {
+			continue
+		}
+		startTime, err := processStartTime(w.pid)
+		if err != nil {
+			log.Debugf("cannot persist registration of worker %v: %v", w.handler, err)
+			continue
+		}
+		r.Workers = append(r.Workers, registeredWorker{
+			File:            file,
+			PID:             w.pid,
+			StartTime:       startTime,
+			Handler:         w.handler,
+			Addr:            w.addr,
+			Features:        w.features,
+			DetachedContent: w.detachedContent,
+			Ordered:         w.ordered,
+			Topics:          w.topics,
+			Version:         w.version,
+			Coalesce:        w.coalesce,
+			LocalContent:    w.localContent,
+		})
+	}
+	workerFiles.RUnlock()
+	d.RUnlock()
+
+	if err := writeRegistry(registryFile(), &r); err != nil {
+		log.Errorf("cannot persist worker registrations: %v", err)
+	}
+}
+
+// running returns the set of PIDs of the workers of r that are still
+// running, the same processes as when they registered. r may be nil.
+func (r *workerRegistry) running() map[int]bool {
+	pids := make(map[int]bool)
+	if r == nil {
+		return pids
+	}
+	for _, rw := range r.Workers {
+		if startTime, err := processStartTime(rw.PID); err == nil && startTime == rw.StartTime {
+			pids[rw.PID] = true
+		}
+	}
+	return pids
+}
+
+// reattachWorkers registers the workers of r that are still running and
+// returns the set of files they were started from. The other registrations
+// are dropped. r may be nil.
+func (d *dispatcher) reattachWorkers(r *workerRegistry, env []string) map[string]bool {
+	reattached := make(map[string]bool)
+	running := r.running()
+	if len(running) == 0 {
+		return reattached
+	}
+	for _, rw := range r.Workers {
+		if !running[rw.PID] {
+			log.Debugf("not reattaching worker %v: process %v is gone", rw.Handler, rw.PID)
+			continue
+		}
+		if _, err := os.Stat(rw.File); err != nil {
+			log.Infof("not reattaching worker %v: %v", rw.Handler, err)
+			if err := killWorker(workerPIDFile(rw.File)); err != nil {
+				log.Errorf("cannot kill worker: %v", err)
+			}
+			continue
+		}
+
+		if isWorkerManifest(rw.File) {
+			manifest, err := loadWorkerManifest(rw.File)
+			if err != nil {
+				log.Errorf("not reattaching worker %v: %v", rw.Handler, err)
+				continue
+			}
+			manifestWorkers.Lock()
+			manifestWorkers.m[rw.PID] = manifest
+			manifestWorkers.Unlock()
+		}
+		workerFiles.Lock()
+		workerFiles.m[rw.PID] = rw.File
+		workerFiles.Unlock()
+
+		w := rw.worker()
+		d.Lock()
+		d.workers[w.handler] = w
+		d.pidHandlers[w.pid] = w.handler
+		d.Unlock()
+		reattached[rw.File] = true
+		log.Infof("worker reattached: %+v", w)
+
+		go d.watchReattached(rw.File, w.pid, env)
+	}
+	return reattached
+}
+
+// subscribeReattached requests the subscriptions to the additional topics of
+// the reattached workers.
+func (d *dispatcher) subscribeReattached() {
+	d.RLock()
+	var subscriptions []subscription
+	for _, w := range d.workers {
+		for _, topic := range w.topics {
+			subscriptions = append(subscriptions, subscription{topic: topic, directive: w.handler})
+		}
+	}
+	d.RUnlock()
+
+	for _, s := range subscriptions {
+		d.subscriptions <- s
+	}
+}
+
+// watchReattached waits for the reattached worker process pid, started from
+// file, to exit, then unregisters it and starts it again with env, unless it
+// was killed on purpose.
+func (d *dispatcher) watchReattached(file string, pid int, env []string) {
+	for processExists(pid) {
+		time.Sleep(reattachedPollInterval)
+	}
+
+	manifestWorkers.Lock()
+	delete(manifestWorkers.m, pid)
+	manifestWorkers.Unlock()
+	workerFiles.Lock()
+	delete(workerFiles.m, pid)
+	workerFiles.Unlock()
+
+	if isWorkerManifest(file) {
+		if err := removeCgroup(manifestName(file)); err != nil {
+			log.Debugf("cannot remove cgroup of worker %v: %v", file, err)
+		}
+		if err := removeCredentials(manifestName(file)); err != nil {
+			log.Errorf("cannot remove credentials of worker %v: %v", file, err)
+		}
+	}
+
+	d.deadWorkers <- pid
+
+	stoppingWorkers.Lock()
+	stopped, prs := stoppingWorkers.m[pid]
+	delete(stoppingWorkers.m, pid)
+	stoppingWorkers.Unlock()
+	if prs {
+		log.Infof("worker %v stopped", file)
+		close(stopped)
+		return
+	}
+
+	// The exit status of a process that is not a child is unknown, so the
+	// restart policy of its manifest cannot be applied.
+	log.Infof("reattached worker %v exited; restarting", file)
+	go startProcess(file, env, 0, d.deadWorkers)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run", "registry.json")
+
+	r, err := readRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != nil {
+		t.Fatalf("read %+v from missing registry, want nil", r)
+	}
+
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &workerRegistry{
+		SocketAddr: "@yggd-dispatcher-test",
+		Workers: []registeredWorker{
+			{
+				File:      "/usr/libexec/yggdrasil/echo-worker",
+				PID:       os.Getpid(),
+				StartTime: startTime,
+				Handler:   "echo",
+				Addr:      "@ygg-echo-test",
+				Features:  map[string]string{"version": "1"},
+				Topics:    []string{"a/b"},
+			},
+			{
+				File:      "/usr/libexec/yggdrasil/gone-worker",
+				PID:       os.Getpid(),
+				StartTime: startTime + 1,
+				Handler:   "gone",
+			},
+		},
+	}
+	if err := writeRegistry(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+
+	// The second worker has the PID of a process started at another time.
+	running := got.running()
+	if len(running) != 1 || !running[os.Getpid()] {
+		t.Errorf("running %v, want only %v", running, os.Getpid())
+	}
+	if running := (*workerRegistry)(nil).running(); len(running) != 0 {
+		t.Errorf("running %v, want none", running)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// routeMetrics holds the number of messages "routed" by a rule, and the
+// number of "copies" dispatched to the handlers of rules with several
+// handlers.
+var routeMetrics = expvar.NewMap("routes")
+
+// A route sends the messages for the directives it matches to other handlers.
+// A route matches either a single directive or, if pattern is set, the
+// directives pattern matches as a whole.
+type route struct {
+	directive string
+	pattern   *regexp.Regexp
+	handlers  []string
+}
+
+// parseRoutes parses routing rules in the form "DIRECTIVE=HANDLER[,HANDLER]",
+// where a DIRECTIVE starting with "~" is a regular expression. The handlers of
+// a regular expression may refer to its submatches, as in "$1".
+func parseRoutes(values []string) ([]route, error) {
+	routes := make([]route, 0, len(values))
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid route %q: expected DIRECTIVE=HANDLER[,HANDLER]", value)
+		}
+		r := route{directive: value[:i]}
+		for _, handler := range strings.Split(value[i+1:], ",") {
+			if handler == "" {
+				return nil, fmt.Errorf("invalid route %q: empty handler", value)
+			}
+			r.handlers = append(r.handlers, handler)
+		}
+		if strings.HasPrefix(r.directive, "~") {
+			pattern, err := regexp.Compile("^(?:" + r.directive[1:] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid route %q: %w", value, err)
+			}
+			r.pattern = pattern
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// match returns the handlers directive is routed to, if r matches it.
+func (r route) match(directive string) ([]string, bool) {
+	if r.pattern == nil {
+		return r.handlers, directive == r.directive
+	}
+	submatches := r.pattern.FindStringSubmatchIndex(directive)
+	if submatches == nil {
+		return nil, false
+	}
+	handlers := make([]string, 0, len(r.handlers))
+	for _, handler := range r.handlers {
+		handlers = append(handlers, string(r.pattern.ExpandString(nil, handler, directive, submatches)))
+	}
+	return handlers, true
+}
+
+// routeData returns the messages data is dispatched as: a copy of data for
+// each handler of the first route matching its directive, its directive
+// replaced by the handler and the original directive recorded in its
+// MetadataKeyRoutedFrom metadata key, or data itself if no route matches.
+// Messages that were already routed are not routed again.
+func routeData(routes []route, data yggdrasil.Data) []yggdrasil.Data {
+	if _, prs := data.Metadata[yggdrasil.MetadataKeyRoutedFrom]; prs {
+		return []yggdrasil.Data{data}
+	}
+	for _, r := range routes {
+		handlers, ok := r.match(data.Directive)
+		if !ok {
+			continue
+		}
+		routeMetrics.Add("routed", 1)
+		if len(handlers) > 1 {
+			routeMetrics.Add("copies", int64(len(handlers)))
+		}
+		routed := make([]yggdrasil.Data, 0, len(handlers))
+		for _, handler := range handlers {
+			c := data
+			c.Directive = handler
+			c.Metadata = make(map[string]string, len(data.Metadata)+1)
+			for k, v := range data.Metadata {
+				c.Metadata[k] = v
+			}
+			c.Metadata[yggdrasil.MetadataKeyRoutedFrom] = data.Directive
+			routed = append(routed, c)
+		}
+		return routed
+	}
+	return []yggdrasil.Data{data}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		wantError   bool
+	}{
+		{
+			description: "alias",
+			input:       []string{"legacy-echo=echo"},
+		},
+		{
+			description: "pattern",
+			input:       []string{"~pkg-(.*)=package-manager,audit-$1"},
+		},
+		{
+			description: "missing handler",
+			input:       []string{"legacy-echo"},
+			wantError:   true,
+		},
+		{
+			description: "empty handler",
+			input:       []string{"inventory=insights,"},
+			wantError:   true,
+		},
+		{
+			description: "invalid pattern",
+			input:       []string{"~pkg-(=package-manager"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := parseRoutes(test.input)
+			if (err != nil) != test.wantError {
+				t.Errorf("error = %v, want error %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func TestRouteData(t *testing.T) {
+	routes, err := parseRoutes([]string{
+		"legacy-echo=echo",
+		"inventory=insights,compliance",
+		"~pkg-(.*)=package-manager-$1",
+		"~pkg-.*=never",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		input       yggdrasil.Data
+		want        []yggdrasil.Data
+	}{
+		{
+			description: "no route",
+			input:       yggdrasil.Data{MessageID: "1", Directive: "echo"},
+			want:        []yggdrasil.Data{{MessageID: "1", Directive: "echo"}},
+		},
+		{
+			description: "alias",
+			input:       yggdrasil.Data{MessageID: "2", Directive: "legacy-echo", Metadata: map[string]string{"a": "1"}},
+			want: []yggdrasil.Data{
+				{MessageID: "2", Directive: "echo", Metadata: map[string]string{"a": "1", "routed-from": "legacy-echo"}},
+			},
+		},
+		{
+			description: "fan-out",
+			input:       yggdrasil.Data{MessageID: "3", Directive: "inventory"},
+			want: []yggdrasil.Data{
+				{MessageID: "3", Directive: "insights", Metadata: map[string]string{"routed-from": "inventory"}},
+				{MessageID: "3", Directive: "compliance", Metadata: map[string]string{"routed-from": "inventory"}},
+			},
+		},
+		{
+			description: "pattern",
+			input:       yggdrasil.Data{MessageID: "4", Directive: "pkg-install"},
+			want: []yggdrasil.Data{
+				{MessageID: "4", Directive: "package-manager-install", Metadata: map[string]string{"routed-from": "pkg-install"}},
+			},
+		},
+		{
+			description: "pattern matches whole directive",
+			input:       yggdrasil.Data{MessageID: "5", Directive: "legacy-pkg-install"},
+			want:        []yggdrasil.Data{{MessageID: "5", Directive: "legacy-pkg-install"}},
+		},
+		{
+			description: "already routed",
+			input:       yggdrasil.Data{MessageID: "6", Directive: "legacy-echo", Metadata: map[string]string{"routed-from": "inventory"}},
+			want: []yggdrasil.Data{
+				{MessageID: "6", Directive: "legacy-echo", Metadata: map[string]string{"routed-from": "inventory"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := routeData(routes, test.input)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// cgroupMountPoint is the mount point of the cgroup v2 hierarchy.
+var cgroupMountPoint = "/sys/fs/cgroup"
+
+// cgroupCPUPeriod is the period, in microseconds, over which the CPU quota of
+// a worker cgroup is enforced.
+const cgroupCPUPeriod = 100000
+
+// sandboxExecEnv is set in the environment of yggd when it is executed as the
+// helper that sandboxes itself before executing a worker. The sandboxSpec to
+// apply is read from file descriptor sandboxSpecFD.
+const (
+	sandboxExecEnv = "YGG_SANDBOX_EXEC"
+	sandboxSpecFD  = 3
+)
+
+// sandboxSpec describes the sandbox the helper applies to itself before
+// executing a worker, in this order: it joins Cgroup, sets Limits, switches to
+// Credential, then loads the Seccomp filter.
+type sandboxSpec struct {
+	Cgroup     string              `json:"cgroup,omitempty"`
+	Limits     []resourceLimit     `json:"limits,omitempty"`
+	Credential *syscall.Credential `json:"credential,omitempty"`
+	Seccomp    []byte              `json:"seccomp,omitempty"`
+}
+
+// Constants of prctl(2) and seccomp(2) the syscall package does not define.
+const (
+	prSetNoNewPrivs   = 38
+	seccompModeFilter = 2
+	bpfMaxInsns       = 4096
+)
+
+// sockFilter is a classic BPF instruction, struct sock_filter.
+type sockFilter struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// sockFprog is a classic BPF program, struct sock_fprog.
+type sockFprog struct {
+	Len    uint16
+	Filter *sockFilter
+}
+
+// lookupCredential returns the credential of the process of a worker run as
+// userName and groupName, each either a name or a numeric ID. The group
+// defaults to the primary group of the user, and the user to the user of yggd.
+func lookupCredential(userName, groupName string) (*syscall.Credential, error) {
+	cred := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up user %v: %w", userName, err)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %v: %w", u.Uid, err)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid %v: %w", u.Gid, err)
+		}
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+
+		groupIDs, err := u.GroupIds()
+		if err == nil {
+			for _, id := range groupIDs {
+				if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+					cred.Groups = append(cred.Groups, uint32(gid))
+				}
+			}
+		}
+	}
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up group %v: %w", groupName, err)
+		}
+		gid, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid %v: %w", g.Gid, err)
+		}
+		cred.Gid = uint32(gid)
+	}
+
+	return cred, nil
+}
+
+// owner returns the IDs of the user and group the worker of the manifest runs
+// as, for the files only the worker may read, or -1 for both if the manifest
+// sets neither.
+func (m *workerManifest) owner() (int, int, error) {
+	if m.User == "" && m.Group == "" {
+		return -1, -1, nil
+	}
+	cred, err := lookupCredential(m.User, m.Group)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(cred.Uid), int(cred.Gid), nil
+}
+
+// sandbox configures cmd to run the worker named name under the user, group,
+// resource limits, cgroup and seccomp filter of the manifest. A worker with
+// resource limits, a cgroup or a seccomp filter is started through yggd
+// itself, which applies them to itself before executing the worker, so that
+// the worker never runs outside its sandbox, and is not started at all if the
+// sandbox cannot be applied. The sandboxSpec is passed as an extra file that
+// the caller closes once cmd has started.
+func (m *workerManifest) sandbox(cmd *exec.Cmd, name string) error {
+	var cred *syscall.Credential
+	if m.User != "" || m.Group != "" {
+		var err error
+		cred, err = lookupCredential(m.User, m.Group)
+		if err != nil {
+			return err
+		}
+	}
+
+	limits := m.resourceLimits()
+	if m.Seccomp == "" && len(limits) == 0 && m.CGroup.CPU == 0 && m.CGroup.Memory == 0 {
+		if cred != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		}
+		return nil
+	}
+
+	spec := sandboxSpec{Limits: limits, Credential: cred}
+	if m.Seccomp != "" {
+		// The filter is verified and parsed here, and the verified content
+		// is passed to the helper, so that the file cannot be replaced
+		// between its verification and its use.
+		data, err := readVerified(m.Seccomp)
+		if err != nil {
+			return fmt.Errorf("cannot read seccomp filter: %w", err)
+		}
+		if _, err := parseSeccompFilter(data); err != nil {
+			return err
+		}
+		spec.Seccomp = data
+	}
+	dir, err := m.createCgroup(name)
+	if err != nil {
+		return err
+	}
+	spec.Cgroup = dir
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot find executable: %w", err)
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("cannot marshal sandbox: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("cannot create pipe: %w", err)
+	}
+	// A filter is at most bpfMaxInsns instructions, so the specification
+	// fits in the pipe buffer and the write does not wait for the helper.
+	_, err = w.Write(data)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return fmt.Errorf("cannot pass sandbox: %w", err)
+	}
+	cmd.Path = exe
+	cmd.Args = append([]string{exe, m.Exec}, m.Args...)
+	cmd.Env = append(cmd.Env, sandboxExecEnv+"=1")
+	cmd.ExtraFiles = []*os.File{r}
+
+	return nil
+}
+
+// A resourceLimit is the value of a resource limit, such as RLIMIT_NOFILE.
+type resourceLimit struct {
+	Resource int    `json:"resource"`
+	Value    uint64 `json:"value"`
+}
+
+// resourceLimits returns the resource limits set in the manifest.
+func (m *workerManifest) resourceLimits() []resourceLimit {
+	var limits []resourceLimit
+	for _, l := range []resourceLimit{
+		{syscall.RLIMIT_AS, m.Limits.Memory},
+		{syscall.RLIMIT_NOFILE, m.Limits.OpenFiles},
+		{rlimitNproc, m.Limits.Processes},
+		{syscall.RLIMIT_CPU, m.Limits.CPUTime},
+	} {
+		if l.Value != 0 {
+			limits = append(limits, l)
+		}
+	}
+	return limits
+}
+
+// setLimits sets limits on the process pid, or on the calling process if pid
+// is 0.
+func setLimits(pid int, limits []resourceLimit) error {
+	for _, l := range limits {
+		if err := prlimit(pid, l.Resource, &syscall.Rlimit{Cur: l.Value, Max: l.Value}); err != nil {
+			return fmt.Errorf("cannot set resource limit %v: %w", l.Resource, err)
+		}
+	}
+	return nil
+}
+
+// rlimitNproc is RLIMIT_NPROC, which the syscall package does not define.
+const rlimitNproc = 0x6
+
+// prlimit sets the resource limit of the process pid.
+func prlimit(pid int, resource int, limit *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// parseSeccompFilter parses a seccomp filter in the format written by
+// seccomp_export_bpf(3): an array of struct sock_filter in native byte order.
+func parseSeccompFilter(data []byte) ([]sockFilter, error) {
+	size := int(unsafe.Sizeof(sockFilter{}))
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid seccomp filter size %v", len(data))
+	}
+	if len(data)/size > bpfMaxInsns {
+		return nil, fmt.Errorf("seccomp filter exceeds %v instructions", bpfMaxInsns)
+	}
+	filter := make([]sockFilter, len(data)/size)
+	for i := range filter {
+		filter[i] = *(*sockFilter)(unsafe.Pointer(&data[i*size]))
+	}
+	return filter, nil
+}
+
+// execSandboxed runs in the helper process started for a sandboxed worker:
+// it applies the sandboxSpec it is passed to itself, then executes the
+// worker, never returning unless it fails.
+func execSandboxed() error {
+	// Credentials and the seccomp filter are set on the calling thread,
+	// which must therefore be the one executing the worker.
+	runtime.LockOSThread()
+
+	f := os.NewFile(sandboxSpecFD, "sandbox")
+	var spec sandboxSpec
+	err := json.NewDecoder(f).Decode(&spec)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("cannot read sandbox: %w", err)
+	}
+
+	// Everything the worker is executed with is prepared first, since the
+	// process may not be able to allocate memory once its limits are set.
+	var prog *sockFprog
+	if len(spec.Seccomp) > 0 {
+		filter, err := parseSeccompFilter(spec.Seccomp)
+		if err != nil {
+			return err
+		}
+		prog = &sockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	}
+	if len(os.Args) < 2 {
+		return fmt.Errorf("missing worker executable")
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, sandboxExecEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	path, err := syscall.BytePtrFromString(os.Args[1])
+	if err != nil {
+		return err
+	}
+	argv, err := syscall.SlicePtrFromStrings(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	envv, err := syscall.SlicePtrFromStrings(env)
+	if err != nil {
+		return err
+	}
+
+	if spec.Cgroup != "" {
+		if err := joinCgroup(spec.Cgroup, os.Getpid()); err != nil {
+			return err
+		}
+	}
+	// Limits are set while the process may still raise them.
+	if err := setLimits(0, spec.Limits); err != nil {
+		return err
+	}
+	if spec.Credential != nil {
+		if err := setCredential(spec.Credential); err != nil {
+			return err
+		}
+	}
+	if prog != nil {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			return fmt.Errorf("cannot set no_new_privs: %w", errno)
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_SECCOMP, seccompModeFilter, uintptr(unsafe.Pointer(prog))); errno != 0 {
+			return fmt.Errorf("cannot load seccomp filter: %w", errno)
+		}
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&argv[0])), uintptr(unsafe.Pointer(&envv[0])))
+	return fmt.Errorf("cannot execute worker: %w", errno)
+}
+
+// setCredential switches the process to the groups, group and user of cred,
+// in that order, since a process can no longer change its groups once it has
+// switched to an unprivileged user.
+func setCredential(cred *syscall.Credential) error {
+	groups := make([]int, 0, len(cred.Groups))
+	for _, g := range cred.Groups {
+		groups = append(groups, int(g))
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("cannot set groups: %w", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("cannot set group: %w", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("cannot set user: %w", err)
+	}
+	return nil
+}
+
+// workerCgroup returns the cgroup directory of the worker named name.
+func workerCgroup(name string) string {
+	return filepath.Join(cgroupMountPoint, yggdrasil.LongName+"-workers", name)
+}
+
+// createCgroup creates a cgroup of its own for the worker named name, limited
+// to the CPU and memory set in the manifest, and returns its directory. It
+// returns an empty directory if the manifest sets no cgroup limits.
+func (m *workerManifest) createCgroup(name string) (string, error) {
+	if m.CGroup.CPU == 0 && m.CGroup.Memory == 0 {
+		return "", nil
+	}
+
+	dir := workerCgroup(name)
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("cannot create cgroup: %w", err)
+	}
+	// Controllers must be enabled in each ancestor for the leaf to use them.
+	for _, p := range []string{filepath.Dir(parent), parent} {
+		if err := ioutil.WriteFile(filepath.Join(p, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644); err != nil {
+			return "", fmt.Errorf("cannot enable cgroup controllers: %w", err)
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("cannot create cgroup: %w", err)
+	}
+
+	files := map[string]string{}
+	if m.CGroup.CPU > 0 {
+		files["cpu.max"] = fmt.Sprintf("%d %d", int64(m.CGroup.CPU*cgroupCPUPeriod), cgroupCPUPeriod)
+	}
+	if m.CGroup.Memory > 0 {
+		files["memory.max"] = strconv.FormatUint(m.CGroup.Memory, 10)
+	}
+	for file, value := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+			return "", fmt.Errorf("cannot set %v: %w", file, err)
+		}
+	}
+	return dir, nil
+}
+
+// joinCgroup moves the process pid to the cgroup directory dir.
+func joinCgroup(dir string, pid int) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("cannot move process to cgroup: %w", err)
+	}
+	return nil
+}
+
+// cgroupOOMKilled reports whether the kernel killed a process in the cgroup
+// of the worker named name for exceeding its memory limit.
+func cgroupOOMKilled(name string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(workerCgroup(name), "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCgroup removes the cgroup of the worker named name, if any, once its
+// processes have exited.
+func removeCgroup(name string) error {
+	if err := os.Remove(workerCgroup(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
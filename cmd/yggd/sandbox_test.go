@@ -0,0 +1,168 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSeccompFilter(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []byte
+		want        int
+		wantError   bool
+	}{
+		{
+			description: "two instructions",
+			input:       make([]byte, 16),
+			want:        2,
+		},
+		{
+			description: "empty",
+			input:       []byte{},
+			wantError:   true,
+		},
+		{
+			description: "truncated",
+			input:       make([]byte, 12),
+			wantError:   true,
+		},
+		{
+			description: "too long",
+			input:       make([]byte, (bpfMaxInsns+1)*8),
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseSeccompFilter(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v instructions", len(got))
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != test.want {
+					t.Errorf("%v != %v", len(got), test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCgroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { cgroupMountPoint = old }(cgroupMountPoint)
+	cgroupMountPoint = dir
+
+	var m workerManifest
+	m.CGroup.CPU = 0.5
+	m.CGroup.Memory = 1048576
+	cgroup, err := m.createCgroup("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cgroup != workerCgroup("echo") {
+		t.Errorf("cgroup %v, want %v", cgroup, workerCgroup("echo"))
+	}
+	if err := joinCgroup(cgroup, 1234); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	for _, file := range []string{"cpu.max", "memory.max", "cgroup.procs"} {
+		data, err := ioutil.ReadFile(filepath.Join(workerCgroup("echo"), file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[file] = string(data)
+	}
+	want := map[string]string{
+		"cpu.max":      "50000 100000",
+		"memory.max":   "1048576",
+		"cgroup.procs": "1234",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { cgroupMountPoint = old }(cgroupMountPoint)
+	cgroupMountPoint = dir
+
+	tests := []struct {
+		description string
+		manifest    func(m *workerManifest)
+		wantHelper  bool
+		want        sandboxSpec
+	}{
+		{
+			description: "none",
+			manifest:    func(m *workerManifest) {},
+		},
+		{
+			description: "resource limits",
+			manifest:    func(m *workerManifest) { m.Limits.OpenFiles = 256 },
+			wantHelper:  true,
+			want:        sandboxSpec{Limits: []resourceLimit{{syscall.RLIMIT_NOFILE, 256}}},
+		},
+		{
+			description: "cgroup",
+			manifest:    func(m *workerManifest) { m.CGroup.Memory = 1048576 },
+			wantHelper:  true,
+			want:        sandboxSpec{Cgroup: filepath.Join(dir, "yggdrasil-workers", "echo")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			m := workerManifest{Exec: "/usr/libexec/echo-worker"}
+			test.manifest(&m)
+			cmd, err := m.command(nil, "echo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.wantHelper {
+				if cmd.Path != m.Exec || len(cmd.ExtraFiles) != 0 {
+					t.Errorf("worker started through %v with %v extra files, want directly", cmd.Path, len(cmd.ExtraFiles))
+				}
+				return
+			}
+			if len(cmd.ExtraFiles) != 1 || !cmp.Equal(cmd.Args[1:], []string{m.Exec}) {
+				t.Fatalf("worker started as %v with %v extra files, want through the helper", cmd.Args, len(cmd.ExtraFiles))
+			}
+			defer cmd.ExtraFiles[0].Close()
+			var got sandboxSpec
+			if err := json.NewDecoder(cmd.ExtraFiles[0]).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
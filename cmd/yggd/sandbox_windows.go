@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// sandboxExecEnv is set in the environment of yggd when it is executed as the
+// helper that sandboxes itself before executing a worker, which Windows does
+// not support.
+const sandboxExecEnv = "YGG_SANDBOX_EXEC"
+
+// errNoSandbox is returned for manifests setting a user, group, resource
+// limits, cgroup or seccomp filter, which cannot be applied on Windows.
+var errNoSandbox = fmt.Errorf("user, group, limits, cgroup and seccomp are not supported on Windows")
+
+// owner returns -1 for both IDs, since workers run as the user of yggd.
+func (m *workerManifest) owner() (int, int, error) {
+	if m.User != "" || m.Group != "" {
+		return 0, 0, errNoSandbox
+	}
+	return -1, -1, nil
+}
+
+// sandbox fails if the manifest sets a user, group, resource limits, cgroup
+// or seccomp filter, rather than running the worker without them.
+func (m *workerManifest) sandbox(cmd *exec.Cmd, name string) error {
+	if m.User != "" || m.Group != "" || m.Seccomp != "" ||
+		m.Limits.Memory != 0 || m.Limits.OpenFiles != 0 || m.Limits.Processes != 0 || m.Limits.CPUTime != 0 ||
+		m.CGroup.CPU != 0 || m.CGroup.Memory != 0 {
+		return errNoSandbox
+	}
+	return nil
+}
+
+// execSandboxed fails: yggd never starts itself as a sandboxing helper on
+// Windows.
+func execSandboxed() error {
+	return errNoSandbox
+}
+
+// cgroupOOMKilled reports false, since workers are not placed in cgroups.
+func cgroupOOMKilled(name string) bool {
+	return false
+}
+
+// removeCgroup does nothing, since workers are not placed in cgroups.
+func removeCgroup(name string) error {
+	return nil
+}
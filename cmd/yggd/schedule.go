@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// scheduleHorizon bounds the search for the time a message may be
+// dispatched: a message whose window is never open outside the blackout
+// windows within it is rejected.
+const scheduleHorizon = 8 * 24 * time.Hour
+
+// scheduleResumeDelay is the delay before the messages held by a previous
+// instance of yggd are released, giving the workers started with yggd time
+// to register.
+const scheduleResumeDelay = 10 * time.Second
+
+// scheduleMetrics holds the number of data messages "held" until their
+// window opens and "released" since, and the number of messages "scheduled"
+// now.
+var scheduleMetrics = expvar.NewMap("schedule")
+
+// scheduleDir returns the directory in which held messages are stored.
+func scheduleDir() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "scheduled")
+}
+
+// A scheduledMessage is a data message held until it may be dispatched.
+type scheduledMessage struct {
+	seq  uint64
+	at   time.Time
+	data yggdrasil.Data
+}
+
+// A messageScheduler holds data messages received from the server until
+// they may be dispatched: not before the time of their MetadataKeyNotBefore
+// metadata, within the daily window of their MetadataKeyWindow metadata, and
+// outside the blackout windows configured locally, which apply to every
+// message. Held messages are stored on disk, one file per message, so that
+// they survive a restart of yggd, and handed to release once due.
+type messageScheduler struct {
+	lock      sync.Mutex
+	dir       string
+	blackouts []transferWindow
+	held      []scheduledMessage
+	next      uint64
+	timer     *time.Timer
+	release   func(yggdrasil.Data)
+}
+
+// newMessageScheduler creates a messageScheduler storing held messages in
+// dir, from a list of blackout windows in the form "HH:MM-HH:MM". Messages
+// are handed to release once due.
+func newMessageScheduler(dir string, blackouts []string, release func(yggdrasil.Data)) (*messageScheduler, error) {
+	s := &messageScheduler{dir: dir, release: release}
+	for _, value := range blackouts {
+		w, err := parseTransferWindow(value)
+		if err != nil {
+			return nil, err
+		}
+		s.blackouts = append(s.blackouts, w)
+	}
+	return s, nil
+}
+
+// load reads the messages held by a previous instance of yggd and schedules
+// their release, no sooner than scheduleResumeDelay from now.
+func (s *messageScheduler) load(now time.Time) error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read directory: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, info := range infos {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, info.Name())
+		var data yggdrasil.Data
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(content, &data)
+		}
+		var at time.Time
+		if err == nil {
+			at, err = s.schedule(data, now)
+		}
+		if err != nil {
+			log.Warnf("discarding scheduled message %v: %v", info.Name(), err)
+			os.Remove(path)
+			continue
+		}
+		if resume := now.Add(scheduleResumeDelay); at.Before(resume) {
+			at = resume
+		}
+		s.held = append(s.held, scheduledMessage{seq: seq, at: at, data: data})
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	s.sort()
+	if len(s.held) > 0 {
+		log.Infof("holding %v scheduled messages", len(s.held))
+	}
+	s.arm(now)
+	return nil
+}
+
+// path returns the path of the file of the message with sequence number seq.
+func (s *messageScheduler) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// len returns the number of held messages.
+func (s *messageScheduler) len() int {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.held)
+}
+
+// parseWindow parses the daily window of data, if it has one.
+func parseWindow(data yggdrasil.Data) (*transferWindow, error) {
+	value, prs := data.Metadata[yggdrasil.MetadataKeyWindow]
+	if !prs {
+		return nil, nil
+	}
+	w, err := parseTransferWindow(value)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// schedule returns the earliest time from now at which data may be
+// dispatched. Windows are bounded by minutes, so the search advances a
+// minute at a time.
+func (s *messageScheduler) schedule(data yggdrasil.Data, now time.Time) (time.Time, error) {
+	at := now
+	if value, prs := data.Metadata[yggdrasil.MetadataKeyNotBefore]; prs {
+		notBefore, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cannot parse not-before time: %w", err)
+		}
+		if notBefore.After(at) {
+			at = notBefore
+		}
+	}
+	window, err := parseWindow(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	limit := at.Add(scheduleHorizon)
+	for at.Before(limit) {
+		if s.permitted(window, at.Local()) {
+			return at, nil
+		}
+		at = at.Truncate(time.Minute).Add(time.Minute)
+	}
+	return time.Time{}, fmt.Errorf("window never opens outside blackout windows")
+}
+
+// permitted reports whether a message with window may be dispatched at t.
+func (s *messageScheduler) permitted(window *transferWindow, t time.Time) bool {
+	if window != nil && !window.contains(t) {
+		return false
+	}
+	for _, w := range s.blackouts {
+		if w.contains(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// hold stores data until it may be dispatched, reporting whether it did. Data
+// that may be dispatched now is not held. A nil scheduler holds nothing.
+func (s *messageScheduler) hold(data yggdrasil.Data, now time.Time) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	at, err := s.schedule(data, now)
+	if err != nil {
+		return false, err
+	}
+	if !at.After(now) {
+		return false, nil
+	}
+	if deadline, ok := messageDeadline(data); ok && at.After(deadline) {
+		return false, fmt.Errorf("message cannot be dispatched before its deadline %v", deadline.Format(time.RFC3339))
+	}
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return false, fmt.Errorf("cannot marshal message: %w", err)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return false, fmt.Errorf("cannot create directory: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seq := s.next
+	if err := ioutil.WriteFile(s.path(seq), content, 0600); err != nil {
+		return false, fmt.Errorf("cannot write file: %w", err)
+	}
+	s.next++
+	s.held = append(s.held, scheduledMessage{seq: seq, at: at, data: data})
+	s.sort()
+	s.arm(now)
+	scheduleMetrics.Add("held", 1)
+	log.Infof("holding message %v until %v", data.MessageID, at.Format(time.RFC3339))
+	return true, nil
+}
+
+// sort orders the held messages by the time they are due, then by the order
+// they were received. The caller must hold the lock.
+func (s *messageScheduler) sort() {
+	sort.SliceStable(s.held, func(i, j int) bool {
+		if !s.held[i].at.Equal(s.held[j].at) {
+			return s.held[i].at.Before(s.held[j].at)
+		}
+		return s.held[i].seq < s.held[j].seq
+	})
+}
+
+// arm sets the timer to release the first message due. The caller must hold
+// the lock.
+func (s *messageScheduler) arm(now time.Time) {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.held) == 0 {
+		return
+	}
+	s.timer = time.AfterFunc(s.held[0].at.Sub(now), func() { s.releaseDue(time.Now()) })
+}
+
+// releaseDue removes the messages due at now and hands them to release, in
+// the order they are due.
+func (s *messageScheduler) releaseDue(now time.Time) {
+	s.lock.Lock()
+	var due []yggdrasil.Data
+	for len(s.held) > 0 && !s.held[0].at.After(now) {
+		m := s.held[0]
+		s.held = s.held[1:]
+		if err := os.Remove(s.path(m.seq)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("cannot remove scheduled message %v: %v", m.data.MessageID, err)
+		}
+		due = append(due, m.data)
+	}
+	s.arm(now)
+	s.lock.Unlock()
+
+	for _, data := range due {
+		log.Infof("releasing scheduled message %v", data.MessageID)
+		scheduleMetrics.Add("released", 1)
+		s.release(data)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestMessageSchedulerSchedule(t *testing.T) {
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		description string
+		metadata    map[string]string
+		blackouts   []string
+		want        time.Time
+		wantError   bool
+	}{
+		{
+			description: "unconstrained",
+			want:        now,
+		},
+		{
+			description: "not before",
+			metadata:    map[string]string{yggdrasil.MetadataKeyNotBefore: now.Add(90 * time.Minute).Format(time.RFC3339)},
+			want:        now.Add(90 * time.Minute),
+		},
+		{
+			description: "not before in the past",
+			metadata:    map[string]string{yggdrasil.MetadataKeyNotBefore: now.Add(-time.Hour).Format(time.RFC3339)},
+			want:        now,
+		},
+		{
+			description: "window",
+			metadata:    map[string]string{yggdrasil.MetadataKeyWindow: "22:00-23:00"},
+			want:        time.Date(2021, 3, 1, 22, 0, 0, 0, time.Local),
+		},
+		{
+			description: "open window",
+			metadata:    map[string]string{yggdrasil.MetadataKeyWindow: "09:30-10:30"},
+			want:        now,
+		},
+		{
+			description: "window after not before",
+			metadata: map[string]string{
+				yggdrasil.MetadataKeyNotBefore: time.Date(2021, 3, 1, 23, 30, 0, 0, time.Local).Format(time.RFC3339),
+				yggdrasil.MetadataKeyWindow:    "22:00-23:00",
+			},
+			want: time.Date(2021, 3, 2, 22, 0, 0, 0, time.Local),
+		},
+		{
+			description: "blackout",
+			blackouts:   []string{"09:00-12:00"},
+			want:        time.Date(2021, 3, 1, 12, 0, 0, 0, time.Local),
+		},
+		{
+			description: "window within blackout",
+			metadata:    map[string]string{yggdrasil.MetadataKeyWindow: "10:00-11:00"},
+			blackouts:   []string{"09:00-12:00"},
+			wantError:   true,
+		},
+		{
+			description: "invalid window",
+			metadata:    map[string]string{yggdrasil.MetadataKeyWindow: "22:00"},
+			wantError:   true,
+		},
+		{
+			description: "invalid not before",
+			metadata:    map[string]string{yggdrasil.MetadataKeyNotBefore: "tomorrow"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			s, err := newMessageScheduler("", test.blackouts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.schedule(yggdrasil.Data{Metadata: test.metadata}, now)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMessageSchedulerHold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-schedule-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	data := yggdrasil.Data{
+		MessageID: "1",
+		Directive: "echo",
+		Metadata:  map[string]string{yggdrasil.MetadataKeyNotBefore: now.Add(time.Hour).Format(time.RFC3339)},
+		Content:   []byte(`"hello"`),
+	}
+
+	s, err := newMessageScheduler(dir, nil, func(yggdrasil.Data) { t.Error("released before due") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := s.hold(yggdrasil.Data{MessageID: "0"}, now)
+	if err != nil || held {
+		t.Errorf("held = %v, %v; want unconstrained message dispatched", held, err)
+	}
+	held, err = s.hold(data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !held {
+		t.Fatal("message not held")
+	}
+	expired := data
+	expired.MessageID = "2"
+	expired.Metadata = map[string]string{
+		yggdrasil.MetadataKeyNotBefore: now.Add(time.Hour).Format(time.RFC3339),
+		yggdrasil.MetadataKeyDeadline:  now.Add(time.Minute).Format(time.RFC3339),
+	}
+	if _, err := s.hold(expired, now); err == nil {
+		t.Error("message due past its deadline held")
+	}
+	s.timer.Stop()
+
+	// A new instance resumes holding the stored message.
+	var released []yggdrasil.Data
+	s, err = newMessageScheduler(dir, nil, func(data yggdrasil.Data) { released = append(released, data) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.load(now); err != nil {
+		t.Fatal(err)
+	}
+	defer s.timer.Stop()
+	if s.len() != 1 {
+		t.Fatalf("len = %v, want 1", s.len())
+	}
+
+	s.releaseDue(now.Add(30 * time.Minute))
+	if len(released) != 0 {
+		t.Errorf("released %v messages before due", len(released))
+	}
+	s.releaseDue(now.Add(time.Hour))
+	want := []yggdrasil.Data{data}
+	if !cmp.Equal(released, want) {
+		t.Errorf("%#v", cmp.Diff(released, want))
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("%v files left after release", len(infos))
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// schemaMetrics holds the number of messages "rejected" for not matching the
+// schema of their directive.
+var schemaMetrics = expvar.NewMap("schemas")
+
+// errInvalidContent is returned by dispatch for a message whose content does
+// not match the schema of its directive. It has already been reported, and
+// must not be retried.
+var errInvalidContent = errors.New("message content does not match schema")
+
+// schemasDir returns the directory holding the JSON schemas the content of
+// data messages is validated against, each in a file named after the
+// directive it applies to, such as "echo.json".
+func schemasDir() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "schemas.d")
+}
+
+// contentSchemas validates the content of data messages against the schemas
+// in a directory. Schemas are compiled when first needed and again when their
+// file changes, so they can be installed and updated while yggd runs.
+type contentSchemas struct {
+	dir     string
+	lock    sync.Mutex
+	schemas map[string]compiledSchema
+}
+
+// A compiledSchema is a schema compiled from the version of its file last
+// modified at modTime.
+type compiledSchema struct {
+	modTime time.Time
+	schema  *gojsonschema.Schema
+}
+
+func newContentSchemas(dir string) *contentSchemas {
+	return &contentSchemas{
+		dir:     dir,
+		schemas: make(map[string]compiledSchema),
+	}
+}
+
+// A schemaError lists the ways message content violates a schema.
+type schemaError struct {
+	violations []string
+}
+
+func (e *schemaError) Error() string {
+	return strings.Join(e.violations, "; ")
+}
+
+// schema returns the compiled schema of directive, or nil if it has none.
+func (s *contentSchemas) schema(directive string) (*gojsonschema.Schema, error) {
+	if directive == "" || strings.ContainsAny(directive, `/\`) {
+		return nil, nil
+	}
+	path := filepath.Join(s.dir, directive+".json")
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat schema: %w", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if c, prs := s.schemas[directive]; prs && c.modTime.Equal(info.ModTime()) {
+		return c.schema, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read schema: %w", err)
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile schema %v: %w", path, err)
+	}
+	s.schemas[directive] = compiledSchema{modTime: info.ModTime(), schema: schema}
+	log.Debugf("compiled schema %v", path)
+	return schema, nil
+}
+
+// validate validates content against the schema of directive, if it has one.
+// It returns a *schemaError if content does not match the schema.
+func (s *contentSchemas) validate(directive string, content []byte) error {
+	if s == nil {
+		return nil
+	}
+	schema, err := s.schema(directive)
+	if err != nil || schema == nil {
+		return err
+	}
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(content))
+	if err != nil {
+		return &schemaError{violations: []string{err.Error()}}
+	}
+	if result.Valid() {
+		return nil
+	}
+	e := &schemaError{}
+	for _, violation := range result.Errors() {
+		e.violations = append(e.violations, violation.String())
+	}
+	return e
+}
+
+// validateContent validates the content of data against the schema of its
+// directive. Content that does not match is reported to the server with a
+// "content-invalid" event, and errInvalidContent is returned. A schema that
+// cannot be loaded is logged and the content is let through, so that a bad
+// schema file does not stop a directive.
+func (d *dispatcher) validateContent(data yggdrasil.Data) error {
+	err := d.schemas.validate(data.Directive, data.Content)
+	var violations *schemaError
+	if !errors.As(err, &violations) {
+		if err != nil {
+			log.Errorf("cannot validate message %v: %v", data.MessageID, err)
+		}
+		return nil
+	}
+
+	schemaMetrics.Add("rejected", 1)
+	log.Warnf("rejecting message %v for directive %v: %v", data.MessageID, data.Directive, violations)
+	lasterror.Set(lasterror.Dispatcher, fmt.Errorf("cannot dispatch message %v: %w", data.MessageID, errInvalidContent))
+	d.deliveryDone(data, errInvalidContent)
+	d.events <- yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: data.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameContentInvalid),
+		Details: map[string]string{
+			"directive":  data.Directive,
+			"schema":     data.Directive + ".json",
+			"violations": strconv.Itoa(len(violations.violations)),
+			"error":      violations.Error(),
+		},
+	}
+	return errInvalidContent
+}
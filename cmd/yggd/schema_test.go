@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestContentSchemasValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schema := `{"type": "object", "properties": {"count": {"type": "integer"}}, "required": ["count"]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "echo.json"), []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"type": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		directive   string
+		content     string
+		wantInvalid bool
+		wantError   bool
+	}{
+		{
+			description: "valid",
+			directive:   "echo",
+			content:     `{"count": 1}`,
+		},
+		{
+			description: "missing property",
+			directive:   "echo",
+			content:     `{}`,
+			wantInvalid: true,
+		},
+		{
+			description: "wrong type",
+			directive:   "echo",
+			content:     `{"count": "one"}`,
+			wantInvalid: true,
+		},
+		{
+			description: "not JSON",
+			directive:   "echo",
+			content:     `count`,
+			wantInvalid: true,
+		},
+		{
+			description: "no schema",
+			directive:   "other",
+			content:     `"anything"`,
+		},
+		{
+			description: "invalid schema",
+			directive:   "broken",
+			content:     `{}`,
+			wantError:   true,
+		},
+		{
+			description: "directive outside the directory",
+			directive:   "../echo",
+			content:     `{}`,
+		},
+	}
+
+	s := newContentSchemas(dir)
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := s.validate(test.directive, []byte(test.content))
+			var violations *schemaError
+			invalid := errors.As(err, &violations)
+			if invalid != test.wantInvalid {
+				t.Errorf("invalid: %v != %v (%v)", invalid, test.wantInvalid, err)
+			}
+			if gotError := err != nil && !invalid; gotError != test.wantError {
+				t.Errorf("error: %v != %v (%v)", gotError, test.wantError, err)
+			}
+		})
+	}
+}
+
+func TestValidateContentRecompiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "echo.json")
+	if err := ioutil.WriteFile(path, []byte(`{"type": "string"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := dispatcher{
+		events:  make(chan yggdrasil.Event, 1),
+		schemas: newContentSchemas(dir),
+	}
+	data := yggdrasil.Data{MessageID: "1", Directive: "echo", Content: []byte(`1`)}
+	if err := d.validateContent(data); err != errInvalidContent {
+		t.Fatalf("%v != %v", err, errInvalidContent)
+	}
+	event := <-d.events
+	if event.Content != string(yggdrasil.EventNameContentInvalid) || event.ResponseTo != "1" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"type": "integer"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.validateContent(data); err != nil {
+		t.Errorf("content rejected by replaced schema: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/redhatinsights/yggdrasil/internal/secrets"
+	"github.com/urfave/cli/v2"
+)
+
+// secretStore holds the secrets that credential-bearing options may refer to
+// as "secret:NAME". It is replaced at startup by a store using the backend set
+// by the "secrets-backend" flag.
+var secretStore = secrets.NewStore(secrets.DefaultPath(), &secrets.KeyFile{Path: secrets.DefaultKeyPath()})
+
+// openSecretStore sets secretStore to a store using the backend named by the
+// "secrets-backend" flag.
+func openSecretStore(c *cli.Context) error {
+	backend, err := secrets.NewBackend(c.String("secrets-backend"))
+	if err != nil {
+		return err
+	}
+	secretStore = secrets.NewStore(secrets.DefaultPath(), backend)
+	return nil
+}
+
+// resolveSecret returns the value of the flag name, replaced by the secret it
+// refers to, if any.
+func resolveSecret(c *cli.Context, name string) (string, error) {
+	value, err := secretStore.Resolve(c.String(name))
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve %v: %w", name, err)
+	}
+	return value, nil
+}
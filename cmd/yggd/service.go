@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+)
+
+// logDumpSignals are the signals on which the log ring buffer is dumped to a
+// file.
+var logDumpSignals = []os.Signal{syscall.SIGUSR1}
+
+// runApp runs app with the arguments of the process.
+func runApp(app *cli.App) error {
+	return app.Run(os.Args)
+}
+
+// notifyQuit relays the signals asking yggd to quit, TERM and INT, to quit.
+func notifyQuit(quit chan<- os.Signal) {
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+}
+
+// notifyReload relays the signal asking yggd to reload its configuration,
+// HUP, to reload.
+func notifyReload(reload chan<- os.Signal) {
+	signal.Notify(reload, syscall.SIGHUP)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/windows/svc"
+)
+
+// logDumpSignals is empty: Windows has no signal to dump the log ring buffer
+// with, which is dumped with "yggctl dump-logs" instead.
+var logDumpSignals []os.Signal
+
+// serviceSignals holds the channels the requests of the service control
+// manager are relayed to, as the signals they stand for.
+var serviceSignals struct {
+	sync.Mutex
+	quit     chan<- os.Signal
+	reload   chan<- os.Signal
+	stopping bool
+}
+
+// runApp runs app with the arguments of the process, as a Windows service if
+// the process was started by the service control manager.
+func runApp(app *cli.App) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("cannot detect service: %w", err)
+	}
+	if !isService {
+		return app.Run(os.Args)
+	}
+	return svc.Run(app.Name, &serviceHandler{app: app})
+}
+
+// notifyQuit relays console interrupts and the stop and shutdown requests of
+// the service control manager to quit.
+func notifyQuit(quit chan<- os.Signal) {
+	signal.Notify(quit, os.Interrupt)
+
+	serviceSignals.Lock()
+	defer serviceSignals.Unlock()
+	serviceSignals.quit = quit
+	if serviceSignals.stopping {
+		relaySignal(quit, syscall.SIGTERM)
+	}
+}
+
+// notifyReload relays the parameter change requests of the service control
+// manager ("sc control yggd paramchange") to reload.
+func notifyReload(reload chan<- os.Signal) {
+	serviceSignals.Lock()
+	defer serviceSignals.Unlock()
+	serviceSignals.reload = reload
+}
+
+// relaySignal sends sig to c, if set, unless a signal is already pending.
+func relaySignal(c chan<- os.Signal, sig os.Signal) {
+	if c == nil {
+		return
+	}
+	select {
+	case c <- sig:
+	default:
+	}
+}
+
+// serviceHandler runs yggd as a Windows service, translating the requests of
+// the service control manager into the signals yggd handles on other
+// systems.
+type serviceHandler struct {
+	app *cli.App
+}
+
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+
+	s <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.app.Run(os.Args)
+	}()
+	s <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Errorf("%v", err)
+				return false, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				serviceSignals.Lock()
+				serviceSignals.stopping = true
+				relaySignal(serviceSignals.quit, syscall.SIGTERM)
+				serviceSignals.Unlock()
+			case svc.ParamChange:
+				serviceSignals.Lock()
+				relaySignal(serviceSignals.reload, syscall.SIGHUP)
+				serviceSignals.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// Modes of the "disconnect" command, set by its "mode" argument.
+const (
+	// disconnectSoft disconnects the transport only; workers keep running
+	// and connected.
+	disconnectSoft = "soft"
+
+	// disconnectDrain waits for the messages in flight to be handled before
+	// disconnecting workers and the transport.
+	disconnectDrain = "drain"
+
+	// disconnectHalt disconnects workers and the transport, and stops the
+	// worker processes.
+	disconnectHalt = "halt"
+)
+
+// defaultDrainTimeout and maxDrainTimeout bound the wait of a "drain"
+// disconnect for the messages in flight.
+const (
+	defaultDrainTimeout = time.Minute
+	maxDrainTimeout     = time.Hour
+)
+
+// drainPollInterval is the interval at which a "drain" disconnect checks
+// whether the messages in flight are handled.
+const drainPollInterval = time.Second
+
+// parseDisconnectArguments parses the "mode" and "timeout" arguments of a
+// disconnect command. An empty mode disconnects workers and the transport.
+// The timeout, a duration string, only applies to the "drain" mode.
+func parseDisconnectArguments(arguments map[string]string) (string, time.Duration, error) {
+	mode := arguments["mode"]
+	switch mode {
+	case "", disconnectSoft, disconnectHalt:
+		return mode, 0, nil
+	case disconnectDrain:
+	default:
+		return "", 0, fmt.Errorf("unknown disconnect mode %q", mode)
+	}
+
+	value, prs := arguments["timeout"]
+	if !prs {
+		return mode, defaultDrainTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot parse timeout: %v", value)
+	}
+	if timeout < 0 || timeout > maxDrainTimeout {
+		return "", 0, fmt.Errorf("timeout %v is not between 0 and %v", timeout, maxDrainTimeout)
+	}
+	return mode, timeout, nil
+}
+
+// disconnect handles the disconnect command cmd received on t. The command is
+// acknowledged by a "disconnect" event published just before t disconnects.
+func (d *dispatcher) disconnect(t transport.Transport, cmd yggdrasil.Command) {
+	mode, timeout, err := parseDisconnectArguments(cmd.Content.Arguments)
+	if err != nil {
+		log.Errorf("ignoring disconnect command: %v", err)
+		return
+	}
+
+	details := map[string]string{}
+	if mode != "" {
+		details["mode"] = mode
+	}
+	switch mode {
+	case disconnectSoft:
+		log.Info("disconnecting transport...")
+	case disconnectDrain:
+		log.Infof("draining messages in flight for up to %v...", timeout)
+		pending := d.drain(timeout)
+		details["pending"] = strconv.Itoa(pending)
+		if pending > 0 {
+			log.Warnf("disconnecting with %v messages in flight", pending)
+		}
+		d.disconnectWorkers()
+	case disconnectHalt:
+		log.Info("disconnecting and stopping workers...")
+		d.disconnectWorkers()
+		if err := killWorkers(nil); err != nil {
+			log.Errorf("cannot stop workers: %v", err)
+			details["error"] = err.Error()
+		}
+	default:
+		log.Info("disconnecting...")
+		d.disconnectWorkers()
+	}
+
+	event := yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: cmd.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameDisconnect),
+		Details:    details,
+
+		OperationGroup: cmd.OperationGroup,
+	}
+	if err := t.SendControl(event); err != nil {
+		log.Errorf("cannot publish event %v: %v", event.MessageID, err)
+	}
+	t.Disconnect(500)
+}
+
+// drain waits up to timeout for the messages queued for dispatch and those
+// dispatched to workers to be handled, and returns the number of messages
+// still pending.
+func (d *dispatcher) drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := d.sendDepth() + d.inflight.len()
+		if pending == 0 || !time.Now().Before(deadline) {
+			return pending
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// disconnectWorkers asks every registered worker to disconnect.
+func (d *dispatcher) disconnectWorkers() {
+	d.RLock()
+	workers := make([]worker, 0, len(d.workers))
+	for _, w := range d.workers {
+		workers = append(workers, w)
+	}
+	d.RUnlock()
+
+	for _, w := range workers {
+		disconnectWorker(w)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestParseDisconnectArguments(t *testing.T) {
+	tests := []struct {
+		description string
+		input       map[string]string
+		wantMode    string
+		wantTimeout time.Duration
+		wantError   bool
+	}{
+		{
+			description: "no mode",
+			input:       map[string]string{},
+		},
+		{
+			description: "soft",
+			input:       map[string]string{"mode": "soft"},
+			wantMode:    disconnectSoft,
+		},
+		{
+			description: "drain",
+			input:       map[string]string{"mode": "drain"},
+			wantMode:    disconnectDrain,
+			wantTimeout: defaultDrainTimeout,
+		},
+		{
+			description: "drain with timeout",
+			input:       map[string]string{"mode": "drain", "timeout": "5m"},
+			wantMode:    disconnectDrain,
+			wantTimeout: 5 * time.Minute,
+		},
+		{
+			description: "drain with invalid timeout",
+			input:       map[string]string{"mode": "drain", "timeout": "soon"},
+			wantError:   true,
+		},
+		{
+			description: "drain with excessive timeout",
+			input:       map[string]string{"mode": "drain", "timeout": "48h"},
+			wantError:   true,
+		},
+		{
+			description: "halt",
+			input:       map[string]string{"mode": "halt"},
+			wantMode:    disconnectHalt,
+		},
+		{
+			description: "unknown mode",
+			input:       map[string]string{"mode": "reboot"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			mode, timeout, err := parseDisconnectArguments(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got mode %q", mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode != test.wantMode || timeout != test.wantTimeout {
+				t.Errorf("%q, %v != %q, %v", mode, timeout, test.wantMode, test.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	d := dispatcher{
+		sendQ:    make(chan yggdrasil.Data, 1),
+		inflight: newMessageTable(10),
+	}
+	if pending := d.drain(time.Minute); pending != 0 {
+		t.Fatalf("%v messages pending, want none", pending)
+	}
+
+	d.inflight.set("a", "echo")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.inflight.remove("a")
+	}()
+	if pending := d.drain(time.Minute); pending != 0 {
+		t.Fatalf("%v messages pending, want none", pending)
+	}
+
+	d.inflight.set("b", "echo")
+	if pending := d.drain(0); pending != 1 {
+		t.Fatalf("%v messages pending, want 1", pending)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/signing"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// signatureMetrics holds the number of "control" and "data" messages rejected
+// for not being signed with a trusted key.
+var signatureMetrics = expvar.NewMap("signatures")
+
+// messageKeysDir returns the directory holding the public keys trusted to
+// sign server messages, each a PEM encoded Ed25519 public key in a ".pem"
+// file.
+func messageKeysDir() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "message-keys.d")
+}
+
+// openSigned returns the message signed in payload, received on channel
+// ("control" or "data"), if it was signed with one of the keys of the
+// dispatcher. Otherwise, the message is reported and false is returned.
+func (d *dispatcher) openSigned(channel string, payload []byte) ([]byte, bool) {
+	msg, err := signing.Open(payload, d.messageKeys)
+	if err == nil {
+		return msg, true
+	}
+
+	// The message ID of a rejected message cannot be trusted, but helps the
+	// server find the message the broker was given.
+	var header struct {
+		MessageID string `json:"message_id"`
+	}
+	json.Unmarshal(payload, &header)
+
+	signatureMetrics.Add(channel, 1)
+	err = fmt.Errorf("rejecting %v message %v: %w", channel, header.MessageID, err)
+	log.Warn(err)
+	lasterror.Set(lasterror.Dispatcher, err)
+	d.events <- yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: header.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameSignatureInvalid),
+		Details: map[string]string{
+			"channel": channel,
+			"error":   err.Error(),
+		},
+	}
+	return nil, false
+}
+
+// verifyDataMessages returns a DataHandler that hands handler the data
+// messages signed with a trusted key, if the dispatcher has any, and drops the
+// others.
+func verifyDataMessages(d *dispatcher, handler transport.DataHandler) transport.DataHandler {
+	if len(d.messageKeys) == 0 {
+		return handler
+	}
+	return func(payload []byte) {
+		if msg, ok := d.openSigned("data", payload); ok {
+			handler(msg)
+		}
+	}
+}
+
+// verifyControlMessages returns a CommandHandler that hands handler the
+// control messages signed with a trusted key, if the dispatcher has any, and
+// drops the others.
+func verifyControlMessages(d *dispatcher, handler transport.CommandHandler) transport.CommandHandler {
+	if len(d.messageKeys) == 0 {
+		return handler
+	}
+	return func(payload []byte, t transport.Transport) {
+		if msg, ok := d.openSigned("control", payload); ok {
+			handler(msg, t)
+		}
+	}
+}
+
+// readMessageKeys reads the keys trusted to sign server messages in dir,
+// failing if there are none.
+func readMessageKeys(dir string) ([]ed25519.PublicKey, error) {
+	keys, err := readPublicKeys(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read message keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("cannot read message keys: no key in %v", dir)
+	}
+	return keys, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/signing"
+)
+
+func TestVerifyDataMessages(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(`{"type":"data","message_id":"1","directive":"echo"}`)
+	sign := func(key ed25519.PrivateKey) []byte {
+		data, err := json.Marshal(signing.Sign(msg, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		description string
+		keys        []ed25519.PublicKey
+		input       []byte
+		want        []byte
+		wantEvent   bool
+	}{
+		{
+			description: "verification disabled",
+			input:       msg,
+			want:        msg,
+		},
+		{
+			description: "trusted key",
+			keys:        []ed25519.PublicKey{public},
+			input:       sign(private),
+			want:        msg,
+		},
+		{
+			description: "untrusted key",
+			keys:        []ed25519.PublicKey{public},
+			input:       sign(otherPrivate),
+			wantEvent:   true,
+		},
+		{
+			description: "unsigned",
+			keys:        []ed25519.PublicKey{public},
+			input:       msg,
+			wantEvent:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil, 1, 0, 10)
+			d.messageKeys = test.keys
+			events := make(chan yggdrasil.Event, 1)
+			go func() {
+				for e := range d.events {
+					events <- e
+				}
+			}()
+
+			var got []byte
+			verifyDataMessages(d, func(msg []byte) { got = msg })(test.input)
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+			if test.wantEvent {
+				e := <-events
+				if e.Content != string(yggdrasil.EventNameSignatureInvalid) {
+					t.Errorf("%v != %v", e.Content, yggdrasil.EventNameSignatureInvalid)
+				}
+			}
+		})
+	}
+}
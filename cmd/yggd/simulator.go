@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	"github.com/redhatinsights/yggdrasil/internal/transport/memory"
+)
+
+// simulator is the in-memory transport of the simulator mode, started with
+// --transport none. It is nil otherwise.
+var simulator *memory.Transport
+
+// errNotSimulating is returned when messages are injected while yggd does not
+// run in simulator mode.
+var errNotSimulating = fmt.Errorf("not running with --transport none")
+
+// newSimulatorTransport creates the in-memory transport of the simulator
+// mode, logging each message published, and sets simulator.
+func newSimulatorTransport(controlHandler transport.CommandHandler, dataHandler transport.DataHandler, status transport.StatusFunc) *memory.Transport {
+	t := memory.NewTransport(controlHandler, dataHandler, status)
+	t.Published = func(channel string, msg []byte) {
+		log.Infof("published %v message: %s", channel, msg)
+	}
+	simulator = t
+	return t
+}
+
+// injectMessages injects the messages read from r with the simulator
+// transport, returning the number of messages injected.
+func injectMessages(r io.Reader) (int, error) {
+	if simulator == nil {
+		return 0, errNotSimulating
+	}
+	return simulator.InjectFrom(r)
+}
+
+// injectFile injects the messages read from the file at path with the
+// simulator transport after delay, giving the workers started with yggd time
+// to register.
+func injectFile(path string, delay time.Duration) {
+	time.Sleep(delay)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("cannot inject messages: %v", err)
+		return
+	}
+	defer f.Close()
+	n, err := injectMessages(f)
+	if err != nil {
+		log.Errorf("cannot inject messages from %v: %v", path, err)
+	}
+	log.Infof("injected %v messages from %v", n, path)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// spoolFlushInterval is the interval at which the spool is flushed once the
+// transport is connected again.
+const spoolFlushInterval = 10 * time.Second
+
+// spoolDefaultClass is the class of messages without a MetadataKeyClass
+// metadata key, or with a class that is not configured.
+const spoolDefaultClass = "default"
+
+// spoolMetrics holds the number of "messages" and "bytes" in the spool, and
+// the number of messages "spooled", "flushed", "evicted" and "rejected".
+var spoolMetrics = expvar.NewMap("spool")
+
+// SpoolPolicy describes which messages are evicted when a message of a class
+// does not fit in the spool quota.
+type SpoolPolicy string
+
+const (
+	// SpoolPolicyDropOldest evicts the oldest messages of the same class.
+	SpoolPolicyDropOldest SpoolPolicy = "drop-oldest"
+
+	// SpoolPolicyDropLowestPriority evicts messages of classes with a lower
+	// priority, lowest priority and oldest first.
+	SpoolPolicyDropLowestPriority SpoolPolicy = "drop-lowest-priority"
+
+	// SpoolPolicyRejectNew keeps the spooled messages and drops the new one.
+	SpoolPolicyRejectNew SpoolPolicy = "reject-new"
+)
+
+// A spoolClass is the eviction policy and priority of a class of messages.
+type spoolClass struct {
+	policy   SpoolPolicy
+	priority int
+}
+
+// parseSpoolClasses parses message classes in the form
+// "CLASS=POLICY[:PRIORITY]". Classes have a priority of 0 by default; the
+// "default" class, if not set, has the drop-oldest policy.
+func parseSpoolClasses(values []string) (map[string]spoolClass, error) {
+	classes := map[string]spoolClass{
+		spoolDefaultClass: {policy: SpoolPolicyDropOldest},
+	}
+	for _, value := range values {
+		fields := strings.SplitN(value, "=", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid message class %q: expected CLASS=POLICY[:PRIORITY]", value)
+		}
+		spec := strings.SplitN(fields[1], ":", 2)
+		class := spoolClass{policy: SpoolPolicy(spec[0])}
+		switch class.policy {
+		case SpoolPolicyDropOldest, SpoolPolicyDropLowestPriority, SpoolPolicyRejectNew:
+		default:
+			return nil, fmt.Errorf("invalid message class %q: unknown policy %v", value, spec[0])
+		}
+		if len(spec) == 2 {
+			priority, err := strconv.Atoi(spec[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid message class %q: priority must be an integer", value)
+			}
+			class.priority = priority
+		}
+		classes[fields[0]] = class
+	}
+	return classes, nil
+}
+
+// A spoolEntry is a message stored in the spool.
+type spoolEntry struct {
+	seq   uint64
+	class string
+	size  int64
+}
+
+// A spool stores the data messages published while the transport is
+// disconnected on disk, one file per message, until they can be published.
+// The total size of the files is limited to a quota; when a message does not
+// fit, messages are evicted according to the policy of its class. Evictions
+// are counted per class until they are reported.
+type spool struct {
+	lock      sync.Mutex
+	dir       string
+	quota     int64
+	classes   map[string]spoolClass
+	entries   []spoolEntry
+	bytes     int64
+	next      uint64
+	evictions map[string]int
+}
+
+// spoolDir returns the directory in which the spool is stored.
+func spoolDir() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "spool")
+}
+
+// openSpool opens the spool stored in dir, creating it if needed, limited to
+// quota bytes.
+func openSpool(dir string, quota int64, classes map[string]spoolClass) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory: %w", err)
+	}
+
+	s := &spool{
+		dir:       dir,
+		quota:     quota,
+		classes:   classes,
+		evictions: make(map[string]int),
+	}
+	for _, info := range infos {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		data, err := s.read(seq)
+		if err != nil {
+			log.Warnf("discarding spooled message %v: %v", info.Name(), err)
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		s.entries = append(s.entries, spoolEntry{seq: seq, class: s.classOf(data), size: info.Size()})
+		s.bytes += info.Size()
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+
+	return s, nil
+}
+
+// classOf returns the configured class of data.
+func (s *spool) classOf(data yggdrasil.Data) string {
+	class := data.Metadata[yggdrasil.MetadataKeyClass]
+	if _, prs := s.classes[class]; !prs {
+		return spoolDefaultClass
+	}
+	return class
+}
+
+// path returns the path of the file of the message with sequence number seq.
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// read reads the message with sequence number seq.
+func (s *spool) read(seq uint64) (yggdrasil.Data, error) {
+	var data yggdrasil.Data
+	content, err := ioutil.ReadFile(s.path(seq))
+	if err != nil {
+		return data, fmt.Errorf("cannot read file: %w", err)
+	}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return data, fmt.Errorf("cannot unmarshal message: %w", err)
+	}
+	return data, nil
+}
+
+// len returns the number of spooled messages.
+func (s *spool) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.entries)
+}
+
+// size returns the total size of the spooled messages.
+func (s *spool) size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bytes
+}
+
+// put stores data in the spool, evicting messages if it does not fit in the
+// quota. It returns an error if data was rejected.
+func (s *spool) put(data yggdrasil.Data) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message: %w", err)
+	}
+	size := int64(len(content))
+	name := s.classOf(data)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if need := s.bytes + size - s.quota; need > 0 {
+		victims := s.victims(name, need)
+		if victims == nil {
+			s.evictions[name]++
+			spoolMetrics.Add("rejected", 1)
+			return fmt.Errorf("spool quota of %v bytes exceeded by message of class %v", s.quota, name)
+		}
+		for _, e := range victims {
+			log.Warnf("evicting spooled message of class %v to make room for message %v", e.class, data.MessageID)
+			s.remove(e.seq)
+			s.evictions[e.class]++
+			spoolMetrics.Add("evicted", 1)
+		}
+	}
+
+	seq := s.next
+	if err := ioutil.WriteFile(s.path(seq), content, 0600); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	s.next++
+	s.entries = append(s.entries, spoolEntry{seq: seq, class: name, size: size})
+	s.bytes += size
+	spoolMetrics.Add("spooled", 1)
+	return nil
+}
+
+// victims returns the entries to evict, according to the policy of class, to
+// free need bytes, or nil if the policy does not allow freeing enough. The
+// caller must hold the lock.
+func (s *spool) victims(class string, need int64) []spoolEntry {
+	c := s.classes[class]
+
+	var candidates []spoolEntry
+	switch c.policy {
+	case SpoolPolicyDropOldest:
+		for _, e := range s.entries {
+			if e.class == class {
+				candidates = append(candidates, e)
+			}
+		}
+	case SpoolPolicyDropLowestPriority:
+		for _, e := range s.entries {
+			if s.classes[e.class].priority < c.priority {
+				candidates = append(candidates, e)
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return s.classes[candidates[i].class].priority < s.classes[candidates[j].class].priority
+		})
+	}
+
+	var freed int64
+	for i, e := range candidates {
+		freed += e.size
+		if freed >= need {
+			return candidates[:i+1]
+		}
+	}
+	return nil
+}
+
+// remove deletes the message with sequence number seq. The caller must hold
+// the lock.
+func (s *spool) remove(seq uint64) {
+	for i, e := range s.entries {
+		if e.seq == seq {
+			if err := os.Remove(s.path(seq)); err != nil && !os.IsNotExist(err) {
+				log.Errorf("cannot remove spooled message: %v", err)
+			}
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			s.bytes -= e.size
+			return
+		}
+	}
+}
+
+// flush publishes the spooled messages with send, oldest first, removing
+// each once it is published. It stops at the first message that cannot be
+// published and returns the error. Messages that cannot be read are
+// discarded.
+func (s *spool) flush(send func(yggdrasil.Data) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.entries) > 0 {
+		seq := s.entries[0].seq
+		data, err := s.read(seq)
+		if err != nil {
+			log.Errorf("discarding spooled message: %v", err)
+			s.remove(seq)
+			continue
+		}
+		if err := send(data); err != nil {
+			return err
+		}
+		s.remove(seq)
+		spoolMetrics.Add("flushed", 1)
+		log.Debugf("published spooled message %v", data.MessageID)
+	}
+	return nil
+}
+
+// takeEvictions returns the number of messages evicted or rejected per class
+// since the last call.
+func (s *spool) takeEvictions() map[string]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	evictions := s.evictions
+	s.evictions = make(map[string]int)
+	return evictions
+}
+
+// isConnected reports whether t is connected. Transports that cannot report
+// their connection state are assumed to be connected.
+func isConnected(t transport.Transport) bool {
+	c, ok := t.(transport.Connector)
+	return !ok || c.Connected()
+}
+
+// spoolData returns a channel receiving the data messages sent on c that can
+// be published right away. Messages are stored in the spool instead while t
+// is disconnected, or while earlier messages remain spooled, so that they are
+// published in order.
+func (d *dispatcher) spoolData(t transport.Transport, c <-chan yggdrasil.Data) <-chan yggdrasil.Data {
+	out := make(chan yggdrasil.Data)
+	go func() {
+		defer close(out)
+		for data := range c {
+			if isConnected(t) && d.spool.len() == 0 {
+				out <- data
+				continue
+			}
+			if err := d.spool.put(data); err != nil {
+				log.Errorf("dropping message %v: %v", data.MessageID, err)
+				continue
+			}
+			log.Debugf("spooled message %v while disconnected", data.MessageID)
+		}
+	}()
+	return out
+}
+
+// spoolUnpublished returns a function, called after each message is
+// published, that stores in the spool the messages that could not be
+// published because t disconnected, before calling published.
+func (d *dispatcher) spoolUnpublished(t transport.Transport, published func(yggdrasil.Data, error)) func(yggdrasil.Data, error) {
+	return func(data yggdrasil.Data, err error) {
+		if err != nil && !isConnected(t) {
+			if err := d.spool.put(data); err != nil {
+				log.Errorf("dropping message %v: %v", data.MessageID, err)
+			} else {
+				log.Debugf("spooled message %v after failing to publish it", data.MessageID)
+			}
+		}
+		published(data, err)
+	}
+}
+
+// flushSpool periodically publishes the spooled messages with t while it is
+// connected. Once the spool is empty, the messages evicted while the transport
+// was disconnected are reported in a "spool-evicted" event.
+func (d *dispatcher) flushSpool(t transport.Transport) {
+	for range time.Tick(spoolFlushInterval) {
+		if !isConnected(t) {
+			continue
+		}
+		if d.spool.len() > 0 {
+			log.Infof("publishing %v spooled messages", d.spool.len())
+			if err := d.spool.flush(t.SendData); err != nil {
+				log.Errorf("cannot publish spooled message: %v", err)
+				continue
+			}
+		}
+		if evictions := d.spool.takeEvictions(); len(evictions) > 0 {
+			d.events <- spoolEvictedEvent(evictions)
+		}
+	}
+}
+
+// spoolEvictedEvent returns a "spool-evicted" event reporting the number of
+// messages of each class lost to the spool quota.
+func spoolEvictedEvent(evictions map[string]int) yggdrasil.Event {
+	details := make(map[string]string, len(evictions))
+	for class, n := range evictions {
+		details[class] = strconv.Itoa(n)
+	}
+	return yggdrasil.Event{
+		Type:      yggdrasil.MessageTypeEvent,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+		Content:   string(yggdrasil.EventNameSpoolEvicted),
+		Details:   details,
+	}
+}
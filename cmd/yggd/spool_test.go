@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestSpoolPut(t *testing.T) {
+	message := func(id, class string) yggdrasil.Data {
+		return yggdrasil.Data{
+			Type:      yggdrasil.MessageTypeData,
+			MessageID: id,
+			Metadata:  map[string]string{yggdrasil.MetadataKeyClass: class},
+			Content:   json.RawMessage(`"0123456789"`),
+		}
+	}
+	classes := map[string]spoolClass{
+		spoolDefaultClass: {policy: SpoolPolicyDropOldest},
+		"telemetry":       {policy: SpoolPolicyDropOldest, priority: 0},
+		"results":         {policy: SpoolPolicyDropLowestPriority, priority: 10},
+		"audit":           {policy: SpoolPolicyRejectNew, priority: 10},
+	}
+
+	tests := []struct {
+		description   string
+		spooled       []yggdrasil.Data
+		input         yggdrasil.Data
+		want          []string
+		wantEvictions map[string]int
+		wantError     bool
+	}{
+		{
+			description: "fits",
+			spooled:     []yggdrasil.Data{message("1", "telemetry")},
+			input:       message("2", "telemetry"),
+			want:        []string{"1", "2"},
+		},
+		{
+			description:   "drop oldest of same class",
+			spooled:       []yggdrasil.Data{message("1", "results"), message("2", "telemetry"), message("3", "telemetry")},
+			input:         message("4", "telemetry"),
+			want:          []string{"1", "3", "4"},
+			wantEvictions: map[string]int{"telemetry": 1},
+		},
+		{
+			description:   "drop lowest priority",
+			spooled:       []yggdrasil.Data{message("1", "results"), message("2", "telemetry"), message("3", "results")},
+			input:         message("4", "results"),
+			want:          []string{"1", "3", "4"},
+			wantEvictions: map[string]int{"telemetry": 1},
+		},
+		{
+			description:   "no lower priority",
+			spooled:       []yggdrasil.Data{message("1", "results"), message("2", "audit"), message("3", "results")},
+			input:         message("4", "results"),
+			want:          []string{"1", "2", "3"},
+			wantEvictions: map[string]int{"results": 1},
+			wantError:     true,
+		},
+		{
+			description:   "reject new",
+			spooled:       []yggdrasil.Data{message("1", "telemetry"), message("2", "telemetry"), message("3", "telemetry")},
+			input:         message("4", "audit"),
+			want:          []string{"1", "2", "3"},
+			wantEvictions: map[string]int{"audit": 1},
+			wantError:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-spool-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// The quota fits three messages of the class with the longest
+			// name.
+			size, err := json.Marshal(message("0", "telemetry"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := openSpool(dir, int64(3*len(size)), classes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range test.spooled {
+				if err := s.put(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = s.put(test.input)
+			if test.wantError && err == nil {
+				t.Errorf("expected error")
+			} else if !test.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if evictions := s.takeEvictions(); len(evictions) > 0 || test.wantEvictions != nil {
+				if !cmp.Equal(evictions, test.wantEvictions) {
+					t.Errorf("%#v != %#v", evictions, test.wantEvictions)
+				}
+			}
+
+			// Reopen the spool to check the messages persisted on disk.
+			s, err = openSpool(dir, s.quota, classes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			if err := s.flush(func(data yggdrasil.Data) error {
+				got = append(got, data.MessageID)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/nats-io/nats.go"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// Exit codes of yggd, telling provisioning automation why it failed to start
+// without parsing its logs.
+const (
+	// exitFailure is the exit code of any other failure.
+	exitFailure = 1
+
+	// exitCertificate is the exit code when the client certificate or key
+	// cannot be read or loaded.
+	exitCertificate = 10
+
+	// exitDNS is the exit code when the host name of the server cannot be
+	// resolved.
+	exitDNS = 11
+
+	// exitUnreachable is the exit code when the server refuses connections
+	// or cannot be reached.
+	exitUnreachable = 12
+
+	// exitAuthRejected is the exit code when the TLS handshake fails, or the
+	// server rejects the credentials of the client.
+	exitAuthRejected = 13
+
+	// exitStartupTimeout is the exit code when the transport is not connected
+	// by the startup deadline, for any other reason.
+	exitStartupTimeout = 14
+)
+
+// startupRetryInterval is the delay before the first retry to start the
+// transport before the startup deadline; it doubles with every retry, up to
+// maxStartupRetryInterval.
+var startupRetryInterval = time.Second
+
+// maxStartupRetryInterval is the longest delay between two attempts to start
+// the transport before the startup deadline.
+const maxStartupRetryInterval = 30 * time.Second
+
+// errStartupTimeout is wrapped by the error of a transport not connected by
+// the startup deadline.
+var errStartupTimeout = errors.New("startup deadline exceeded")
+
+// startTransport starts t. If deadline is not zero, failed attempts are
+// retried, waiting longer after each, until deadline, after which an error
+// wrapping errStartupTimeout and describing the last failure is returned.
+func startTransport(t transport.Transport, deadline time.Time) error {
+	if deadline.IsZero() {
+		return t.Start()
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	delay := startupRetryInterval
+	var lastErr error
+	for {
+		result := make(chan error, 1)
+		go func() { result <- t.Start() }()
+		select {
+		case err := <-result:
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		case <-timer.C:
+			return startupTimeout(lastErr)
+		}
+
+		log.Warnf("cannot start transport: %v; trying again in %v", lastErr, delay)
+		select {
+		case <-time.After(delay):
+		case <-timer.C:
+			return startupTimeout(lastErr)
+		}
+		delay *= 2
+		if delay > maxStartupRetryInterval {
+			delay = maxStartupRetryInterval
+		}
+	}
+}
+
+// startupTimeout returns the error of a transport not connected by the startup
+// deadline, whose last attempt failed with err, if any.
+func startupTimeout(err error) error {
+	if err == nil {
+		return errStartupTimeout
+	}
+	return &startupError{err: err}
+}
+
+// A startupError is the error of a transport not connected by the startup
+// deadline, wrapping the error of the last attempt.
+type startupError struct {
+	err error
+}
+
+func (e *startupError) Error() string {
+	return fmt.Sprintf("%v: %v", errStartupTimeout, e.err)
+}
+
+func (e *startupError) Unwrap() error {
+	return e.err
+}
+
+func (e *startupError) Is(target error) bool {
+	return target == errStartupTimeout
+}
+
+// startupExitCode returns the exit code telling why starting the transport
+// failed with err.
+func startupExitCode(err error) int {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCertificate x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	switch {
+	case errors.As(err, &dnsErr):
+		return exitDNS
+	case errors.Is(err, transport.ErrNotAuthorized),
+		errors.Is(err, packets.ErrorRefusedNotAuthorised),
+		errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword),
+		errors.Is(err, nats.ErrAuthorization),
+		errors.Is(err, nats.ErrAuthExpired),
+		errors.Is(err, nats.ErrAuthRevoked),
+		errors.As(err, &unknownAuthority),
+		errors.As(err, &invalidCertificate),
+		errors.As(err, &hostname),
+		// The server rejected the client certificate with a TLS alert.
+		strings.Contains(err.Error(), "remote error: tls: "):
+		return exitAuthRejected
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH),
+		isNetTimeout(err):
+		return exitUnreachable
+	case errors.Is(err, errStartupTimeout):
+		return exitStartupTimeout
+	}
+	return exitFailure
+}
+
+// isNetTimeout reports whether err is a network timeout.
+func isNetTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// A failingTransport fails to start a number of times before starting.
+type failingTransport struct {
+	failures int
+	err      error
+	attempts int
+}
+
+func (t *failingTransport) Start() error {
+	t.attempts++
+	if t.attempts <= t.failures {
+		return t.err
+	}
+	return nil
+}
+func (t *failingTransport) SendData(data yggdrasil.Data) error    { return nil }
+func (t *failingTransport) SendControl(ctrlMsg interface{}) error { return nil }
+func (t *failingTransport) Disconnect(quiesce uint)               {}
+
+func TestStartTransport(t *testing.T) {
+	defer func(d time.Duration) { startupRetryInterval = d }(startupRetryInterval)
+	startupRetryInterval = time.Millisecond
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		description  string
+		failures     int
+		timeout      time.Duration
+		wantAttempts int
+		wantTimeout  bool
+	}{
+		{
+			description:  "no deadline",
+			failures:     1,
+			wantAttempts: 1,
+		},
+		{
+			description:  "started before deadline",
+			failures:     2,
+			timeout:      time.Minute,
+			wantAttempts: 3,
+		},
+		{
+			description: "deadline exceeded",
+			failures:    1 << 30,
+			timeout:     50 * time.Millisecond,
+			wantTimeout: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ft := &failingTransport{failures: test.failures, err: refused}
+			var deadline time.Time
+			if test.timeout > 0 {
+				deadline = time.Now().Add(test.timeout)
+			}
+			err := startTransport(ft, deadline)
+			if test.wantAttempts > 0 && ft.attempts != test.wantAttempts {
+				t.Errorf("attempts = %v, want %v", ft.attempts, test.wantAttempts)
+			}
+			if errors.Is(err, errStartupTimeout) != test.wantTimeout {
+				t.Errorf("error = %v, want startup timeout %v", err, test.wantTimeout)
+			}
+			if test.wantTimeout && !errors.Is(err, syscall.ECONNREFUSED) {
+				t.Errorf("error = %v, want last failure", err)
+			}
+		})
+	}
+}
+
+func TestStartupExitCode(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		description string
+		input       error
+		want        int
+	}{
+		{
+			description: "DNS",
+			input:       &net.DNSError{Err: "no such host", Name: "broker.example.com", IsNotFound: true},
+			want:        exitDNS,
+		},
+		{
+			description: "connection refused",
+			input:       fmt.Errorf("cannot connect: %w", refused),
+			want:        exitUnreachable,
+		},
+		{
+			description: "MQTT not authorized",
+			input:       packets.ErrorRefusedNotAuthorised,
+			want:        exitAuthRejected,
+		},
+		{
+			description: "MQTT v5 not authorized",
+			input:       fmt.Errorf("%w: bad user name or password", transport.ErrNotAuthorized),
+			want:        exitAuthRejected,
+		},
+		{
+			description: "TLS alert",
+			input:       errors.New("remote error: tls: bad certificate"),
+			want:        exitAuthRejected,
+		},
+		{
+			description: "timeout",
+			input:       startupTimeout(nil),
+			want:        exitStartupTimeout,
+		},
+		{
+			description: "timeout refused",
+			input:       startupTimeout(refused),
+			want:        exitUnreachable,
+		},
+		{
+			description: "other",
+			input:       errors.New("boom"),
+			want:        exitFailure,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := startupExitCode(test.input); got != test.want {
+				t.Errorf("startupExitCode(%v) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
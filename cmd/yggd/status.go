@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// transportStatus describes the state of the transport.
+type transportStatus struct {
+	Connected     bool       `json:"connected"`
+	LastPublished *time.Time `json:"last_published,omitempty"`
+}
+
+// statusResponse is the response of the "/status" endpoint.
+type statusResponse struct {
+	ClientID  string                          `json:"client_id"`
+	Transport transportStatus                 `json:"transport"`
+	Workers   map[string]yggdrasil.WorkerInfo `json:"workers"`
+	Queues    adminQueues                     `json:"queues"`
+}
+
+// newStatusHandler returns the handler of the status endpoint, for local
+// monitoring and container orchestration. Unlike the admin API, it is read
+// only and unauthenticated. It exposes:
+//
+//	GET /status     transport state, last publication, workers and queues
+//	GET /healthz    liveness check
+//	GET /readyz     readiness check: succeeds while t is connected, or held
+//	                disconnected by --start-disconnected
+func newStatusHandler(d *dispatcher, t transport.Transport) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s := statusResponse{
+			ClientID:  ClientID,
+			Transport: transportStatus{Connected: isConnected(t)},
+			Workers:   d.makeWorkersMap(),
+			Queues:    d.queueStatus(),
+		}
+		if published, ok := d.lastPublished.Load().(time.Time); ok {
+			s.Transport.LastPublished = &published
+		}
+		writeJSON(w, http.StatusOK, s)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		if !isConnected(t) && gate.allowed() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "disconnected"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	return mux
+}
+
+// serveStatus starts serving the status endpoint for d and t on the TCP
+// address addr.
+func serveStatus(addr string, d *dispatcher, t transport.Transport) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen: %w", err)
+	}
+	go func() {
+		log.Infof("serving status on: %v", l.Addr())
+		if err := http.Serve(l, newStatusHandler(d, t)); err != nil {
+			log.Errorf("cannot serve status: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type connectorTransport struct {
+	fakeTransport
+	connected bool
+}
+
+func (t *connectorTransport) Connected() bool { return t.connected }
+
+func TestStatusHandler(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+
+	tests := []struct {
+		description string
+		method      string
+		path        string
+		connected   bool
+		want        int
+	}{
+		{description: "status", method: http.MethodGet, path: "/status", want: http.StatusOK},
+		{description: "healthz", method: http.MethodGet, path: "/healthz", want: http.StatusOK},
+		{description: "ready", method: http.MethodGet, path: "/readyz", connected: true, want: http.StatusOK},
+		{description: "not ready", method: http.MethodGet, path: "/readyz", want: http.StatusServiceUnavailable},
+		{description: "method not allowed", method: http.MethodPost, path: "/healthz", want: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			handler := newStatusHandler(d, &connectorTransport{connected: test.connected})
+			r := httptest.NewRequest(test.method, test.path, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.want {
+				t.Errorf("%v != %v: %v", w.Code, test.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/logging"
+)
+
+// A supportCheck is the result of a check of the health of yggd included in
+// support bundles.
+type supportCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// supportStats holds the state of the message journal and spool included in
+// support bundles.
+type supportStats struct {
+	Journal struct {
+		Recorded int `json:"recorded"`
+		Pending  int `json:"pending"`
+	} `json:"journal"`
+	Spool *supportSpoolStats `json:"spool,omitempty"`
+}
+
+// supportSpoolStats holds the usage of the spool.
+type supportSpoolStats struct {
+	Messages int   `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	Quota    int64 `json:"quota"`
+}
+
+// supportBundle is a gzip compressed tar archive being written.
+type supportBundle struct {
+	tw       *tar.Writer
+	modified time.Time
+	errors   []string
+}
+
+// add adds a file named name holding data to the bundle.
+func (b *supportBundle) add(name string, data []byte) error {
+	if err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.modified,
+	}); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// addJSON adds a file named name holding the indented JSON encoding of v to
+// the bundle.
+func (b *supportBundle) addJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		b.failed(name, err)
+		return nil
+	}
+	return b.add(name, append(data, '\n'))
+}
+
+// failed records that the file name could not be collected; the errors are
+// added to the bundle in errors.txt.
+func (b *supportBundle) failed(name string, err error) {
+	b.errors = append(b.errors, fmt.Sprintf("%v: %v", name, err))
+}
+
+// writeSupportBundle writes a gzip compressed tar archive to w holding what
+// support needs to diagnose yggd: its configuration and the worker manifests,
+// redacted, its recent logs, status, queues, metrics, the state of the
+// message journal and spool, and the results of health checks. Parts that
+// cannot be collected are listed in errors.txt rather than failing the
+// bundle.
+func (d *dispatcher) writeSupportBundle(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	b := &supportBundle{tw: tar.NewWriter(gz), modified: time.Now()}
+	redactor := newMessageMirror(nil)
+
+	var checks []supportCheck
+
+	if configFile != "" {
+		config, err := readRedactedTOML(configFile, redactor)
+		if err != nil {
+			b.failed("config.json", err)
+		} else if err := b.addJSON("config.json", map[string]interface{}{
+			"file":    configFile,
+			"profile": configProfile,
+			"values":  config,
+		}); err != nil {
+			return err
+		}
+		check := supportCheck{Name: "config", OK: true}
+		if _, _, err := newConfigSource(configFile, configProfile); err != nil {
+			check.OK = false
+			check.Detail = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	manifestCheck := supportCheck{Name: "manifests", OK: true}
+	files, err := filepath.Glob(filepath.Join(workerManifestDir(), "*.toml"))
+	if err != nil {
+		b.failed("manifests", err)
+	}
+	var invalid []string
+	for _, file := range files {
+		name := "manifests/" + manifestName(file) + ".json"
+		if manifest, err := readRedactedTOML(file, redactor); err != nil {
+			b.failed(name, err)
+		} else if err := b.addJSON(name, manifest); err != nil {
+			return err
+		}
+		if _, err := loadWorkerManifest(file); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%v: %v", manifestName(file), err))
+		}
+	}
+	if len(invalid) > 0 {
+		manifestCheck.OK = false
+		manifestCheck.Detail = strings.Join(invalid, "; ")
+	}
+	checks = append(checks, manifestCheck)
+
+	dispatchers, workers := d.connectionStatus()
+	if err := b.addJSON("status.json", adminStatus{
+		ClientID:    ClientID,
+		Dispatchers: dispatchers,
+		Workers:     workers,
+		Errors:      lasterror.All(),
+	}); err != nil {
+		return err
+	}
+	buildInfo := adminBuildInfo{Build: yggdrasil.ReadBuildInfo(), Workers: map[string]workerVersion{}}
+	for directive, info := range d.makeWorkersMap() {
+		buildInfo.Workers[directive] = workerVersion{Version: info.Version, ManifestVersion: info.ManifestVersion}
+	}
+	if err := b.addJSON("buildinfo.json", buildInfo); err != nil {
+		return err
+	}
+	if err := b.addJSON("queues.json", d.queueStatus()); err != nil {
+		return err
+	}
+
+	metrics := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		metrics[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	if err := b.addJSON("metrics.json", metrics); err != nil {
+		return err
+	}
+
+	var stats supportStats
+	stats.Journal.Recorded, stats.Journal.Pending = journal.counts()
+	if d.spool != nil {
+		stats.Spool = &supportSpoolStats{Messages: d.spool.len(), Bytes: d.spool.size(), Quota: d.spool.quota}
+		check := supportCheck{Name: "spool", OK: stats.Spool.Bytes*10 < stats.Spool.Quota*9}
+		if !check.OK {
+			check.Detail = fmt.Sprintf("%v of %v bytes used", stats.Spool.Bytes, stats.Spool.Quota)
+		}
+		checks = append(checks, check)
+	}
+	if err := b.addJSON("stats.json", stats); err != nil {
+		return err
+	}
+
+	errorsCheck := supportCheck{Name: "errors", OK: true}
+	for subsystem, e := range lasterror.All() {
+		if time.Since(e.Time) < time.Hour {
+			errorsCheck.OK = false
+			errorsCheck.Detail += fmt.Sprintf("%v: %v; ", subsystem, e.Message)
+		}
+	}
+	errorsCheck.Detail = strings.TrimSuffix(errorsCheck.Detail, "; ")
+	checks = append(checks, errorsCheck)
+	if err := b.addJSON("checks.json", checks); err != nil {
+		return err
+	}
+
+	if ring := logging.CurrentRing(); ring != nil {
+		var compressed, logs bytes.Buffer
+		if err := ring.Dump(&compressed); err != nil {
+			b.failed("logs.txt", err)
+		} else if err := logging.Decompress(&logs, &compressed); err != nil {
+			b.failed("logs.txt", err)
+		} else if err := b.add("logs.txt", logs.Bytes()); err != nil {
+			return err
+		}
+	} else {
+		b.failed("logs.txt", errNoLogRing)
+	}
+
+	if len(b.errors) > 0 {
+		if err := b.add("errors.txt", []byte(strings.Join(b.errors, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readRedactedTOML reads the TOML file at path and returns its values with
+// those of the keys redactor redacts replaced, as are those of the "KEY=VALUE"
+// environment variables of "env" arrays.
+func readRedactedTOML(path string, redactor *messageMirror) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %v: %w", path, err)
+	}
+	values := tree.ToMap()
+	if env, ok := values["env"].([]interface{}); ok {
+		for i, v := range env {
+			if s, ok := v.(string); ok {
+				if fields := strings.SplitN(s, "=", 2); len(fields) == 2 && redactor.redacted(fields[0]) {
+					env[i] = fields[0] + "=" + mirrorRedacted
+				}
+			}
+		}
+	}
+	redactor.redactValue(values)
+	return values, nil
+}
+
+// writeSupportBundleFile writes a support bundle to a new temporary file and
+// returns its path.
+func (d *dispatcher) writeSupportBundleFile() (string, error) {
+	f, err := ioutil.TempFile("", "yggdrasil-support-*.tar.gz")
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %w", err)
+	}
+	defer f.Close()
+	if err := d.writeSupportBundle(f); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("cannot write support bundle: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("cannot write support bundle: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// errNoUploadURL is returned when a support bundle is to be uploaded without
+// an upload URL.
+var errNoUploadURL = fmt.Errorf("no upload-url set")
+
+// uploadSupportBundle writes a support bundle and uploads it through the data
+// plane, under the upload URL followed by the client ID and the time of the
+// bundle, and returns a reference to the uploaded bundle.
+func (d *dispatcher) uploadSupportBundle() (yggdrasil.ContentReference, error) {
+	if d.uploadURL == "" {
+		return yggdrasil.ContentReference{}, errNoUploadURL
+	}
+	URL, err := uploadURL(d.uploadURL, ClientID, "support-bundle-"+time.Now().UTC().Format("20060102T150405Z"))
+	if err != nil {
+		return yggdrasil.ContentReference{}, err
+	}
+	path, err := d.writeSupportBundleFile()
+	if err != nil {
+		return yggdrasil.ContentReference{}, err
+	}
+	defer os.Remove(path)
+
+	d.transfers.wait()
+	ref, err := uploadFile(d.httpClient, URL, path)
+	if err != nil {
+		return ref, fmt.Errorf("cannot upload support bundle: %w", err)
+	}
+	return ref, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestWriteSupportBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-supportbundle-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(old string) { yggdrasil.SysconfDir = old }(yggdrasil.SysconfDir)
+	yggdrasil.SysconfDir = dir
+	manifestDir := workerManifestDir()
+	if err := os.MkdirAll(manifestDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `exec = "/usr/libexec/echo-worker"
+env = ["ECHO_PREFIX=hello", "API_TOKEN=s3cr3t"]
+`
+	if err := ioutil.WriteFile(filepath.Join(manifestDir, "echo.toml"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old string) { configFile = old }(configFile)
+	configFile = filepath.Join(dir, "config.toml")
+	config := `log-level = "debug"
+broker-password = "hunter2"
+`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDispatcher(nil, 1, 0, 10)
+	var buf bytes.Buffer
+	if err := d.writeSupportBundle(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][]byte)
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = data
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// The log buffer is not enabled in tests.
+	wantNames := []string{"buildinfo.json", "checks.json", "config.json", "errors.txt", "manifests/echo.json", "metrics.json", "queues.json", "stats.json", "status.json"}
+	if !cmp.Equal(names, wantNames) {
+		t.Errorf("%#v", cmp.Diff(names, wantNames))
+	}
+
+	var gotConfig struct {
+		Values map[string]interface{} `json:"values"`
+	}
+	if err := json.Unmarshal(files["config.json"], &gotConfig); err != nil {
+		t.Fatal(err)
+	}
+	wantConfig := map[string]interface{}{"log-level": "debug", "broker-password": mirrorRedacted}
+	if !cmp.Equal(gotConfig.Values, wantConfig) {
+		t.Errorf("%#v", cmp.Diff(gotConfig.Values, wantConfig))
+	}
+
+	var gotManifest map[string]interface{}
+	if err := json.Unmarshal(files["manifests/echo.json"], &gotManifest); err != nil {
+		t.Fatal(err)
+	}
+	wantEnv := []interface{}{"ECHO_PREFIX=hello", "API_TOKEN=" + mirrorRedacted}
+	if !cmp.Equal(gotManifest["env"], wantEnv) {
+		t.Errorf("%#v", cmp.Diff(gotManifest["env"], wantEnv))
+	}
+	if bytes.Contains(buf.Bytes(), []byte("s3cr3t")) || bytes.Contains(buf.Bytes(), []byte("hunter2")) {
+		t.Error("bundle holds a secret")
+	}
+
+	var checks []supportCheck
+	if err := json.Unmarshal(files["checks.json"], &checks); err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range checks {
+		if check.Name == "config" && !check.OK {
+			t.Errorf("config check failed: %v", check.Detail)
+		}
+	}
+}
+
+func TestUploadSupportBundleWithoutURL(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	if _, err := d.uploadSupportBundle(); err != errNoUploadURL {
+		t.Errorf("error = %v, want %v", err, errNoUploadURL)
+	}
+}
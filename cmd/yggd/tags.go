@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/tags"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// serverTagsFile returns the path of the file the tags assigned by the server
+// are persisted in.
+func serverTagsFile() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "server-tags.toml")
+}
+
+// scopedTags holds the tags of each scope: the locally configured tags of
+// the tags file, the tags assigned by the server, persisted across restarts,
+// and the tags derived by each registered worker. Each scope is updated on its
+// own, so that no party overwrites the tags of another.
+type scopedTags struct {
+	localFile  string
+	serverFile string
+
+	lock    sync.Mutex
+	workers map[string]map[string]string
+}
+
+func newScopedTags(localFile, serverFile string) *scopedTags {
+	return &scopedTags{
+		localFile:  localFile,
+		serverFile: serverFile,
+		workers:    make(map[string]map[string]string),
+	}
+}
+
+// scopes returns the tags of each scope, the tags of all workers merged into
+// the worker scope. Should two workers set the same tag, the worker whose
+// handler sorts last wins.
+func (s *scopedTags) scopes() (map[string]map[string]string, error) {
+	local, err := tags.ReadTagsFile(s.localFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read local tags: %w", err)
+	}
+	server, err := tags.ReadTagsFile(s.serverFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read server tags: %w", err)
+	}
+
+	s.lock.Lock()
+	handlers := make([]string, 0, len(s.workers))
+	for handler := range s.workers {
+		handlers = append(handlers, handler)
+	}
+	sort.Strings(handlers)
+	workers := make([]map[string]string, 0, len(handlers))
+	for _, handler := range handlers {
+		workers = append(workers, s.workers[handler])
+	}
+	s.lock.Unlock()
+
+	return map[string]map[string]string{
+		tags.ScopeLocal:  local,
+		tags.ScopeServer: server,
+		tags.ScopeWorker: tags.Merge(workers...),
+	}, nil
+}
+
+// merged returns the tags of all scopes merged by precedence, as published in
+// connection-status messages.
+func (s *scopedTags) merged() (map[string]string, error) {
+	scopes, err := s.scopes()
+	if err != nil {
+		return nil, err
+	}
+	return tags.Merge(scopes[tags.ScopeWorker], scopes[tags.ScopeServer], scopes[tags.ScopeLocal]), nil
+}
+
+// setServer replaces the tags assigned by the server.
+func (s *scopedTags) setServer(t map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := tags.WriteTagsFile(s.serverFile, t); err != nil {
+		return fmt.Errorf("cannot write server tags: %w", err)
+	}
+	return nil
+}
+
+// updateLocal sets the locally configured tags in set and removes those in
+// unset, leaving the others as they are.
+func (s *scopedTags) updateLocal(set map[string]string, unset []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	local, err := tags.ReadTagsFile(s.localFile)
+	if err != nil {
+		return fmt.Errorf("cannot read local tags: %w", err)
+	}
+	local = tags.Merge(local, set)
+	for _, k := range unset {
+		delete(local, k)
+	}
+	if err := tags.WriteTagsFile(s.localFile, local); err != nil {
+		return fmt.Errorf("cannot write local tags: %w", err)
+	}
+	return nil
+}
+
+// setWorker replaces the tags derived by the worker registered for handler.
+// Empty tags remove them.
+func (s *scopedTags) setWorker(handler string, t map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(t) == 0 {
+		delete(s.workers, handler)
+		return
+	}
+	s.workers[handler] = t
+}
+
+// SetTags implements the "SetTags" method of the Dispatcher gRPC service,
+// replacing the tags derived by the calling worker and publishing a
+// connection-status message.
+func (d *dispatcher) SetTags(ctx context.Context, r *pb.SetTagsRequest) (*pb.Empty, error) {
+	d.RLock()
+	w, prs := d.workers[r.GetHandler()]
+	d.RUnlock()
+	if !prs || w.callerPID() != int(r.GetPid()) {
+		return nil, fmt.Errorf("no worker with pid %v registered for handler %v", r.GetPid(), r.GetHandler())
+	}
+
+	d.tags.setWorker(r.GetHandler(), r.GetTags())
+	log.Infof("worker %v set tags: %v", r.GetHandler(), r.GetTags())
+	d.sendDispatchersMap()
+
+	return &pb.Empty{}, nil
+}
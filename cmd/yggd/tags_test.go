@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestScopedTags(t *testing.T) {
+	tests := []struct {
+		description string
+		local       map[string]string
+		server      map[string]string
+		workers     map[string]map[string]string
+		set         map[string]string
+		unset       []string
+		want        map[string]string
+	}{
+		{
+			description: "empty",
+		},
+		{
+			description: "local overrides server and worker",
+			local:       map[string]string{"env": "prod"},
+			server:      map[string]string{"env": "stage", "group": "a"},
+			workers:     map[string]map[string]string{"echo": {"env": "dev", "arch": "x86_64"}},
+			want:        map[string]string{"env": "prod", "group": "a", "arch": "x86_64"},
+		},
+		{
+			description: "workers by handler",
+			workers:     map[string]map[string]string{"b": {"k": "b"}, "a": {"k": "a", "x": "a"}},
+			want:        map[string]string{"k": "b", "x": "a"},
+		},
+		{
+			description: "update local",
+			local:       map[string]string{"env": "prod", "owner": "ops"},
+			server:      map[string]string{"env": "stage"},
+			set:         map[string]string{"site": "east"},
+			unset:       []string{"env"},
+			want:        map[string]string{"env": "stage", "owner": "ops", "site": "east"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-tags-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s := newScopedTags(filepath.Join(dir, "tags.toml"), filepath.Join(dir, "server-tags.toml"))
+			if err := s.updateLocal(test.local, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.setServer(test.server); err != nil {
+				t.Fatal(err)
+			}
+			for handler, tags := range test.workers {
+				s.setWorker(handler, tags)
+			}
+			if test.set != nil || test.unset != nil {
+				if err := s.updateLocal(test.set, test.unset); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := s.merged()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
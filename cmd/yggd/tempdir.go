@@ -0,0 +1,252 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// tempDirMetrics holds the number of temporary directories "created" and
+// "removed", and the number of times one was emptied for exceeding its quota,
+// "quota_exceeded".
+var tempDirMetrics = expvar.NewMap("temp_dirs")
+
+const (
+	// tempDirCheckInterval is the interval at which the size and age of
+	// temporary directories are checked.
+	tempDirCheckInterval = 10 * time.Second
+
+	// tempDirMaxAge is the age after which the temporary directory of a
+	// message no response was published to is removed.
+	tempDirMaxAge = 24 * time.Hour
+)
+
+// tempDirRoot returns the directory holding the temporary directories of
+// messages, one directory per directive.
+func tempDirRoot() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "tmp")
+}
+
+// A tempDir is the temporary directory provided to the worker handling a
+// message.
+type tempDir struct {
+	path      string
+	directive string
+	created   time.Time
+}
+
+// tempDirs provides workers with a temporary directory for each message they
+// handle, passed in the MetadataKeyTempDir metadata key, and removes it once
+// the response to the message is published. A directory that grows beyond the
+// quota is emptied.
+type tempDirs struct {
+	root  string
+	quota int64
+
+	lock sync.Mutex
+	dirs map[string]tempDir
+}
+
+// newTempDirs removes the temporary directories left in root by a previous
+// run and returns tempDirs of at most quota bytes each in root.
+func newTempDirs(root string, quota int64) (*tempDirs, error) {
+	if err := os.RemoveAll(root); err != nil {
+		return nil, fmt.Errorf("cannot remove temporary directories: %w", err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+	return &tempDirs{
+		root:  root,
+		quota: quota,
+		dirs:  make(map[string]tempDir),
+	}, nil
+}
+
+// validPathElement reports whether name can be used as the name of a
+// directory.
+func validPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// create creates the temporary directory of the message data, owned by the
+// user and group the worker w runs as, and returns its path. It returns an
+// empty path if temporary directories are disabled, or the worker runs in a
+// virtual machine and cannot reach them.
+func (t *tempDirs) create(w worker, data yggdrasil.Data) (string, error) {
+	if t == nil || w.vm {
+		return "", nil
+	}
+	if !validPathElement(data.Directive) || !validPathElement(data.MessageID) {
+		return "", fmt.Errorf("cannot create temporary directory: invalid directive or message ID")
+	}
+	uid, gid := -1, -1
+	if m := manifestForPID(w.pid); m != nil {
+		var err error
+		uid, gid, err = m.owner()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	path := filepath.Join(t.root, data.Directive, data.MessageID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("cannot create directory: %w", err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		return "", fmt.Errorf("cannot create temporary directory: %w", err)
+	}
+	if uid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			os.RemoveAll(path)
+			return "", fmt.Errorf("cannot change owner of temporary directory: %w", err)
+		}
+	}
+
+	t.lock.Lock()
+	t.dirs[data.MessageID] = tempDir{path: path, directive: data.Directive, created: time.Now()}
+	t.lock.Unlock()
+	tempDirMetrics.Add("created", 1)
+	return path, nil
+}
+
+// remove removes the temporary directory of the message with the given ID, if
+// any.
+func (t *tempDirs) remove(messageID string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	dir, prs := t.dirs[messageID]
+	delete(t.dirs, messageID)
+	t.lock.Unlock()
+	if !prs {
+		return
+	}
+
+	if err := os.RemoveAll(dir.path); err != nil {
+		log.Errorf("cannot remove temporary directory %v: %v", dir.path, err)
+		return
+	}
+	tempDirMetrics.Add("removed", 1)
+	log.Debugf("removed temporary directory of message %v", messageID)
+}
+
+// An exceededTempDir is a temporary directory emptied for exceeding its
+// quota.
+type exceededTempDir struct {
+	messageID string
+	directive string
+	size      int64
+}
+
+// check removes the temporary directories older than tempDirMaxAge at now,
+// and empties those larger than the quota, returning them.
+func (t *tempDirs) check(now time.Time) []exceededTempDir {
+	t.lock.Lock()
+	dirs := make(map[string]tempDir, len(t.dirs))
+	for messageID, dir := range t.dirs {
+		dirs[messageID] = dir
+	}
+	t.lock.Unlock()
+
+	var exceeded []exceededTempDir
+	for messageID, dir := range dirs {
+		if now.Sub(dir.created) > tempDirMaxAge {
+			log.Infof("removing temporary directory of message %v after %v", messageID, tempDirMaxAge)
+			t.remove(messageID)
+			continue
+		}
+		if t.quota <= 0 {
+			continue
+		}
+		size, err := dirSize(dir.path)
+		if err != nil {
+			log.Errorf("cannot measure temporary directory %v: %v", dir.path, err)
+			continue
+		}
+		if size <= t.quota {
+			continue
+		}
+		if err := emptyDir(dir.path); err != nil {
+			log.Errorf("cannot empty temporary directory %v: %v", dir.path, err)
+			continue
+		}
+		tempDirMetrics.Add("quota_exceeded", 1)
+		exceeded = append(exceeded, exceededTempDir{messageID: messageID, directive: dir.directive, size: size})
+	}
+	return exceeded
+}
+
+// dirSize returns the total size of the regular files in dir and its
+// subdirectories.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// emptyDir removes the content of dir, leaving it in place.
+func emptyDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchTempDirs checks the temporary directories every tempDirCheckInterval,
+// sending a "temp-quota-exceeded" event for each directory emptied for
+// exceeding its quota.
+func (d *dispatcher) watchTempDirs() {
+	ticker := time.NewTicker(tempDirCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, dir := range d.tempDirs.check(now) {
+			log.Warnf("emptied temporary directory of message %v: %v bytes exceeds quota of %v bytes", dir.messageID, dir.size, d.tempDirs.quota)
+			d.events <- yggdrasil.Event{
+				Type:       yggdrasil.MessageTypeEvent,
+				MessageID:  uuid.New().String(),
+				ResponseTo: dir.messageID,
+				Version:    1,
+				Sent:       time.Now(),
+				Content:    string(yggdrasil.EventNameTempQuotaExceeded),
+				Details: map[string]string{
+					"directive": dir.directive,
+					"size":      strconv.FormatInt(dir.size, 10),
+					"quota":     strconv.FormatInt(d.tempDirs.quota, 10),
+				},
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestTempDirs(t *testing.T) {
+	tests := []struct {
+		description string
+		data        yggdrasil.Data
+		write       int
+		age         time.Duration
+		wantError   bool
+		wantExists  bool
+		wantEmptied bool
+	}{
+		{
+			description: "within quota",
+			data:        yggdrasil.Data{MessageID: "1", Directive: "echo"},
+			write:       10,
+			wantExists:  true,
+		},
+		{
+			description: "quota exceeded",
+			data:        yggdrasil.Data{MessageID: "2", Directive: "echo"},
+			write:       200,
+			wantExists:  true,
+			wantEmptied: true,
+		},
+		{
+			description: "expired",
+			data:        yggdrasil.Data{MessageID: "3", Directive: "echo"},
+			age:         tempDirMaxAge + time.Minute,
+		},
+		{
+			description: "invalid message ID",
+			data:        yggdrasil.Data{MessageID: "../4", Directive: "echo"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "yggd-tmp-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			dirs, err := newTempDirs(filepath.Join(root, "tmp"), 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path, err := dirs.create(worker{}, test.data)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(path, "file"), make([]byte, test.write), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			exceeded := dirs.check(time.Now().Add(test.age))
+
+			var want []exceededTempDir
+			if test.wantEmptied {
+				want = []exceededTempDir{{messageID: test.data.MessageID, directive: test.data.Directive, size: int64(test.write)}}
+			}
+			if !cmp.Equal(exceeded, want, cmp.AllowUnexported(exceededTempDir{})) {
+				t.Errorf("%#v", cmp.Diff(exceeded, want, cmp.AllowUnexported(exceededTempDir{})))
+			}
+			if _, err := os.Stat(path); (err == nil) != test.wantExists {
+				t.Errorf("directory exists: %v, want %v", err == nil, test.wantExists)
+			}
+			if _, err := os.Stat(filepath.Join(path, "file")); err == nil && test.wantEmptied {
+				t.Errorf("directory was not emptied")
+			}
+
+			dirs.remove(test.data.MessageID)
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("directory was not removed: %v", err)
+			}
+		})
+	}
+}
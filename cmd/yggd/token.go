@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil/internal/auth"
+	"github.com/urfave/cli/v2"
+)
+
+// tokenRequestTimeout is how long a request to the OAuth2 token endpoint may
+// take.
+const tokenRequestTimeout = 30 * time.Second
+
+// newTokenSource returns the source of the bearer tokens authenticating
+// requests to the HTTP server: the token file set by the "http-token-file"
+// flag, the OAuth2 token endpoint set by the "http-token-url" flag, or nil if
+// neither is set. Requests to the token endpoint are sent with tlsConfig, so
+// that the endpoint may authenticate the client by its certificate too.
+func newTokenSource(c *cli.Context, tlsConfig *tls.Config) (auth.TokenSource, error) {
+	file := c.String("http-token-file")
+	tokenURL := c.String("http-token-url")
+	switch {
+	case file != "" && tokenURL != "":
+		return nil, fmt.Errorf("cannot use both http-token-file and http-token-url")
+	case file != "":
+		return &auth.TokenFile{Path: file}, nil
+	case tokenURL == "":
+		return nil, nil
+	}
+
+	if c.String("http-client-id") == "" {
+		return nil, fmt.Errorf("http-token-url requires http-client-id")
+	}
+	secret, err := resolveSecret(c, "http-client-secret")
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	return &auth.ClientCredentials{
+		TokenURL:     tokenURL,
+		ClientID:     c.String("http-client-id"),
+		ClientSecret: secret,
+		Scopes:       c.StringSlice("http-token-scope"),
+		Skew:         c.Duration("http-token-skew"),
+		Client:       &http.Client{Transport: transport, Timeout: tokenRequestTimeout},
+	}, nil
+}
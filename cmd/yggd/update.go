@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// Methods of the "update" command, set by its "method" argument.
+const (
+	// updateBinary downloads a signed executable and installs it in place
+	// of the running one.
+	updateBinary = "binary"
+
+	// updateDNF updates the package with dnf.
+	updateDNF = "dnf"
+
+	// updateRPMOSTree stages a new deployment with rpm-ostree, which takes
+	// effect on the next boot.
+	updateRPMOSTree = "rpm-ostree"
+)
+
+// Ways of restarting once updated, set by the "restart" argument of the
+// "update" command.
+const (
+	// restartExec re-executes yggd once it has disconnected.
+	restartExec = "exec"
+
+	// restartSchedule has systemd restart the service after a delay.
+	restartSchedule = "schedule"
+
+	// restartNone leaves yggd running; the update takes effect on its next
+	// start.
+	restartNone = "none"
+)
+
+// Stages of an update, reported in the "stage" detail of its events.
+const (
+	updateStageDownloading = "downloading"
+	updateStageVerifying   = "verifying"
+	updateStageInstalling  = "installing"
+	updateStageRestarting  = "restarting"
+)
+
+// defaultRestartDelay is the delay after which a scheduled restart happens,
+// unless the "delay" argument sets another.
+const defaultRestartDelay = time.Minute
+
+// updateTimeout bounds the time an update may take before being abandoned.
+const updateTimeout = 30 * time.Minute
+
+// updateKeysDir returns the directory holding the public keys trusted to sign
+// yggd executables, each a PEM encoded Ed25519 public key in a ".pem" file.
+func updateKeysDir() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "update-keys.d")
+}
+
+// updateCacheDir returns the directory in which executables are downloaded.
+func updateCacheDir() string {
+	return filepath.Join(yggdrasil.LocalstateDir, "cache", yggdrasil.LongName, "update")
+}
+
+// runUpdateCommand runs the package manager command name with args and
+// returns its combined output.
+var runUpdateCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// updating holds a value while an update is in progress, so that only one
+// runs at a time.
+var updating = make(chan struct{}, 1)
+
+// restarting is set once yggd is asked to quit in order to be re-executed.
+var restarting struct {
+	sync.Mutex
+	requested bool
+}
+
+// restartRequested is signalled when yggd must quit to be re-executed.
+var restartRequested = make(chan struct{}, 1)
+
+// requestRestart asks yggd to quit and be re-executed once it has
+// disconnected and stopped its workers.
+func requestRestart() {
+	restarting.Lock()
+	restarting.requested = true
+	restarting.Unlock()
+	select {
+	case restartRequested <- struct{}{}:
+	default:
+	}
+}
+
+// restartPending reports whether yggd was asked to quit to be re-executed.
+func restartPending() bool {
+	restarting.Lock()
+	defer restarting.Unlock()
+	return restarting.requested
+}
+
+// An updateRequest holds the parsed arguments of an "update" command.
+type updateRequest struct {
+	method    string
+	url       string
+	checksum  string
+	signature []byte
+	version   string
+	restart   string
+	delay     time.Duration
+}
+
+// parseUpdateArguments parses the arguments of an "update" command. The
+// "binary" method requires "url", "checksum" and a base64 encoded
+// "signature"; the "dnf" method accepts the "version" of the package to
+// update to. A deployment staged by rpm-ostree only takes effect on reboot,
+// so it is never followed by a restart.
+func parseUpdateArguments(arguments map[string]string) (updateRequest, error) {
+	r := updateRequest{
+		method:  arguments["method"],
+		url:     arguments["url"],
+		version: arguments["version"],
+		restart: arguments["restart"],
+		delay:   defaultRestartDelay,
+	}
+	switch r.method {
+	case updateBinary:
+		if r.url == "" {
+			return r, fmt.Errorf("missing url")
+		}
+		r.checksum = arguments["checksum"]
+		if _, err := parseChecksum(r.checksum); err != nil {
+			return r, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(arguments["signature"])
+		if err != nil || len(signature) != ed25519.SignatureSize {
+			return r, fmt.Errorf("invalid signature %q", arguments["signature"])
+		}
+		r.signature = signature
+	case updateDNF:
+	case updateRPMOSTree:
+		if r.restart != "" && r.restart != restartNone {
+			return r, fmt.Errorf("restart %q is not supported by rpm-ostree, which requires a reboot", r.restart)
+		}
+		r.restart = restartNone
+	default:
+		return r, fmt.Errorf("unknown update method %q", r.method)
+	}
+
+	switch r.restart {
+	case "":
+		r.restart = defaultRestart
+	case restartExec, restartSchedule:
+		if !restartSupported {
+			return r, fmt.Errorf("restart %q is not supported on this system", r.restart)
+		}
+	case restartNone:
+	default:
+		return r, fmt.Errorf("unknown restart %q", r.restart)
+	}
+
+	if value, prs := arguments["delay"]; prs {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay <= 0 {
+			return r, fmt.Errorf("invalid delay %q", value)
+		}
+		r.delay = delay
+	}
+	return r, nil
+}
+
+// An updateError is an error that occurred at a stage of an update.
+type updateError struct {
+	stage string
+	err   error
+}
+
+func (e *updateError) Error() string {
+	return e.err.Error()
+}
+
+func (e *updateError) Unwrap() error {
+	return e.err
+}
+
+// runUpdate carries out r, reporting each stage it reaches to progress, and
+// returns the version installed, as reported by the new executable or the
+// package manager. The executable exe is replaced by the "binary" method.
+func (d *dispatcher) runUpdate(ctx context.Context, r updateRequest, exe string, progress func(stage string)) (string, error) {
+	switch r.method {
+	case updateBinary:
+		return d.updateBinary(ctx, r, exe, progress)
+	case updateDNF:
+		progress(updateStageInstalling)
+		// dnf verifies the signature of the package against the keys of
+		// its repository.
+		pkg := yggdrasil.LongName
+		if r.version != "" {
+			pkg += "-" + r.version
+		}
+		if output, err := runUpdateCommand(ctx, "dnf", "--assumeyes", "--setopt=gpgcheck=1", "upgrade", pkg); err != nil {
+			return "", &updateError{updateStageInstalling, fmt.Errorf("dnf failed: %w: %s", err, strings.TrimSpace(string(output)))}
+		}
+		progress(updateStageVerifying)
+		output, err := runUpdateCommand(ctx, "rpm", "--query", "--queryformat", "%{VERSION}-%{RELEASE}", yggdrasil.LongName)
+		if err != nil {
+			return "", &updateError{updateStageVerifying, fmt.Errorf("cannot query installed version: %w: %s", err, strings.TrimSpace(string(output)))}
+		}
+		return strings.TrimSpace(string(output)), nil
+	case updateRPMOSTree:
+		progress(updateStageInstalling)
+		// rpm-ostree verifies the commit against the keys of its remote.
+		output, err := runUpdateCommand(ctx, "rpm-ostree", "upgrade")
+		if err != nil {
+			return "", &updateError{updateStageInstalling, fmt.Errorf("rpm-ostree failed: %w: %s", err, strings.TrimSpace(string(output)))}
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown update method %q", r.method)
+}
+
+// updateBinary downloads the executable of r, checks its checksum and
+// signature, checks it runs, and installs it in place of exe. The executable
+// replaced is kept next to it with a ".old" suffix.
+func (d *dispatcher) updateBinary(ctx context.Context, r updateRequest, exe string, progress func(stage string)) (string, error) {
+	progress(updateStageDownloading)
+	d.transfers.wait()
+	path, err := fetchContent(ctx, d.httpClient, yggdrasil.ContentReference{URL: r.url, Checksum: r.checksum}, updateCacheDir())
+	if err != nil {
+		return "", &updateError{updateStageDownloading, fmt.Errorf("cannot download executable: %w", err)}
+	}
+	defer os.Remove(path)
+
+	progress(updateStageVerifying)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", &updateError{updateStageVerifying, fmt.Errorf("cannot read executable: %w", err)}
+	}
+	keys, err := readPublicKeys(updateKeysDir())
+	if err != nil {
+		return "", &updateError{updateStageVerifying, fmt.Errorf("cannot read update keys: %w", err)}
+	}
+	if !verifiedBy(data, r.signature, keys) {
+		return "", &updateError{updateStageVerifying, fmt.Errorf("signature of %v was not made with a trusted key", r.url)}
+	}
+
+	progress(updateStageInstalling)
+	next := exe + ".new"
+	if err := writeExecutable(next, data); err != nil {
+		return "", &updateError{updateStageInstalling, err}
+	}
+	version, err := executableVersion(ctx, next)
+	if err != nil {
+		os.Remove(next)
+		return "", &updateError{updateStageVerifying, err}
+	}
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Link(exe, old); err != nil {
+		log.Debugf("cannot keep previous executable: %v", err)
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Remove(next)
+		return "", &updateError{updateStageInstalling, fmt.Errorf("cannot replace executable: %w", err)}
+	}
+	return version, nil
+}
+
+// verifiedBy reports whether signature is the Ed25519 signature of data made
+// with the private key of one of keys.
+func verifiedBy(data, signature []byte, keys []ed25519.PublicKey) bool {
+	for _, key := range keys {
+		if ed25519.Verify(key, data, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeExecutable writes data to a new executable file at path.
+func writeExecutable(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	return nil
+}
+
+// executableVersion runs the executable at path with "--version" and returns
+// the version it prints, the last field of its output, such as "0.2.1" in
+// "yggd version 0.2.1". An executable that does not run on this system is
+// rejected before it replaces the running one.
+func executableVersion(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot run new executable: %w", err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("new executable printed no version")
+	}
+	return fields[len(fields)-1], nil
+}
+
+// scheduleRestart has systemd restart the yggd service after delay, in a
+// transient timer that outlives yggd.
+func scheduleRestart(ctx context.Context, delay time.Duration) error {
+	output, err := runUpdateCommand(ctx, "systemd-run",
+		fmt.Sprintf("--on-active=%vs", int(delay.Seconds())),
+		"systemctl", "try-restart", yggdrasil.ShortName+"d.service")
+	if err != nil {
+		return fmt.Errorf("cannot schedule restart: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// updateEvent returns an event of the update answering the command
+// responseTo, with details.
+func updateEvent(responseTo string, name yggdrasil.EventName, details map[string]string) yggdrasil.Event {
+	return yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: responseTo,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(name),
+		Details:    details,
+	}
+}
+
+// update handles the "update" command cmd received on t, publishing an
+// "update-progress" event at each stage, then an "updated" or
+// "update-failed" event. Once updated, yggd is restarted as the command
+// asks.
+func (d *dispatcher) update(t transport.Transport, cmd yggdrasil.Command) {
+	send := func(name yggdrasil.EventName, details map[string]string) {
+		event := updateEvent(cmd.MessageID, name, details)
+		event.OperationGroup = cmd.OperationGroup
+		if err := t.SendControl(event); err != nil {
+			log.Error(err)
+		}
+	}
+	fail := func(stage string, err error) {
+		log.Errorf("cannot update: %v", err)
+		send(yggdrasil.EventNameUpdateFailed, map[string]string{"stage": stage, "error": err.Error()})
+	}
+
+	r, err := parseUpdateArguments(cmd.Content.Arguments)
+	if err != nil {
+		fail("", err)
+		return
+	}
+	select {
+	case updating <- struct{}{}:
+		defer func() { <-updating }()
+	default:
+		fail("", fmt.Errorf("an update is already in progress"))
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fail("", fmt.Errorf("cannot locate executable: %w", err))
+		return
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		fail("", fmt.Errorf("cannot locate executable: %w", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	log.Infof("updating with %v", r.method)
+	version, err := d.runUpdate(ctx, r, exe, func(stage string) {
+		log.Infof("update %v", stage)
+		send(yggdrasil.EventNameUpdateProgress, map[string]string{"method": r.method, "stage": stage})
+	})
+	if err != nil {
+		stage := ""
+		var e *updateError
+		if errors.As(err, &e) {
+			stage = e.stage
+		}
+		fail(stage, err)
+		return
+	}
+
+	details := map[string]string{"method": r.method, "restart": r.restart}
+	if version != "" {
+		details["version"] = version
+	}
+	if r.method == updateRPMOSTree {
+		details["reboot"] = "required"
+	}
+	log.Infof("updated to version %v", version)
+	send(yggdrasil.EventNameUpdated, details)
+
+	switch r.restart {
+	case restartExec:
+		send(yggdrasil.EventNameUpdateProgress, map[string]string{"method": r.method, "stage": updateStageRestarting})
+		requestRestart()
+	case restartSchedule:
+		if err := scheduleRestart(ctx, r.delay); err != nil {
+			fail(updateStageRestarting, err)
+			return
+		}
+		log.Infof("restart scheduled in %v", r.delay)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+)
+
+func TestParseUpdateArguments(t *testing.T) {
+	signature := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+	checksum := fmt.Sprintf("sha256:%x", sha256.Sum256(nil))
+
+	tests := []struct {
+		description string
+		input       map[string]string
+		wantRestart string
+		wantDelay   time.Duration
+		wantError   bool
+	}{
+		{
+			description: "binary",
+			input:       map[string]string{"method": "binary", "url": "https://example.com/yggd", "checksum": checksum, "signature": signature},
+			wantRestart: defaultRestart,
+			wantDelay:   defaultRestartDelay,
+		},
+		{
+			description: "binary without signature",
+			input:       map[string]string{"method": "binary", "url": "https://example.com/yggd", "checksum": checksum},
+			wantError:   true,
+		},
+		{
+			description: "binary without checksum",
+			input:       map[string]string{"method": "binary", "url": "https://example.com/yggd", "signature": signature},
+			wantError:   true,
+		},
+		{
+			description: "dnf without restart",
+			input:       map[string]string{"method": "dnf", "restart": "none"},
+			wantRestart: restartNone,
+			wantDelay:   defaultRestartDelay,
+		},
+		{
+			description: "rpm-ostree",
+			input:       map[string]string{"method": "rpm-ostree"},
+			wantRestart: restartNone,
+			wantDelay:   defaultRestartDelay,
+		},
+		{
+			description: "rpm-ostree with restart",
+			input:       map[string]string{"method": "rpm-ostree", "restart": "exec"},
+			wantError:   true,
+		},
+		{
+			description: "unknown method",
+			input:       map[string]string{"method": "apt"},
+			wantError:   true,
+		},
+		{
+			description: "unknown restart",
+			input:       map[string]string{"method": "dnf", "restart": "reboot"},
+			wantError:   true,
+		},
+		{
+			description: "invalid delay",
+			input:       map[string]string{"method": "dnf", "restart": "none", "delay": "-1s"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseUpdateArguments(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.restart != test.wantRestart {
+				t.Errorf("restart = %v, want %v", got.restart, test.wantRestart)
+			}
+			if got.delay != test.wantDelay {
+				t.Errorf("delay = %v, want %v", got.delay, test.wantDelay)
+			}
+		})
+	}
+}
+
+func TestUpdateBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test executables are shell scripts")
+	}
+	executable := []byte("#!/bin/sh\necho yggd version 2.0.0\n")
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write(executable)
+	}))
+	defer server.Close()
+	client := http.NewHTTPClient(nil, "test", dialer.New(dialer.DefaultTimeouts))
+
+	tests := []struct {
+		description string
+		signature   []byte
+		wantVersion string
+		wantStage   string
+	}{
+		{
+			description: "trusted signature",
+			signature:   ed25519.Sign(private, executable),
+			wantVersion: "2.0.0",
+		},
+		{
+			description: "untrusted signature",
+			signature:   ed25519.Sign(other, executable),
+			wantStage:   updateStageVerifying,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-update-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			defer func(old string) { yggdrasil.SysconfDir = old }(yggdrasil.SysconfDir)
+			yggdrasil.SysconfDir = filepath.Join(dir, "etc")
+			defer func(old string) { yggdrasil.LocalstateDir = old }(yggdrasil.LocalstateDir)
+			yggdrasil.LocalstateDir = filepath.Join(dir, "var")
+			if err := os.MkdirAll(updateKeysDir(), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(updateKeysDir(), "vendor.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+				t.Fatal(err)
+			}
+			exe := filepath.Join(dir, "yggd")
+			if err := ioutil.WriteFile(exe, []byte("#!/bin/sh\necho yggd version 1.0.0\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			d := newDispatcher(client, 1, 0, 10)
+			r := updateRequest{
+				method:    updateBinary,
+				url:       server.URL,
+				checksum:  fmt.Sprintf("sha256:%x", sha256.Sum256(executable)),
+				signature: test.signature,
+			}
+			var stages []string
+			version, err := d.runUpdate(context.Background(), r, exe, func(stage string) {
+				stages = append(stages, stage)
+			})
+
+			got, readErr := ioutil.ReadFile(exe)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if test.wantStage != "" {
+				var e *updateError
+				if !errors.As(err, &e) || e.stage != test.wantStage {
+					t.Errorf("error = %v, want error at stage %v", err, test.wantStage)
+				}
+				if strings.Contains(string(got), "2.0.0") {
+					t.Error("executable replaced")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != test.wantVersion {
+				t.Errorf("version = %v, want %v", version, test.wantVersion)
+			}
+			if string(got) != string(executable) {
+				t.Errorf("executable = %q, want %q", got, executable)
+			}
+			if _, err := os.Stat(exe + ".old"); err != nil {
+				t.Errorf("previous executable not kept: %v", err)
+			}
+			wantStages := []string{updateStageDownloading, updateStageVerifying, updateStageInstalling}
+			if !cmp.Equal(stages, wantStages) {
+				t.Errorf("%#v", cmp.Diff(stages, wantStages))
+			}
+		})
+	}
+}
+
+func TestUpdateDNF(t *testing.T) {
+	defer func(f func(context.Context, string, ...string) ([]byte, error)) { runUpdateCommand = f }(runUpdateCommand)
+	var commands []string
+	runUpdateCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		if name == "rpm" {
+			return []byte("0.3.0-1.el9\n"), nil
+		}
+		return nil, nil
+	}
+
+	d := newDispatcher(nil, 1, 0, 10)
+	version, err := d.runUpdate(context.Background(), updateRequest{method: updateDNF, version: "0.3.0"}, "", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "0.3.0-1.el9" {
+		t.Errorf("version = %v, want 0.3.0-1.el9", version)
+	}
+	wantCommands := []string{
+		"dnf --assumeyes --setopt=gpgcheck=1 upgrade yggdrasil-0.3.0",
+		"rpm --query --queryformat %{VERSION}-%{RELEASE} yggdrasil",
+	}
+	if !cmp.Equal(commands, wantCommands) {
+		t.Errorf("%#v", cmp.Diff(commands, wantCommands))
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+)
+
+// A progressReader logs the progress of reading size bytes from r, every
+// tenth of the total.
+type progressReader struct {
+	r    io.Reader
+	name string
+	size int64
+	read int64
+	next int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.size > 0 && p.read*10 >= p.next*p.size {
+		log.Debugf("uploaded %v of %v bytes of %v", p.read, p.size, p.name)
+		p.next = p.read*10/p.size + 1
+	}
+	return n, err
+}
+
+// uploadURL returns the URL the file offloaded from the message with the
+// given ID is uploaded to.
+func uploadURL(base, clientID, messageID string) (string, error) {
+	URL, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse upload URL: %w", err)
+	}
+	if yggdrasil.DataHost != "" {
+		URL.Host = yggdrasil.DataHost
+	}
+	URL.Path = path.Join(URL.Path, clientID, messageID)
+	return URL.String(), nil
+}
+
+// uploadFile uploads the file at filePath to URL and returns a reference to
+// the uploaded content.
+func uploadFile(client *http.Client, URL, filePath string) (yggdrasil.ContentReference, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return yggdrasil.ContentReference{}, fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+	return upload(client, URL, f)
+}
+
+// upload uploads the content of f, from its start, to URL and returns a
+// reference to the uploaded content.
+func upload(client *http.Client, URL string, f *os.File) (yggdrasil.ContentReference, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return yggdrasil.ContentReference{}, fmt.Errorf("cannot seek file: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return yggdrasil.ContentReference{}, fmt.Errorf("cannot compute digest: %w", err)
+	}
+	digest := h.Sum(nil)
+	ref := yggdrasil.ContentReference{
+		URL:      URL,
+		Checksum: fmt.Sprintf("sha256:%x", digest),
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ref, fmt.Errorf("cannot seek file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return ref, fmt.Errorf("cannot stat file: %w", err)
+	}
+	ref.Size = info.Size()
+
+	body := &progressReader{r: f, name: f.Name(), size: ref.Size}
+	headers := map[string]string{
+		"Content-Type": "application/octet-stream",
+		"Digest":       "sha-256=" + base64.StdEncoding.EncodeToString(digest),
+	}
+	if err := client.Put(URL, headers, body, ref.Size); err != nil {
+		return ref, err
+	}
+
+	return ref, nil
+}
+
+// createUploadDir creates the upload directory of the worker w, only
+// accessible to the user and group it runs as, if it does not exist.
+func createUploadDir(w worker) error {
+	if !validPathElement(w.handler) {
+		return fmt.Errorf("cannot create upload directory: invalid handler %q", w.handler)
+	}
+	uid, gid := -1, -1
+	if m := manifestForPID(w.pid); m != nil {
+		var err error
+		uid, gid, err = m.owner()
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := yggdrasil.WorkerUploadDir(w.handler)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("cannot create upload directory: %w", err)
+	}
+	if uid != -1 {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return fmt.Errorf("cannot change owner of upload directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// workerUID returns the uid the worker w runs as: the user of its manifest,
+// if any, or else the user of yggd.
+func workerUID(w worker) (int, error) {
+	if m := manifestForPID(w.pid); m != nil {
+		uid, _, err := m.owner()
+		if err != nil || uid != -1 {
+			return uid, err
+		}
+	}
+	return os.Getuid(), nil
+}
+
+// openUpload opens the file at filePath that a worker running as uid asked to
+// offload. The file must be a regular file owned by uid, directly in dir, the
+// upload directory of the worker. It is opened without following symbolic
+// links and checked once open, so that it cannot be replaced in between.
+func openUpload(dir string, uid int, filePath string) (*os.File, error) {
+	if !filepath.IsAbs(filePath) || filepath.Dir(filepath.Clean(filePath)) != filepath.Clean(dir) {
+		return nil, fmt.Errorf("%v is not in upload directory %v", filePath, dir)
+	}
+	f, err := os.OpenFile(filePath, os.O_RDONLY|openUploadFlags, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("%v is not a regular file", filePath)
+	}
+	if owner := fileOwner(info); owner != uid {
+		f.Close()
+		return nil, fmt.Errorf("%v is owned by uid %v, not %v", filePath, owner, uid)
+	}
+	return f, nil
+}
+
+// offload uploads f, the file whose path a worker set in the metadata of
+// data, then publishes data with a reference to the uploaded content in place
+// of the file, and closes f. Failed uploads are retried like failed
+// deliveries; if all attempts fail, an "upload-failed" event is published.
+func (d *dispatcher) offload(data yggdrasil.Data, f *os.File) {
+	defer f.Close()
+
+	URL, err := uploadURL(d.uploadURL, ClientID, data.MessageID)
+	if err != nil {
+		log.Errorf("cannot upload content of message %v: %v", data.MessageID, err)
+		d.uploadFailed(data, err)
+		return
+	}
+
+	var ref yggdrasil.ContentReference
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		if attempt > 1 {
+			delay := backoff(d.retryInterval, attempt-1)
+			log.Debugf("retrying upload of message %v in %v (attempt %v of %v)", data.MessageID, delay, attempt, d.maxAttempts)
+			time.Sleep(delay)
+		}
+		d.transfers.wait()
+
+		ref, err = upload(d.httpClient, URL, f)
+		if err == nil {
+			break
+		}
+		log.Errorf("cannot upload content of message %v: %v", data.MessageID, err)
+		lasterror.Set(lasterror.DataPlane, err)
+	}
+	if err != nil {
+		d.uploadFailed(data, err)
+		return
+	}
+	log.Infof("uploaded content of message %v to %v", data.MessageID, ref.URL)
+
+	content, err := json.Marshal(ref)
+	if err != nil {
+		log.Errorf("cannot marshal content reference: %v", err)
+		return
+	}
+	metadata := make(map[string]string, len(data.Metadata))
+	for k, v := range data.Metadata {
+		metadata[k] = v
+	}
+	delete(metadata, yggdrasil.MetadataKeyContentPath)
+	metadata[yggdrasil.MetadataKeyContentReference] = "true"
+	data.Metadata = metadata
+	data.Content = content
+
+	if !d.enqueue(d.recvQ, "receive", data) {
+		d.uploadFailed(data, fmt.Errorf("receive queue is full"))
+	}
+}
+
+// uploadFailed publishes an "upload-failed" event for data.
+func (d *dispatcher) uploadFailed(data yggdrasil.Data, err error) {
+	d.events <- yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: data.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameUploadFailed),
+		Details: map[string]string{
+			"directive": data.Directive,
+			"attempts":  strconv.Itoa(d.maxAttempts),
+			"error":     err.Error(),
+		},
+	}
+}
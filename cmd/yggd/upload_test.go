@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+)
+
+func TestUploadURL(t *testing.T) {
+	got, err := uploadURL("https://example.com/api/upload/", "client", "message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://example.com/api/upload/client/message"
+	if got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	payload := []byte("result")
+	filePath := filepath.Join(dir, "result")
+	if err := ioutil.WriteFile(filePath, payload, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var uploaded []byte
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		if r.Method != nethttp.MethodPut {
+			w.WriteHeader(nethttp.StatusMethodNotAllowed)
+			return
+		}
+		uploaded, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	client := http.NewHTTPClient(nil, "test", dialer.New(dialer.DefaultTimeouts))
+
+	got, err := uploadFile(client, server.URL+"/client/message", filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := yggdrasil.ContentReference{
+		URL:      server.URL + "/client/message",
+		Checksum: fmt.Sprintf("sha256:%x", sha256.Sum256(payload)),
+		Size:     int64(len(payload)),
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+	if string(uploaded) != string(payload) {
+		t.Errorf("%q != %q", uploaded, payload)
+	}
+}
+
+func TestOpenUpload(t *testing.T) {
+	root, err := ioutil.TempDir("", "yggd-upload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "echo")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(dir, "result"), filepath.Join(root, "secret")} {
+		if err := ioutil.WriteFile(name, []byte("result"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "secret"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	uid := os.Getuid()
+
+	tests := []struct {
+		description string
+		path        string
+		uid         int
+		wantError   bool
+	}{
+		{
+			description: "file in upload directory",
+			path:        filepath.Join(dir, "result"),
+			uid:         uid,
+		},
+		{
+			description: "file outside upload directory",
+			path:        filepath.Join(root, "secret"),
+			uid:         uid,
+			wantError:   true,
+		},
+		{
+			description: "relative path out of upload directory",
+			path:        filepath.Join(dir, "..", "secret"),
+			uid:         uid,
+			wantError:   true,
+		},
+		{
+			description: "symbolic link",
+			path:        filepath.Join(dir, "link"),
+			uid:         uid,
+			wantError:   true,
+		},
+		{
+			description: "directory",
+			path:        filepath.Join(dir, "subdir"),
+			uid:         uid,
+			wantError:   true,
+		},
+		{
+			description: "file of another user",
+			path:        filepath.Join(dir, "result"),
+			uid:         uid + 1,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			f, err := openUpload(dir, test.uid, test.path)
+			if err == nil {
+				f.Close()
+			}
+			if (err != nil) != test.wantError {
+				t.Errorf("error = %v, want error %v", err, test.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// openUploadFlags make opening a file to offload fail if it is a symbolic
+// link, and not block if it is a FIFO.
+const openUploadFlags = syscall.O_NOFOLLOW | syscall.O_NONBLOCK
+
+// fileOwner returns the uid of the owner of the file described by info.
+func fileOwner(info os.FileInfo) int {
+	return int(info.Sys().(*syscall.Stat_t).Uid)
+}
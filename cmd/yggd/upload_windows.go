@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+// openUploadFlags is empty: Windows cannot refuse to follow symbolic links
+// when opening a file.
+const openUploadFlags = 0
+
+// fileOwner returns -1, the uid of every process on Windows, where files
+// have no owner uid.
+func fileOwner(info os.FileInfo) int {
+	return -1
+}
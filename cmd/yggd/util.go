@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 func init() {
@@ -89,3 +96,125 @@ func setClientID(data []byte, file string) error {
 	return nil
 
 }
+
+const (
+	// maxReconnectDelay is the longest delay a reconnect command may request.
+	maxReconnectDelay = time.Hour
+
+	// reconnectJitter is the largest fraction of the requested delay added at
+	// random, so that a fleet told to reconnect at once does not return at
+	// once.
+	reconnectJitter = 0.25
+)
+
+// parseReconnectDelay parses the "delay" argument of a reconnect command. It
+// accepts a duration string ("30s", "5m") or, for compatibility, a bare number
+// of seconds. An empty value is a delay of 0. Negative delays and delays
+// longer than maxReconnectDelay are rejected.
+func parseReconnectDelay(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds > int64(maxReconnectDelay/time.Second) {
+			return 0, fmt.Errorf("delay %vs exceeds maximum of %v", seconds, maxReconnectDelay)
+		}
+		delay = time.Duration(seconds) * time.Second
+	} else {
+		delay, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse delay: %v", value)
+		}
+	}
+
+	if delay < 0 {
+		return 0, fmt.Errorf("delay %v is negative", value)
+	}
+	if delay > maxReconnectDelay {
+		return 0, fmt.Errorf("delay %v exceeds maximum of %v", delay, maxReconnectDelay)
+	}
+
+	return delay, nil
+}
+
+// jitter returns delay increased by a random amount of up to fraction of
+// delay.
+func jitter(delay time.Duration, fraction float64) time.Duration {
+	return delay + time.Duration(rand.Float64()*fraction*float64(delay))
+}
+
+// dmiProductUUIDPath is the path of the file holding the system UUID read
+// from the DMI tables.
+var dmiProductUUIDPath = "/sys/class/dmi/id/product_uuid"
+
+// clientIDCommandTimeout is the time the client-id command may run for.
+const clientIDCommandTimeout = 30 * time.Second
+
+// validateClientID checks that id can be used as a client ID, which is part
+// of the topics the client subscribes and publishes to.
+func validateClientID(id string) error {
+	if id == "" {
+		return fmt.Errorf("client ID is empty")
+	}
+	if strings.ContainsAny(id, "/+# \t\r\n") {
+		return fmt.Errorf("client ID %q contains an invalid character", id)
+	}
+	return nil
+}
+
+// readDMIUUID returns the system UUID in the file at path, in lowercase. Nil
+// UUIDs, and the all-ones UUID set by some firmware, are rejected as they do
+// not identify the system.
+func readDMIUUID(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read file: %w", err)
+	}
+	id, err := uuid.Parse(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse system UUID: %w", err)
+	}
+	if id == uuid.Nil || id.String() == "ffffffff-ffff-ffff-ffff-ffffffffffff" {
+		return "", fmt.Errorf("system UUID %v is not set", id)
+	}
+	return id.String(), nil
+}
+
+// getHostnameID returns the host name of the system, rejecting names shared
+// by unconfigured systems.
+func getHostnameID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("cannot get hostname: %w", err)
+	}
+	switch hostname {
+	case "localhost", "localhost.localdomain":
+		return "", fmt.Errorf("hostname %v does not identify the system", hostname)
+	}
+	return hostname, validateClientID(hostname)
+}
+
+// runClientIDCommand runs command with the shell and returns its standard
+// output, stripped of surrounding white space, as the client ID.
+func runClientIDCommand(command string, timeout time.Duration) (string, error) {
+	if command == "" {
+		return "", fmt.Errorf("missing client-id-command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("cannot run client-id-command: %w: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	id := strings.TrimSpace(stdout.String())
+	return id, validateClientID(id)
+}
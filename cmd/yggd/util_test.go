@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseReconnectDelay(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        time.Duration
+		wantError   bool
+	}{
+		{description: "empty", input: "", want: 0},
+		{description: "seconds", input: "30", want: 30 * time.Second},
+		{description: "duration", input: "5m", want: 5 * time.Minute},
+		{description: "maximum", input: "1h", want: time.Hour},
+		{description: "negative seconds", input: "-5", wantError: true},
+		{description: "negative duration", input: "-5s", wantError: true},
+		{description: "too long", input: "90000", wantError: true},
+		{description: "overflow", input: "9223372036854775807", wantError: true},
+		{description: "invalid", input: "soon", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseReconnectDelay(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Errorf("%v != %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		got := jitter(time.Minute, 0.25)
+		if got < time.Minute || got > time.Minute+15*time.Second {
+			t.Fatalf("%v out of range", got)
+		}
+	}
+}
+
+func TestReadDMIUUID(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantError   bool
+	}{
+		{description: "valid", input: "4C4C4544-0042-3510-8052-B4C04F4A4E32\n", want: "4c4c4544-0042-3510-8052-b4c04f4a4e32"},
+		{description: "nil", input: "00000000-0000-0000-0000-000000000000\n", wantError: true},
+		{description: "all ones", input: "FFFFFFFF-FFFF-FFFF-FFFF-FFFFFFFFFFFF\n", wantError: true},
+		{description: "not settable", input: "Not Settable\n", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-dmi-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "product_uuid")
+			if err := ioutil.WriteFile(path, []byte(test.input), 0400); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readDMIUUID(path)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunClientIDCommand(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantError   bool
+	}{
+		{description: "output", input: "echo ' site-1234 '", want: "site-1234"},
+		{description: "empty output", input: "true", wantError: true},
+		{description: "invalid output", input: "echo site/1234", wantError: true},
+		{description: "failure", input: "exit 1", wantError: true},
+		{description: "timeout", input: "exec sleep 5", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := runClientIDCommand(test.input, time.Second)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
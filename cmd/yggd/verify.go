@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// VerificationMode represents accepted values for the "worker-verification"
+// option.
+type VerificationMode string
+
+const (
+	// VerificationOff starts workers without verifying them.
+	VerificationOff VerificationMode = "off"
+
+	// VerificationWarn logs a warning when a worker fails verification, but
+	// starts it anyway.
+	VerificationWarn VerificationMode = "warn"
+
+	// VerificationEnforce refuses to start workers that fail verification.
+	VerificationEnforce VerificationMode = "enforce"
+)
+
+// WorkerVerification is the verification mode applied before starting a
+// worker.
+var WorkerVerification = VerificationOff
+
+// workerDigestsFile returns the path of the file listing the expected digests
+// of worker files. Each line holds a digest and an absolute path, separated
+// by white space, in the format written by "sha256sum" (a hex SHA-256 digest
+// of the file content) or "fsverity measure" (a "sha256:" prefixed fs-verity
+// file digest).
+func workerDigestsFile() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "worker-digests")
+}
+
+// readDigests parses the worker digests from r, keyed by path.
+func readDigests(r io.Reader) (map[string]string, error) {
+	digests := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line: %v", line)
+		}
+		// sha256sum marks files read in binary mode with a leading '*'.
+		digests[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// verifyDigest checks data, the content of f, opened from file, against the
+// digest listed for file in digests. An fs-verity digest is measured on f,
+// whose content cannot change once fs-verity is enabled.
+func verifyDigest(file string, f *os.File, data []byte, digests map[string]string) error {
+	want, prs := digests[file]
+	if !prs {
+		return fmt.Errorf("no digest listed for %v", file)
+	}
+
+	var got string
+	if strings.HasPrefix(want, "sha256:") {
+		digest, err := measureVerity(f)
+		if err != nil {
+			return fmt.Errorf("cannot measure fs-verity digest: %w", err)
+		}
+		got = "sha256:" + hex.EncodeToString(digest)
+	} else {
+		sum := sha256.Sum256(data)
+		got = hex.EncodeToString(sum[:])
+	}
+
+	if got != want {
+		return fmt.Errorf("digest mismatch for %v: expected %v, got %v", file, want, got)
+	}
+	return nil
+}
+
+// workerKeysDir returns the directory holding the public keys trusted to sign
+// worker files, each a PEM encoded Ed25519 public key in a ".pem" file.
+func workerKeysDir() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "worker-keys.d")
+}
+
+// readPublicKeys reads the Ed25519 public keys in the ".pem" files of dir.
+func readPublicKeys(dir string) ([]ed25519.PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ed25519.PublicKey
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read file: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("no public key found in %v", file)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key in %v: %w", file, err)
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key in %v is not an Ed25519 key", file)
+		}
+		keys = append(keys, edKey)
+	}
+	return keys, nil
+}
+
+// verifySignature checks data, the content of file, against the detached
+// signature of file, the raw Ed25519 signature of its content in file +
+// ".sig", as written by "openssl pkeyutl -sign -rawin". The signature must
+// have been made with the private key of one of keys.
+func verifySignature(file string, data []byte, keys []ed25519.PublicKey) error {
+	signature, err := ioutil.ReadFile(file + ".sig")
+	if err != nil {
+		return fmt.Errorf("cannot read signature: %w", err)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature size %v", len(signature))
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, data, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature of %v was not made with a trusted key", file)
+}
+
+// verifyWorker verifies file, the executable or container description a
+// worker is started from, according to WorkerVerification. It returns an
+// error if the worker must not be started.
+func verifyWorker(file string) error {
+	if WorkerVerification == VerificationOff {
+		return nil
+	}
+	_, err := readVerified(file)
+	return err
+}
+
+// readVerified reads file, such as a worker manifest or seccomp filter, and
+// verifies its content according to WorkerVerification. A file with a
+// detached signature is verified against the trusted keys; any other file
+// against the listed digests. The content returned is the one verified, so a
+// file replaced after it was verified is never used. It returns an error if
+// the file must not be used.
+func readVerified(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+	if WorkerVerification == VerificationOff {
+		return data, nil
+	}
+
+	err = func() error {
+		if _, err := os.Stat(file + ".sig"); err == nil {
+			keys, err := readPublicKeys(workerKeysDir())
+			if err != nil {
+				return fmt.Errorf("cannot read worker keys: %w", err)
+			}
+			return verifySignature(file, data, keys)
+		}
+
+		digestsFile, err := os.Open(workerDigestsFile())
+		if err != nil {
+			return fmt.Errorf("cannot read worker digests: %w", err)
+		}
+		defer digestsFile.Close()
+
+		digests, err := readDigests(digestsFile)
+		if err != nil {
+			return fmt.Errorf("cannot parse worker digests: %w", err)
+		}
+		return verifyDigest(file, f, data, digests)
+	}()
+	if err == nil {
+		log.Debugf("verified %v", file)
+		return data, nil
+	}
+
+	if WorkerVerification == VerificationWarn {
+		log.Warnf("worker verification failed: %v", err)
+		return data, nil
+	}
+	return nil, fmt.Errorf("worker verification failed: %w", err)
+}
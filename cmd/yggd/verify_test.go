@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestReadDigests(t *testing.T) {
+	input := `# worker digests
+11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437  /usr/libexec/yggdrasil/echo-worker
+sha256:0d0a2e71bbc16c5b3cbe4e3eadd0bea1ce5ecf60d9ee8f3e0e9a4b7e0bdc4ef1 /usr/libexec/yggdrasil/foo-worker
+
+C0FFEE *relative-worker
+`
+	want := map[string]string{
+		"/usr/libexec/yggdrasil/echo-worker": "11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437",
+		"/usr/libexec/yggdrasil/foo-worker":  "sha256:0d0a2e71bbc16c5b3cbe4e3eadd0bea1ce5ecf60d9ee8f3e0e9a4b7e0bdc4ef1",
+		"relative-worker":                    "c0ffee",
+	}
+
+	got, err := readDigests(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+
+	if _, err := readDigests(strings.NewReader("c0ffee")); err == nil {
+		t.Errorf("expected error for line without path")
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-digests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "echo-worker")
+	if err := ioutil.WriteFile(file, []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		input       map[string]string
+		wantError   bool
+	}{
+		{
+			description: "match",
+			input:       map[string]string{file: "11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437"},
+		},
+		{
+			description: "mismatch",
+			input:       map[string]string{file: "0000000000000000000000000000000000000000000000000000000000000000"},
+			wantError:   true,
+		},
+		{
+			description: "not listed",
+			input:       map[string]string{},
+			wantError:   true,
+		},
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := verifyDigest(file, f, []byte("new"), test.input)
+
+			if test.wantError && err == nil {
+				t.Errorf("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-keys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "vendor.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := readPublicKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "echo-worker")
+	if err := ioutil.WriteFile(file, []byte("new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		signature   []byte
+		keys        []ed25519.PublicKey
+		wantError   bool
+	}{
+		{
+			description: "valid",
+			signature:   ed25519.Sign(private, []byte("new")),
+			keys:        keys,
+		},
+		{
+			description: "other content",
+			signature:   ed25519.Sign(private, []byte("old")),
+			keys:        keys,
+			wantError:   true,
+		},
+		{
+			description: "untrusted key",
+			signature:   ed25519.Sign(private, []byte("new")),
+			keys:        []ed25519.PublicKey{other},
+			wantError:   true,
+		},
+		{
+			description: "truncated",
+			signature:   []byte("short"),
+			keys:        keys,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if err := ioutil.WriteFile(file+".sig", test.signature, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := verifySignature(file, []byte("new"), test.keys)
+
+			if test.wantError && err == nil {
+				t.Errorf("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestReadVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-digests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sysconfDir, mode := yggdrasil.SysconfDir, WorkerVerification
+	defer func() { yggdrasil.SysconfDir, WorkerVerification = sysconfDir, mode }()
+	yggdrasil.SysconfDir = dir
+
+	file := filepath.Join(dir, "echo.toml")
+	if err := os.MkdirAll(filepath.Dir(workerDigestsFile()), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(workerDigestsFile(), []byte("11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437 "+file+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		mode        VerificationMode
+		content     string
+		want        string
+		wantError   bool
+	}{
+		{
+			description: "verified",
+			mode:        VerificationEnforce,
+			content:     "new",
+			want:        "new",
+		},
+		{
+			description: "replaced",
+			mode:        VerificationEnforce,
+			content:     "old",
+			wantError:   true,
+		},
+		{
+			description: "replaced with warn",
+			mode:        VerificationWarn,
+			content:     "old",
+			want:        "old",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			WorkerVerification = test.mode
+			if err := ioutil.WriteFile(file, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readVerified(file)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("%q != %q", got, test.want)
+			}
+		})
+	}
+}
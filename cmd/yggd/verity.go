@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fsIocMeasureVerity is the FS_IOC_MEASURE_VERITY ioctl request.
+const fsIocMeasureVerity = 0xc0046686
+
+// measureVerity returns the fs-verity SHA-256 digest of f. It fails if
+// fs-verity is not enabled on the file.
+func measureVerity(f *os.File) ([]byte, error) {
+	// struct fsverity_digest { __u16 digest_algorithm; __u16 digest_size; __u8 digest[]; }
+	buf := make([]byte, 4+64)
+	binary.LittleEndian.PutUint16(buf[2:], 64)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocMeasureVerity, uintptr(unsafe.Pointer(&buf[0]))); errno != 0 {
+		return nil, errno
+	}
+
+	if algorithm := binary.LittleEndian.Uint16(buf[0:]); algorithm != 1 {
+		return nil, fmt.Errorf("unsupported fs-verity digest algorithm: %v", algorithm)
+	}
+	size := binary.LittleEndian.Uint16(buf[2:])
+	return buf[4 : 4+size], nil
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// measureVerity fails: fs-verity is not available on Windows.
+func measureVerity(f *os.File) ([]byte, error) {
+	return nil, fmt.Errorf("fs-verity is not supported on Windows")
+}
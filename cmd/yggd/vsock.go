@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	"google.golang.org/grpc/peer"
+)
+
+// vmPollInterval is the interval at which the dispatcher checks whether the
+// workers running in virtual machines still accept connections.
+const vmPollInterval = 10 * time.Second
+
+// minVMWorkerPort is the lowest VM socket port assigned to workers running in
+// virtual machines; lower ports are privileged in the guest.
+const minVMWorkerPort = 1024
+
+// lastVMPID is the last pseudo PID assigned to a worker running in a virtual
+// machine.
+var lastVMPID int32
+
+// nextVMPID returns a pseudo PID identifying a worker running in a virtual
+// machine, whose PID is only meaningful in its guest. Pseudo PIDs are negative
+// so that they cannot be mistaken for the PID of a process on the host.
+func nextVMPID() int {
+	return -int(atomic.AddInt32(&lastVMPID, 1))
+}
+
+// vmWorkerAddr returns a VM socket address for a worker running in the
+// virtual machine with context ID cid to listen on.
+func vmWorkerAddr(cid uint32) string {
+	return ipc.VsockAddr(cid, minVMWorkerPort+uint32(rand.Int31n(1<<30)))
+}
+
+// peerVsockCID returns the context ID of the virtual machine that made the
+// call of ctx, if the call was made over a VM socket.
+func peerVsockCID(ctx context.Context) (uint32, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+	return ipc.PeerVsockCID(p.Addr)
+}
+
+// watchVM checks that the worker with pseudo PID pid, which runs in a virtual
+// machine, still accepts connections at addr, and unregisters it once it
+// does not.
+func (d *dispatcher) watchVM(pid int, addr string) {
+	for {
+		time.Sleep(vmPollInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), vmPollInterval)
+		conn, err := ipc.DialContext(ctx, addr)
+		cancel()
+		if err != nil {
+			log.Debugf("cannot connect to worker at %v: %v", addr, err)
+			d.deadWorkers <- pid
+			return
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	"github.com/redhatinsights/yggdrasil/internal/wake"
+)
+
+// wakeRetryInterval is the interval at which a wake trigger that failed, or
+// whose command exited, is watched again.
+const wakeRetryInterval = 10 * time.Second
+
+// wakeMetrics holds the number of wake "signals" received.
+var wakeMetrics = expvar.NewMap("wake")
+
+// watchWake watches trigger for wake signals, waking t for each of them.
+func watchWake(trigger wake.Trigger, t transport.Transport, duration time.Duration) {
+	log.Infof("watching %v for wake signals", trigger)
+	for {
+		err := trigger.Watch(func(reason string) {
+			wakeTransport(t, reason, duration)
+		})
+		log.Errorf("cannot watch %v for wake signals: %v", trigger, err)
+		time.Sleep(wakeRetryInterval)
+	}
+}
+
+// wakeTransport connects t for at least duration, if it is kept
+// disconnected, and asks it to poll the server now, if it polls.
+func wakeTransport(t transport.Transport, reason string, duration time.Duration) {
+	wakeMetrics.Add("signals", 1)
+	log.Infof("woken by signal %q", reason)
+	if gate != nil {
+		if err := gate.wake(time.Now(), duration); err != nil {
+			log.Errorf("cannot connect transport after wake signal: %v", err)
+			return
+		}
+	}
+	if w, ok := t.(transport.Waker); ok {
+		w.Wake()
+	}
+}
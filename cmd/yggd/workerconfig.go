@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// maxWorkerConfigSize is the largest worker configuration accepted, in bytes.
+const maxWorkerConfigSize = 1 << 20
+
+// validateWorkerConfig checks that config names a valid directive and that its
+// content is a JSON object of acceptable size.
+func validateWorkerConfig(config yggdrasil.WorkerConfig) error {
+	if config.Directive == "" || config.Directive == "." || config.Directive == ".." ||
+		strings.ContainsAny(config.Directive, `/\`) {
+		return fmt.Errorf("invalid directive %q", config.Directive)
+	}
+	if len(config.Content) > maxWorkerConfigSize {
+		return fmt.Errorf("configuration exceeds %v bytes", maxWorkerConfigSize)
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(config.Content, &content); err != nil || content == nil {
+		return fmt.Errorf("configuration is not a JSON object")
+	}
+	return nil
+}
+
+// writeWorkerConfig replaces the file at path with content atomically,
+// returning the previous content of the file, or nil if it did not exist.
+func writeWorkerConfig(path string, content []byte) ([]byte, error) {
+	previous, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return nil, fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, fmt.Errorf("cannot rename file: %w", err)
+	}
+	return previous, nil
+}
+
+// restoreWorkerConfig puts back the previous content of the file at path, as
+// returned by writeWorkerConfig.
+func restoreWorkerConfig(path string, previous []byte) error {
+	if previous == nil {
+		return os.Remove(path)
+	}
+	_, err := writeWorkerConfig(path, previous)
+	return err
+}
+
+// configure validates and persists the configuration pushed by the server,
+// then delivers it to the worker, if one is registered for its directive. If
+// the worker rejects it, the previous configuration is restored. An event
+// reporting the outcome is published in response.
+func (d *dispatcher) configure(config yggdrasil.WorkerConfig) {
+	if err := validateWorkerConfig(config); err != nil {
+		log.Errorf("rejecting configuration %v: %v", config.MessageID, err)
+		d.events <- configEvent(config, false, err)
+		return
+	}
+
+	path := yggdrasil.WorkerConfigPath(config.Directive)
+	previous, err := writeWorkerConfig(path, config.Content)
+	if err != nil {
+		log.Errorf("cannot persist configuration %v: %v", config.MessageID, err)
+		d.events <- configEvent(config, false, err)
+		return
+	}
+	log.Infof("persisted configuration for directive %v to %v", config.Directive, path)
+
+	d.RLock()
+	w, prs := d.workers[config.Directive]
+	d.RUnlock()
+	if !prs {
+		d.events <- configEvent(config, false, nil)
+		return
+	}
+
+	if err := configureWorker(w, config.Content, path); err != nil {
+		log.Errorf("worker %v rejected configuration %v: %v", w.handler, config.MessageID, err)
+		if err := restoreWorkerConfig(path, previous); err != nil {
+			log.Errorf("cannot restore previous configuration of directive %v: %v", config.Directive, err)
+		}
+		d.events <- configEvent(config, true, err)
+		return
+	}
+	d.events <- configEvent(config, true, nil)
+}
+
+// configureWorker calls the "Configure" method of the worker w.
+func configureWorker(w worker, config []byte, path string) error {
+	conn, err := ipc.Dial(w.addr)
+	if err != nil {
+		return fmt.Errorf("cannot dial socket: %w", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewWorkerClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.Configure(ctx, &pb.ConfigureRequest{Config: config, Path: path}); err != nil {
+		return fmt.Errorf("cannot configure worker: %w", err)
+	}
+	return nil
+}
+
+// configEvent returns the event responding to config. delivered reports
+// whether the configuration was sent to a running worker; err is the reason
+// it was rejected, if it was.
+func configEvent(config yggdrasil.WorkerConfig, delivered bool, err error) yggdrasil.Event {
+	event := yggdrasil.Event{
+		Type:       yggdrasil.MessageTypeEvent,
+		MessageID:  uuid.New().String(),
+		ResponseTo: config.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Content:    string(yggdrasil.EventNameConfigApplied),
+		Details: map[string]string{
+			"directive": config.Directive,
+			"delivered": strconv.FormatBool(delivered),
+		},
+	}
+	if err != nil {
+		event.Content = string(yggdrasil.EventNameConfigRejected)
+		event.Details["error"] = err.Error()
+	}
+	return event
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestValidateWorkerConfig(t *testing.T) {
+	tests := []struct {
+		description string
+		input       yggdrasil.WorkerConfig
+		wantError   bool
+	}{
+		{
+			description: "object",
+			input:       yggdrasil.WorkerConfig{Directive: "echo", Content: []byte(`{"interval":5}`)},
+		},
+		{
+			description: "missing directive",
+			input:       yggdrasil.WorkerConfig{Content: []byte(`{}`)},
+			wantError:   true,
+		},
+		{
+			description: "directive with path separator",
+			input:       yggdrasil.WorkerConfig{Directive: "../echo", Content: []byte(`{}`)},
+			wantError:   true,
+		},
+		{
+			description: "array",
+			input:       yggdrasil.WorkerConfig{Directive: "echo", Content: []byte(`[1, 2]`)},
+			wantError:   true,
+		},
+		{
+			description: "null",
+			input:       yggdrasil.WorkerConfig{Directive: "echo", Content: []byte(`null`)},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := validateWorkerConfig(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+			} else {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteWorkerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "echo", "config.json")
+
+	previous, err := writeWorkerConfig(path, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous != nil {
+		t.Errorf("unexpected previous configuration: %s", previous)
+	}
+
+	previous, err = writeWorkerConfig(path, []byte(`{"a":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(previous) != `{"a":1}` {
+		t.Errorf("%s != %s", previous, `{"a":1}`)
+	}
+
+	if err := restoreWorkerConfig(path, previous); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `{"a":1}` {
+		t.Errorf("%s != %s", got, `{"a":1}`)
+	}
+
+	if err := restoreWorkerConfig(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected configuration to be removed, got %v", err)
+	}
+}
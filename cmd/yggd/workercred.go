@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// workerCredentialMetrics holds the number of credentials "issued" to workers
+// and the number of requests "denied".
+var workerCredentialMetrics = expvar.NewMap("worker_credentials")
+
+// GetCredential implements the "GetCredential" method of the Dispatcher gRPC
+// service, handing a registered worker a secret or identity token its
+// manifest allows. Workers not started from a manifest may request none.
+func (d *dispatcher) GetCredential(ctx context.Context, r *pb.CredentialRequest) (*pb.CredentialResponse, error) {
+	d.RLock()
+	w, prs := d.workers[r.GetHandler()]
+	d.RUnlock()
+	if !prs || w.vm || w.pid != int(r.GetPid()) {
+		return nil, fmt.Errorf("no worker with pid %v registered for handler %v", r.GetPid(), r.GetHandler())
+	}
+	if pid, ok := peerPID(ctx); ok && pid != w.pid {
+		workerCredentialMetrics.Add("denied", 1)
+		log.Warnf("denied credential request for worker %v from pid %v", r.GetHandler(), pid)
+		return nil, status.Error(codes.PermissionDenied, "credentials are only available to the process of the worker")
+	}
+
+	value, expires, err := d.issueCredential(manifestForPID(w.pid), r.GetHandler(), r, time.Now())
+	if err != nil {
+		workerCredentialMetrics.Add("denied", 1)
+		log.Warnf("denied credential request of worker %v: %v", r.GetHandler(), err)
+		return nil, err
+	}
+	workerCredentialMetrics.Add("issued", 1)
+	log.Debugf("issued credential to worker %v until %v", r.GetHandler(), expires.Format(time.RFC3339))
+	return &pb.CredentialResponse{Value: value, Expires: expires.Unix()}, nil
+}
+
+// issueCredential returns the credential r requests on behalf of the worker
+// registered for handler, started from the manifest m, and the time after
+// which it must be requested again.
+func (d *dispatcher) issueCredential(m *workerManifest, handler string, r *pb.CredentialRequest, now time.Time) ([]byte, time.Time, error) {
+	if (r.GetName() == "") == (r.GetAudience() == "") {
+		return nil, time.Time{}, status.Error(codes.InvalidArgument, "exactly one of name and audience must be set")
+	}
+	if m == nil {
+		return nil, time.Time{}, status.Error(codes.PermissionDenied, "credentials are only available to workers started from a manifest")
+	}
+
+	if name := r.GetName(); name != "" {
+		if !containsString(m.Secrets, name) {
+			return nil, time.Time{}, status.Errorf(codes.PermissionDenied, "secret %v not allowed by the worker manifest", name)
+		}
+		value, err := readCredential(name)
+		if err != nil {
+			return nil, time.Time{}, status.Error(codes.Unavailable, err.Error())
+		}
+		return value, now.Add(d.credentialLifetime), nil
+	}
+
+	audience := r.GetAudience()
+	if !containsString(m.TokenAudiences, audience) {
+		return nil, time.Time{}, status.Errorf(codes.PermissionDenied, "audience %v not allowed by the worker manifest", audience)
+	}
+	if d.identity == nil {
+		return nil, time.Time{}, status.Error(codes.FailedPrecondition, "no client certificate to sign identity tokens with")
+	}
+	token, expires, err := d.identity.Issue(handler, audience, now)
+	if err != nil {
+		return nil, time.Time{}, status.Errorf(codes.Internal, "cannot issue identity token: %v", err)
+	}
+	return []byte(token), expires, nil
+}
+
+// containsString reports whether s is one of list.
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
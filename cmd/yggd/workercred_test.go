@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil/internal/idtoken"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestIssueCredential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-workercred-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "vault-token"), []byte("s3cr3t"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(credentialsEnv)
+	os.Setenv(credentialsEnv, dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := &idtoken.Issuer{
+		ClientID:    "client",
+		Certificate: tls.Certificate{Certificate: [][]byte{[]byte("certificate")}, PrivateKey: key},
+		Lifetime:    time.Minute,
+	}
+	manifest := &workerManifest{Secrets: []string{"vault-token", "missing"}, TokenAudiences: []string{"vault"}}
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		description string
+		manifest    *workerManifest
+		identity    *idtoken.Issuer
+		request     *pb.CredentialRequest
+		wantValue   string
+		wantExpires time.Time
+		wantError   bool
+	}{
+		{
+			description: "secret",
+			manifest:    manifest,
+			request:     &pb.CredentialRequest{Name: "vault-token"},
+			wantValue:   "s3cr3t",
+			wantExpires: now.Add(5 * time.Minute),
+		},
+		{
+			description: "token",
+			manifest:    manifest,
+			identity:    identity,
+			request:     &pb.CredentialRequest{Audience: "vault"},
+			wantExpires: now.Add(time.Minute),
+		},
+		{
+			description: "secret not allowed",
+			manifest:    manifest,
+			request:     &pb.CredentialRequest{Name: "db-password"},
+			wantError:   true,
+		},
+		{
+			description: "missing secret",
+			manifest:    manifest,
+			request:     &pb.CredentialRequest{Name: "missing"},
+			wantError:   true,
+		},
+		{
+			description: "audience not allowed",
+			manifest:    manifest,
+			identity:    identity,
+			request:     &pb.CredentialRequest{Audience: "other"},
+			wantError:   true,
+		},
+		{
+			description: "no certificate",
+			manifest:    manifest,
+			request:     &pb.CredentialRequest{Audience: "vault"},
+			wantError:   true,
+		},
+		{
+			description: "no manifest",
+			request:     &pb.CredentialRequest{Name: "vault-token"},
+			wantError:   true,
+		},
+		{
+			description: "name and audience",
+			manifest:    manifest,
+			identity:    identity,
+			request:     &pb.CredentialRequest{Name: "vault-token", Audience: "vault"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil, 1, 0, 10)
+			d.credentialLifetime = 5 * time.Minute
+			d.identity = test.identity
+			value, expires, err := d.issueCredential(test.manifest, "echo", test.request, now)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %q", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantValue != "" && string(value) != test.wantValue {
+				t.Errorf("value = %q, want %q", value, test.wantValue)
+			}
+			if test.request.GetAudience() != "" && strings.Count(string(value), ".") != 2 {
+				t.Errorf("value = %q, want a token", value)
+			}
+			if !expires.Equal(test.wantExpires) {
+				t.Errorf("expires = %v, want %v", expires, test.wantExpires)
+			}
+		})
+	}
+}
+
+func TestGetCredentialUnregistered(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	d.workers["echo"] = worker{handler: "echo", pid: 1234}
+
+	for _, r := range []*pb.CredentialRequest{
+		{Handler: "echo", Pid: 4321, Name: "vault-token"},
+		{Handler: "other", Pid: 1234, Name: "vault-token"},
+	} {
+		if _, err := d.GetCredential(context.Background(), r); err == nil {
+			t.Errorf("credential issued for %v", r)
+		}
+	}
+}
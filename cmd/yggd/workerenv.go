@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// workerEnvFile returns the path of the file in which the variables set by
+// "set-env" commands are persisted.
+func workerEnvFile() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "worker-env.toml")
+}
+
+// A workerEnv holds per-directive variables set by the server with the
+// "set-env" command. The variables are passed to the worker as metadata on
+// every message dispatched to it afterwards, so worker behavior can be tuned
+// at runtime. Only variables whose name matches one of the allowed patterns
+// may be set.
+type workerEnv struct {
+	lock    sync.RWMutex
+	path    string
+	allowed []string
+	vars    map[string]map[string]string
+}
+
+// loadWorkerEnv reads the variables persisted at path, if any. Variables that
+// are no longer allowed are discarded.
+func loadWorkerEnv(path string, allowed []string) (*workerEnv, error) {
+	for _, pattern := range allowed {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid variable pattern %q: %w", pattern, err)
+		}
+	}
+
+	e := &workerEnv{
+		path:    path,
+		allowed: allowed,
+		vars:    make(map[string]map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return e, nil
+		}
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+	var vars map[string]map[string]string
+	if err := toml.Unmarshal(data, &vars); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal worker environment: %w", err)
+	}
+	for directive, env := range vars {
+		for name, value := range env {
+			if e.isAllowed(name) {
+				e.setLocked(directive, name, value)
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// isAllowed reports whether the variable name matches an allowed pattern.
+func (e *workerEnv) isAllowed(name string) bool {
+	for _, pattern := range e.allowed {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// set sets the variable name to value for directive, or removes it if value
+// is empty, and persists the result.
+func (e *workerEnv) set(directive, name, value string) error {
+	if directive == "" || name == "" {
+		return fmt.Errorf("missing directive or variable name")
+	}
+	if !e.isAllowed(name) {
+		return fmt.Errorf("variable %v is not allowed", name)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.setLocked(directive, name, value)
+
+	return e.save()
+}
+
+// setLocked sets or removes a variable. The caller must hold the lock.
+func (e *workerEnv) setLocked(directive, name, value string) {
+	if value == "" {
+		delete(e.vars[directive], name)
+		if len(e.vars[directive]) == 0 {
+			delete(e.vars, directive)
+		}
+		return
+	}
+	if e.vars[directive] == nil {
+		e.vars[directive] = make(map[string]string)
+	}
+	e.vars[directive][name] = value
+}
+
+// save writes the variables to the environment file, replacing it
+// atomically. The caller must hold the lock.
+func (e *workerEnv) save() error {
+	data, err := toml.Marshal(e.vars)
+	if err != nil {
+		return fmt.Errorf("cannot marshal worker environment: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(e.path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	tmp := e.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.Rename(tmp, e.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot replace file: %w", err)
+	}
+	return nil
+}
+
+// metadata returns a copy of metadata with the variables set for directive
+// added under the MetadataKeyEnvPrefix prefix. metadata is returned unchanged
+// if no variables are set.
+func (e *workerEnv) metadata(directive string, metadata map[string]string) map[string]string {
+	if e == nil {
+		return metadata
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	env := e.vars[directive]
+	if len(env) == 0 {
+		return metadata
+	}
+	m := make(map[string]string, len(metadata)+len(env))
+	for k, v := range metadata {
+		m[k] = v
+	}
+	for name, value := range env {
+		m[yggdrasil.MetadataKeyEnvPrefix+name] = value
+	}
+	return m
+}
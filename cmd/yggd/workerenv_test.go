@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWorkerEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-env-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "worker-env.toml")
+
+	e, err := loadWorkerEnv(path, []string{"LOG_*", "INTERVAL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		directive   string
+		name        string
+		value       string
+		wantError   bool
+	}{
+		{description: "allowed name", directive: "echo", name: "INTERVAL", value: "5"},
+		{description: "allowed pattern", directive: "echo", name: "LOG_LEVEL", value: "debug"},
+		{description: "other directive", directive: "tail", name: "INTERVAL", value: "10"},
+		{description: "remove", directive: "tail", name: "INTERVAL", value: ""},
+		{description: "not allowed", directive: "echo", name: "PATH", value: "/tmp", wantError: true},
+		{description: "missing directive", directive: "", name: "INTERVAL", value: "5", wantError: true},
+	}
+
+	for _, test := range tests {
+		err := e.set(test.directive, test.name, test.value)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("%v: expected error", test.description)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", test.description, err)
+		}
+	}
+
+	want := map[string]string{
+		"id":            "1",
+		"env.INTERVAL":  "5",
+		"env.LOG_LEVEL": "debug",
+	}
+	got := e.metadata("echo", map[string]string{"id": "1"})
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+	if got := e.metadata("tail", nil); got != nil {
+		t.Errorf("unexpected metadata for directive tail: %#v", got)
+	}
+
+	// Variables persist across a restart, unless they are no longer allowed.
+	e, err = loadWorkerEnv(path, []string{"INTERVAL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{
+		"env.INTERVAL": "5",
+	}
+	got = e.metadata("echo", nil)
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
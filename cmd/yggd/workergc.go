@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"os"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+)
+
+// workerGCMetrics holds the number of "sweeps" of the registered workers, the
+// number of stale workers "collected", by the reason they were found stale,
+// and the number of "socket_files_removed".
+var workerGCMetrics = expvar.NewMap("worker_gc")
+
+// Reasons a registered worker is found stale.
+const (
+	staleProcessGone       = "process_gone"
+	staleConnectionRefused = "connection_refused"
+)
+
+// staleStrikes is the number of consecutive sweeps a worker must be found
+// stale on before it is collected, so that a worker that registered but does
+// not listen on its socket yet is left alone.
+const staleStrikes = 2
+
+// workerProbeTimeout is how long connecting to the socket of a worker may
+// take. A worker too busy to accept the connection in time is not stale.
+const workerProbeTimeout = 5 * time.Second
+
+// collectStaleWorkers sweeps the registered workers every interval, and
+// unregisters those whose process is gone or whose socket refuses
+// connections, removing the socket file they leave behind.
+func (d *dispatcher) collectStaleWorkers(interval time.Duration) {
+	strikes := make(map[int]int)
+	for {
+		time.Sleep(interval)
+		for _, w := range d.sweepWorkers(probeWorker, strikes) {
+			if path, ok := ipc.SocketFile(w.addr); ok {
+				if err := os.Remove(path); err == nil {
+					workerGCMetrics.Add("socket_files_removed", 1)
+				} else if !os.IsNotExist(err) {
+					log.Warnf("cannot remove socket file of worker %v: %v", w.handler, err)
+				}
+			}
+			d.deadWorkers <- w.pid
+		}
+	}
+}
+
+// sweepWorkers probes each registered worker, other than attached products
+// and workers in virtual machines, which are watched otherwise, and returns
+// those found stale on staleStrikes consecutive sweeps. strikes holds the
+// number of consecutive sweeps each worker, by PID, was found stale on.
+func (d *dispatcher) sweepWorkers(probe func(worker) string, strikes map[int]int) []worker {
+	d.RLock()
+	workers := make([]worker, 0, len(d.workers))
+	for _, w := range d.workers {
+		if !w.namespace && !w.vm {
+			workers = append(workers, w)
+		}
+	}
+	d.RUnlock()
+	workerGCMetrics.Add("sweeps", 1)
+
+	registered := make(map[int]bool, len(workers))
+	var stale []worker
+	for _, w := range workers {
+		registered[w.pid] = true
+		reason := probe(w)
+		if reason == "" {
+			delete(strikes, w.pid)
+			continue
+		}
+		strikes[w.pid]++
+		log.Debugf("worker %v found stale (%v) on %v sweeps", w.handler, reason, strikes[w.pid])
+		if strikes[w.pid] < staleStrikes {
+			continue
+		}
+		log.Warnf("collecting stale worker %v: %v", w.handler, reason)
+		workerGCMetrics.Add("collected", 1)
+		workerGCMetrics.Add(reason, 1)
+		delete(strikes, w.pid)
+		stale = append(stale, w)
+	}
+	for pid := range strikes {
+		if !registered[pid] {
+			delete(strikes, pid)
+		}
+	}
+	return stale
+}
+
+// probeWorker returns the reason w is stale, or an empty string if its
+// process is running and accepts connections on its socket.
+func probeWorker(w worker) string {
+	if !processExists(w.pid) {
+		return staleProcessGone
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), workerProbeTimeout)
+	defer cancel()
+	conn, err := ipc.DialContext(ctx, w.addr)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, os.ErrNotExist) {
+			return staleConnectionRefused
+		}
+		log.Debugf("cannot connect to worker %v: %v", w.handler, err)
+		return ""
+	}
+	conn.Close()
+	return ""
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+)
+
+func TestSweepWorkers(t *testing.T) {
+	d := newDispatcher(nil, 1, 0, 10)
+	d.workers = map[string]worker{
+		"alive":    {pid: 1, handler: "alive"},
+		"stale":    {pid: 2, handler: "stale"},
+		"flapping": {pid: 3, handler: "flapping"},
+		"product":  {pid: 4, handler: "product", namespace: true},
+		"vm":       {pid: 5, handler: "vm", vm: true},
+	}
+	sweep := 0
+	probe := func(w worker) string {
+		switch w.handler {
+		case "alive":
+			return ""
+		case "flapping":
+			if sweep%2 == 0 {
+				return ""
+			}
+		}
+		return staleConnectionRefused
+	}
+
+	strikes := make(map[int]int)
+	var got [][]string
+	for sweep = 1; sweep <= 4; sweep++ {
+		var handlers []string
+		for _, w := range d.sweepWorkers(probe, strikes) {
+			handlers = append(handlers, w.handler)
+		}
+		got = append(got, handlers)
+	}
+
+	// The stale worker is collected on its second sweep, and again on its
+	// fourth since it is still registered; the flapping worker never is.
+	want := [][]string{nil, {"stale"}, nil, {"stale"}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+}
+
+func TestProbeWorker(t *testing.T) {
+	addr := ipc.Addr(fmt.Sprintf("yggd-gc-test-%v", randomString(6)))
+	l, err := ipc.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		input       worker
+		want        string
+	}{
+		{
+			description: "alive",
+			input:       worker{pid: os.Getpid(), addr: addr},
+		},
+		{
+			description: "process gone",
+			input:       worker{pid: exited.Process.Pid, addr: addr},
+			want:        staleProcessGone,
+		},
+		{
+			description: "connection refused",
+			input:       worker{pid: os.Getpid(), addr: ipc.Addr("yggd-gc-test-nobody")},
+			want:        staleConnectionRefused,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := probeWorker(test.input); got != test.want {
+				t.Errorf("probeWorker = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -26,6 +26,11 @@ var (
 	Provider string
 )
 
+// ExitCodeConfigError is the exit code of a worker that cannot run because of
+// an error in its configuration, as EX_CONFIG of sysexits.h. Restarting such a
+// worker is pointless, so yggd does not unless its manifest says otherwise.
+const ExitCodeConfigError = 78
+
 // Installation directory prefix and paths. Values are specified by compile-time
 // substitution values, and are then set to sane defaults at runtime if the
 // value is a zero-value string.
@@ -44,6 +49,7 @@ var (
 )
 
 func init() {
+	setPlatformDirs()
 	if PrefixDir == "" {
 		PrefixDir = "/usr/local"
 	}
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package yggdrasil
+
+// setPlatformDirs leaves the installation directories not set at compile time
+// to the defaults under PrefixDir.
+func setPlatformDirs() {}
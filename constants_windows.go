@@ -0,0 +1,34 @@
+package yggdrasil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// setPlatformDirs sets the installation directories not set at compile time
+// to their Windows defaults: programs under %ProgramFiles%\yggdrasil, and
+// configuration and state under %ProgramData%\yggdrasil.
+func setPlatformDirs() {
+	name := LongName
+	if name == "" {
+		name = "yggdrasil"
+	}
+	programFiles := os.Getenv("ProgramFiles")
+	if programFiles == "" {
+		programFiles = `C:\Program Files`
+	}
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		programData = `C:\ProgramData`
+	}
+
+	if PrefixDir == "" {
+		PrefixDir = filepath.Join(programFiles, name)
+	}
+	if SysconfDir == "" {
+		SysconfDir = filepath.Join(programData, name, "etc")
+	}
+	if LocalstateDir == "" {
+		LocalstateDir = filepath.Join(programData, name, "var")
+	}
+}
@@ -0,0 +1,120 @@
+package yggdrasil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// FactsTimeout is the maximum time a facts executable is allowed to run.
+var FactsTimeout = 10 * time.Second
+
+// A FactsError records the files that failed to contribute facts.
+type FactsError struct {
+	Errors map[string]error
+}
+
+func (e FactsError) Error() string {
+	files := make([]string, 0, len(e.Errors))
+	for file := range e.Errors {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	msgs := make([]string, 0, len(files))
+	for _, file := range files {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", file, e.Errors[file]))
+	}
+	return "cannot read facts: " + strings.Join(msgs, "; ")
+}
+
+// CollectFacts reads additional facts from every file in dir, in lexical
+// order, and merges them into a single map. Facts from later files override
+// facts of the same name from earlier ones. Files that cannot be read are
+// skipped and reported in a FactsError returned alongside the facts that were
+// collected. A missing dir is not an error.
+func CollectFacts(dir string) (map[string]interface{}, error) {
+	facts := make(map[string]interface{})
+
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return facts, nil
+		}
+		return nil, err
+	}
+
+	errs := make(map[string]error)
+	for _, info := range fileInfos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(dir, info.Name())
+		f, err := ReadFacts(file)
+		if err != nil {
+			errs[file] = err
+			continue
+		}
+		for k, v := range f {
+			facts[k] = v
+		}
+	}
+
+	if len(errs) > 0 {
+		return facts, FactsError{Errors: errs}
+	}
+	return facts, nil
+}
+
+// ReadFacts reads facts from file. If file is executable, it is run and its
+// standard output is parsed as a JSON object. Otherwise, the file is parsed as
+// JSON or TOML, depending on its extension.
+func ReadFacts(file string) (map[string]interface{}, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	format := filepath.Ext(file)
+	if info.Mode()&0111 != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), FactsTimeout)
+		defer cancel()
+
+		data, err = exec.CommandContext(ctx, file).Output()
+		if err != nil {
+			return nil, fmt.Errorf("cannot run facts executable: %w", err)
+		}
+		format = ".json"
+	} else {
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	facts := make(map[string]interface{})
+	switch format {
+	case ".json":
+		if err := json.Unmarshal(data, &facts); err != nil {
+			return nil, fmt.Errorf("cannot parse JSON: %w", err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &facts); err != nil {
+			return nil, fmt.Errorf("cannot parse TOML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported facts file format: %v", format)
+	}
+
+	return facts, nil
+}
@@ -0,0 +1,52 @@
+package yggdrasil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCollectFacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggdrasil-facts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []struct {
+		name string
+		data string
+		mode os.FileMode
+	}{
+		{name: "10-site.json", data: `{"site": "lab", "rack": 4}`, mode: 0644},
+		{name: "20-site.toml", data: `site = "datacenter"`, mode: 0644},
+		{name: "30-uptime", data: "#!/bin/sh\necho '{\"uptime\": 42}'\n", mode: 0755},
+		{name: "40-broken.json", data: `{`, mode: 0644},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := CollectFacts(dir)
+	want := map[string]interface{}{
+		"site":   "datacenter",
+		"rack":   float64(4),
+		"uptime": float64(42),
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+
+	factsErr, ok := err.(FactsError)
+	if !ok {
+		t.Fatalf("expected FactsError, got %#v", err)
+	}
+	if _, prs := factsErr.Errors[filepath.Join(dir, "40-broken.json")]; !prs || len(factsErr.Errors) != 1 {
+		t.Errorf("unexpected errors: %v", factsErr)
+	}
+}
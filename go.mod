@@ -3,15 +3,26 @@ module github.com/redhatinsights/yggdrasil
 go 1.13
 
 require (
+	filippo.io/age v1.0.0
 	git.sr.ht/~spc/go-log v0.0.0-20210409014304-ce6a6f3602dc
+	github.com/Microsoft/go-winio v0.4.16
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
-	github.com/eclipse/paho.mqtt.golang v1.3.5
-	github.com/google/go-cmp v0.5.6
+	github.com/eclipse/paho.golang v0.11.0
+	github.com/eclipse/paho.mqtt.golang v1.4.2
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/google/go-cmp v0.5.7
 	github.com/google/uuid v1.1.2
+	github.com/klauspost/compress v1.14.4
+	github.com/mdlayher/vsock v1.1.1
+	github.com/miekg/pkcs11 v1.1.1 // indirect
+	github.com/nats-io/nats.go v1.11.0
 	github.com/pelletier/go-toml v1.9.3
 	github.com/rjeczalik/notify v0.9.2
+	github.com/segmentio/kafka-go v0.4.30
 	github.com/urfave/cli/v2 v2.3.0
-	golang.org/x/net v0.0.0-20201031054903-ff519b6c9102 // indirect
+	github.com/xeipuuv/gojsonschema v1.2.0
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/sys v0.0.0-20220204135822-1c1b9b1eba6a
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/grpc v1.34.0
 	google.golang.org/protobuf v1.25.0
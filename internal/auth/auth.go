@@ -0,0 +1,240 @@
+// Package auth provides the bearer tokens that authenticate HTTP requests to
+// servers behind an API gateway, which expect an OAuth2 access token rather
+// than, or in addition to, a client certificate.
+//
+// A TokenFile reads a static token, such as a long-lived JWT, from a file that
+// another agent may rotate. ClientCredentials obtains access tokens from an
+// OAuth2 token endpoint with the client credentials grant (RFC 6749, section
+// 4.4), and refreshes them before they expire.
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSkew is the margin by which tokens are refreshed before they expire,
+// absorbing the difference between the local clock and that of the server
+// and the time requests take to reach it.
+const DefaultSkew = 30 * time.Second
+
+// A TokenSource provides the bearer token of requests.
+type TokenSource interface {
+	// Token returns a valid token, obtaining a new one if needed.
+	Token(ctx context.Context) (string, error)
+
+	// Invalidate discards the current token, after the server rejected it,
+	// so that the next call to Token obtains a new one.
+	Invalidate()
+}
+
+// A TokenFile is a TokenSource reading the token from a file. The file is read
+// again whenever it changes, or after the token was rejected.
+type TokenFile struct {
+	Path string
+
+	lock    sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+// Token returns the token held by the file, without surrounding white space.
+func (f *TokenFile) Token(ctx context.Context) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat token file: %w", err)
+	}
+	if f.token != "" && info.ModTime().Equal(f.modTime) {
+		return f.token, nil
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %v is empty", f.Path)
+	}
+	f.token = token
+	f.modTime = info.ModTime()
+	return f.token, nil
+}
+
+// Invalidate makes the next call to Token read the file again.
+func (f *TokenFile) Invalidate() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.token = ""
+}
+
+// ClientCredentials is a TokenSource obtaining access tokens from an OAuth2
+// token endpoint with the client credentials grant.
+type ClientCredentials struct {
+	// TokenURL is the URL of the token endpoint.
+	TokenURL string
+
+	// ClientID and ClientSecret authenticate the client to the token
+	// endpoint, with HTTP basic authentication.
+	ClientID     string
+	ClientSecret string
+
+	// Scopes are the scopes requested, if any.
+	Scopes []string
+
+	// Skew is the margin by which tokens are refreshed before they expire.
+	Skew time.Duration
+
+	// Client sends the requests to the token endpoint;
+	// http.DefaultClient if nil.
+	Client *http.Client
+
+	// now returns the current time; time.Now if nil.
+	now func() time.Time
+
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenResponse is the successful response of a token endpoint.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// errorResponse is the error response of a token endpoint.
+type errorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Token returns the current access token, requesting a new one once it is
+// within Skew of its expiry.
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.clock()
+	if c.token != "" && (c.expiry.IsZero() || now.Add(c.Skew).Before(c.expiry)) {
+		return c.token, nil
+	}
+	token, expiry, err := c.request(ctx, now)
+	if err != nil {
+		return "", err
+	}
+	c.token = token
+	c.expiry = expiry
+	return c.token, nil
+}
+
+// Invalidate makes the next call to Token request a new access token.
+func (c *ClientCredentials) Invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.token = ""
+}
+
+func (c *ClientCredentials) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// request requests an access token from the token endpoint at now, returning
+// it and its expiry, by the local clock; the expiry is zero if the token does
+// not expire.
+func (c *ClientCredentials) request(ctx context.Context, now time.Time) (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot request token: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot read token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e errorResponse
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return "", time.Time{}, fmt.Errorf("token request failed: %v: %v %v", resp.Status, e.Error, e.ErrorDescription)
+		}
+		return "", time.Time{}, fmt.Errorf("token request failed: %v", resp.Status)
+	}
+	var r tokenResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot parse token response: %w", err)
+	}
+	if r.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token response has no access token")
+	}
+	if r.TokenType != "" && !strings.EqualFold(r.TokenType, "bearer") {
+		return "", time.Time{}, fmt.Errorf("unsupported token type: %v", r.TokenType)
+	}
+
+	if r.ExpiresIn > 0 {
+		return r.AccessToken, now.Add(time.Duration(r.ExpiresIn) * time.Second), nil
+	}
+	// Without expires_in, a JWT access token expires at its "exp" claim, a
+	// time by the clock of the server. The Date of the response tells how far
+	// the local clock is from it.
+	exp, ok := jwtExpiry(r.AccessToken)
+	if !ok {
+		return r.AccessToken, time.Time{}, nil
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		exp = exp.Add(now.Sub(date))
+	}
+	return r.AccessToken, exp, nil
+}
+
+// jwtExpiry returns the time of the "exp" claim of token, if it is a JWT with
+// one. The signature of the token is not verified; that is for the server to
+// do.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.Exp), 0), true
+}
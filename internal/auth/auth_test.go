@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	f := &TokenFile{Path: path}
+	if _, err := f.Token(context.Background()); err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := f.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "first" {
+		t.Errorf("token = %q, want %q", got, "first")
+	}
+
+	// The rotated token is read once the file changes.
+	if err := ioutil.WriteFile(path, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	got, err = f.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "second" {
+		t.Errorf("token = %q, want %q", got, "second")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f.Invalidate()
+	if _, err := f.Token(context.Background()); err == nil {
+		t.Error("expected error for empty file")
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	var requests int
+	var form []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "device" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		requests++
+		r.ParseForm()
+		form = []string{r.PostForm.Get("grant_type"), r.PostForm.Get("scope")}
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":300}`, requests)
+	}))
+	defer server.Close()
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := &ClientCredentials{
+		TokenURL:     server.URL,
+		ClientID:     "device",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"control", "data"},
+		Skew:         30 * time.Second,
+		now:          func() time.Time { return now },
+	}
+
+	tests := []struct {
+		description string
+		elapsed     time.Duration
+		invalidate  bool
+		want        string
+	}{
+		{
+			description: "first token",
+			want:        "token-1",
+		},
+		{
+			description: "cached",
+			elapsed:     4 * time.Minute,
+			want:        "token-1",
+		},
+		{
+			description: "within skew of expiry",
+			elapsed:     31 * time.Second,
+			want:        "token-2",
+		},
+		{
+			description: "invalidated",
+			invalidate:  true,
+			want:        "token-3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			now = now.Add(test.elapsed)
+			if test.invalidate {
+				c.Invalidate()
+			}
+			got, err := c.Token(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("token = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	want := []string{"client_credentials", "control data"}
+	if !cmp.Equal(form, want) {
+		t.Errorf("%#v", cmp.Diff(form, want))
+	}
+
+	c.ClientSecret = "wrong"
+	c.Invalidate()
+	if _, err := c.Token(context.Background()); err == nil {
+		t.Error("expected error for rejected credentials")
+	}
+}
+
+func TestClientCredentialsJWTExpiry(t *testing.T) {
+	// The server clock is an hour ahead of the local clock.
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	serverNow := now.Add(time.Hour)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, serverNow.Add(5*time.Minute).Unix())))
+	token := "eyJhbGciOiJub25lIn0." + payload + ".sig"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", serverNow.Format(http.TimeFormat))
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"bearer"}`, token)
+	}))
+	defer server.Close()
+
+	c := &ClientCredentials{
+		TokenURL: server.URL,
+		now:      func() time.Time { return now },
+	}
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := now.Add(5 * time.Minute)
+	if !c.expiry.Equal(want) {
+		t.Errorf("expiry = %v, want %v", c.expiry, want)
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        time.Time
+		wantOK      bool
+	}{
+		{
+			description: "exp claim",
+			input:       "a." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"x","exp":1609459200}`)) + ".c",
+			want:        time.Unix(1609459200, 0),
+			wantOK:      true,
+		},
+		{
+			description: "no exp claim",
+			input:       "a." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"x"}`)) + ".c",
+		},
+		{
+			description: "opaque token",
+			input:       "2YotnFZFEjr1zCsicMWpAA",
+		},
+		{
+			description: "invalid payload",
+			input:       "a.!!.c",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, ok := jwtExpiry(test.input)
+			if ok != test.wantOK || !got.Equal(test.want) {
+				t.Errorf("jwtExpiry = %v, %v, want %v, %v", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
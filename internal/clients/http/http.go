@@ -2,61 +2,152 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"git.sr.ht/~spc/go-log"
 	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/auth"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
 )
 
 type Client struct {
 	client    *http.Client
 	userAgent string
+
+	// TokenSource, if set, provides the bearer token sent with each request.
+	TokenSource auth.TokenSource
+
+	// Retry decides which failed requests are retried.
+	Retry RetryPolicy
+
+	// Breaker, if set, stops requests to hosts that keep failing.
+	Breaker *CircuitBreaker
+
+	// UploadLimiter and DownloadLimiter, if set, limit the rate at which
+	// request bodies are sent and response bodies received.
+	UploadLimiter   *Limiter
+	DownloadLimiter *Limiter
 }
 
-// NewHTTPClient initializes the HTTP Client
-func NewHTTPClient(config *tls.Config, ua string) *Client{
+// NewHTTPClient initializes the HTTP Client. Connections are established
+// with d, so that each phase of a connection has its own timeout.
+func NewHTTPClient(config *tls.Config, ua string, d *dialer.Dialer) *Client{
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	transport.DialContext = d.DialContext
+	// The transport's TLS config is read at dial time, since the transport
+	// adds the protocols it negotiates to it when first used.
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.DialTLSContext(ctx, network, addr, transport.TLSClientConfig)
+	}
+	transport.TLSHandshakeTimeout = d.Timeouts.TLSHandshake
 	client := &http.Client{
-		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		Transport: transport,
 	}
-	client.Transport.(*http.Transport).TLSClientConfig = config
 
 	return &Client{
 		client: client,
 		userAgent: ua,
+		Retry:     DefaultRetryPolicy,
 	}
 }
 
-func (c *Client) Get(url string) ([]byte, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// Get requests the resource at url, giving up when ctx is done.
+func (c *Client) Get(ctx context.Context, url string) ([]byte, error) {
+	data, _, err := c.Poll(ctx, url)
+	return data, err
+}
+
+// Poll requests the resource at url like Get, and also returns the delay the
+// server asked the client to wait before its next request with the
+// Retry-After header, or -1 if the server did not set one.
+func (c *Client) Poll(ctx context.Context, url string) ([]byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create HTTP request: %w", err)
+		return nil, -1, fmt.Errorf("cannot create HTTP request: %w", err)
 	}
 	req.Header.Add("User-Agent", c.userAgent)
+	if err := c.authorize(req); err != nil {
+		return nil, -1, err
+	}
 
 	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
 	log.Tracef("request: %v", req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.send(req)
 	if err != nil {
-		return nil, fmt.Errorf("cannot download from URL: %w", err)
+		return nil, -1, fmt.Errorf("cannot download from URL: %w", err)
 	}
 	defer resp.Body.Close()
+	c.checkUnauthorized(resp)
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read response body: %w", err)
+		return nil, retryAfter, fmt.Errorf("cannot read response body: %w", err)
 	}
 	log.Debugf("received HTTP %v: %v", resp.Status, strings.TrimSpace(string(data)))
 
 	if resp.StatusCode >= 400 {
-		return nil, &yggdrasil.APIResponseError{Code: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+		return nil, retryAfter, &yggdrasil.APIResponseError{Code: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+
+	return data, retryAfter, nil
+}
+
+// authorize sets the Authorization header of req to the bearer token of the
+// client's TokenSource, if it has one.
+func (c *Client) authorize(req *http.Request) error {
+	if c.TokenSource == nil {
+		return nil
+	}
+	token, err := c.TokenSource.Token(req.Context())
+	if err != nil {
+		return fmt.Errorf("cannot get bearer token: %w", err)
 	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
 
-	return data, nil
+// checkUnauthorized invalidates the token of the client's TokenSource if the
+// server rejected it, so that the next request is sent with a new one.
+func (c *Client) checkUnauthorized(resp *http.Response) {
+	if c.TokenSource != nil && resp.StatusCode == http.StatusUnauthorized {
+		log.Warnf("bearer token rejected by %v", resp.Request.URL.Host)
+		c.TokenSource.Invalidate()
+	}
+}
+
+// parseRetryAfter returns the delay set by a Retry-After header value, either
+// a number of seconds or an HTTP date, relative to now. It returns -1 if the
+// value is empty or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return -1
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return -1
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return -1
 }
 
 func (c *Client) Post(url string, headers map[string]string, body []byte) error {
@@ -69,15 +160,94 @@ func (c *Client) Post(url string, headers map[string]string, body []byte) error
 		req.Header.Add(k, strings.TrimSpace(v))
 	}
 	req.Header.Add("User-Agent", c.userAgent)
+	if err := c.authorize(req); err != nil {
+		return err
+	}
 
 	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
 	log.Tracef("request: %v", req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.send(req)
 	if err != nil {
 		return fmt.Errorf("cannot post to URL: %w", err)
 	}
 	defer resp.Body.Close()
+	c.checkUnauthorized(resp)
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read response body: %w", err)
+	}
+	log.Debugf("received HTTP %v: %v", resp.Status, strings.TrimSpace(string(data)))
+
+	if resp.StatusCode >= 400 {
+		return &yggdrasil.APIResponseError{Code: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+
+	return nil
+}
+
+// Download requests the resource at url, starting at byte offset, giving up
+// when ctx is done. It returns the response body and whether the server
+// honored the offset; if it did not, the body holds the whole resource. The
+// caller must close the body.
+func (c *Client) Download(ctx context.Context, url string, offset int64) (io.ReadCloser, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot create HTTP request: %w", err)
+	}
+	req.Header.Add("User-Agent", c.userAgent)
+	if err := c.authorize(req); err != nil {
+		return nil, false, err
+	}
+	if offset > 0 {
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
+	log.Tracef("request: %v", req)
+
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot download from URL: %w", err)
+	}
+	log.Debugf("received HTTP %v", resp.Status)
+	c.checkUnauthorized(resp)
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, false, &yggdrasil.APIResponseError{Code: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+
+	return resp.Body, offset > 0 && resp.StatusCode == http.StatusPartialContent, nil
+}
+
+// Put uploads size bytes read from body to url.
+func (c *Client) Put(url string, headers map[string]string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		return fmt.Errorf("cannot create HTTP request: %w", err)
+	}
+	req.ContentLength = size
+
+	for k, v := range headers {
+		req.Header.Add(k, strings.TrimSpace(v))
+	}
+	req.Header.Add("User-Agent", c.userAgent)
+	if err := c.authorize(req); err != nil {
+		return err
+	}
+
+	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
+	log.Tracef("request: %v", req)
+
+	resp, err := c.send(req)
+	if err != nil {
+		return fmt.Errorf("cannot upload to URL: %w", err)
+	}
+	defer resp.Body.Close()
+	c.checkUnauthorized(resp)
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
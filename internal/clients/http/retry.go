@@ -0,0 +1,219 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// Metrics holds the number of requests "retried", the number of times a
+// circuit was "circuit_opened", and the number of requests "circuit_rejected"
+// while it was open.
+var Metrics = expvar.NewMap("http_client")
+
+// ErrCircuitOpen is returned for requests to a host whose circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// A RetryPolicy decides which failed requests are retried, and when. Requests
+// failing to reach the server, or answered with one of StatusCodes, are sent
+// again up to MaxAttempts in all, after a delay doubling from MinBackoff up to
+// MaxBackoff, of which a random half is taken off so that clients do not
+// retry in step. A longer Retry-After set by the server is honored, up to
+// MaxBackoff. Requests whose body cannot be sent again are not retried.
+type RetryPolicy struct {
+	MaxAttempts int
+	StatusCodes []int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultRetryPolicy sends each request once.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 1,
+	StatusCodes: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	MinBackoff:  time.Second,
+	MaxBackoff:  30 * time.Second,
+}
+
+// retryable reports whether p retries requests answered with code.
+func (p RetryPolicy) retryable(code int) bool {
+	for _, c := range p.StatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the retry following attempt, the number of
+// attempts made so far, with jitter drawn from int63n, such as rand.Int63n.
+// retryAfter is the delay the server asked for, or -1.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration, int63n func(n int64) int64) time.Duration {
+	delay := p.MinBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay > 0 {
+		delay = delay/2 + time.Duration(int63n(int64(delay/2)+1))
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+		if delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+	}
+	return delay
+}
+
+// A CircuitBreaker stops requests to a host after Threshold consecutive
+// failed attempts, so that a failing host is not sent requests that are bound
+// to fail. Once Cooldown has passed, a single trial request is let through:
+// the circuit closes again if it succeeds, and stays open for another
+// Cooldown if it fails. Attempts failing to reach the server or answered with
+// a 5xx or 429 status count as failures.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	lock     sync.Mutex
+	circuits map[string]*circuit
+}
+
+// A circuit is the state of the requests to a host.
+type circuit struct {
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// allow reports whether a request may be sent to host at now. A nil
+// CircuitBreaker allows all requests.
+func (b *CircuitBreaker) allow(host string, now time.Time) bool {
+	if b == nil || b.Threshold <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	c, prs := b.circuits[host]
+	if !prs || c.failures < b.Threshold {
+		return true
+	}
+	if c.trial || now.Sub(c.openedAt) < b.Cooldown {
+		Metrics.Add("circuit_rejected", 1)
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// done records the result of an attempt to send a request to host at now.
+func (b *CircuitBreaker) done(host string, failed bool, now time.Time) {
+	if b == nil || b.Threshold <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.circuits == nil {
+		b.circuits = make(map[string]*circuit)
+	}
+	c, prs := b.circuits[host]
+	if !prs {
+		c = &circuit{}
+		b.circuits[host] = c
+	}
+	c.trial = false
+	if !failed {
+		if c.failures >= b.Threshold {
+			log.Infof("circuit to %v closed", host)
+		}
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= b.Threshold {
+		if c.failures == b.Threshold {
+			log.Warnf("circuit to %v opened after %v failed requests", host, c.failures)
+			Metrics.Add("circuit_opened", 1)
+		}
+		c.openedAt = now
+	}
+}
+
+// failed reports whether an attempt that returned resp and err counts as a
+// failure of the host.
+func failed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// send sends req, retrying it according to the retry policy of the client,
+// unless the circuit of its host is open. The request and response bodies are
+// throttled by the limiters of the client.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	req.Body = c.UploadLimiter.throttle(req.Context(), req.Body)
+	for attempt := 1; ; attempt++ {
+		if !c.Breaker.allow(host, time.Now()) {
+			return nil, fmt.Errorf("cannot send request to %v: %w", host, ErrCircuitOpen)
+		}
+		resp, err := c.client.Do(req)
+		c.Breaker.done(host, failed(resp, err), time.Now())
+
+		retry := err != nil || c.Retry.retryable(resp.StatusCode)
+		replayable := req.Body == nil || req.GetBody != nil
+		if !retry || !replayable || attempt >= c.Retry.MaxAttempts || req.Context().Err() != nil {
+			if err == nil {
+				resp.Body = c.DownloadLimiter.throttle(req.Context(), resp.Body)
+			}
+			return resp, err
+		}
+
+		retryAfter := time.Duration(-1)
+		if err != nil {
+			log.Debugf("HTTP request %v %v failed: %v", req.Method, req.URL, err)
+		} else {
+			log.Debugf("received HTTP %v for %v %v", resp.Status, req.Method, req.URL)
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		delay := c.Retry.backoff(attempt, retryAfter, rand.Int63n)
+		log.Debugf("retrying HTTP request %v %v in %v", req.Method, req.URL, delay)
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("cannot rewind request body: %w", err)
+			}
+			req.Body = c.UploadLimiter.throttle(req.Context(), body)
+		}
+		Metrics.Add("retried", 1)
+	}
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,174 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	max := func(n int64) int64 { return n - 1 }
+	none := func(n int64) int64 { return 0 }
+
+	tests := []struct {
+		description string
+		attempt     int
+		retryAfter  time.Duration
+		int63n      func(int64) int64
+		want        time.Duration
+	}{
+		{
+			description: "first retry",
+			attempt:     1,
+			retryAfter:  -1,
+			int63n:      max,
+			want:        time.Second,
+		},
+		{
+			description: "doubled",
+			attempt:     3,
+			retryAfter:  -1,
+			int63n:      max,
+			want:        4 * time.Second,
+		},
+		{
+			description: "jitter",
+			attempt:     3,
+			retryAfter:  -1,
+			int63n:      none,
+			want:        2 * time.Second,
+		},
+		{
+			description: "capped",
+			attempt:     10,
+			retryAfter:  -1,
+			int63n:      max,
+			want:        10 * time.Second,
+		},
+		{
+			description: "retry after",
+			attempt:     1,
+			retryAfter:  5 * time.Second,
+			int63n:      max,
+			want:        5 * time.Second,
+		},
+		{
+			description: "retry after capped",
+			attempt:     1,
+			retryAfter:  time.Minute,
+			int63n:      max,
+			want:        10 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := p.backoff(test.attempt, test.retryAfter, test.int63n); got != test.want {
+				t.Errorf("backoff = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &CircuitBreaker{Threshold: 2, Cooldown: time.Minute}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var got []bool
+	step := func(elapsed time.Duration, failed bool) {
+		now = now.Add(elapsed)
+		allowed := b.allow("data.example.com", now)
+		got = append(got, allowed)
+		if allowed {
+			b.done("data.example.com", failed, now)
+		}
+	}
+	step(0, true)            // first failure
+	step(0, true)            // opens the circuit
+	step(time.Second, false) // rejected
+	step(time.Minute, true)  // trial fails, reopens
+	step(time.Second, false) // rejected
+	step(time.Minute, false) // trial succeeds, closes
+	step(time.Second, false) // allowed
+
+	want := []bool{true, true, false, true, false, true, true}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+	if !b.allow("other.example.com", now) {
+		t.Error("circuit of another host open")
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		description  string
+		statuses     []int
+		policy       RetryPolicy
+		breaker      *CircuitBreaker
+		wantRequests int
+		wantError    bool
+		wantOpen     bool
+	}{
+		{
+			description:  "retried until success",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+			policy:       RetryPolicy{MaxAttempts: 3, StatusCodes: DefaultRetryPolicy.StatusCodes},
+			wantRequests: 3,
+		},
+		{
+			description:  "attempts exhausted",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			policy:       RetryPolicy{MaxAttempts: 2, StatusCodes: DefaultRetryPolicy.StatusCodes},
+			wantRequests: 2,
+			wantError:    true,
+		},
+		{
+			description:  "not retryable",
+			statuses:     []int{http.StatusInternalServerError, http.StatusOK},
+			policy:       RetryPolicy{MaxAttempts: 3, StatusCodes: DefaultRetryPolicy.StatusCodes},
+			wantRequests: 1,
+			wantError:    true,
+		},
+		{
+			description:  "circuit opened",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			policy:       RetryPolicy{MaxAttempts: 3, StatusCodes: DefaultRetryPolicy.StatusCodes},
+			breaker:      &CircuitBreaker{Threshold: 2, Cooldown: time.Minute},
+			wantRequests: 2,
+			wantError:    true,
+			wantOpen:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.statuses[requests])
+				requests++
+			}))
+			defer server.Close()
+
+			c := NewHTTPClient(nil, "test", dialer.New(dialer.DefaultTimeouts))
+			c.Retry = test.policy
+			c.Breaker = test.breaker
+			err := c.Post(server.URL, nil, []byte("{}"))
+			if requests != test.wantRequests {
+				t.Errorf("requests = %v, want %v", requests, test.wantRequests)
+			}
+			if (err != nil) != test.wantError {
+				t.Errorf("error = %v, want error %v", err, test.wantError)
+			}
+			if errors.Is(err, ErrCircuitOpen) != test.wantOpen {
+				t.Errorf("error = %v, want circuit open %v", err, test.wantOpen)
+			}
+		})
+	}
+}
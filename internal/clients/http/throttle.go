@@ -0,0 +1,107 @@
+package http
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxThrottledRead is the largest read of a throttled body, so that the
+// transfer proceeds smoothly rather than in bursts of a full buffer.
+const maxThrottledRead = 32 << 10
+
+// A Limiter limits the rate of the transfers of the bodies it throttles, all
+// together, to a number of bytes per second, so that transfers do not saturate
+// a constrained link. It is a token bucket holding up to a second worth of
+// bytes; reads that exceed it wait until enough bytes have accumulated.
+type Limiter struct {
+	rate float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// now and sleep are time.Now and a sleep until ctx is done; they are
+	// replaced in tests.
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewLimiter returns a Limiter of rate bytes per second, or nil, which does
+// not limit transfers, if rate is not positive.
+func NewLimiter(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		now:    time.Now,
+		sleep:  sleep,
+	}
+}
+
+// take takes n bytes from the bucket, and returns how long to wait before
+// transferring more, once the bucket is overdrawn.
+func (l *Limiter) take(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// chunk returns the largest read of a throttled body.
+func (l *Limiter) chunk() int {
+	n := int(l.rate)
+	if n > maxThrottledRead {
+		n = maxThrottledRead
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// throttle returns body, whose reads are limited by l until ctx is done. A
+// nil Limiter returns body as is.
+func (l *Limiter) throttle(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	if l == nil || body == nil {
+		return body
+	}
+	return &throttledBody{ReadCloser: body, ctx: ctx, limiter: l}
+}
+
+// A throttledBody is a body whose reads are limited by a Limiter.
+type throttledBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *Limiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if max := b.limiter.chunk(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if wait := b.limiter.take(n); wait > 0 {
+			if werr := b.limiter.sleep(b.ctx, wait); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	tests := []struct {
+		description string
+		rate        int64
+		size        int
+		want        time.Duration
+	}{
+		{
+			description: "within burst",
+			rate:        10 << 10,
+			size:        10 << 10,
+		},
+		{
+			description: "throttled",
+			rate:        10 << 10,
+			size:        100 << 10,
+			want:        9 * time.Second,
+		},
+		{
+			description: "small rate",
+			rate:        100,
+			size:        1000,
+			want:        9 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			l := NewLimiter(test.rate)
+			now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			var slept time.Duration
+			l.now = func() time.Time { return now }
+			l.sleep = func(ctx context.Context, d time.Duration) error {
+				slept += d
+				now = now.Add(d)
+				return nil
+			}
+
+			body := l.throttle(context.Background(), ioutil.NopCloser(bytes.NewReader(make([]byte, test.size))))
+			data, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != test.size {
+				t.Errorf("read %v bytes, want %v", len(data), test.size)
+			}
+			if slept != test.want {
+				t.Errorf("slept %v, want %v", slept, test.want)
+			}
+		})
+	}
+
+	if NewLimiter(0) != nil {
+		t.Error("expected no limiter for rate 0")
+	}
+}
@@ -0,0 +1,171 @@
+// Package clock detects discontinuous changes of the system wall clock.
+//
+// Devices without a real-time clock typically boot with a wall clock far in
+// the past and jump forward once time is synchronized over the network. Any
+// timer or deadline computed from the wall clock before the jump is then
+// meaningless, and TLS sessions established before it may have been validated
+// against the wrong time.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Source reads the wall clock and a monotonic clock.
+type Source interface {
+	// Wall returns the current wall clock time.
+	Wall() time.Time
+
+	// Monotonic returns the time elapsed since an arbitrary, fixed origin,
+	// as measured by a clock that is not affected by changes of the wall
+	// clock.
+	Monotonic() time.Duration
+}
+
+// systemSource reads the clocks of the system.
+type systemSource struct {
+	origin time.Time
+}
+
+func (s systemSource) Wall() time.Time          { return time.Now().Round(0) }
+func (s systemSource) Monotonic() time.Duration { return time.Since(s.origin) }
+
+// System is the Source reading the clocks of the system.
+var System Source = systemSource{origin: time.Now()}
+
+// A JumpDetector compares the progression of the wall clock with that of the
+// monotonic clock and reports when the two diverge by more than a threshold.
+type JumpDetector struct {
+	source    Source
+	threshold time.Duration
+	lastWall  time.Time
+	lastMono  time.Duration
+}
+
+// NewJumpDetector creates a JumpDetector that reports jumps of the wall clock
+// of source larger than threshold.
+func NewJumpDetector(source Source, threshold time.Duration) *JumpDetector {
+	return &JumpDetector{
+		source:    source,
+		threshold: threshold,
+		lastWall:  source.Wall(),
+		lastMono:  source.Monotonic(),
+	}
+}
+
+// Check reads the clocks and compares them against the previous check. If the
+// wall clock advanced by more than threshold more (or less) than the
+// monotonic clock, the difference is returned along with true.
+func (d *JumpDetector) Check() (time.Duration, bool) {
+	wall, mono := d.source.Wall(), d.source.Monotonic()
+	skew := wall.Sub(d.lastWall) - (mono - d.lastMono)
+	d.lastWall, d.lastMono = wall, mono
+
+	if skew > d.threshold || skew < -d.threshold {
+		return skew, true
+	}
+	return 0, false
+}
+
+// WatchJumps checks the system wall clock every interval, sending the size of
+// each detected jump larger than threshold on the returned channel.
+func WatchJumps(interval, threshold time.Duration) <-chan time.Duration {
+	c := make(chan time.Duration)
+	go func() {
+		d := NewJumpDetector(System, threshold)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if skew, jumped := d.Check(); jumped {
+				c <- skew
+			}
+		}
+	}()
+	return c
+}
+
+// A Schedule calls functions at wall clock times, such as message deadlines
+// set by a server. The time left until each call is measured on the monotonic
+// clock, so a jump of the wall clock does not move it; once the wall clock
+// has been corrected, Rebase recomputes it from the new wall clock time.
+type Schedule struct {
+	source Source
+	lock   sync.Mutex
+	timers map[string]*scheduledCall
+}
+
+// scheduledCall is a function waiting to be called at a wall clock time.
+type scheduledCall struct {
+	at    time.Time
+	fn    func()
+	timer *time.Timer
+}
+
+// NewSchedule creates a Schedule reading the wall clock of source.
+func NewSchedule(source Source) *Schedule {
+	return &Schedule{
+		source: source,
+		timers: make(map[string]*scheduledCall),
+	}
+}
+
+// At calls fn, on its own goroutine, once the wall clock reaches at. Any
+// function scheduled with the same key is cancelled.
+func (s *Schedule) At(key string, at time.Time, fn func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, prs := s.timers[key]; prs {
+		old.timer.Stop()
+	}
+	call := &scheduledCall{at: at, fn: fn}
+	s.arm(key, call)
+	s.timers[key] = call
+}
+
+// Stop cancels the function scheduled with key, if any.
+func (s *Schedule) Stop(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if call, prs := s.timers[key]; prs {
+		call.timer.Stop()
+		delete(s.timers, key)
+	}
+}
+
+// Len returns the number of functions waiting to be called.
+func (s *Schedule) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.timers)
+}
+
+// Rebase recomputes the time left until each scheduled call from the current
+// wall clock time. It is called after a jump of the wall clock.
+func (s *Schedule) Rebase() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, call := range s.timers {
+		if call.timer.Stop() {
+			s.arm(key, call)
+		}
+	}
+}
+
+// arm starts the timer of call, scheduled with key. The caller must hold the
+// lock.
+func (s *Schedule) arm(key string, call *scheduledCall) {
+	call.timer = time.AfterFunc(call.at.Sub(s.source.Wall()), func() {
+		s.lock.Lock()
+		if s.timers[key] != call {
+			s.lock.Unlock()
+			return
+		}
+		delete(s.timers, key)
+		s.lock.Unlock()
+		call.fn()
+	})
+}
@@ -0,0 +1,135 @@
+package clock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSource is a Source whose clocks are advanced by the test.
+type fakeSource struct {
+	lock sync.Mutex
+	wall time.Time
+	mono time.Duration
+}
+
+func (s *fakeSource) Wall() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.wall
+}
+
+func (s *fakeSource) Monotonic() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mono
+}
+
+// advance moves the wall clock by wall and the monotonic clock by mono.
+func (s *fakeSource) advance(wall, mono time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.wall = s.wall.Add(wall)
+	s.mono += mono
+}
+
+func TestJumpDetector(t *testing.T) {
+	tests := []struct {
+		description string
+		wall        time.Duration
+		mono        time.Duration
+		wantSkew    time.Duration
+		wantJumped  bool
+	}{
+		{
+			description: "steady",
+			wall:        10 * time.Second,
+			mono:        10 * time.Second,
+		},
+		{
+			description: "drift below threshold",
+			wall:        10*time.Second + 500*time.Millisecond,
+			mono:        10 * time.Second,
+		},
+		{
+			description: "forward jump",
+			wall:        24 * time.Hour,
+			mono:        10 * time.Second,
+			wantSkew:    24*time.Hour - 10*time.Second,
+			wantJumped:  true,
+		},
+		{
+			description: "backward jump",
+			wall:        -time.Hour,
+			mono:        10 * time.Second,
+			wantSkew:    -time.Hour - 10*time.Second,
+			wantJumped:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			s := &fakeSource{wall: time.Unix(0, 0)}
+			d := NewJumpDetector(s, time.Minute)
+			s.advance(test.wall, test.mono)
+
+			skew, jumped := d.Check()
+			if jumped != test.wantJumped {
+				t.Errorf("jumped %v != %v", jumped, test.wantJumped)
+			}
+			if skew != test.wantSkew {
+				t.Errorf("skew %v != %v", skew, test.wantSkew)
+			}
+
+			// The next check compares against the clocks read by this one.
+			s.advance(time.Second, time.Second)
+			if _, jumped := d.Check(); jumped {
+				t.Error("jump reported twice")
+			}
+		})
+	}
+}
+
+func TestScheduleRebase(t *testing.T) {
+	// The wall clock is an hour behind when the call is scheduled, as on a
+	// device that has not synchronized its clock yet.
+	deadline := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := &fakeSource{wall: deadline.Add(-time.Hour)}
+	schedule := NewSchedule(s)
+
+	called := make(chan struct{})
+	schedule.At("1", deadline, func() { close(called) })
+
+	select {
+	case <-called:
+		t.Fatal("called an hour early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.advance(time.Hour-50*time.Millisecond, 0)
+	schedule.Rebase()
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("not called after the clock was corrected")
+	}
+	if n := schedule.Len(); n != 0 {
+		t.Errorf("%v calls left", n)
+	}
+}
+
+func TestScheduleStop(t *testing.T) {
+	s := &fakeSource{wall: time.Unix(0, 0)}
+	schedule := NewSchedule(s)
+
+	called := make(chan struct{}, 2)
+	schedule.At("1", time.Unix(0, 0).Add(20*time.Millisecond), func() { called <- struct{}{} })
+	schedule.At("2", time.Unix(0, 0).Add(20*time.Millisecond), func() { called <- struct{}{} })
+	schedule.Stop("1")
+
+	time.Sleep(100 * time.Millisecond)
+	if n := len(called); n != 1 {
+		t.Errorf("%v calls, want 1", n)
+	}
+}
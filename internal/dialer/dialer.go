@@ -0,0 +1,192 @@
+// Package dialer establishes network connections with a separate timeout for
+// each phase of the connection: resolving the host name, connecting to the
+// resolved address and performing the TLS handshake. A single timeout
+// covering all phases makes a slow network indistinguishable from a dead one;
+// with per-phase timeouts and metrics, the failing phase can be identified.
+// Clients time the handshake of their own protocol, such as the MQTT CONNECT
+// exchange, as a further phase.
+//
+// Metrics for each phase are published with expvar in the "dial" map, as
+// counters named after the phase ("dns", "connect", "tls", "handshake") and
+// the counter.
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// Phases of a connection.
+const (
+	PhaseDNS       = "dns"
+	PhaseConnect   = "connect"
+	PhaseTLS       = "tls"
+	PhaseHandshake = "handshake"
+)
+
+// Metrics holds the "attempts", "failures", "timeouts" and "duration_ms" (the
+// total time spent) counters of each connection phase, such as
+// "dns.attempts".
+var Metrics = expvar.NewMap("dial")
+
+// Timeouts holds the maximum duration of each phase of a connection. A zero
+// timeout does not limit the phase.
+type Timeouts struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+
+	// Handshake is the maximum duration of the handshake of the protocol
+	// spoken over the connection, timed by the client.
+	Handshake time.Duration
+}
+
+// DefaultTimeouts are the timeouts used unless configured otherwise.
+var DefaultTimeouts = Timeouts{
+	DNS:          10 * time.Second,
+	Connect:      10 * time.Second,
+	TLSHandshake: 10 * time.Second,
+	Handshake:    10 * time.Second,
+}
+
+// Total returns the sum of the timeouts of the phases establishing the
+// connection, for clients that only support a single connection timeout. It
+// returns 0 if any phase is unlimited.
+func (t Timeouts) Total() time.Duration {
+	if t.DNS == 0 || t.Connect == 0 || t.TLSHandshake == 0 {
+		return 0
+	}
+	return t.DNS + t.Connect + t.TLSHandshake
+}
+
+// A Dialer connects to network addresses, applying its timeouts to each
+// phase of the connection.
+type Dialer struct {
+	Timeouts Timeouts
+	Resolver *net.Resolver
+}
+
+// New creates a Dialer using timeouts and the default resolver.
+func New(timeouts Timeouts) *Dialer {
+	return &Dialer{
+		Timeouts: timeouts,
+		Resolver: net.DefaultResolver,
+	}
+}
+
+// DialContext resolves the host of address, then connects to each of its
+// addresses in turn until a connection is established.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	err = d.phase(ctx, PhaseDNS, d.Timeouts.DNS, func(ctx context.Context) error {
+		var err error
+		addrs, err = d.Resolver.LookupHost(ctx, host)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %v: %w", host, err)
+	}
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		err = d.phase(ctx, PhaseConnect, d.Timeouts.Connect, func(ctx context.Context) error {
+			var dialer net.Dialer
+			var err error
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			return err
+		})
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot connect to %v: %w", address, err)
+}
+
+// DialTLSContext connects to address like DialContext and performs a TLS
+// handshake using config. The server name is taken from address if config
+// does not set one.
+func (d *Dialer) DialTLSContext(ctx context.Context, network, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	err = d.phase(ctx, PhaseTLS, d.Timeouts.TLSHandshake, func(ctx context.Context) error {
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+			defer tlsConn.SetDeadline(time.Time{})
+		}
+		return tlsConn.Handshake()
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot perform TLS handshake with %v: %w", address, err)
+	}
+	return tlsConn, nil
+}
+
+// phase runs fn with a context limited by timeout, recording the outcome and
+// duration of the named phase.
+func (d *Dialer) phase(ctx context.Context, name string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := fn(ctx)
+	Record(name, time.Since(start), err)
+	return err
+}
+
+// Record records the outcome and duration of the named phase, for phases timed
+// by clients.
+func Record(name string, elapsed time.Duration, err error) {
+	Metrics.Add(name+".attempts", 1)
+	Metrics.Add(name+".duration_ms", elapsed.Milliseconds())
+	if err != nil {
+		Metrics.Add(name+".failures", 1)
+		if isTimeout(err) {
+			Metrics.Add(name+".timeouts", 1)
+			log.Debugf("%v phase timed out after %v", name, elapsed)
+		}
+		return
+	}
+	log.Tracef("%v phase completed in %v", name, elapsed)
+}
+
+// isTimeout reports whether err was caused by a timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
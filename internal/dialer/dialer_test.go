@@ -0,0 +1,72 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsTotal(t *testing.T) {
+	tests := []struct {
+		description string
+		input       Timeouts
+		want        time.Duration
+	}{
+		{
+			description: "default",
+			input:       DefaultTimeouts,
+			want:        30 * time.Second,
+		},
+		{
+			description: "unlimited phase",
+			input:       Timeouts{DNS: time.Second, Connect: 0, TLSHandshake: time.Second},
+			want:        0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := test.input.Total()
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	attempts := func() int64 {
+		if v, ok := Metrics.Get(PhaseConnect + ".attempts").(interface{ Value() int64 }); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := attempts()
+
+	d := New(DefaultTimeouts)
+	conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := attempts() - before; got != 1 {
+		t.Errorf("connect attempts: %v != %v", got, 1)
+	}
+}
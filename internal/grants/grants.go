@@ -0,0 +1,97 @@
+// Package grants implements time-boxed approvals of restricted directives. An
+// approver signs a Grant with an Ed25519 private key; the dispatcher accepts
+// it if the signature was made with one of its trusted keys, and dispatches
+// messages for the granted directive until the grant expires.
+package grants
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// A Grant allows messages for a restricted directive to be dispatched between
+// NotBefore and NotAfter.
+type Grant struct {
+	// Directive is the restricted directive, or namespace of directives,
+	// the grant allows.
+	Directive string `json:"directive"`
+
+	// ClientID, if set, limits the grant to the client with that ID.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Approver names the person or system that approved the grant.
+	Approver string `json:"approver"`
+
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// A Signed grant holds the JSON encoding of a Grant and its Ed25519
+// signature. It is itself encoded as a JSON object with base64 encoded
+// "grant" and "signature" fields.
+type Signed struct {
+	Grant     []byte `json:"grant"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign encodes g and signs it with key.
+func Sign(g Grant, key ed25519.PrivateKey) (Signed, error) {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return Signed{}, fmt.Errorf("cannot marshal grant: %w", err)
+	}
+	return Signed{Grant: data, Signature: ed25519.Sign(key, data)}, nil
+}
+
+// Verify checks that the signature of s was made with one of keys, and
+// returns the grant it holds.
+func Verify(s Signed, keys []ed25519.PublicKey) (Grant, error) {
+	var g Grant
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, s.Grant, s.Signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return g, fmt.Errorf("grant was not signed with a trusted key")
+	}
+	if err := json.Unmarshal(s.Grant, &g); err != nil {
+		return g, fmt.Errorf("cannot unmarshal grant: %w", err)
+	}
+	if g.Directive == "" {
+		return g, fmt.Errorf("grant has no directive")
+	}
+	if !g.NotAfter.After(g.NotBefore) {
+		return g, fmt.Errorf("grant expires before it starts")
+	}
+	return g, nil
+}
+
+// ReadPrivateKey reads a PEM encoded PKCS #8 Ed25519 private key, as written
+// by "openssl genpkey -algorithm ed25519", from the file at path.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no private key found in %v", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key in %v: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %v is not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
@@ -0,0 +1,75 @@
+package grants
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	grant := Grant{Directive: "package-manager", Approver: "jdoe", NotBefore: now, NotAfter: now.Add(time.Hour)}
+	signed, err := Sign(grant, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := Signed{Grant: append([]byte{}, signed.Grant...), Signature: signed.Signature}
+	tampered.Grant[len(tampered.Grant)-2] = '9'
+
+	tests := []struct {
+		description string
+		input       Signed
+		keys        []ed25519.PublicKey
+		want        Grant
+		wantError   bool
+	}{
+		{
+			description: "trusted key",
+			input:       signed,
+			keys:        []ed25519.PublicKey{otherPublic, public},
+			want:        grant,
+		},
+		{
+			description: "untrusted key",
+			input:       signed,
+			keys:        []ed25519.PublicKey{otherPublic},
+			wantError:   true,
+		},
+		{
+			description: "tampered grant",
+			input:       tampered,
+			keys:        []ed25519.PublicKey{public},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := Verify(test.input, test.keys)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%#v != %#v", got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Package idtoken issues short-lived identity tokens: JSON Web Tokens signed
+// with the private key of the client certificate, so that a service trusting
+// the certificate authority of the device identity can authenticate a worker
+// without the worker holding a long-lived secret. The certificate chain is
+// carried in the "x5c" header of each token.
+package idtoken
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Claims are the claims of an identity token.
+type Claims struct {
+	// Issuer is the client ID of the device.
+	Issuer string `json:"iss"`
+
+	// Subject is the worker the token was issued to.
+	Subject string `json:"sub"`
+
+	// Audience is the service the token is meant for.
+	Audience string `json:"aud"`
+
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// header is the JOSE header of a token.
+type header struct {
+	Algorithm string   `json:"alg"`
+	Type      string   `json:"typ"`
+	Chain     []string `json:"x5c,omitempty"`
+}
+
+// An Issuer signs identity tokens with a certificate and its private key.
+type Issuer struct {
+	// ClientID is the issuer of the tokens.
+	ClientID string
+
+	// Certificate is the client certificate and the private key signing
+	// the tokens, which must be an RSA, ECDSA P-256 or Ed25519 key.
+	Certificate tls.Certificate
+
+	// Lifetime is how long each token is valid.
+	Lifetime time.Duration
+}
+
+// Issue returns a token issued at now to subject for audience, and its
+// expiry.
+func (i *Issuer) Issue(subject, audience string, now time.Time) (string, time.Time, error) {
+	signer, ok := i.Certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("private key cannot sign")
+	}
+	alg, err := algorithm(signer.Public())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	h := header{Algorithm: alg, Type: "JWT"}
+	for _, der := range i.Certificate.Certificate {
+		h.Chain = append(h.Chain, base64.StdEncoding.EncodeToString(der))
+	}
+	expires := now.Add(i.Lifetime)
+	claims := Claims{
+		Issuer:    i.ClientID,
+		Subject:   subject,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expires.Unix(),
+	}
+
+	hdata, err := json.Marshal(h)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot marshal header: %w", err)
+	}
+	cdata, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot marshal claims: %w", err)
+	}
+	input := encode(hdata) + "." + encode(cdata)
+	sig, err := sign(signer, alg, []byte(input))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot sign token: %w", err)
+	}
+	return input + "." + encode(sig), expires, nil
+}
+
+// algorithm returns the JWS algorithm of tokens signed with key.
+func algorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize != 256 {
+			return "", fmt.Errorf("unsupported ECDSA curve %v", k.Curve.Params().Name)
+		}
+		return "ES256", nil
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// sign returns the JWS signature of input with alg.
+func sign(signer crypto.Signer, alg string, input []byte) ([]byte, error) {
+	if alg == "EdDSA" {
+		return signer.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(input)
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil || alg != "ES256" {
+		return sig, err
+	}
+	// ECDSA signers return an ASN.1 encoded signature; JWS uses the
+	// concatenation of its fixed size R and S.
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+		return nil, fmt.Errorf("cannot parse ECDSA signature: %w", err)
+	}
+	raw := make([]byte, 64)
+	r, s := rs.R.Bytes(), rs.S.Bytes()
+	copy(raw[32-len(r):32], r)
+	copy(raw[64-len(s):], s)
+	return raw, nil
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,146 @@
+package idtoken
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIssue(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		key         crypto.Signer
+		wantAlg     string
+		wantError   bool
+	}{
+		{
+			description: "ecdsa",
+			key:         ecKey,
+			wantAlg:     "ES256",
+		},
+		{
+			description: "rsa",
+			key:         rsaKey,
+			wantAlg:     "RS256",
+		},
+		{
+			description: "ed25519",
+			key:         edKey,
+			wantAlg:     "EdDSA",
+		},
+		{
+			description: "unsupported curve",
+			key:         p384Key,
+			wantError:   true,
+		},
+	}
+
+	now := time.Unix(1700000000, 0)
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			issuer := Issuer{
+				ClientID: "client",
+				Certificate: tls.Certificate{
+					Certificate: [][]byte{[]byte("certificate")},
+					PrivateKey:  test.key,
+				},
+				Lifetime: 5 * time.Minute,
+			}
+			token, expires, err := issuer.Issue("worker", "https://vault.example.com", now)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", token)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !expires.Equal(now.Add(5 * time.Minute)) {
+				t.Errorf("expires = %v", expires)
+			}
+
+			parts := strings.Split(token, ".")
+			if len(parts) != 3 {
+				t.Fatalf("token has %v parts", len(parts))
+			}
+			var h header
+			decode(t, parts[0], &h)
+			wantHeader := header{Algorithm: test.wantAlg, Type: "JWT", Chain: []string{base64.StdEncoding.EncodeToString([]byte("certificate"))}}
+			if !cmp.Equal(h, wantHeader) {
+				t.Errorf("%#v", cmp.Diff(h, wantHeader))
+			}
+			var claims Claims
+			decode(t, parts[1], &claims)
+			wantClaims := Claims{
+				Issuer:    "client",
+				Subject:   "worker",
+				Audience:  "https://vault.example.com",
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(5 * time.Minute).Unix(),
+			}
+			if !cmp.Equal(claims, wantClaims) {
+				t.Errorf("%#v", cmp.Diff(claims, wantClaims))
+			}
+
+			input := []byte(parts[0] + "." + parts[1])
+			sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := sha256.Sum256(input)
+			var verified bool
+			switch k := test.key.Public().(type) {
+			case *ecdsa.PublicKey:
+				verified = len(sig) == 64 && ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+			case *rsa.PublicKey:
+				verified = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+			case ed25519.PublicKey:
+				verified = ed25519.Verify(k, input, sig)
+			}
+			if !verified {
+				t.Error("signature not verified")
+			}
+		})
+	}
+}
+
+func decode(t *testing.T, part string, v interface{}) {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
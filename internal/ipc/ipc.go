@@ -0,0 +1,54 @@
+// Package ipc provides the local sockets yggd, its workers and yggctl talk
+// over: unix domain sockets, abstract or not, on Linux, and named pipes on
+// Windows. Workers running in virtual machines on the same host talk to yggd
+// over VM sockets (vsock) instead.
+//
+// Addresses are either the address of a socket, such as "@yggd" or
+// `\\.\pipe\yggd`, or a gRPC target naming it, prefixed with Scheme, as set
+// in the YGG_SOCKET_ADDR environment variable of workers. VM socket addresses
+// are always targets, such as "vsock:2:1024".
+package ipc
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+)
+
+// Target returns the gRPC target of the socket at addr. addr is returned as
+// is if it is already a target.
+func Target(addr string) string {
+	if strings.HasPrefix(addr, Scheme+":") || isVsock(addr) {
+		return addr
+	}
+	return Scheme + ":" + addr
+}
+
+// Listen listens on the socket at addr.
+func Listen(addr string) (net.Listener, error) {
+	if isVsock(addr) {
+		return listenVsock(addr)
+	}
+	return listen(addr)
+}
+
+// DialContext connects to the socket at addr.
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if isVsock(addr) {
+		return dialVsock(ctx, addr)
+	}
+	return dialContext(ctx, addr)
+}
+
+// Dial creates a gRPC client connection to target, a socket address or
+// target, with opts.
+func Dial(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if isVsock(target) {
+		// gRPC does not resolve the vsock scheme; the target is passed
+		// through to the dialer as is.
+		return grpc.Dial(target, append([]grpc.DialOption{grpc.WithInsecure(), grpc.WithContextDialer(dialVsock)}, opts...)...)
+	}
+	return grpc.Dial(Target(target), append(dialOptions(), opts...)...)
+}
@@ -0,0 +1,92 @@
+package ipc
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTarget(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+	}{
+		{
+			description: "address",
+			input:       Addr("yggd"),
+			want:        Scheme + ":" + Addr("yggd"),
+		},
+		{
+			description: "target",
+			input:       Scheme + ":" + Addr("yggd"),
+			want:        Scheme + ":" + Addr("yggd"),
+		},
+		{
+			description: "vsock",
+			input:       VsockAddr(VsockHost, 1024),
+			want:        "vsock:2:1024",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := Target(test.input); got != test.want {
+				t.Errorf("%q != %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseVsockAddr(t *testing.T) {
+	type addr struct {
+		CID  uint32
+		Port uint32
+	}
+	tests := []struct {
+		description string
+		input       string
+		want        addr
+		wantError   bool
+	}{
+		{
+			description: "host",
+			input:       "vsock:2:1024",
+			want:        addr{CID: 2, Port: 1024},
+		},
+		{
+			description: "any",
+			input:       VsockListenAddr(1024),
+			want:        addr{CID: 0xffffffff, Port: 1024},
+		},
+		{
+			description: "missing port",
+			input:       "vsock:2",
+			wantError:   true,
+		},
+		{
+			description: "invalid context ID",
+			input:       "vsock:host:1024",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cid, port, err := parseVsockAddr(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v:%v", cid, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := addr{CID: cid, Port: port}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
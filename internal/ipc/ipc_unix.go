@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc"
+)
+
+// Scheme is the gRPC scheme of socket targets.
+const Scheme = "unix"
+
+// Addr returns the address of the socket named name, in the abstract
+// namespace.
+func Addr(name string) string {
+	return "@" + name
+}
+
+// SocketFile returns the path of the socket file at addr, and false if addr
+// is the address of an abstract or VM socket, which has no file.
+func SocketFile(addr string) (string, bool) {
+	path := strings.TrimPrefix(addr, Scheme+":")
+	if path == "" || strings.HasPrefix(path, "@") || isVsock(addr) {
+		return "", false
+	}
+	return path, true
+}
+
+// listen listens on the socket at addr.
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("unix", strings.TrimPrefix(addr, Scheme+":"))
+}
+
+// ListenPrivate listens on the socket file at path, replacing a stale socket
+// file, and restricts access to the socket to its owner. The socket is
+// created with a umask that leaves it accessible to its owner only, so that
+// there is no window between its creation and the change of its permissions
+// in which other users may connect.
+func ListenPrivate(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot remove socket: %w", err)
+	}
+	umask := syscall.Umask(0177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen to socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("cannot change socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+// dialContext connects to the socket at addr.
+func dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", strings.TrimPrefix(addr, Scheme+":"))
+}
+
+// dialOptions returns the options gRPC connections to sockets are created
+// with.
+func dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithInsecure()}
+}
+
+// PeerPID returns the PID of the process at the other end of conn, as
+// reported by the kernel. ok is false if conn is not a socket connection.
+func PeerPID(conn net.Conn) (pid int, ok bool, err error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, false, nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot get raw connection: %w", err)
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, false, fmt.Errorf("cannot get peer credentials: %w", err)
+	}
+	if credErr != nil {
+		return 0, false, fmt.Errorf("cannot get peer credentials: %w", credErr)
+	}
+	return int(ucred.Pid), true, nil
+}
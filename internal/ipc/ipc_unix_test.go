@@ -0,0 +1,114 @@
+//go:build !windows
+// +build !windows
+
+package ipc
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipc-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	umask := syscall.Umask(0022)
+	defer syscall.Umask(umask)
+
+	l, err := ListenPrivate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permissions %v, want 0600", perm)
+	}
+	if got := syscall.Umask(0022); got != 0022 {
+		t.Errorf("umask %#o after listening, want 022", got)
+	}
+}
+
+func TestPeerPID(t *testing.T) {
+	addr := Addr("ipc-test")
+	l, err := Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		if c, err := DialContext(context.Background(), Target(addr)); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	pid, ok, err := PeerPID(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || pid != os.Getpid() {
+		t.Errorf("peer %v (%v), want %v", pid, ok, os.Getpid())
+	}
+}
+
+func TestSocketFile(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantOK      bool
+	}{
+		{
+			description: "path",
+			input:       "/run/yggd/worker.sock",
+			want:        "/run/yggd/worker.sock",
+			wantOK:      true,
+		},
+		{
+			description: "target",
+			input:       "unix:/run/yggd/worker.sock",
+			want:        "/run/yggd/worker.sock",
+			wantOK:      true,
+		},
+		{
+			description: "abstract",
+			input:       "@ygg-echo-abcdef",
+		},
+		{
+			description: "abstract target",
+			input:       "unix:@ygg-echo-abcdef",
+		},
+		{
+			description: "vsock",
+			input:       "vsock:3:1024",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, ok := SocketFile(test.input)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("SocketFile(%q) = %q, %v, want %q, %v", test.input, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"unsafe"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
+	"google.golang.org/grpc"
+)
+
+// Scheme is the gRPC scheme of socket targets. gRPC does not resolve it
+// itself; Dial connects to the named pipe.
+const Scheme = "npipe"
+
+// privateSecurityDescriptor only allows the local system and administrators
+// to connect to a named pipe.
+const privateSecurityDescriptor = "D:P(A;;GA;;;SY)(A;;GA;;;BA)"
+
+// Addr returns the address of the named pipe named name.
+func Addr(name string) string {
+	return `\\.\pipe\` + name
+}
+
+// SocketFile returns false: named pipes have no file to remove once their
+// server is gone.
+func SocketFile(addr string) (string, bool) {
+	return "", false
+}
+
+// listen listens on the named pipe at addr, with the default security of
+// named pipes: only the local system, administrators and the owner of the
+// process may connect.
+func listen(addr string) (net.Listener, error) {
+	return winio.ListenPipe(strings.TrimPrefix(addr, Scheme+":"), nil)
+}
+
+// ListenPrivate listens on the named pipe at path, which only the local
+// system and administrators may connect to.
+func ListenPrivate(path string) (net.Listener, error) {
+	l, err := winio.ListenPipe(path, &winio.PipeConfig{SecurityDescriptor: privateSecurityDescriptor})
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen to named pipe: %w", err)
+	}
+	return l, nil
+}
+
+// dialContext connects to the named pipe at addr.
+func dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, strings.TrimPrefix(addr, Scheme+":"))
+}
+
+// dialOptions returns the options gRPC connections to named pipes are
+// created with. The target is passed through as the address of the pipe.
+func dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(dialContext),
+	}
+}
+
+var procGetNamedPipeClientProcessId = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetNamedPipeClientProcessId")
+
+// PeerPID returns the PID of the client process of conn, as reported by the
+// system. ok is false if conn is not a named pipe connection.
+func PeerPID(conn net.Conn) (pid int, ok bool, err error) {
+	f, ok := conn.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, false, nil
+	}
+	var id uint32
+	r, _, e := procGetNamedPipeClientProcessId.Call(f.Fd(), uintptr(unsafe.Pointer(&id)))
+	if r == 0 {
+		return 0, false, fmt.Errorf("cannot get client process: %w", e)
+	}
+	return int(id), true, nil
+}
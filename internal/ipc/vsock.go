@@ -0,0 +1,87 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/vsock"
+)
+
+// VsockScheme is the prefix of VM socket addresses.
+const VsockScheme = "vsock"
+
+// VsockHost is the context ID under which virtual machines reach their host.
+const VsockHost = vsock.Host
+
+// vsockAny is the context ID a listener binds to in order to accept
+// connections addressed to any context ID of the machine.
+const vsockAny = 0xffffffff
+
+// VsockAddr returns the address of VM socket port on the machine with context
+// ID cid.
+func VsockAddr(cid, port uint32) string {
+	return fmt.Sprintf("%v:%v:%v", VsockScheme, cid, port)
+}
+
+// VsockListenAddr returns the address of VM socket port on any context ID of
+// the local machine.
+func VsockListenAddr(port uint32) string {
+	return VsockAddr(vsockAny, port)
+}
+
+// PeerVsockCID returns the context ID of the machine at addr, the remote
+// address of a connection. ok is false if addr is not a VM socket address.
+func PeerVsockCID(addr net.Addr) (cid uint32, ok bool) {
+	a, ok := addr.(*vsock.Addr)
+	if !ok {
+		return 0, false
+	}
+	return a.ContextID, true
+}
+
+func isVsock(addr string) bool {
+	return strings.HasPrefix(addr, VsockScheme+":")
+}
+
+// parseVsockAddr returns the context ID and port of the VM socket address
+// addr.
+func parseVsockAddr(addr string) (cid, port uint32, err error) {
+	fields := strings.Split(strings.TrimPrefix(addr, VsockScheme+":"), ":")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid VM socket address %q", addr)
+	}
+	c, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid VM socket context ID %q: %w", fields[0], err)
+	}
+	p, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid VM socket port %q: %w", fields[1], err)
+	}
+	return uint32(c), uint32(p), nil
+}
+
+// listenVsock listens on the VM socket at addr.
+func listenVsock(addr string) (net.Listener, error) {
+	cid, port, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return vsock.ListenContextID(cid, port, nil)
+}
+
+// dialVsock connects to the VM socket at addr. The VM socket dialer does not
+// take a context, so ctx is only checked before connecting.
+func dialVsock(ctx context.Context, addr string) (net.Conn, error) {
+	cid, port, err := parseVsockAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return vsock.Dial(cid, port, nil)
+}
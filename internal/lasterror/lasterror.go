@@ -0,0 +1,67 @@
+// Package lasterror records the most recent error of each subsystem of yggd,
+// such as the transport, the dispatcher, the data plane HTTP client or an
+// individual worker, so that a failing subsystem can be identified without
+// searching the logs.
+//
+// The number of errors of each subsystem is published with expvar in the
+// "errors" map, keyed by subsystem.
+package lasterror
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// Subsystem names.
+const (
+	Transport  = "transport"
+	Dispatcher = "dispatcher"
+	DataPlane  = "data-plane"
+)
+
+// Worker returns the subsystem name of the worker handling directive.
+func Worker(directive string) string {
+	return "worker/" + directive
+}
+
+// Metrics counts the errors recorded for each subsystem.
+var Metrics = expvar.NewMap("errors")
+
+var (
+	lock     sync.RWMutex
+	registry = make(map[string]yggdrasil.SubsystemError)
+)
+
+// Set records err as the last error of subsystem. A nil err is ignored.
+func Set(subsystem string, err error) {
+	if err == nil {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	e := registry[subsystem]
+	e.Message = err.Error()
+	e.Time = time.Now().UTC()
+	e.Count++
+	registry[subsystem] = e
+
+	Metrics.Add(subsystem, 1)
+}
+
+// All returns a copy of the last error of each subsystem that recorded one,
+// keyed by subsystem.
+func All() map[string]yggdrasil.SubsystemError {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	all := make(map[string]yggdrasil.SubsystemError, len(registry))
+	for subsystem, e := range registry {
+		all[subsystem] = e
+	}
+	return all
+}
@@ -0,0 +1,36 @@
+package lasterror
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	Set(Transport, fmt.Errorf("connection refused"))
+	Set(Transport, fmt.Errorf("connection reset"))
+	Set(Worker("echo"), fmt.Errorf("cannot dial socket"))
+	Set(DataPlane, nil)
+
+	all := All()
+	if len(all) != 2 {
+		t.Fatalf("expected 2 subsystems, got %v", len(all))
+	}
+
+	tests := []struct {
+		subsystem   string
+		wantMessage string
+		wantCount   int
+	}{
+		{subsystem: Transport, wantMessage: "connection reset", wantCount: 2},
+		{subsystem: "worker/echo", wantMessage: "cannot dial socket", wantCount: 1},
+	}
+	for _, test := range tests {
+		got := all[test.subsystem]
+		if got.Message != test.wantMessage || got.Count != test.wantCount {
+			t.Errorf("%v: %+v, want message %q and count %v", test.subsystem, got, test.wantMessage, test.wantCount)
+		}
+		if got.Time.IsZero() {
+			t.Errorf("%v: time not set", test.subsystem)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package logging provides alternative output formats for the go-log
+// package, and per-subsystem log levels.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modulePath = "github.com/redhatinsights/yggdrasil/"
+	goLogPath  = "git.sr.ht/~spc/go-log"
+
+	loggingPath = modulePath + "internal/logging"
+)
+
+// levels maps the names of go-log logging functions, without their "f" or
+// "ln" suffix, to the level they log at.
+var levels = map[string]string{
+	"Error": "error",
+	"Warn":  "warn",
+	"Info":  "info",
+	"Debug": "debug",
+	"Trace": "trace",
+	"Fatal": "fatal",
+	"Panic": "panic",
+}
+
+var (
+	messageIDPattern = regexp.MustCompile(`message ([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})`)
+	directivePattern = regexp.MustCompile(`directive:? ([^\s:;,]+)`)
+	groupPattern     = regexp.MustCompile(`operation group:? ([^\s:;,]+)`)
+)
+
+// An Entry is a single structured log record.
+type Entry struct {
+	Time           time.Time `json:"time"`
+	Level          string    `json:"level,omitempty"`
+	Component      string    `json:"component,omitempty"`
+	Caller         string    `json:"caller,omitempty"`
+	Message        string    `json:"message"`
+	MessageID      string    `json:"message_id,omitempty"`
+	Directive      string    `json:"directive,omitempty"`
+	OperationGroup string    `json:"operation_group,omitempty"`
+}
+
+// A JSONWriter is an io.Writer that formats each log line written by go-log
+// as a JSON object on a line of its own. It is installed with log.SetOutput,
+// with flags set to 0 and an empty prefix, so that each write is exactly one
+// message.
+//
+// go-log does not pass the level of a message to its output, so the level,
+// the component (the package of the calling code) and the caller are
+// recovered from the call stack. A message ID, directive and operation group
+// are included when the message names them ("message <UUID>",
+// "directive <NAME>", "operation group <ID>").
+type JSONWriter struct {
+	lock sync.Mutex
+	out  io.Writer
+	name string
+}
+
+// NewJSONWriter creates a JSONWriter writing to out. Messages logged from a
+// main package are attributed to the component name.
+func NewJSONWriter(out io.Writer, name string) *JSONWriter {
+	return &JSONWriter{out: out, name: name}
+}
+
+// Write formats p as a JSON log entry and writes it to the underlying writer.
+func (w *JSONWriter) Write(p []byte) (int, error) {
+	entry := Entry{
+		Time:    time.Now().UTC(),
+		Message: strings.TrimSuffix(string(p), "\n"),
+	}
+	var pkg string
+	entry.Level, pkg, entry.Caller = caller()
+	entry.Component = strings.TrimPrefix(pkg, modulePath)
+	if entry.Component == "main" {
+		entry.Component = w.name
+	}
+	if m := messageIDPattern.FindStringSubmatch(entry.Message); m != nil {
+		entry.MessageID = m[1]
+	}
+	if m := directivePattern.FindStringSubmatch(entry.Message); m != nil {
+		entry.Directive = m[1]
+	}
+	if m := groupPattern.FindStringSubmatch(entry.Message); m != nil {
+		entry.OperationGroup = m[1]
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, err := w.out.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// caller walks the call stack up to the first frame outside of the log and
+// go-log packages and the writers of this package, returning the level of the
+// logging function called and the package and location of the calling code.
+func caller() (level, pkg, location string) {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		frame, more := frames.Next()
+		p := packageName(frame.Function)
+		if p == "log" || p == goLogPath {
+			name := frame.Function[strings.LastIndex(frame.Function, ".")+1:]
+			name = strings.TrimSuffix(strings.TrimSuffix(name, "ln"), "f")
+			if l, ok := levels[name]; ok && level == "" {
+				level = l
+			}
+		} else if p != "" && !strings.HasPrefix(frame.Function, loggingPath+".(*") {
+			return level, p, fmt.Sprintf("%v:%v", frame.File, frame.Line)
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// packageName returns the import path of the package of the fully qualified
+// function name fn.
+func packageName(fn string) string {
+	slash := strings.LastIndex(fn, "/")
+	dot := strings.Index(fn[slash+1:], ".")
+	if dot < 0 {
+		return ""
+	}
+	return fn[:slash+1+dot]
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New(NewJSONWriter(&buf, "yggd"), "", 0, log.LevelTrace)
+
+	l.Warnf("cannot dispatch message %v to directive: %v", "0f2a3c1e-8d0b-4f6a-9e3b-1c2d3e4f5a6b", "echo")
+	l.Trace("ping")
+	l.Infof("received message %v in operation group %v", "0f2a3c1e-8d0b-4f6a-9e3b-1c2d3e4f5a6b", "campaign-42")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %v", len(lines))
+	}
+
+	want := []Entry{
+		{
+			Level:     "warn",
+			Component: "internal/logging",
+			Message:   "cannot dispatch message 0f2a3c1e-8d0b-4f6a-9e3b-1c2d3e4f5a6b to directive: echo",
+			MessageID: "0f2a3c1e-8d0b-4f6a-9e3b-1c2d3e4f5a6b",
+			Directive: "echo",
+		},
+		{
+			Level:     "trace",
+			Component: "internal/logging",
+			Message:   "ping",
+		},
+		{
+			Level:          "info",
+			Component:      "internal/logging",
+			Message:        "received message 0f2a3c1e-8d0b-4f6a-9e3b-1c2d3e4f5a6b in operation group campaign-42",
+			MessageID:      "0f2a3c1e-8d0b-4f6a-9e3b-1c2d3e4f5a6b",
+			OperationGroup: "campaign-42",
+		},
+	}
+
+	for i, line := range lines {
+		var got Entry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(got.Caller, "json_test.go:") {
+			t.Errorf("unexpected caller: %v", got.Caller)
+		}
+		if !cmp.Equal(got, want[i], cmpopts.IgnoreFields(Entry{}, "Time", "Caller")) {
+			t.Errorf("%#v != %#v", got, want[i])
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// Subsystems are the names of the parts of yggd whose log level may be set
+// apart from the default level.
+var Subsystems = []string{"dispatcher", "transport", "http"}
+
+// levelState holds the default log level and the per-subsystem overrides.
+var levelState = struct {
+	sync.RWMutex
+	level     log.Level
+	overrides map[string]log.Level
+}{
+	level:     log.LevelInfo,
+	overrides: map[string]log.Level{},
+}
+
+// subsystem returns the subsystem the package pkg belongs to, or an empty
+// string if it belongs to none.
+func subsystem(pkg string) string {
+	switch {
+	case pkg == "main":
+		return "dispatcher"
+	case pkg == modulePath+"internal/transport" || strings.HasPrefix(pkg, modulePath+"internal/transport/"):
+		return "transport"
+	case pkg == modulePath+"internal/clients/http":
+		return "http"
+	}
+	return ""
+}
+
+// SetLevel sets the default log level, applied to every subsystem without an
+// override.
+func SetLevel(level log.Level) {
+	levelState.Lock()
+	defer levelState.Unlock()
+	levelState.level = level
+	applyLevel()
+}
+
+// Level returns the default log level.
+func Level() log.Level {
+	levelState.RLock()
+	defer levelState.RUnlock()
+	return levelState.level
+}
+
+// SetSubsystemLevel overrides the log level of subsystem, which must be one
+// of Subsystems.
+func SetSubsystemLevel(subsystem string, level log.Level) error {
+	if !isSubsystem(subsystem) {
+		return fmt.Errorf("unknown subsystem %q: expected one of %v", subsystem, strings.Join(Subsystems, ", "))
+	}
+	levelState.Lock()
+	defer levelState.Unlock()
+	levelState.overrides[subsystem] = level
+	applyLevel()
+	return nil
+}
+
+// ClearSubsystemLevel removes the override of the log level of subsystem,
+// which then logs at the default level again.
+func ClearSubsystemLevel(subsystem string) error {
+	if !isSubsystem(subsystem) {
+		return fmt.Errorf("unknown subsystem %q: expected one of %v", subsystem, strings.Join(Subsystems, ", "))
+	}
+	levelState.Lock()
+	defer levelState.Unlock()
+	delete(levelState.overrides, subsystem)
+	applyLevel()
+	return nil
+}
+
+// SetSubsystemLevels replaces all the overrides with levels, as parsed by
+// ParseSubsystemLevels.
+func SetSubsystemLevels(levels map[string]log.Level) {
+	levelState.Lock()
+	defer levelState.Unlock()
+	levelState.overrides = make(map[string]log.Level, len(levels))
+	for s, l := range levels {
+		levelState.overrides[s] = l
+	}
+	applyLevel()
+}
+
+// SubsystemLevels returns the overridden log level of each subsystem.
+func SubsystemLevels() map[string]log.Level {
+	levelState.RLock()
+	defer levelState.RUnlock()
+	levels := make(map[string]log.Level, len(levelState.overrides))
+	for s, l := range levelState.overrides {
+		levels[s] = l
+	}
+	return levels
+}
+
+// ParseSubsystemLevels parses overrides in the form "SUBSYSTEM=LEVEL".
+func ParseSubsystemLevels(values []string) (map[string]log.Level, error) {
+	levels := make(map[string]log.Level, len(values))
+	for _, value := range values {
+		fields := strings.SplitN(value, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid log level override %q: expected SUBSYSTEM=LEVEL", value)
+		}
+		if !isSubsystem(fields[0]) {
+			return nil, fmt.Errorf("unknown subsystem %q: expected one of %v", fields[0], strings.Join(Subsystems, ", "))
+		}
+		level, err := log.ParseLevel(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level override %q: %w", value, err)
+		}
+		levels[fields[0]] = level
+	}
+	return levels, nil
+}
+
+// FormatSubsystemLevels formats levels as a sorted, comma-separated list of
+// "SUBSYSTEM=LEVEL" pairs.
+func FormatSubsystemLevels(levels map[string]log.Level) string {
+	pairs := make([]string, 0, len(levels))
+	for s, l := range levels {
+		pairs = append(pairs, s+"="+strings.ToLower(l.String()))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func isSubsystem(name string) bool {
+	for _, s := range Subsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OutputLevel returns the most verbose level messages are written to the
+// output at: the most verbose of the default level and the overrides.
+func OutputLevel() log.Level {
+	levelState.RLock()
+	defer levelState.RUnlock()
+	return outputLevel()
+}
+
+// outputLevel implements OutputLevel. It must be called with levelState
+// locked.
+func outputLevel() log.Level {
+	level := levelState.level
+	for _, l := range levelState.overrides {
+		if l > level {
+			level = l
+		}
+	}
+	return level
+}
+
+// applyLevel sets the level of go-log to the output level, so that the
+// messages of every subsystem reach the output written by Filter, or to the
+// trace level if a Ring is set, so that it receives every message. It must be
+// called with levelState locked.
+func applyLevel() {
+	if CurrentRing() != nil {
+		log.SetLevel(log.LevelTrace)
+		return
+	}
+	log.SetLevel(outputLevel())
+}
+
+// A levelFilter is an io.Writer that drops the log lines written by go-log
+// that are more verbose than the level of the subsystem that logged them.
+type levelFilter struct {
+	out io.Writer
+}
+
+// Filter returns an io.Writer, installed with log.SetOutput, that writes to
+// out the log lines at or below the level of the subsystem logging them: its
+// override, if set with SetSubsystemLevel, or else the default level. Like
+// JSONWriter, it recovers the level and the calling package from the call
+// stack. Every line is also written to the Ring set with SetRing, if any.
+func Filter(out io.Writer) io.Writer {
+	return &levelFilter{out: out}
+}
+
+func (f *levelFilter) Write(p []byte) (int, error) {
+	r := CurrentRing()
+	if r != nil {
+		r.Write(p)
+	}
+
+	levelState.RLock()
+	filtered := len(levelState.overrides) > 0 || r != nil
+	levelState.RUnlock()
+	if !filtered {
+		return f.out.Write(p)
+	}
+
+	name, pkg, _ := caller()
+	if level, err := log.ParseLevel(name); err == nil && level > effectiveLevel(subsystem(pkg)) {
+		return len(p), nil
+	}
+	return f.out.Write(p)
+}
+
+// effectiveLevel returns the level messages of subsystem are logged at.
+func effectiveLevel(subsystem string) log.Level {
+	levelState.RLock()
+	defer levelState.RUnlock()
+	if l, prs := levelState.overrides[subsystem]; prs {
+		return l
+	}
+	return levelState.level
+}
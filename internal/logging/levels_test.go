@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSubsystem(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "main", want: "dispatcher"},
+		{input: modulePath + "internal/transport", want: "transport"},
+		{input: modulePath + "internal/transport/mqtt", want: "transport"},
+		{input: modulePath + "internal/clients/http", want: "http"},
+		{input: modulePath + "internal/transporter", want: ""},
+		{input: modulePath + "worker", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			if got := subsystem(test.input); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSubsystemLevels(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        map[string]log.Level
+		wantError   bool
+	}{
+		{
+			description: "valid",
+			input:       []string{"transport=trace", "http=debug"},
+			want:        map[string]log.Level{"transport": log.LevelTrace, "http": log.LevelDebug},
+		},
+		{
+			description: "unknown subsystem",
+			input:       []string{"worker=debug"},
+			wantError:   true,
+		},
+		{
+			description: "invalid level",
+			input:       []string{"transport=loud"},
+			wantError:   true,
+		},
+		{
+			description: "missing level",
+			input:       []string{"transport"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := ParseSubsystemLevels(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	defer SetSubsystemLevels(nil)
+	defer SetLevel(Level())
+
+	var buf bytes.Buffer
+	l := log.New(Filter(&buf), "", 0, log.LevelTrace)
+
+	SetLevel(log.LevelInfo)
+	l.Debug("unfiltered")
+
+	// Messages logged from this package belong to no subsystem, and are
+	// therefore filtered at the default level once overrides are set.
+	SetSubsystemLevels(map[string]log.Level{"transport": log.LevelTrace})
+	l.Debug("filtered")
+	l.Info("kept")
+	if level := log.CurrentLevel(); level != log.LevelTrace {
+		t.Errorf("go-log level %v != %v", level, log.LevelTrace)
+	}
+
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{"unfiltered", "kept"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
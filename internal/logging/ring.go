@@ -0,0 +1,121 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ringChunkSize is the amount of log output, in bytes, compressed at once
+// into a Zstandard frame. Larger chunks compress better, but the output not
+// yet compressed is held uncompressed.
+const ringChunkSize = 64 << 10
+
+// A Ring is an io.Writer keeping the most recent log output, compressed with
+// Zstandard, within a bounded amount of memory. The output is compressed in
+// chunks, each an independent Zstandard frame, and the oldest chunks are
+// dropped once the compressed size exceeds the size of the ring.
+type Ring struct {
+	lock    sync.Mutex
+	size    int
+	chunks  [][]byte
+	used    int
+	pending bytes.Buffer
+	encoder *zstd.Encoder
+}
+
+// NewRing returns a Ring keeping at most size bytes of compressed output, in
+// addition to the output not yet compressed.
+func NewRing(size int) (*Ring, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create encoder: %w", err)
+	}
+	return &Ring{size: size, encoder: encoder}, nil
+}
+
+// Write appends p to the ring.
+func (r *Ring) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pending.Write(p)
+	if r.pending.Len() >= ringChunkSize {
+		r.compress()
+	}
+	return len(p), nil
+}
+
+// compress compresses the pending output into a new chunk, dropping the
+// oldest chunks that no longer fit. The caller must hold the lock.
+func (r *Ring) compress() {
+	chunk := r.encoder.EncodeAll(r.pending.Bytes(), nil)
+	r.pending.Reset()
+	r.chunks = append(r.chunks, chunk)
+	r.used += len(chunk)
+	for r.used > r.size && len(r.chunks) > 1 {
+		r.used -= len(r.chunks[0])
+		r.chunks[0] = nil
+		r.chunks = r.chunks[1:]
+	}
+}
+
+// Dump writes the content of the ring to w as a Zstandard stream, which
+// zstd(1) decompresses.
+func (r *Ring) Dump(w io.Writer) error {
+	r.lock.Lock()
+	chunks := append([][]byte(nil), r.chunks...)
+	if r.pending.Len() > 0 {
+		chunks = append(chunks, r.encoder.EncodeAll(r.pending.Bytes(), nil))
+	}
+	r.lock.Unlock()
+
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decompress writes the content of the Zstandard stream read from r, as
+// written by Ring.Dump, to w.
+func Decompress(w io.Writer, r io.Reader) error {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("cannot create decoder: %w", err)
+	}
+	defer decoder.Close()
+	if _, err := io.Copy(w, decoder); err != nil {
+		return fmt.Errorf("cannot decompress: %w", err)
+	}
+	return nil
+}
+
+// ring receives all log output, whatever its level, when set with SetRing.
+var ring struct {
+	sync.RWMutex
+	r *Ring
+}
+
+// SetRing makes r receive all log output, including trace messages not
+// written to the output because of the log level. r may be nil to stop.
+func SetRing(r *Ring) {
+	ring.Lock()
+	ring.r = r
+	ring.Unlock()
+
+	levelState.Lock()
+	defer levelState.Unlock()
+	applyLevel()
+}
+
+// CurrentRing returns the Ring set with SetRing, if any.
+func CurrentRing() *Ring {
+	ring.RLock()
+	defer ring.RUnlock()
+	return ring.r
+}
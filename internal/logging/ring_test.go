@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		description string
+		size        int
+		lines       int
+		wantFirst   bool
+	}{
+		{
+			description: "within size",
+			size:        1 << 20,
+			lines:       10000,
+			wantFirst:   true,
+		},
+		{
+			description: "oldest dropped",
+			size:        1,
+			lines:       30000,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r, err := NewRing(test.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < test.lines; i++ {
+				fmt.Fprintf(r, "line %v\n", i)
+			}
+
+			var dump, got bytes.Buffer
+			if err := r.Dump(&dump); err != nil {
+				t.Fatal(err)
+			}
+			if err := Decompress(&got, &dump); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(got.String(), fmt.Sprintf("line %v\n", test.lines-1)) {
+				t.Errorf("last line missing from dump")
+			}
+			if first := strings.HasPrefix(got.String(), "line 0\n"); first != test.wantFirst {
+				t.Errorf("first line kept: %v, want %v", first, test.wantFirst)
+			}
+		})
+	}
+}
+
+func TestFilterRing(t *testing.T) {
+	defer SetRing(nil)
+	defer SetLevel(Level())
+
+	r, err := NewRing(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetLevel(log.LevelInfo)
+	SetRing(r)
+	if level := log.CurrentLevel(); level != log.LevelTrace {
+		t.Errorf("go-log level %v != %v", level, log.LevelTrace)
+	}
+
+	var buf bytes.Buffer
+	l := log.New(Filter(&buf), "", 0, log.LevelTrace)
+	l.Trace("traced")
+	l.Info("kept")
+
+	if got, want := strings.TrimSpace(buf.String()), "kept"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	var dump, got bytes.Buffer
+	if err := r.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+	if err := Decompress(&got, &dump); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"traced", "kept"}
+	if lines := strings.Split(strings.TrimSpace(got.String()), "\n"); !cmp.Equal(lines, want) {
+		t.Errorf("%#v != %#v", lines, want)
+	}
+}
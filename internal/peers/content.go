@@ -0,0 +1,80 @@
+package peers
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contentPath is the path prefix under which peers serve content, followed by
+// the hex encoded SHA-256 digest of the payload.
+const contentPath = "/v1/content/"
+
+// A Handler serves the payloads in Dir, each in a file named after its hex
+// encoded SHA-256 digest, to peers.
+type Handler struct {
+	Dir string
+
+	// Served, if set, is called with the digest of each payload served.
+	Served func(digest string)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	digest := strings.TrimPrefix(r.URL.Path, contentPath)
+	if digest == r.URL.Path || !validDigest(digest) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(h.Dir, digest))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	if h.Served != nil && r.Method == http.MethodGet {
+		h.Served(digest)
+	}
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// Fetch downloads the payload with digest from the peer at addr into w. The
+// caller verifies the payload; peers are not trusted.
+func Fetch(ctx context.Context, client *http.Client, addr string, digest []byte, w io.Writer) error {
+	URL := "http://" + addr + contentPath + hex.EncodeToString(digest)
+	req, err := http.NewRequest(http.MethodGet, URL, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create request: %w", err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("cannot get content from peer: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot get content from peer %v: %v", addr, resp.Status)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("cannot get content from peer %v: %w", addr, err)
+	}
+	return nil
+}
+
+// validDigest reports whether s is a hex encoded SHA-256 digest.
+func validDigest(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32 && s == strings.ToLower(s)
+}
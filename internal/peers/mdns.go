@@ -0,0 +1,266 @@
+// Package peers lets yggd instances on the same network find each other with
+// multicast DNS, so that payloads one of them already downloaded can be
+// fetched from it rather than again from the server. Each instance announces
+// the content service under its own instance name and answers queries for it;
+// a querier takes the address a response came from and the port of its SRV
+// record as the address of a peer.
+package peers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Service is the DNS-SD service type peers announce.
+const Service = "_yggdrasil-content._tcp.local."
+
+// mdnsAddr is the IPv4 multicast DNS group and port.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// announceTTL is the time to live of the records of an announcement, in
+// seconds.
+const announceTTL = 120
+
+// A Responder answers multicast DNS queries for Service with the instance and
+// port of the local content server.
+type Responder struct {
+	// Instance names the local instance, such as the client ID.
+	Instance string
+
+	// Port is the port of the content server.
+	Port int
+}
+
+// ListenAndServe joins the multicast DNS group on all interfaces and answers
+// queries until ctx is done or reading fails.
+func (r *Responder) ListenAndServe(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return fmt.Errorf("cannot join multicast DNS group: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return r.Serve(conn)
+}
+
+// Serve answers the queries read from conn until reading fails.
+func (r *Responder) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 9000)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp, ok := r.answer(buf[:n])
+		if !ok {
+			continue
+		}
+		// Answers are sent to the querier only, which is all that
+		// queriers from ephemeral ports accept.
+		conn.WriteTo(resp, addr)
+	}
+}
+
+// answer returns the response to the query msg, if it asks for Service.
+func (r *Responder) answer(msg []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false
+	}
+	var q *dnsmessage.Question
+	for i := range questions {
+		if strings.EqualFold(questions[i].Name.String(), Service) && (questions[i].Type == dnsmessage.TypePTR || questions[i].Type == dnsmessage.TypeALL) {
+			q = &questions[i]
+			break
+		}
+	}
+	if q == nil {
+		return nil, false
+	}
+
+	instance, err := dnsmessage.NewName(instanceName(r.Instance))
+	if err != nil {
+		return nil, false
+	}
+	target, err := dnsmessage.NewName(hostName(r.Instance))
+	if err != nil {
+		return nil, false
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(*q); err != nil {
+		return nil, false
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, false
+	}
+	if err := b.PTRResource(
+		dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: announceTTL},
+		dnsmessage.PTRResource{PTR: instance},
+	); err != nil {
+		return nil, false
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, false
+	}
+	if err := b.SRVResource(
+		dnsmessage.ResourceHeader{Name: instance, Class: dnsmessage.ClassINET, TTL: announceTTL},
+		dnsmessage.SRVResource{Port: uint16(r.Port), Target: target},
+	); err != nil {
+		return nil, false
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Discover sends a multicast DNS query for Service and returns the address,
+// as "host:port", of each peer that answered within timeout, except the
+// instance self.
+func Discover(ctx context.Context, self string, timeout time.Duration) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open socket: %w", err)
+	}
+	defer conn.Close()
+	return discover(ctx, conn, mdnsAddr, self, timeout)
+}
+
+func discover(ctx context.Context, conn net.PacketConn, group net.Addr, self string, timeout time.Duration) ([]string, error) {
+	query, err := newQuery()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(query, group); err != nil {
+		return nil, fmt.Errorf("cannot send query: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("cannot set deadline: %w", err)
+	}
+
+	var addrs []string
+	seen := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return addrs, nil
+			}
+			return addrs, err
+		}
+		udp, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		instance, port, ok := parseAnswer(buf[:n])
+		if !ok || strings.EqualFold(instance, instanceName(self)) {
+			continue
+		}
+		addr := net.JoinHostPort(udp.IP.String(), fmt.Sprint(port))
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+}
+
+// newQuery returns a multicast DNS query for the PTR records of Service.
+func newQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(Service)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseAnswer returns the instance and port announced in the response msg.
+func parseAnswer(msg []byte) (string, uint16, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response {
+		return "", 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", 0, false
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return "", 0, false
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return "", 0, false
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err != nil {
+			return "", 0, false
+		}
+		if rh.Type != dnsmessage.TypeSRV || !strings.HasSuffix(strings.ToLower(rh.Name.String()), "."+Service) {
+			if err := p.SkipAdditional(); err != nil {
+				return "", 0, false
+			}
+			continue
+		}
+		srv, err := p.SRVResource()
+		if err != nil {
+			return "", 0, false
+		}
+		return rh.Name.String(), srv.Port, true
+	}
+}
+
+// instanceName returns the DNS-SD service instance name of instance.
+func instanceName(instance string) string {
+	return label(instance) + "." + Service
+}
+
+// hostName returns the host name announced for instance.
+func hostName(instance string) string {
+	return label(instance) + ".local."
+}
+
+// label returns instance as a single DNS label.
+func label(instance string) string {
+	l := strings.Map(func(r rune) rune {
+		if r == '.' || r == '\\' {
+			return '-'
+		}
+		return r
+	}, instance)
+	if len(l) > 63 {
+		l = l[:63]
+	}
+	if l == "" {
+		l = "yggdrasil"
+	}
+	return l
+}
@@ -0,0 +1,137 @@
+package peers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		description string
+		instance    string
+		self        string
+		wantPeer    bool
+	}{
+		{
+			description: "peer",
+			instance:    "host-a",
+			self:        "host-b",
+			wantPeer:    true,
+		},
+		{
+			description: "self",
+			instance:    "host-a",
+			self:        "host-a",
+		},
+		{
+			description: "dotted instance",
+			instance:    "host.example.com",
+			self:        "host-b",
+			wantPeer:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			r := &Responder{Instance: test.instance, Port: 8911}
+			go r.Serve(server)
+
+			client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			got, err := discover(context.Background(), client, server.LocalAddr(), test.self, 500*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			if test.wantPeer {
+				want = []string{"127.0.0.1:8911"}
+			}
+			if !cmp.Equal(got, want) {
+				t.Errorf("%#v", cmp.Diff(got, want))
+			}
+		})
+	}
+}
+
+func TestAnswerIgnoresOtherQueries(t *testing.T) {
+	r := &Responder{Instance: "host-a", Port: 8911}
+	if _, ok := r.answer([]byte("not a DNS message")); ok {
+		t.Error("answered garbage")
+	}
+	query, err := newQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := r.answer(query)
+	if !ok {
+		t.Fatal("query not answered")
+	}
+	if _, ok := r.answer(resp); ok {
+		t.Error("answered a response")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-peers-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("payload")
+	digest := sha256.Sum256(content)
+	if err := ioutil.WriteFile(filepath.Join(dir, hex.EncodeToString(digest[:])), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var served []string
+	server := httptest.NewServer(&Handler{Dir: dir, Served: func(d string) { served = append(served, d) }})
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	var buf bytes.Buffer
+	if err := Fetch(context.Background(), server.Client(), addr, digest[:], &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("content = %q, want %q", buf.Bytes(), content)
+	}
+	if len(served) != 1 {
+		t.Errorf("served = %v", served)
+	}
+
+	missing := sha256.Sum256([]byte("missing"))
+	if err := Fetch(context.Background(), server.Client(), addr, missing[:], &buf); err == nil {
+		t.Error("fetched missing content")
+	}
+	for _, path := range []string{"/v1/content/../secret", "/v1/content/" + strings.ToUpper(hex.EncodeToString(digest[:])), "/other"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%v: status = %v", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keySize is the size of the key file, in bytes.
+const keySize = 32
+
+// MachineIDPath is the path of the file holding the machine ID the
+// encryption key is bound to.
+var MachineIDPath = "/etc/machine-id"
+
+// KeyFile is a Backend encrypting secrets with AES-256-GCM. The encryption
+// key is derived from a random key file, readable only by its owner and
+// stored apart from the configuration, and from the machine ID, binding the
+// secrets to the machine: a copy of the secrets and key files cannot be
+// decrypted elsewhere. The key is only as safe as the key file, though.
+type KeyFile struct {
+	// Path is the path of the key file, which is created when the first
+	// secret is sealed.
+	Path string
+}
+
+// Seal implements Backend.
+func (k *KeyFile) Seal(name string, value []byte) ([]byte, error) {
+	aead, err := k.cipher(true)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, value, []byte(name)), nil
+}
+
+// Unseal implements Backend.
+func (k *KeyFile) Unseal(name string, sealed []byte) ([]byte, error) {
+	aead, err := k.cipher(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed value too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+}
+
+// cipher returns the AEAD encrypting the secrets, creating the key file if
+// create is true and it does not exist.
+func (k *KeyFile) cipher(create bool) (cipher.AEAD, error) {
+	key, err := ioutil.ReadFile(k.Path)
+	if os.IsNotExist(err) && create {
+		key, err = createKey(k.Path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key: %w", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid key size %v", len(key))
+	}
+	machineID, err := ioutil.ReadFile(MachineIDPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read machine ID: %w", err)
+	}
+
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte(strings.TrimSpace(string(machineID))))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// createKey writes a new random key to the file at path, readable only by its
+// owner.
+func createKey(path string) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("cannot generate key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,203 @@
+// Package secrets stores credentials, such as broker passwords and tokens,
+// encrypted on disk, so that configuration files refer to them by name
+// instead of holding them in plain text.
+//
+// Secrets are sealed by a Backend. KeyFile encrypts them with a key derived
+// from a random key file and the machine ID; TPM2 seals them with a key held
+// by the TPM of the machine.
+package secrets
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// ReferencePrefix prefixes configuration values that name a secret rather
+// than hold a value, such as "secret:broker-password".
+const ReferencePrefix = "secret:"
+
+// A Backend seals the values of secrets, so that they can be stored, and
+// unseals them. The name of the secret is bound to its sealed value, so that
+// sealed values cannot be swapped between secrets.
+type Backend interface {
+	Seal(name string, value []byte) ([]byte, error)
+	Unseal(name string, sealed []byte) ([]byte, error)
+}
+
+// Backend names accepted by NewBackend.
+const (
+	BackendKeyFile = "key-file"
+	BackendTPM2    = "tpm2"
+)
+
+// NewBackend returns the backend named name: BackendKeyFile, a KeyFile
+// backend using the key file at DefaultKeyPath, or BackendTPM2, a TPM2
+// backend.
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case BackendKeyFile:
+		return &KeyFile{Path: DefaultKeyPath()}, nil
+	case BackendTPM2:
+		return &TPM2{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported secrets backend: %v", name)
+	}
+}
+
+// DefaultPath returns the path of the file holding the encrypted secrets.
+func DefaultPath() string {
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "secrets.json")
+}
+
+// DefaultKeyPath returns the path of the key file.
+func DefaultKeyPath() string {
+	return filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "secrets.key")
+}
+
+// A Store is a set of named secrets kept in the file at path, sealed by a
+// backend.
+type Store struct {
+	lock    sync.Mutex
+	path    string
+	backend Backend
+}
+
+// NewStore returns the store of the secrets in the file at path, sealed by
+// backend.
+func NewStore(path string, backend Backend) *Store {
+	return &Store{path: path, backend: backend}
+}
+
+// Get returns the value of the secret name.
+func (s *Store) Get(name string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sealed, err := s.read()
+	if err != nil {
+		return "", err
+	}
+	encoded, prs := sealed[name]
+	if !prs {
+		return "", fmt.Errorf("secret %v not found", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("secret %v is corrupt", name)
+	}
+	value, err := s.backend.Unseal(name, data)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret %v: %w", name, err)
+	}
+	return string(value), nil
+}
+
+// Set encrypts value and stores it as the secret name, replacing any previous
+// value.
+func (s *Store) Set(name, value string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sealed, err := s.read()
+	if err != nil {
+		return err
+	}
+	data, err := s.backend.Seal(name, []byte(value))
+	if err != nil {
+		return fmt.Errorf("cannot encrypt secret %v: %w", name, err)
+	}
+	sealed[name] = base64.StdEncoding.EncodeToString(data)
+	return s.write(sealed)
+}
+
+// Delete removes the secret name.
+func (s *Store) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sealed, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, prs := sealed[name]; !prs {
+		return fmt.Errorf("secret %v not found", name)
+	}
+	delete(sealed, name)
+	return s.write(sealed)
+}
+
+// List returns the names of the stored secrets, sorted.
+func (s *Store) List() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sealed, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(sealed))
+	for name := range sealed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Resolve returns value unchanged, unless it is a reference to a secret in
+// the form "secret:NAME", in which case it returns the value of the secret.
+func (s *Store) Resolve(value string) (string, error) {
+	if !strings.HasPrefix(value, ReferencePrefix) {
+		return value, nil
+	}
+	return s.Get(strings.TrimPrefix(value, ReferencePrefix))
+}
+
+// read reads the encrypted secrets. The caller must hold the lock.
+func (s *Store) read() (map[string]string, error) {
+	sealed := make(map[string]string)
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sealed, nil
+		}
+		return nil, fmt.Errorf("cannot read secrets: %w", err)
+	}
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal secrets: %w", err)
+	}
+	return sealed, nil
+}
+
+// write replaces the secrets file with sealed atomically. The caller must
+// hold the lock.
+func (s *Store) write(sealed map[string]string) error {
+	data, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot marshal secrets: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write secrets: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot replace secrets: %w", err)
+	}
+	return nil
+}
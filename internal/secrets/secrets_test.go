@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(path string) { MachineIDPath = path }(MachineIDPath)
+	MachineIDPath = filepath.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(MachineIDPath, []byte("0123456789abcdef0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(filepath.Join(dir, "secrets.json"), &KeyFile{Path: filepath.Join(dir, "state", "secrets.key")})
+	if err := s.Set("broker-password", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("token", "abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		want        string
+		wantError   bool
+	}{
+		{description: "plain value", input: "hunter2", want: "hunter2"},
+		{description: "reference", input: "secret:broker-password", want: "hunter2"},
+		{description: "missing secret", input: "secret:proxy-password", wantError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := s.Resolve(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "secrets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("secret stored in plain text: %v", string(data))
+	}
+
+	if err := s.Delete("token"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(names, []string{"broker-password"}) {
+		t.Errorf("unexpected secrets: %v", names)
+	}
+
+	// Secrets cannot be decrypted on another machine.
+	if err := ioutil.WriteFile(MachineIDPath, []byte("fedcba9876543210fedcba9876543210\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get("broker-password"); err == nil {
+		t.Errorf("expected error, got %v", got)
+	}
+}
+
+func TestTPM2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake systemd-creds records its arguments and reverses its input,
+	// standing in for the TPM.
+	defer func(path string) { SystemdCredsPath = path }(SystemdCredsPath)
+	SystemdCredsPath = filepath.Join(dir, "systemd-creds")
+	script := "#!/bin/sh\necho \"$@\" >> " + filepath.Join(dir, "args") + "\nrev\n"
+	if err := ioutil.WriteFile(SystemdCredsPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(filepath.Join(dir, "secrets.json"), &TPM2{})
+	if err := s.Set("broker-password", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get("broker-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hunter2" {
+		t.Errorf("%v != hunter2", got)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "encrypt --with-key=tpm2 --name=broker-password - -\ndecrypt --name=broker-password - -\n"
+	if string(data) != want {
+		t.Errorf("%q != %q", string(data), want)
+	}
+}
@@ -0,0 +1,44 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SystemdCredsPath is the path of systemd-creds(1), which seals and unseals
+// secrets for the TPM2 backend.
+var SystemdCredsPath = "systemd-creds"
+
+// TPM2 is a Backend sealing secrets with a key held by the TPM of the machine,
+// through systemd-creds(1), so that they cannot be decrypted without the TPM,
+// even with a copy of the whole file system.
+type TPM2 struct{}
+
+// Seal implements Backend.
+func (t *TPM2) Seal(name string, value []byte) ([]byte, error) {
+	return systemdCreds(value, "encrypt", "--with-key=tpm2", "--name="+name, "-", "-")
+}
+
+// Unseal implements Backend.
+func (t *TPM2) Unseal(name string, sealed []byte) ([]byte, error) {
+	return systemdCreds(sealed, "decrypt", "--name="+name, "-", "-")
+}
+
+// systemdCreds runs systemd-creds with args, writing input to its standard
+// input, and returns its standard output.
+func systemdCreds(input []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(SystemdCredsPath, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("systemd-creds %v: %w: %v", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("systemd-creds %v: %w", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
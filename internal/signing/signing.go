@@ -0,0 +1,53 @@
+// Package signing implements signed server messages. The server signs the
+// encoding of a control or data message with an Ed25519 private key and
+// publishes it in an Envelope, next to its detached signature; the client
+// opens the envelope if the signature was made with one of its trusted keys,
+// so that a broker cannot inject messages of its own.
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrUnsigned is returned by Open for a payload that is not an Envelope.
+var ErrUnsigned = errors.New("message is not signed")
+
+// ErrUntrusted is returned by Open for an Envelope whose signature was not
+// made with a trusted key.
+var ErrUntrusted = errors.New("message was not signed with a trusted key")
+
+// An Envelope holds the encoding of a message and its Ed25519 signature. It is
+// itself encoded as a JSON object with base64 encoded "message" and
+// "signature" fields, so that it survives transcoding to and from other
+// encodings.
+type Envelope struct {
+	Message   []byte `json:"message"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign signs msg, the encoding of a message, with key and returns it in an
+// Envelope.
+func Sign(msg []byte, key ed25519.PrivateKey) Envelope {
+	return Envelope{Message: msg, Signature: ed25519.Sign(key, msg)}
+}
+
+// Open checks that payload is an Envelope signed with one of keys, and
+// returns the message it holds.
+func Open(payload []byte, keys []ed25519.PublicKey) ([]byte, error) {
+	var e Envelope
+	if err := json.Unmarshal(payload, &e); err != nil || e.Message == nil || e.Signature == nil {
+		return nil, ErrUnsigned
+	}
+	if len(e.Signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature size %v", len(e.Signature))
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, e.Message, e.Signature) {
+			return e.Message, nil
+		}
+	}
+	return nil, ErrUntrusted
+}
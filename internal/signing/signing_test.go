@@ -0,0 +1,83 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOpen(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte(`{"type":"command","message_id":"1"}`)
+	signed, err := json.Marshal(Sign(msg, private))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := Sign(msg, private)
+	envelope.Message = []byte(`{"type":"command","message_id":"2"}`)
+	tampered, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		input       []byte
+		keys        []ed25519.PublicKey
+		want        []byte
+		wantError   error
+	}{
+		{
+			description: "trusted key",
+			input:       signed,
+			keys:        []ed25519.PublicKey{otherPublic, public},
+			want:        msg,
+		},
+		{
+			description: "untrusted key",
+			input:       signed,
+			keys:        []ed25519.PublicKey{otherPublic},
+			wantError:   ErrUntrusted,
+		},
+		{
+			description: "tampered message",
+			input:       tampered,
+			keys:        []ed25519.PublicKey{public},
+			wantError:   ErrUntrusted,
+		},
+		{
+			description: "unsigned",
+			input:       msg,
+			keys:        []ed25519.PublicKey{public},
+			wantError:   ErrUnsigned,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := Open(test.input, test.keys)
+			if test.wantError != nil {
+				if err != test.wantError {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%#v", cmp.Diff(got, test.want))
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"time"
@@ -23,6 +25,20 @@ func (e *errorTag) Is(o error) bool {
 	return reflect.TypeOf(e) == reflect.TypeOf(o)
 }
 
+// ReadTagsFile reads the tags in the TOML file at path. It returns nil if the
+// file does not exist.
+func ReadTagsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+	return ReadTags(f)
+}
+
 // ReadTags reads from its input, unmarshalling the TOML-encoded value to a map.
 // It then parses the map values into a map of string values.
 func ReadTags(in io.Reader) (map[string]string, error) {
@@ -58,3 +74,78 @@ func ReadTags(in io.Reader) (map[string]string, error) {
 
 	return tags, nil
 }
+
+// Scopes of tags, each maintained by a different party. When scopes set the
+// same tag, the value of the scope with the highest precedence is published:
+// locally configured tags override server-assigned tags, which override tags
+// derived by workers.
+const (
+	ScopeLocal  = "local"
+	ScopeServer = "server"
+	ScopeWorker = "worker"
+)
+
+// Merge returns the tags of scopes merged into a single map, the tags of later
+// scopes overriding those of earlier ones. It returns nil if no scope sets a
+// tag.
+func Merge(scopes ...map[string]string) map[string]string {
+	var merged map[string]string
+	for _, scope := range scopes {
+		for k, v := range scope {
+			if merged == nil {
+				merged = make(map[string]string)
+			}
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// WriteTagsFile writes tags to the TOML file at path, replacing it atomically
+// so that readers never see a partially written file. The file is removed if
+// tags is empty.
+func WriteTagsFile(path string, tags map[string]string) error {
+	if len(tags) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove file: %w", err)
+		}
+		return nil
+	}
+
+	values := make(map[string]interface{}, len(tags))
+	for k, v := range tags {
+		values[k] = v
+	}
+	tree, err := toml.TreeFromMap(values)
+	if err != nil {
+		return fmt.Errorf("cannot encode tags: %w", err)
+	}
+	data, err := tree.Marshal()
+	if err != nil {
+		return fmt.Errorf("cannot encode tags: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot change mode of file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("cannot rename file: %w", err)
+	}
+	return nil
+}
@@ -2,6 +2,9 @@ package tags
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -59,3 +62,92 @@ func TestReadTags(t *testing.T) {
 		})
 	}
 }
+
+func TestReadTagsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tags-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tags.toml")
+
+	got, err := ReadTagsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("expected no tags, got %v", got)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`env = "prod"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ReadTagsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"env": "prod"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []map[string]string
+		want        map[string]string
+	}{
+		{
+			description: "empty",
+			input:       []map[string]string{nil, {}},
+			want:        nil,
+		},
+		{
+			description: "precedence",
+			input: []map[string]string{
+				{"region": "worker", "role": "db"},
+				{"region": "server", "team": "ops"},
+				{"region": "local"},
+			},
+			want: map[string]string{"region": "local", "role": "db", "team": "ops"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := Merge(test.input...)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteTagsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tags-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "tags.toml")
+
+	want := map[string]string{"env": "prod", "quoted key": `"value"`}
+	if err := WriteTagsFile(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadTagsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+
+	if err := WriteTagsFile(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file was not removed: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Package tracing records a timeline of the activity of yggd, such as
+// dispatches to workers, publishes to the server, worker RPCs and transport
+// reconnects, while a recording is in progress. Recordings are written in the
+// Chrome trace event format, which chrome://tracing and Perfetto load, for
+// offline performance analysis.
+//
+// Recording is off by default; Begin and Instant then do nothing but load a
+// pointer.
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Categories of recorded events. Each category is shown as its own track.
+const (
+	Dispatch  = "dispatch"
+	Publish   = "publish"
+	Worker    = "worker"
+	Transport = "transport"
+)
+
+// MaxEvents is the number of events a recording holds; later events are
+// dropped and counted.
+const MaxEvents = 100000
+
+// ErrRecording is returned by Start while a recording is in progress.
+var ErrRecording = errors.New("a trace is already being recorded")
+
+// An event is a Chrome trace event: a complete event ("X") with a duration,
+// or an instant event ("i").
+type event struct {
+	Name      string            `json:"name"`
+	Category  string            `json:"cat"`
+	Phase     string            `json:"ph"`
+	Timestamp int64             `json:"ts"`
+	Duration  int64             `json:"dur,omitempty"`
+	Scope     string            `json:"s,omitempty"`
+	PID       int               `json:"pid"`
+	TID       int               `json:"tid"`
+	Args      map[string]string `json:"args,omitempty"`
+}
+
+// A Recording holds the events recorded between Start and its Stop.
+type Recording struct {
+	start   time.Time
+	lock    sync.Mutex
+	events  []event
+	dropped int
+	tracks  map[string]int
+}
+
+var current atomic.Value // *Recording
+
+// Start starts a recording, or returns ErrRecording if one is in progress.
+func Start() (*Recording, error) {
+	r := &Recording{start: time.Now(), tracks: make(map[string]int)}
+	startLock.Lock()
+	defer startLock.Unlock()
+	if active() != nil {
+		return nil, ErrRecording
+	}
+	current.Store(r)
+	return r, nil
+}
+
+var startLock sync.Mutex
+
+// Stop ends the recording. Events are no longer recorded once it returns.
+func (r *Recording) Stop() {
+	startLock.Lock()
+	defer startLock.Unlock()
+	if active() == r {
+		current.Store((*Recording)(nil))
+	}
+}
+
+// active returns the recording in progress, if any.
+func active() *Recording {
+	r, _ := current.Load().(*Recording)
+	return r
+}
+
+// Begin records the start of an operation named name in category, and
+// returns a function recording its end. args annotate the operation.
+func Begin(category, name string, args map[string]string) func() {
+	r := active()
+	if r == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		r.add(event{
+			Name:      name,
+			Category:  category,
+			Phase:     "X",
+			Timestamp: r.since(start),
+			Duration:  time.Since(start).Microseconds(),
+			Args:      args,
+		})
+	}
+}
+
+// Instant records an event without duration named name in category.
+func Instant(category, name string, args map[string]string) {
+	r := active()
+	if r == nil {
+		return
+	}
+	r.add(event{
+		Name:      name,
+		Category:  category,
+		Phase:     "i",
+		Timestamp: r.since(time.Now()),
+		Scope:     "t",
+		Args:      args,
+	})
+}
+
+// since returns the time elapsed between the start of the recording and t,
+// in microseconds.
+func (r *Recording) since(t time.Time) int64 {
+	return t.Sub(r.start).Microseconds()
+}
+
+func (r *Recording) add(e event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.events) >= MaxEvents {
+		r.dropped++
+		return
+	}
+	tid, prs := r.tracks[e.Category]
+	if !prs {
+		tid = len(r.tracks) + 1
+		r.tracks[e.Category] = tid
+	}
+	e.PID = os.Getpid()
+	e.TID = tid
+	r.events = append(r.events, e)
+}
+
+// Dropped returns the number of events dropped because the recording was full.
+func (r *Recording) Dropped() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.dropped
+}
+
+// WriteChrome writes the recorded events to w as a Chrome trace event JSON
+// object, naming each track after its category.
+func (r *Recording) WriteChrome(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	events := make([]event, 0, len(r.tracks)+len(r.events))
+	for category, tid := range r.tracks {
+		events = append(events, event{
+			Name:  "thread_name",
+			Phase: "M",
+			PID:   os.Getpid(),
+			TID:   tid,
+			Args:  map[string]string{"name": category},
+		})
+	}
+	events = append(events, r.events...)
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []event           `json:"traceEvents"`
+		DisplayTimeUnit string            `json:"displayTimeUnit"`
+		OtherData       map[string]string `json:"otherData"`
+	}{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ms",
+		OtherData:       map[string]string{"start": r.start.Format(time.RFC3339Nano)},
+	})
+}
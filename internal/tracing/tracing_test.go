@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecording(t *testing.T) {
+	tests := []struct {
+		description string
+		record      func()
+		want        []string
+	}{
+		{
+			description: "none",
+			record:      func() {},
+			want:        []string{},
+		},
+		{
+			description: "complete",
+			record: func() {
+				Begin(Dispatch, "echo", map[string]string{"message_id": "1"})()
+			},
+			want: []string{"M thread_name", "X echo"},
+		},
+		{
+			description: "instant",
+			record: func() {
+				Instant(Transport, "connected", nil)
+				end := Begin(Worker, "Send", nil)
+				Instant(Transport, "connection lost", nil)
+				end()
+			},
+			want: []string{"M thread_name", "M thread_name", "i connected", "i connection lost", "X Send"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r, err := Start()
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.record()
+			r.Stop()
+			Instant(Transport, "after stop", nil)
+
+			var buf bytes.Buffer
+			if err := r.WriteChrome(&buf); err != nil {
+				t.Fatal(err)
+			}
+			var trace struct {
+				TraceEvents []event `json:"traceEvents"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range trace.TraceEvents {
+				got = append(got, e.Phase+" "+e.Name)
+			}
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestStartRecording(t *testing.T) {
+	r, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Start(); err != ErrRecording {
+		t.Errorf("%v != %v", err, ErrRecording)
+	}
+	r.Stop()
+	r, err = Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Stop()
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Query parameters of a broker URI overriding, for that broker only, the TLS
+// configuration of the transport.
+const (
+	// BrokerParamCAFile names a file of PEM encoded CA certificates trusted
+	// in place of those of the transport.
+	BrokerParamCAFile = "tls-ca-file"
+
+	// BrokerParamCertFile and BrokerParamKeyFile name the files of the PEM
+	// encoded client certificate and key presented in place of those of the
+	// transport. Both must be set.
+	BrokerParamCertFile = "tls-cert-file"
+	BrokerParamKeyFile  = "tls-key-file"
+
+	// BrokerParamInsecureSkipVerify, if true, accepts any certificate the
+	// broker presents. It is meant for lab brokers only.
+	BrokerParamInsecureSkipVerify = "tls-insecure-skip-verify"
+
+	// BrokerParamServerName sets the name the certificate of the broker is
+	// verified against, in place of its host.
+	BrokerParamServerName = "tls-server-name"
+)
+
+// brokerTLSPrefix prefixes the names of the query parameters overriding the
+// TLS configuration.
+const brokerTLSPrefix = "tls-"
+
+// BrokerTLSConfig returns the TLS configuration to connect to broker with:
+// base with the overrides in the query parameters of broker applied, and
+// broker without these parameters. base is returned as is if broker has no
+// overrides. The files named are read on every call, so that replaced
+// certificates are picked up on the next connection.
+func BrokerTLSConfig(broker *url.URL, base *tls.Config) (*tls.Config, *url.URL, error) {
+	query := broker.Query()
+	overrides := make(map[string]string)
+	for name := range query {
+		if strings.HasPrefix(name, brokerTLSPrefix) {
+			overrides[name] = query.Get(name)
+			query.Del(name)
+		}
+	}
+	if len(overrides) == 0 {
+		return base, broker, nil
+	}
+	stripped := *broker
+	stripped.RawQuery = query.Encode()
+
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	for name, value := range overrides {
+		switch name {
+		case BrokerParamCAFile:
+			data, err := ioutil.ReadFile(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot read CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, nil, fmt.Errorf("no certificates found in %v", value)
+			}
+			config.RootCAs = pool
+		case BrokerParamCertFile:
+			keyFile := overrides[BrokerParamKeyFile]
+			if keyFile == "" {
+				return nil, nil, fmt.Errorf("missing %v", BrokerParamKeyFile)
+			}
+			cert, err := tls.LoadX509KeyPair(value, keyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot load client certificate: %w", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+			config.GetClientCertificate = nil
+		case BrokerParamKeyFile:
+			if overrides[BrokerParamCertFile] == "" {
+				return nil, nil, fmt.Errorf("missing %v", BrokerParamCertFile)
+			}
+		case BrokerParamInsecureSkipVerify:
+			insecure, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid value for %v: %v", name, value)
+			}
+			config.InsecureSkipVerify = insecure
+		case BrokerParamServerName:
+			config.ServerName = value
+		default:
+			return nil, nil, fmt.Errorf("unknown broker parameter %v", name)
+		}
+	}
+	return config, &stripped, nil
+}
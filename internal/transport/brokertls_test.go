@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBrokerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-brokertls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	base := &tls.Config{ServerName: "base.example.com"}
+
+	tests := []struct {
+		description string
+		broker      string
+		wantBroker  string
+		check       func(t *testing.T, config *tls.Config)
+		wantError   bool
+	}{
+		{
+			description: "no overrides",
+			broker:      "ssl://broker.example.com:8883?keep=1",
+			wantBroker:  "ssl://broker.example.com:8883?keep=1",
+			check: func(t *testing.T, config *tls.Config) {
+				if config != base {
+					t.Error("base configuration not returned as is")
+				}
+			},
+		},
+		{
+			description: "server name and insecure",
+			broker:      "ssl://10.0.0.1:8883?tls-server-name=broker.example.com&tls-insecure-skip-verify=true",
+			wantBroker:  "ssl://10.0.0.1:8883",
+			check: func(t *testing.T, config *tls.Config) {
+				if config.ServerName != "broker.example.com" || !config.InsecureSkipVerify {
+					t.Errorf("server name = %v, insecure = %v", config.ServerName, config.InsecureSkipVerify)
+				}
+				if base.InsecureSkipVerify {
+					t.Error("base configuration modified")
+				}
+			},
+		},
+		{
+			description: "CA and client certificate",
+			broker:      "wss://broker.example.com/mqtt?tls-ca-file=" + url.QueryEscape(certFile) + "&tls-cert-file=" + url.QueryEscape(certFile) + "&tls-key-file=" + url.QueryEscape(keyFile),
+			wantBroker:  "wss://broker.example.com/mqtt",
+			check: func(t *testing.T, config *tls.Config) {
+				if config.RootCAs == nil || len(config.Certificates) != 1 {
+					t.Errorf("root CAs = %v, certificates = %v", config.RootCAs, len(config.Certificates))
+				}
+			},
+		},
+		{
+			description: "certificate without key",
+			broker:      "ssl://broker.example.com:8883?tls-cert-file=" + url.QueryEscape(certFile),
+			wantError:   true,
+		},
+		{
+			description: "missing CA file",
+			broker:      "ssl://broker.example.com:8883?tls-ca-file=" + url.QueryEscape(filepath.Join(dir, "missing.pem")),
+			wantError:   true,
+		},
+		{
+			description: "CA file without certificates",
+			broker:      "ssl://broker.example.com:8883?tls-ca-file=" + url.QueryEscape(keyFile),
+			wantError:   true,
+		},
+		{
+			description: "invalid insecure",
+			broker:      "ssl://broker.example.com:8883?tls-insecure-skip-verify=maybe",
+			wantError:   true,
+		},
+		{
+			description: "unknown parameter",
+			broker:      "ssl://broker.example.com:8883?tls-version=1.0",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			u, err := url.Parse(test.broker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, broker, err := BrokerTLSConfig(u, base)
+			if test.wantError {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if broker.String() != test.wantBroker {
+				t.Errorf("broker = %v, want %v", broker, test.wantBroker)
+			}
+			test.check(t, config)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package transport
+
+import (
+	"sync"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+var (
+	capabilitiesLock   sync.RWMutex
+	serverCapabilities yggdrasil.CapabilitiesContent
+)
+
+// SetServerCapabilities records the capabilities announced by the server.
+func SetServerCapabilities(c yggdrasil.CapabilitiesContent) {
+	capabilitiesLock.Lock()
+	defer capabilitiesLock.Unlock()
+	serverCapabilities = c
+}
+
+// ServerCapabilities returns the capabilities most recently announced by the
+// server. Until the server announces its capabilities, the zero value is
+// returned, imposing no limits.
+func ServerCapabilities() yggdrasil.CapabilitiesContent {
+	capabilitiesLock.RLock()
+	defer capabilitiesLock.RUnlock()
+	return serverCapabilities
+}
@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// Content encodings of compressed data message content, as set in the
+// MetadataKeyContentEncoding metadata key and listed in the encodings of
+// server capabilities and connection-status messages.
+const (
+	ContentEncodingGzip = "gzip"
+	ContentEncodingZstd = "zstd"
+)
+
+// Compression is the content encoding data message content is compressed
+// with before it is published, once the server lists it in its capabilities.
+// Content is not compressed if Compression is empty.
+var Compression string
+
+// CompressionThreshold is the size, in bytes, below which content is not
+// compressed.
+var CompressionThreshold = 1024
+
+// maxDecompressedSize is the largest content, in bytes, a compressed or
+// encrypted message is allowed to expand to.
+const maxDecompressedSize = 64 << 20
+
+// CompressContent returns data with its content compressed if compression is
+// enabled, the server accepts the encoding and the content is at least
+// CompressionThreshold bytes long. data is returned as is if compressing
+// would not make it smaller.
+func CompressContent(data yggdrasil.Data) (yggdrasil.Data, error) {
+	if Compression == "" || len(data.Content) < CompressionThreshold || data.Metadata[yggdrasil.MetadataKeyContentEncoding] != "" {
+		return data, nil
+	}
+	if !ServerCapabilities().SupportsEncoding(Compression) {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch Compression {
+	case ContentEncodingGzip:
+		w = gzip.NewWriter(&buf)
+	case ContentEncodingZstd:
+		var err error
+		w, err = zstd.NewWriter(&buf)
+		if err != nil {
+			return data, fmt.Errorf("cannot create zstd writer: %w", err)
+		}
+	default:
+		return data, fmt.Errorf("unsupported content encoding: %v", Compression)
+	}
+	if _, err := w.Write(data.Content); err != nil {
+		return data, fmt.Errorf("cannot compress content: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return data, fmt.Errorf("cannot compress content: %w", err)
+	}
+	content, err := json.Marshal(buf.Bytes())
+	if err != nil {
+		return data, fmt.Errorf("cannot marshal compressed content: %w", err)
+	}
+	if len(content) >= len(data.Content) {
+		return data, nil
+	}
+
+	metadata := make(map[string]string, len(data.Metadata)+1)
+	for k, v := range data.Metadata {
+		metadata[k] = v
+	}
+	metadata[yggdrasil.MetadataKeyContentEncoding] = Compression
+	data.Metadata = metadata
+	data.Content = content
+	return data, nil
+}
+
+// DecompressContent returns data with its content decompressed if it sets
+// MetadataKeyContentEncoding, and as is otherwise.
+func DecompressContent(data yggdrasil.Data) (yggdrasil.Data, error) {
+	encoding, prs := data.Metadata[yggdrasil.MetadataKeyContentEncoding]
+	if !prs {
+		return data, nil
+	}
+
+	var compressed []byte
+	if err := json.Unmarshal(data.Content, &compressed); err != nil {
+		return data, fmt.Errorf("cannot unmarshal compressed content: %w", err)
+	}
+	var r io.Reader
+	switch encoding {
+	case ContentEncodingGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return data, fmt.Errorf("cannot decompress content: %w", err)
+		}
+		defer gr.Close()
+		r = gr
+	case ContentEncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return data, fmt.Errorf("cannot decompress content: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return data, fmt.Errorf("unsupported content encoding: %v", encoding)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return data, fmt.Errorf("cannot decompress content: %w", err)
+	}
+	if len(content) > maxDecompressedSize {
+		return data, fmt.Errorf("decompressed content exceeds %v bytes", maxDecompressedSize)
+	}
+	if !json.Valid(content) {
+		return data, fmt.Errorf("decompressed content is not valid JSON")
+	}
+
+	metadata := make(map[string]string, len(data.Metadata))
+	for k, v := range data.Metadata {
+		if k != yggdrasil.MetadataKeyContentEncoding {
+			metadata[k] = v
+		}
+	}
+	data.Metadata = metadata
+	data.Content = content
+	return data, nil
+}
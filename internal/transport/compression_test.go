@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestCompressContent(t *testing.T) {
+	defer func() {
+		Compression = ""
+		CompressionThreshold = 1024
+		SetServerCapabilities(yggdrasil.CapabilitiesContent{})
+	}()
+
+	large := json.RawMessage(`"` + strings.Repeat("a", 2048) + `"`)
+	tests := []struct {
+		description     string
+		compression     string
+		serverEncodings []string
+		content         json.RawMessage
+		want            string
+	}{
+		{
+			description:     "disabled",
+			serverEncodings: []string{ContentEncodingGzip},
+			content:         large,
+			want:            "",
+		},
+		{
+			description: "not accepted by server",
+			compression: ContentEncodingGzip,
+			content:     large,
+			want:        "",
+		},
+		{
+			description:     "below threshold",
+			compression:     ContentEncodingGzip,
+			serverEncodings: []string{ContentEncodingGzip},
+			content:         json.RawMessage(`{"a":1}`),
+			want:            "",
+		},
+		{
+			description:     "gzip",
+			compression:     ContentEncodingGzip,
+			serverEncodings: []string{ContentEncodingGzip},
+			content:         large,
+			want:            ContentEncodingGzip,
+		},
+		{
+			description:     "zstd",
+			compression:     ContentEncodingZstd,
+			serverEncodings: []string{ContentEncodingGzip, ContentEncodingZstd},
+			content:         large,
+			want:            ContentEncodingZstd,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			Compression = test.compression
+			SetServerCapabilities(yggdrasil.CapabilitiesContent{Encodings: test.serverEncodings})
+			data := yggdrasil.Data{
+				MessageID: "1",
+				Metadata:  map[string]string{"a": "b"},
+				Content:   test.content,
+			}
+
+			got, err := CompressContent(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding := got.Metadata[yggdrasil.MetadataKeyContentEncoding]; encoding != test.want {
+				t.Errorf("%v != %v", encoding, test.want)
+			}
+			if test.want != "" && len(got.Content) >= len(test.content) {
+				t.Errorf("compressed content of %v bytes is not smaller than %v", len(got.Content), len(test.content))
+			}
+
+			got, err = DecompressContent(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, data) {
+				t.Errorf("%#v", cmp.Diff(got, data))
+			}
+		})
+	}
+}
+
+func TestDecompressContent(t *testing.T) {
+	tests := []struct {
+		description string
+		metadata    map[string]string
+		content     json.RawMessage
+		wantError   bool
+	}{
+		{
+			description: "unknown encoding",
+			metadata:    map[string]string{yggdrasil.MetadataKeyContentEncoding: "br"},
+			content:     json.RawMessage(`""`),
+			wantError:   true,
+		},
+		{
+			description: "not base64",
+			metadata:    map[string]string{yggdrasil.MetadataKeyContentEncoding: ContentEncodingGzip},
+			content:     json.RawMessage(`{"a":1}`),
+			wantError:   true,
+		},
+		{
+			description: "not gzip",
+			metadata:    map[string]string{yggdrasil.MetadataKeyContentEncoding: ContentEncodingGzip},
+			content:     json.RawMessage(`"aGVsbG8="`),
+			wantError:   true,
+		},
+		{
+			description: "uncompressed",
+			content:     json.RawMessage(`{"a":1}`),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := DecompressContent(yggdrasil.Data{Metadata: test.metadata, Content: test.content})
+			if (err != nil) != test.wantError {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
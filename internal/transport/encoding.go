@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// EncodingCBOR is the name of the CBOR message encoding, as listed in the
+// encodings of server capabilities and connection-status messages.
+const EncodingCBOR = "cbor"
+
+// CBOR enables the CBOR message encoding on transports that support it. The
+// client then announces that it accepts CBOR messages, and encodes the
+// messages it publishes in CBOR once the server lists the encoding in its
+// capabilities. Connection-status messages are always encoded in JSON, so
+// that servers can read them before they know about the client.
+var CBOR bool
+
+// cborDecMode decodes CBOR maps into maps keyed by string, as JSON objects
+// are.
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+// Encodings returns the message and content encodings the client accepts
+// besides JSON. Compressed content is accepted once compression is enabled.
+func Encodings() []string {
+	var encodings []string
+	if CBOR {
+		encodings = append(encodings, EncodingCBOR)
+	}
+	if Compression != "" {
+		encodings = append(encodings, ContentEncodingGzip, ContentEncodingZstd)
+	}
+	return encodings
+}
+
+// EncodeMessage returns msg, encoded in CBOR if CBOR is enabled and the
+// server accepts it, or in JSON otherwise, and the content type of the
+// encoding.
+func EncodeMessage(msg interface{}) ([]byte, string, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+	if _, status := msg.(yggdrasil.ConnectionStatus); status || !CBOR || !ServerCapabilities().SupportsEncoding(EncodingCBOR) {
+		return data, "application/json", nil
+	}
+	data, err = jsonToCBOR(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, "application/cbor", nil
+}
+
+// DecodeMessage returns the JSON encoding of payload, a message received
+// from the server. CBOR messages are only accepted if CBOR is enabled; other
+// payloads are returned as is.
+func DecodeMessage(payload []byte) ([]byte, error) {
+	if !CBOR || !isCBORMap(payload) {
+		return payload, nil
+	}
+	return cborToJSON(payload)
+}
+
+// isCBORMap reports whether data starts with a CBOR map, which a JSON
+// document cannot.
+func isCBORMap(data []byte) bool {
+	return len(data) > 0 && data[0]>>5 == 5
+}
+
+// jsonToCBOR transcodes the JSON document data to CBOR. Integers stay
+// integers, rather than becoming floating point numbers.
+func jsonToCBOR(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal JSON message: %w", err)
+	}
+	data, err := cbor.Marshal(fromJSONNumbers(v))
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal message to CBOR: %w", err)
+	}
+	return data, nil
+}
+
+// fromJSONNumbers replaces the JSON numbers in v by integers, if they are
+// integers, or floating point numbers.
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = fromJSONNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = fromJSONNumbers(value)
+		}
+	}
+	return v
+}
+
+// cborToJSON transcodes the CBOR data item data to JSON. Byte strings become
+// base64 encoded strings.
+func cborToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := cborDecMode.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal CBOR message: %w", err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestCBORRoundTrip(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+	}{
+		{
+			description: "data",
+			input:       `{"type":"data","message_id":"a","directive":"echo","metadata":{"k":"v"},"content":{"count":1,"ratio":0.5,"items":["x",null,true]}}`,
+		},
+		{
+			description: "large integer",
+			input:       `{"n":9007199254740993}`,
+		},
+		{
+			description: "empty",
+			input:       `{}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			encoded, err := jsonToCBOR([]byte(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isCBORMap(encoded) {
+				t.Fatalf("%x is not a CBOR map", encoded)
+			}
+			if len(encoded) >= len(test.input) {
+				t.Errorf("CBOR encoding of %v bytes is not smaller than JSON encoding of %v bytes", len(encoded), len(test.input))
+			}
+			decoded, err := cborToJSON(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(decoded, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.input), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, want) {
+				t.Errorf("%#v", cmp.Diff(got, want))
+			}
+			if test.description == "large integer" && string(decoded) != test.input {
+				t.Errorf("%v != %v", string(decoded), test.input)
+			}
+		})
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	defer func() {
+		CBOR = false
+		SetServerCapabilities(yggdrasil.CapabilitiesContent{})
+	}()
+
+	tests := []struct {
+		description     string
+		cbor            bool
+		serverEncodings []string
+		message         interface{}
+		want            string
+	}{
+		{
+			description:     "disabled",
+			serverEncodings: []string{EncodingCBOR},
+			message:         yggdrasil.Data{Type: yggdrasil.MessageTypeData},
+			want:            "application/json",
+		},
+		{
+			description: "not accepted by server",
+			cbor:        true,
+			message:     yggdrasil.Data{Type: yggdrasil.MessageTypeData},
+			want:        "application/json",
+		},
+		{
+			description:     "negotiated",
+			cbor:            true,
+			serverEncodings: []string{EncodingCBOR},
+			message:         yggdrasil.Data{Type: yggdrasil.MessageTypeData},
+			want:            "application/cbor",
+		},
+		{
+			description:     "connection status",
+			cbor:            true,
+			serverEncodings: []string{EncodingCBOR},
+			message:         yggdrasil.ConnectionStatus{Type: yggdrasil.MessageTypeConnectionStatus},
+			want:            "application/json",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			CBOR = test.cbor
+			SetServerCapabilities(yggdrasil.CapabilitiesContent{Encodings: test.serverEncodings})
+			data, contentType, err := EncodeMessage(test.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != test.want {
+				t.Errorf("%v != %v", contentType, test.want)
+			}
+			decoded, err := DecodeMessage(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !json.Valid(decoded) {
+				t.Errorf("decoded message is not JSON: %q", decoded)
+			}
+		})
+	}
+}
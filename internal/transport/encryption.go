@@ -0,0 +1,111 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"filippo.io/age"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// ContentEncryptionAge is the value of the MetadataKeyContentEncryption
+// metadata key on messages whose content is encrypted with age.
+const ContentEncryptionAge = "age"
+
+// PayloadIdentity is the private key of the client, with which the content of
+// data messages encrypted by the server is decrypted. Its public key is
+// announced in connection-status messages. Encrypted content is rejected if
+// PayloadIdentity is nil.
+var PayloadIdentity *age.X25519Identity
+
+// PayloadRecipients are the keys the content of the data messages the client
+// publishes is encrypted to. Content is published in the clear if there are
+// none.
+var PayloadRecipients []age.Recipient
+
+// PayloadRecipient returns the public key of PayloadIdentity, or an empty
+// string if it is nil.
+func PayloadRecipient() string {
+	if PayloadIdentity == nil {
+		return ""
+	}
+	return PayloadIdentity.Recipient().String()
+}
+
+// EncryptContent returns data with its content encrypted to
+// PayloadRecipients, if any.
+func EncryptContent(data yggdrasil.Data) (yggdrasil.Data, error) {
+	if len(PayloadRecipients) == 0 {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, PayloadRecipients...)
+	if err != nil {
+		return data, fmt.Errorf("cannot encrypt content: %w", err)
+	}
+	if _, err := w.Write(data.Content); err != nil {
+		return data, fmt.Errorf("cannot encrypt content: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return data, fmt.Errorf("cannot encrypt content: %w", err)
+	}
+	content, err := json.Marshal(buf.Bytes())
+	if err != nil {
+		return data, fmt.Errorf("cannot marshal encrypted content: %w", err)
+	}
+
+	metadata := make(map[string]string, len(data.Metadata)+1)
+	for k, v := range data.Metadata {
+		metadata[k] = v
+	}
+	metadata[yggdrasil.MetadataKeyContentEncryption] = ContentEncryptionAge
+	data.Metadata = metadata
+	data.Content = content
+	return data, nil
+}
+
+// DecryptContent returns data with its content decrypted with
+// PayloadIdentity if it sets MetadataKeyContentEncryption, and as is
+// otherwise.
+func DecryptContent(data yggdrasil.Data) (yggdrasil.Data, error) {
+	encryption, prs := data.Metadata[yggdrasil.MetadataKeyContentEncryption]
+	if !prs {
+		return data, nil
+	}
+	if encryption != ContentEncryptionAge {
+		return data, fmt.Errorf("unsupported content encryption: %v", encryption)
+	}
+	if PayloadIdentity == nil {
+		return data, fmt.Errorf("cannot decrypt content: payload encryption is not enabled")
+	}
+
+	var encrypted []byte
+	if err := json.Unmarshal(data.Content, &encrypted); err != nil {
+		return data, fmt.Errorf("cannot unmarshal encrypted content: %w", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(encrypted), PayloadIdentity)
+	if err != nil {
+		return data, fmt.Errorf("cannot decrypt content: %w", err)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return data, fmt.Errorf("cannot decrypt content: %w", err)
+	}
+	if len(content) > maxDecompressedSize {
+		return data, fmt.Errorf("decrypted content exceeds %v bytes", maxDecompressedSize)
+	}
+
+	metadata := make(map[string]string, len(data.Metadata))
+	for k, v := range data.Metadata {
+		if k != yggdrasil.MetadataKeyContentEncryption {
+			metadata[k] = v
+		}
+	}
+	data.Metadata = metadata
+	data.Content = content
+	return data, nil
+}
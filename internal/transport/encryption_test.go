@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"encoding/json"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestEncryptContent(t *testing.T) {
+	defer func() {
+		PayloadIdentity = nil
+		PayloadRecipients = nil
+	}()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		recipients  []age.Recipient
+		identity    *age.X25519Identity
+		want        string
+		wantError   bool
+	}{
+		{
+			description: "disabled",
+			identity:    identity,
+			want:        "",
+		},
+		{
+			description: "encrypted",
+			recipients:  []age.Recipient{identity.Recipient()},
+			identity:    identity,
+			want:        ContentEncryptionAge,
+		},
+		{
+			description: "other recipient",
+			recipients:  []age.Recipient{other.Recipient()},
+			identity:    identity,
+			want:        ContentEncryptionAge,
+			wantError:   true,
+		},
+		{
+			description: "no identity",
+			recipients:  []age.Recipient{identity.Recipient()},
+			want:        ContentEncryptionAge,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			PayloadRecipients = test.recipients
+			PayloadIdentity = test.identity
+			data := yggdrasil.Data{
+				MessageID: "1",
+				Metadata:  map[string]string{"a": "b"},
+				Content:   json.RawMessage(`{"secret":true}`),
+			}
+
+			got, err := EncryptContent(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encryption := got.Metadata[yggdrasil.MetadataKeyContentEncryption]; encryption != test.want {
+				t.Errorf("%v != %v", encryption, test.want)
+			}
+
+			got, err = DecryptContent(got)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, data) {
+				t.Errorf("%#v", cmp.Diff(got, data))
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// EventClass is the class of events in MessageExpiry. Data messages name
+// their class in their MetadataKeyClass metadata key; those without one
+// belong to DefaultClass.
+const (
+	EventClass   = "event"
+	DefaultClass = "default"
+)
+
+// MessageExpiry is the time, per message class, after which a message not yet
+// delivered by the broker or server may be discarded. Messages of classes not
+// listed never expire.
+var MessageExpiry map[string]time.Duration
+
+// ParseMessageExpiry parses message expiry intervals in the form
+// "CLASS=DURATION".
+func ParseMessageExpiry(values []string) (map[string]time.Duration, error) {
+	expiry := make(map[string]time.Duration, len(values))
+	for _, value := range values {
+		fields := strings.SplitN(value, "=", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid message expiry %q: expected CLASS=DURATION", value)
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid message expiry %q: duration must be positive", value)
+		}
+		expiry[fields[0]] = d
+	}
+	return expiry, nil
+}
+
+// Expiry returns the time after which msg, published at now, may be discarded
+// if not yet delivered: the expiry of its class or, for a data message with a
+// deadline, the time left until its deadline, whichever is shorter. A message
+// whose deadline has passed is given a second rather than published without
+// expiry. ok is false if msg never expires.
+func Expiry(msg interface{}, now time.Time) (expiry time.Duration, ok bool) {
+	switch msg := msg.(type) {
+	case yggdrasil.Data:
+		class := msg.Metadata[yggdrasil.MetadataKeyClass]
+		if class == "" {
+			class = DefaultClass
+		}
+		expiry, ok = MessageExpiry[class]
+		if value, prs := msg.Metadata[yggdrasil.MetadataKeyDeadline]; prs {
+			deadline, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				log.Warnf("ignoring invalid deadline %q of message %v: %v", value, msg.MessageID, err)
+				break
+			}
+			left := deadline.Sub(now)
+			if left < time.Second {
+				left = time.Second
+			}
+			if !ok || left < expiry {
+				expiry, ok = left, true
+			}
+		}
+	case yggdrasil.Event:
+		expiry, ok = MessageExpiry[EventClass]
+	}
+	return expiry, ok
+}
@@ -0,0 +1,132 @@
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestExpiry(t *testing.T) {
+	defer func() { MessageExpiry = nil }()
+	MessageExpiry = map[string]time.Duration{
+		"telemetry":  time.Hour,
+		DefaultClass: 24 * time.Hour,
+		EventClass:   10 * time.Minute,
+	}
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		input       interface{}
+		wantExpiry  time.Duration
+		wantOK      bool
+	}{
+		{
+			description: "class",
+			input:       yggdrasil.Data{Metadata: map[string]string{"class": "telemetry"}},
+			wantExpiry:  time.Hour,
+			wantOK:      true,
+		},
+		{
+			description: "default class",
+			input:       yggdrasil.Data{},
+			wantExpiry:  24 * time.Hour,
+			wantOK:      true,
+		},
+		{
+			description: "unlisted class",
+			input:       yggdrasil.Data{Metadata: map[string]string{"class": "results"}},
+		},
+		{
+			description: "deadline before class expiry",
+			input:       yggdrasil.Data{Metadata: map[string]string{"class": "telemetry", "deadline": "2021-06-01T12:01:30Z"}},
+			wantExpiry:  90 * time.Second,
+			wantOK:      true,
+		},
+		{
+			description: "deadline after class expiry",
+			input:       yggdrasil.Data{Metadata: map[string]string{"class": "telemetry", "deadline": "2021-06-02T12:00:00Z"}},
+			wantExpiry:  time.Hour,
+			wantOK:      true,
+		},
+		{
+			description: "deadline passed",
+			input:       yggdrasil.Data{Metadata: map[string]string{"class": "results", "deadline": "2021-06-01T11:00:00Z"}},
+			wantExpiry:  time.Second,
+			wantOK:      true,
+		},
+		{
+			description: "event",
+			input:       yggdrasil.Event{},
+			wantExpiry:  10 * time.Minute,
+			wantOK:      true,
+		},
+		{
+			description: "connection status",
+			input:       yggdrasil.ConnectionStatus{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, ok := Expiry(test.input, now)
+
+			if ok != test.wantOK {
+				t.Errorf("ok = %v, want %v", ok, test.wantOK)
+			}
+			if !cmp.Equal(got, test.wantExpiry) {
+				t.Errorf("%#v", cmp.Diff(got, test.wantExpiry))
+			}
+		})
+	}
+}
+
+func TestParseMessageExpiry(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        map[string]time.Duration
+		wantError   bool
+	}{
+		{
+			description: "empty",
+			want:        map[string]time.Duration{},
+		},
+		{
+			description: "classes",
+			input:       []string{"telemetry=1h", "event=10m"},
+			want:        map[string]time.Duration{"telemetry": time.Hour, "event": 10 * time.Minute},
+		},
+		{
+			description: "missing duration",
+			input:       []string{"telemetry"},
+			wantError:   true,
+		},
+		{
+			description: "not positive",
+			input:       []string{"telemetry=0s"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := ParseMessageExpiry(test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// failoverMaxProbeInterval is the longest time a Failover waits between
+// attempts to start a primary transport that cannot be started.
+const failoverMaxProbeInterval = time.Minute
+
+// A Connector is a Transport that can report whether it is currently
+// connected.
+type Connector interface {
+	Connected() bool
+}
+
+// Failover is a Transport that sends messages over a primary Transport, and
+// switches to a secondary Transport when the primary has been disconnected
+// for longer than a delay. It switches back once the primary reconnects.
+type Failover struct {
+	primary   Transport
+	secondary Transport
+	delay     time.Duration
+
+	// OnSwitch, if set, is called after the active transport changes.
+	OnSwitch func(t Transport)
+
+	lock           sync.RWMutex
+	active         Transport
+	primaryStarted bool
+	downSince      time.Time
+	stop           chan struct{}
+
+	// subscriptions holds the additional topics subscribed to, which are
+	// replayed on the transport switched to. subscriptionsLock is held while
+	// subscribing and while switching transports, so that no subscription is
+	// made on a transport that is being switched away from.
+	subscriptionsLock sync.Mutex
+	subscriptions     map[string]TopicHandler
+
+	// probeAt is the earliest time the primary transport is started again
+	// after probeFailures failed attempts.
+	probeAt       time.Time
+	probeFailures int
+}
+
+// NewFailover creates a Failover transport that falls back to secondary once
+// primary has been unreachable for delay.
+func NewFailover(primary, secondary Transport, delay time.Duration) *Failover {
+	return &Failover{
+		primary:       primary,
+		secondary:     secondary,
+		delay:         delay,
+		subscriptions: make(map[string]TopicHandler),
+	}
+}
+
+// Start starts the primary transport and a goroutine that monitors its
+// connection. If the primary transport cannot be started, the secondary is
+// started immediately.
+func (f *Failover) Start() error {
+	f.lock.Lock()
+	f.stop = make(chan struct{})
+	f.active = f.primary
+	if err := f.primary.Start(); err != nil {
+		log.Warnf("cannot start primary transport: %v", err)
+		if err := f.secondary.Start(); err != nil {
+			f.lock.Unlock()
+			return fmt.Errorf("cannot start secondary transport: %w", err)
+		}
+		f.active = f.secondary
+		f.probeFailures = 1
+		f.probeAt = time.Now().Add(time.Second)
+	} else {
+		f.primaryStarted = true
+	}
+	stop := f.stop
+	f.lock.Unlock()
+
+	go f.monitor(stop)
+
+	return nil
+}
+
+// SendData sends data over the active transport.
+func (f *Failover) SendData(data yggdrasil.Data) error {
+	return f.Active().SendData(data)
+}
+
+// SendControl sends a control message over the active transport.
+func (f *Failover) SendControl(ctrlMsg interface{}) error {
+	return f.Active().SendControl(ctrlMsg)
+}
+
+// Disconnect stops monitoring and disconnects both transports.
+func (f *Failover) Disconnect(quiesce uint) {
+	f.lock.Lock()
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+	active := f.active
+	f.primaryStarted = false
+	f.lock.Unlock()
+
+	f.primary.Disconnect(quiesce)
+	if active == f.secondary {
+		f.secondary.Disconnect(quiesce)
+	}
+}
+
+// Subscribe subscribes to topic on the active transport, if it supports
+// additional topics. The subscription is replayed on the other transport when
+// the active transport changes.
+func (f *Failover) Subscribe(topic string, handler TopicHandler) error {
+	_, primaryOK := f.primary.(Subscriber)
+	_, secondaryOK := f.secondary.(Subscriber)
+	if !primaryOK && !secondaryOK {
+		return fmt.Errorf("cannot subscribe to topic %v: transport does not support additional topics", topic)
+	}
+
+	f.subscriptionsLock.Lock()
+	defer f.subscriptionsLock.Unlock()
+
+	f.subscriptions[topic] = handler
+	if s, ok := f.Active().(Subscriber); ok {
+		return s.Subscribe(topic, handler)
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription to topic from both transports.
+func (f *Failover) Unsubscribe(topic string) error {
+	f.subscriptionsLock.Lock()
+	defer f.subscriptionsLock.Unlock()
+
+	delete(f.subscriptions, topic)
+	for _, t := range []Transport{f.primary, f.secondary} {
+		if s, ok := t.(Subscriber); ok {
+			if err := s.Unsubscribe(topic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetBrokers sets the brokers of both transports, if they support it.
+func (f *Failover) SetBrokers(brokers []string) error {
+	for _, t := range []Transport{f.primary, f.secondary} {
+		if s, ok := t.(BrokerSetter); ok {
+			if err := s.SetBrokers(brokers); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Brokers returns the brokers of the primary transport or, if it has none,
+// of the secondary transport.
+func (f *Failover) Brokers() []string {
+	for _, t := range []Transport{f.primary, f.secondary} {
+		if s, ok := t.(BrokerSetter); ok {
+			return s.Brokers()
+		}
+	}
+	return nil
+}
+
+// Wake asks the active transport to poll the server now, if it polls.
+func (f *Failover) Wake() {
+	if w, ok := f.Active().(Waker); ok {
+		w.Wake()
+	}
+}
+
+// Connected reports whether the active transport is connected.
+func (f *Failover) Connected() bool {
+	return connected(f.Active())
+}
+
+// Active returns the transport currently used to send messages.
+func (f *Failover) Active() Transport {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.active
+}
+
+// monitor periodically checks the primary transport and switches the active
+// transport when necessary, until stop is closed.
+func (f *Failover) monitor(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			f.check(now)
+		}
+	}
+}
+
+// check switches to the secondary transport if the primary has been down for
+// longer than the failover delay, and back to the primary once it is up. A
+// primary transport that cannot be started is retried with an exponential
+// backoff. Transports are started without holding the lock, since connecting
+// may take a while and must not block senders.
+func (f *Failover) check(now time.Time) {
+	f.lock.RLock()
+	started := f.primaryStarted
+	probeAt := f.probeAt
+	f.lock.RUnlock()
+
+	if !started && !now.Before(probeAt) {
+		err := f.primary.Start()
+		f.lock.Lock()
+		if err != nil {
+			f.probeFailures++
+			f.probeAt = now.Add(probeInterval(f.probeFailures))
+			log.Tracef("cannot start primary transport (retrying at %v): %v", f.probeAt, err)
+		} else {
+			started = true
+			f.primaryStarted = true
+			f.probeFailures = 0
+			f.probeAt = time.Time{}
+		}
+		f.lock.Unlock()
+	}
+	up := started && connected(f.primary)
+
+	f.lock.Lock()
+	active := f.active
+	if up {
+		f.downSince = time.Time{}
+	} else if f.downSince.IsZero() {
+		f.downSince = now
+	}
+	downFor := now.Sub(f.downSince)
+	f.lock.Unlock()
+
+	var next Transport
+	switch {
+	case up && active == f.secondary:
+		log.Infof("primary transport reconnected; switching back from secondary transport")
+		f.secondary.Disconnect(0)
+		next = f.primary
+	case !up && active == f.primary && downFor >= f.delay:
+		log.Warnf("primary transport unreachable for %v; switching to secondary transport", downFor)
+		if err := f.secondary.Start(); err != nil {
+			log.Errorf("cannot start secondary transport: %v", err)
+			return
+		}
+		next = f.secondary
+	default:
+		return
+	}
+
+	f.subscriptionsLock.Lock()
+	f.lock.Lock()
+	f.active = next
+	f.lock.Unlock()
+	if s, ok := next.(Subscriber); ok {
+		for topic, handler := range f.subscriptions {
+			if err := s.Subscribe(topic, handler); err != nil {
+				log.Errorf("cannot replay subscription: %v", err)
+			}
+		}
+	}
+	f.subscriptionsLock.Unlock()
+
+	if f.OnSwitch != nil {
+		f.OnSwitch(next)
+	}
+}
+
+// probeInterval returns the time to wait before starting the primary transport
+// again after n failed attempts, doubling from one second up to
+// failoverMaxProbeInterval.
+func probeInterval(n int) time.Duration {
+	interval := time.Second
+	for i := 1; i < n; i++ {
+		interval *= 2
+		if interval >= failoverMaxProbeInterval {
+			return failoverMaxProbeInterval
+		}
+	}
+	return interval
+}
+
+// connected reports whether t is connected. Transports that cannot report
+// their connection state are assumed to be connected.
+func connected(t Transport) bool {
+	c, ok := t.(Connector)
+	if !ok {
+		return true
+	}
+	return c.Connected()
+}
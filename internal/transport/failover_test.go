@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+type fakeTransport struct {
+	connected bool
+	started   bool
+}
+
+func (t *fakeTransport) Start() error                          { t.started = true; return nil }
+func (t *fakeTransport) SendData(data yggdrasil.Data) error    { return nil }
+func (t *fakeTransport) SendControl(ctrlMsg interface{}) error { return nil }
+func (t *fakeTransport) Disconnect(quiesce uint)               { t.started = false }
+func (t *fakeTransport) Connected() bool                       { return t.connected }
+
+func TestFailoverCheck(t *testing.T) {
+	primary := &fakeTransport{connected: true}
+	secondary := &fakeTransport{connected: true}
+	f := NewFailover(primary, secondary, 10*time.Second)
+	f.active = primary
+	f.primaryStarted = true
+
+	now := time.Now()
+
+	primary.connected = false
+	f.check(now)
+	if f.Active() != primary {
+		t.Fatal("switched to secondary before failover delay elapsed")
+	}
+
+	f.check(now.Add(10 * time.Second))
+	if f.Active() != secondary {
+		t.Fatal("did not switch to secondary after failover delay elapsed")
+	}
+	if !secondary.started {
+		t.Fatal("secondary transport was not started")
+	}
+
+	primary.connected = true
+	f.check(now.Add(11 * time.Second))
+	if f.Active() != primary {
+		t.Fatal("did not switch back to primary after it reconnected")
+	}
+	if secondary.started {
+		t.Fatal("secondary transport was not disconnected")
+	}
+}
+
+// subscribingTransport is a fakeTransport that records its subscriptions.
+type subscribingTransport struct {
+	fakeTransport
+	topics map[string]bool
+}
+
+func (t *subscribingTransport) Subscribe(topic string, handler TopicHandler) error {
+	t.topics[topic] = true
+	return nil
+}
+
+func (t *subscribingTransport) Unsubscribe(topic string) error {
+	delete(t.topics, topic)
+	return nil
+}
+
+func TestFailoverSubscriptions(t *testing.T) {
+	primary := &subscribingTransport{fakeTransport: fakeTransport{connected: true}, topics: map[string]bool{}}
+	secondary := &subscribingTransport{fakeTransport: fakeTransport{connected: true}, topics: map[string]bool{}}
+	f := NewFailover(primary, secondary, 0)
+	f.active = primary
+	f.primaryStarted = true
+
+	if err := f.Subscribe("a", func(string, []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if !primary.topics["a"] {
+		t.Fatal("not subscribed on the primary transport")
+	}
+
+	primary.connected = false
+	f.check(time.Now())
+	if f.Active() != secondary {
+		t.Fatal("did not switch to secondary")
+	}
+	if !secondary.topics["a"] {
+		t.Fatal("subscription not replayed on the secondary transport")
+	}
+
+	if err := f.Subscribe("b", func(string, []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	if !secondary.topics["b"] {
+		t.Fatal("not subscribed on the active secondary transport")
+	}
+
+	primary.connected = true
+	f.check(time.Now())
+	if !primary.topics["b"] {
+		t.Fatal("subscription not replayed on the primary transport")
+	}
+
+	if err := f.Unsubscribe("a"); err != nil {
+		t.Fatal(err)
+	}
+	if primary.topics["a"] || secondary.topics["a"] {
+		t.Fatal("subscription not removed from both transports")
+	}
+}
+
+// failingTransport is a fakeTransport that cannot be started.
+type failingTransport struct {
+	fakeTransport
+	starts int
+}
+
+func (t *failingTransport) Start() error {
+	t.starts++
+	return errors.New("unreachable")
+}
+
+func TestFailoverProbeBackoff(t *testing.T) {
+	primary := &failingTransport{}
+	secondary := &fakeTransport{connected: true}
+	f := NewFailover(primary, secondary, 10*time.Second)
+	f.active = secondary
+
+	now := time.Now()
+	tests := []struct {
+		description string
+		at          time.Duration
+		wantStarts  int
+	}{
+		{description: "first probe", at: 0, wantStarts: 1},
+		{description: "before one second", at: 500 * time.Millisecond, wantStarts: 1},
+		{description: "after one second", at: time.Second, wantStarts: 2},
+		{description: "before two seconds more", at: 2 * time.Second, wantStarts: 2},
+		{description: "after two seconds more", at: 3 * time.Second, wantStarts: 3},
+		{description: "before four seconds more", at: 6 * time.Second, wantStarts: 3},
+		{description: "after four seconds more", at: 7 * time.Second, wantStarts: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			f.check(now.Add(test.at))
+			if primary.starts != test.wantStarts {
+				t.Errorf("%v starts, want %v", primary.starts, test.wantStarts)
+			}
+		})
+	}
+}
@@ -1,59 +1,89 @@
 package http
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"sync/atomic"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
 	"github.com/redhatinsights/yggdrasil"
 	"github.com/redhatinsights/yggdrasil/internal/clients/http"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
 	"github.com/redhatinsights/yggdrasil/internal/transport"
 )
 
 type Transport struct {
-	ClientID        string
-	HttpClient      *http.Client
-	Server          string
-	controlHandler  transport.CommandHandler
-	dataHandler     transport.DataHandler
-	pollingInterval time.Duration
-	disconnected    atomic.Value
+	ClientID       string
+	HttpClient     *http.Client
+	Server         string
+	controlHandler transport.CommandHandler
+	dataHandler    transport.DataHandler
+	controlPolling *pollInterval
+	dataPolling    *pollInterval
+	disconnected   atomic.Value
+	status         transport.StatusFunc
 }
 
+// NewHTTPTransport creates a transport polling server for messages. Each
+// channel is polled every minPollingInterval while messages flow; the delay
+// doubles after each empty poll, up to maxPollingInterval.
 func NewHTTPTransport(ClientID string, server string, tlsConfig *tls.Config, userAgent string,
-	pollingInterval time.Duration, controlHandler transport.CommandHandler,
-	dataHandler transport.DataHandler) (*Transport, error) {
+	minPollingInterval time.Duration, maxPollingInterval time.Duration, controlHandler transport.CommandHandler,
+	dataHandler transport.DataHandler, status transport.StatusFunc, d *dialer.Dialer) (*Transport, error) {
 	disconnected := atomic.Value{}
 	disconnected.Store(false)
 	return &Transport{
-		Server:          server,
-		ClientID:        ClientID,
-		HttpClient:      http.NewHTTPClient(tlsConfig, userAgent),
-		controlHandler:  controlHandler,
-		dataHandler:     dataHandler,
-		pollingInterval: pollingInterval,
-		disconnected:    disconnected,
+		Server:         server,
+		ClientID:       ClientID,
+		HttpClient:     http.NewHTTPClient(tlsConfig, userAgent, d),
+		controlHandler: controlHandler,
+		dataHandler:    dataHandler,
+		controlPolling: newPollInterval(minPollingInterval, maxPollingInterval),
+		dataPolling:    newPollInterval(minPollingInterval, maxPollingInterval),
+		disconnected:   disconnected,
+		status:         status,
 	}, nil
 }
 
 func (t *Transport) Start() error {
 	t.disconnected.Store(false)
+
+	// There is no connection to announce, so publish the full inventory as
+	// soon as polling starts; the server otherwise only learns about workers
+	// when the dispatchers map changes.
+	dispatchers, workers := t.status()
+	go transport.PublishConnectionStatus(t, dispatchers, workers)
 	go func() {
+		// The server capability document is handled like a capabilities
+		// control message published by an MQTT server.
+		payload, err := t.HttpClient.Get(context.Background(), t.getCapabilitiesUrl())
+		if err != nil {
+			log.Debugf("cannot get server capabilities: %v", err)
+		} else if len(payload) > 0 {
+			t.controlHandler(payload, t)
+		}
+
 		for {
 			if t.disconnected.Load().(bool) {
 				return
 			}
-			payload, err := t.HttpClient.Get(t.getUrl("in", "control"))
+			payload, retryAfter, err := t.HttpClient.Poll(context.Background(), t.getUrl("in", "control"))
 			if err != nil {
 				log.Tracef("Error while getting work: %v", err)
+				lasterror.Set(lasterror.Transport, err)
 			}
 			if len(payload) > 0 {
+				transport.MirrorReceivedMessage("control", payload)
 				t.controlHandler(payload, t)
 			}
-			time.Sleep(t.pollingInterval)
+			t.controlPolling.wait(t.controlPolling.next(len(payload) > 0, retryAfter))
 		}
 	}()
 
@@ -62,14 +92,16 @@ func (t *Transport) Start() error {
 			if t.disconnected.Load().(bool) {
 				return
 			}
-			payload, err := t.HttpClient.Get(t.getUrl("in", "data"))
+			payload, retryAfter, err := t.HttpClient.Poll(context.Background(), t.getUrl("in", "data"))
 			if err != nil {
 				log.Tracef("Error while getting work: %v", err)
+				lasterror.Set(lasterror.Transport, err)
 			}
 			if len(payload) > 0 {
+				transport.MirrorReceivedMessage("data", payload)
 				t.dataHandler(payload)
 			}
-			time.Sleep(t.pollingInterval)
+			t.dataPolling.wait(t.dataPolling.next(len(payload) > 0, retryAfter))
 		}
 	}()
 
@@ -87,6 +119,20 @@ func (t *Transport) SendControl(ctrlMsg interface{}) error {
 func (t *Transport) Disconnect(quiesce uint) {
 	time.Sleep(time.Millisecond * time.Duration(quiesce))
 	t.disconnected.Store(true)
+	t.controlPolling.reset()
+	t.dataPolling.reset()
+}
+
+// Wake polls the server now and backs off from the minimum polling interval
+// again.
+func (t *Transport) Wake() {
+	t.controlPolling.reset()
+	t.dataPolling.reset()
+}
+
+// Connected reports whether the transport is polling the server.
+func (t *Transport) Connected() bool {
+	return !t.disconnected.Load().(bool)
 }
 
 func (t *Transport) send(message interface{}, channel string) error {
@@ -102,7 +148,42 @@ func (t *Transport) send(message interface{}, channel string) error {
 		"Content-Type": "application/json",
 	}
 	log.Tracef("Sending %s", string(dataBytes))
-	return t.HttpClient.Post(url, headers, dataBytes)
+	if transport.ServerCapabilities().SupportsEncoding("gzip") {
+		dataBytes, err = compress(dataBytes)
+		if err != nil {
+			return err
+		}
+		headers["Content-Encoding"] = "gzip"
+	}
+	if expiry, ok := transport.Expiry(message, time.Now()); ok {
+		// Like the MQTT 5 message expiry interval, in whole seconds.
+		headers["X-Message-Expiry"] = strconv.FormatInt(int64((expiry+time.Second-1)/time.Second), 10)
+	}
+	if err := t.HttpClient.Post(url, headers, dataBytes); err != nil {
+		return err
+	}
+	transport.MirrorSentMessage(channel, message)
+	// A reply to a message sent is likely to follow.
+	t.controlPolling.reset()
+	t.dataPolling.reset()
+	return nil
+}
+
+// compress returns data compressed with gzip.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("cannot compress message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot compress message: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *Transport) getCapabilitiesUrl() string {
+	return fmt.Sprintf("http://%s/api/flotta-management/v1/capabilities", t.Server)
 }
 
 func (t *Transport) getUrl(direction string, channel string) string {
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"sync"
+	"time"
+)
+
+// A pollInterval is the adaptive delay between two polls of a channel. It
+// doubles after each poll that returned nothing, up to max, and drops back to
+// min as soon as a poll returns a message or the client sends one, since a
+// reply is then likely to follow.
+type pollInterval struct {
+	min, max time.Duration
+
+	lock    sync.Mutex
+	current time.Duration
+	wake    chan struct{}
+}
+
+func newPollInterval(min, max time.Duration) *pollInterval {
+	if max < min {
+		max = min
+	}
+	return &pollInterval{
+		min:     min,
+		max:     max,
+		current: min,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// next returns the delay before the next poll, given whether the last poll
+// returned a message. A hint that is not negative, the Retry-After delay
+// requested by the server, overrides the computed delay within the bounds of
+// the interval.
+func (p *pollInterval) next(active bool, hint time.Duration) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch {
+	case hint >= 0:
+		p.current = hint
+	case active:
+		p.current = p.min
+	default:
+		p.current *= 2
+	}
+	if p.current < p.min {
+		p.current = p.min
+	}
+	if p.current > p.max {
+		p.current = p.max
+	}
+	return p.current
+}
+
+// reset drops the interval back to its minimum and cuts short a pending wait.
+func (p *pollInterval) reset() {
+	p.lock.Lock()
+	p.current = p.min
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait sleeps for d, or until the interval is reset.
+func (p *pollInterval) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-p.wake:
+	}
+}
@@ -0,0 +1,71 @@
+package http
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPollIntervalNext(t *testing.T) {
+	type poll struct {
+		active bool
+		hint   time.Duration
+	}
+	tests := []struct {
+		description string
+		polls       []poll
+		want        []time.Duration
+	}{
+		{
+			description: "idle",
+			polls:       []poll{{false, -1}, {false, -1}, {false, -1}, {false, -1}, {false, -1}},
+			want:        []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second},
+		},
+		{
+			description: "activity",
+			polls:       []poll{{false, -1}, {false, -1}, {true, -1}, {false, -1}},
+			want:        []time.Duration{2 * time.Second, 4 * time.Second, time.Second, 2 * time.Second},
+		},
+		{
+			description: "hint",
+			polls:       []poll{{false, 5 * time.Second}, {false, -1}, {false, 0}, {true, time.Hour}},
+			want:        []time.Duration{5 * time.Second, 10 * time.Second, time.Second, 10 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			p := newPollInterval(time.Second, 10*time.Second)
+			var got []time.Duration
+			for _, poll := range test.polls {
+				got = append(got, p.next(poll.active, poll.hint))
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestPollIntervalReset(t *testing.T) {
+	p := newPollInterval(time.Second, time.Hour)
+	p.next(false, -1)
+	p.next(false, -1)
+
+	done := make(chan struct{})
+	go func() {
+		p.wait(time.Hour)
+		close(done)
+	}()
+	p.reset()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait was not cut short by reset")
+	}
+	if got := p.next(false, -1); got != 2*time.Second {
+		t.Errorf("%v != %v", got, 2*time.Second)
+	}
+}
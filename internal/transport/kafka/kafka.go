@@ -0,0 +1,269 @@
+// Package kafka implements a data sink publishing the data messages sent by
+// workers to Kafka topics, for deployments whose results are consumed by
+// analytics pipelines, while control messages keep flowing over the control
+// plane transport.
+//
+// Messages are produced with github.com/segmentio/kafka-go, over connections
+// established by the dialer of the sink, with TLS and SASL PLAIN
+// authentication.
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// DirectivePlaceholder is replaced by the directive of a message in the topic
+// the message is published to.
+const DirectivePlaceholder = "{directive}"
+
+// requestTimeout bounds the time a broker takes to answer a request.
+const requestTimeout = 30 * time.Second
+
+// maxReconnectDelay is the longest delay between attempts to reconnect.
+const maxReconnectDelay = 2 * time.Minute
+
+// A Sink is a transport.Transport that publishes data messages to Kafka. Each
+// message is encoded as JSON and keyed by its directive, so that the messages
+// of a directive land in the same partition, in order.
+type Sink struct {
+	ClientID string
+
+	// Topic is the topic messages are published to. DirectivePlaceholder is
+	// replaced by the directive of each message.
+	Topic string
+
+	// Username and Password, if set, authenticate the sink to the brokers
+	// with SASL PLAIN.
+	Username string
+	Password string
+
+	brokers   []string
+	tlsConfig *tls.Config
+	dialer    *dialer.Dialer
+
+	lock         sync.Mutex
+	connected    bool
+	stopped      bool
+	reconnecting bool
+	transport    *kafkago.Transport
+	writer       *kafkago.Writer
+}
+
+// NewSink creates a Sink bootstrapping from brokers, in the form
+// "HOST:PORT". Connections use TLS if tlsConfig is not nil.
+func NewSink(clientID string, brokers []string, topic string, tlsConfig *tls.Config, d *dialer.Dialer) (*Sink, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("missing brokers")
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("missing topic")
+	}
+	return &Sink{
+		ClientID:  clientID,
+		Topic:     topic,
+		brokers:   brokers,
+		tlsConfig: tlsConfig,
+		dialer:    d,
+	}, nil
+}
+
+// Start creates the producer and connects to one of the bootstrap brokers. If
+// none is reachable, it returns an error, and keeps trying to connect in the
+// background until Disconnect is called.
+func (s *Sink) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopped = false
+	if s.writer == nil {
+		s.transport = &kafkago.Transport{
+			Dial:        s.dial,
+			DialTimeout: requestTimeout,
+			ClientID:    s.ClientID,
+		}
+		if s.Username != "" {
+			s.transport.SASL = plain.Mechanism{Username: s.Username, Password: s.Password}
+		}
+		s.writer = &kafkago.Writer{
+			Addr:         kafkago.TCP(s.brokers...),
+			Balancer:     &kafkago.Hash{},
+			MaxAttempts:  2,
+			BatchSize:    1,
+			WriteTimeout: requestTimeout,
+			RequiredAcks: kafkago.RequireAll,
+			Transport:    s.transport,
+		}
+	}
+	if err := s.bootstrap(); err != nil {
+		s.startReconnecting()
+		return err
+	}
+	s.connected = true
+	log.Infof("connected to Kafka brokers %v", s.brokers)
+	return nil
+}
+
+// SendData publishes data to its topic.
+func (s *Sink) SendData(data yggdrasil.Data) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message: %w", err)
+	}
+	topic := strings.Replace(s.Topic, DirectivePlaceholder, data.Directive, -1)
+	msg := kafkago.Message{
+		Topic: topic,
+		Key:   []byte(data.Directive),
+		Value: value,
+		Headers: []kafkago.Header{
+			{Key: "client_id", Value: []byte(s.ClientID)},
+			{Key: "message_id", Value: []byte(data.MessageID)},
+			{Key: "directive", Value: []byte(data.Directive)},
+		},
+	}
+
+	s.lock.Lock()
+	w := s.writer
+	s.lock.Unlock()
+	if w == nil {
+		return fmt.Errorf("cannot publish to Kafka topic %v: sink not started", topic)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*requestTimeout)
+	defer cancel()
+	if err := w.WriteMessages(ctx, msg); err != nil {
+		if werrs, ok := err.(kafkago.WriteErrors); ok && len(werrs) == 1 {
+			err = werrs[0]
+		}
+		if isNetError(err) {
+			s.lock.Lock()
+			if s.connected && !s.stopped {
+				log.Warnf("disconnected from Kafka brokers: %v", err)
+				s.connected = false
+				s.startReconnecting()
+			}
+			s.lock.Unlock()
+		}
+		return fmt.Errorf("cannot publish to Kafka topic %v: %w", topic, err)
+	}
+	transport.MirrorSentMessage("data", data)
+	log.Debugf("published message %v to Kafka topic %v", data.MessageID, topic)
+	return nil
+}
+
+// SendControl fails: control messages are published by the control plane
+// transport.
+func (s *Sink) SendControl(ctrlMsg interface{}) error {
+	return fmt.Errorf("cannot publish control messages to Kafka")
+}
+
+// Disconnect closes the producer and its connections to the brokers.
+func (s *Sink) Disconnect(quiesce uint) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			log.Debugf("cannot close Kafka producer: %v", err)
+		}
+		s.transport.CloseIdleConnections()
+		s.writer = nil
+		s.transport = nil
+	}
+	s.connected = false
+	s.stopped = true
+}
+
+// Connected reports whether the sink is started.
+func (s *Sink) Connected() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connected
+}
+
+// bootstrap asks the bootstrap brokers for the API versions they support,
+// which connects and authenticates to the first reachable one. The caller
+// must hold the lock.
+func (s *Sink) bootstrap() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	client := kafkago.Client{Addr: s.writer.Addr, Transport: s.transport}
+	resp, err := client.ApiVersions(ctx, &kafkago.ApiVersionsRequest{})
+	if err == nil {
+		err = resp.Error
+	}
+	if err != nil {
+		return fmt.Errorf("cannot connect to Kafka brokers: %w", err)
+	}
+	return nil
+}
+
+// dial connects to the broker at addr with the dialer of the sink, over TLS
+// if the sink has a TLS configuration.
+func (s *Sink) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.tlsConfig != nil {
+		return s.dialer.DialTLSContext(ctx, network, addr, s.tlsConfig)
+	}
+	return s.dialer.DialContext(ctx, network, addr)
+}
+
+// startReconnecting starts a goroutine that reconnects to the bootstrap
+// brokers, unless one is already running. The caller must hold the lock.
+func (s *Sink) startReconnecting() {
+	if s.reconnecting {
+		return
+	}
+	s.reconnecting = true
+	go s.reconnect()
+}
+
+// reconnect tries to connect to the bootstrap brokers, doubling the delay
+// between attempts, until it succeeds or the sink is disconnected.
+func (s *Sink) reconnect() {
+	delay := time.Second
+	for {
+		time.Sleep(delay)
+
+		s.lock.Lock()
+		if s.stopped || s.connected {
+			s.reconnecting = false
+			s.lock.Unlock()
+			return
+		}
+		err := s.bootstrap()
+		if err == nil {
+			s.connected = true
+			s.reconnecting = false
+			s.lock.Unlock()
+			log.Infof("reconnected to Kafka brokers %v", s.brokers)
+			return
+		}
+		s.lock.Unlock()
+
+		log.Debugf("cannot reconnect to Kafka brokers: %v", err)
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// isNetError reports whether err is not an error returned by a broker, but
+// an error of the connection to it.
+func isNetError(err error) bool {
+	var kerr kafkago.Error
+	return !errors.As(err, &kerr)
+}
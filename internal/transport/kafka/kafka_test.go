@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// producedRecord is a record received by fakeBroker.
+type producedRecord struct {
+	Topic   string
+	Key     string
+	Value   string
+	Headers map[string]string
+}
+
+// fakeBroker answers the requests of the connections accepted on l,
+// describing topics, each as a single partition led by itself, and sends the
+// records of Produce requests on records.
+func fakeBroker(t *testing.T, l net.Listener, topics []string, records chan<- producedRecord) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go serveFakeBroker(t, l, c, topics, records)
+	}
+}
+
+func serveFakeBroker(t *testing.T, l net.Listener, c net.Conn, topics []string, records chan<- producedRecord) {
+	defer c.Close()
+
+	host, portString, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	for {
+		apiVersion, correlationID, _, msg, err := protocol.ReadRequest(c)
+		if err != nil {
+			return
+		}
+
+		var resp protocol.Message
+		switch req := msg.(type) {
+		case *apiversions.Request:
+			resp = &apiversions.Response{
+				ApiKeys: []apiversions.ApiKeyResponse{
+					{ApiKey: int16(protocol.ApiVersions), MinVersion: 0, MaxVersion: 0},
+					{ApiKey: int16(protocol.Metadata), MinVersion: 1, MaxVersion: 1},
+					{ApiKey: int16(protocol.Produce), MinVersion: 3, MaxVersion: 3},
+				},
+			}
+		case *metadata.Request:
+			// The described topics are not filtered by the requested ones:
+			// the producer requests all topics to discover the cluster.
+			m := &metadata.Response{
+				Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: host, Port: int32(port)}},
+			}
+			for _, topic := range topics {
+				m.Topics = append(m.Topics, metadata.ResponseTopic{
+					Name:       topic,
+					Partitions: []metadata.ResponsePartition{{PartitionIndex: 0, LeaderID: 1}},
+				})
+			}
+			resp = m
+		case *produce.Request:
+			p := &produce.Response{}
+			for _, topic := range req.Topics {
+				for _, partition := range topic.Partitions {
+					for {
+						r, err := partition.RecordSet.Records.ReadRecord()
+						if err != nil {
+							break
+						}
+						records <- readRecord(t, topic.Topic, r)
+					}
+				}
+				p.Topics = append(p.Topics, produce.ResponseTopic{
+					Topic:      topic.Topic,
+					Partitions: []produce.ResponsePartition{{Partition: 0}},
+				})
+			}
+			resp = p
+		default:
+			t.Errorf("unexpected request %T", msg)
+			return
+		}
+		if err := protocol.WriteResponse(c, apiVersion, correlationID, resp); err != nil {
+			return
+		}
+	}
+}
+
+func readRecord(t *testing.T, topic string, r *protocol.Record) producedRecord {
+	key, err := protocol.ReadAll(r.Key)
+	if err != nil {
+		t.Error(err)
+	}
+	value, err := protocol.ReadAll(r.Value)
+	if err != nil {
+		t.Error(err)
+	}
+	headers := make(map[string]string)
+	for _, h := range r.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	return producedRecord{Topic: topic, Key: string(key), Value: string(value), Headers: headers}
+}
+
+func TestSinkSendData(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	records := make(chan producedRecord, 1)
+	go fakeBroker(t, l, []string{"results.echo"}, records)
+
+	s, err := NewSink("client", []string{l.Addr().String()}, "results."+DirectivePlaceholder, nil, dialer.New(dialer.Timeouts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect(0)
+
+	data := yggdrasil.Data{MessageID: "1", Directive: "echo", Content: json.RawMessage(`"hello"`)}
+	if err := s.SendData(data); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := producedRecord{
+		Topic: "results.echo",
+		Key:   "echo",
+		Value: string(value),
+		Headers: map[string]string{
+			"client_id":  "client",
+			"message_id": "1",
+			"directive":  "echo",
+		},
+	}
+	select {
+	case got := <-records:
+		if !cmp.Equal(got, want) {
+			t.Errorf("%#v", cmp.Diff(got, want))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record produced")
+	}
+}
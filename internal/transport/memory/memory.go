@@ -0,0 +1,162 @@
+// Package memory implements a Transport that exchanges messages with the
+// process it runs in rather than with a server, so that yggd and its workers
+// can be tested end to end without a broker. Messages from the "server" are
+// injected with Inject, and published messages are handed to a function.
+package memory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// Channels of published and injected messages.
+const (
+	ChannelControl = "control"
+	ChannelData    = "data"
+)
+
+// Transport is an in-memory Transport.
+type Transport struct {
+	// Published, if set, is called with the channel and the JSON encoding of
+	// each message published.
+	Published func(channel string, msg []byte)
+
+	controlHandler transport.CommandHandler
+	dataHandler    transport.DataHandler
+	status         transport.StatusFunc
+
+	lock      sync.Mutex
+	connected bool
+}
+
+// NewTransport creates a Transport handing injected messages to
+// controlHandler and dataHandler, and publishing the status returned by
+// status in a connection-status message each time it is started.
+func NewTransport(controlHandler transport.CommandHandler, dataHandler transport.DataHandler, status transport.StatusFunc) *Transport {
+	return &Transport{
+		controlHandler: controlHandler,
+		dataHandler:    dataHandler,
+		status:         status,
+	}
+}
+
+// Start connects the transport, which never fails.
+func (t *Transport) Start() error {
+	t.lock.Lock()
+	t.connected = true
+	t.lock.Unlock()
+	log.Info("connected in-memory transport")
+
+	if t.status != nil {
+		dispatchers, workers := t.status()
+		go transport.PublishConnectionStatus(t, dispatchers, workers)
+	}
+	return nil
+}
+
+// SendData publishes data on the data channel.
+func (t *Transport) SendData(data yggdrasil.Data) error {
+	return t.publish(ChannelData, data)
+}
+
+// SendControl publishes ctrlMsg on the control channel.
+func (t *Transport) SendControl(ctrlMsg interface{}) error {
+	return t.publish(ChannelControl, ctrlMsg)
+}
+
+// Disconnect disconnects the transport. Messages can neither be published
+// nor injected until it is started again.
+func (t *Transport) Disconnect(quiesce uint) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.connected = false
+}
+
+// Connected reports whether the transport is connected.
+func (t *Transport) Connected() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.connected
+}
+
+func (t *Transport) publish(channel string, msg interface{}) error {
+	if !t.Connected() {
+		return fmt.Errorf("not connected")
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+	transport.MirrorSentMessage(channel, msg)
+	log.Debugf("published message on %v channel: %s", channel, data)
+	if t.Published != nil {
+		t.Published(channel, data)
+	}
+	return nil
+}
+
+// Inject hands msg, the JSON encoding of a message, to the handler of its
+// channel as if it had been received from the server: data messages to the
+// data handler, and other messages to the control handler.
+func (t *Transport) Inject(msg []byte) error {
+	var header struct {
+		Type yggdrasil.MessageType `json:"type"`
+	}
+	if err := json.Unmarshal(msg, &header); err != nil {
+		return fmt.Errorf("cannot unmarshal message: %w", err)
+	}
+	if header.Type == "" {
+		return fmt.Errorf("message has no type")
+	}
+	if header.Type == yggdrasil.MessageTypeData {
+		return t.Deliver(ChannelData, msg)
+	}
+	return t.Deliver(ChannelControl, msg)
+}
+
+// Deliver hands msg to the handler of channel as it is, as if it had been
+// received from the server on that channel, whether or not it is a valid
+// message.
+func (t *Transport) Deliver(channel string, msg []byte) error {
+	if !t.Connected() {
+		return fmt.Errorf("not connected")
+	}
+	switch channel {
+	case ChannelData:
+		transport.MirrorReceivedMessage(ChannelData, msg)
+		t.dataHandler(msg)
+	case ChannelControl:
+		transport.MirrorReceivedMessage(ChannelControl, msg)
+		t.controlHandler(msg, t)
+	default:
+		return fmt.Errorf("unknown channel %v", channel)
+	}
+	return nil
+}
+
+// InjectFrom injects the messages read from r, a sequence of JSON documents
+// such as one message per line, in order. It returns the number of messages
+// injected, stopping at the first that cannot be read or injected.
+func (t *Transport) InjectFrom(r io.Reader) (int, error) {
+	decoder := json.NewDecoder(r)
+	n := 0
+	for {
+		var msg json.RawMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("cannot read message %v: %w", n+1, err)
+		}
+		if err := t.Inject(bytes.TrimSpace(msg)); err != nil {
+			return n, fmt.Errorf("cannot inject message %v: %w", n+1, err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,127 @@
+package memory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestInjectFrom(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		wantControl []string
+		wantData    []string
+		wantN       int
+		wantError   bool
+	}{
+		{
+			description: "lines",
+			input: `{"type":"command","message_id":"1"}
+{"type":"data","message_id":"2"}
+`,
+			wantControl: []string{`{"type":"command","message_id":"1"}`},
+			wantData:    []string{`{"type":"data","message_id":"2"}`},
+			wantN:       2,
+		},
+		{
+			description: "indented",
+			input: `{
+  "type": "data",
+  "message_id": "1"
+}
+{
+  "type": "worker-config",
+  "message_id": "2"
+}`,
+			wantControl: []string{"{\n  \"type\": \"worker-config\",\n  \"message_id\": \"2\"\n}"},
+			wantData:    []string{"{\n  \"type\": \"data\",\n  \"message_id\": \"1\"\n}"},
+			wantN:       2,
+		},
+		{
+			description: "missing type",
+			input:       `{"type":"data"} {"message_id":"2"} {"type":"data"}`,
+			wantData:    []string{`{"type":"data"}`},
+			wantN:       1,
+			wantError:   true,
+		},
+		{
+			description: "invalid",
+			input:       `{"type":"data"} {`,
+			wantData:    []string{`{"type":"data"}`},
+			wantN:       1,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var control, data []string
+			tr := NewTransport(func(msg []byte, _ transport.Transport) {
+				control = append(control, string(msg))
+			}, func(msg []byte) {
+				data = append(data, string(msg))
+			}, nil)
+			if err := tr.Start(); err != nil {
+				t.Fatal(err)
+			}
+			n, err := tr.InjectFrom(strings.NewReader(test.input))
+			if (err != nil) != test.wantError {
+				t.Errorf("error = %v, want error %v", err, test.wantError)
+			}
+			if n != test.wantN {
+				t.Errorf("n = %v, want %v", n, test.wantN)
+			}
+			if !cmp.Equal(control, test.wantControl) {
+				t.Errorf("%#v", cmp.Diff(control, test.wantControl))
+			}
+			if !cmp.Equal(data, test.wantData) {
+				t.Errorf("%#v", cmp.Diff(data, test.wantData))
+			}
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	type published struct {
+		Channel string
+		Msg     string
+	}
+	var got []published
+	tr := NewTransport(nil, nil, nil)
+	tr.Published = func(channel string, msg []byte) {
+		got = append(got, published{channel, string(msg)})
+	}
+
+	if err := tr.SendData(yggdrasil.Data{MessageID: "1"}); err == nil {
+		t.Error("published while disconnected")
+	}
+	if err := tr.Inject([]byte(`{"type":"data"}`)); err == nil {
+		t.Error("injected while disconnected")
+	}
+
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SendData(yggdrasil.Data{Type: yggdrasil.MessageTypeData, MessageID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SendControl(map[string]string{"type": "event"}); err != nil {
+		t.Fatal(err)
+	}
+	tr.Disconnect(0)
+	if tr.Connected() {
+		t.Error("connected after disconnecting")
+	}
+
+	if len(got) != 2 || got[0].Channel != ChannelData || got[1].Channel != ChannelControl {
+		t.Fatalf("published %+v", got)
+	}
+	want := published{ChannelControl, `{"type":"event"}`}
+	if !cmp.Equal(got[1], want) {
+		t.Errorf("%#v", cmp.Diff(got[1], want))
+	}
+}
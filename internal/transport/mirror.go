@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"encoding/json"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// Directions of mirrored messages.
+const (
+	MirrorSent     = "sent"
+	MirrorReceived = "received"
+)
+
+// Mirror, if set, is called with the JSON encoding of every message the
+// transports publish, once published, and of every message they receive on
+// the control and data channels, so that the messages exchanged with the
+// server can be observed. direction is MirrorSent or MirrorReceived, and
+// channel is "control" or "data". It is called by the goroutines of the
+// transports, and must not block.
+var Mirror func(direction, channel string, msg []byte)
+
+// MirrorSentMessage passes msg, published on channel, to Mirror, if set.
+func MirrorSentMessage(channel string, msg interface{}) {
+	if Mirror == nil {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Debugf("cannot mirror message: %v", err)
+		return
+	}
+	Mirror(MirrorSent, channel, data)
+}
+
+// MirrorReceivedMessage passes msg, the JSON encoding of a message received on
+// channel, to Mirror, if set.
+func MirrorReceivedMessage(channel string, msg []byte) {
+	if Mirror == nil {
+		return
+	}
+	Mirror(MirrorReceived, channel, msg)
+}
@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// openConnection returns a function opening the connections of the MQTT
+// client with d, so that each phase of the connection is limited and measured
+// on its own. The client dials websockets itself, under the sum of the
+// timeouts of d. The TLS configuration of the client is overridden by that of
+// the URI of the broker, if any.
+func openConnection(d *dialer.Dialer) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		tlsConfig, uri, err := transport.BrokerTLSConfig(uri, options.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings of broker: %w", err)
+		}
+		var conn net.Conn
+		switch uri.Scheme {
+		case "ws":
+			return mqtt.NewWebsocket(uri.String(), nil, d.Timeouts.Total(), options.HTTPHeaders, options.WebsocketOptions)
+		case "wss":
+			return mqtt.NewWebsocket(uri.String(), tlsConfig, d.Timeouts.Total(), options.HTTPHeaders, options.WebsocketOptions)
+		case "tcp", "mqtt":
+			conn, err = d.DialContext(context.Background(), "tcp", uri.Host)
+		case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+			conn, err = d.DialTLSContext(context.Background(), "tcp", uri.Host, tlsConfig)
+		default:
+			return nil, fmt.Errorf("unsupported broker scheme: %v", uri.Scheme)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &handshakeConn{Conn: conn, timeout: d.Timeouts.Handshake}, nil
+	}
+}
+
+// handshakeConn is a connection to a broker over which the MQTT client
+// performs the CONNECT exchange under a deadline it sets, then clears once the
+// broker accepted the connection. The client counts its deadline from before
+// the connection was opened; handshakeConn replaces it with timeout, counted
+// from the start of the exchange, and records the exchange as the handshake
+// phase of the dialer metrics.
+type handshakeConn struct {
+	net.Conn
+	timeout time.Duration
+
+	lock  sync.Mutex
+	start time.Time
+	done  bool
+}
+
+func (c *handshakeConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch {
+	case c.done:
+	case c.start.IsZero():
+		c.start = time.Now()
+		t = time.Time{}
+		if c.timeout > 0 {
+			t = c.start.Add(c.timeout)
+		}
+	case t.IsZero():
+		c.done = true
+		dialer.Record(dialer.PhaseHandshake, time.Since(c.start), nil)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *handshakeConn) Close() error {
+	c.lock.Lock()
+	if !c.done && !c.start.IsZero() {
+		// The client closes the connection when the exchange failed.
+		c.done = true
+		elapsed := time.Since(c.start)
+		err := fmt.Errorf("connection refused by broker")
+		if c.timeout > 0 && elapsed >= c.timeout {
+			err = context.DeadlineExceeded
+		}
+		dialer.Record(dialer.PhaseHandshake, elapsed, err)
+	}
+	c.lock.Unlock()
+
+	return c.Conn.Close()
+}
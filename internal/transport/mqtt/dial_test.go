@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+)
+
+// handshakeMetric returns the value of the handshake phase counter name.
+func handshakeMetric(name string) int64 {
+	if v, ok := dialer.Metrics.Get(dialer.PhaseHandshake + "." + name).(interface{ Value() int64 }); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestHandshakeConn(t *testing.T) {
+	tests := []struct {
+		description  string
+		timeout      time.Duration
+		accept       bool
+		wantFailures int64
+		wantTimeouts int64
+	}{
+		{
+			description: "accepted",
+			timeout:     time.Second,
+			accept:      true,
+		},
+		{
+			description:  "timed out",
+			timeout:      10 * time.Millisecond,
+			wantFailures: 1,
+			wantTimeouts: 1,
+		},
+		{
+			description:  "refused",
+			timeout:      time.Minute,
+			wantFailures: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			conn := &handshakeConn{Conn: client, timeout: test.timeout}
+
+			attempts := handshakeMetric("attempts")
+			failures := handshakeMetric("failures")
+			timeouts := handshakeMetric("timeouts")
+
+			// The deadline set by the client, counted from before the
+			// connection was opened, is replaced by the handshake timeout.
+			if err := conn.SetDeadline(time.Now().Add(-time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			go server.Write([]byte{0})
+			if _, err := conn.Read(make([]byte, 1)); err != nil {
+				t.Fatalf("read before the handshake timeout: %v", err)
+			}
+
+			if test.accept {
+				if err := conn.SetDeadline(time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			} else if test.wantTimeouts > 0 {
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					t.Fatal("read past the handshake timeout")
+				}
+			}
+			conn.Close()
+
+			if got := handshakeMetric("attempts") - attempts; got != 1 {
+				t.Errorf("attempts %v, want 1", got)
+			}
+			if got := handshakeMetric("failures") - failures; got != test.wantFailures {
+				t.Errorf("failures %v, want %v", got, test.wantFailures)
+			}
+			if got := handshakeMetric("timeouts") - timeouts; got != test.wantTimeouts {
+				t.Errorf("timeouts %v, want %v", got, test.wantTimeouts)
+			}
+		})
+	}
+}
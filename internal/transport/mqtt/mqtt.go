@@ -4,93 +4,264 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
 	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/tracing"
 	"github.com/redhatinsights/yggdrasil/internal/transport"
 )
 
 type Transport struct {
-	ClientID   string
-	MqttClient mqtt.Client
+	ClientID string
+
+	// ResolveBrokers, if set, is called to obtain the list of brokers before
+	// each connection attempt, replacing the brokers the transport was
+	// created with.
+	ResolveBrokers func() ([]string, error)
+
+	// Username and Password, if set, authenticate the client to the brokers.
+	Username string
+	Password string
+
+	tlsConfig      *tls.Config
+	dialer         *dialer.Dialer
+	controlHandler transport.CommandHandler
+	dataHandler    transport.DataHandler
+	status         transport.StatusFunc
+
+	subscriptionsLock sync.RWMutex
+	subscriptions     map[string]transport.TopicHandler
+
+	// instance identifies the transport in the presences it publishes.
+	instance string
+
+	// takeovers detects another client taking over the session.
+	takeovers takeoverDetector
+
+	// clientLock guards client, which SetBrokers replaces.
+	clientLock sync.RWMutex
+	client     mqtt.Client
 }
 
-func NewMQTTTransport(ClientID string, brokers []string, tlsConfig *tls.Config, controlHandler transport.CommandHandler, dataHandler transport.DataHandler) (*Transport, error) {
+// oldClientQuiesce is the time, in milliseconds, the client replaced by
+// SetBrokers is given to complete its work before it is disconnected.
+const oldClientQuiesce = 250
+
+// offlineStatus returns an "offline" connection-status message, used as the
+// will of the client.
+func offlineStatus() ([]byte, error) {
+	data, err := json.Marshal(&yggdrasil.ConnectionStatus{
+		Type:      yggdrasil.MessageTypeConnectionStatus,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+		Content: yggdrasil.ConnectionStatusContent{
+			State: yggdrasil.ConnectionStateOffline,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+	return data, nil
+}
+
+// NewMQTTTransport creates a Transport connecting to brokers with d.
+func NewMQTTTransport(ClientID string, brokers []string, tlsConfig *tls.Config, controlHandler transport.CommandHandler, dataHandler transport.DataHandler, status transport.StatusFunc, d *dialer.Dialer) (*Transport, error) {
 	t := Transport{
-		ClientID: ClientID,
+		ClientID:       ClientID,
+		tlsConfig:      tlsConfig,
+		dialer:         d,
+		controlHandler: controlHandler,
+		dataHandler:    dataHandler,
+		status:         status,
+		subscriptions:  make(map[string]transport.TopicHandler),
+		instance:       uuid.New().String(),
+	}
+
+	client, err := t.newClient(brokers)
+	if err != nil {
+		return nil, err
 	}
-	// Create and configure MQTT client
+	t.client = client
+
+	return &t, nil
+}
+
+// SetBrokers replaces the MQTT client with one configured to connect to
+// brokers, picking up the current topic prefix. The transport should be
+// disconnected before, and must be started again after, calling SetBrokers;
+// a client still connected is disconnected before it is replaced, so that it
+// does not keep reconnecting alongside the new one.
+func (t *Transport) SetBrokers(brokers []string) error {
+	client, err := t.newClient(brokers)
+	if err != nil {
+		return err
+	}
+
+	t.clientLock.Lock()
+	defer t.clientLock.Unlock()
+	if t.client != nil && t.client.IsConnected() {
+		log.Debugf("disconnecting client replaced by new brokers")
+		t.client.Disconnect(oldClientQuiesce)
+	}
+	t.client = client
+	return nil
+}
+
+// mqttClient returns the current MQTT client.
+func (t *Transport) mqttClient() mqtt.Client {
+	t.clientLock.RLock()
+	defer t.clientLock.RUnlock()
+	return t.client
+}
+
+// Brokers returns the brokers the MQTT client connects to.
+func (t *Transport) Brokers() []string {
+	opts := t.mqttClient().OptionsReader()
+	servers := opts.Servers()
+	brokers := make([]string, 0, len(servers))
+	for _, u := range servers {
+		brokers = append(brokers, u.String())
+	}
+	return brokers
+}
+
+// newClient creates and configures an MQTT client that connects to brokers.
+func (t *Transport) newClient(brokers []string) (mqtt.Client, error) {
 	mqttClientOpts := mqtt.NewClientOptions()
 	for _, broker := range brokers {
 		mqttClientOpts.AddBroker(broker)
 	}
-	mqttClientOpts.SetClientID(ClientID)
-	mqttClientOpts.SetTLSConfig(tlsConfig)
+	mqttClientOpts.SetClientID(t.ClientID)
+	mqttClientOpts.SetTLSConfig(t.tlsConfig)
+	mqttClientOpts.SetCustomOpenConnectionFn(openConnection(t.dialer))
 	mqttClientOpts.SetCleanSession(true)
+	mqttClientOpts.SetCredentialsProvider(func() (string, string) {
+		return t.Username, t.Password
+	})
 	mqttClientOpts.SetOnConnectHandler(func(client mqtt.Client) {
 		opts := client.OptionsReader()
 		for _, url := range opts.Servers() {
 			log.Tracef("connected to broker: %v", url)
 		}
+		t.takeovers.connect(time.Now())
+		tracing.Instant(tracing.Transport, "connected", nil)
 
 		// Publish a throwaway message in case the topic does not exist;
 		// this is a workaround for the Akamai MQTT broker implementation.
 		go func() {
-			topic := fmt.Sprintf("%v/%v/data/out", yggdrasil.TopicPrefix, ClientID)
+			topic := fmt.Sprintf("%v/%v/data/out", yggdrasil.TopicPrefix, t.ClientID)
 			client.Publish(topic, 0, false, []byte{})
 		}()
 
+		// Messages are handed to the handlers synchronously, in the order
+		// they arrive; the handlers only queue them, so a full queue holds
+		// up the client rather than piling up goroutines.
 		var topic string
 		topic = fmt.Sprintf("%v/%v/data/in", yggdrasil.TopicPrefix, t.ClientID)
-		client.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
-			go t.handleDataMessage(m, dataHandler)
-		})
-		log.Tracef("subscribed to topic: %v", topic)
+		if err := subscribe(client, topic, func(c mqtt.Client, m mqtt.Message) {
+			t.handleDataMessage(m, t.dataHandler)
+		}); err != nil {
+			log.Error(err)
+		}
 
 		topic = fmt.Sprintf("%v/%v/control/in", yggdrasil.TopicPrefix, t.ClientID)
-		client.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
-			go t.handleControlMessage(m, controlHandler)
-		})
-		log.Tracef("subscribed to topic: %v", topic)
+		if err := subscribe(client, topic, func(c mqtt.Client, m mqtt.Message) {
+			t.handleControlMessage(m, t.controlHandler)
+		}); err != nil {
+			log.Error(err)
+		}
+
+		// Watch the presences published with our client ID, including the
+		// retained one, to detect another client using it, then announce our
+		// own.
+		topic = presenceTopic(t.ClientID)
+		if err := subscribe(client, topic, func(c mqtt.Client, m mqtt.Message) {
+			go checkPresence(t, t.ClientID, t.instance, m.Payload(), m.Retained())
+		}); err != nil {
+			log.Warnf("cannot detect client ID conflicts: %v", err)
+		}
+		if data, err := newPresence(t.instance); err != nil {
+			log.Error(err)
+		} else if token := client.Publish(topic, 1, true, data); token.Wait() && token.Error() != nil {
+			log.Errorf("cannot publish presence: %v", token.Error())
+		}
+
+		// Restore any additional subscriptions; the session is not persisted
+		// across connections.
+		t.subscriptionsLock.RLock()
+		for topic, handler := range t.subscriptions {
+			t.subscribe(client, topic, handler)
+		}
+		t.subscriptionsLock.RUnlock()
 
-		go transport.PublishConnectionStatus(&t, map[string]map[string]string{})
+		dispatchers, workers := t.status()
+		go transport.PublishConnectionStatus(t, dispatchers, workers)
+		go reportTakeovers(t, &t.takeovers)
 	})
 	mqttClientOpts.SetDefaultPublishHandler(func(c mqtt.Client, m mqtt.Message) {
 		log.Errorf("unhandled message: %v", string(m.Payload()))
 	})
+	mqttClientOpts.SetReconnectingHandler(func(c mqtt.Client, opts *mqtt.ClientOptions) {
+		// The handler is called before each attempt to reconnect, so
+		// waiting in it throttles reconnecting.
+		if delay := t.takeovers.reconnectDelay(); delay > 0 {
+			time.Sleep(delay)
+		}
+		if t.ResolveBrokers == nil {
+			return
+		}
+		brokers, err := t.ResolveBrokers()
+		if err != nil {
+			log.Errorf("cannot resolve brokers; reconnecting to previous brokers: %v", err)
+			return
+		}
+		resolved := mqtt.NewClientOptions()
+		for _, broker := range brokers {
+			resolved.AddBroker(broker)
+		}
+		opts.Servers = resolved.Servers
+		log.Debugf("resolved brokers: %v", brokers)
+	})
 	mqttClientOpts.SetConnectionLostHandler(func(c mqtt.Client, e error) {
 		log.Errorf("connection lost unexpectedly: %v", e)
+		lasterror.Set(lasterror.Transport, fmt.Errorf("connection lost: %w", e))
+		sessionLost(&t.takeovers, t.ClientID, false)
+		tracing.Instant(tracing.Transport, "connection lost", map[string]string{"error": e.Error()})
 	})
-	data, err := json.Marshal(&yggdrasil.ConnectionStatus{
-		Type:      yggdrasil.MessageTypeConnectionStatus,
-		MessageID: uuid.New().String(),
-		Version:   1,
-		Sent:      time.Now(),
-		Content: struct {
-			CanonicalFacts yggdrasil.CanonicalFacts     "json:\"canonical_facts\""
-			Dispatchers    map[string]map[string]string "json:\"dispatchers\""
-			State          yggdrasil.ConnectionState    "json:\"state\""
-			Tags           map[string]string            "json:\"tags,omitempty\""
-		}{
-			State: yggdrasil.ConnectionStateOffline,
-		},
-	})
+	data, err := offlineStatus()
 	if err != nil {
-		return nil, fmt.Errorf("cannot marshal message to JSON: %w", err)
+		return nil, err
 	}
-	mqttClientOpts.SetBinaryWill(fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, ClientID), data, 1, false)
-
-	t.MqttClient = mqtt.NewClient(mqttClientOpts)
+	mqttClientOpts.SetBinaryWill(fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, t.ClientID), data, 1, transport.RetainConnectionStatus)
 
-	return &t, nil
+	return mqtt.NewClient(mqttClientOpts), nil
 }
 
+// Start connects to the brokers, resolving them first if ResolveBrokers is
+// set.
 func (t *Transport) Start() error {
-	if token := t.MqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("cannot connect to broker: %w", token.Error())
+	if t.ResolveBrokers != nil {
+		brokers, err := t.ResolveBrokers()
+		if err != nil {
+			lasterror.Set(lasterror.Transport, err)
+			return fmt.Errorf("cannot resolve brokers: %w", err)
+		}
+		log.Debugf("resolved brokers: %v", brokers)
+		if err := t.SetBrokers(brokers); err != nil {
+			return err
+		}
+	}
+	if token := t.mqttClient().Connect(); token.Wait() && token.Error() != nil {
+		err := fmt.Errorf("cannot connect to broker: %w", token.Error())
+		lasterror.Set(lasterror.Transport, err)
+		return err
 	}
 	return nil
 }
@@ -98,46 +269,150 @@ func (t *Transport) Start() error {
 func (t *Transport) SendData(data yggdrasil.Data) error {
 	topic := fmt.Sprintf("%v/%v/data/out", yggdrasil.TopicPrefix, t.ClientID)
 
-	d, err := json.Marshal(data)
+	d, _, err := transport.EncodeMessage(data)
 	if err != nil {
-		log.Errorf("cannot marshal message to JSON: %v", err)
+		log.Errorf("cannot encode message: %v", err)
 		return err
 	}
 
-	if token := t.MqttClient.Publish(topic, 1, false, d); token.Wait() && token.Error() != nil {
+	if token := t.mqttClient().Publish(topic, 1, false, d); token.Wait() && token.Error() != nil {
 		log.Errorf("failed to publish message: %v", token.Error())
 		return token.Error()
 	}
+	transport.MirrorSentMessage("data", data)
 	log.Debugf("published message %v to topic %v", data.MessageID, topic)
 	log.Tracef("message: %+v", data)
 	return nil
 }
 
+// SendControl publishes ctrlMsg on the control topic. Connection-status
+// messages are retained if RetainConnectionStatus is true.
 func (t *Transport) SendControl(ctrlMsg interface{}) error {
 	topic := fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, t.ClientID)
 
-	data, err := json.Marshal(ctrlMsg)
+	data, _, err := transport.EncodeMessage(ctrlMsg)
 	if err != nil {
-		log.Errorf("cannot marshal message to JSON: %v", err)
+		log.Errorf("cannot encode message: %v", err)
 		return err
 	}
 
-	if token := t.MqttClient.Publish(topic, 1, false, data); token.Wait() && token.Error() != nil {
+	_, retained := ctrlMsg.(yggdrasil.ConnectionStatus)
+	retained = retained && transport.RetainConnectionStatus
+
+	if token := t.mqttClient().Publish(topic, 1, retained, data); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
+	transport.MirrorSentMessage("control", ctrlMsg)
+	return nil
+}
+
+// Subscribe subscribes to topic, calling handler for each message received on
+// it. The subscription is restored each time the client reconnects.
+func (t *Transport) Subscribe(topic string, handler transport.TopicHandler) error {
+	t.subscriptionsLock.Lock()
+	t.subscriptions[topic] = handler
+	t.subscriptionsLock.Unlock()
+
+	client := t.mqttClient()
+	if !client.IsConnected() {
+		return nil
+	}
+	return t.subscribe(client, topic, handler)
+}
+
+// Unsubscribe removes the subscription to topic.
+func (t *Transport) Unsubscribe(topic string) error {
+	t.subscriptionsLock.Lock()
+	delete(t.subscriptions, topic)
+	t.subscriptionsLock.Unlock()
+
+	client := t.mqttClient()
+	if !client.IsConnected() {
+		return nil
+	}
+	if token := client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("cannot unsubscribe from topic %v: %w", topic, token.Error())
+	}
+	log.Tracef("unsubscribed from topic: %v", topic)
+	return nil
+}
+
+func (t *Transport) subscribe(client mqtt.Client, topic string, handler transport.TopicHandler) error {
+	return subscribe(client, topic, func(c mqtt.Client, m mqtt.Message) {
+		log.Debugf("received a message %v on topic %v", m.MessageID(), m.Topic())
+		handler(m.Topic(), m.Payload())
+	})
+}
+
+// subscribe subscribes client to topic, calling handler for each message
+// received on it. It fails if the broker refuses the subscription, as brokers
+// do for topics the client is not authorized to read.
+func subscribe(client mqtt.Client, topic string, handler mqtt.MessageHandler) error {
+	token := client.Subscribe(topic, 1, handler)
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("cannot subscribe to topic %v: %w", topic, token.Error())
+	}
+	if st, ok := token.(*mqtt.SubscribeToken); ok && st.Result()[topic] == 0x80 {
+		return fmt.Errorf("cannot subscribe to topic %v: refused by broker", topic)
+	}
+	log.Tracef("subscribed to topic: %v", topic)
 	return nil
 }
 
 func (t *Transport) handleDataMessage(msg mqtt.Message, handler transport.DataHandler) {
 	log.Debugf("received a message %v on topic %v", msg.MessageID(), msg.Topic())
-	handler(msg.Payload())
+	payload, err := transport.DecodeMessage(msg.Payload())
+	if err != nil {
+		log.Errorf("cannot decode message %v: %v", msg.MessageID(), err)
+		return
+	}
+	transport.MirrorReceivedMessage("data", payload)
+	handler(payload)
 }
 
 func (t *Transport) handleControlMessage(msg mqtt.Message, handler transport.CommandHandler) {
 	log.Debugf("received a message %v on topic %v", msg.MessageID(), msg.Topic())
-	handler(msg.Payload(), t)
+	payload, err := transport.DecodeMessage(msg.Payload())
+	if err != nil {
+		log.Errorf("cannot decode message %v: %v", msg.MessageID(), err)
+		return
+	}
+	transport.MirrorReceivedMessage("control", payload)
+	handler(payload, t)
 }
 
+// Connected reports whether the client has an open connection to a broker.
+func (t *Transport) Connected() bool {
+	return t.mqttClient().IsConnectionOpen()
+}
+
+// Disconnect publishes an "offline" connection-status message and clears the
+// retained one, since the broker does not publish the will of a client that
+// disconnects cleanly, clears the retained presence, then disconnects from
+// the broker.
 func (t *Transport) Disconnect(quiesce uint) {
-	t.MqttClient.Disconnect(quiesce)
+	client := t.mqttClient()
+	if client.IsConnectionOpen() {
+		if err := t.SendControl(yggdrasil.ConnectionStatus{
+			Type:      yggdrasil.MessageTypeConnectionStatus,
+			MessageID: uuid.New().String(),
+			Version:   1,
+			Sent:      time.Now(),
+			Content: yggdrasil.ConnectionStatusContent{
+				State: yggdrasil.ConnectionStateOffline,
+			},
+		}); err != nil {
+			log.Errorf("cannot publish connection-status: %v", err)
+		}
+		if transport.RetainConnectionStatus {
+			topic := fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, t.ClientID)
+			if token := client.Publish(topic, 1, true, []byte{}); token.Wait() && token.Error() != nil {
+				log.Errorf("cannot clear retained connection-status: %v", token.Error())
+			}
+		}
+		if token := client.Publish(presenceTopic(t.ClientID), 1, true, []byte{}); token.Wait() && token.Error() != nil {
+			log.Errorf("cannot clear presence: %v", token.Error())
+		}
+	}
+	client.Disconnect(quiesce)
 }
@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestTransportSetBrokers(t *testing.T) {
+	tr, err := NewMQTTTransport("test", []string{"tcp://localhost:1883"}, nil,
+		func([]byte, transport.Transport) {}, func([]byte) {},
+		func() (map[string]map[string]string, map[string]yggdrasil.WorkerInfo) { return nil, nil },
+		dialer.New(dialer.DefaultTimeouts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is replaced while other goroutines use the transport.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				tr.Connected()
+				tr.Brokers()
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := tr.SetBrokers([]string{"tcp://localhost:1884"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if got := tr.Brokers(); len(got) != 1 || got[0] != "tcp://localhost:1884" {
+		t.Errorf("brokers %v, want tcp://localhost:1884", got)
+	}
+}
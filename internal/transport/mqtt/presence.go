@@ -0,0 +1,82 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// A presence announces the instance of a transport connected with a client
+// ID. Each transport publishes its presence, retained, on the presence topic
+// of its client ID every time it connects, and clears it when it disconnects
+// cleanly. Since brokers let a client take over the session of another client
+// connecting with the same ID, two clients sharing an ID keep reconnecting,
+// and each sees the presence of the other as it does.
+type presence struct {
+	Instance string    `json:"instance"`
+	Sent     time.Time `json:"sent"`
+}
+
+// presenceTopic returns the topic presences are published on for clientID.
+func presenceTopic(clientID string) string {
+	return fmt.Sprintf("%v/%v/presence", yggdrasil.TopicPrefix, clientID)
+}
+
+// newPresence returns the presence of instance.
+func newPresence(instance string) ([]byte, error) {
+	data, err := json.Marshal(presence{Instance: instance, Sent: time.Now()})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal presence to JSON: %w", err)
+	}
+	return data, nil
+}
+
+// checkPresence inspects a message received on the presence topic of
+// clientID. The presence of an instance other than instance means another
+// client is connected with the same client ID; the two would keep taking the
+// session from each other, so the conflict is reported on t rather than left
+// to show only as repeated connection losses.
+func checkPresence(t transport.Transport, clientID, instance string, payload []byte, retained bool) {
+	if len(payload) == 0 {
+		return
+	}
+	var p presence
+	if err := json.Unmarshal(payload, &p); err != nil {
+		log.Debugf("ignoring invalid presence: %v", err)
+		return
+	}
+	if p.Instance == instance {
+		return
+	}
+
+	err := fmt.Errorf("instance %v connected at %v using client ID %v", p.Instance, p.Sent, clientID)
+	if retained {
+		// The retained presence may be left over from a previous run that
+		// did not disconnect cleanly.
+		log.Warnf("possible client ID conflict: %v", err)
+		return
+	}
+	log.Errorf("client ID conflict: %v", err)
+	lasterror.Set(lasterror.Transport, fmt.Errorf("client ID conflict: %w", err))
+
+	event := yggdrasil.Event{
+		Type:      yggdrasil.MessageTypeEvent,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+		Content:   string(yggdrasil.EventNameClientIDConflict),
+		Details: map[string]string{
+			"instance": p.Instance,
+			"sent":     p.Sent.Format(time.RFC3339),
+		},
+	}
+	if err := t.SendControl(event); err != nil {
+		log.Errorf("cannot publish event %v: %v", event.MessageID, err)
+	}
+}
@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// controlRecorder is a Transport recording the control messages sent on it.
+type controlRecorder struct {
+	sent []interface{}
+}
+
+func (t *controlRecorder) Start() error                       { return nil }
+func (t *controlRecorder) SendData(data yggdrasil.Data) error { return nil }
+func (t *controlRecorder) SendControl(ctrlMsg interface{}) error {
+	t.sent = append(t.sent, ctrlMsg)
+	return nil
+}
+func (t *controlRecorder) Disconnect(quiesce uint) {}
+
+func TestCheckPresence(t *testing.T) {
+	own, err := newPresence("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newPresence("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		payload     []byte
+		retained    bool
+		wantEvent   bool
+	}{
+		{
+			description: "own presence",
+			payload:     own,
+		},
+		{
+			description: "cleared presence",
+			payload:     []byte{},
+			retained:    true,
+		},
+		{
+			description: "invalid presence",
+			payload:     []byte("{"),
+		},
+		{
+			description: "retained presence of another instance",
+			payload:     other,
+			retained:    true,
+		},
+		{
+			description: "presence of another instance",
+			payload:     other,
+			wantEvent:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr := &controlRecorder{}
+			checkPresence(tr, "test", "a", test.payload, test.retained)
+
+			if !test.wantEvent {
+				if len(tr.sent) != 0 {
+					t.Errorf("sent %v, want nothing", tr.sent)
+				}
+				return
+			}
+			if len(tr.sent) != 1 {
+				t.Fatalf("sent %v, want a single event", tr.sent)
+			}
+			event, ok := tr.sent[0].(yggdrasil.Event)
+			if !ok || event.Content != string(yggdrasil.EventNameClientIDConflict) || event.Details["instance"] != "b" {
+				t.Errorf("sent %+v, want a client-id-conflict event for instance b", tr.sent[0])
+			}
+		})
+	}
+}
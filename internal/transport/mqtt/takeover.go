@@ -0,0 +1,150 @@
+package mqtt
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+const (
+	// takeoverSession is the duration under which a lost session counts as
+	// taken over.
+	takeoverSession = time.Minute
+
+	// takeoverWindow is the period over which short sessions are counted.
+	takeoverWindow = 10 * time.Minute
+
+	// takeoverThreshold is the number of short sessions within
+	// takeoverWindow that indicate another client keeps taking over the
+	// session.
+	takeoverThreshold = 3
+
+	// minTakeoverDelay and maxTakeoverDelay bound the delay added before
+	// reconnecting once takeovers are detected; it doubles with each further
+	// takeover.
+	minTakeoverDelay = 30 * time.Second
+	maxTakeoverDelay = 10 * time.Minute
+)
+
+// A takeoverDetector watches the sessions of a transport for the rapid
+// connect and disconnect cycle of two clients sharing a client ID, each
+// taking over the session of the other as it reconnects. Once detected,
+// reconnecting is throttled, so that the clients do not flood the broker,
+// until a session lasts.
+type takeoverDetector struct {
+	lock      sync.Mutex
+	connected time.Time
+	short     []time.Time
+	delay     time.Duration
+	alert     bool
+}
+
+// connect records that a session started at now.
+func (d *takeoverDetector) connect(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.connected = now
+}
+
+// lost records that the session was lost at now, taken over if the broker
+// said so. It returns the number of recent short sessions and whether
+// takeovers are detected.
+func (d *takeoverDetector) lost(now time.Time, takenOver bool) (int, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.connected.IsZero() {
+		return 0, false
+	}
+	duration := now.Sub(d.connected)
+	d.connected = time.Time{}
+	if !takenOver && duration >= takeoverSession {
+		d.short = nil
+		d.delay = 0
+		return 0, false
+	}
+
+	short := d.short[:0]
+	for _, t := range d.short {
+		if now.Sub(t) < takeoverWindow {
+			short = append(short, t)
+		}
+	}
+	d.short = append(short, now)
+	// Once reconnecting is throttled, short sessions may be further apart
+	// than takeoverWindow; each of them still means the takeovers go on.
+	if len(d.short) < takeoverThreshold && d.delay == 0 {
+		return len(d.short), false
+	}
+
+	d.delay *= 2
+	if d.delay < minTakeoverDelay {
+		d.delay = minTakeoverDelay
+	}
+	if d.delay > maxTakeoverDelay {
+		d.delay = maxTakeoverDelay
+	}
+	d.alert = true
+	return len(d.short), true
+}
+
+// reconnectDelay returns the delay to wait before reconnecting.
+func (d *takeoverDetector) reconnectDelay() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.delay
+}
+
+// pendingAlert returns the number of short sessions and the reconnect delay
+// of takeovers detected since the last call, if any.
+func (d *takeoverDetector) pendingAlert() (int, time.Duration, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.alert {
+		return 0, 0, false
+	}
+	d.alert = false
+	return len(d.short), d.delay, true
+}
+
+// sessionLost records the loss of the session of clientID on d, logging and
+// reporting as the last transport error any takeovers detected.
+func sessionLost(d *takeoverDetector, clientID string, takenOver bool) {
+	n, detected := d.lost(time.Now(), takenOver)
+	if !detected {
+		return
+	}
+	err := fmt.Errorf("session of client ID %v lost %v times within %v of connecting; another client may be using it", clientID, n, takeoverSession)
+	log.Errorf("%v; waiting %v before reconnecting", err, d.reconnectDelay())
+	lasterror.Set(lasterror.Transport, err)
+}
+
+// reportTakeovers sends a session-takeovers event on t if takeovers were
+// detected by d since the last report.
+func reportTakeovers(t transport.Transport, d *takeoverDetector) {
+	takeovers, delay, ok := d.pendingAlert()
+	if !ok {
+		return
+	}
+	event := yggdrasil.Event{
+		Type:      yggdrasil.MessageTypeEvent,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+		Content:   string(yggdrasil.EventNameSessionTakeovers),
+		Details: map[string]string{
+			"takeovers":       strconv.Itoa(takeovers),
+			"reconnect_delay": delay.String(),
+		},
+	}
+	if err := t.SendControl(event); err != nil {
+		log.Errorf("cannot publish event %v: %v", event.MessageID, err)
+	}
+}
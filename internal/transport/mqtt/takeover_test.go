@@ -0,0 +1,95 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestTakeoverDetector(t *testing.T) {
+	// A session lasts for duration before it is lost, taken over if the
+	// broker said so.
+	type session struct {
+		duration  time.Duration
+		takenOver bool
+	}
+	tests := []struct {
+		description string
+		sessions    []session
+		wantDelays  []time.Duration
+	}{
+		{
+			description: "stable sessions",
+			sessions:    []session{{time.Hour, false}, {time.Hour, false}, {time.Hour, false}},
+			wantDelays:  []time.Duration{0, 0, 0},
+		},
+		{
+			description: "short sessions",
+			sessions:    []session{{time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Second, false}},
+			wantDelays:  []time.Duration{0, 0, minTakeoverDelay, 2 * minTakeoverDelay},
+		},
+		{
+			description: "stable session resets",
+			sessions:    []session{{time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Hour, false}, {time.Second, false}},
+			wantDelays:  []time.Duration{0, 0, minTakeoverDelay, 0, 0},
+		},
+		{
+			description: "taken over",
+			sessions:    []session{{2 * time.Minute, true}, {2 * time.Minute, true}, {2 * time.Minute, true}},
+			wantDelays:  []time.Duration{0, 0, minTakeoverDelay},
+		},
+		{
+			description: "capped",
+			sessions:    []session{{time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Second, false}, {time.Second, false}},
+			wantDelays:  []time.Duration{0, 0, 30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, maxTakeoverDelay},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var d takeoverDetector
+			now := time.Now()
+			var got []time.Duration
+			for _, s := range test.sessions {
+				d.connect(now)
+				now = now.Add(s.duration)
+				d.lost(now, s.takenOver)
+				got = append(got, d.reconnectDelay())
+				now = now.Add(d.reconnectDelay())
+			}
+			if !cmp.Equal(got, test.wantDelays) {
+				t.Errorf("%#v", cmp.Diff(got, test.wantDelays))
+			}
+		})
+	}
+}
+
+func TestReportTakeovers(t *testing.T) {
+	var d takeoverDetector
+	now := time.Now()
+	for i := 0; i < takeoverThreshold; i++ {
+		d.connect(now)
+		d.lost(now, true)
+	}
+
+	var recorder controlRecorder
+	reportTakeovers(&recorder, &d)
+	reportTakeovers(&recorder, &d)
+
+	if len(recorder.sent) != 1 {
+		t.Fatalf("expected 1 event, got %v", len(recorder.sent))
+	}
+	event, ok := recorder.sent[0].(yggdrasil.Event)
+	if !ok {
+		t.Fatalf("expected event, got %#v", recorder.sent[0])
+	}
+	want := map[string]string{
+		"takeovers":       "3",
+		"reconnect_delay": minTakeoverDelay.String(),
+	}
+	if event.Content != string(yggdrasil.EventNameSessionTakeovers) || !cmp.Equal(event.Details, want) {
+		t.Errorf("unexpected event %#v", event)
+	}
+}
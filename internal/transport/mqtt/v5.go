@@ -0,0 +1,722 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/tracing"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+const (
+	// v5KeepAlive is the keep alive interval, in seconds, requested from
+	// the broker; the same as the default of the MQTT 3.1.1 client.
+	v5KeepAlive = 30
+
+	// v5TopicAliasMaximum is the number of topic aliases the broker may use
+	// for the topics the transport subscribes to.
+	v5TopicAliasMaximum = 16
+
+	// v5MaxReconnectInterval is the longest time between two attempts to
+	// reconnect to the brokers.
+	v5MaxReconnectInterval = 10 * time.Minute
+)
+
+// V5Transport is a Transport speaking MQTT 5. It publishes on the same topics
+// as Transport, and in addition:
+//
+// - replaces the topics it publishes on by topic aliases, up to the number
+// the broker allows, so that each message does not carry its full topic;
+// - sets the metadata of data messages as user properties, so that brokers
+// and bridges can route on them without parsing the payload;
+// - sets the expiry interval of data messages that carry a deadline, so that
+// the broker discards them once the deadline passes.
+type V5Transport struct {
+	ClientID string
+
+	// ResolveBrokers, if set, is called to obtain the list of brokers before
+	// each connection attempt, replacing the brokers the transport was
+	// created with.
+	ResolveBrokers func() ([]string, error)
+
+	// Username and Password, if set, authenticate the client to the brokers.
+	Username string
+	Password string
+
+	tlsConfig      *tls.Config
+	dialer         *dialer.Dialer
+	controlHandler transport.CommandHandler
+	dataHandler    transport.DataHandler
+	status         transport.StatusFunc
+
+	// lock guards the fields below it. client is nil while the transport is
+	// not connected, and done is closed by Disconnect to stop reconnecting.
+	lock    sync.RWMutex
+	brokers []string
+	client  *paho.Client
+	router  *paho.StandardRouter
+	aliases *topicAliases
+	done    chan struct{}
+
+	subscriptionsLock sync.RWMutex
+	subscriptions     map[string]transport.TopicHandler
+
+	// instance identifies the transport in the presences it publishes.
+	instance string
+
+	// takeovers detects another client taking over the session.
+	takeovers takeoverDetector
+}
+
+// NewMQTTv5Transport creates a V5Transport connecting to brokers with d.
+func NewMQTTv5Transport(ClientID string, brokers []string, tlsConfig *tls.Config, controlHandler transport.CommandHandler, dataHandler transport.DataHandler, status transport.StatusFunc, d *dialer.Dialer) (*V5Transport, error) {
+	t := V5Transport{
+		ClientID:       ClientID,
+		tlsConfig:      tlsConfig,
+		dialer:         d,
+		controlHandler: controlHandler,
+		dataHandler:    dataHandler,
+		status:         status,
+		subscriptions:  make(map[string]transport.TopicHandler),
+		instance:       uuid.New().String(),
+	}
+	if err := t.SetBrokers(brokers); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SetBrokers sets the brokers the transport connects to. The transport must
+// be disconnected before, and started again after, calling SetBrokers.
+func (t *V5Transport) SetBrokers(brokers []string) error {
+	for _, broker := range brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return fmt.Errorf("cannot parse broker %v: %w", broker, err)
+		}
+		if _, err := v5Secure(u.Scheme); err != nil {
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.brokers = append([]string(nil), brokers...)
+	return nil
+}
+
+// Brokers returns the brokers the transport connects to.
+func (t *V5Transport) Brokers() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return append([]string(nil), t.brokers...)
+}
+
+// v5Secure reports whether scheme, the scheme of a broker URI, requires TLS.
+// Unlike the MQTT 3.1.1 client, the MQTT 5 client does not support
+// websockets.
+func v5Secure(scheme string) (bool, error) {
+	switch scheme {
+	case "tcp", "mqtt":
+		return false, nil
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported broker scheme for MQTT 5: %v", scheme)
+	}
+}
+
+// Start connects to the brokers, resolving them first if ResolveBrokers is
+// set. Once connected, the transport reconnects whenever the connection is
+// lost, until Disconnect is called.
+func (t *V5Transport) Start() error {
+	if t.ResolveBrokers != nil {
+		brokers, err := t.ResolveBrokers()
+		if err != nil {
+			lasterror.Set(lasterror.Transport, err)
+			return fmt.Errorf("cannot resolve brokers: %w", err)
+		}
+		log.Debugf("resolved brokers: %v", brokers)
+		if err := t.SetBrokers(brokers); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	t.lock.Lock()
+	t.done = done
+	t.lock.Unlock()
+
+	if err := t.connect(done); err != nil {
+		lasterror.Set(lasterror.Transport, err)
+		return err
+	}
+	return nil
+}
+
+// connect connects to each broker in turn until a connection is established.
+func (t *V5Transport) connect(done chan struct{}) error {
+	var err error
+	for _, broker := range t.Brokers() {
+		if err = t.connectBroker(broker, done); err == nil {
+			return nil
+		}
+		log.Debugf("cannot connect to broker %v: %v", broker, err)
+	}
+	if err == nil {
+		return fmt.Errorf("cannot connect to broker: no brokers")
+	}
+	return fmt.Errorf("cannot connect to broker: %w", err)
+}
+
+// connectBroker connects to broker, subscribes to the topics of the
+// transport and publishes its connection status.
+func (t *V5Transport) connectBroker(broker string, done chan struct{}) error {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+	secure, err := v5Secure(u.Scheme)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, u, err := transport.BrokerTLSConfig(u, t.tlsConfig)
+	if err != nil {
+		return fmt.Errorf("invalid TLS settings of broker: %w", err)
+	}
+
+	var conn net.Conn
+	if secure {
+		conn, err = t.dialer.DialTLSContext(context.Background(), "tcp", u.Host, tlsConfig)
+	} else {
+		conn, err = t.dialer.DialContext(context.Background(), "tcp", u.Host)
+	}
+	if err != nil {
+		return err
+	}
+
+	will, err := offlineStatus()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	router := paho.NewStandardRouter()
+	var client *paho.Client
+	client = paho.NewClient(paho.ClientConfig{
+		ClientID: t.ClientID,
+		Conn:     packets.NewThreadSafeConn(conn),
+		Router:   router,
+		OnClientError: func(err error) {
+			t.connectionLost(client, err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			t.connectionLost(client, &serverDisconnect{code: d.ReasonCode})
+		},
+	})
+
+	connect := &paho.Connect{
+		ClientID:   t.ClientID,
+		KeepAlive:  v5KeepAlive,
+		CleanStart: true,
+		Properties: &paho.ConnectProperties{
+			TopicAliasMaximum: paho.Uint16(v5TopicAliasMaximum),
+		},
+		WillMessage: &paho.WillMessage{
+			Topic:   fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, t.ClientID),
+			Payload: will,
+			QoS:     1,
+			Retain:  transport.RetainConnectionStatus,
+		},
+		WillProperties: &paho.WillProperties{
+			ContentType: "application/json",
+		},
+	}
+	if t.Username != "" {
+		connect.Username = t.Username
+		connect.UsernameFlag = true
+	}
+	if t.Password != "" {
+		connect.Password = []byte(t.Password)
+		connect.PasswordFlag = true
+	}
+
+	ctx := context.Background()
+	if timeout := t.dialer.Timeouts.Handshake; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	connack, err := client.Connect(ctx, connect)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	dialer.Record(dialer.PhaseHandshake, time.Since(start), err)
+	if err != nil {
+		conn.Close()
+		if connack != nil && isAuthReasonCode(connack.ReasonCode) {
+			return fmt.Errorf("%w: %v", transport.ErrNotAuthorized, err)
+		}
+		return err
+	}
+	var aliasMaximum uint16
+	if connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+		aliasMaximum = *connack.Properties.TopicAliasMaximum
+	}
+
+	t.lock.Lock()
+	select {
+	case <-done:
+		// Disconnect was called while connecting.
+		t.lock.Unlock()
+		client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return fmt.Errorf("transport disconnected")
+	default:
+	}
+	t.client = client
+	t.router = router
+	t.aliases = newTopicAliases(aliasMaximum)
+	t.lock.Unlock()
+	log.Tracef("connected to broker: %v", broker)
+	t.takeovers.connect(time.Now())
+	tracing.Instant(tracing.Transport, "connected", nil)
+
+	// Messages are handed to the handlers synchronously, in the order they
+	// arrive; the handlers only queue them, so a full queue holds up the
+	// client rather than piling up goroutines.
+	var topic string
+	topic = fmt.Sprintf("%v/%v/data/in", yggdrasil.TopicPrefix, t.ClientID)
+	if err := t.subscribe(topic, func(p *paho.Publish) {
+		log.Debugf("received a message %v on topic %v", p.PacketID, p.Topic)
+		payload, err := transport.DecodeMessage(p.Payload)
+		if err != nil {
+			log.Errorf("cannot decode message %v: %v", p.PacketID, err)
+			return
+		}
+		transport.MirrorReceivedMessage("data", payload)
+		t.dataHandler(payload)
+	}); err != nil {
+		log.Error(err)
+	}
+
+	topic = fmt.Sprintf("%v/%v/control/in", yggdrasil.TopicPrefix, t.ClientID)
+	if err := t.subscribe(topic, func(p *paho.Publish) {
+		log.Debugf("received a message %v on topic %v", p.PacketID, p.Topic)
+		payload, err := transport.DecodeMessage(p.Payload)
+		if err != nil {
+			log.Errorf("cannot decode message %v: %v", p.PacketID, err)
+			return
+		}
+		transport.MirrorReceivedMessage("control", payload)
+		t.controlHandler(payload, t)
+	}); err != nil {
+		log.Error(err)
+	}
+
+	// Watch the presences published with our client ID, including the
+	// retained one, to detect another client using it, then announce our own.
+	topic = presenceTopic(t.ClientID)
+	if err := t.subscribe(topic, func(p *paho.Publish) {
+		go checkPresence(t, t.ClientID, t.instance, p.Payload, p.Retain)
+	}); err != nil {
+		log.Warnf("cannot detect client ID conflicts: %v", err)
+	}
+	if data, err := newPresence(t.instance); err != nil {
+		log.Error(err)
+	} else if err := t.publish(topic, data, true, &paho.PublishProperties{ContentType: "application/json"}); err != nil {
+		log.Errorf("cannot publish presence: %v", err)
+	}
+
+	// Restore any additional subscriptions; the session is not persisted
+	// across connections.
+	t.subscriptionsLock.RLock()
+	for topic, handler := range t.subscriptions {
+		if err := t.subscribeTopic(topic, handler); err != nil {
+			log.Error(err)
+		}
+	}
+	t.subscriptionsLock.RUnlock()
+
+	dispatchers, workers := t.status()
+	go transport.PublishConnectionStatus(t, dispatchers, workers)
+	go reportTakeovers(t, &t.takeovers)
+
+	return nil
+}
+
+// connectionLost handles the loss of the connection of client, reconnecting
+// unless client was replaced or the transport disconnected.
+func (t *V5Transport) connectionLost(client *paho.Client, err error) {
+	t.lock.Lock()
+	if client != t.client {
+		t.lock.Unlock()
+		return
+	}
+	t.client = nil
+	done := t.done
+	t.lock.Unlock()
+
+	log.Errorf("connection lost unexpectedly: %v", err)
+	lasterror.Set(lasterror.Transport, fmt.Errorf("connection lost: %w", err))
+	var disconnect *serverDisconnect
+	sessionLost(&t.takeovers, t.ClientID, errors.As(err, &disconnect) && disconnect.code == reasonSessionTakenOver)
+	tracing.Instant(tracing.Transport, "connection lost", map[string]string{"error": err.Error()})
+	go t.reconnect(done)
+}
+
+// reasonSessionTakenOver is the reason code of the DISCONNECT packet a broker
+// sends when another client connects with the same client ID.
+const reasonSessionTakenOver = 0x8e
+
+// Reason codes of the CONNACK packet a broker sends when it rejects the
+// credentials of the client.
+const (
+	reasonBadUserNameOrPassword = 0x86
+	reasonNotAuthorized         = 0x87
+	reasonBadAuthMethod         = 0x8c
+)
+
+// isAuthReasonCode reports whether code is the reason code of a CONNACK
+// packet rejecting the credentials of the client.
+func isAuthReasonCode(code byte) bool {
+	return code == reasonBadUserNameOrPassword || code == reasonNotAuthorized || code == reasonBadAuthMethod
+}
+
+// A serverDisconnect is the loss of a connection closed by the broker.
+type serverDisconnect struct {
+	code byte
+}
+
+func (e *serverDisconnect) Error() string {
+	return fmt.Sprintf("disconnected by broker with reason code %v", e.code)
+}
+
+// reconnect connects to the brokers again, resolving them first if
+// ResolveBrokers is set, waiting longer after each failed attempt, until
+// connected or done is closed. The first attempt is delayed while another
+// client keeps taking over the session.
+func (t *V5Transport) reconnect(done chan struct{}) {
+	interval := time.Second + t.takeovers.reconnectDelay()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		if t.ResolveBrokers != nil {
+			brokers, err := t.ResolveBrokers()
+			if err != nil {
+				log.Errorf("cannot resolve brokers; reconnecting to previous brokers: %v", err)
+			} else if err := t.SetBrokers(brokers); err != nil {
+				log.Errorf("cannot use resolved brokers; reconnecting to previous brokers: %v", err)
+			} else {
+				log.Debugf("resolved brokers: %v", brokers)
+			}
+		}
+
+		err := t.connect(done)
+		if err == nil {
+			return
+		}
+		log.Errorf("cannot reconnect: %v", err)
+		lasterror.Set(lasterror.Transport, err)
+
+		interval *= 2
+		if interval > v5MaxReconnectInterval {
+			interval = v5MaxReconnectInterval
+		}
+	}
+}
+
+// connection returns the client and topic aliases of the current connection,
+// or an error if the transport is not connected.
+func (t *V5Transport) connection() (*paho.Client, *paho.StandardRouter, *topicAliases, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.client == nil {
+		return nil, nil, nil, fmt.Errorf("not connected")
+	}
+	return t.client, t.router, t.aliases, nil
+}
+
+// publish publishes payload on topic, replacing topic by an alias once the
+// broker knows it.
+func (t *V5Transport) publish(topic string, payload []byte, retained bool, properties *paho.PublishProperties) error {
+	client, _, aliases, err := t.connection()
+	if err != nil {
+		return err
+	}
+	if properties == nil {
+		properties = &paho.PublishProperties{}
+	}
+
+	p := &paho.Publish{
+		QoS:        1,
+		Retain:     retained,
+		Topic:      topic,
+		Payload:    payload,
+		Properties: properties,
+	}
+	alias, known := aliases.get(topic)
+	if alias != 0 {
+		p.Properties.TopicAlias = paho.Uint16(alias)
+		if known {
+			p.Topic = ""
+		}
+	}
+
+	if _, err := client.Publish(context.Background(), p); err != nil {
+		return err
+	}
+	if alias != 0 && !known {
+		aliases.established(topic)
+	}
+	return nil
+}
+
+func (t *V5Transport) SendData(data yggdrasil.Data) error {
+	topic := fmt.Sprintf("%v/%v/data/out", yggdrasil.TopicPrefix, t.ClientID)
+
+	d, contentType, err := transport.EncodeMessage(data)
+	if err != nil {
+		log.Errorf("cannot encode message: %v", err)
+		return err
+	}
+
+	properties := dataProperties(data, time.Now())
+	properties.ContentType = contentType
+	if err := t.publish(topic, d, false, properties); err != nil {
+		log.Errorf("failed to publish message: %v", err)
+		return err
+	}
+	transport.MirrorSentMessage("data", data)
+	log.Debugf("published message %v to topic %v", data.MessageID, topic)
+	log.Tracef("message: %+v", data)
+	return nil
+}
+
+// dataProperties returns the properties of the message publishing data at
+// now: its metadata as user properties, sorted by key, and an expiry interval
+// ending at its deadline or after the expiry of its class, if set.
+func dataProperties(data yggdrasil.Data, now time.Time) *paho.PublishProperties {
+	properties := &paho.PublishProperties{
+		ContentType: "application/json",
+	}
+
+	keys := make([]string, 0, len(data.Metadata))
+	for key := range data.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		properties.User.Add(key, data.Metadata[key])
+	}
+
+	properties.MessageExpiry = messageExpiry(data, now)
+
+	return properties
+}
+
+// messageExpiry returns the message expiry interval of msg published at now,
+// rounded up to whole seconds, or nil if it never expires.
+func messageExpiry(msg interface{}, now time.Time) *uint32 {
+	expiry, ok := transport.Expiry(msg, now)
+	if !ok {
+		return nil
+	}
+	return paho.Uint32(uint32((expiry + time.Second - 1) / time.Second))
+}
+
+// SendControl publishes ctrlMsg on the control topic. Connection-status
+// messages are retained if RetainConnectionStatus is true.
+func (t *V5Transport) SendControl(ctrlMsg interface{}) error {
+	topic := fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, t.ClientID)
+
+	data, contentType, err := transport.EncodeMessage(ctrlMsg)
+	if err != nil {
+		log.Errorf("cannot encode message: %v", err)
+		return err
+	}
+
+	_, retained := ctrlMsg.(yggdrasil.ConnectionStatus)
+	retained = retained && transport.RetainConnectionStatus
+
+	if err := t.publish(topic, data, retained, &paho.PublishProperties{
+		ContentType:   contentType,
+		MessageExpiry: messageExpiry(ctrlMsg, time.Now()),
+	}); err != nil {
+		return err
+	}
+	transport.MirrorSentMessage("control", ctrlMsg)
+	return nil
+}
+
+// Subscribe subscribes to topic, calling handler for each message received on
+// it. The subscription is restored each time the client reconnects.
+func (t *V5Transport) Subscribe(topic string, handler transport.TopicHandler) error {
+	t.subscriptionsLock.Lock()
+	t.subscriptions[topic] = handler
+	t.subscriptionsLock.Unlock()
+
+	if !t.Connected() {
+		return nil
+	}
+	return t.subscribeTopic(topic, handler)
+}
+
+// Unsubscribe removes the subscription to topic.
+func (t *V5Transport) Unsubscribe(topic string) error {
+	t.subscriptionsLock.Lock()
+	delete(t.subscriptions, topic)
+	t.subscriptionsLock.Unlock()
+
+	client, router, _, err := t.connection()
+	if err != nil {
+		return nil
+	}
+	router.UnregisterHandler(topic)
+	if _, err := client.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: []string{topic}}); err != nil {
+		return fmt.Errorf("cannot unsubscribe from topic %v: %w", topic, err)
+	}
+	log.Tracef("unsubscribed from topic: %v", topic)
+	return nil
+}
+
+func (t *V5Transport) subscribeTopic(topic string, handler transport.TopicHandler) error {
+	return t.subscribe(topic, func(p *paho.Publish) {
+		log.Debugf("received a message %v on topic %v", p.PacketID, p.Topic)
+		handler(p.Topic, p.Payload)
+	})
+}
+
+// subscribe registers handler for topic and subscribes to it.
+func (t *V5Transport) subscribe(topic string, handler paho.MessageHandler) error {
+	client, router, _, err := t.connection()
+	if err != nil {
+		return fmt.Errorf("cannot subscribe to topic %v: %w", topic, err)
+	}
+	router.RegisterHandler(topic, handler)
+	if _, err := client.Subscribe(context.Background(), &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{
+			topic: {QoS: 1},
+		},
+	}); err != nil {
+		router.UnregisterHandler(topic)
+		return fmt.Errorf("cannot subscribe to topic %v: %w", topic, err)
+	}
+	log.Tracef("subscribed to topic: %v", topic)
+	return nil
+}
+
+// Connected reports whether the client has an open connection to a broker.
+func (t *V5Transport) Connected() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.client != nil
+}
+
+// Disconnect publishes an "offline" connection-status message and clears the
+// retained one, since the broker does not publish the will of a client that
+// disconnects cleanly, clears the retained presence, then disconnects from
+// the broker and stops reconnecting. quiesce is ignored: publishing is synchronous, so no work is
+// left once the last message is published.
+func (t *V5Transport) Disconnect(quiesce uint) {
+	if t.Connected() {
+		if err := t.SendControl(yggdrasil.ConnectionStatus{
+			Type:      yggdrasil.MessageTypeConnectionStatus,
+			MessageID: uuid.New().String(),
+			Version:   1,
+			Sent:      time.Now(),
+			Content: yggdrasil.ConnectionStatusContent{
+				State: yggdrasil.ConnectionStateOffline,
+			},
+		}); err != nil {
+			log.Errorf("cannot publish connection-status: %v", err)
+		}
+		if transport.RetainConnectionStatus {
+			topic := fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, t.ClientID)
+			if err := t.publish(topic, []byte{}, true, nil); err != nil {
+				log.Errorf("cannot clear retained connection-status: %v", err)
+			}
+		}
+		if err := t.publish(presenceTopic(t.ClientID), []byte{}, true, nil); err != nil {
+			log.Errorf("cannot clear presence: %v", err)
+		}
+	}
+
+	t.lock.Lock()
+	client := t.client
+	t.client = nil
+	if t.done != nil {
+		close(t.done)
+		t.done = nil
+	}
+	t.lock.Unlock()
+
+	if client != nil {
+		if err := client.Disconnect(&paho.Disconnect{ReasonCode: 0}); err != nil {
+			log.Errorf("cannot disconnect: %v", err)
+		}
+	}
+}
+
+// topicAliases assigns topic aliases to the topics published on, up to the
+// maximum set by the broker. An alias is only used in place of its topic once
+// a message carrying both was acknowledged; until then, concurrent messages
+// may reach the broker before the one that introduces the alias.
+type topicAliases struct {
+	lock    sync.Mutex
+	maximum uint16
+	aliases map[string]uint16
+	known   map[string]bool
+}
+
+// newTopicAliases returns topicAliases assigning up to maximum aliases.
+func newTopicAliases(maximum uint16) *topicAliases {
+	return &topicAliases{
+		maximum: maximum,
+		aliases: make(map[string]uint16),
+		known:   make(map[string]bool),
+	}
+}
+
+// get returns the alias of topic, assigning one if possible, and whether the
+// broker knows it. It returns 0 if no alias is left.
+func (a *topicAliases) get(topic string) (uint16, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if alias, prs := a.aliases[topic]; prs {
+		return alias, a.known[topic]
+	}
+	if len(a.aliases) >= int(a.maximum) {
+		return 0, false
+	}
+	alias := uint16(len(a.aliases) + 1)
+	a.aliases[topic] = alias
+	return alias, false
+}
+
+// established records that the broker knows the alias of topic.
+func (a *topicAliases) established(topic string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.known[topic] = true
+}
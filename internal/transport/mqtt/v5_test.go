@@ -0,0 +1,210 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestDataProperties(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		input       yggdrasil.Data
+		wantUser    paho.UserProperties
+		wantExpiry  *uint32
+	}{
+		{
+			description: "no metadata",
+			input:       yggdrasil.Data{},
+			wantUser:    nil,
+		},
+		{
+			description: "metadata",
+			input: yggdrasil.Data{
+				Metadata: map[string]string{"b": "2", "a": "1"},
+			},
+			wantUser: paho.UserProperties{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}},
+		},
+		{
+			description: "deadline",
+			input: yggdrasil.Data{
+				Metadata: map[string]string{"deadline": "2021-06-01T12:01:30Z"},
+			},
+			wantUser:   paho.UserProperties{{Key: "deadline", Value: "2021-06-01T12:01:30Z"}},
+			wantExpiry: paho.Uint32(90),
+		},
+		{
+			description: "deadline passed",
+			input: yggdrasil.Data{
+				Metadata: map[string]string{"deadline": "2021-06-01T11:00:00Z"},
+			},
+			wantUser:   paho.UserProperties{{Key: "deadline", Value: "2021-06-01T11:00:00Z"}},
+			wantExpiry: paho.Uint32(1),
+		},
+		{
+			description: "invalid deadline",
+			input: yggdrasil.Data{
+				Metadata: map[string]string{"deadline": "tomorrow"},
+			},
+			wantUser: paho.UserProperties{{Key: "deadline", Value: "tomorrow"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := dataProperties(test.input, now)
+
+			if !cmp.Equal(got.User, test.wantUser) {
+				t.Errorf("%#v", cmp.Diff(got.User, test.wantUser))
+			}
+			if !cmp.Equal(got.MessageExpiry, test.wantExpiry) {
+				t.Errorf("%#v", cmp.Diff(got.MessageExpiry, test.wantExpiry))
+			}
+		})
+	}
+}
+
+func TestTopicAliases(t *testing.T) {
+	aliases := newTopicAliases(2)
+
+	if alias, known := aliases.get("a"); alias != 1 || known {
+		t.Errorf("a: alias %v known %v, want 1 false", alias, known)
+	}
+	// The alias is sent along with the topic until the broker acknowledged
+	// a message carrying both.
+	if alias, known := aliases.get("a"); alias != 1 || known {
+		t.Errorf("a: alias %v known %v, want 1 false", alias, known)
+	}
+	aliases.established("a")
+	if alias, known := aliases.get("a"); alias != 1 || !known {
+		t.Errorf("a: alias %v known %v, want 1 true", alias, known)
+	}
+
+	if alias, _ := aliases.get("b"); alias != 2 {
+		t.Errorf("b: alias %v, want 2", alias)
+	}
+	if alias, _ := aliases.get("c"); alias != 0 {
+		t.Errorf("c: alias %v, want none past the maximum", alias)
+	}
+
+	if alias, _ := newTopicAliases(0).get("a"); alias != 0 {
+		t.Errorf("alias %v, want none when the broker allows none", alias)
+	}
+}
+
+// fakeBroker accepts a single MQTT 5 connection on l, allowing aliases topic
+// aliases, and sends the PUBLISH packets it receives on published.
+func fakeBroker(t *testing.T, l net.Listener, aliases uint16, published chan<- *packets.Publish) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply *packets.ControlPacket
+		switch p.Type {
+		case packets.CONNECT:
+			reply = packets.NewControlPacket(packets.CONNACK)
+			reply.Content.(*packets.Connack).Properties.TopicAliasMaximum = paho.Uint16(aliases)
+		case packets.SUBSCRIBE:
+			reply = packets.NewControlPacket(packets.SUBACK)
+			reply.Content.(*packets.Suback).PacketID = p.PacketID()
+			reply.Content.(*packets.Suback).Reasons = []byte{1}
+		case packets.PUBLISH:
+			publish := p.Content.(*packets.Publish)
+			published <- publish
+			reply = packets.NewControlPacket(packets.PUBACK)
+			reply.Content.(*packets.Puback).PacketID = publish.PacketID
+		case packets.DISCONNECT:
+			return
+		default:
+			continue
+		}
+		if _, err := reply.WriteTo(conn); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestV5TransportSendData(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	published := make(chan *packets.Publish, 10)
+	go fakeBroker(t, l, 4, published)
+
+	tr, err := NewMQTTv5Transport("test", []string{"tcp://" + l.Addr().String()}, nil,
+		func([]byte, transport.Transport) {}, func([]byte) {},
+		func() (map[string]map[string]string, map[string]yggdrasil.WorkerInfo) { return nil, nil },
+		dialer.New(dialer.DefaultTimeouts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disconnect(0)
+
+	data := yggdrasil.Data{
+		MessageID: "1",
+		Metadata:  map[string]string{"deadline": time.Now().Add(time.Hour).Format(time.RFC3339)},
+	}
+	for i := 0; i < 2; i++ {
+		if err := tr.SendData(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The connection-status published once connected may come first, and
+	// take an alias of its own.
+	topics := make(map[uint16]string)
+	var got []*packets.Publish
+	for len(got) < 2 {
+		select {
+		case p := <-published:
+			if p.Properties.TopicAlias == nil {
+				t.Fatalf("message published on %v without topic alias", p.Topic)
+			}
+			if p.Topic != "" {
+				topics[*p.Properties.TopicAlias] = p.Topic
+			}
+			if topics[*p.Properties.TopicAlias] == yggdrasil.TopicPrefix+"/test/data/out" {
+				got = append(got, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages not published")
+		}
+	}
+
+	if got[0].Topic == "" {
+		t.Error("first message published without its topic")
+	}
+	if got[1].Topic != "" {
+		t.Errorf("second message published on %v, want its alias only", got[1].Topic)
+	}
+	for _, p := range got {
+		if p.Properties.MessageExpiry == nil || *p.Properties.MessageExpiry > 3600 || *p.Properties.MessageExpiry < 3590 {
+			t.Errorf("message expiry %v, want about an hour", p.Properties.MessageExpiry)
+		}
+		if len(p.Properties.User) != 1 || p.Properties.User[0].Key != "deadline" {
+			t.Errorf("user properties %v, want the message metadata", p.Properties.User)
+		}
+	}
+}
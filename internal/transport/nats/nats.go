@@ -0,0 +1,439 @@
+// Package nats implements a transport exchanging messages with the server
+// over NATS, for deployments already running NATS for edge messaging.
+//
+// Messages are published on the subjects matching the MQTT topics, with
+// slashes replaced by dots: "<prefix>.<client ID>.control.out" and so on.
+// Control messages always use core NATS. Data messages use JetStream when
+// enabled, so that they are stored by the servers until consumed rather than
+// lost while either end is disconnected.
+package nats
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	nats "github.com/nats-io/nats.go"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+const (
+	// minReconnectDelay and maxReconnectDelay bound the delay between
+	// attempts to reconnect, which doubles with each failed attempt.
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 2 * time.Minute
+
+	// publishTimeout bounds the time the servers take to acknowledge a data
+	// message published to JetStream.
+	publishTimeout = 30 * time.Second
+)
+
+// Transport is a transport.Transport connecting to NATS servers.
+type Transport struct {
+	ClientID string
+
+	// Username and Password, if set, authenticate the client to the servers.
+	Username string
+	Password string
+
+	// JetStream, if true, publishes data messages to JetStream and consumes
+	// them from a durable consumer named after the client ID, acknowledging
+	// each message once it is queued for dispatch. The servers must have a
+	// stream capturing the data subjects of the client.
+	JetStream bool
+
+	tlsConfig      *tls.Config
+	dialer         *dialer.Dialer
+	controlHandler transport.CommandHandler
+	dataHandler    transport.DataHandler
+	status         transport.StatusFunc
+
+	// lock guards the fields below it. conn is nil while the transport is
+	// not started.
+	lock          sync.Mutex
+	brokers       []string
+	conn          *nats.Conn
+	js            nats.JetStreamContext
+	dataSub       *nats.Subscription
+	subscriptions map[string]transport.TopicHandler
+	subscribed    map[string]*nats.Subscription
+}
+
+// NewNATSTransport creates a Transport connecting to brokers, NATS server
+// URLs such as "nats://HOST:PORT" or "tls://HOST:PORT", with d. Connections
+// use TLS if tlsConfig is not nil.
+func NewNATSTransport(clientID string, brokers []string, tlsConfig *tls.Config, controlHandler transport.CommandHandler, dataHandler transport.DataHandler, status transport.StatusFunc, d *dialer.Dialer) (*Transport, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("missing brokers")
+	}
+	return &Transport{
+		ClientID:       clientID,
+		tlsConfig:      tlsConfig,
+		dialer:         d,
+		controlHandler: controlHandler,
+		dataHandler:    dataHandler,
+		status:         status,
+		brokers:        brokers,
+		subscriptions:  make(map[string]transport.TopicHandler),
+		subscribed:     make(map[string]*nats.Subscription),
+	}, nil
+}
+
+// SetBrokers replaces the servers the transport connects to. The transport
+// must be disconnected before, and started again after, calling SetBrokers.
+func (t *Transport) SetBrokers(brokers []string) error {
+	if len(brokers) == 0 {
+		return fmt.Errorf("missing brokers")
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.brokers = brokers
+	return nil
+}
+
+// Brokers returns the servers the transport connects to.
+func (t *Transport) Brokers() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]string(nil), t.brokers...)
+}
+
+// Start connects to one of the servers and subscribes to the control and data
+// subjects. Once connected, the connection is reestablished whenever it is
+// lost, doubling the delay between attempts up to maxReconnectDelay.
+func (t *Transport) Start() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+
+	opts := []nats.Option{
+		nats.Name(t.ClientID),
+		nats.SetCustomDialer(natsDialer{t.dialer}),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(reconnectDelay),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			if err == nil {
+				return
+			}
+			log.Errorf("connection lost unexpectedly: %v", err)
+			lasterror.Set(lasterror.Transport, fmt.Errorf("connection lost: %w", err))
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Infof("reconnected to NATS server %v", c.ConnectedUrl())
+			t.onConnect()
+		}),
+		nats.ErrorHandler(func(c *nats.Conn, s *nats.Subscription, err error) {
+			if s != nil {
+				log.Errorf("error on subject %v: %v", s.Subject, err)
+				return
+			}
+			log.Errorf("NATS error: %v", err)
+		}),
+	}
+	if t.tlsConfig != nil {
+		opts = append(opts, nats.Secure(t.tlsConfig))
+	}
+	if t.Username != "" {
+		opts = append(opts, nats.UserInfo(t.Username, t.Password))
+	}
+
+	conn, err := nats.Connect(strings.Join(t.brokers, ","), opts...)
+	if err != nil {
+		err = fmt.Errorf("cannot connect to NATS servers: %w", err)
+		lasterror.Set(lasterror.Transport, err)
+		return err
+	}
+	log.Infof("connected to NATS server %v", conn.ConnectedUrl())
+	t.conn = conn
+	t.js = nil
+	t.dataSub = nil
+
+	// Core NATS subscriptions are restored by the client each time it
+	// reconnects. Messages are handed to the handlers synchronously, in the
+	// order they arrive; the handlers only queue them.
+	if _, err := conn.Subscribe(subject("control", "in", t.ClientID), func(m *nats.Msg) {
+		log.Debugf("received a message on subject %v", m.Subject)
+		transport.MirrorReceivedMessage("control", m.Data)
+		t.controlHandler(m.Data, t)
+	}); err != nil {
+		conn.Close()
+		t.conn = nil
+		return fmt.Errorf("cannot subscribe to control subject: %w", err)
+	}
+	if t.JetStream {
+		js, err := conn.JetStream()
+		if err != nil {
+			conn.Close()
+			t.conn = nil
+			return fmt.Errorf("cannot use JetStream: %w", err)
+		}
+		t.js = js
+	} else {
+		if _, err := conn.Subscribe(subject("data", "in", t.ClientID), func(m *nats.Msg) {
+			log.Debugf("received a message on subject %v", m.Subject)
+			transport.MirrorReceivedMessage("data", m.Data)
+			t.dataHandler(m.Data)
+		}); err != nil {
+			conn.Close()
+			t.conn = nil
+			return fmt.Errorf("cannot subscribe to data subject: %w", err)
+		}
+	}
+	for topic, handler := range t.subscriptions {
+		if err := t.subscribe(topic, handler); err != nil {
+			log.Error(err)
+		}
+	}
+
+	go t.onConnect()
+	return nil
+}
+
+// onConnect consumes data messages from JetStream, if enabled and not already
+// consuming, and publishes a connection-status message.
+func (t *Transport) onConnect() {
+	t.lock.Lock()
+	if t.js != nil && t.dataSub == nil {
+		sub, err := t.js.Subscribe(subject("data", "in", t.ClientID), func(m *nats.Msg) {
+			log.Debugf("received a message on subject %v", m.Subject)
+			transport.MirrorReceivedMessage("data", m.Data)
+			t.dataHandler(m.Data)
+			if err := m.Ack(); err != nil {
+				log.Errorf("cannot acknowledge message: %v", err)
+			}
+		}, nats.Durable(durableName(t.ClientID)), nats.ManualAck())
+		if err != nil {
+			log.Errorf("cannot consume data messages from JetStream: %v", err)
+			lasterror.Set(lasterror.Transport, fmt.Errorf("cannot consume data messages: %w", err))
+		} else {
+			t.dataSub = sub
+		}
+	}
+	t.lock.Unlock()
+
+	dispatchers, workers := t.status()
+	transport.PublishConnectionStatus(t, dispatchers, workers)
+}
+
+// SendData publishes data on the data subject, to JetStream if enabled, in
+// which case the message ID deduplicates retried publications.
+func (t *Transport) SendData(data yggdrasil.Data) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+	subj := subject("data", "out", t.ClientID)
+
+	t.lock.Lock()
+	conn, js := t.conn, t.js
+	t.lock.Unlock()
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	if js != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		defer cancel()
+		if _, err := js.Publish(subj, d, nats.MsgId(data.MessageID), nats.Context(ctx)); err != nil {
+			return fmt.Errorf("cannot publish to JetStream: %w", err)
+		}
+	} else if err := conn.Publish(subj, d); err != nil {
+		return fmt.Errorf("cannot publish message: %w", err)
+	}
+	transport.MirrorSentMessage("data", data)
+	log.Debugf("published message %v to subject %v", data.MessageID, subj)
+	log.Tracef("message: %+v", data)
+	return nil
+}
+
+// SendControl publishes ctrlMsg on the control subject. NATS does not retain
+// messages, so connection-status messages are not retained.
+func (t *Transport) SendControl(ctrlMsg interface{}) error {
+	data, err := json.Marshal(ctrlMsg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	if err := conn.Publish(subject("control", "out", t.ClientID), data); err != nil {
+		return err
+	}
+	transport.MirrorSentMessage("control", ctrlMsg)
+	return nil
+}
+
+// Subscribe subscribes to topic, an MQTT topic filter, calling handler for
+// each message received on the matching subject with the topic it was
+// published on.
+func (t *Transport) Subscribe(topic string, handler transport.TopicHandler) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.subscriptions[topic] = handler
+	if t.conn == nil {
+		return nil
+	}
+	return t.subscribe(topic, handler)
+}
+
+// Unsubscribe removes the subscription to topic.
+func (t *Transport) Unsubscribe(topic string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.subscriptions, topic)
+	sub, prs := t.subscribed[topic]
+	if !prs {
+		return nil
+	}
+	delete(t.subscribed, topic)
+	if err := sub.Unsubscribe(); err != nil && err != nats.ErrConnectionClosed {
+		return fmt.Errorf("cannot unsubscribe from topic %v: %w", topic, err)
+	}
+	return nil
+}
+
+// subscribe subscribes the connection to the subject matching topic. The
+// caller must hold the lock.
+func (t *Transport) subscribe(topic string, handler transport.TopicHandler) error {
+	sub, err := t.conn.Subscribe(topicSubject(topic), func(m *nats.Msg) {
+		log.Debugf("received a message on subject %v", m.Subject)
+		handler(subjectTopic(m.Subject), m.Data)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot subscribe to topic %v: %w", topic, err)
+	}
+	t.subscribed[topic] = sub
+	log.Tracef("subscribed to topic: %v", topic)
+	return nil
+}
+
+// Connected reports whether the transport is connected to a server.
+func (t *Transport) Connected() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.conn != nil && t.conn.IsConnected()
+}
+
+// Disconnect publishes an "offline" connection-status message, since NATS
+// has no will, then waits up to quiesce milliseconds for pending messages to
+// be sent and closes the connection. The durable JetStream consumer is kept,
+// so data messages published while disconnected are delivered on the next
+// start.
+func (t *Transport) Disconnect(quiesce uint) {
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+	if conn == nil {
+		return
+	}
+
+	if conn.IsConnected() {
+		if err := t.SendControl(yggdrasil.ConnectionStatus{
+			Type:      yggdrasil.MessageTypeConnectionStatus,
+			MessageID: uuid.New().String(),
+			Version:   1,
+			Sent:      time.Now(),
+			Content: yggdrasil.ConnectionStatusContent{
+				State: yggdrasil.ConnectionStateOffline,
+			},
+		}); err != nil {
+			log.Errorf("cannot publish connection-status: %v", err)
+		}
+		if err := conn.FlushTimeout(time.Duration(quiesce) * time.Millisecond); err != nil {
+			log.Debugf("cannot flush pending messages: %v", err)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conn.Close()
+	if t.conn == conn {
+		t.conn = nil
+		t.js = nil
+		t.dataSub = nil
+		t.subscribed = make(map[string]*nats.Subscription)
+	}
+}
+
+// natsDialer dials the servers with a dialer.Dialer, so that the connection
+// phase timeouts apply. NATS upgrades the connection to TLS itself.
+type natsDialer struct {
+	d *dialer.Dialer
+}
+
+func (n natsDialer) Dial(network, address string) (net.Conn, error) {
+	return n.d.DialContext(context.Background(), network, address)
+}
+
+// reconnectDelay returns the delay before the given attempt to reconnect.
+func reconnectDelay(attempts int) time.Duration {
+	delay := minReconnectDelay
+	for i := 1; i < attempts && delay < maxReconnectDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+	return delay
+}
+
+// subject returns the subject of the given kind ("control" or "data") and
+// direction ("in" or "out") for clientID.
+func subject(kind, direction, clientID string) string {
+	return topicSubject(fmt.Sprintf("%v/%v/%v/%v", yggdrasil.TopicPrefix, clientID, kind, direction))
+}
+
+// topicSubject returns the NATS subject matching the MQTT topic filter topic:
+// levels are separated by dots, "+" becomes "*" and "#" becomes ">".
+func topicSubject(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "*"
+		case "#":
+			levels[i] = ">"
+		default:
+			levels[i] = strings.Replace(level, ".", "_", -1)
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// subjectTopic returns the MQTT topic matching subject.
+func subjectTopic(subject string) string {
+	return strings.Replace(subject, ".", "/", -1)
+}
+
+// durableName returns the name of the JetStream consumer of the data
+// messages of clientID. Consumer names cannot contain dots, wildcards or
+// whitespace.
+func durableName(clientID string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, clientID)
+}
@@ -0,0 +1,171 @@
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/dialer"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestTopicSubject(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+	}{
+		{
+			description: "topic",
+			input:       "yggdrasil/test/control/in",
+			want:        "yggdrasil.test.control.in",
+		},
+		{
+			description: "wildcards",
+			input:       "yggdrasil/+/data/#",
+			want:        "yggdrasil.*.data.>",
+		},
+		{
+			description: "dotted level",
+			input:       "yggdrasil/host.example.com/data/in",
+			want:        "yggdrasil.host_example_com.data.in",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := topicSubject(test.input); got != test.want {
+				t.Errorf("%q != %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 4, want: 8 * time.Second},
+		{attempts: 100, want: maxReconnectDelay},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.attempts), func(t *testing.T) {
+			if got := reconnectDelay(test.attempts); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+// fakeServer speaks enough of the NATS client protocol to accept a single
+// client: it answers pings, sends the messages written to deliver to the
+// client's first subscription matching their subject, and sends the subjects
+// and payloads of the messages the client publishes on published.
+func fakeServer(t *testing.T, l net.Listener, deliver <-chan [2]string, published chan<- [2]string) {
+	c, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	fmt.Fprintf(c, "INFO {\"server_id\":\"test\",\"version\":\"2.2.0\",\"headers\":true,\"max_payload\":1048576}\r\n")
+
+	sids := make(chan map[string]string, 1)
+	sids <- make(map[string]string)
+	go func() {
+		for m := range deliver {
+			s := <-sids
+			sid := s[m[0]]
+			sids <- s
+			fmt.Fprintf(c, "MSG %v %v %v\r\n%v\r\n", m[0], sid, len(m[1]), m[1])
+		}
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			fmt.Fprintf(c, "PONG\r\n")
+		case "SUB":
+			s := <-sids
+			s[fields[1]] = fields[len(fields)-1]
+			sids <- s
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			published <- [2]string{fields[1], string(payload[:size])}
+		}
+	}
+}
+
+func TestTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	deliver := make(chan [2]string)
+	defer close(deliver)
+	published := make(chan [2]string, 10)
+	go fakeServer(t, l, deliver, published)
+
+	commands := make(chan string, 1)
+	tr, err := NewNATSTransport("test", []string{"nats://" + l.Addr().String()}, nil, func(command []byte, t transport.Transport) {
+		commands <- string(command)
+	}, func(data []byte) {}, func() (map[string]map[string]string, map[string]yggdrasil.WorkerInfo) {
+		return nil, nil
+	}, dialer.New(dialer.Timeouts{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disconnect(0)
+
+	if err := tr.SendData(yggdrasil.Data{MessageID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case m := <-published:
+			if m[0] != "yggdrasil.test.data.out" {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("data message not published")
+		}
+		break
+	}
+
+	deliver <- [2]string{"yggdrasil.test.control.in", "command"}
+	select {
+	case got := <-commands:
+		if got != "command" {
+			t.Errorf("%q != %q", got, "command")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("control message not handled")
+	}
+}
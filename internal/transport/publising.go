@@ -1,38 +1,50 @@
 package transport
 
 import (
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"git.sr.ht/~spc/go-log"
 	"github.com/google/uuid"
 	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/lasterror"
 	"github.com/redhatinsights/yggdrasil/internal/tags"
-	"os"
-	"path/filepath"
-	"time"
+	"github.com/redhatinsights/yggdrasil/internal/tracing"
 )
 
-func PublishConnectionStatus(t Transport, dispatchers map[string]map[string]string) {
+// ReportErrors includes the last error of each subsystem in connection-status
+// messages when true.
+var ReportErrors bool
+
+// RetainConnectionStatus publishes connection-status messages as retained
+// messages when true, on transports that support it, so the last known state
+// of the client is available to subscribers that connect later.
+var RetainConnectionStatus bool
+
+// CurrentTags returns the tags published in connection-status messages. It
+// reads the tags file unless replaced.
+var CurrentTags = func() (map[string]string, error) {
+	return tags.ReadTagsFile(yggdrasil.TagsFilePath())
+}
+
+func PublishConnectionStatus(t Transport, dispatchers map[string]map[string]string, workers map[string]yggdrasil.WorkerInfo) {
 	facts, err := yggdrasil.GetCanonicalFacts()
 	if err != nil {
 		log.Errorf("cannot get canonical facts: %v", err)
 		return
 	}
 
-	tagsFilePath := filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "tags.toml")
-
-	var tagMap map[string]string
-	if _, err := os.Stat(tagsFilePath); !os.IsNotExist(err) {
-		f, err := os.Open(tagsFilePath)
-		if err != nil {
-			log.Errorf("cannot open '%v' for reading: %v", tagsFilePath, err)
-			return
-		}
-		defer f.Close()
+	factsDirPath := yggdrasil.FactsDirPath()
+	extraFacts, err := yggdrasil.CollectFacts(factsDirPath)
+	if err != nil {
+		log.Errorf("cannot collect facts from '%v': %v", factsDirPath, err)
+	}
 
-		tagMap, err = tags.ReadTags(f)
-		if err != nil {
-			log.Errorf("cannot read tags file: %v", err)
-			return
-		}
+	tagMap, err := CurrentTags()
+	if err != nil {
+		log.Errorf("cannot read tags: %v", err)
+		return
 	}
 
 	msg := yggdrasil.ConnectionStatus{
@@ -40,32 +52,90 @@ func PublishConnectionStatus(t Transport, dispatchers map[string]map[string]stri
 		MessageID: uuid.New().String(),
 		Version:   1,
 		Sent:      time.Now(),
-		Content: struct {
-			CanonicalFacts yggdrasil.CanonicalFacts     "json:\"canonical_facts\""
-			Dispatchers    map[string]map[string]string "json:\"dispatchers\""
-			State          yggdrasil.ConnectionState    "json:\"state\""
-			Tags           map[string]string            "json:\"tags,omitempty\""
-		}{
-			CanonicalFacts: *facts,
-			Dispatchers:    dispatchers,
-			State:          yggdrasil.ConnectionStateOnline,
-			Tags:           tagMap,
+		Content: yggdrasil.ConnectionStatusContent{
+			CanonicalFacts:   *facts,
+			Dispatchers:      dispatchers,
+			State:            yggdrasil.ConnectionStateOnline,
+			Tags:             tagMap,
+			Workers:          workers,
+			Facts:            extraFacts,
+			Build:            yggdrasil.ReadBuildInfo(),
+			Encodings:        Encodings(),
+			PayloadRecipient: PayloadRecipient(),
 		},
 	}
+	if ReportErrors {
+		msg.Content.Errors = lasterror.All()
+	}
 
+	end := tracing.Begin(tracing.Publish, "connection-status", nil)
 	err = t.SendControl(msg)
+	end()
 	if err != nil {
 		log.Error(err)
+		lasterror.Set(lasterror.Transport, err)
 	}
 	log.Debugf("published message %v to control topic", msg.MessageID)
 	log.Tracef("message: %+v", msg)
 }
 
-func PublishReceivedData(transport Transport, c <-chan yggdrasil.Data) {
+// PublishReceivedData publishes the data received on c, compressing and
+// encrypting its content if enabled. If published is not nil, it is called with each message,
+// as received, and the result of publishing it.
+func PublishReceivedData(transport Transport, c <-chan yggdrasil.Data, published func(yggdrasil.Data, error)) {
 	for d := range c {
-		err := transport.SendData(d)
+		msg, err := CompressContent(d)
+		if err != nil {
+			log.Warnf("publishing data message %v uncompressed: %v", d.MessageID, err)
+		}
+		msg, err = EncryptContent(msg)
+		if err != nil {
+			log.Errorf("cannot publish data message %v: %v", d.MessageID, err)
+			lasterror.Set(lasterror.Transport, err)
+			if published != nil {
+				published(d, err)
+			}
+			continue
+		}
+		if max := ServerCapabilities().MaxPayloadSize; max > 0 {
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Errorf("cannot marshal data message %v: %v", d.MessageID, err)
+				if published != nil {
+					published(d, err)
+				}
+				continue
+			}
+			if len(data) > max {
+				err := fmt.Errorf("size %v exceeds server maximum payload size %v", len(data), max)
+				log.Errorf("cannot publish data message %v: %v", d.MessageID, err)
+				if published != nil {
+					published(d, err)
+				}
+				continue
+			}
+		}
+		end := tracing.Begin(tracing.Publish, "data", map[string]string{"directive": d.Directive, "message_id": d.MessageID})
+		err = transport.SendData(msg)
+		end()
 		if err != nil {
 			log.Debug(err)
+			lasterror.Set(lasterror.Transport, err)
+		}
+		if published != nil {
+			published(d, err)
+		}
+	}
+}
+
+func PublishEvents(transport Transport, c <-chan yggdrasil.Event) {
+	for e := range c {
+		err := transport.SendControl(e)
+		if err != nil {
+			log.Errorf("cannot publish event %v: %v", e.MessageID, err)
+			lasterror.Set(lasterror.Transport, err)
+			continue
 		}
+		log.Debugf("published event %v: %v", e.MessageID, e.Content)
 	}
 }
@@ -1,12 +1,28 @@
 package transport
 
 import (
+	"errors"
+
 	"github.com/redhatinsights/yggdrasil"
 )
 
+// ErrNotAuthorized is wrapped by the errors of transports whose server
+// rejected the credentials of the client, when the protocol of the transport
+// has no error value of its own for it.
+var ErrNotAuthorized = errors.New("not authorized")
+
 type CommandHandler func(command []byte, t Transport)
 type DataHandler func(data []byte)
 
+// A TopicHandler is called with the payload of a message received on a topic
+// subscribed to with a Subscriber. Handlers are called in the order messages
+// arrive and must not block for long.
+type TopicHandler func(topic string, data []byte)
+
+// A StatusFunc returns the dispatchers map and worker details to include in
+// connection-status messages.
+type StatusFunc func() (map[string]map[string]string, map[string]yggdrasil.WorkerInfo)
+
 type Transport interface {
 	Start() error
 	SendData(data yggdrasil.Data) error
@@ -14,3 +30,23 @@ type Transport interface {
 	Disconnect(quiesce uint)
 }
 
+// A BrokerSetter is a Transport whose list of brokers can be changed at
+// runtime. The transport must be disconnected before, and started again after,
+// calling SetBrokers.
+type BrokerSetter interface {
+	SetBrokers(brokers []string) error
+	Brokers() []string
+}
+
+// A Waker is a Transport that polls the server at intervals, and can be asked
+// to poll it now instead.
+type Waker interface {
+	Wake()
+}
+
+// A Subscriber is a Transport that can subscribe to arbitrary topics beyond
+// the standard control and data topics.
+type Subscriber interface {
+	Subscribe(topic string, handler TopicHandler) error
+	Unsubscribe(topic string) error
+}
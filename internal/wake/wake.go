@@ -0,0 +1,114 @@
+// Package wake delivers out-of-band signals, such as an SMS received by a
+// modem, a GPIO line raised or a LoRa downlink, asking a mostly offline
+// client to connect and poll the server now rather than at its next interval.
+package wake
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A Trigger watches a source of wake signals.
+type Trigger interface {
+	// Watch calls wake with the reason of each signal, the line the source
+	// sent, until the source fails or ends.
+	Watch(wake func(reason string)) error
+
+	// String names the source of the signals.
+	String() string
+}
+
+// A FIFO is a Trigger reading signals, one per line, from a named pipe that
+// a modem, GPIO or LoRa daemon writes to.
+type FIFO struct {
+	Path string
+}
+
+// Watch reads signals from the named pipe, opening it again each time all its
+// writers have closed it.
+func (f *FIFO) Watch(wake func(reason string)) error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return fmt.Errorf("cannot stat wake pipe: %w", err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("cannot watch %v: not a named pipe", f.Path)
+	}
+	for {
+		// Opening a named pipe for reading blocks until a writer opens it.
+		file, err := os.Open(f.Path)
+		if err != nil {
+			return fmt.Errorf("cannot open wake pipe: %w", err)
+		}
+		err = scan(file, wake)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *FIFO) String() string {
+	return "pipe " + f.Path
+}
+
+// A Command is a Trigger running a program, such as one polling a modem or a
+// GPIO line, that writes a line to its standard output for each signal.
+type Command struct {
+	Path string
+	Args []string
+}
+
+// ParseCommand returns the Command running the program and arguments of the
+// space-separated command line.
+func ParseCommand(commandLine string) (*Command, error) {
+	fields := strings.Fields(commandLine)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty wake command")
+	}
+	return &Command{Path: fields[0], Args: fields[1:]}, nil
+}
+
+// Watch runs the program and reads signals from its output until it exits.
+func (c *Command) Watch(wake func(reason string)) error {
+	cmd := exec.Command(c.Path, c.Args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cannot create pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start wake command: %w", err)
+	}
+	if err := scan(stdout, wake); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("wake command failed: %w", err)
+	}
+	return fmt.Errorf("wake command exited")
+}
+
+func (c *Command) String() string {
+	return "command " + c.Path
+}
+
+// scan calls wake with each non-empty line read from r until it ends.
+func scan(r io.Reader, wake func(reason string)) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			wake(line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("cannot read wake signal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package wake
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommand(t *testing.T) {
+	c := &Command{Path: "sh", Args: []string{"-c", "printf 'sms\\n\\n  gpio \\n'"}}
+
+	var got []string
+	err := c.Watch(func(reason string) { got = append(got, reason) })
+	if err == nil {
+		t.Error("expected error once the command exited")
+	}
+	want := []string{"sms", "gpio"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v", cmp.Diff(got, want))
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        *Command
+		wantError   bool
+	}{
+		{
+			description: "program",
+			input:       "/usr/libexec/sms-wake",
+			want:        &Command{Path: "/usr/libexec/sms-wake", Args: []string{}},
+		},
+		{
+			description: "arguments",
+			input:       "gpio-wake --line  17",
+			want:        &Command{Path: "gpio-wake", Args: []string{"--line", "17"}},
+		},
+		{
+			description: "empty",
+			input:       "  ",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := ParseCommand(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestFIFONotNamedPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-wake-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wake")
+	if err := ioutil.WriteFile(path, []byte("sms\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &FIFO{Path: path}
+	if err := f.Watch(func(string) { t.Error("woken by a regular file") }); err == nil {
+		t.Error("expected error watching a regular file")
+	}
+}
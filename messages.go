@@ -14,6 +14,8 @@ const (
 	MessageTypeCommand          MessageType = "command"
 	MessageTypeEvent            MessageType = "event"
 	MessageTypeData             MessageType = "data"
+	MessageTypeCapabilities     MessageType = "capabilities"
+	MessageTypeWorkerConfig     MessageType = "worker-config"
 )
 
 // ConnectionState represents accepted values for the "state" field of
@@ -41,8 +43,62 @@ const (
 	// CommandNamePing instructs a client to respond with a "pong" event.
 	CommandNamePing CommandName = "ping"
 
-	// CommandNameDisconnect instructs a client to permanently disconnect.
+	// CommandNameDisconnect instructs a client to permanently disconnect. The
+	// optional "mode" argument is "soft", to only disconnect the transport,
+	// "drain", to wait up to "timeout" for the messages in flight to be
+	// handled first, or "halt", to also stop the workers.
 	CommandNameDisconnect CommandName = "disconnect"
+
+	// CommandNameEchoTest instructs a client to send a test message through
+	// a worker and respond with an "echo-test" event.
+	CommandNameEchoTest CommandName = "echo-test"
+
+	// CommandNameSetEnv instructs a client to set the variable "name" to
+	// "value" for the worker handling "directive". An empty value removes
+	// the variable.
+	CommandNameSetEnv CommandName = "set-env"
+
+	// CommandNameLogLevel instructs a client to change its log level, and that
+	// of its workers, to "level". If "subsystem" is set, only the level of that
+	// subsystem of the client is changed; a "level" of "default" then makes
+	// the subsystem log at the client's level again.
+	CommandNameLogLevel CommandName = "log-level"
+
+	// CommandNameSetBrokers instructs a client to connect to the brokers in
+	// the comma-separated list of URIs "brokers" from then on, in place of
+	// its configured brokers. If it cannot connect to them, it reconnects to
+	// its previous brokers.
+	CommandNameSetBrokers CommandName = "set-brokers"
+
+	// CommandNameCancel instructs a client to abort the processing of the data
+	// message identified by "message_id".
+	CommandNameCancel CommandName = "cancel"
+
+	// CommandNameDumpLogs instructs a client to post the recent log messages
+	// it keeps in memory, at every level, to the URL "url", as a Zstandard
+	// stream.
+	CommandNameDumpLogs CommandName = "dump-logs"
+
+	// CommandNameSetTags instructs a client to replace the tags assigned by
+	// the server with its arguments, each naming a tag and its value. Locally
+	// configured tags take precedence over server-assigned tags, which take
+	// precedence over the tags derived by workers.
+	CommandNameSetTags CommandName = "set-tags"
+
+	// CommandNameUpdate instructs a client to update itself with the
+	// "method" argument: "binary" downloads the executable at "url", which
+	// must match "checksum" and the Ed25519 "signature", while "dnf" and
+	// "rpm-ostree" update the package with the system package manager. The
+	// optional "restart" argument is "exec", to re-execute the client once
+	// updated, "schedule", to have the service manager restart it after
+	// "delay", or "none".
+	CommandNameUpdate CommandName = "update"
+
+	// CommandNameFetchFiles instructs a client to upload, through the data
+	// plane, an archive of the files matching the comma-separated absolute
+	// paths or patterns of the "paths" argument, as far as its local policy
+	// allows them to be fetched, redacted.
+	CommandNameFetchFiles CommandName = "fetch-files"
 )
 
 // EventName represents accepted values for the "event" field of an Event
@@ -51,29 +107,211 @@ type EventName string
 
 const (
 	// EventNameDisconnect informs the server that the client will disconnect.
+	// In response to a "disconnect" command, its details hold the "mode" of
+	// the command and, for the "drain" mode, the number of messages still
+	// "pending".
 	EventNameDisconnect EventName = "disconnect"
 
 	// EventNamePong informs the server that the client has received a "ping"
 	// command.
 	EventNamePong EventName = "pong"
+
+	// EventNameDeliveryFailed informs the server that a data message could not
+	// be delivered to a worker after exhausting all delivery attempts.
+	EventNameDeliveryFailed EventName = "delivery-failed"
+
+	// EventNameCoalesced informs the server that a data message was not
+	// delivered because a newer message for the same directive superseded it.
+	EventNameCoalesced EventName = "coalesced"
+
+	// EventNameEchoTest reports the result and per-stage latencies of an
+	// "echo-test" command.
+	EventNameEchoTest EventName = "echo-test"
+
+	// EventNameCancelled informs the server that the processing of a data
+	// message was aborted in response to a "cancel" command.
+	EventNameCancelled EventName = "cancelled"
+
+	// EventNameCancelFailed informs the server that a "cancel" command could
+	// not be carried out.
+	EventNameCancelFailed EventName = "cancel-failed"
+
+	// EventNameUploadFailed informs the server that the file offloaded from a
+	// data message could not be uploaded after exhausting all attempts.
+	EventNameUploadFailed EventName = "upload-failed"
+
+	// EventNameConfigApplied informs the server that a "worker-config"
+	// message was persisted and, if the worker is running, accepted by it.
+	EventNameConfigApplied EventName = "config-applied"
+
+	// EventNameConfigRejected informs the server that a "worker-config"
+	// message was invalid or rejected by the worker. The previous
+	// configuration remains in effect.
+	EventNameConfigRejected EventName = "config-rejected"
+
+	// EventNameClientIDConflict informs the server that another client
+	// announced its presence using the same client ID. The "instance" and
+	// "sent" details identify the presence of the other client.
+	EventNameClientIDConflict EventName = "client-id-conflict"
+
+	// EventNameSessionTakeovers informs the server that the client kept
+	// losing its session shortly after connecting, as happens when another
+	// client takes it over with the same client ID, and now waits before
+	// reconnecting. The "takeovers" and "reconnect_delay" details hold the
+	// number of short sessions and the delay.
+	EventNameSessionTakeovers EventName = "session-takeovers"
+
+	// EventNameSpoolEvicted informs the server that messages were evicted
+	// from, or rejected by, the full offline spool while the client was
+	// disconnected. Its details hold the number of messages lost per class.
+	EventNameSpoolEvicted EventName = "spool-evicted"
+
+	// EventNameContentInvalid informs the server that a data message was
+	// rejected because its content does not match the schema of its
+	// directive. The "error" detail lists the violations.
+	EventNameContentInvalid EventName = "content-invalid"
+
+	// EventNameDeadlineExceeded informs the server that a data message was
+	// not handled before its deadline, and was dropped or cancelled.
+	EventNameDeadlineExceeded EventName = "deadline-exceeded"
+
+	// EventNameTempQuotaExceeded informs the server that the temporary
+	// directory of a data message was emptied for growing beyond its quota.
+	// Its details hold the "directive", the "size" of the directory and the
+	// "quota", in bytes.
+	EventNameTempQuotaExceeded EventName = "temp-quota-exceeded"
+
+	// EventNameSignatureInvalid informs the server that a message received
+	// on the "channel" in its details was dropped for not being signed with
+	// a trusted key, with the reason in its details.
+	EventNameSignatureInvalid EventName = "signature-invalid"
+
+	// EventNameLogsDumped informs the server that the logs requested with a
+	// "dump-logs" command were posted to the URL in its details.
+	EventNameLogsDumped EventName = "logs-dumped"
+
+	// EventNameLogsDumpFailed informs the server that a "dump-logs" command
+	// failed, with the reason in its details.
+	EventNameLogsDumpFailed EventName = "logs-dump-failed"
+
+	// EventNameBroadcastCompleted informs the server that a broadcast
+	// message was delivered to, or failed for, every registered worker, with
+	// the result of each worker in its details.
+	EventNameBroadcastCompleted EventName = "broadcast-completed"
+
+	// EventNameMessageState informs the server that the delivery state of a
+	// data message it sent changed, with the new MessageState in its details.
+	EventNameMessageState EventName = "message-state"
+
+	// EventNameUpdateProgress informs the server that an "update" command
+	// reached the "stage" in its details.
+	EventNameUpdateProgress EventName = "update-progress"
+
+	// EventNameUpdated informs the server that an "update" command installed
+	// the "version" in its details, and how the client restarts.
+	EventNameUpdated EventName = "updated"
+
+	// EventNameUpdateFailed informs the server that an "update" command
+	// failed at the "stage" in its details, with the reason.
+	EventNameUpdateFailed EventName = "update-failed"
+
+	// EventNameWorkerExited informs the server that a worker exited
+	// unexpectedly, with the "class" of the exit, the exit "status", and
+	// whether the worker is restarted and the exit raises an "alert" in its
+	// details.
+	EventNameWorkerExited EventName = "worker-exited"
+
+	// EventNameFilesFetched informs the server that a "fetch-files" command
+	// uploaded the "files" allowed to the "url" in its details, and lists
+	// those "denied".
+	EventNameFilesFetched EventName = "files-fetched"
+
+	// EventNameFileFetchFailed informs the server that a "fetch-files"
+	// command failed, with the reason.
+	EventNameFileFetchFailed EventName = "file-fetch-failed"
+)
+
+// MessageState represents the delivery state of a data message received by
+// the client.
+type MessageState string
+
+const (
+	// MessageStateAccepted indicates that a message was queued for
+	// dispatch.
+	MessageStateAccepted MessageState = "accepted"
+
+	// MessageStateDelivered indicates that a message was delivered to the
+	// worker handling its directive.
+	MessageStateDelivered MessageState = "delivered"
+
+	// MessageStateResponded indicates that the worker sent a message in
+	// response to a message.
+	MessageStateResponded MessageState = "responded"
+
+	// MessageStateFailed indicates that a message could not be delivered.
+	MessageStateFailed MessageState = "failed"
 )
 
+// DirectiveBroadcast is the directive of a data message to be delivered to
+// every registered worker.
+const DirectiveBroadcast = "*"
+
 // A ConnectionStatus message is published by the client when it connects to
 // the broker. The message is expected to be published as a retained message
 // and its presence is considered an acceptable way to decide whether a client
 // is active and functioning normally.
 type ConnectionStatus struct {
-	Type       MessageType `json:"type"`
-	MessageID  string      `json:"message_id"`
-	ResponseTo string      `json:"response_to"`
-	Version    int         `json:"version"`
-	Sent       time.Time   `json:"sent"`
-	Content    struct {
-		CanonicalFacts CanonicalFacts               `json:"canonical_facts"`
-		Dispatchers    map[string]map[string]string `json:"dispatchers"`
-		State          ConnectionState              `json:"state"`
-		Tags           map[string]string            `json:"tags,omitempty"`
-	} `json:"content"`
+	Type       MessageType             `json:"type"`
+	MessageID  string                  `json:"message_id"`
+	ResponseTo string                  `json:"response_to"`
+	Version    int                     `json:"version"`
+	Sent       time.Time               `json:"sent"`
+	Content    ConnectionStatusContent `json:"content"`
+}
+
+// ConnectionStatusContent is the content of a ConnectionStatus message.
+type ConnectionStatusContent struct {
+	CanonicalFacts CanonicalFacts               `json:"canonical_facts"`
+	Dispatchers    map[string]map[string]string `json:"dispatchers"`
+	State          ConnectionState              `json:"state"`
+	Tags           map[string]string            `json:"tags,omitempty"`
+	Workers        map[string]WorkerInfo        `json:"workers,omitempty"`
+	Facts          map[string]interface{}       `json:"facts,omitempty"`
+	Errors         map[string]SubsystemError    `json:"errors,omitempty"`
+	Build          *BuildInfo                   `json:"build,omitempty"`
+
+	// Encodings lists the message and content encodings, besides JSON, the
+	// client accepts.
+	Encodings []string `json:"encodings,omitempty"`
+
+	// PayloadRecipient is the age public key of the client, to which the
+	// server encrypts the content of the data messages it sends, if payload
+	// encryption is enabled.
+	PayloadRecipient string `json:"payload_recipient,omitempty"`
+}
+
+// A SubsystemError is the most recent error of a subsystem of the client, keyed
+// by subsystem name in the "errors" field of a ConnectionStatus message.
+type SubsystemError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	Count   int       `json:"count"`
+}
+
+// WorkerInfo describes a worker registered with the dispatcher, keyed by the
+// directive it handles in the "workers" field of a ConnectionStatus message.
+// The PID of a worker running in a virtual machine is its PID in the guest,
+// whose VM socket context ID is VsockCID.
+type WorkerInfo struct {
+	Version         string   `json:"version,omitempty"`
+	ManifestVersion string   `json:"manifest_version,omitempty"`
+	PID             int      `json:"pid"`
+	VsockCID        uint32   `json:"vsock_cid,omitempty"`
+	DetachedContent bool     `json:"detached_content"`
+	Ordered         bool     `json:"ordered"`
+	Coalesce        bool     `json:"coalesce"`
+	Topics          []string `json:"topics,omitempty"`
+	Paused          bool     `json:"paused,omitempty"`
 }
 
 // A Command message is published by the server on the "control" topic when it
@@ -88,6 +326,10 @@ type Command struct {
 		Command   CommandName       `json:"command"`
 		Arguments map[string]string `json:"arguments"`
 	} `json:"content"`
+
+	// OperationGroup optionally identifies the fleet-wide operation the
+	// command is part of.
+	OperationGroup string `json:"operation_group,omitempty"`
 }
 
 // An Event message is published by the client on the "control" topic when it
@@ -99,6 +341,63 @@ type Event struct {
 	Version    int         `json:"version"`
 	Sent       time.Time   `json:"sent"`
 	Content    string      `json:"content"`
+
+	// Details optionally carries structured information about the event.
+	Details map[string]string `json:"details,omitempty"`
+
+	// OperationGroup is the operation group of the message the event
+	// responds to, if any.
+	OperationGroup string `json:"operation_group,omitempty"`
+}
+
+// A Capabilities message is published by the server to describe what it
+// supports. MQTT servers publish it as a retained message on the "control"
+// topic; HTTP servers return it when the client connects.
+type Capabilities struct {
+	Type       MessageType         `json:"type"`
+	MessageID  string              `json:"message_id"`
+	ResponseTo string              `json:"response_to"`
+	Version    int                 `json:"version"`
+	Sent       time.Time           `json:"sent"`
+	Content    CapabilitiesContent `json:"content"`
+}
+
+// CapabilitiesContent is the content of a Capabilities message. Zero values
+// indicate the server does not state a limit or restriction.
+type CapabilitiesContent struct {
+	// MaxPayloadSize is the largest message, in bytes, the server accepts.
+	MaxPayloadSize int `json:"max_payload_size,omitempty"`
+
+	// Encodings is a list of content encodings the server accepts.
+	Encodings []string `json:"encodings,omitempty"`
+
+	// Commands is a list of commands the server may send.
+	Commands []CommandName `json:"commands,omitempty"`
+}
+
+// SupportsEncoding reports whether the server accepts encoding. A server that
+// does not list its encodings is assumed to accept none beyond plain JSON.
+func (c CapabilitiesContent) SupportsEncoding(encoding string) bool {
+	for _, e := range c.Encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsCommand reports whether the server may send command. A server that
+// does not list its commands is assumed to support all of them.
+func (c CapabilitiesContent) SupportsCommand(command CommandName) bool {
+	if len(c.Commands) == 0 {
+		return true
+	}
+	for _, cmd := range c.Commands {
+		if cmd == command {
+			return true
+		}
+	}
+	return false
 }
 
 // Data messages are published by both client and server on their respective
@@ -113,4 +412,138 @@ type Data struct {
 	Directive  string            `json:"directive"`
 	Metadata   map[string]string `json:"metadata"`
 	Content    json.RawMessage   `json:"content"`
+
+	// OperationGroup optionally identifies the fleet-wide operation the
+	// message is part of. It is preserved on responses to the message.
+	OperationGroup string `json:"operation_group,omitempty"`
+}
+
+// A WorkerConfig message is published by the server on the "data" topic to
+// configure the worker handling "Directive". Unlike data, which the worker
+// acts upon, configuration is persisted by the client and remains in effect
+// across restarts until replaced. The content must be a JSON object.
+type WorkerConfig struct {
+	Type       MessageType     `json:"type"`
+	MessageID  string          `json:"message_id"`
+	ResponseTo string          `json:"response_to"`
+	Version    int             `json:"version"`
+	Sent       time.Time       `json:"sent"`
+	Directive  string          `json:"directive"`
+	Content    json.RawMessage `json:"content"`
 }
+
+// Metadata keys set by the dispatcher on Data messages.
+const (
+	// MetadataKeyOrdering is set to "strict" on messages exchanged with a
+	// worker that requires in-order delivery.
+	MetadataKeyOrdering = "ordering"
+
+	// MetadataKeySequence is set to a per-directive, monotonically increasing
+	// sequence number on messages exchanged with a worker that requires
+	// in-order delivery.
+	MetadataKeySequence = "sequence"
+
+	// MetadataKeyTopic is set to the name of the topic a message was received
+	// on when it did not arrive on one of the standard data topics.
+	MetadataKeyTopic = "topic"
+
+	// MetadataKeyEnvPrefix prefixes the name of each variable set for the
+	// message's directive with a "set-env" command.
+	MetadataKeyEnvPrefix = "env."
+
+	// MetadataKeyOperationGroup is set to the operation group of a message,
+	// if any. A worker sets it on the messages it sends to place them in an
+	// operation group; responses otherwise inherit the group of the message
+	// they respond to.
+	MetadataKeyOperationGroup = "operation_group"
+
+	// MetadataKeyContentReference is set to "true" by the server on messages
+	// whose content is a ContentReference rather than the payload itself.
+	MetadataKeyContentReference = "content-reference"
+
+	// MetadataKeyContentPath is set to the path of the downloaded payload of a
+	// content reference on messages sent to workers that registered to
+	// receive local content. The content of such messages is empty.
+	//
+	// Conversely, a worker sets it on a message it sends to offload a large
+	// payload: the dispatcher uploads the file and publishes the message with
+	// a content reference in its place. The file must be a regular file
+	// owned by the worker, directly in its WorkerUploadDir.
+	MetadataKeyContentPath = "content-path"
+
+	// MetadataKeyContentEncoding is set to "gzip" or "zstd" on messages
+	// whose content is the payload compressed with that algorithm, encoded
+	// as a base64 JSON string. Content is compressed and decompressed by the
+	// client; workers never see it set.
+	MetadataKeyContentEncoding = "content-encoding"
+
+	// MetadataKeyContentEncryption is set to "age" on messages whose content
+	// is the payload encrypted with age, encoded as a base64 JSON string.
+	// Encrypted content may be compressed, in which case it is decrypted
+	// before it is decompressed. Like compression, encryption is handled by
+	// the client; workers never see it set.
+	MetadataKeyContentEncryption = "content-encryption"
+
+	// MetadataKeyTempDir is set to the path of a temporary directory, private
+	// to the message, on messages sent to workers if temporary directories
+	// are enabled. The directory and its content are removed once the
+	// response to the message is published, and emptied if they grow beyond
+	// their quota.
+	MetadataKeyTempDir = "temp-dir"
+
+	// MetadataKeyClass is set by a worker on the messages it sends to name
+	// their class, such as "results" or "telemetry", which determines the
+	// messages evicted first from the offline spool when it is full.
+	MetadataKeyClass = "class"
+
+	// MetadataKeyDeadline is set by the server to the time, in RFC 3339
+	// format, by which a message must be handled. The dispatcher gives up
+	// fetching content for and delivering a message past its deadline, and
+	// asks the worker to cancel it if it is still in flight by then. It is
+	// passed on to the worker, whose gRPC call also carries the deadline.
+	MetadataKeyDeadline = "deadline"
+
+	// MetadataKeyRoutedFrom is set to the directive of a message dispatched
+	// to a worker by a routing rule, or by broadcast, rather than to the
+	// worker registered for its directive.
+	MetadataKeyRoutedFrom = "routed-from"
+
+	// MetadataKeyNotBefore is set by the server to the time, in RFC 3339
+	// format, before which a message must not be dispatched to its worker.
+	// The dispatcher holds the message until then, across restarts.
+	MetadataKeyNotBefore = "not-before"
+
+	// MetadataKeyWindow is set by the server to a daily window of local
+	// time, in the form "HH:MM-HH:MM", outside of which a message must not
+	// be dispatched to its worker. The dispatcher holds the message until
+	// the window opens, and outside the blackout windows configured on the
+	// client.
+	MetadataKeyWindow = "window"
+
+	// MetadataKeyPriority is set by the server to PriorityHigh or PriorityLow
+	// on data messages dispatched ahead of, or after, those of normal
+	// priority waiting to be dispatched.
+	MetadataKeyPriority = "priority"
+)
+
+// Values of the MetadataKeyPriority metadata. Messages without it have normal
+// priority.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// A ContentReference is the content of a data message whose payload is too
+// large to be carried by the message itself. The dispatcher downloads the
+// payload from URL and verifies it against Checksum, in the form
+// "sha256:<hex digest>", before handing it to the worker.
+type ContentReference struct {
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// OrderingStrict is the value of the MetadataKeyOrdering metadata key for
+// messages that are delivered in order.
+const OrderingStrict = "strict"
@@ -23,6 +23,35 @@ type DispatcherClient interface {
 	Register(ctx context.Context, in *RegistrationRequest, opts ...grpc.CallOption) (*RegistrationResponse, error)
 	// Send is called by a worker to send data to the dispatcher.
 	Send(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Receipt, error)
+	// EchoTest is called to send a test message to the worker handling a
+	// directive, wait for its response to be published, and report the
+	// latency of each stage.
+	EchoTest(ctx context.Context, in *DirectiveRequest, opts ...grpc.CallOption) (*EchoTestResponse, error)
+	// UpdateFeatures is called by a registered worker to replace the set of
+	// features it announced during registration.
+	UpdateFeatures(ctx context.Context, in *UpdateFeaturesRequest, opts ...grpc.CallOption) (*Empty, error)
+	// GetFacts is called by a worker to retrieve the canonical facts and
+	// additional facts the dispatcher publishes.
+	GetFacts(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*FactsResponse, error)
+	// GetTags is called by a worker to retrieve the tags the dispatcher
+	// publishes.
+	GetTags(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*TagsResponse, error)
+	// Attach is called by a local product, not started by the dispatcher, to
+	// share the dispatcher's connection: it handles the directives of its
+	// namespace, in the form "NAMESPACE/NAME", and publishes through the
+	// dispatcher within the quota of its namespace.
+	Attach(ctx context.Context, in *AttachRequest, opts ...grpc.CallOption) (*RegistrationResponse, error)
+	// Grant is called by yggctl to temporarily allow the dispatch of a
+	// restricted directive with a signed grant.
+	Grant(ctx context.Context, in *GrantRequest, opts ...grpc.CallOption) (*Empty, error)
+	// SetTags is called by a registered worker to replace the tags it
+	// derives, which the dispatcher publishes with a lower precedence than
+	// locally configured and server-assigned tags.
+	SetTags(ctx context.Context, in *SetTagsRequest, opts ...grpc.CallOption) (*Empty, error)
+	// GetCredential is called by a registered worker to get a short-lived
+	// credential its manifest allows: a secret held by the dispatcher, or a
+	// token signed with the device identity.
+	GetCredential(ctx context.Context, in *CredentialRequest, opts ...grpc.CallOption) (*CredentialResponse, error)
 }
 
 type dispatcherClient struct {
@@ -51,6 +80,78 @@ func (c *dispatcherClient) Send(ctx context.Context, in *Data, opts ...grpc.Call
 	return out, nil
 }
 
+func (c *dispatcherClient) EchoTest(ctx context.Context, in *DirectiveRequest, opts ...grpc.CallOption) (*EchoTestResponse, error) {
+	out := new(EchoTestResponse)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/EchoTest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) UpdateFeatures(ctx context.Context, in *UpdateFeaturesRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/UpdateFeatures", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) GetFacts(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*FactsResponse, error) {
+	out := new(FactsResponse)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/GetFacts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) GetTags(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*TagsResponse, error) {
+	out := new(TagsResponse)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/GetTags", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) Attach(ctx context.Context, in *AttachRequest, opts ...grpc.CallOption) (*RegistrationResponse, error) {
+	out := new(RegistrationResponse)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/Attach", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) Grant(ctx context.Context, in *GrantRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/Grant", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) SetTags(ctx context.Context, in *SetTagsRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/SetTags", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) GetCredential(ctx context.Context, in *CredentialRequest, opts ...grpc.CallOption) (*CredentialResponse, error) {
+	out := new(CredentialResponse)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/GetCredential", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DispatcherServer is the server API for Dispatcher service.
 // All implementations must embed UnimplementedDispatcherServer
 // for forward compatibility
@@ -60,6 +161,35 @@ type DispatcherServer interface {
 	Register(context.Context, *RegistrationRequest) (*RegistrationResponse, error)
 	// Send is called by a worker to send data to the dispatcher.
 	Send(context.Context, *Data) (*Receipt, error)
+	// EchoTest is called to send a test message to the worker handling a
+	// directive, wait for its response to be published, and report the
+	// latency of each stage.
+	EchoTest(context.Context, *DirectiveRequest) (*EchoTestResponse, error)
+	// UpdateFeatures is called by a registered worker to replace the set of
+	// features it announced during registration.
+	UpdateFeatures(context.Context, *UpdateFeaturesRequest) (*Empty, error)
+	// GetFacts is called by a worker to retrieve the canonical facts and
+	// additional facts the dispatcher publishes.
+	GetFacts(context.Context, *Empty) (*FactsResponse, error)
+	// GetTags is called by a worker to retrieve the tags the dispatcher
+	// publishes.
+	GetTags(context.Context, *Empty) (*TagsResponse, error)
+	// Attach is called by a local product, not started by the dispatcher, to
+	// share the dispatcher's connection: it handles the directives of its
+	// namespace, in the form "NAMESPACE/NAME", and publishes through the
+	// dispatcher within the quota of its namespace.
+	Attach(context.Context, *AttachRequest) (*RegistrationResponse, error)
+	// Grant is called by yggctl to temporarily allow the dispatch of a
+	// restricted directive with a signed grant.
+	Grant(context.Context, *GrantRequest) (*Empty, error)
+	// SetTags is called by a registered worker to replace the tags it
+	// derives, which the dispatcher publishes with a lower precedence than
+	// locally configured and server-assigned tags.
+	SetTags(context.Context, *SetTagsRequest) (*Empty, error)
+	// GetCredential is called by a registered worker to get a short-lived
+	// credential its manifest allows: a secret held by the dispatcher, or a
+	// token signed with the device identity.
+	GetCredential(context.Context, *CredentialRequest) (*CredentialResponse, error)
 	mustEmbedUnimplementedDispatcherServer()
 }
 
@@ -73,6 +203,30 @@ func (UnimplementedDispatcherServer) Register(context.Context, *RegistrationRequ
 func (UnimplementedDispatcherServer) Send(context.Context, *Data) (*Receipt, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
 }
+func (UnimplementedDispatcherServer) EchoTest(context.Context, *DirectiveRequest) (*EchoTestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EchoTest not implemented")
+}
+func (UnimplementedDispatcherServer) UpdateFeatures(context.Context, *UpdateFeaturesRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFeatures not implemented")
+}
+func (UnimplementedDispatcherServer) GetFacts(context.Context, *Empty) (*FactsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFacts not implemented")
+}
+func (UnimplementedDispatcherServer) GetTags(context.Context, *Empty) (*TagsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTags not implemented")
+}
+func (UnimplementedDispatcherServer) Attach(context.Context, *AttachRequest) (*RegistrationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Attach not implemented")
+}
+func (UnimplementedDispatcherServer) Grant(context.Context, *GrantRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Grant not implemented")
+}
+func (UnimplementedDispatcherServer) SetTags(context.Context, *SetTagsRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetTags not implemented")
+}
+func (UnimplementedDispatcherServer) GetCredential(context.Context, *CredentialRequest) (*CredentialResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCredential not implemented")
+}
 func (UnimplementedDispatcherServer) mustEmbedUnimplementedDispatcherServer() {}
 
 // UnsafeDispatcherServer may be embedded to opt out of forward compatibility for this service.
@@ -122,6 +276,150 @@ func _Dispatcher_Send_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Dispatcher_EchoTest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DirectiveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).EchoTest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/EchoTest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).EchoTest(ctx, req.(*DirectiveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_UpdateFeatures_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateFeaturesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).UpdateFeatures(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/UpdateFeatures",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).UpdateFeatures(ctx, req.(*UpdateFeaturesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_GetFacts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).GetFacts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/GetFacts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).GetFacts(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_GetTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).GetTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/GetTags",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).GetTags(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_Attach_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AttachRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).Attach(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/Attach",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).Attach(ctx, req.(*AttachRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_Grant_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GrantRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).Grant(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/Grant",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).Grant(ctx, req.(*GrantRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_SetTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetTagsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).SetTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/SetTags",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).SetTags(ctx, req.(*SetTagsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_GetCredential_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CredentialRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).GetCredential(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/GetCredential",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).GetCredential(ctx, req.(*CredentialRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Dispatcher_ServiceDesc is the grpc.ServiceDesc for Dispatcher service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -137,9 +435,41 @@ var Dispatcher_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Send",
 			Handler:    _Dispatcher_Send_Handler,
 		},
+		{
+			MethodName: "EchoTest",
+			Handler:    _Dispatcher_EchoTest_Handler,
+		},
+		{
+			MethodName: "UpdateFeatures",
+			Handler:    _Dispatcher_UpdateFeatures_Handler,
+		},
+		{
+			MethodName: "GetFacts",
+			Handler:    _Dispatcher_GetFacts_Handler,
+		},
+		{
+			MethodName: "GetTags",
+			Handler:    _Dispatcher_GetTags_Handler,
+		},
+		{
+			MethodName: "Attach",
+			Handler:    _Dispatcher_Attach_Handler,
+		},
+		{
+			MethodName: "Grant",
+			Handler:    _Dispatcher_Grant_Handler,
+		},
+		{
+			MethodName: "SetTags",
+			Handler:    _Dispatcher_SetTags_Handler,
+		},
+		{
+			MethodName: "GetCredential",
+			Handler:    _Dispatcher_GetCredential_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
-	Metadata: "protocol/yggdrasil.proto",
+	Metadata: "yggdrasil.proto",
 }
 
 // WorkerClient is the client API for Worker service.
@@ -150,6 +480,15 @@ type WorkerClient interface {
 	Send(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Receipt, error)
 	// Disconnect is called by an operator to handle device deregistration gracefully
 	Disconnect(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*DisconnectResponse, error)
+	// SetLogLevel is called by the dispatcher to change the log level of a
+	// worker at runtime.
+	SetLogLevel(ctx context.Context, in *LogLevelRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Cancel is called by the dispatcher to abort the processing of a
+	// message previously sent to the worker.
+	Cancel(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Configure is called by the dispatcher to deliver configuration the
+	// server pushed for the worker.
+	Configure(ctx context.Context, in *ConfigureRequest, opts ...grpc.CallOption) (*Empty, error)
 }
 
 type workerClient struct {
@@ -178,6 +517,33 @@ func (c *workerClient) Disconnect(ctx context.Context, in *Empty, opts ...grpc.C
 	return out, nil
 }
 
+func (c *workerClient) SetLogLevel(ctx context.Context, in *LogLevelRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Worker/SetLogLevel", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) Cancel(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Worker/Cancel", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) Configure(ctx context.Context, in *ConfigureRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Worker/Configure", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // WorkerServer is the server API for Worker service.
 // All implementations must embed UnimplementedWorkerServer
 // for forward compatibility
@@ -186,6 +552,15 @@ type WorkerServer interface {
 	Send(context.Context, *Data) (*Receipt, error)
 	// Disconnect is called by an operator to handle device deregistration gracefully
 	Disconnect(context.Context, *Empty) (*DisconnectResponse, error)
+	// SetLogLevel is called by the dispatcher to change the log level of a
+	// worker at runtime.
+	SetLogLevel(context.Context, *LogLevelRequest) (*Empty, error)
+	// Cancel is called by the dispatcher to abort the processing of a
+	// message previously sent to the worker.
+	Cancel(context.Context, *CancelRequest) (*Empty, error)
+	// Configure is called by the dispatcher to deliver configuration the
+	// server pushed for the worker.
+	Configure(context.Context, *ConfigureRequest) (*Empty, error)
 	mustEmbedUnimplementedWorkerServer()
 }
 
@@ -199,6 +574,15 @@ func (UnimplementedWorkerServer) Send(context.Context, *Data) (*Receipt, error)
 func (UnimplementedWorkerServer) Disconnect(context.Context, *Empty) (*DisconnectResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Disconnect not implemented")
 }
+func (UnimplementedWorkerServer) SetLogLevel(context.Context, *LogLevelRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetLogLevel not implemented")
+}
+func (UnimplementedWorkerServer) Cancel(context.Context, *CancelRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Cancel not implemented")
+}
+func (UnimplementedWorkerServer) Configure(context.Context, *ConfigureRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Configure not implemented")
+}
 func (UnimplementedWorkerServer) mustEmbedUnimplementedWorkerServer() {}
 
 // UnsafeWorkerServer may be embedded to opt out of forward compatibility for this service.
@@ -248,6 +632,60 @@ func _Worker_Disconnect_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Worker_SetLogLevel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LogLevelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).SetLogLevel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Worker/SetLogLevel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).SetLogLevel(ctx, req.(*LogLevelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_Cancel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).Cancel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Worker/Cancel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).Cancel(ctx, req.(*CancelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_Configure_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfigureRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).Configure(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Worker/Configure",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).Configure(ctx, req.(*ConfigureRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Worker_ServiceDesc is the grpc.ServiceDesc for Worker service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -263,7 +701,19 @@ var Worker_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Disconnect",
 			Handler:    _Worker_Disconnect_Handler,
 		},
+		{
+			MethodName: "SetLogLevel",
+			Handler:    _Worker_SetLogLevel_Handler,
+		},
+		{
+			MethodName: "Cancel",
+			Handler:    _Worker_Cancel_Handler,
+		},
+		{
+			MethodName: "Configure",
+			Handler:    _Worker_Configure_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
-	Metadata: "protocol/yggdrasil.proto",
+	Metadata: "yggdrasil.proto",
 }
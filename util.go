@@ -16,3 +16,27 @@ func ConfigPath() (string, error) {
 
 	return filePath, nil
 }
+
+// WorkerConfigPath returns the path of the file in which the configuration
+// pushed by the server for the worker handling directive is persisted.
+func WorkerConfigPath(directive string) string {
+	return filepath.Join(SysconfDir, LongName, "workers", directive, "config.json")
+}
+
+// WorkerUploadDir returns the path of the directory in which the worker
+// handling directive places the files it offloads to the dispatcher.
+func WorkerUploadDir(directive string) string {
+	return filepath.Join(LocalstateDir, LongName, "uploads", directive)
+}
+
+// FactsDirPath returns the path of the directory from which additional facts
+// published with the canonical facts are collected.
+func FactsDirPath() string {
+	return filepath.Join(SysconfDir, LongName, "facts.d")
+}
+
+// TagsFilePath returns the path of the file holding the tags published with
+// the canonical facts.
+func TagsFilePath() string {
+	return filepath.Join(SysconfDir, LongName, "tags.toml")
+}
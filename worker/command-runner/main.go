@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+
+	"git.sr.ht/~spc/go-log"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+func main() {
+	policyPath := filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "command-runner.toml")
+	p, err := loadPolicy(policyPath)
+	if err != nil {
+		log.Fatalf("cannot load policy: %v", err)
+	}
+	if len(p.AllowedInterpreters) == 0 {
+		log.Warnf("no allowed interpreters in %v; all commands will be rejected", policyPath)
+	}
+
+	a, err := openAuditLog(p.AuditLog)
+	if err != nil {
+		log.Fatalf("cannot open audit log: %v", err)
+	}
+	defer a.Close()
+
+	// Create a worker that handles the "command-runner" directive.
+	w := worker.NewWorker("command-runner", nil, func(w *worker.Worker, d *pb.Data) error {
+		return handle(w, d, p, a)
+	})
+	w.OnError = func(w *worker.Worker, d *pb.Data, err error) {
+		log.Error(err)
+	}
+
+	if err := w.Connect(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// policy controls which commands may be run and how.
+type policy struct {
+	// AllowedInterpreters is a list of absolute paths of the interpreters
+	// scripts may be run with.
+	AllowedInterpreters []string `toml:"allowed-interpreters"`
+
+	// User is the name of the user commands run as. If empty, commands run as
+	// the worker's user.
+	User string `toml:"user"`
+
+	// Timeout is the maximum time a command may run, as a duration string.
+	// Requests may ask for a shorter timeout, but never a longer one.
+	Timeout string `toml:"timeout"`
+
+	// AllowedEnv is a list of environment variable names a request may set.
+	// All other variables are removed from the command's environment.
+	AllowedEnv []string `toml:"allowed-env"`
+
+	// MaxOutput is the maximum number of bytes of combined standard output
+	// and standard error reported back. Additional output is discarded.
+	MaxOutput int `toml:"max-output"`
+
+	// AuditLog is the path of the file every request is recorded in.
+	AuditLog string `toml:"audit-log"`
+
+	timeout time.Duration
+}
+
+// loadPolicy reads a policy from file. A missing file yields a policy that
+// rejects all commands.
+func loadPolicy(file string) (*policy, error) {
+	p := policy{
+		Timeout:   "5m",
+		MaxOutput: 64 * 1024,
+		AuditLog:  filepath.Join(yggdrasil.LocalstateDir, "log", yggdrasil.LongName, "command-runner.log"),
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := toml.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("cannot parse policy: %w", err)
+		}
+	}
+
+	p.timeout, err = time.ParseDuration(p.Timeout)
+	if err != nil || p.timeout <= 0 {
+		return nil, fmt.Errorf("invalid timeout: %v", p.Timeout)
+	}
+
+	return &p, nil
+}
+
+// interpreterAllowed reports whether interpreter may be used to run scripts.
+func (p *policy) interpreterAllowed(interpreter string) bool {
+	for _, i := range p.AllowedInterpreters {
+		if i == interpreter {
+			return true
+		}
+	}
+	return false
+}
+
+// environ returns the environment of a command, keeping only the variables
+// in env the policy allows.
+func (p *policy) environ(env map[string]string) []string {
+	environ := []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+	for _, name := range p.AllowedEnv {
+		if value, ok := env[name]; ok {
+			environ = append(environ, name+"="+value)
+		}
+	}
+	return environ
+}
+
+// commandTimeout returns the timeout of a command requesting requested. A
+// requested timeout of 0 or greater than the policy's yields the policy's.
+func (p *policy) commandTimeout(requested time.Duration) time.Duration {
+	if requested <= 0 || requested > p.timeout {
+		return p.timeout
+	}
+	return requested
+}
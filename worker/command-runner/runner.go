@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+// command is the content of a data message sent to the worker.
+type command struct {
+	Interpreter string            `json:"interpreter"`
+	Script      string            `json:"script"`
+	Args        []string          `json:"args,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Timeout     string            `json:"timeout,omitempty"`
+}
+
+// result is the content of the data message sent back in response to a
+// command.
+type result struct {
+	Success   bool   `json:"success"`
+	ExitCode  int    `json:"exit_code"`
+	Output    string `json:"output"`
+	Truncated bool   `json:"truncated,omitempty"`
+	TimedOut  bool   `json:"timed_out,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// limitedBuffer is an io.Writer that keeps at most max bytes and discards the
+// rest.
+type limitedBuffer struct {
+	lock      sync.Mutex
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n := len(p)
+	if room := b.max - len(b.buf); n > room {
+		if room > 0 {
+			b.buf = append(b.buf, p[:room]...)
+		}
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return n, nil
+}
+
+// run runs cmd according to p.
+func run(cmd command, p *policy) result {
+	r := result{ExitCode: -1}
+
+	if !p.interpreterAllowed(cmd.Interpreter) {
+		r.Error = fmt.Sprintf("interpreter not allowed by policy: %v", cmd.Interpreter)
+		return r
+	}
+
+	var requested time.Duration
+	if cmd.Timeout != "" {
+		var err error
+		requested, err = time.ParseDuration(cmd.Timeout)
+		if err != nil {
+			r.Error = fmt.Sprintf("invalid timeout: %v", cmd.Timeout)
+			return r
+		}
+	}
+
+	uid, gid := -1, -1
+	if p.User != "" {
+		u, err := user.Lookup(p.User)
+		if err != nil {
+			r.Error = fmt.Sprintf("cannot find user: %v", p.User)
+			return r
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+
+	dir, err := ioutil.TempDir("", "command-runner-")
+	if err != nil {
+		r.Error = fmt.Sprintf("cannot create temporary directory: %v", err)
+		return r
+	}
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(script, []byte(cmd.Script), 0500); err != nil {
+		r.Error = fmt.Sprintf("cannot write script: %v", err)
+		return r
+	}
+	if uid >= 0 {
+		for _, path := range []string{dir, script} {
+			if err := os.Chown(path, uid, gid); err != nil {
+				r.Error = fmt.Sprintf("cannot change script owner: %v", err)
+				return r
+			}
+		}
+	}
+
+	output := limitedBuffer{max: p.MaxOutput}
+	c := exec.Command(cmd.Interpreter, append([]string{script}, cmd.Args...)...)
+	c.Dir = dir
+	c.Env = p.environ(cmd.Env)
+	c.Stdout = &output
+	c.Stderr = &output
+	c.SysProcAttr = sysProcAttr(uid, gid)
+
+	if err := c.Start(); err != nil {
+		r.Error = fmt.Sprintf("cannot start command: %v", err)
+		return r
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	timer := time.NewTimer(p.commandTimeout(requested))
+	defer timer.Stop()
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		if err := kill(c.Process); err != nil {
+			log.Errorf("cannot kill command: %v", err)
+		}
+		<-done
+		r.Output = string(output.buf)
+		r.Truncated = output.truncated
+		r.TimedOut = true
+		r.Error = "command timed out"
+		return r
+	}
+
+	r.Output = string(output.buf)
+	r.Truncated = output.truncated
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			r.ExitCode = exitErr.ExitCode()
+		}
+		r.Error = err.Error()
+		return r
+	}
+	r.ExitCode = 0
+	r.Success = true
+
+	return r
+}
+
+// auditLog records every command request as a line of JSON.
+type auditLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// auditEntry is a single record in the audit log.
+type auditEntry struct {
+	Time         time.Time `json:"time"`
+	MessageID    string    `json:"message_id"`
+	Interpreter  string    `json:"interpreter"`
+	ScriptSHA256 string    `json:"script_sha256"`
+	Args         []string  `json:"args,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Duration     string    `json:"duration"`
+	ExitCode     int       `json:"exit_code"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// openAuditLog opens file for appending audit entries, creating it and its
+// parent directory if necessary.
+func openAuditLog(file string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+// Record appends entry to the audit log.
+func (a *auditLog) Record(entry auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the audit log file.
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+// handle is the handler function of the "command-runner" worker. It
+// unmarshals the data into a command, runs it, records it in the audit log
+// and sends the result back to the dispatcher.
+func handle(w *worker.Worker, d *pb.Data, p *policy, a *auditLog) error {
+	log.Tracef("received data: %#v", d)
+
+	var cmd command
+	var r result
+	start := time.Now()
+	if err := json.Unmarshal(d.GetContent(), &cmd); err != nil {
+		r = result{ExitCode: -1, Error: fmt.Sprintf("cannot unmarshal command: %v", err)}
+	} else {
+		log.Infof("running script with %v for message %v", cmd.Interpreter, d.GetMessageId())
+		r = run(cmd, p)
+	}
+
+	sum := sha256.Sum256([]byte(cmd.Script))
+	if err := a.Record(auditEntry{
+		Time:         start.UTC(),
+		MessageID:    d.GetMessageId(),
+		Interpreter:  cmd.Interpreter,
+		ScriptSHA256: hex.EncodeToString(sum[:]),
+		Args:         cmd.Args,
+		User:         p.User,
+		Duration:     time.Since(start).String(),
+		ExitCode:     r.ExitCode,
+		Error:        r.Error,
+	}); err != nil {
+		log.Errorf("cannot write audit log: %v", err)
+	}
+
+	content, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("cannot marshal result: %w", err)
+	}
+
+	return w.Send(&pb.Data{
+		MessageId:  uuid.New().String(),
+		ResponseTo: d.GetMessageId(),
+		Metadata:   d.GetMetadata(),
+		Content:    content,
+		Directive:  d.GetDirective(),
+	})
+}
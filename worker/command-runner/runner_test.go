@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLimitedBuffer(t *testing.T) {
+	b := limitedBuffer{max: 5}
+	for _, s := range []string{"abc", "def", "ghi"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %v, %v", s, n, err)
+		}
+	}
+
+	if got := string(b.buf); got != "abcde" {
+		t.Errorf("%q != %q", got, "abcde")
+	}
+	if !b.truncated {
+		t.Errorf("expected output to be truncated")
+	}
+}
+
+func TestRun(t *testing.T) {
+	p := &policy{
+		AllowedInterpreters: []string{"/bin/sh"},
+		AllowedEnv:          []string{"GREETING"},
+		MaxOutput:           1024,
+		timeout:             5 * time.Second,
+	}
+
+	tests := []struct {
+		description string
+		input       command
+		want        result
+	}{
+		{
+			description: "environment scrubbed",
+			input: command{
+				Interpreter: "/bin/sh",
+				Script:      `echo "$GREETING ${SECRET:-none}"`,
+				Env:         map[string]string{"GREETING": "hello", "SECRET": "s3cr3t"},
+			},
+			want: result{Success: true, Output: "hello none\n"},
+		},
+		{
+			description: "exit code",
+			input:       command{Interpreter: "/bin/sh", Script: "exit 3"},
+			want:        result{ExitCode: 3, Error: "exit status 3"},
+		},
+		{
+			description: "interpreter not allowed",
+			input:       command{Interpreter: "/usr/bin/python3", Script: "print()"},
+			want:        result{ExitCode: -1, Error: "interpreter not allowed by policy: /usr/bin/python3"},
+		},
+		{
+			description: "timeout",
+			input:       command{Interpreter: "/bin/sh", Script: "sleep 5", Timeout: "100ms"},
+			want:        result{ExitCode: -1, TimedOut: true, Error: "command timed out"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := run(test.input, p)
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// sysProcAttr returns no attributes: commands run as the worker on Windows,
+// where a policy user is rejected when the script cannot be chowned to it.
+func sysProcAttr(uid, gid int) *syscall.SysProcAttr {
+	return nil
+}
+
+// kill kills p. The processes it started are left running.
+func kill(p *os.Process) error {
+	return p.Kill()
+}
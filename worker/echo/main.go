@@ -1,58 +1,24 @@
 package main
 
 import (
-	"context"
-	"net"
-	"os"
-	"time"
-
 	"git.sr.ht/~spc/go-log"
 
 	pb "github.com/redhatinsights/yggdrasil/protocol"
-	"google.golang.org/grpc"
+	"github.com/redhatinsights/yggdrasil/worker"
 )
 
-var yggdDispatchSocketAddr string
-
 func main() {
-	// Get initialization values from the environment.
-	var ok bool
-	yggdDispatchSocketAddr, ok = os.LookupEnv("YGG_SOCKET_ADDR")
-	if !ok {
-		log.Fatal("Missing YGG_SOCKET_ADDR environment variable")
-	}
-
-	// Dial the dispatcher on its well-known address.
-	conn, err := grpc.Dial(yggdDispatchSocketAddr, grpc.WithInsecure())
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-
-	// Create a dispatcher client
-	c := pb.NewDispatcherClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	// Register as a handler of the "echo" type.
-	r, err := c.Register(ctx, &pb.RegistrationRequest{Handler: "echo", Pid: int64(os.Getpid())})
-	if err != nil {
-		log.Fatal(err)
+	// Create a worker that handles the "echo" directive and start accepting
+	// data from the dispatcher.
+	w := worker.NewWorker("echo", nil, echo)
+	w.OnError = func(w *worker.Worker, d *pb.Data, err error) {
+		log.Error(err)
 	}
-	if !r.GetRegistered() {
-		log.Fatalf("handler registration failed: %v", err)
-	}
-
-	// Listen on the provided socket address.
-	l, err := net.Listen("unix", r.GetAddress())
-	if err != nil {
-		log.Fatal(err)
+	w.OnDisconnect = func(w *worker.Worker) {
+		log.Infof("received worker disconnect request")
 	}
 
-	// Register as a Worker service with gRPC and start accepting connections.
-	s := grpc.NewServer()
-	pb.RegisterWorkerServer(s, &echoServer{})
-	if err := s.Serve(l); err != nil {
+	if err := w.Connect(); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/pelletier/go-toml"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+// policy controls where and how files may be written.
+type policy struct {
+	// AllowedPaths is a list of directories or glob patterns a destination
+	// must be within or match.
+	AllowedPaths []string `toml:"allowed-paths"`
+
+	// Backup keeps a copy of a replaced file next to it, with a ".bak"
+	// suffix.
+	Backup bool `toml:"backup"`
+
+	// AllowSpecialBits permits the setuid, setgid and sticky bits in file
+	// modes. Without it, modes are masked to their permission bits.
+	AllowSpecialBits bool `toml:"allow-special-bits"`
+}
+
+// loadPolicy reads a policy from file. A missing file yields an empty policy
+// that rejects all destinations.
+func loadPolicy(file string) (*policy, error) {
+	p := policy{Backup: true}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &p, nil
+		}
+		return nil, err
+	}
+
+	if err := toml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("cannot parse policy: %w", err)
+	}
+
+	return &p, nil
+}
+
+// allowed reports whether the policy permits writing to path.
+func (p *policy) allowed(path string) bool {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return false
+	}
+	for _, pattern := range p.AllowedPaths {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+		dir := strings.TrimSuffix(pattern, "/")
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns path with the symbolic links of its existing ancestors
+// resolved, and checks the result against the policy. A destination that is
+// itself a symbolic link is rejected, so a link planted within an allowed
+// directory cannot redirect a write outside of it.
+func (p *policy) resolve(path string) (string, error) {
+	if !p.allowed(path) {
+		return "", fmt.Errorf("destination not allowed by policy: %v", path)
+	}
+
+	// Directories that do not exist yet are created by the worker and
+	// cannot be links, so only the deepest existing ancestor is resolved.
+	dir, rest := filepath.Dir(path), filepath.Base(path)
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = filepath.Dir(dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve destination: %w", err)
+	}
+	resolved = filepath.Join(resolved, rest)
+	if !p.allowed(resolved) {
+		return "", fmt.Errorf("destination not allowed by policy: %v resolves to %v", path, resolved)
+	}
+
+	if info, err := os.Lstat(resolved); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("destination is a symbolic link: %v", resolved)
+	}
+
+	return resolved, nil
+}
+
+// fileMode converts the octal mode m to an os.FileMode. The setuid, setgid
+// and sticky bits are dropped unless allowSpecial is set.
+func fileMode(m uint64, allowSpecial bool) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if !allowSpecial {
+		return mode
+	}
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// file is the content of a data message sent to the worker.
+type file struct {
+	Path     string `json:"path"`
+	Content  []byte `json:"content"`
+	Mode     string `json:"mode,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// result is the content of the data message sent back in response to a file.
+type result struct {
+	Path     string `json:"path"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Backup   string `json:"backup,omitempty"`
+}
+
+// install writes f to its destination according to p. The content is
+// verified against the checksum, written to a temporary file in the
+// destination directory and renamed over the destination, so readers never
+// observe a partially written file.
+func install(f file, p *policy) result {
+	r := result{Path: f.Path}
+
+	path, err := p.resolve(f.Path)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+
+	sum := sha256.Sum256(f.Content)
+	r.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+	if f.Checksum != "" && !strings.EqualFold(f.Checksum, r.Checksum) {
+		r.Error = fmt.Sprintf("checksum mismatch: expected %v, got %v", f.Checksum, r.Checksum)
+		return r
+	}
+
+	mode := os.FileMode(0644)
+	if f.Mode != "" {
+		m, err := strconv.ParseUint(f.Mode, 8, 32)
+		if err != nil || m > 07777 {
+			r.Error = fmt.Sprintf("invalid mode: %v", f.Mode)
+			return r
+		}
+		mode = fileMode(m, p.AllowSpecialBits)
+	}
+
+	uid, gid, err := lookupOwner(f.Owner, f.Group)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.Error = fmt.Sprintf("cannot create directory: %v", err)
+		return r
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		r.Error = fmt.Sprintf("cannot create temporary file: %v", err)
+		return r
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writeFile(tmp, f.Content, mode, uid, gid); err != nil {
+		r.Error = err.Error()
+		return r
+	}
+
+	if p.Backup {
+		backup := path + ".bak"
+		if !p.allowed(backup) {
+			r.Error = fmt.Sprintf("backup not allowed by policy: %v", backup)
+			return r
+		}
+		if err := copyFile(path, backup); err == nil {
+			r.Backup = backup
+		} else if !os.IsNotExist(err) {
+			r.Error = fmt.Sprintf("cannot back up file: %v", err)
+			return r
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		r.Error = fmt.Sprintf("cannot replace file: %v", err)
+		return r
+	}
+	r.Success = true
+
+	return r
+}
+
+// writeFile writes data to f, sets its mode and ownership, and closes it.
+func writeFile(f *os.File, data []byte, mode os.FileMode, uid, gid int) error {
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		return fmt.Errorf("cannot set mode: %w", err)
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := f.Chown(uid, gid); err != nil {
+			return fmt.Errorf("cannot set owner: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync file: %w", err)
+	}
+	return f.Close()
+}
+
+// copyFile copies src to dst, preserving its mode. Neither is followed if it
+// is a symbolic link, and dst is replaced by a new file rather than written
+// through.
+func copyFile(src, dst string) error {
+	in, err := os.OpenFile(src, os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|oNoFollow, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// lookupOwner resolves owner and group names (or numeric IDs) to a uid and
+// gid. An empty name resolves to -1, leaving the ID unchanged.
+func lookupOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			u, err = user.LookupId(owner)
+		}
+		if err != nil {
+			return -1, -1, fmt.Errorf("cannot find user: %v", owner)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return -1, -1, fmt.Errorf("cannot find group: %v", group)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return uid, gid, nil
+}
+
+// handle is the handler function of the "file-distribution" worker. It
+// unmarshals the data into a file, installs it and sends the result back to
+// the dispatcher.
+func handle(w *worker.Worker, d *pb.Data, p *policy) error {
+	log.Tracef("received data: %#v", d)
+
+	var f file
+	var r result
+	if err := json.Unmarshal(d.GetContent(), &f); err != nil {
+		r = result{Error: fmt.Sprintf("cannot unmarshal file: %v", err)}
+	} else {
+		r = install(f, p)
+	}
+	if r.Success {
+		log.Infof("installed file %v", r.Path)
+	} else {
+		log.Errorf("cannot install file %v: %v", r.Path, r.Error)
+	}
+
+	content, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("cannot marshal result: %w", err)
+	}
+
+	return w.Send(&pb.Data{
+		MessageId:  uuid.New().String(),
+		ResponseTo: d.GetMessageId(),
+		Metadata:   d.GetMetadata(),
+		Content:    content,
+		Directive:  d.GetDirective(),
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	p := policy{AllowedPaths: []string{"/etc/app/", "/etc/*.conf"}}
+
+	tests := []struct {
+		description string
+		input       string
+		want        bool
+	}{
+		{description: "in directory", input: "/etc/app/app.toml", want: true},
+		{description: "in subdirectory", input: "/etc/app/conf.d/a.toml", want: true},
+		{description: "glob", input: "/etc/foo.conf", want: true},
+		{description: "directory prefix", input: "/etc/application/a.toml", want: false},
+		{description: "traversal", input: "/etc/app/../shadow", want: false},
+		{description: "relative", input: "etc/app/a.toml", want: false},
+		{description: "outside", input: "/usr/bin/sh", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := p.allowed(test.input); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-distribution-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &policy{AllowedPaths: []string{dir}, Backup: true}
+
+	r := install(file{Path: path, Content: []byte("new"), Checksum: "sha256:0000"}, p)
+	if r.Success {
+		t.Fatalf("expected checksum mismatch, got %#v", r)
+	}
+
+	r = install(file{
+		Path:     path,
+		Content:  []byte("new"),
+		Mode:     "0640",
+		Checksum: "sha256:11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437",
+	}, p)
+	if !r.Success {
+		t.Fatalf("install failed: %v", r.Error)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("%q != %q", got, "new")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("%v != %v", info.Mode().Perm(), os.FileMode(0640))
+	}
+	backup, err := ioutil.ReadFile(r.Backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != "old" {
+		t.Errorf("%q != %q", backup, "old")
+	}
+}
+
+func TestInstallSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-distribution-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	allowed := filepath.Join(dir, "allowed")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{allowed, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target := filepath.Join(outside, "target")
+	if err := ioutil.WriteFile(target, []byte("target"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(allowed, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(allowed, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(allowed, "app.conf"), []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(allowed, "app.conf.bak")); err != nil {
+		t.Fatal(err)
+	}
+	p := &policy{AllowedPaths: []string{allowed}, Backup: true}
+
+	tests := []struct {
+		description string
+		input       string
+		wantSuccess bool
+	}{
+		{description: "linked directory", input: filepath.Join(allowed, "dir", "target")},
+		{description: "new file in linked directory", input: filepath.Join(allowed, "dir", "new", "file")},
+		{description: "linked file", input: filepath.Join(allowed, "link")},
+		{description: "linked backup", input: filepath.Join(allowed, "app.conf"), wantSuccess: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r := install(file{Path: test.input, Content: []byte("new")}, p)
+			if r.Success != test.wantSuccess {
+				t.Errorf("success %v != %v: %v", r.Success, test.wantSuccess, r.Error)
+			}
+			got, err := ioutil.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "target" {
+				t.Errorf("file outside of allowed paths overwritten with %q", got)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("directory created outside of allowed paths: %v", err)
+	}
+}
+
+func TestInstallMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-distribution-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		description  string
+		allowSpecial bool
+		want         os.FileMode
+	}{
+		{description: "masked", want: 0755},
+		{description: "allowed", allowSpecial: true, want: 0755 | os.ModeSetgid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path := filepath.Join(dir, test.description)
+			p := &policy{AllowedPaths: []string{dir}, AllowSpecialBits: test.allowSpecial}
+			if r := install(file{Path: path, Mode: "2755"}, p); !r.Success {
+				t.Fatalf("install failed: %v", r.Error)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
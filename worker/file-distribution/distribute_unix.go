@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// oNoFollow makes opening a file fail if it is a symbolic link.
+const oNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,4 @@
+package main
+
+// oNoFollow is not available on Windows, where symbolic links are followed.
+const oNoFollow = 0
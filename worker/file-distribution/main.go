@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+
+	"git.sr.ht/~spc/go-log"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+func main() {
+	policyPath := filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "file-distribution.toml")
+	p, err := loadPolicy(policyPath)
+	if err != nil {
+		log.Fatalf("cannot load policy: %v", err)
+	}
+	if len(p.AllowedPaths) == 0 {
+		log.Warnf("no allowed paths in %v; all files will be rejected", policyPath)
+	}
+
+	// Create a worker that handles the "file-distribution" directive. Files
+	// are written one at a time so that concurrent writes to the same
+	// destination cannot race.
+	w := worker.NewWorker("file-distribution", nil, func(w *worker.Worker, d *pb.Data) error {
+		return handle(w, d, p)
+	})
+	w.Ordered = true
+	w.OnError = func(w *worker.Worker, d *pb.Data, err error) {
+		log.Error(err)
+	}
+
+	if err := w.Connect(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"git.sr.ht/~spc/go-log"
+
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+func main() {
+	backend := detectBackend()
+	log.Infof("using package manager backend: %v", backend)
+
+	// Create a worker that handles the "package-manager" directive. Operations
+	// are handled one at a time, since package managers hold a lock on the
+	// package database while a transaction runs.
+	w := worker.NewWorker("package-manager", map[string]string{"backend": backend}, handle)
+	w.Ordered = true
+	w.OnError = func(w *worker.Worker, d *pb.Data, err error) {
+		log.Error(err)
+	}
+
+	if err := w.Connect(); err != nil {
+		log.Fatal(err)
+	}
+}
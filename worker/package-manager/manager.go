@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/redhatinsights/yggdrasil/worker"
+)
+
+const (
+	backendDNF       = "dnf"
+	backendRPMOSTree = "rpm-ostree"
+)
+
+// request is the content of a data message sent to the worker.
+type request struct {
+	Operation string   `json:"operation"`
+	Packages  []string `json:"packages,omitempty"`
+}
+
+// result is the content of the data message sent back in response to a
+// request.
+type result struct {
+	Operation   string `json:"operation"`
+	Backend     string `json:"backend"`
+	Success     bool   `json:"success"`
+	ExitCode    int    `json:"exit_code"`
+	Output      string `json:"output"`
+	Error       string `json:"error,omitempty"`
+	Transaction string `json:"transaction,omitempty"`
+}
+
+// detectBackend returns rpm-ostree on image-based systems and dnf otherwise.
+func detectBackend() string {
+	if _, err := os.Stat("/run/ostree-booted"); err == nil {
+		return backendRPMOSTree
+	}
+	return backendDNF
+}
+
+// commandArgs returns the command line that performs req with backend.
+func commandArgs(backend string, req request) ([]string, error) {
+	switch req.Operation {
+	case "install", "remove":
+		if len(req.Packages) == 0 {
+			return nil, fmt.Errorf("operation %v requires at least one package", req.Operation)
+		}
+	case "update", "rollback":
+	default:
+		return nil, fmt.Errorf("unsupported operation: %v", req.Operation)
+	}
+
+	switch backend {
+	case backendDNF:
+		switch req.Operation {
+		case "install":
+			return append([]string{"dnf", "--assumeyes", "install"}, req.Packages...), nil
+		case "update":
+			return append([]string{"dnf", "--assumeyes", "upgrade"}, req.Packages...), nil
+		case "remove":
+			return append([]string{"dnf", "--assumeyes", "remove"}, req.Packages...), nil
+		case "rollback":
+			return []string{"dnf", "--assumeyes", "history", "undo", "last"}, nil
+		}
+	case backendRPMOSTree:
+		switch req.Operation {
+		case "install":
+			return append([]string{"rpm-ostree", "install"}, req.Packages...), nil
+		case "update":
+			if len(req.Packages) > 0 {
+				return nil, fmt.Errorf("%v cannot update individual packages", backend)
+			}
+			return []string{"rpm-ostree", "upgrade"}, nil
+		case "remove":
+			return append([]string{"rpm-ostree", "uninstall"}, req.Packages...), nil
+		case "rollback":
+			return []string{"rpm-ostree", "rollback"}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported backend: %v", backend)
+}
+
+var dnfTransactionID = regexp.MustCompile(`(?m)^Transaction ID\s*:\s*(\d+)`)
+
+// transaction returns an identifier of the most recent transaction made by
+// backend: the history ID for dnf and the checksum of the default deployment
+// for rpm-ostree.
+func transaction(backend string) (string, error) {
+	switch backend {
+	case backendDNF:
+		output, err := exec.Command("dnf", "history", "info", "last").Output()
+		if err != nil {
+			return "", err
+		}
+		m := dnfTransactionID.FindSubmatch(output)
+		if m == nil {
+			return "", fmt.Errorf("cannot find transaction ID")
+		}
+		return string(m[1]), nil
+	case backendRPMOSTree:
+		output, err := exec.Command("rpm-ostree", "status", "--json").Output()
+		if err != nil {
+			return "", err
+		}
+		var status struct {
+			Deployments []struct {
+				Checksum string `json:"checksum"`
+			} `json:"deployments"`
+		}
+		if err := json.Unmarshal(output, &status); err != nil {
+			return "", err
+		}
+		if len(status.Deployments) == 0 {
+			return "", fmt.Errorf("no deployments found")
+		}
+		return status.Deployments[0].Checksum, nil
+	}
+	return "", fmt.Errorf("unsupported backend: %v", backend)
+}
+
+// run performs req and reports the outcome.
+func run(backend string, req request) result {
+	r := result{
+		Operation: req.Operation,
+		Backend:   backend,
+	}
+
+	args, err := commandArgs(backend, req)
+	if err != nil {
+		r.ExitCode = -1
+		r.Error = err.Error()
+		return r
+	}
+
+	log.Infof("running %v", strings.Join(args, " "))
+	var output bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err = cmd.Run()
+	r.Output = output.String()
+	if err != nil {
+		r.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			r.ExitCode = exitErr.ExitCode()
+		}
+		r.Error = err.Error()
+		return r
+	}
+	r.Success = true
+
+	r.Transaction, err = transaction(backend)
+	if err != nil {
+		log.Warnf("cannot determine transaction: %v", err)
+	}
+
+	return r
+}
+
+// handle is the handler function of the "package-manager" worker. It
+// unmarshals the data into a request, performs it and sends the result back
+// to the dispatcher.
+func handle(w *worker.Worker, d *pb.Data) error {
+	log.Tracef("received data: %#v", d)
+
+	var req request
+	var r result
+	if err := json.Unmarshal(d.GetContent(), &req); err != nil {
+		r = result{ExitCode: -1, Error: fmt.Sprintf("cannot unmarshal request: %v", err)}
+	} else {
+		r = run(w.Features["backend"], req)
+	}
+
+	content, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("cannot marshal result: %w", err)
+	}
+
+	return w.Send(&pb.Data{
+		MessageId:  uuid.New().String(),
+		ResponseTo: d.GetMessageId(),
+		Metadata:   d.GetMetadata(),
+		Content:    content,
+		Directive:  d.GetDirective(),
+	})
+}
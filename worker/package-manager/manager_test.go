@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		description string
+		backend     string
+		input       request
+		want        []string
+		wantError   bool
+	}{
+		{
+			description: "dnf install",
+			backend:     backendDNF,
+			input:       request{Operation: "install", Packages: []string{"vim", "tmux"}},
+			want:        []string{"dnf", "--assumeyes", "install", "vim", "tmux"},
+		},
+		{
+			description: "rpm-ostree rollback",
+			backend:     backendRPMOSTree,
+			input:       request{Operation: "rollback"},
+			want:        []string{"rpm-ostree", "rollback"},
+		},
+		{
+			description: "rpm-ostree update packages",
+			backend:     backendRPMOSTree,
+			input:       request{Operation: "update", Packages: []string{"vim"}},
+			wantError:   true,
+		},
+		{
+			description: "install without packages",
+			backend:     backendDNF,
+			input:       request{Operation: "install"},
+			wantError:   true,
+		},
+		{
+			description: "unsupported operation",
+			backend:     backendDNF,
+			input:       request{Operation: "downgrade"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := commandArgs(test.backend, test.input)
+
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%#v != %#v", got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,550 @@
+// Package worker provides the gRPC plumbing needed to implement a yggdrasil
+// worker in Go. A worker is created with NewWorker, passing the directive it
+// handles, a set of features to announce and a HandlerFunc to call when data
+// is received. Handlers that should stop when the deadline of a message
+// passes set ContextHandler instead. Calling Connect registers the worker with
+// the dispatcher and serves the Worker service until an error occurs.
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/ipc"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"google.golang.org/grpc"
+)
+
+// SocketAddrEnv is the name of the environment variable yggd sets to the
+// address of its dispatcher socket when starting a worker.
+const SocketAddrEnv = "YGG_SOCKET_ADDR"
+
+// HandlerFunc is called for each data message the dispatcher sends to the
+// worker. Unless the worker is ordered or coalescing, it is called on its own
+// goroutine, so long running work does not block the dispatcher.
+type HandlerFunc func(w *Worker, data *pb.Data) error
+
+// ContextHandlerFunc is a HandlerFunc that is also passed a context, done
+// once the deadline set in the "deadline" metadata key of data passes, or
+// once the dispatcher cancels the message. Handlers should abandon their work
+// when ctx is done, since its result would arrive too late to be of use.
+type ContextHandlerFunc func(ctx context.Context, w *Worker, data *pb.Data) error
+
+// ErrorFunc is called when a HandlerFunc or ContextHandlerFunc returns an
+// error.
+type ErrorFunc func(w *Worker, data *pb.Data, err error)
+
+// A Worker registers itself with the yggdrasil dispatcher as the handler of a
+// single directive and receives data destined for that directive.
+type Worker struct {
+	// Directive is the name of the directive the worker handles.
+	Directive string
+
+	// Version is the version of the worker, reported to the server in
+	// connection-status messages.
+	Version string
+
+	// Features is a set of key-value pairs announced to the dispatcher during
+	// registration.
+	Features map[string]string
+
+	// DetachedContent indicates the worker expects the dispatcher to fetch
+	// message content from the URL found in the message payload.
+	DetachedContent bool
+
+	// LocalContent indicates the worker receives the payload of content
+	// references as the path of a downloaded file, set in the
+	// "content-path" metadata key, rather than as the message content. The
+	// worker is responsible for removing the file.
+	LocalContent bool
+
+	// Ordered indicates the worker requires strict in-order delivery. The
+	// dispatcher sends an ordered worker one message at a time, and Handler
+	// is called synchronously so the next message is not accepted until the
+	// current one has been handled.
+	Ordered bool
+
+	// Coalesce indicates that messages queued while the worker is busy may be
+	// collapsed into the most recent one. Like an ordered worker, Handler is
+	// called synchronously, so the worker is busy until Handler returns.
+	Coalesce bool
+
+	// Topics is a list of additional transport topics the worker receives
+	// messages from. Messages are delivered to Handler with the topic they
+	// were received on set in the "topic" metadata key.
+	Topics []string
+
+	// Attach indicates the worker is a local product, not started by the
+	// dispatcher, sharing its connection. It attaches to the namespace named
+	// by Directive and handles every directive in the form
+	// "NAMESPACE/NAME". The dispatcher must allow the namespace with
+	// --facade. Only Features and Version are announced.
+	Attach bool
+
+	// Handler is called for each data message received, unless
+	// ContextHandler is set.
+	Handler HandlerFunc
+
+	// ContextHandler, if set, is called for each data message received
+	// instead of Handler, with a context carrying the deadline of the
+	// message.
+	ContextHandler ContextHandlerFunc
+
+	// OnError, if set, is called when the handler returns an error.
+	OnError ErrorFunc
+
+	// OnDisconnect, if set, is called when the dispatcher asks the worker to
+	// disconnect.
+	OnDisconnect func(w *Worker)
+
+	// OnLogLevel, if set, is called when the dispatcher asks the worker to
+	// change its log level. If unset, the level of the go-log standard logger
+	// is changed.
+	OnLogLevel func(w *Worker, level string) error
+
+	// OnCancel, if set, is called when the dispatcher asks the worker to abort
+	// the processing of the message with the given ID. Workers without it or
+	// a ContextHandler cannot be cancelled.
+	OnCancel func(w *Worker, messageID string) error
+
+	// OnConfig, if set, is called with the configuration the server pushed
+	// for the worker's directive, a JSON object: once when the worker
+	// connects, if a configuration was persisted, and again whenever the
+	// server pushes a new one. Returning an error rejects the new
+	// configuration. Workers without it cannot be configured.
+	OnConfig func(w *Worker, config []byte) error
+
+	lock       sync.Mutex
+	conn       *grpc.ClientConn
+	dispatcher pb.DispatcherClient
+	listener   net.Listener
+	server     *grpc.Server
+
+	// cancels holds the functions cancelling the context of each message
+	// being handled by ContextHandler, by message ID.
+	cancels map[string]context.CancelFunc
+}
+
+// NewWorker creates a Worker that handles messages for directive, announcing
+// features to the dispatcher and calling handler for each received message.
+func NewWorker(directive string, features map[string]string, handler HandlerFunc) *Worker {
+	return &Worker{
+		Directive: directive,
+		Features:  features,
+		Handler:   handler,
+	}
+}
+
+// Connect reads the dispatcher address from the environment, registers the
+// worker and serves the Worker gRPC service on the address assigned by the
+// dispatcher. It blocks until the server stops. The connection to the
+// dispatcher is kept open, and used by Send, SetFeatures, Facts and Tags,
+// until Stop is called.
+func (w *Worker) Connect() error {
+	addr, ok := os.LookupEnv(SocketAddrEnv)
+	if !ok {
+		return fmt.Errorf("missing %v environment variable", SocketAddrEnv)
+	}
+
+	conn, err := ipc.Dial(addr)
+	if err != nil {
+		return fmt.Errorf("cannot dial dispatcher: %w", err)
+	}
+	w.lock.Lock()
+	w.conn = conn
+	w.dispatcher = pb.NewDispatcherClient(conn)
+	w.lock.Unlock()
+
+	l, err := w.register()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	server := grpc.NewServer()
+	pb.RegisterWorkerServer(server, &workerServer{w: w})
+	w.lock.Lock()
+	w.listener = l
+	w.server = server
+	w.lock.Unlock()
+
+	return server.Serve(l)
+}
+
+// register registers or attaches the worker with the dispatcher, applies its
+// persisted configuration and listens on the address the dispatcher
+// assigned.
+func (w *Worker) register() (net.Listener, error) {
+	c, err := w.client()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var r *pb.RegistrationResponse
+	if w.Attach {
+		r, err = c.Attach(ctx, &pb.AttachRequest{
+			Namespace: w.Directive,
+			Pid:       int64(os.Getpid()),
+			Features:  w.Features,
+			Version:   w.Version,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot attach: %w", err)
+		}
+		if !r.GetRegistered() {
+			return nil, fmt.Errorf("cannot attach to namespace %v", w.Directive)
+		}
+	} else {
+		r, err = c.Register(ctx, &pb.RegistrationRequest{
+			Handler:         w.Directive,
+			Pid:             int64(os.Getpid()),
+			DetachedContent: w.DetachedContent,
+			Features:        w.Features,
+			Ordered:         w.Ordered,
+			Topics:          w.Topics,
+			Version:         w.Version,
+			Coalesce:        w.Coalesce,
+			LocalContent:    w.LocalContent,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot register worker: %w", err)
+		}
+		if !r.GetRegistered() {
+			return nil, fmt.Errorf("handler registration failed for directive %v", w.Directive)
+		}
+	}
+
+	if w.OnConfig != nil {
+		config, err := ioutil.ReadFile(yggdrasil.WorkerConfigPath(w.Directive))
+		if err == nil {
+			if err := w.OnConfig(w, config); err != nil {
+				return nil, fmt.Errorf("cannot apply configuration: %w", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read configuration: %w", err)
+		}
+	}
+
+	l, err := ipc.Listen(r.GetAddress())
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on socket: %w", err)
+	}
+	return l, nil
+}
+
+// Stop stops the worker gRPC server, closing its listener, and closes the
+// connection to the dispatcher.
+func (w *Worker) Stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.server != nil {
+		w.server.Stop()
+	}
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+// client returns the client of the dispatcher connected to by Connect.
+func (w *Worker) client() (pb.DispatcherClient, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.dispatcher == nil {
+		return nil, fmt.Errorf("worker is not connected")
+	}
+	return w.dispatcher, nil
+}
+
+// Send sends data to the dispatcher. If data does not include a directive,
+// the worker's directive is used.
+func (w *Worker) Send(data *pb.Data) error {
+	if data.GetDirective() == "" {
+		data.Directive = w.Directive
+	}
+
+	c, err := w.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.Send(ctx, data); err != nil {
+		return fmt.Errorf("cannot send data: %w", err)
+	}
+	return nil
+}
+
+// SetFeatures replaces the features the worker announced to the dispatcher,
+// which publishes them to the server.
+func (w *Worker) SetFeatures(features map[string]string) error {
+	c, err := w.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.UpdateFeatures(ctx, &pb.UpdateFeaturesRequest{
+		Handler:  w.Directive,
+		Pid:      int64(os.Getpid()),
+		Features: features,
+	}); err != nil {
+		return fmt.Errorf("cannot update features: %w", err)
+	}
+	w.Features = features
+	return nil
+}
+
+// Facts returns the canonical facts and the additional facts the dispatcher
+// publishes, so that reports identify the host with the same values.
+func (w *Worker) Facts() (*yggdrasil.CanonicalFacts, map[string]interface{}, error) {
+	c, err := w.client()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := c.GetFacts(ctx, &pb.Empty{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get facts: %w", err)
+	}
+	var canonicalFacts yggdrasil.CanonicalFacts
+	if err := json.Unmarshal(r.GetCanonicalFacts(), &canonicalFacts); err != nil {
+		return nil, nil, fmt.Errorf("cannot unmarshal canonical facts: %w", err)
+	}
+	var facts map[string]interface{}
+	if err := json.Unmarshal(r.GetFacts(), &facts); err != nil {
+		return nil, nil, fmt.Errorf("cannot unmarshal facts: %w", err)
+	}
+	return &canonicalFacts, facts, nil
+}
+
+// Tags returns the tags the dispatcher publishes.
+func (w *Worker) Tags() (map[string]string, error) {
+	c, err := w.client()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r, err := c.GetTags(ctx, &pb.Empty{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get tags: %w", err)
+	}
+	return r.GetTags(), nil
+}
+
+// SetTags replaces the tags the worker derived, which the dispatcher publishes
+// along with the locally configured and server-assigned tags. Locally
+// configured and server-assigned tags take precedence over them.
+func (w *Worker) SetTags(tags map[string]string) error {
+	c, err := w.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.SetTags(ctx, &pb.SetTagsRequest{
+		Handler: w.Directive,
+		Pid:     int64(os.Getpid()),
+		Tags:    tags,
+	}); err != nil {
+		return fmt.Errorf("cannot set tags: %w", err)
+	}
+	return nil
+}
+
+// Secret returns the value of the secret name, which the worker manifest
+// must allow, and the time after which it must be requested again.
+func (w *Worker) Secret(name string) ([]byte, time.Time, error) {
+	return w.credential(&pb.CredentialRequest{Name: name})
+}
+
+// IdentityToken returns a token for audience signed with the identity of the
+// device, which the worker manifest must allow, and its expiry.
+func (w *Worker) IdentityToken(audience string) (string, time.Time, error) {
+	token, expires, err := w.credential(&pb.CredentialRequest{Audience: audience})
+	return string(token), expires, err
+}
+
+func (w *Worker) credential(r *pb.CredentialRequest) ([]byte, time.Time, error) {
+	c, err := w.client()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r.Handler = w.Directive
+	r.Pid = int64(os.Getpid())
+	resp, err := c.GetCredential(ctx, r)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot get credential: %w", err)
+	}
+	return resp.GetValue(), time.Unix(resp.GetExpires(), 0), nil
+}
+
+// Env returns the variables the server set for the worker's directive, as
+// passed in the metadata of data.
+func Env(data *pb.Data) map[string]string {
+	env := make(map[string]string)
+	for k, v := range data.GetMetadata() {
+		if strings.HasPrefix(k, yggdrasil.MetadataKeyEnvPrefix) {
+			env[strings.TrimPrefix(k, yggdrasil.MetadataKeyEnvPrefix)] = v
+		}
+	}
+	return env
+}
+
+// workerServer implements the Worker gRPC service on behalf of a Worker.
+type workerServer struct {
+	pb.UnimplementedWorkerServer
+	w *Worker
+}
+
+// Send implements the "Send" method of the Worker gRPC service. The worker's
+// handler is called on a new goroutine and a receipt is returned immediately,
+// unless the worker is ordered or coalescing, in which case the receipt is
+// returned once the handler is done.
+func (s *workerServer) Send(ctx context.Context, d *pb.Data) (*pb.Receipt, error) {
+	if s.w.Ordered || s.w.Coalesce {
+		s.handle(d)
+	} else {
+		go s.handle(d)
+	}
+
+	return &pb.Receipt{}, nil
+}
+
+// handle calls the worker's handler, reporting any error to its error
+// function.
+func (s *workerServer) handle(d *pb.Data) {
+	var err error
+	switch {
+	case s.w.ContextHandler != nil:
+		ctx, cancel := s.w.messageContext(d)
+		defer cancel()
+		err = s.w.ContextHandler(ctx, s.w, d)
+	case s.w.Handler != nil:
+		err = s.w.Handler(s.w, d)
+	}
+	if err != nil && s.w.OnError != nil {
+		s.w.OnError(s.w, d, err)
+	}
+}
+
+// messageContext returns a context that is done when the deadline of d, if
+// any, passes, or when the message is cancelled with cancelMessage. The
+// returned function must be called once the message is handled.
+func (w *Worker) messageContext(d *pb.Data) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if value, prs := d.GetMetadata()[yggdrasil.MetadataKeyDeadline]; prs {
+		deadline, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Warnf("ignoring invalid deadline of message %v: %v", d.GetMessageId(), err)
+		} else {
+			cancel()
+			ctx, cancel = context.WithDeadline(context.Background(), deadline)
+		}
+	}
+
+	id := d.GetMessageId()
+	w.lock.Lock()
+	if w.cancels == nil {
+		w.cancels = make(map[string]context.CancelFunc)
+	}
+	w.cancels[id] = cancel
+	w.lock.Unlock()
+
+	return ctx, func() {
+		w.lock.Lock()
+		delete(w.cancels, id)
+		w.lock.Unlock()
+		cancel()
+	}
+}
+
+// cancelMessage cancels the context of the message with the given ID,
+// reporting whether the message was being handled.
+func (w *Worker) cancelMessage(id string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	cancel, prs := w.cancels[id]
+	if prs {
+		cancel()
+	}
+	return prs
+}
+
+// Disconnect implements the "Disconnect" method of the Worker gRPC service.
+func (s *workerServer) Disconnect(ctx context.Context, in *pb.Empty) (*pb.DisconnectResponse, error) {
+	if s.w.OnDisconnect != nil {
+		s.w.OnDisconnect(s.w)
+	}
+
+	return &pb.DisconnectResponse{}, nil
+}
+
+// SetLogLevel implements the "SetLogLevel" method of the Worker gRPC service.
+func (s *workerServer) SetLogLevel(ctx context.Context, r *pb.LogLevelRequest) (*pb.Empty, error) {
+	if s.w.OnLogLevel != nil {
+		if err := s.w.OnLogLevel(s.w, r.GetLevel()); err != nil {
+			return nil, err
+		}
+		return &pb.Empty{}, nil
+	}
+
+	level, err := log.ParseLevel(r.GetLevel())
+	if err != nil {
+		return nil, err
+	}
+	log.SetLevel(level)
+
+	return &pb.Empty{}, nil
+}
+
+// Cancel implements the "Cancel" method of the Worker gRPC service. The
+// context passed to ContextHandler for the message is cancelled, then
+// OnCancel is called, if set.
+func (s *workerServer) Cancel(ctx context.Context, r *pb.CancelRequest) (*pb.Empty, error) {
+	if s.w.OnCancel == nil && s.w.ContextHandler == nil {
+		return nil, fmt.Errorf("worker %v does not support cancellation", s.w.Directive)
+	}
+	cancelled := s.w.cancelMessage(r.GetMessageId())
+	if s.w.OnCancel != nil {
+		if err := s.w.OnCancel(s.w, r.GetMessageId()); err != nil {
+			return nil, err
+		}
+	} else if !cancelled {
+		return nil, fmt.Errorf("message %v is not being handled", r.GetMessageId())
+	}
+
+	return &pb.Empty{}, nil
+}
+
+// Configure implements the "Configure" method of the Worker gRPC service.
+func (s *workerServer) Configure(ctx context.Context, r *pb.ConfigureRequest) (*pb.Empty, error) {
+	if s.w.OnConfig == nil {
+		return nil, fmt.Errorf("worker %v does not support configuration", s.w.Directive)
+	}
+	if err := s.w.OnConfig(s.w, r.GetConfig()); err != nil {
+		return nil, err
+	}
+
+	return &pb.Empty{}, nil
+}
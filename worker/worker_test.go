@@ -0,0 +1,236 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"google.golang.org/grpc"
+)
+
+// fakeDispatcher registers workers at workerAddr and records the data they
+// send.
+type fakeDispatcher struct {
+	pb.UnimplementedDispatcherServer
+	workerAddr string
+
+	lock       sync.Mutex
+	registered *pb.RegistrationRequest
+	sent       []*pb.Data
+}
+
+func (d *fakeDispatcher) Register(ctx context.Context, r *pb.RegistrationRequest) (*pb.RegistrationResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.registered = r
+	return &pb.RegistrationResponse{Registered: true, Address: d.workerAddr}, nil
+}
+
+func (d *fakeDispatcher) Send(ctx context.Context, r *pb.Data) (*pb.Receipt, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.sent = append(d.sent, r)
+	return &pb.Receipt{}, nil
+}
+
+// startWorker serves a fakeDispatcher, connects w to it and returns a client
+// of the worker's gRPC service.
+func startWorker(t *testing.T, w *Worker) (*fakeDispatcher, pb.WorkerClient) {
+	dir, err := ioutil.TempDir("", "worker-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	d := &fakeDispatcher{workerAddr: filepath.Join(dir, "worker.sock")}
+	l, err := net.Listen("unix", filepath.Join(dir, "dispatcher.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterDispatcherServer(s, d)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	os.Setenv(SocketAddrEnv, "unix:"+l.Addr().String())
+	defer os.Unsetenv(SocketAddrEnv)
+
+	errs := make(chan error, 1)
+	go func() { errs <- w.Connect() }()
+	t.Cleanup(w.Stop)
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		select {
+		case err := <-errs:
+			t.Fatalf("cannot connect: %v", err)
+		default:
+		}
+		if _, err := os.Stat(d.workerAddr); err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("worker did not start serving")
+		}
+	}
+
+	conn, err := grpc.Dial("unix:"+d.workerAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return d, pb.NewWorkerClient(conn)
+}
+
+func TestWorkerConnect(t *testing.T) {
+	w := NewWorker("test", map[string]string{"version": "1"}, nil)
+	w.Ordered = true
+	d, _ := startWorker(t, w)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.registered.GetHandler() != "test" {
+		t.Errorf("registered handler %q != %q", d.registered.GetHandler(), "test")
+	}
+	if !d.registered.GetOrdered() {
+		t.Error("worker not registered as ordered")
+	}
+	if d.registered.GetFeatures()["version"] != "1" {
+		t.Errorf("features not announced: %v", d.registered.GetFeatures())
+	}
+}
+
+func TestWorkerSend(t *testing.T) {
+	w := NewWorker("test", nil, nil)
+	d, _ := startWorker(t, w)
+
+	for i := 0; i < 3; i++ {
+		if err := w.Send(&pb.Data{MessageId: "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.sent) != 3 {
+		t.Fatalf("%v messages sent, want 3", len(d.sent))
+	}
+	if d.sent[0].GetDirective() != "test" {
+		t.Errorf("directive %q != %q", d.sent[0].GetDirective(), "test")
+	}
+}
+
+func TestWorkerSendNotConnected(t *testing.T) {
+	w := NewWorker("test", nil, nil)
+	if err := w.Send(&pb.Data{}); err == nil {
+		t.Error("expected an error sending from a worker that is not connected")
+	}
+}
+
+func TestWorkerOrdered(t *testing.T) {
+	handled := make(chan string, 2)
+	w := NewWorker("test", nil, func(w *Worker, data *pb.Data) error {
+		time.Sleep(50 * time.Millisecond)
+		handled <- data.GetMessageId()
+		return nil
+	})
+	w.Ordered = true
+	_, c := startWorker(t, w)
+
+	for _, id := range []string{"1", "2"} {
+		if _, err := c.Send(context.Background(), &pb.Data{MessageId: id}); err != nil {
+			t.Fatal(err)
+		}
+		// An ordered worker returns the receipt once the handler is done.
+		select {
+		case got := <-handled:
+			if got != id {
+				t.Errorf("handled %v, want %v", got, id)
+			}
+		default:
+			t.Fatalf("receipt for %v returned before it was handled", id)
+		}
+	}
+}
+
+func TestWorkerOnError(t *testing.T) {
+	errs := make(chan error, 1)
+	w := NewWorker("test", nil, func(w *Worker, data *pb.Data) error {
+		return errors.New("failed")
+	})
+	w.OnError = func(w *Worker, data *pb.Data, err error) {
+		errs <- err
+	}
+	_, c := startWorker(t, w)
+
+	if _, err := c.Send(context.Background(), &pb.Data{MessageId: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err.Error() != "failed" {
+			t.Errorf("error %q != %q", err, "failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnError not called")
+	}
+}
+
+func TestWorkerContextHandler(t *testing.T) {
+	tests := []struct {
+		description string
+		metadata    map[string]string
+		cancel      bool
+		wantErr     error
+	}{
+		{
+			description: "deadline",
+			metadata:    map[string]string{yggdrasil.MetadataKeyDeadline: time.Now().Add(time.Second).Format(time.RFC3339)},
+			wantErr:     context.DeadlineExceeded,
+		},
+		{
+			description: "cancelled",
+			cancel:      true,
+			wantErr:     context.Canceled,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			started := make(chan struct{})
+			done := make(chan error, 1)
+			w := NewWorker("test", nil, nil)
+			w.ContextHandler = func(ctx context.Context, w *Worker, data *pb.Data) error {
+				close(started)
+				select {
+				case <-ctx.Done():
+					done <- ctx.Err()
+				case <-time.After(5 * time.Second):
+					done <- errors.New("context not done")
+				}
+				return nil
+			}
+			_, c := startWorker(t, w)
+
+			if _, err := c.Send(context.Background(), &pb.Data{MessageId: "1", Metadata: test.metadata}); err != nil {
+				t.Fatal(err)
+			}
+			<-started
+			if test.cancel {
+				if _, err := c.Cancel(context.Background(), &pb.CancelRequest{MessageId: "1"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := <-done; err != test.wantErr {
+				t.Errorf("context error %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}